@@ -0,0 +1,197 @@
+package main
+
+import (
+	"SE/internal/auth"
+	"SE/internal/cache"
+	"SE/internal/fileprocessor"
+	"SE/internal/oauth"
+	"SE/internal/store"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// Check result statuses
+const (
+	checkOK   = "ok"
+	checkWarn = "warn"
+	checkFail = "fail"
+)
+
+type checkResult struct {
+	Name   string `json:"name"`
+	Status string `json:"status"`
+	Detail string `json:"detail,omitempty"`
+}
+
+type checkReport struct {
+	OK        bool          `json:"ok"`
+	CheckedAt time.Time     `json:"checked_at"`
+	Checks    []checkResult `json:"checks"`
+}
+
+// runSelfCheck validates configuration and dependencies, prints a JSON report and
+// returns the process exit code (non-zero when any check failed)
+func runSelfCheck(required []string) int {
+	report := checkReport{OK: true, CheckedAt: time.Now().UTC()}
+	add := func(name, status, detail string) {
+		report.Checks = append(report.Checks, checkResult{Name: name, Status: status, Detail: detail})
+		if status == checkFail {
+			report.OK = false
+		}
+	}
+
+	// Required env vars
+	var missing []string
+	for _, k := range required {
+		if os.Getenv(k) == "" {
+			missing = append(missing, k)
+		}
+	}
+	if len(missing) > 0 {
+		add("config", checkFail, "missing env: "+strings.Join(missing, ", "))
+	} else {
+		add("config", checkOK, "")
+	}
+
+	// JWT signing keys
+	if err := auth.InitJWTKeys(); err != nil {
+		add("jwt_keys", checkFail, err.Error())
+	} else {
+		add("jwt_keys", checkOK, auth.SigningKeyInfo())
+	}
+
+	// Who may sign up
+	if err := auth.InitRegistrationMode(); err != nil {
+		add("registration_mode", checkFail, err.Error())
+	} else {
+		add("registration_mode", checkOK, auth.RegistrationMode())
+	}
+
+	// Password policy
+	if err := auth.InitPasswordPolicy(); err != nil {
+		add("password_policy", checkFail, err.Error())
+	} else {
+		add("password_policy", checkOK, "")
+	}
+
+	// Token encryption key
+	if _, err := oauth.DecodeTokenEncKey(os.Getenv("TOKEN_ENC_KEY")); err != nil {
+		add("token_enc_key", checkFail, err.Error())
+	} else {
+		add("token_enc_key", checkOK, "")
+	}
+
+	// The in-memory store runs without Mongo or a Google OAuth client, SQLite without Mongo
+	switch os.Getenv("STORE_DRIVER") {
+	case "memory":
+		add("store", checkOK, "in-memory store, Mongo and OAuth checks skipped")
+	case "sqlite":
+		checkOAuthClient(add)
+		checkSQLite(add)
+	default:
+		checkOAuthClient(add)
+		checkMongo(add)
+	}
+
+	// Temp dir: writable and roomy enough for the original, obfuscated copy and chunks of a max-size file
+	fileprocessor.InitFileConfig()
+	dir, free, err := fileprocessor.CheckTempDir()
+	switch {
+	case err != nil:
+		add("temp_dir", checkFail, fmt.Sprintf("%s: %v", dir, err))
+	case free < 0:
+		add("temp_dir", checkWarn, dir+": free space unknown on this platform")
+	case free < 3*fileprocessor.GetMaxFileSize():
+		add("temp_dir", checkWarn, fmt.Sprintf("%s: %d bytes free, a max-size upload needs about %d", dir, free, 3*fileprocessor.GetMaxFileSize()))
+	default:
+		add("temp_dir", checkOK, fmt.Sprintf("%s: %d bytes free", dir, free))
+	}
+
+	// Malware scanner: clamd must answer when scanning is on, or every upload fails
+	switch err := fileprocessor.InitScanner(); {
+	case err != nil:
+		add("malware_scanner", checkFail, err.Error())
+	case !fileprocessor.ScanningEnabled():
+		add("malware_scanner", checkOK, "scanning off, CLAMAV_ADDR not set")
+	default:
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		if err := fileprocessor.PingScanner(ctx); err != nil {
+			add("malware_scanner", checkFail, err.Error())
+		} else {
+			add("malware_scanner", checkOK, os.Getenv("CLAMAV_ADDR"))
+		}
+		cancel()
+	}
+
+	// Redis cache: optional, lookups fall back to the store while it's down
+	switch err := cache.InitCache(); {
+	case err != nil:
+		add("cache", checkFail, err.Error())
+	case !cache.Enabled():
+		add("cache", checkOK, "caching off, REDIS_URL not set")
+	default:
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		if err := cache.Ping(ctx); err != nil {
+			add("cache", checkWarn, err.Error())
+		} else {
+			add("cache", checkOK, "redis")
+		}
+		cancel()
+		cache.Close()
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	enc.Encode(report)
+
+	if !report.OK {
+		return 1
+	}
+	return 0
+}
+
+// checkOAuthClient checks the Google OAuth client configuration
+func checkOAuthClient(add func(name, status, detail string)) {
+	if err := oauth.ValidateClientConfig(); err != nil {
+		add("oauth_client", checkFail, err.Error())
+	} else {
+		add("oauth_client", checkOK, "")
+	}
+}
+
+// checkSQLite checks that the SQLite database can be opened and has its tables
+func checkSQLite(add func(name, status, detail string)) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	path, missing, err := store.CheckSQLite(ctx)
+	switch {
+	case err != nil:
+		add("sqlite", checkFail, err.Error())
+	case len(missing) > 0:
+		// InitStore creates these on a normal start
+		add("sqlite", checkWarn, path+": missing (created on startup): "+strings.Join(missing, ", "))
+	default:
+		add("sqlite", checkOK, path)
+	}
+}
+
+// checkMongo checks Mongo connectivity and indexes
+func checkMongo(add func(name, status, detail string)) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if missingIdx, err := store.CheckStore(ctx); err != nil {
+		add("mongo", checkFail, err.Error())
+	} else {
+		add("mongo", checkOK, "")
+		if len(missingIdx) > 0 {
+			// InitStore creates these on a normal start
+			add("mongo_indexes", checkWarn, "missing (created on startup): "+strings.Join(missingIdx, ", "))
+		} else {
+			add("mongo_indexes", checkOK, "")
+		}
+	}
+}
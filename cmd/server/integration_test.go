@@ -0,0 +1,404 @@
+//go:build integration
+
+// The integration suite boots the full server against a Mongo started in Docker, with local
+// drives standing in for Google Drive, and drives it over HTTP like a client would:
+//
+//	go test -tags integration ./cmd/server
+//
+// Set INTEGRATION_MONGO_URI to run against a Mongo that is already up instead.
+package main
+
+import (
+	"SE/internal/audit"
+	"SE/internal/auth"
+	"SE/internal/cache"
+	"SE/internal/drivemanager"
+	"SE/internal/filehandlers"
+	"SE/internal/fileprocessor"
+	"SE/internal/jobs"
+	"SE/internal/notify"
+	"SE/internal/oauth"
+	"SE/internal/store"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ory/dockertest/v3"
+	"github.com/ory/dockertest/v3/docker"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// baseURL is where the server under test listens
+var baseURL string
+
+func TestMain(m *testing.M) {
+	os.Exit(runIntegration(m))
+}
+
+func runIntegration(m *testing.M) int {
+	uri := os.Getenv("INTEGRATION_MONGO_URI")
+	if uri == "" {
+		pool, err := dockertest.NewPool("")
+		if err != nil {
+			log.Printf("integration: docker: %v", err)
+			return 1
+		}
+		pool.MaxWait = 2 * time.Minute
+		mongoC, err := pool.RunWithOptions(&dockertest.RunOptions{Repository: "mongo", Tag: "7"}, func(hc *docker.HostConfig) {
+			hc.AutoRemove = true
+			hc.RestartPolicy = docker.RestartPolicy{Name: "no"}
+		})
+		if err != nil {
+			log.Printf("integration: start mongo: %v", err)
+			return 1
+		}
+		defer pool.Purge(mongoC)
+		// Reaped by Docker even if the suite is killed
+		mongoC.Expire(600)
+
+		uri = "mongodb://" + mongoC.GetHostPort("27017/tcp")
+		if err := pool.Retry(func() error { return pingMongo(uri) }); err != nil {
+			log.Printf("integration: mongo never came up: %v", err)
+			return 1
+		}
+	}
+
+	dir, err := os.MkdirTemp("", "se-integration-*")
+	if err != nil {
+		log.Printf("integration: %v", err)
+		return 1
+	}
+	defer os.RemoveAll(dir)
+
+	encKey := make([]byte, 32)
+	rand.Read(encKey)
+	for k, v := range map[string]string{
+		"MONGO_URI":         uri,
+		"JWT_SECRET":        "integration",
+		"TOKEN_ENC_KEY":     base64.StdEncoding.EncodeToString(encKey),
+		"LOCAL_DRIVES":      "true",
+		"LOCAL_DRIVE_DIR":   filepath.Join(dir, "drives"),
+		"UPLOAD_TEMP_DIR":   filepath.Join(dir, "uploads"),
+		"DOWNLOAD_TEMP_DIR": filepath.Join(dir, "downloads"),
+		"RESTORE_CACHE_DIR": filepath.Join(dir, "cache"),
+	} {
+		os.Setenv(k, v)
+	}
+
+	// Same start-up as main, minus the listener
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := auth.InitJWTKeys(); err != nil {
+		log.Printf("integration: jwt keys: %v", err)
+		return 1
+	}
+	auth.InitTokenConfig()
+	if err := auth.InitRegistrationMode(); err != nil {
+		log.Printf("integration: registration: %v", err)
+		return 1
+	}
+	if err := auth.InitPasswordPolicy(); err != nil {
+		log.Printf("integration: password policy: %v", err)
+		return 1
+	}
+	if err := store.InitStore(ctx); err != nil {
+		log.Printf("integration: init store: %v", err)
+		return 1
+	}
+	defer store.DisconnectStore(context.Background())
+	if err := cache.InitCache(); err != nil {
+		log.Printf("integration: cache: %v", err)
+		return 1
+	}
+	oauth.InitOAuthConfig()
+	fileprocessor.InitFileConfig()
+	drivemanager.InitDriveConfig()
+	notify.InitNotifyConfig()
+	audit.InitAuditConfig()
+	jobs.InitJobConfig()
+	go jobs.Run(ctx, filehandlers.ProcessJob, filehandlers.FailJobSession)
+	go fileprocessor.RunWatchdog(ctx)
+
+	srv := httptest.NewServer(newRouter())
+	defer srv.Close()
+	baseURL = srv.URL
+
+	return m.Run()
+}
+
+func pingMongo(uri string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	c, err := mongo.Connect(ctx, options.Client().ApplyURI(uri))
+	if err != nil {
+		return err
+	}
+	defer c.Disconnect(context.Background())
+	return c.Ping(ctx, nil)
+}
+
+// apiClient calls the server under test as one user
+type apiClient struct {
+	t     *testing.T
+	token string
+}
+
+// do sends a request and fails the test unless the response has status want
+func (c *apiClient) do(method, path, contentType string, body io.Reader, want int) []byte {
+	c.t.Helper()
+	req, err := http.NewRequest(method, baseURL+path, body)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		c.t.Fatalf("%s %s: %v", method, path, err)
+	}
+	defer resp.Body.Close()
+	out, err := io.ReadAll(resp.Body)
+	if err != nil {
+		c.t.Fatalf("%s %s: %v", method, path, err)
+	}
+	if resp.StatusCode != want {
+		c.t.Fatalf("%s %s: status %d, want %d: %s", method, path, resp.StatusCode, want, out)
+	}
+	return out
+}
+
+// json sends in as a JSON body (nil for none) and decodes the response into out (nil to skip)
+func (c *apiClient) json(method, path string, in any, want int, out any) {
+	c.t.Helper()
+	var body io.Reader
+	if in != nil {
+		b, err := json.Marshal(in)
+		if err != nil {
+			c.t.Fatal(err)
+		}
+		body = bytes.NewReader(b)
+	}
+	resp := c.do(method, path, "application/json", body, want)
+	if out != nil {
+		if err := json.Unmarshal(resp, out); err != nil {
+			c.t.Fatalf("%s %s: decode %s: %v", method, path, resp, err)
+		}
+	}
+}
+
+// newUser signs up a fresh user with two local drives linked and returns a client for them
+func newUser(t *testing.T) *apiClient {
+	t.Helper()
+	c := &apiClient{t: t}
+	name := fmt.Sprintf("it%d", time.Now().UnixNano())
+	creds := map[string]string{"username": name, "email": name + "@example.com", "password": "integration-pass-1"}
+	c.json("POST", "/api/signup", creds, http.StatusCreated, nil)
+
+	var login struct {
+		Token string `json:"token"`
+	}
+	c.json("POST", "/api/login", map[string]string{"email": creds["email"], "password": creds["password"]}, http.StatusOK, &login)
+	if login.Token == "" {
+		t.Fatal("login returned no token")
+	}
+	c.token = login.Token
+
+	c.json("POST", "/api/drive/local", map[string]string{"display_name": "drive a"}, http.StatusCreated, nil)
+	c.json("POST", "/api/drive/local", map[string]string{"display_name": "drive b"}, http.StatusCreated, nil)
+	return c
+}
+
+// initiate opens an upload session for a file of size bytes
+func (c *apiClient) initiate(filename string, size int64) string {
+	c.t.Helper()
+	var resp struct {
+		SessionID string `json:"session_id"`
+	}
+	c.json("POST", "/api/files/upload/initiate", map[string]any{"filename": filename, "file_size": size}, http.StatusOK, &resp)
+	return resp.SessionID
+}
+
+// uploadRange sends data as the bytes starting at offset of a total-byte file
+func (c *apiClient) uploadRange(sessionID string, data []byte, offset, total int64) {
+	c.t.Helper()
+	req, err := http.NewRequest("PUT", baseURL+"/api/files/upload/chunk?session_id="+sessionID, bytes.NewReader(data))
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer "+c.token)
+	req.Header.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", offset, offset+int64(len(data))-1, total))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(resp.Body)
+		c.t.Fatalf("upload %d bytes at %d: status %d: %s", len(data), offset, resp.StatusCode, msg)
+	}
+}
+
+// waitForStatus polls the session until it leaves processing and returns its final status
+func (c *apiClient) waitForStatus(sessionID string) string {
+	c.t.Helper()
+	deadline := time.Now().Add(2 * time.Minute)
+	for time.Now().Before(deadline) {
+		var status struct {
+			Status       string `json:"status"`
+			ErrorMessage string `json:"error_message"`
+		}
+		c.json("GET", "/api/files/upload/status/"+sessionID, nil, http.StatusOK, &status)
+		if status.Status != "processing" {
+			if status.Status != "complete" {
+				c.t.Logf("session %s ended %s: %s", sessionID, status.Status, status.ErrorMessage)
+			}
+			return status.Status
+		}
+		time.Sleep(250 * time.Millisecond)
+	}
+	c.t.Fatalf("session %s still processing after 2 minutes", sessionID)
+	return ""
+}
+
+func TestHealth(t *testing.T) {
+	c := &apiClient{t: t}
+	c.do("GET", "/health", "", nil, http.StatusOK)
+}
+
+// TestUploadPipeline walks a file through signup, drive linking, upload, processing,
+// verification of where its chunks landed, and download
+func TestUploadPipeline(t *testing.T) {
+	c := newUser(t)
+
+	data := make([]byte, 3<<20+12345)
+	rand.Read(data)
+	size := int64(len(data))
+	sessionID := c.initiate("pipeline.bin", size)
+
+	// Out of order, to exercise range tracking
+	half := size / 2
+	c.uploadRange(sessionID, data[half:], half, size)
+	c.uploadRange(sessionID, data[:half], 0, size)
+
+	c.json("POST", "/api/files/upload/finalize", map[string]string{"session_id": sessionID, "strategy": "balanced"}, http.StatusOK, nil)
+	if status := c.waitForStatus(sessionID); status != "complete" {
+		t.Fatalf("status %s, want complete", status)
+	}
+
+	var list struct {
+		Files []struct {
+			ID               string `json:"id"`
+			OriginalFilename string `json:"original_filename"`
+			OriginalSize     int64  `json:"original_size"`
+		} `json:"files"`
+	}
+	c.json("GET", "/api/files/list", nil, http.StatusOK, &list)
+	if len(list.Files) != 1 || list.Files[0].OriginalFilename != "pipeline.bin" || list.Files[0].OriginalSize != size {
+		t.Fatalf("file list = %+v, want pipeline.bin of %d bytes", list.Files, size)
+	}
+	fileID := list.Files[0].ID
+
+	// Balanced spreads the chunks over both drives
+	var detail struct {
+		Status string `json:"status"`
+		Chunks []struct {
+			DriveAccountID string `json:"drive_account_id"`
+			DriveFileID    string `json:"drive_file_id"`
+		} `json:"chunks"`
+	}
+	c.json("GET", "/api/files/"+fileID, nil, http.StatusOK, &detail)
+	if detail.Status != "active" {
+		t.Errorf("file status %s, want active", detail.Status)
+	}
+	drives := make(map[string]bool)
+	for _, chunk := range detail.Chunks {
+		if chunk.DriveFileID == "" {
+			t.Errorf("chunk without a drive file: %+v", chunk)
+		}
+		drives[chunk.DriveAccountID] = true
+	}
+	if len(drives) != 2 {
+		t.Errorf("chunks on %d drives, want 2", len(drives))
+	}
+
+	// Every chunk is where the database says, and nothing else is
+	var report struct {
+		Accounts []struct {
+			AccountID  string `json:"account_id"`
+			Consistent int    `json:"consistent"`
+			Orphaned   []any  `json:"orphaned"`
+			Missing    []any  `json:"missing"`
+			Error      string `json:"error"`
+		} `json:"accounts"`
+	}
+	c.json("GET", "/api/drive/reconcile", nil, http.StatusOK, &report)
+	consistent := 0
+	for _, acct := range report.Accounts {
+		if acct.Error != "" || len(acct.Orphaned) > 0 || len(acct.Missing) > 0 {
+			t.Errorf("drive %s not consistent: %+v", acct.AccountID, acct)
+		}
+		consistent += acct.Consistent
+	}
+	if consistent != len(detail.Chunks) {
+		t.Errorf("%d consistent chunks, want %d", consistent, len(detail.Chunks))
+	}
+
+	got := c.do("GET", "/api/files/"+fileID+"/download", "", nil, http.StatusOK)
+	if !bytes.Equal(got, data) {
+		t.Fatalf("downloaded %d bytes that differ from the %d uploaded", len(got), len(data))
+	}
+
+	// Another user can't see the file
+	other := newUser(t)
+	other.do("GET", "/api/files/"+fileID, "", nil, http.StatusNotFound)
+	other.do("GET", "/api/files/"+fileID+"/download", "", nil, http.StatusNotFound)
+}
+
+// TestDiscardUpload deletes an abandoned session. Stored files can't be deleted through the
+// API, so this is the deletion path the pipeline has.
+func TestDiscardUpload(t *testing.T) {
+	c := newUser(t)
+
+	data := make([]byte, 1<<20)
+	rand.Read(data)
+	sessionID := c.initiate("abandoned.bin", int64(len(data))*2)
+	c.uploadRange(sessionID, data, 0, int64(len(data))*2)
+
+	var sessions struct {
+		Sessions []struct {
+			ID     string `json:"id"`
+			Status string `json:"status"`
+		} `json:"sessions"`
+	}
+	c.json("GET", "/api/files/upload/sessions", nil, http.StatusOK, &sessions)
+	if len(sessions.Sessions) != 1 || sessions.Sessions[0].ID != sessionID || sessions.Sessions[0].Status != "uploading" {
+		t.Fatalf("sessions = %+v, want %s uploading", sessions.Sessions, sessionID)
+	}
+
+	c.do("DELETE", "/api/files/upload/sessions/"+sessionID, "", nil, http.StatusNoContent)
+	c.do("GET", "/api/files/upload/status/"+sessionID, "", nil, http.StatusNotFound)
+	c.json("GET", "/api/files/upload/sessions", nil, http.StatusOK, &sessions)
+	if len(sessions.Sessions) != 0 {
+		t.Fatalf("sessions after delete = %+v, want none", sessions.Sessions)
+	}
+
+	if _, err := os.Stat(filepath.Join(os.Getenv("UPLOAD_TEMP_DIR"), sessionID+"_abandoned.bin")); !os.IsNotExist(err) {
+		t.Errorf("uploaded temp file left behind (stat: %v)", err)
+	}
+}
@@ -1,15 +1,22 @@
 package main
 
 import (
+	"SE/internal/audit"
 	"SE/internal/auth"
+	"SE/internal/cache"
+	"SE/internal/drivemanager"
 	"SE/internal/filehandlers"
 	"SE/internal/fileprocessor"
 	"SE/internal/handlers"
+	"SE/internal/jobs"
+	"SE/internal/metrics"
 	"SE/internal/middleware"
+	"SE/internal/notify"
 	"SE/internal/oauth"
 	"SE/internal/store"
 	"context"
 	"encoding/json"
+	"flag"
 	"fmt"
 	"log"
 	"net/http"
@@ -20,18 +27,42 @@ import (
 )
 
 func main() {
+	check := flag.Bool("check", false, "validate configuration, Mongo, temp dir and OAuth settings, print a report and exit")
+	flag.Parse()
+
 	// Load env vars
 	if err := godotenv.Load(); err != nil {
 		log.Println("Warning: .env file not found")
 	}
 
-	// Check required env vars
-	required := []string{"MONGO_URI", "JWT_SECRET", "TOKEN_ENC_KEY", "GOOGLE_CLIENT_ID", "GOOGLE_CLIENT_SECRET", "BASE_URL"}
+	// Check required env vars. The in-memory store needs neither Mongo nor Google credentials,
+	// SQLite no Mongo. JWT_SECRET or JWT_KEYS is checked when the signing keys are loaded.
+	required := []string{"MONGO_URI", "TOKEN_ENC_KEY", "GOOGLE_CLIENT_ID", "GOOGLE_CLIENT_SECRET", "BASE_URL"}
+	memoryStore := os.Getenv("STORE_DRIVER") == "memory"
+	if memoryStore {
+		required = []string{"TOKEN_ENC_KEY"}
+	}
+	if os.Getenv("STORE_DRIVER") == "sqlite" {
+		required = required[1:]
+	}
+	if *check {
+		os.Exit(runSelfCheck(required))
+	}
 	for _, k := range required {
 		if os.Getenv(k) == "" {
 			log.Fatalf("env %s is required", k)
 		}
 	}
+	if err := auth.InitJWTKeys(); err != nil {
+		log.Fatalf("jwt keys: %v", err)
+	}
+	auth.InitTokenConfig()
+	if err := auth.InitRegistrationMode(); err != nil {
+		log.Fatalf("registration: %v", err)
+	}
+	if err := auth.InitPasswordPolicy(); err != nil {
+		log.Fatalf("password policy: %v", err)
+	}
 
 	// Initialize store (Mongo)
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
@@ -40,6 +71,12 @@ func main() {
 	if err := store.InitStore(ctx); err != nil {
 		log.Fatalf("init store: %v", err)
 	}
+	if memoryStore {
+		log.Println("Store driver memory: data lives in this process and is lost on exit")
+	}
+	if os.Getenv("STORE_DRIVER") == "sqlite" {
+		log.Printf("Store driver sqlite: %s", store.SQLitePath())
+	}
 	defer func() {
 		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 		defer cancel()
@@ -48,51 +85,207 @@ func main() {
 		}
 	}()
 
+	// Optional Redis cache for upload session lookups and drive quotas
+	if err := cache.InitCache(); err != nil {
+		log.Fatalf("cache: %v", err)
+	}
+	if cache.Enabled() {
+		if err := cache.Ping(ctx); err != nil {
+			log.Printf("Warning: redis unreachable, lookups go to the store until it is: %v", err)
+		}
+		defer cache.Close()
+	}
+
 	// Initialize oauth config
 	oauth.InitOAuthConfig()
+	if err := oauth.InitFinishedPage(); err != nil {
+		log.Fatalf("branding: %v", err)
+	}
 
 	// Initialize file processor config
 	fileprocessor.InitFileConfig()
+	if err := fileprocessor.InitScanner(); err != nil {
+		log.Fatalf("malware scanner: %v", err)
+	}
+
+	// Initialize drive manager config
+	drivemanager.InitDriveConfig()
+
+	// Restore today's Drive API usage and keep persisting it
+	if err := drivemanager.LoadAPIUsage(ctx); err != nil {
+		log.Printf("load drive api usage: %v", err)
+	}
+	go drivemanager.RunUsageFlusher(context.Background())
+
+	// Initialize notification channels
+	notify.InitNotifyConfig()
+
+	// Security audit log retention
+	audit.InitAuditConfig()
+
+	// Process finalized uploads from the durable job queue, resuming work interrupted by a restart.
+	// With PROCESSING_MODE=external this server only queues jobs and cmd/worker processes them.
+	jobs.InitJobConfig()
+	// Sweep sessions a crash or deploy left processing before the queue starts
+	if err := filehandlers.RecoverSessions(context.Background()); err != nil {
+		log.Printf("recover sessions: %v", err)
+	}
+	if os.Getenv("PROCESSING_MODE") != "external" || memoryStore {
+		go jobs.Run(context.Background(), filehandlers.ProcessJob, filehandlers.FailJobSession)
+	} else {
+		log.Println("Processing mode external: leaving queued jobs to workers")
+	}
+
+	// Watchdog fails processing sessions whose heartbeat went stale
+	go fileprocessor.RunWatchdog(context.Background())
+
+	// Scrubber spot-checks stored chunks against their checksums
+	go fileprocessor.RunScrubber(context.Background())
+
+	// Purger removes deleted files' records once their retention is over
+	go fileprocessor.RunPurger(context.Background())
 
-	// Setup routes
+	addr := ":8080"
+	fmt.Printf("Starting server on %s\n", addr)
+	if err := http.ListenAndServe(addr, newRouter()); err != nil {
+		log.Fatalf("server: %v", err)
+	}
+}
+
+// newRouter sets up the API routes and middlewares
+func newRouter() http.Handler {
 	mux := http.NewServeMux()
 
 	// Health check route
 	mux.HandleFunc("/health", requireMethod("GET", healthCheckHandler))
 
+	// Prometheus metrics
+	mux.HandleFunc("/metrics", requireMethod("GET", metrics.Handler))
+
 	// Authentication routes
 	mux.HandleFunc("/api/signup", requireMethod("POST", auth.SignupHandler))
 	mux.HandleFunc("/api/login", requireMethod("POST", auth.LoginHandler))
+	mux.HandleFunc("/api/auth/refresh", requireMethod("POST", auth.RefreshHandler))
+	mux.HandleFunc("/api/auth/logout", requireMethod("POST", auth.LogoutHandler))
+	mux.HandleFunc("/api/password/policy", requireMethod("GET", auth.PasswordPolicyHandler))
+	mux.HandleFunc("/api/password/change", auth.AuthMiddleware(requireMethod("POST", auth.ChangePasswordHandler)))
+	mux.HandleFunc("/api/sessions", auth.AuthMiddleware(requireMethod("GET", auth.ListSessionsHandler)))
+	mux.HandleFunc("/api/sessions/", auth.AuthMiddleware(requireMethod("DELETE", auth.RevokeSessionHandler)))
+	mux.HandleFunc("/api/audit", auth.AuthMiddleware(requireMethod("GET", handlers.AuditLogHandler)))
+	mux.HandleFunc("/api/auth/google", requireMethod("GET", oauth.GoogleLoginHandler))
+	mux.HandleFunc("/api/auth/google/token", requireMethod("POST", oauth.GoogleLoginTokenHandler))
+	mux.HandleFunc("/.well-known/jwks.json", requireMethod("GET", auth.JWKSHandler))
+	// Old path of /api/auth/refresh
+	mux.HandleFunc("/api/token/refresh", requireMethod("POST", auth.RefreshHandler))
 
 	// Drive OAuth routes
 	mux.HandleFunc("/api/drive/link", auth.AuthMiddleware(requireMethod("GET", oauth.DriveLinkHandler)))
+	mux.HandleFunc("/api/drive/link/start", requireMethod("GET", oauth.DriveLinkStartHandler))
 	mux.HandleFunc("/api/drive/accounts", auth.AuthMiddleware(requireMethod("GET", handlers.ListDriveAccountsHandler)))
+	mux.HandleFunc("/api/drive/accounts/", auth.AuthMiddleware(requireMethod("PATCH", handlers.UpdateDriveAccountHandler)))
+	mux.HandleFunc("/api/drive/service-account", auth.AuthMiddleware(requireMethod("POST", handlers.AddServiceAccountHandler)))
+	mux.HandleFunc("/api/drive/local", auth.AuthMiddleware(requireMethod("POST", handlers.AddLocalDriveHandler)))
+	mux.HandleFunc("/api/usage", auth.AuthMiddleware(requireMethod("GET", handlers.UsageHandler)))
 	mux.HandleFunc("/api/drive/space", auth.AuthMiddleware(requireMethod("GET", filehandlers.GetDriveSpacesHandler)))
+	mux.HandleFunc("/api/drive/reconcile", auth.AuthMiddleware(requireMethod("GET", handlers.ReconcileHandler)))
+
+	// Notification routes
+	mux.HandleFunc("/api/notifications/channels", auth.AuthMiddleware(routeMethods(map[string]http.HandlerFunc{
+		"GET": handlers.GetNotificationChannelsHandler,
+		"PUT": handlers.SetNotificationChannelsHandler,
+	})))
+
+	// Chunk placement policy routes
+	mux.HandleFunc("/api/placement/policy", auth.AuthMiddleware(routeMethods(map[string]http.HandlerFunc{
+		"GET": handlers.GetPlacementPolicyHandler,
+		"PUT": handlers.SetPlacementPolicyHandler,
+	})))
+
+	// Per-user default preferences
+	mux.HandleFunc("/api/preferences", auth.AuthMiddleware(routeMethods(map[string]http.HandlerFunc{
+		"GET":   handlers.GetPreferencesHandler,
+		"PUT":   handlers.SetPreferencesHandler,
+		"PATCH": handlers.PatchPreferencesHandler,
+	})))
 
 	// File upload routes
 	mux.HandleFunc("/api/files/upload/initiate", auth.AuthMiddleware(requireMethod("POST", filehandlers.InitiateUploadHandler)))
-	mux.HandleFunc("/api/files/upload/chunk", auth.AuthMiddleware(requireMethod("POST", filehandlers.UploadChunkHandler)))
+	mux.HandleFunc("/api/files/upload/chunk", auth.AuthMiddleware(routeMethods(map[string]http.HandlerFunc{
+		"POST": filehandlers.UploadChunkHandler,
+		"PUT":  filehandlers.UploadChunkRawHandler,
+	})))
+	mux.HandleFunc("/api/files/upload/from-url", auth.AuthMiddleware(requireMethod("POST", filehandlers.UploadFromURLHandler)))
 	mux.HandleFunc("/api/files/upload/finalize", auth.AuthMiddleware(requireMethod("POST", filehandlers.FinalizeUploadHandler)))
 	mux.HandleFunc("/api/files/upload/status/", auth.AuthMiddleware(requireMethod("GET", filehandlers.GetUploadStatusHandler)))
+	mux.HandleFunc("/api/files/upload/batch/", auth.AuthMiddleware(requireMethod("GET", filehandlers.BatchHandler)))
+	mux.HandleFunc("/api/files/upload/pause/", auth.AuthMiddleware(requireMethod("POST", filehandlers.PauseUploadHandler)))
+	mux.HandleFunc("/api/files/upload/resume/", auth.AuthMiddleware(requireMethod("POST", filehandlers.ResumeUploadHandler)))
+	mux.HandleFunc("/api/files/upload/events/", auth.AuthMiddleware(requireMethod("GET", filehandlers.UploadEventsHandler)))
+	mux.HandleFunc("/api/files/upload/sessions", auth.AuthMiddleware(requireMethod("GET", filehandlers.ListUploadSessionsHandler)))
+	mux.HandleFunc("/api/files/upload/sessions/", auth.AuthMiddleware(requireMethod("DELETE", filehandlers.DeleteUploadSessionHandler)))
+	mux.HandleFunc("/api/files/upload/extend/", auth.AuthMiddleware(requireMethod("POST", filehandlers.ExtendUploadSessionHandler)))
 	mux.HandleFunc("/api/files/chunking/calculate", auth.AuthMiddleware(requireMethod("POST", filehandlers.CalculateChunkingHandler)))
 	mux.HandleFunc("/api/files/download-key/", auth.AuthMiddleware(requireMethod("GET", filehandlers.DownloadKeyFileHandler)))
+	mux.HandleFunc("/api/files/undelete", auth.AuthMiddleware(requireMethod("POST", filehandlers.UndeleteFileHandler)))
+	mux.HandleFunc("/api/files/restore-from-key", auth.AuthMiddleware(requireMethod("POST", filehandlers.RestoreFromKeyHandler)))
+	mux.HandleFunc("/api/files/download/zip", auth.AuthMiddleware(requireMethod("POST", filehandlers.DownloadZipHandler)))
+	mux.HandleFunc("/api/files/download/sessions", auth.AuthMiddleware(requireMethod("GET", filehandlers.ListDownloadSessionsHandler)))
+	mux.HandleFunc("/api/files/download/cancel/", auth.AuthMiddleware(requireMethod("POST", filehandlers.CancelDownloadHandler)))
+	mux.HandleFunc("/api/files/export", auth.AuthMiddleware(requireMethod("POST", filehandlers.ExportHandler)))
+	mux.HandleFunc("/api/files/export/", auth.AuthMiddleware(requireMethod("GET", filehandlers.ExportStatusHandler)))
+	mux.HandleFunc("/api/files/verify/", auth.AuthMiddleware(requireMethod("GET", filehandlers.VerificationStatusHandler)))
+	mux.HandleFunc("/api/files/batch", auth.AuthMiddleware(requireMethod("POST", filehandlers.BatchJobHandler)))
+	mux.HandleFunc("/api/files/batch/", auth.AuthMiddleware(requireMethod("GET", filehandlers.BatchJobStatusHandler)))
+
+	// Stored file routes
+	mux.HandleFunc("/api/files/list", auth.AuthMiddleware(requireMethod("GET", filehandlers.ListStoredFilesHandler)))
+	mux.HandleFunc("/api/files/search", auth.AuthMiddleware(requireMethod("GET", filehandlers.SearchFilesHandler)))
+	mux.HandleFunc("/api/files/trash", auth.AuthMiddleware(requireMethod("GET", filehandlers.ListTrashHandler)))
+	mux.HandleFunc("/api/files/shared", auth.AuthMiddleware(requireMethod("GET", filehandlers.ListSharedFilesHandler)))
+	mux.HandleFunc("/api/files/", auth.AuthMiddleware(filehandlers.FileResourceHandler))
+
+	// Folder routes
+	mux.HandleFunc("/api/folders", auth.AuthMiddleware(requireMethod("GET", filehandlers.ListFoldersHandler)))
+	mux.HandleFunc("/api/folders/", auth.AuthMiddleware(routeMethods(map[string]http.HandlerFunc{
+		"POST":   filehandlers.CreateFolderHandler,
+		"PATCH":  filehandlers.UpdateFolderHandler,
+		"DELETE": filehandlers.DeleteFolderHandler,
+	})))
+
+	// Signed download links, which carry their own authorization
+	mux.HandleFunc("/api/links/", requireMethod("GET", filehandlers.SignedDownloadHandler))
 
-	// OAuth callback (no auth header; state validated via DB)
+	// Public links: managed by their owner, used by anyone with the token
+	mux.HandleFunc("/api/public-links", auth.AuthMiddleware(requireMethod("GET", filehandlers.ListPublicLinksHandler)))
+	mux.HandleFunc("/api/public-links/", auth.AuthMiddleware(requireMethod("DELETE", filehandlers.DeletePublicLinkHandler)))
+	mux.HandleFunc("/api/public/", routeMethods(map[string]http.HandlerFunc{
+		"GET":  filehandlers.PublicDownloadHandler,
+		"POST": filehandlers.PublicDownloadHandler,
+	}))
+
+	// Admin routes
+	mux.HandleFunc("/api/admin/drive-quota", auth.AdminMiddleware(requireMethod("GET", handlers.DriveQuotaHandler)))
+	mux.HandleFunc("/api/admin/users", auth.AdminMiddleware(requireMethod("GET", handlers.ListUsersHandler)))
+	mux.HandleFunc("/api/admin/users/", auth.AdminMiddleware(requireMethod("PUT", handlers.AdminUserHandler)))
+	mux.HandleFunc("/api/admin/sessions", auth.AdminMiddleware(requireMethod("GET", filehandlers.AdminSessionsHandler)))
+	mux.HandleFunc("/api/admin/cleanup", auth.AdminMiddleware(requireMethod("POST", handlers.CleanupHandler)))
+	mux.HandleFunc("/api/admin/audit", auth.AdminMiddleware(requireMethod("GET", handlers.AdminAuditLogHandler)))
+	mux.HandleFunc("/api/admin/reports", auth.AdminMiddleware(requireMethod("POST", handlers.ReportHandler)))
+	mux.HandleFunc("/api/admin/invites", auth.AdminMiddleware(routeMethods(map[string]http.HandlerFunc{
+		"GET":  auth.ListInvitesHandler,
+		"POST": auth.CreateInviteHandler,
+	})))
+	mux.HandleFunc("/api/admin/invites/", auth.AdminMiddleware(requireMethod("DELETE", auth.DeleteInviteHandler)))
+
+	// OAuth callback (no auth header; state validated via DB and nonce cookie)
 	mux.HandleFunc("/oauth2/callback", requireMethod("GET", oauth.OauthCallbackHandler))
 
 	// OAuth completion page
-	mux.HandleFunc("/oauth/finished", func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Content-Type", "text/html")
-		w.Write([]byte("<h1>OAuth flow completed</h1><p>You can close this window and return to the application.</p>"))
-	})
+	mux.HandleFunc("/oauth/finished", requireMethod("GET", oauth.FinishedHandler))
 
-	addr := ":8080"
-	fmt.Printf("Starting server on %s\n", addr)
 	// Apply middlewares: CORS (allow all for now) then Logger
 	handler := middleware.CORS([]string{"*"})(mux)
-	if err := http.ListenAndServe(addr, middleware.Logger(handler)); err != nil {
-		log.Fatalf("server: %v", err)
-	}
+	return middleware.Logger(handler)
 }
 
 func healthCheckHandler(w http.ResponseWriter, r *http.Request) {
@@ -116,4 +309,14 @@ func requireMethod(verb string, h http.HandlerFunc) http.HandlerFunc {
 	}
 }
 
- 
+// routeMethods dispatches to a handler per HTTP method on a single path
+func routeMethods(byVerb map[string]http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		h, ok := byVerb[r.Method]
+		if !ok {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		h(w, r)
+	}
+}
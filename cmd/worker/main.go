@@ -0,0 +1,120 @@
+// Command worker processes finalized uploads (obfuscation, chunking, Drive transfer) from the
+// durable job queue, so processing can run and scale separately from the API servers.
+// Workers need the same UPLOAD_TEMP_DIR as the API servers, e.g. on a shared volume.
+package main
+
+import (
+	"SE/internal/cache"
+	"SE/internal/drivemanager"
+	"SE/internal/filehandlers"
+	"SE/internal/fileprocessor"
+	"SE/internal/jobs"
+	"SE/internal/metrics"
+	"SE/internal/notify"
+	"SE/internal/oauth"
+	"SE/internal/store"
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/joho/godotenv"
+)
+
+func main() {
+	// Load env vars
+	if err := godotenv.Load(); err != nil {
+		log.Println("Warning: .env file not found")
+	}
+
+	// The in-memory store only exists inside the API server process
+	if os.Getenv("STORE_DRIVER") == "memory" {
+		log.Fatal("STORE_DRIVER=memory can't be shared with a separate worker; run the server with in-process processing")
+	}
+
+	// Drive credentials are needed to refresh tokens; no JWT or callback URL is used here.
+	// A SQLite file is shared with a server on the same machine instead of Mongo.
+	required := []string{"MONGO_URI", "TOKEN_ENC_KEY", "GOOGLE_CLIENT_ID", "GOOGLE_CLIENT_SECRET"}
+	if os.Getenv("STORE_DRIVER") == "sqlite" {
+		required = required[1:]
+	}
+	for _, k := range required {
+		if os.Getenv(k) == "" {
+			log.Fatalf("env %s is required", k)
+		}
+	}
+
+	// Stop claiming jobs on SIGINT/SIGTERM; jobs in flight are left to be resumed by another worker
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	initCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	if err := store.InitStore(initCtx); err != nil {
+		log.Fatalf("init store: %v", err)
+	}
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := store.DisconnectStore(ctx); err != nil {
+			log.Printf("disconnect store: %v", err)
+		}
+	}()
+
+	// Optional Redis cache for upload session lookups and drive quotas
+	if err := cache.InitCache(); err != nil {
+		log.Fatalf("cache: %v", err)
+	}
+	if cache.Enabled() {
+		if err := cache.Ping(initCtx); err != nil {
+			log.Printf("Warning: redis unreachable, lookups go to the store until it is: %v", err)
+		}
+		defer cache.Close()
+	}
+
+	oauth.InitOAuthConfig()
+	fileprocessor.InitFileConfig()
+	if err := fileprocessor.InitScanner(); err != nil {
+		log.Fatalf("malware scanner: %v", err)
+	}
+	drivemanager.InitDriveConfig()
+	notify.InitNotifyConfig()
+	jobs.InitJobConfig()
+
+	// Drive API usage is shared with the API servers through Mongo
+	if err := drivemanager.LoadAPIUsage(initCtx); err != nil {
+		log.Printf("load drive api usage: %v", err)
+	}
+	flushed := make(chan struct{})
+	go func() {
+		drivemanager.RunUsageFlusher(ctx)
+		close(flushed)
+	}()
+
+	go fileprocessor.RunWatchdog(ctx)
+
+	// Optional health and metrics endpoint for orchestrators and Prometheus
+	if addr := os.Getenv("WORKER_METRICS_ADDR"); addr != "" {
+		mux := http.NewServeMux()
+		mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(map[string]string{"status": "healthy", "message": "Worker is running"})
+		})
+		mux.HandleFunc("/metrics", metrics.Handler)
+		go func() {
+			log.Printf("Worker metrics on %s", addr)
+			if err := http.ListenAndServe(addr, mux); err != nil {
+				log.Printf("worker metrics: %v", err)
+			}
+		}()
+	}
+
+	jobs.Run(ctx, filehandlers.ProcessJob, filehandlers.FailJobSession)
+	// The flusher writes pending usage once ctx is done
+	<-flushed
+	log.Println("Worker stopped")
+}
@@ -0,0 +1,35 @@
+package audit
+
+import (
+	"SE/internal/middleware"
+	"SE/internal/models"
+	"SE/internal/store"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+)
+
+// retention is how long audit events are kept
+var retention time.Duration
+
+// InitAuditConfig reads how long audit events are kept
+func InitAuditConfig() {
+	days, _ := strconv.Atoi(os.Getenv("AUDIT_RETENTION_DAYS"))
+	if days == 0 {
+		days = 365
+	}
+	retention = time.Duration(days) * 24 * time.Hour
+}
+
+// Record stores e as done by the client of r. A failure is logged rather than failing the
+// action being audited.
+func Record(r *http.Request, e models.AuditEvent) {
+	e.Client = middleware.ClientInfo(r)
+	e.CreatedAt = time.Now().UTC()
+	e.ExpiresAt = e.CreatedAt.Add(retention)
+	if err := store.InsertAuditEvent(r.Context(), &e); err != nil {
+		log.Printf("Failed to record audit event %s for user %s: %v", e.Action, e.UserID.Hex(), err)
+	}
+}
@@ -0,0 +1,90 @@
+package auth_test
+
+import (
+	"SE/internal/auth"
+	"SE/internal/handlers"
+	"SE/internal/models"
+	"SE/internal/store"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// admin returns the status AdminMiddleware answers a request with the access token with, 200
+// if it lets the request through
+func admin(t *testing.T, token string) int {
+	t.Helper()
+	r := httptest.NewRequest("GET", "/api/admin/users", nil)
+	if token != "" {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	auth.AdminMiddleware(func(w http.ResponseWriter, r *http.Request) {})(w, r)
+	return w.Code
+}
+
+// setRole asks PUT /api/admin/users/{id}/role with the access token to give the user role
+func setRole(t *testing.T, token string, user *models.User, role string, want int) {
+	t.Helper()
+	r := post(t, "/api/admin/users/"+user.ID.Hex()+"/role", map[string]string{"role": role})
+	r.Method = "PUT"
+	r.Header.Set("Authorization", "Bearer "+token)
+	call(t, auth.AdminMiddleware(handlers.AdminUserHandler), r, want)
+}
+
+func TestAdminRoutes(t *testing.T) {
+	setup(t)
+	user, userTok := login(t)
+	boss, bossTok := login(t)
+	if _, err := store.SetUserRole(context.Background(), boss.ID, models.RoleAdmin); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := admin(t, ""); got != http.StatusUnauthorized {
+		t.Errorf("admin route without a token: %d, want 401", got)
+	}
+	if got := admin(t, userTok.Token); got != http.StatusForbidden {
+		t.Errorf("admin route as a user: %d, want 403", got)
+	}
+	if got := admin(t, bossTok.Token); got != http.StatusOK {
+		t.Errorf("admin route as an admin: %d, want 200", got)
+	}
+
+	// A user can't make themselves an admin
+	setRole(t, userTok.Token, user, models.RoleAdmin, http.StatusForbidden)
+
+	// Roles take effect on the next request, with the tokens the user already has
+	setRole(t, bossTok.Token, user, models.RoleAdmin, http.StatusOK)
+	if got := admin(t, userTok.Token); got != http.StatusOK {
+		t.Errorf("admin route after being made an admin: %d, want 200", got)
+	}
+	setRole(t, bossTok.Token, user, models.RoleUser, http.StatusOK)
+	if got := admin(t, userTok.Token); got != http.StatusForbidden {
+		t.Errorf("admin route after being made a user again: %d, want 403", got)
+	}
+	setRole(t, bossTok.Token, user, "root", http.StatusBadRequest)
+}
+
+func TestAdminEmails(t *testing.T) {
+	t.Setenv("ADMIN_EMAILS", "boss@example.com, other@example.com")
+	setup(t)
+
+	// Google verified the email, so it counts
+	boss, err := auth.ExternalLogin(context.Background(), "Boss@example.com", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	auth.RespondWithLogin(w, httptest.NewRequest("POST", "/api/auth/google/token", nil), boss.ID, false)
+	if got := admin(t, decodeTokens(t, w).Token); got != http.StatusOK {
+		t.Errorf("admin route as a verified ADMIN_EMAILS user: %d, want 200", got)
+	}
+
+	// A password signup under a listed email proves nothing
+	call(t, auth.SignupHandler, post(t, "/api/signup", map[string]string{"email": "other@example.com", "password": "other-pass"}), http.StatusCreated)
+	w = call(t, auth.LoginHandler, post(t, "/api/login", map[string]string{"email": "other@example.com", "password": "other-pass"}), http.StatusOK)
+	if got := admin(t, decodeTokens(t, w).Token); got != http.StatusForbidden {
+		t.Errorf("admin route as an unverified ADMIN_EMAILS user: %d, want 403", got)
+	}
+}
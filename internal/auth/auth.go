@@ -1,14 +1,19 @@
 package auth
 
 import (
+	"SE/internal/audit"
+	"SE/internal/middleware"
 	"SE/internal/models"
 	"SE/internal/store"
 	"context"
+	"crypto/subtle"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"log"
 	"net/http"
 	"os"
+	"strconv"
 	"strings"
 	"time"
 
@@ -17,18 +22,77 @@ import (
 	"golang.org/x/crypto/bcrypt"
 )
 
-var jwtSecret = []byte(os.Getenv("JWT_SECRET"))
+// Token types, in the "typ" claim. Access tokens issued before refresh tokens existed have none,
+// and refresh JWTs are only still around from before refresh tokens were stored.
+const (
+	tokenAccess  = "access"
+	tokenRefresh = "refresh"
+)
+
+var (
+	// tokenLifetime is how long an access token is valid
+	tokenLifetime time.Duration
+	// sessionLifetime is how long the refresh tokens of a login last, and refreshTokenLifetime
+	// how long they last with remember me
+	sessionLifetime      time.Duration
+	refreshTokenLifetime time.Duration
+	// downloadLinkLifetime is how long a signed download link is valid unless asked otherwise,
+	// and maxDownloadLinkLifetime the most that can be asked for
+	downloadLinkLifetime    time.Duration
+	maxDownloadLinkLifetime time.Duration
+)
+
+// InitTokenConfig reads the token lifetimes
+func InitTokenConfig() {
+	minutes, _ := strconv.Atoi(os.Getenv("TOKEN_LIFETIME_MINUTES"))
+	if minutes == 0 {
+		minutes = 15
+	}
+	tokenLifetime = time.Duration(minutes) * time.Minute
+
+	hours, _ := strconv.Atoi(os.Getenv("SESSION_LIFETIME_HOURS"))
+	if hours == 0 {
+		hours = 24
+	}
+	sessionLifetime = time.Duration(hours) * time.Hour
+
+	days, _ := strconv.Atoi(os.Getenv("REFRESH_TOKEN_DAYS"))
+	if days == 0 {
+		days = 30
+	}
+	refreshTokenLifetime = time.Duration(days) * 24 * time.Hour
+
+	linkMinutes, _ := strconv.Atoi(os.Getenv("DOWNLOAD_LINK_MINUTES"))
+	if linkMinutes == 0 {
+		linkMinutes = 60
+	}
+	downloadLinkLifetime = time.Duration(linkMinutes) * time.Minute
+
+	linkHours, _ := strconv.Atoi(os.Getenv("DOWNLOAD_LINK_MAX_HOURS"))
+	if linkHours == 0 {
+		linkHours = 24
+	}
+	maxDownloadLinkLifetime = time.Duration(linkHours) * time.Hour
+}
 
 type loginReq struct {
-	Email    string `json:"email"`
-	Password string `json:"password"`
+	Email      string `json:"email"`
+	Password   string `json:"password"`
+	RememberMe bool   `json:"remember_me"`
+	InviteCode string `json:"invite_code"` // signup only, in invite-only mode
+	// BootstrapToken signs up the first admin whatever the mode; signup only
+	BootstrapToken string `json:"bootstrap_token"`
 }
 
 type loginResp struct {
-	Token string `json:"token"`
+	Token            string     `json:"token"`
+	ExpiresAt        time.Time  `json:"expires_at"`
+	RefreshToken     string     `json:"refresh_token,omitempty"`
+	RefreshExpiresAt *time.Time `json:"refresh_expires_at,omitempty"`
 }
 
 func SignupHandler(w http.ResponseWriter, r *http.Request) {
+	middleware.OmitRequestBody(r)
 	var req loginReq
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		http.Error(w, "bad request", http.StatusBadRequest)
@@ -40,13 +104,36 @@ func SignupHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "email and password required", http.StatusBadRequest)
 		return
 	}
-	if len(req.Password) < 6 {
-		http.Error(w, "password must be at least 6 characters", http.StatusBadRequest)
+	if !validPassword(w, r, req.Password) {
 		return
 	}
 
 	ctx := r.Context()
-	existing, err := store.FindUserByEmail(ctx, req.Email)
+	email := strings.ToLower(strings.TrimSpace(req.Email))
+	// Nothing vouches for the email here, so ADMIN_EMAILS doesn't let it past the mode
+	bootstrap := req.BootstrapToken != ""
+	if bootstrap {
+		ok, err := checkBootstrapToken(ctx, req.BootstrapToken)
+		if err != nil {
+			http.Error(w, "server error", http.StatusInternalServerError)
+			return
+		}
+		if !ok {
+			http.Error(w, "invalid bootstrap token", http.StatusForbidden)
+			return
+		}
+	}
+	if registrationMode == RegistrationClosed && !bootstrap {
+		http.Error(w, "registration is closed", http.StatusForbidden)
+		return
+	}
+	needInvite := registrationMode == RegistrationInviteOnly && !bootstrap
+	if needInvite && strings.TrimSpace(req.InviteCode) == "" {
+		http.Error(w, "invite code required", http.StatusForbidden)
+		return
+	}
+
+	existing, err := store.FindUserByEmail(ctx, email)
 	if err != nil {
 		http.Error(w, "server error", http.StatusInternalServerError)
 		return
@@ -62,13 +149,34 @@ func SignupHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Use up the invite before creating the account, so two signups can't share it
+	var inviteHash string
+	if needInvite {
+		inviteHash = HashInviteCode(req.InviteCode)
+		ok, err := store.RedeemInvite(ctx, inviteHash, email)
+		if err != nil {
+			http.Error(w, "server error", http.StatusInternalServerError)
+			return
+		}
+		if !ok {
+			http.Error(w, "invalid invite code", http.StatusForbidden)
+			return
+		}
+	}
+
 	u := &models.User{
-		Email:         strings.ToLower(strings.TrimSpace(req.Email)),
+		Email:         email,
 		PasswordsHash: passHash,
 		DriveAccounts: []models.DriveAccount{},
 	}
+	if bootstrap {
+		u.Role = models.RoleAdmin
+	}
 
 	if err := store.CreateUser(ctx, u); err != nil {
+		if inviteHash != "" {
+			store.ReleaseInvite(ctx, inviteHash)
+		}
 		http.Error(w, "create user failed", http.StatusInternalServerError)
 		return
 	}
@@ -79,6 +187,7 @@ func SignupHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func LoginHandler(w http.ResponseWriter, r *http.Request) {
+	middleware.OmitRequestBody(r)
 	var req loginReq
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		http.Error(w, "bad request", http.StatusBadRequest)
@@ -86,58 +195,216 @@ func LoginHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	ctx := r.Context()
-	u, err := store.FindUserByEmail(ctx, strings.ToLower(strings.TrimSpace(req.Email)))
+	email := strings.ToLower(strings.TrimSpace(req.Email))
+	u, err := store.FindUserByEmail(ctx, email)
 	if err != nil {
 		http.Error(w, "server error", http.StatusInternalServerError)
 		return
 	}
 	if u == nil {
+		audit.Record(r, models.AuditEvent{Email: email, Action: models.AuditLoginFailed, Detail: "unknown email"})
 		http.Error(w, "invalid credentials", http.StatusUnauthorized)
 		return
 	}
 
 	if err := bcrypt.CompareHashAndPassword(u.PasswordsHash, []byte(req.Password)); err != nil {
+		audit.Record(r, models.AuditEvent{UserID: u.ID, Email: email, Action: models.AuditLoginFailed, Detail: "wrong password"})
+		http.Error(w, "invalid credentials", http.StatusUnauthorized)
+		return
+	}
+
+	audit.Record(r, models.AuditEvent{UserID: u.ID, Email: email, Action: models.AuditLoginSucceeded, Detail: "password"})
+	RespondWithLogin(w, r, u.ID, req.RememberMe)
+}
+
+// ChangePasswordHandler - POST /api/password/change
+// Replaces the password and ends every other login, returning tokens for this one
+func ChangePasswordHandler(w http.ResponseWriter, r *http.Request) {
+	middleware.OmitRequestBody(r)
+	userID := r.Context().Value("userID").(primitive.ObjectID)
+
+	var req struct {
+		CurrentPassword string `json:"current_password"`
+		NewPassword     string `json:"new_password"`
+		RememberMe      bool   `json:"remember_me"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+	if !validPassword(w, r, req.NewPassword) {
+		return
+	}
+
+	ctx := r.Context()
+	u, err := store.GetUserByID(ctx, userID)
+	if err != nil || u == nil {
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+	// Accounts made by Google sign-in have no password to check
+	if len(u.PasswordsHash) == 0 {
+		http.Error(w, "account has no password", http.StatusConflict)
+		return
+	}
+	if err := bcrypt.CompareHashAndPassword(u.PasswordsHash, []byte(req.CurrentPassword)); err != nil {
 		http.Error(w, "invalid credentials", http.StatusUnauthorized)
 		return
 	}
 
-	tokenString, err := generateJWT(u.ID.Hex())
+	passHash, err := bcrypt.GenerateFromPassword([]byte(req.NewPassword), bcrypt.DefaultCost)
+	if err != nil {
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+	// Token issue times are in whole seconds, so the cutoff is too
+	if err := store.SetUserPassword(ctx, userID, passHash, time.Now().UTC().Truncate(time.Second)); err != nil {
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+	if err := store.RevokeUserRefreshTokens(ctx, userID); err != nil {
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+	log.Printf("User %s changed their password, other logins ended", userID.Hex())
+	audit.Record(r, models.AuditEvent{UserID: userID, Action: models.AuditPasswordChanged})
+
+	RespondWithLogin(w, r, userID, req.RememberMe)
+}
+
+// RespondWithLogin answers a successful login of the user with an access token and the first
+// refresh token of a new family
+func RespondWithLogin(w http.ResponseWriter, r *http.Request, userID primitive.ObjectID, rememberMe bool) {
+	// Whoever reads the tokens in the log is logged in as the user
+	middleware.OmitResponseBody(r)
+	var resp loginResp
+	var err error
+	familyID := primitive.NewObjectID()
+	resp.Token, resp.ExpiresAt, err = generateJWT(userID.Hex(), familyID.Hex(), tokenAccess, tokenLifetime)
+	if err != nil {
+		http.Error(w, "token gen failed", http.StatusInternalServerError)
+		return
+	}
+	// The family buys access tokens until the login expires; remember me makes that a lot longer
+	now := time.Now().UTC()
+	refreshExp := now.Add(sessionLifetime)
+	if rememberMe {
+		refreshExp = now.Add(refreshTokenLifetime)
+	}
+	resp.RefreshToken, err = issueRefreshToken(r, userID, familyID, now, refreshExp)
 	if err != nil {
 		http.Error(w, "token gen failed", http.StatusInternalServerError)
 		return
 	}
+	resp.RefreshExpiresAt = &refreshExp
 
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(loginResp{Token: tokenString})
+	json.NewEncoder(w).Encode(resp)
+}
+
+// Errors of ExternalLogin, for a new user REGISTRATION_MODE doesn't let in
+var (
+	ErrRegistrationClosed = errors.New("registration is closed")
+	ErrInviteRequired     = errors.New("invite code required")
+	ErrInvalidInvite      = errors.New("invalid invite code")
+	// ErrUnverifiedAccount is for an email that signed up with a password that hasn't been verified
+	ErrUnverifiedAccount = errors.New("an account with this email signed up with a password")
+)
+
+// ExternalLogin returns the user with an email an identity provider has verified, signing them
+// up without a password if there is none yet. inviteHash is the hashed invite code the signup
+// uses in invite-only mode.
+// An unverified account with a password is refused with ErrUnverifiedAccount: anyone can sign
+// up with someone else's email, and taking it over would keep their password working.
+func ExternalLogin(ctx context.Context, email, inviteHash string) (*models.User, error) {
+	email = strings.ToLower(strings.TrimSpace(email))
+	u, err := store.FindUserByEmail(ctx, email)
+	if err != nil {
+		return nil, err
+	}
+	if u != nil {
+		if !u.EmailVerified && len(u.PasswordsHash) > 0 {
+			return nil, ErrUnverifiedAccount
+		}
+		if !u.EmailVerified {
+			if err := store.SetUserEmailVerified(ctx, u.ID); err != nil {
+				return nil, err
+			}
+			u.EmailVerified = true
+		}
+		return u, nil
+	}
+
+	bootstrap := isAdminEmail(email)
+	if registrationMode == RegistrationClosed && !bootstrap {
+		return nil, ErrRegistrationClosed
+	}
+	needInvite := registrationMode == RegistrationInviteOnly && !bootstrap
+	if needInvite {
+		if inviteHash == "" {
+			return nil, ErrInviteRequired
+		}
+		ok, err := store.RedeemInvite(ctx, inviteHash, email)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			return nil, ErrInvalidInvite
+		}
+	}
+
+	// Without a password hash, password logins always fail
+	u = &models.User{
+		Email:         email,
+		DriveAccounts: []models.DriveAccount{},
+		EmailVerified: true,
+	}
+	if err := store.CreateUser(ctx, u); err != nil {
+		if needInvite {
+			store.ReleaseInvite(ctx, inviteHash)
+		}
+		return nil, err
+	}
+	return u, nil
 }
 
-func generateJWT(userID string) (string, error) {
+// generateJWT signs a token of the given type for the login sessionID, returning it with its expiry
+func generateJWT(userID, sessionID, typ string, lifetime time.Duration) (string, time.Time, error) {
+	now := time.Now()
+	exp := now.Add(lifetime)
 	claims := jwt.MapClaims{
 		"sub": userID,
-		"exp": time.Now().Add(24 * time.Hour).Unix(), // 24 hours instead of 15 minutes
-		"iat": time.Now().Unix(),
+		"sid": sessionID,
+		"typ": typ,
+		"exp": exp.Unix(),
+		"iat": now.Unix(),
 	}
-	t := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	return t.SignedString(jwtSecret)
+	signed, err := signJWT(claims)
+	return signed, exp, err
 }
 
-// parse and validate JWT, return userID
-func parseJWT(tokenStr string) (string, error) {
-	tkn, err := jwt.Parse(tokenStr, func(t *jwt.Token) (interface{}, error) {
-		if t.Method != jwt.SigningMethodHS256 {
-			return nil, errors.New("unexpected signing method")
-		}
-		return jwtSecret, nil
-	})
+// parse and validate JWT of the given type, return userID, the login session it belongs to and
+// when it was issued. Tokens from before sessions were named have no session.
+func parseJWT(tokenStr, typ string) (string, string, time.Time, error) {
+	tkn, err := jwt.Parse(tokenStr, verifyKey)
 	if err != nil || !tkn.Valid {
-		return "", errors.New("invalid token")
+		return "", "", time.Time{}, errors.New("invalid token")
 	}
 	if claims, ok := tkn.Claims.(jwt.MapClaims); ok {
+		// A refresh token must not pass as an access token, nor the other way round
+		if got, _ := claims["typ"].(string); got != typ && !(got == "" && typ == tokenAccess) {
+			return "", "", time.Time{}, errors.New("wrong token type")
+		}
+		iat, err := claims.GetIssuedAt()
+		if err != nil || iat == nil {
+			return "", "", time.Time{}, errors.New("invalid claims")
+		}
+		sid, _ := claims["sid"].(string)
 		if sub, ok := claims["sub"].(string); ok {
-			return sub, nil
+			return sub, sid, iat.Time, nil
 		}
 	}
-	return "", errors.New("invalid claims")
+	return "", "", time.Time{}, errors.New("invalid claims")
 }
 
 // middleware that extracts bearer token and sets user id context
@@ -157,7 +424,7 @@ func AuthMiddleware(next http.HandlerFunc) http.HandlerFunc {
 			return
 		}
 
-		uid, err := parseJWT(tok)
+		uid, sid, issuedAt, err := parseJWT(tok, tokenAccess)
 		if err != nil {
 			http.Error(w, "unauthorized", http.StatusUnauthorized)
 			return
@@ -169,8 +436,84 @@ func AuthMiddleware(next http.HandlerFunc) http.HandlerFunc {
 			return
 		}
 
+		// Tokens from before a password change no longer count
+		u, err := store.GetUserByID(r.Context(), oid)
+		if err != nil {
+			http.Error(w, "server error", http.StatusInternalServerError)
+			return
+		}
+		if u == nil || (u.TokensValidAfter != nil && issuedAt.Before(*u.TokensValidAfter)) {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		// Nor do tokens of a login that was logged out or revoked
+		if familyID, err := primitive.ObjectIDFromHex(sid); err == nil {
+			revoked, err := store.IsRefreshTokenFamilyRevoked(r.Context(), familyID)
+			if err != nil {
+				http.Error(w, "server error", http.StatusInternalServerError)
+				return
+			}
+			if revoked {
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+				return
+			}
+		}
+
 		// add to context
 		ctx := context.WithValue(r.Context(), "userID", oid)
+		ctx = context.WithValue(ctx, "sessionID", sid)
 		next.ServeHTTP(w, r.WithContext(ctx))
 	}
 }
+
+// AdminMiddleware only lets through admins: users with the admin role, and users whose verified
+// email is listed in ADMIN_EMAILS (comma-separated), so a first admin can be set up
+func AdminMiddleware(next http.HandlerFunc) http.HandlerFunc {
+	return AuthMiddleware(func(w http.ResponseWriter, r *http.Request) {
+		userID := r.Context().Value("userID").(primitive.ObjectID)
+		user, err := store.GetUserByID(r.Context(), userID)
+		if err != nil {
+			http.Error(w, "server error", http.StatusInternalServerError)
+			return
+		}
+		if user == nil || !IsAdmin(user) {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// IsAdmin reports whether the user has the admin role, or has a verified email listed in
+// ADMIN_EMAILS. Anyone can sign up with a password under an address they don't own.
+func IsAdmin(u *models.User) bool {
+	return u.Role == models.RoleAdmin || (u.EmailVerified && isAdminEmail(u.Email))
+}
+
+// checkBootstrapToken tells whether token is BOOTSTRAP_TOKEN and there is no admin yet, so
+// the token only makes one
+func checkBootstrapToken(ctx context.Context, token string) (bool, error) {
+	if bootstrapToken == "" || subtle.ConstantTimeCompare([]byte(token), []byte(bootstrapToken)) != 1 {
+		return false, nil
+	}
+	users, err := store.ListUsers(ctx)
+	if err != nil {
+		return false, err
+	}
+	for _, u := range users {
+		if IsAdmin(u) {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+func isAdminEmail(email string) bool {
+	for _, admin := range strings.Split(os.Getenv("ADMIN_EMAILS"), ",") {
+		if admin = strings.TrimSpace(admin); admin != "" && strings.EqualFold(admin, email) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,162 @@
+package auth_test
+
+import (
+	"SE/internal/auth"
+	"SE/internal/middleware"
+	"SE/internal/models"
+	"SE/internal/store"
+	"SE/internal/store/storetest"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestMain(m *testing.M) {
+	os.Exit(storetest.Run(m))
+}
+
+// setup starts a test with an empty store and the token, password and registration config
+// read from the env, after any of it set with t.Setenv
+func setup(t *testing.T) {
+	t.Helper()
+	storetest.Setup(t)
+	if _, ok := os.LookupEnv("JWT_SECRET"); !ok {
+		t.Setenv("JWT_SECRET", "auth-test-secret")
+	}
+	if err := auth.InitJWTKeys(); err != nil {
+		t.Fatal(err)
+	}
+	auth.InitTokenConfig()
+	if err := auth.InitPasswordPolicy(); err != nil {
+		t.Fatal(err)
+	}
+	if err := auth.InitRegistrationMode(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// call runs a handler and fails the test unless it answers with status want
+func call(t *testing.T, h http.HandlerFunc, r *http.Request, want int) *httptest.ResponseRecorder {
+	t.Helper()
+	w := httptest.NewRecorder()
+	h(w, r)
+	if w.Code != want {
+		t.Fatalf("%s %s: status %d, want %d: %s", r.Method, r.URL, w.Code, want, w.Body)
+	}
+	return w
+}
+
+// logged is call with h behind the request logger, also returning what it logged
+func logged(t *testing.T, h http.HandlerFunc, r *http.Request, want int) (*httptest.ResponseRecorder, string) {
+	t.Helper()
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+	return call(t, middleware.Logger(h).ServeHTTP, r, want), buf.String()
+}
+
+// tokens is the body of a login or refresh response
+type tokens struct {
+	Token        string `json:"token"`
+	RefreshToken string `json:"refresh_token"`
+}
+
+func decodeTokens(t *testing.T, w *httptest.ResponseRecorder) tokens {
+	t.Helper()
+	var tok tokens
+	if err := json.NewDecoder(w.Body).Decode(&tok); err != nil || tok.Token == "" || tok.RefreshToken == "" {
+		t.Fatalf("login response without tokens: %v", err)
+	}
+	return tok
+}
+
+// login signs in a new user and returns the user with the tokens of the login
+func login(t *testing.T) (*models.User, tokens) {
+	t.Helper()
+	u := storetest.User(t)
+	return u, loginAgain(t, u)
+}
+
+// loginAgain signs in a user of login once more, for the tokens of another login
+func loginAgain(t *testing.T, u *models.User) tokens {
+	t.Helper()
+	w := call(t, auth.LoginHandler, post(t, "/api/login", map[string]string{"email": u.Email, "password": storetest.Password}), http.StatusOK)
+	return decodeTokens(t, w)
+}
+
+// authed returns the status AuthMiddleware answers a request with the access token with,
+// 200 if it lets the request through
+func authed(t *testing.T, token string) int {
+	t.Helper()
+	r := httptest.NewRequest("GET", "/api/files", nil)
+	r.Header.Set("Authorization", "Bearer "+token)
+	w := httptest.NewRecorder()
+	auth.AuthMiddleware(func(w http.ResponseWriter, r *http.Request) {})(w, r)
+	return w.Code
+}
+
+// post builds a JSON POST request
+func post(t *testing.T, target string, body any) *http.Request {
+	t.Helper()
+	b, err := json.Marshal(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest("POST", target, bytes.NewReader(b))
+	r.Header.Set("Content-Type", "application/json")
+	return r
+}
+
+func TestExternalLoginPasswordAccount(t *testing.T) {
+	t.Setenv("ADMIN_EMAILS", "victim@example.com")
+	setup(t)
+	ctx := context.Background()
+
+	// Someone signs up with a password under an address they don't own
+	call(t, auth.SignupHandler, post(t, "/api/signup", map[string]string{"email": "Victim@example.com", "password": "attacker-pass"}), http.StatusCreated)
+
+	if _, err := auth.ExternalLogin(ctx, "victim@example.com", ""); !errors.Is(err, auth.ErrUnverifiedAccount) {
+		t.Fatalf("Google sign-in over an unverified password account = %v, want ErrUnverifiedAccount", err)
+	}
+	u, _ := store.FindUserByEmail(ctx, "victim@example.com")
+	if u.EmailVerified || auth.IsAdmin(u) {
+		t.Error("refused Google sign-in verified the account or made it an admin")
+	}
+	call(t, auth.LoginHandler, post(t, "/api/login", map[string]string{"email": "victim@example.com", "password": "attacker-pass"}), http.StatusOK)
+
+	// An account Google signed up is signed in again
+	first, err := auth.ExternalLogin(ctx, "owner@example.com", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, err := auth.ExternalLogin(ctx, " Owner@example.com", "")
+	if err != nil || again.ID != first.ID || !again.EmailVerified {
+		t.Errorf("second Google sign-in = %+v, %v, want the same verified user", again, err)
+	}
+}
+
+func TestTokensKeptOutOfLog(t *testing.T) {
+	setup(t)
+	creds := map[string]string{"email": "user@example.com", "password": "log-me-not-pass"}
+
+	_, signup := logged(t, auth.SignupHandler, post(t, "/api/signup", creds), http.StatusCreated)
+	w, login := logged(t, auth.LoginHandler, post(t, "/api/login", creds), http.StatusOK)
+	first := decodeTokens(t, w)
+	w, refresh := logged(t, auth.RefreshHandler, post(t, "/api/auth/refresh", map[string]string{"refresh_token": first.RefreshToken}), http.StatusOK)
+	second := decodeTokens(t, w)
+	_, logout := logged(t, auth.LogoutHandler, post(t, "/api/auth/logout", map[string]string{"refresh_token": second.RefreshToken}), http.StatusOK)
+
+	out := signup + login + refresh + logout
+	for _, secret := range []string{creds["password"], first.Token, first.RefreshToken, second.Token, second.RefreshToken} {
+		if strings.Contains(out, secret) {
+			t.Errorf("%q in the request log:\n%s", secret, out)
+		}
+	}
+}
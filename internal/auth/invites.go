@@ -0,0 +1,149 @@
+package auth
+
+import (
+	"SE/internal/models"
+	"SE/internal/store"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Registration modes, set with REGISTRATION_MODE
+const (
+	RegistrationOpen       = "open"        // anyone can sign up
+	RegistrationInviteOnly = "invite-only" // signup needs an unused invite code
+	RegistrationClosed     = "closed"      // no signups
+)
+
+// registrationMode decides who may sign up. Google sign-ins of emails in ADMIN_EMAILS, and a
+// password signup with the bootstrap token, get in whatever the mode.
+var registrationMode = RegistrationOpen
+
+// bootstrapToken, from BOOTSTRAP_TOKEN, signs up the first admin with a password. It stops
+// working once there is an admin.
+var bootstrapToken string
+
+// InitRegistrationMode reads REGISTRATION_MODE, defaulting to open, and BOOTSTRAP_TOKEN
+func InitRegistrationMode() error {
+	bootstrapToken = strings.TrimSpace(os.Getenv("BOOTSTRAP_TOKEN"))
+	mode := strings.ToLower(strings.TrimSpace(os.Getenv("REGISTRATION_MODE")))
+	switch mode {
+	case "":
+		registrationMode = RegistrationOpen
+	case "invite":
+		// Short form of invite-only
+		registrationMode = RegistrationInviteOnly
+	case RegistrationOpen, RegistrationInviteOnly, RegistrationClosed:
+		registrationMode = mode
+	default:
+		return fmt.Errorf("REGISTRATION_MODE %q must be open, invite-only (or invite) or closed", mode)
+	}
+	return nil
+}
+
+// RegistrationMode returns the configured registration mode
+func RegistrationMode() string {
+	return registrationMode
+}
+
+// HashInviteCode is how invite codes are stored, so a leaked database doesn't hand out signups
+func HashInviteCode(code string) string {
+	sum := sha256.Sum256([]byte(strings.TrimSpace(code)))
+	return hex.EncodeToString(sum[:])
+}
+
+// CreateInviteHandler - POST /api/admin/invites
+// Creates a single-use invite code; the code is only returned here
+func CreateInviteHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Note           string `json:"note"`
+		ExpiresInHours int    `json:"expires_in_hours"` // 0 never expires
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+	if req.ExpiresInHours < 0 {
+		http.Error(w, "expires_in_hours must not be negative", http.StatusBadRequest)
+		return
+	}
+
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+	code := base64.RawURLEncoding.EncodeToString(buf)
+
+	inv := &models.Invite{
+		CodeHash:  HashInviteCode(code),
+		Note:      req.Note,
+		CreatedBy: r.Context().Value("userID").(primitive.ObjectID),
+	}
+	if req.ExpiresInHours > 0 {
+		exp := time.Now().UTC().Add(time.Duration(req.ExpiresInHours) * time.Hour)
+		inv.ExpiresAt = &exp
+	}
+	if err := store.CreateInvite(r.Context(), inv); err != nil {
+		log.Printf("Failed to create invite: %v", err)
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(struct {
+		*models.Invite
+		Code string `json:"code"`
+	}{inv, code})
+}
+
+// ListInvitesHandler - GET /api/admin/invites
+// All invites, newest first, with who used them
+func ListInvitesHandler(w http.ResponseWriter, r *http.Request) {
+	invites, err := store.ListInvites(r.Context())
+	if err != nil {
+		log.Printf("Failed to list invites: %v", err)
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"registration_mode": registrationMode,
+		"invites":           invites,
+	})
+}
+
+// DeleteInviteHandler - DELETE /api/admin/invites/:id
+// Revokes an invite
+func DeleteInviteHandler(w http.ResponseWriter, r *http.Request) {
+	inviteID, err := primitive.ObjectIDFromHex(strings.TrimPrefix(r.URL.Path, "/api/admin/invites/"))
+	if err != nil {
+		http.Error(w, "invalid invite id", http.StatusBadRequest)
+		return
+	}
+
+	found, err := store.DeleteInvite(r.Context(), inviteID)
+	if err != nil {
+		log.Printf("Failed to delete invite %s: %v", inviteID.Hex(), err)
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+	if !found {
+		http.Error(w, "invite not found", http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,172 @@
+package auth_test
+
+import (
+	"SE/internal/auth"
+	"SE/internal/store/storetest"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// signup signs up email with a password and the invite code, returning the status
+func signup(t *testing.T, email, inviteCode string) int {
+	t.Helper()
+	w := httptest.NewRecorder()
+	auth.SignupHandler(w, post(t, "/api/signup", map[string]string{"email": email, "password": "signup-pass", "invite_code": inviteCode}))
+	return w.Code
+}
+
+// invite creates an invite as an admin and returns its code and id
+func invite(t *testing.T) (string, primitive.ObjectID) {
+	t.Helper()
+	w := call(t, auth.CreateInviteHandler, storetest.Request("POST", "/api/admin/invites", strings.NewReader(`{"note": "test"}`), primitive.NewObjectID()), http.StatusCreated)
+	var inv struct {
+		ID   primitive.ObjectID `json:"id"`
+		Code string             `json:"code"`
+	}
+	json.NewDecoder(w.Body).Decode(&inv)
+	if inv.Code == "" {
+		t.Fatal("invite without a code")
+	}
+	return inv.Code, inv.ID
+}
+
+func TestRegistrationOpen(t *testing.T) {
+	setup(t)
+	if mode := auth.RegistrationMode(); mode != auth.RegistrationOpen {
+		t.Fatalf("mode without REGISTRATION_MODE = %q, want open", mode)
+	}
+	if got := signup(t, "anyone@example.com", ""); got != http.StatusCreated {
+		t.Errorf("open signup: %d, want 201", got)
+	}
+	if _, err := auth.ExternalLogin(context.Background(), "google@example.com", ""); err != nil {
+		t.Errorf("open Google signup: %v", err)
+	}
+}
+
+func TestRegistrationClosed(t *testing.T) {
+	t.Setenv("REGISTRATION_MODE", "closed")
+	t.Setenv("BOOTSTRAP_TOKEN", "bootstrap-token")
+	t.Setenv("ADMIN_EMAILS", "boss@example.com")
+	setup(t)
+	ctx := context.Background()
+
+	if got := signup(t, "anyone@example.com", ""); got != http.StatusForbidden {
+		t.Errorf("closed signup: %d, want 403", got)
+	}
+	if _, err := auth.ExternalLogin(ctx, "google@example.com", ""); !errors.Is(err, auth.ErrRegistrationClosed) {
+		t.Errorf("closed Google signup = %v, want ErrRegistrationClosed", err)
+	}
+	code, _ := invite(t)
+	if got := signup(t, "invited@example.com", code); got != http.StatusForbidden {
+		t.Errorf("closed signup with an invite: %d, want 403", got)
+	}
+
+	// The bootstrap token makes the first admin, and only the first
+	bootstrap := func(email string) int {
+		w := httptest.NewRecorder()
+		auth.SignupHandler(w, post(t, "/api/signup", map[string]string{"email": email, "password": "signup-pass", "bootstrap_token": "bootstrap-token"}))
+		return w.Code
+	}
+	if got := bootstrap("first@example.com"); got != http.StatusCreated {
+		t.Fatalf("bootstrap signup: %d, want 201", got)
+	}
+	if got := bootstrap("second@example.com"); got != http.StatusForbidden {
+		t.Errorf("bootstrap signup with an admin already there: %d, want 403", got)
+	}
+
+	// Google vouches for the ADMIN_EMAILS address, so it gets in
+	if _, err := auth.ExternalLogin(ctx, "boss@example.com", ""); err != nil {
+		t.Errorf("closed Google signup of an ADMIN_EMAILS address: %v", err)
+	}
+}
+
+func TestRegistrationInviteOnly(t *testing.T) {
+	// "invite" is short for invite-only
+	for _, mode := range []string{"invite-only", "invite", " Invite "} {
+		t.Run(mode, func(t *testing.T) {
+			t.Setenv("REGISTRATION_MODE", mode)
+			setup(t)
+			ctx := context.Background()
+			if got := auth.RegistrationMode(); got != auth.RegistrationInviteOnly {
+				t.Fatalf("REGISTRATION_MODE=%q is mode %q, want invite-only", mode, got)
+			}
+
+			if got := signup(t, "uninvited@example.com", ""); got != http.StatusForbidden {
+				t.Errorf("signup without an invite: %d, want 403", got)
+			}
+			if got := signup(t, "guess@example.com", "made-up-code"); got != http.StatusForbidden {
+				t.Errorf("signup with an unknown invite: %d, want 403", got)
+			}
+
+			code, _ := invite(t)
+			if got := signup(t, "invited@example.com", code); got != http.StatusCreated {
+				t.Fatalf("signup with an invite: %d, want 201", got)
+			}
+			// An invite works once
+			if got := signup(t, "friend@example.com", code); got != http.StatusForbidden {
+				t.Errorf("signup with a used invite: %d, want 403", got)
+			}
+			if _, err := auth.ExternalLogin(ctx, "friend@example.com", auth.HashInviteCode(code)); !errors.Is(err, auth.ErrInvalidInvite) {
+				t.Errorf("Google signup with a used invite = %v, want ErrInvalidInvite", err)
+			}
+
+			if _, err := auth.ExternalLogin(ctx, "google@example.com", ""); !errors.Is(err, auth.ErrInviteRequired) {
+				t.Errorf("Google signup without an invite = %v, want ErrInviteRequired", err)
+			}
+			code, _ = invite(t)
+			if _, err := auth.ExternalLogin(ctx, "google@example.com", auth.HashInviteCode(code)); err != nil {
+				t.Errorf("Google signup with an invite: %v", err)
+			}
+
+			// A revoked invite doesn't work
+			code, id := invite(t)
+			call(t, auth.DeleteInviteHandler, httptest.NewRequest("DELETE", "/api/admin/invites/"+id.Hex(), nil), http.StatusNoContent)
+			if got := signup(t, "revoked@example.com", code); got != http.StatusForbidden {
+				t.Errorf("signup with a revoked invite: %d, want 403", got)
+			}
+		})
+	}
+}
+
+func TestInviteUsedOnce(t *testing.T) {
+	t.Setenv("REGISTRATION_MODE", "invite-only")
+	setup(t)
+	code, _ := invite(t)
+
+	// Signups racing for one invite: only one gets it
+	var wg sync.WaitGroup
+	codes := make([]int, 5)
+	for i := range codes {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			codes[i] = signup(t, fmt.Sprintf("racer%d@example.com", i), code)
+		}()
+	}
+	wg.Wait()
+	created := 0
+	for _, c := range codes {
+		if c == http.StatusCreated {
+			created++
+		}
+	}
+	if created != 1 {
+		t.Errorf("signups with one invite: %v, want one 201", codes)
+	}
+}
+
+func TestRegistrationModeInvalid(t *testing.T) {
+	t.Setenv("REGISTRATION_MODE", "sometimes")
+	if err := auth.InitRegistrationMode(); err == nil {
+		t.Error("REGISTRATION_MODE=sometimes accepted")
+	}
+}
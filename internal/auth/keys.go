@@ -0,0 +1,232 @@
+package auth
+
+import (
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"maps"
+	"math/big"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// jwtKey is a key tokens are signed and verified with. Tokens signed with a key that has
+// a kid carry it in their header, so the key can be found again after others are added.
+type jwtKey struct {
+	kid    string
+	method jwt.SigningMethod
+	// sign is nil for keys that only verify, such as a public key on its own
+	sign   interface{}
+	verify interface{}
+}
+
+var (
+	// signingKey signs new tokens
+	signingKey *jwtKey
+	// verifyKeys verifies tokens by kid; "" is JWT_SECRET, for tokens without a kid
+	verifyKeys map[string]*jwtKey
+)
+
+// InitJWTKeys loads the signing keys. JWT_KEYS lists "kid:secret" pairs, comma-separated, for
+// HS256, and JWT_KEY_FILES lists "kid:path" pairs of PEM files: RSA keys sign with RS256 and
+// Ed25519 keys with EdDSA, and a public key only verifies. JWT_SIGNING_KID names the key that
+// signs new tokens; without it that's the first JWT_KEYS entry, then the first private key file.
+// All of them verify. To rotate, sign with a new key and drop the old one once the tokens it
+// signed have expired. JWT_SECRET, if set, verifies tokens without a kid and signs new ones
+// when no other key does.
+func InitJWTKeys() error {
+	signingKey = nil
+	verifyKeys = make(map[string]*jwtKey)
+
+	if secret := os.Getenv("JWT_SECRET"); secret != "" {
+		verifyKeys[""] = &jwtKey{method: jwt.SigningMethodHS256, sign: []byte(secret), verify: []byte(secret)}
+	}
+	var first *jwtKey
+	for _, entry := range listEnv("JWT_KEYS") {
+		kid, secret, ok := strings.Cut(entry, ":")
+		if !ok || kid == "" || secret == "" {
+			return fmt.Errorf("JWT_KEYS entry %q must be kid:secret", entry)
+		}
+		key := &jwtKey{kid: kid, method: jwt.SigningMethodHS256, sign: []byte(secret), verify: []byte(secret)}
+		if err := addVerifyKey("JWT_KEYS", key); err != nil {
+			return err
+		}
+		if first == nil {
+			first = key
+		}
+	}
+	for _, entry := range listEnv("JWT_KEY_FILES") {
+		kid, path, ok := strings.Cut(entry, ":")
+		if !ok || kid == "" || path == "" {
+			return fmt.Errorf("JWT_KEY_FILES entry %q must be kid:path", entry)
+		}
+		key, err := loadKeyFile(kid, path)
+		if err != nil {
+			return fmt.Errorf("JWT_KEY_FILES %s: %w", kid, err)
+		}
+		if err := addVerifyKey("JWT_KEY_FILES", key); err != nil {
+			return err
+		}
+		if first == nil && key.sign != nil {
+			first = key
+		}
+	}
+
+	if kid := os.Getenv("JWT_SIGNING_KID"); kid != "" {
+		key, ok := verifyKeys[kid]
+		if !ok {
+			return fmt.Errorf("JWT_SIGNING_KID %q is not in JWT_KEYS or JWT_KEY_FILES", kid)
+		}
+		if key.sign == nil {
+			return fmt.Errorf("JWT_SIGNING_KID %q is a public key and can't sign", kid)
+		}
+		first = key
+	}
+	signingKey = first
+	if signingKey == nil {
+		signingKey = verifyKeys[""]
+	}
+	if signingKey == nil {
+		return errors.New("JWT_SECRET, JWT_KEYS or a private key in JWT_KEY_FILES is required")
+	}
+	return nil
+}
+
+// SigningKeyInfo describes the key new tokens are signed with, e.g. "RS256 kid 2025-01"
+func SigningKeyInfo() string {
+	if signingKey.kid == "" {
+		return signingKey.method.Alg() + " JWT_SECRET"
+	}
+	return signingKey.method.Alg() + " kid " + signingKey.kid
+}
+
+// listEnv splits a comma-separated env var, dropping empty entries
+func listEnv(name string) []string {
+	var out []string
+	for _, entry := range strings.Split(os.Getenv(name), ",") {
+		if entry = strings.TrimSpace(entry); entry != "" {
+			out = append(out, entry)
+		}
+	}
+	return out
+}
+
+// addVerifyKey adds key to the verification keys, refusing a kid that's already taken
+func addVerifyKey(env string, key *jwtKey) error {
+	if _, dup := verifyKeys[key.kid]; dup {
+		return fmt.Errorf("%s has kid %q, which is already in use", env, key.kid)
+	}
+	verifyKeys[key.kid] = key
+	return nil
+}
+
+// loadKeyFile reads an RSA or Ed25519 key from a PEM file: a PKCS#8 or PKCS#1 private key, or
+// a PKIX public key
+func loadKeyFile(kid, path string) (*jwtKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM block found")
+	}
+
+	var parsed interface{}
+	switch block.Type {
+	case "PRIVATE KEY":
+		parsed, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	case "RSA PRIVATE KEY":
+		parsed, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "PUBLIC KEY":
+		parsed, err = x509.ParsePKIXPublicKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("unsupported PEM block %q", block.Type)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	key := &jwtKey{kid: kid}
+	switch k := parsed.(type) {
+	case *rsa.PrivateKey:
+		key.method, key.sign, key.verify = jwt.SigningMethodRS256, k, &k.PublicKey
+	case *rsa.PublicKey:
+		key.method, key.verify = jwt.SigningMethodRS256, k
+	case ed25519.PrivateKey:
+		key.method, key.sign, key.verify = jwt.SigningMethodEdDSA, k, k.Public()
+	case ed25519.PublicKey:
+		key.method, key.verify = jwt.SigningMethodEdDSA, k
+	default:
+		return nil, fmt.Errorf("unsupported key type %T", parsed)
+	}
+	if k, ok := key.verify.(*rsa.PublicKey); ok && k.N.BitLen() < 2048 {
+		return nil, errors.New("RSA keys must be at least 2048 bits")
+	}
+	return key, nil
+}
+
+// signJWT signs claims with the signing key, naming it in the header if it has a kid
+func signJWT(claims jwt.Claims) (string, error) {
+	t := jwt.NewWithClaims(signingKey.method, claims)
+	if signingKey.kid != "" {
+		t.Header["kid"] = signingKey.kid
+	}
+	return t.SignedString(signingKey.sign)
+}
+
+// verifyKey finds the key a token was signed with
+func verifyKey(t *jwt.Token) (interface{}, error) {
+	// Tokens without a kid were signed with JWT_SECRET
+	kid, _ := t.Header["kid"].(string)
+	key, ok := verifyKeys[kid]
+	if !ok {
+		return nil, errors.New("unknown signing key")
+	}
+	// A token must use its key's algorithm, so a public key can't be passed off as an HMAC secret
+	if t.Method.Alg() != key.method.Alg() {
+		return nil, errors.New("unexpected signing method")
+	}
+	return key.verify, nil
+}
+
+// JWKSHandler - GET /.well-known/jwks.json
+// Publishes the public keys of JWT_KEY_FILES so other services can verify tokens; secrets stay out
+func JWKSHandler(w http.ResponseWriter, r *http.Request) {
+	keys := []map[string]string{}
+	for _, kid := range slices.Sorted(maps.Keys(verifyKeys)) {
+		key := verifyKeys[kid]
+		var jwk map[string]string
+		switch k := key.verify.(type) {
+		case *rsa.PublicKey:
+			jwk = map[string]string{
+				"kty": "RSA",
+				"n":   base64.RawURLEncoding.EncodeToString(k.N.Bytes()),
+				"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(k.E)).Bytes()),
+			}
+		case ed25519.PublicKey:
+			jwk = map[string]string{
+				"kty": "OKP",
+				"crv": "Ed25519",
+				"x":   base64.RawURLEncoding.EncodeToString(k),
+			}
+		default:
+			continue
+		}
+		jwk["kid"], jwk["alg"], jwk["use"] = key.kid, key.method.Alg(), "sig"
+		keys = append(keys, jwk)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	json.NewEncoder(w).Encode(map[string]interface{}{"keys": keys})
+}
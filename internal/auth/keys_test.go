@@ -0,0 +1,171 @@
+package auth_test
+
+import (
+	"SE/internal/auth"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// header returns the kid and alg a token names in its header
+func header(t *testing.T, token string) (kid, alg string) {
+	t.Helper()
+	parsed, _, err := jwt.NewParser().ParseUnverified(token, jwt.MapClaims{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	kid, _ = parsed.Header["kid"].(string)
+	return kid, parsed.Method.Alg()
+}
+
+// writePEM writes a PEM block to a file in the test's temp dir and returns its path
+func writePEM(t *testing.T, name, typ string, der []byte) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestKeyRotation(t *testing.T) {
+	t.Setenv("JWT_KEYS", "old:old-secret")
+	setup(t)
+	_, before := login(t)
+	if kid, _ := header(t, before.Token); kid != "old" {
+		t.Fatalf("token signed with kid %q, want old", kid)
+	}
+
+	// A new key signs, and tokens of the old one keep working until it's dropped
+	t.Setenv("JWT_KEYS", "new:new-secret,old:old-secret")
+	t.Setenv("JWT_SIGNING_KID", "new")
+	if err := auth.InitJWTKeys(); err != nil {
+		t.Fatal(err)
+	}
+	_, after := login(t)
+	if kid, _ := header(t, after.Token); kid != "new" {
+		t.Errorf("token signed with kid %q after rotation, want new", kid)
+	}
+	if got := authed(t, before.Token); got != http.StatusOK {
+		t.Errorf("token of the old key while it still verifies: %d, want 200", got)
+	}
+
+	t.Setenv("JWT_KEYS", "new:new-secret")
+	if err := auth.InitJWTKeys(); err != nil {
+		t.Fatal(err)
+	}
+	if got := authed(t, before.Token); got != http.StatusUnauthorized {
+		t.Errorf("token of a dropped key: %d, want 401", got)
+	}
+	if got := authed(t, after.Token); got != http.StatusOK {
+		t.Errorf("token of the signing key: %d, want 200", got)
+	}
+
+	t.Setenv("JWT_SIGNING_KID", "gone")
+	if err := auth.InitJWTKeys(); err == nil {
+		t.Error("JWT_SIGNING_KID of no key accepted")
+	}
+}
+
+func TestKeyFiles(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name string
+		key  crypto.Signer
+		alg  string
+	}{
+		{"rsa", rsaKey, "RS256"},
+		{"ed25519", edKey, "EdDSA"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			der, err := x509.MarshalPKCS8PrivateKey(tc.key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Setenv("JWT_KEY_FILES", "file-key:"+writePEM(t, "key.pem", "PRIVATE KEY", der))
+			setup(t)
+
+			_, tok := login(t)
+			if kid, alg := header(t, tok.Token); kid != "file-key" || alg != tc.alg {
+				t.Fatalf("token signed with %s kid %q, want %s kid file-key", alg, kid, tc.alg)
+			}
+			if got := authed(t, tok.Token); got != http.StatusOK {
+				t.Errorf("token of the key file: %d, want 200", got)
+			}
+
+			// JWKS has the public key, which verifies the token, and not JWT_SECRET
+			w := call(t, auth.JWKSHandler, httptest.NewRequest("GET", "/.well-known/jwks.json", nil), http.StatusOK)
+			var jwks struct {
+				Keys []map[string]string `json:"keys"`
+			}
+			json.NewDecoder(w.Body).Decode(&jwks)
+			if len(jwks.Keys) != 1 || jwks.Keys[0]["kid"] != "file-key" || jwks.Keys[0]["alg"] != tc.alg {
+				t.Fatalf("jwks = %v, want only file-key", jwks.Keys)
+			}
+			public := jwkPublicKey(t, jwks.Keys[0])
+			if _, err := jwt.Parse(tok.Token, func(*jwt.Token) (interface{}, error) { return public, nil }, jwt.WithValidMethods([]string{tc.alg})); err != nil {
+				t.Errorf("token doesn't verify with the published key: %v", err)
+			}
+
+			// The public key can't be passed off as an HMAC secret
+			pubDER, err := x509.MarshalPKIXPublicKey(tc.key.Public())
+			if err != nil {
+				t.Fatal(err)
+			}
+			forged := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{"sub": "000000000000000000000000", "iat": 1})
+			forged.Header["kid"] = "file-key"
+			signed, _ := forged.SignedString(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pubDER}))
+			if got := authed(t, signed); got != http.StatusUnauthorized {
+				t.Errorf("HS256 token signed with the public key: %d, want 401", got)
+			}
+
+			// A public key on its own only verifies
+			t.Setenv("JWT_KEY_FILES", "pub:"+writePEM(t, "pub.pem", "PUBLIC KEY", pubDER))
+			t.Setenv("JWT_SIGNING_KID", "pub")
+			if err := auth.InitJWTKeys(); err == nil {
+				t.Error("public key accepted as the signing key")
+			}
+		})
+	}
+}
+
+// jwkPublicKey decodes the public key of a JWKS entry
+func jwkPublicKey(t *testing.T, jwk map[string]string) interface{} {
+	t.Helper()
+	decode := func(field string) []byte {
+		b, err := base64.RawURLEncoding.DecodeString(jwk[field])
+		if err != nil {
+			t.Fatalf("jwk %s: %v", field, err)
+		}
+		return b
+	}
+	switch jwk["kty"] {
+	case "RSA":
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(decode("n")), E: int(new(big.Int).SetBytes(decode("e")).Int64())}
+	case "OKP":
+		return ed25519.PublicKey(decode("x"))
+	}
+	t.Fatalf("jwk of unknown kty %q", jwk["kty"])
+	return nil
+}
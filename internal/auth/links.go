@@ -0,0 +1,90 @@
+package auth
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// tokenDownload is the "typ" of a signed download link
+const tokenDownload = "download"
+
+// DownloadLink is what a signed download link grants: one file of one user, or one chunk of
+// it, until ExpiresAt
+type DownloadLink struct {
+	ID        string // random, to tell one-time links apart once used
+	UserID    primitive.ObjectID
+	FileID    primitive.ObjectID
+	ChunkID   int // 0 for the whole file
+	OneTime   bool
+	ExpiresAt time.Time
+}
+
+// DownloadLinkLifetimes returns how long a download link is valid by default and at most
+func DownloadLinkLifetimes() (def, limit time.Duration) {
+	return min(downloadLinkLifetime, maxDownloadLinkLifetime), maxDownloadLinkLifetime
+}
+
+// SignDownloadLink gives link a fresh ID and returns it as a token, signed like access tokens
+func SignDownloadLink(link *DownloadLink) (string, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+	link.ID = hex.EncodeToString(id)
+
+	claims := jwt.MapClaims{
+		"sub":  link.UserID.Hex(),
+		"typ":  tokenDownload,
+		"jti":  link.ID,
+		"fid":  link.FileID.Hex(),
+		"once": link.OneTime,
+		"exp":  link.ExpiresAt.Unix(),
+		"iat":  time.Now().Unix(),
+	}
+	if link.ChunkID != 0 {
+		claims["cid"] = link.ChunkID
+	}
+	return signJWT(claims)
+}
+
+// ParseDownloadLink checks a download link token's signature and expiry and returns its link
+func ParseDownloadLink(tokenStr string) (*DownloadLink, error) {
+	tkn, err := jwt.Parse(tokenStr, verifyKey, jwt.WithExpirationRequired())
+	if err != nil || !tkn.Valid {
+		return nil, errors.New("invalid token")
+	}
+	claims, ok := tkn.Claims.(jwt.MapClaims)
+	if !ok {
+		return nil, errors.New("invalid claims")
+	}
+	// An access token must not pass as a download link, nor the other way round
+	if typ, _ := claims["typ"].(string); typ != tokenDownload {
+		return nil, errors.New("wrong token type")
+	}
+
+	link := &DownloadLink{}
+	link.ID, _ = claims["jti"].(string)
+	link.OneTime, _ = claims["once"].(bool)
+	if cid, ok := claims["cid"].(float64); ok {
+		link.ChunkID = int(cid)
+	}
+	sub, _ := claims["sub"].(string)
+	fid, _ := claims["fid"].(string)
+	if link.UserID, err = primitive.ObjectIDFromHex(sub); err != nil || link.ID == "" {
+		return nil, errors.New("invalid claims")
+	}
+	if link.FileID, err = primitive.ObjectIDFromHex(fid); err != nil {
+		return nil, errors.New("invalid claims")
+	}
+	exp, err := claims.GetExpirationTime()
+	if err != nil {
+		return nil, errors.New("invalid claims")
+	}
+	link.ExpiresAt = exp.Time
+	return link, nil
+}
@@ -0,0 +1,200 @@
+package auth
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// maxPasswordBytes is the most bcrypt can hash
+const maxPasswordBytes = 72
+
+// hibpRangeURL is the Have I Been Pwned range API, queried with the first five hex digits of a
+// password's SHA-1 so the password itself never leaves the server
+const hibpRangeURL = "https://api.pwnedpasswords.com/range/"
+
+// BreachChecker tells whether a password is known from a data breach
+type BreachChecker interface {
+	Breached(ctx context.Context, password string) (bool, error)
+}
+
+var (
+	// minPasswordLength and minPasswordClasses are the password policy: a length in characters,
+	// and how many of lowercase, uppercase, digits and other characters must be used
+	minPasswordLength  int
+	minPasswordClasses int
+	// breachChecker rejects breached passwords, nil when that check is off
+	breachChecker BreachChecker
+)
+
+// InitPasswordPolicy reads PASSWORD_MIN_LENGTH, PASSWORD_MIN_CLASSES and PASSWORD_BREACH_CHECK,
+// which is "hibp" for the Have I Been Pwned range API or the URL of a compatible one
+func InitPasswordPolicy() error {
+	minPasswordLength, _ = strconv.Atoi(os.Getenv("PASSWORD_MIN_LENGTH"))
+	if minPasswordLength == 0 {
+		minPasswordLength = 6
+	}
+	if minPasswordLength < 1 || minPasswordLength > maxPasswordBytes {
+		return fmt.Errorf("PASSWORD_MIN_LENGTH must be 1-%d", maxPasswordBytes)
+	}
+	minPasswordClasses, _ = strconv.Atoi(os.Getenv("PASSWORD_MIN_CLASSES"))
+	if minPasswordClasses < 0 || minPasswordClasses > 4 {
+		return errors.New("PASSWORD_MIN_CLASSES must be 0-4")
+	}
+
+	breachChecker = nil
+	switch check := strings.TrimSpace(os.Getenv("PASSWORD_BREACH_CHECK")); check {
+	case "", "off":
+	case "hibp":
+		breachChecker = &RangeBreachChecker{URL: hibpRangeURL}
+	default:
+		u, err := url.Parse(check)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("PASSWORD_BREACH_CHECK %q must be off, hibp or a range API URL", check)
+		}
+		breachChecker = &RangeBreachChecker{URL: check}
+	}
+	return nil
+}
+
+// SetBreachChecker replaces the breached-password check; nil turns it off
+func SetBreachChecker(c BreachChecker) {
+	breachChecker = c
+}
+
+// PasswordViolation is one way a password falls short of the policy
+type PasswordViolation struct {
+	Code    string `json:"code"` // "too_short", "too_long", "too_few_classes" or "breached"
+	Message string `json:"message"`
+}
+
+// checkPassword returns how password breaks the policy, nothing if it doesn't. A breach check
+// that fails lets the password through, so an outage of the API doesn't stop signups.
+func checkPassword(ctx context.Context, password string) []PasswordViolation {
+	violations := []PasswordViolation{}
+	if n := len([]rune(password)); n < minPasswordLength {
+		violations = append(violations, PasswordViolation{"too_short", fmt.Sprintf("password must be at least %d characters", minPasswordLength)})
+	}
+	if len(password) > maxPasswordBytes {
+		violations = append(violations, PasswordViolation{"too_long", fmt.Sprintf("password must be at most %d bytes", maxPasswordBytes)})
+	}
+	if classes := passwordClasses(password); classes < minPasswordClasses {
+		violations = append(violations, PasswordViolation{"too_few_classes", fmt.Sprintf("password must use at least %d of lowercase letters, uppercase letters, digits and symbols", minPasswordClasses)})
+	}
+	if len(violations) > 0 || breachChecker == nil {
+		return violations
+	}
+
+	breached, err := breachChecker.Breached(ctx, password)
+	if err != nil {
+		log.Printf("Breached password check failed, allowing the password: %v", err)
+		return violations
+	}
+	if breached {
+		violations = append(violations, PasswordViolation{"breached", "password has appeared in a data breach; choose another"})
+	}
+	return violations
+}
+
+// passwordClasses counts the character classes password uses
+func passwordClasses(password string) int {
+	var lower, upper, digit, other bool
+	for _, c := range password {
+		switch {
+		case unicode.IsLower(c):
+			lower = true
+		case unicode.IsUpper(c):
+			upper = true
+		case unicode.IsDigit(c):
+			digit = true
+		default:
+			other = true
+		}
+	}
+	n := 0
+	for _, used := range []bool{lower, upper, digit, other} {
+		if used {
+			n++
+		}
+	}
+	return n
+}
+
+// validPassword checks password against the policy, answering 400 with the violations if it fails
+func validPassword(w http.ResponseWriter, r *http.Request, password string) bool {
+	violations := checkPassword(r.Context(), password)
+	if len(violations) == 0 {
+		return true
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusBadRequest)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"error":      "password does not meet the policy",
+		"violations": violations,
+	})
+	return false
+}
+
+// PasswordPolicyHandler - GET /api/password/policy
+// Describes the password policy, so clients can check passwords before sending them
+func PasswordPolicyHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"min_length":   minPasswordLength,
+		"max_bytes":    maxPasswordBytes,
+		"min_classes":  minPasswordClasses,
+		"breach_check": breachChecker != nil,
+	})
+}
+
+// RangeBreachChecker asks a k-anonymity range API like Have I Been Pwned's: only the first five
+// hex digits of the password's SHA-1 are sent, and the answer lists the suffixes seen in breaches
+type RangeBreachChecker struct {
+	URL string // the range endpoint, to which the prefix is appended
+}
+
+// Breached reports whether the password's hash is in the range the API returns
+func (c *RangeBreachChecker) Breached(ctx context.Context, password string) (bool, error) {
+	sum := sha1.Sum([]byte(password))
+	hash := strings.ToUpper(hex.EncodeToString(sum[:]))
+	prefix, suffix := hash[:5], hash[5:]
+
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "GET", strings.TrimSuffix(c.URL, "/")+"/"+prefix, nil)
+	if err != nil {
+		return false, err
+	}
+	// Padded answers all have about the same size, so the prefix can't be guessed from it
+	req.Header.Set("Add-Padding", "true")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("range API answered %s", resp.Status)
+	}
+
+	sc := bufio.NewScanner(resp.Body)
+	for sc.Scan() {
+		s, count, ok := strings.Cut(strings.TrimSpace(sc.Text()), ":")
+		// Padding entries have a count of 0
+		if ok && strings.EqualFold(s, suffix) && count != "0" {
+			return true, nil
+		}
+	}
+	return false, sc.Err()
+}
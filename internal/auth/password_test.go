@@ -0,0 +1,113 @@
+package auth_test
+
+import (
+	"SE/internal/auth"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// breached is a BreachChecker of a fixed list of passwords, or one that fails with err
+type breached struct {
+	passwords []string
+	err       error
+}
+
+func (b breached) Breached(ctx context.Context, password string) (bool, error) {
+	return slices.Contains(b.passwords, password), b.err
+}
+
+// violations signs up with password and returns the codes of the policy violations, none if the
+// signup went through
+func violations(t *testing.T, password string) []string {
+	t.Helper()
+	w := httptest.NewRecorder()
+	auth.SignupHandler(w, post(t, "/api/signup", map[string]string{"email": fmt.Sprintf("%x@example.com", sha1.Sum([]byte(password))), "password": password}))
+	if w.Code == http.StatusCreated {
+		return nil
+	}
+	var resp struct {
+		Violations []auth.PasswordViolation `json:"violations"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil || w.Code != http.StatusBadRequest {
+		t.Fatalf("signup: %d, want 201 or 400 with violations", w.Code)
+	}
+	var codes []string
+	for _, v := range resp.Violations {
+		codes = append(codes, v.Code)
+	}
+	return codes
+}
+
+func TestPasswordPolicy(t *testing.T) {
+	t.Setenv("PASSWORD_MIN_LENGTH", "10")
+	t.Setenv("PASSWORD_MIN_CLASSES", "3")
+	setup(t)
+	auth.SetBreachChecker(breached{passwords: []string{"Password123"}})
+
+	for _, tc := range []struct {
+		password string
+		want     []string
+	}{
+		{"Ab1", []string{"too_short"}},
+		{"abc", []string{"too_short", "too_few_classes"}},
+		{"abcdefghijkl", []string{"too_few_classes"}},
+		{"Abcdefghij1", nil},
+		{"ÄÖÜäöüßéè1", nil}, // characters, not bytes
+		{"Aa1" + strings.Repeat("x", 70), []string{"too_long"}},
+		{"Password123", []string{"breached"}},
+	} {
+		if got := violations(t, tc.password); !slices.Equal(got, tc.want) {
+			t.Errorf("violations of %q = %v, want %v", tc.password, got, tc.want)
+		}
+	}
+
+	w := call(t, auth.PasswordPolicyHandler, httptest.NewRequest("GET", "/api/password/policy", nil), http.StatusOK)
+	var policy map[string]any
+	json.NewDecoder(w.Body).Decode(&policy)
+	if policy["min_length"] != 10.0 || policy["min_classes"] != 3.0 || policy["max_bytes"] != 72.0 || policy["breach_check"] != true {
+		t.Errorf("policy = %v", policy)
+	}
+
+	// A breach check that fails doesn't keep people from signing up
+	auth.SetBreachChecker(breached{passwords: []string{"Breached123"}, err: errors.New("range API down")})
+	if got := violations(t, "Breached123"); got != nil {
+		t.Errorf("violations with the breach check down = %v, want none", got)
+	}
+
+	t.Setenv("PASSWORD_MIN_CLASSES", "5")
+	if err := auth.InitPasswordPolicy(); err == nil {
+		t.Error("PASSWORD_MIN_CLASSES=5 accepted")
+	}
+}
+
+func TestRangeBreachChecker(t *testing.T) {
+	sum := sha1.Sum([]byte("hunter2"))
+	hash := strings.ToUpper(hex.EncodeToString(sum[:]))
+	var asked string
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		asked = r.URL.Path
+		// The suffix of hunter2, another one and a padding entry
+		fmt.Fprintf(w, "%s:17\r\n0018A45C4D1DEF81644B54AB7F969B88D65:1\r\n%s:0\r\n", hash[5:], strings.Repeat("F", 35))
+	}))
+	defer api.Close()
+	c := &auth.RangeBreachChecker{URL: api.URL}
+
+	if got, err := c.Breached(context.Background(), "hunter2"); err != nil || !got {
+		t.Errorf("Breached(hunter2) = %v, %v, want true", got, err)
+	}
+	if asked != "/"+hash[:5] {
+		t.Errorf("range API asked for %q, want only the prefix /%s", asked, hash[:5])
+	}
+	if got, err := c.Breached(context.Background(), "correct horse battery staple"); err != nil || got {
+		t.Errorf("Breached of a password not in the range = %v, %v, want false", got, err)
+	}
+}
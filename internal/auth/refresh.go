@@ -0,0 +1,148 @@
+package auth
+
+import (
+	"SE/internal/middleware"
+	"SE/internal/models"
+	"SE/internal/store"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// hashRefreshToken is how refresh tokens are stored, so a leaked database can't be used to log in
+func hashRefreshToken(token string) string {
+	sum := sha256.Sum256([]byte(strings.TrimSpace(token)))
+	return hex.EncodeToString(sum[:])
+}
+
+// issueRefreshToken stores a new refresh token of the family, asked for by r, and returns it
+func issueRefreshToken(r *http.Request, userID, familyID primitive.ObjectID, loginAt, expiresAt time.Time) (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	token := base64.RawURLEncoding.EncodeToString(buf)
+	client := middleware.ClientInfo(r)
+	err := store.CreateRefreshToken(r.Context(), &models.RefreshToken{
+		TokenHash: hashRefreshToken(token),
+		FamilyID:  familyID,
+		UserID:    userID,
+		ExpiresAt: expiresAt,
+		LoginAt:   loginAt,
+		Client:    &client,
+	})
+	return token, err
+}
+
+// RefreshHandler - POST /api/auth/refresh
+// Trades a refresh token for a new access token and the next refresh token of its family
+func RefreshHandler(w http.ResponseWriter, r *http.Request) {
+	// Refresh tokens are stored hashed; the old one coming in and the new one going out stay
+	// out of the log as well
+	middleware.OmitRequestBody(r)
+	middleware.OmitResponseBody(r)
+	var req struct {
+		RefreshToken string `json:"refresh_token"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.RefreshToken == "" {
+		http.Error(w, "refresh_token is required", http.StatusBadRequest)
+		return
+	}
+
+	ctx := r.Context()
+	hash := hashRefreshToken(req.RefreshToken)
+	t, err := store.UseRefreshToken(ctx, hash)
+	if err != nil {
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+	if t == nil {
+		// A token used before was either stolen or replayed; either way, whoever holds the
+		// family's current token can no longer be trusted
+		old, err := store.GetRefreshToken(ctx, hash)
+		if err != nil {
+			http.Error(w, "server error", http.StatusInternalServerError)
+			return
+		}
+		if old != nil && old.UsedAt != nil {
+			log.Printf("Refresh token reuse for user %s, revoking token family %s", old.UserID.Hex(), old.FamilyID.Hex())
+			if err := store.RevokeRefreshTokenFamily(ctx, old.FamilyID); err != nil {
+				log.Printf("Failed to revoke token family %s: %v", old.FamilyID.Hex(), err)
+			}
+			http.Error(w, "refresh token reuse detected", http.StatusUnauthorized)
+			return
+		}
+		http.Error(w, "invalid refresh token", http.StatusUnauthorized)
+		return
+	}
+
+	// The account may have been deleted since the refresh token was issued
+	u, err := store.GetUserByID(ctx, t.UserID)
+	if err != nil {
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+	if u == nil {
+		http.Error(w, "invalid refresh token", http.StatusUnauthorized)
+		return
+	}
+
+	var resp loginResp
+	resp.Token, resp.ExpiresAt, err = generateJWT(t.UserID.Hex(), t.FamilyID.Hex(), tokenAccess, tokenLifetime)
+	if err != nil {
+		http.Error(w, "token gen failed", http.StatusInternalServerError)
+		return
+	}
+	// Tokens from before logins were recorded don't know when theirs happened
+	loginAt := t.LoginAt
+	if loginAt.IsZero() {
+		loginAt = t.CreatedAt
+	}
+	resp.RefreshToken, err = issueRefreshToken(r, t.UserID, t.FamilyID, loginAt, t.ExpiresAt)
+	if err != nil {
+		http.Error(w, "token gen failed", http.StatusInternalServerError)
+		return
+	}
+	resp.RefreshExpiresAt = &t.ExpiresAt
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// LogoutHandler - POST /api/auth/logout
+// Revokes the refresh token's family, so the login it came from can't be refreshed anymore
+func LogoutHandler(w http.ResponseWriter, r *http.Request) {
+	middleware.OmitRequestBody(r)
+	var req struct {
+		RefreshToken string `json:"refresh_token"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.RefreshToken == "" {
+		http.Error(w, "refresh_token is required", http.StatusBadRequest)
+		return
+	}
+
+	t, err := store.GetRefreshToken(r.Context(), hashRefreshToken(req.RefreshToken))
+	if err != nil {
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+	if t == nil {
+		http.Error(w, "invalid refresh token", http.StatusUnauthorized)
+		return
+	}
+	if err := store.RevokeRefreshTokenFamily(r.Context(), t.FamilyID); err != nil {
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"message": "logged out"})
+}
@@ -0,0 +1,139 @@
+package auth_test
+
+import (
+	"SE/internal/auth"
+	"SE/internal/store"
+	"SE/internal/store/storetest"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// refresh trades a refresh token, failing the test unless the answer has status want
+func refresh(t *testing.T, refreshToken string, want int) tokens {
+	t.Helper()
+	w := call(t, auth.RefreshHandler, post(t, "/api/auth/refresh", map[string]string{"refresh_token": refreshToken}), want)
+	if want != http.StatusOK {
+		return tokens{}
+	}
+	return decodeTokens(t, w)
+}
+
+func TestRefreshRotation(t *testing.T) {
+	setup(t)
+	_, first := login(t)
+
+	second := refresh(t, first.RefreshToken, http.StatusOK)
+	if second.RefreshToken == first.RefreshToken {
+		t.Fatal("refresh returned the same refresh token")
+	}
+	if got := authed(t, second.Token); got != http.StatusOK {
+		t.Fatalf("refreshed access token: %d, want 200", got)
+	}
+
+	// Using a refresh token twice ends the whole login: the token it was traded for, and the
+	// access tokens of the login
+	refresh(t, first.RefreshToken, http.StatusUnauthorized)
+	refresh(t, second.RefreshToken, http.StatusUnauthorized)
+	for _, token := range []string{first.Token, second.Token} {
+		if got := authed(t, token); got != http.StatusUnauthorized {
+			t.Errorf("access token of a login ended by reuse: %d, want 401", got)
+		}
+	}
+
+	refresh(t, "not-a-refresh-token", http.StatusUnauthorized)
+}
+
+func TestLogout(t *testing.T) {
+	setup(t)
+	u, tok := login(t)
+	other := loginAgain(t, u)
+
+	call(t, auth.LogoutHandler, post(t, "/api/auth/logout", map[string]string{"refresh_token": tok.RefreshToken}), http.StatusOK)
+	if got := authed(t, tok.Token); got != http.StatusUnauthorized {
+		t.Errorf("access token of a logged out login: %d, want 401", got)
+	}
+	refresh(t, tok.RefreshToken, http.StatusUnauthorized)
+
+	if got := authed(t, other.Token); got != http.StatusOK {
+		t.Errorf("access token of another login: %d, want 200", got)
+	}
+	refresh(t, other.RefreshToken, http.StatusOK)
+}
+
+func TestTokensValidAfter(t *testing.T) {
+	setup(t)
+	ctx := context.Background()
+	u, tok := login(t)
+
+	// Tokens are cut off by issue time, whole seconds, even with the login itself untouched
+	hash, _ := bcrypt.GenerateFromPassword([]byte("another-pass"), bcrypt.MinCost)
+	if err := store.SetUserPassword(ctx, u.ID, hash, time.Now().UTC().Truncate(time.Second).Add(time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	if got := authed(t, tok.Token); got != http.StatusUnauthorized {
+		t.Errorf("access token issued before the cutoff: %d, want 401", got)
+	}
+}
+
+func TestChangePassword(t *testing.T) {
+	setup(t)
+	u, tok := login(t)
+	// Another login of the user, which the change ends too
+	other := loginAgain(t, u)
+
+	change := func(current string, want int) tokens {
+		t.Helper()
+		r := post(t, "/api/password/change", map[string]string{"current_password": current, "new_password": "changed-pass-2"})
+		r.Header.Set("Authorization", "Bearer "+tok.Token)
+		w := call(t, auth.AuthMiddleware(auth.ChangePasswordHandler), r, want)
+		if want != http.StatusOK {
+			return tokens{}
+		}
+		return decodeTokens(t, w)
+	}
+	change("wrong-pass", http.StatusUnauthorized)
+	changed := change(storetest.Password, http.StatusOK)
+
+	for _, old := range []tokens{tok, other} {
+		if got := authed(t, old.Token); got != http.StatusUnauthorized {
+			t.Errorf("access token from before the change: %d, want 401", got)
+		}
+		refresh(t, old.RefreshToken, http.StatusUnauthorized)
+	}
+	if got := authed(t, changed.Token); got != http.StatusOK {
+		t.Errorf("access token of the change: %d, want 200", got)
+	}
+	refresh(t, changed.RefreshToken, http.StatusOK)
+
+	call(t, auth.LoginHandler, post(t, "/api/login", map[string]string{"email": u.Email, "password": storetest.Password}), http.StatusUnauthorized)
+	call(t, auth.LoginHandler, post(t, "/api/login", map[string]string{"email": u.Email, "password": "changed-pass-2"}), http.StatusOK)
+}
+
+func TestRevokeSession(t *testing.T) {
+	setup(t)
+	u, tok := login(t)
+	other := loginAgain(t, u)
+
+	// The other login, as on a lost device, is ended from this one
+	parsed, _, err := jwt.NewParser().ParseUnverified(other.Token, jwt.MapClaims{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sid, _ := parsed.Claims.(jwt.MapClaims)["sid"].(string)
+	r := httptest.NewRequest("DELETE", "/api/sessions/"+sid, nil)
+	r.Header.Set("Authorization", "Bearer "+tok.Token)
+	call(t, auth.AuthMiddleware(auth.RevokeSessionHandler), r, http.StatusOK)
+
+	if got := authed(t, other.Token); got != http.StatusUnauthorized {
+		t.Errorf("access token of a revoked login: %d, want 401", got)
+	}
+	if got := authed(t, tok.Token); got != http.StatusOK {
+		t.Errorf("access token of the login that revoked the other: %d, want 200", got)
+	}
+}
@@ -0,0 +1,93 @@
+package auth
+
+import (
+	"SE/internal/audit"
+	"SE/internal/models"
+	"SE/internal/store"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// loginSession is one login of a user, as the refresh token family it started
+type loginSession struct {
+	ID         string             `json:"id"`
+	Client     *models.ClientInfo `json:"client,omitempty"` // who last refreshed it, or logged in
+	LoginAt    time.Time          `json:"login_at"`
+	LastUsedAt time.Time          `json:"last_used_at"`
+	ExpiresAt  time.Time          `json:"expires_at"`
+	Current    bool               `json:"current"` // the session of the token that asked
+}
+
+// ListSessionsHandler - GET /api/sessions
+// Lists the caller's logins that can still be refreshed, newest first
+func ListSessionsHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("userID").(primitive.ObjectID)
+	current, _ := r.Context().Value("sessionID").(string)
+
+	tokens, err := store.ListActiveRefreshTokens(r.Context(), userID)
+	if err != nil {
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+	sessions := make([]loginSession, 0, len(tokens))
+	for _, t := range tokens {
+		s := loginSession{
+			ID:         t.FamilyID.Hex(),
+			Client:     t.Client,
+			LoginAt:    t.LoginAt,
+			LastUsedAt: t.CreatedAt,
+			ExpiresAt:  t.ExpiresAt,
+			Current:    t.FamilyID.Hex() == current,
+		}
+		if s.LoginAt.IsZero() {
+			s.LoginAt = t.CreatedAt
+		}
+		sessions = append(sessions, s)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"sessions": sessions})
+}
+
+// RevokeSessionHandler - DELETE /api/sessions/{id}
+// Ends one login of the caller's, e.g. on a lost device, so it can't be refreshed anymore
+func RevokeSessionHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("userID").(primitive.ObjectID)
+	familyID, err := primitive.ObjectIDFromHex(strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/sessions/"), "/"))
+	if err != nil {
+		http.Error(w, "invalid session id", http.StatusBadRequest)
+		return
+	}
+
+	// Only the caller's own logins, and only ones that haven't ended already
+	tokens, err := store.ListActiveRefreshTokens(r.Context(), userID)
+	if err != nil {
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+	found := false
+	for _, t := range tokens {
+		if t.FamilyID == familyID {
+			found = true
+			break
+		}
+	}
+	if !found {
+		http.Error(w, "session not found", http.StatusNotFound)
+		return
+	}
+	if err := store.RevokeRefreshTokenFamily(r.Context(), familyID); err != nil {
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+	log.Printf("User %s ended login session %s", userID.Hex(), familyID.Hex())
+	audit.Record(r, models.AuditEvent{UserID: userID, Action: models.AuditSessionRevoked, Target: familyID.Hex()})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"message": "session revoked"})
+}
@@ -0,0 +1,170 @@
+// Package cache keeps short-lived copies of hot records, such as the upload session every
+// chunk is checked against, in Redis shared by the API servers and workers. It is optional:
+// with no cache configured every lookup misses and callers go to the store.
+package cache
+
+import (
+	"context"
+	"errors"
+	"log"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Cache holds values by key for a while. It is best effort: a failed Get is a miss.
+type Cache interface {
+	Get(ctx context.Context, key string) ([]byte, bool)
+	Set(ctx context.Context, key string, value []byte, ttl time.Duration)
+	Delete(ctx context.Context, keys ...string)
+}
+
+var (
+	// current is the configured cache, nil when caching is off
+	current Cache
+
+	// sessionTTL is how long an upload session is cached
+	sessionTTL time.Duration
+	// driveSpaceTTL is how long a drive's quota is cached for planning
+	driveSpaceTTL time.Duration
+)
+
+// InitCache connects to Redis when REDIS_URL is set
+func InitCache() error {
+	current = nil
+	secs, err := strconv.Atoi(os.Getenv("SESSION_CACHE_SECONDS"))
+	if err != nil || secs <= 0 {
+		secs = 60
+	}
+	sessionTTL = time.Duration(secs) * time.Second
+	secs, err = strconv.Atoi(os.Getenv("DRIVE_SPACE_CACHE_SECONDS"))
+	if err != nil || secs < 0 {
+		secs = 30
+	}
+	driveSpaceTTL = time.Duration(secs) * time.Second
+
+	url := os.Getenv("REDIS_URL")
+	if url == "" {
+		return nil
+	}
+	opts, err := redis.ParseURL(url)
+	if err != nil {
+		return err
+	}
+	// A lookup that waits on Redis is slower than the store it saves, so fail fast unless
+	// the URL says otherwise
+	if opts.DialTimeout == 0 {
+		opts.DialTimeout = time.Second
+	}
+	if opts.ReadTimeout == 0 {
+		opts.ReadTimeout = 500 * time.Millisecond
+	}
+	if opts.WriteTimeout == 0 {
+		opts.WriteTimeout = 500 * time.Millisecond
+	}
+	if opts.MaxRetries == 0 {
+		opts.MaxRetries = -1
+	}
+	opts.DialerRetries = 1
+	current = &redisCache{client: redis.NewClient(opts)}
+	return nil
+}
+
+// SetCache replaces the cache; nil turns caching off
+func SetCache(c Cache) {
+	current = c
+}
+
+// Enabled reports whether a cache is configured
+func Enabled() bool {
+	return current != nil
+}
+
+// SessionTTL is how long an upload session may be cached
+func SessionTTL() time.Duration {
+	return sessionTTL
+}
+
+// DriveSpaceTTL is how long a drive's quota may be cached, 0 for not at all
+func DriveSpaceTTL() time.Duration {
+	return driveSpaceTTL
+}
+
+// Get returns the cached value of key
+func Get(ctx context.Context, key string) ([]byte, bool) {
+	if current == nil {
+		return nil, false
+	}
+	return current.Get(ctx, key)
+}
+
+// Set caches value under key for ttl
+func Set(ctx context.Context, key string, value []byte, ttl time.Duration) {
+	if current == nil || ttl <= 0 {
+		return
+	}
+	current.Set(ctx, key, value, ttl)
+}
+
+// Delete drops keys from the cache
+func Delete(ctx context.Context, keys ...string) {
+	if current == nil {
+		return
+	}
+	current.Delete(ctx, keys...)
+}
+
+// Ping checks that the cache is reachable, when it can tell
+func Ping(ctx context.Context) error {
+	if p, ok := current.(interface{ Ping(context.Context) error }); ok {
+		return p.Ping(ctx)
+	}
+	return nil
+}
+
+// Close releases the cache's connections
+func Close() error {
+	if c, ok := current.(interface{ Close() error }); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// redisCache keeps values in Redis
+type redisCache struct {
+	client *redis.Client
+}
+
+func (c *redisCache) Get(ctx context.Context, key string) ([]byte, bool) {
+	b, err := c.client.Get(ctx, key).Bytes()
+	if err != nil {
+		if !errors.Is(err, redis.Nil) {
+			log.Printf("cache get %s: %v", key, err)
+		}
+		return nil, false
+	}
+	return b, true
+}
+
+func (c *redisCache) Set(ctx context.Context, key string, value []byte, ttl time.Duration) {
+	if err := c.client.Set(ctx, key, value, ttl).Err(); err != nil {
+		log.Printf("cache set %s: %v", key, err)
+	}
+}
+
+// Delete errors are logged: the stale value is served until it expires
+func (c *redisCache) Delete(ctx context.Context, keys ...string) {
+	if err := c.client.Del(ctx, keys...).Err(); err != nil {
+		log.Printf("cache delete %v: %v", keys, err)
+	}
+}
+
+func (c *redisCache) Ping(ctx context.Context) error {
+	return c.client.Ping(ctx).Err()
+}
+
+func (c *redisCache) Close() error {
+	return c.client.Close()
+}
@@ -0,0 +1,197 @@
+package drivemanager
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Chunk files start with a fixed-size header so a restore (or an offline tool reading a key
+// file) can tell right away that it got the chunk it asked for, and all of it:
+//
+//	offset  size  field
+//	0       4     magic "2XPF"
+//	4       1     format version
+//	5       3     reserved, zero
+//	8       4     chunk ID
+//	12      8     size of the data after the header
+//	20      12    first 12 bytes of the SHA-256 of the stored file's hex ID
+//
+// Integers are big-endian. Chunks uploaded before the header was introduced have none; their
+// key file entries carry no header_version.
+const (
+	ChunkHeaderVersion = 1
+	ChunkHeaderSize    = 32
+)
+
+var chunkMagic = []byte("2XPF")
+
+// ErrBadChunkHeader means a chunk file's header doesn't match the chunk it was fetched as
+var ErrBadChunkHeader = errors.New("bad chunk header")
+
+// ChunkHeader is the decoded header of a chunk file
+type ChunkHeader struct {
+	Version    int
+	ChunkID    int
+	DataSize   int64
+	FileIDHash [12]byte
+}
+
+// NewChunkHeader is the header of chunk chunkID of fileID, holding size bytes of data
+func NewChunkHeader(fileID primitive.ObjectID, chunkID int, size int64) ChunkHeader {
+	return ChunkHeader{Version: ChunkHeaderVersion, ChunkID: chunkID, DataSize: size, FileIDHash: fileIDHash(fileID)}
+}
+
+func fileIDHash(fileID primitive.ObjectID) [12]byte {
+	sum := sha256.Sum256([]byte(fileID.Hex()))
+	var h [12]byte
+	copy(h[:], sum[:])
+	return h
+}
+
+// Bytes encodes the header
+func (h ChunkHeader) Bytes() []byte {
+	b := make([]byte, ChunkHeaderSize)
+	copy(b, chunkMagic)
+	b[4] = byte(h.Version)
+	binary.BigEndian.PutUint32(b[8:12], uint32(h.ChunkID))
+	binary.BigEndian.PutUint64(b[12:20], uint64(h.DataSize))
+	copy(b[20:], h.FileIDHash[:])
+	return b
+}
+
+// ParseChunkHeader decodes the header at the start of a chunk file
+func ParseChunkHeader(b []byte) (ChunkHeader, error) {
+	if len(b) < ChunkHeaderSize {
+		return ChunkHeader{}, fmt.Errorf("%w: file is %d bytes, shorter than a header", ErrBadChunkHeader, len(b))
+	}
+	if !bytes.Equal(b[:4], chunkMagic) {
+		return ChunkHeader{}, fmt.Errorf("%w: not a chunk file", ErrBadChunkHeader)
+	}
+	h := ChunkHeader{
+		Version:  int(b[4]),
+		ChunkID:  int(binary.BigEndian.Uint32(b[8:12])),
+		DataSize: int64(binary.BigEndian.Uint64(b[12:20])),
+	}
+	copy(h.FileIDHash[:], b[20:ChunkHeaderSize])
+	if h.Version < 1 || h.Version > ChunkHeaderVersion {
+		return ChunkHeader{}, fmt.Errorf("%w: unsupported format version %d", ErrBadChunkHeader, h.Version)
+	}
+	return h, nil
+}
+
+// Check reports whether the header is the one written for chunk chunkID of fileID with size bytes
+func (h ChunkHeader) Check(fileID primitive.ObjectID, chunkID int, size int64) error {
+	if h.FileIDHash != fileIDHash(fileID) {
+		return fmt.Errorf("%w: chunk belongs to another file", ErrBadChunkHeader)
+	}
+	if h.ChunkID != chunkID {
+		return fmt.Errorf("%w: file holds chunk %d, expected chunk %d", ErrBadChunkHeader, h.ChunkID, chunkID)
+	}
+	if h.DataSize != size {
+		return fmt.Errorf("%w: header records %d bytes, expected %d", ErrBadChunkHeader, h.DataSize, size)
+	}
+	return nil
+}
+
+type chunkHeadersKey struct{}
+
+// WithChunkHeaders makes UploadChunksToDrivers prefix every chunk it uploads with a header
+// naming fileID, the stored file the chunks belong to
+func WithChunkHeaders(ctx context.Context, fileID primitive.ObjectID) context.Context {
+	return context.WithValue(ctx, chunkHeadersKey{}, fileID)
+}
+
+// chunkHeader is the header a chunk uploaded with ctx starts with, nil without WithChunkHeaders
+func chunkHeader(ctx context.Context, chunkID int, size int64) []byte {
+	fileID, ok := ctx.Value(chunkHeadersKey{}).(primitive.ObjectID)
+	if !ok {
+		return nil
+	}
+	return NewChunkHeader(fileID, chunkID, size).Bytes()
+}
+
+// storedChunkSize is how many bytes a chunk of size takes on its drive when uploaded with ctx
+func storedChunkSize(ctx context.Context, size int64) int64 {
+	if _, ok := ctx.Value(chunkHeadersKey{}).(primitive.ObjectID); ok {
+		return ChunkHeaderSize + size
+	}
+	return size
+}
+
+// headedReaderAt reads header followed by the size bytes of data
+type headedReaderAt struct {
+	header []byte
+	data   io.ReaderAt
+	size   int64
+}
+
+func (r *headedReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	n := 0
+	if off < int64(len(r.header)) {
+		n = copy(p, r.header[off:])
+		if n == len(p) {
+			return n, nil
+		}
+	}
+	dataOff := off + int64(n) - int64(len(r.header))
+	m, err := io.NewSectionReader(r.data, 0, r.size).ReadAt(p[n:], dataOff)
+	return n + m, err
+}
+
+// chunkHeaderWriter holds back the first ChunkHeaderSize bytes written to it and passes the rest
+// on, once check accepts the header
+type chunkHeaderWriter struct {
+	w      io.Writer
+	header []byte
+	check  func(header []byte) error
+	data   int64
+}
+
+// newCheckedHeaderWriter expects the header of chunk chunkID of fileID holding size bytes
+func newCheckedHeaderWriter(fileID primitive.ObjectID, chunkID int, size int64) *chunkHeaderWriter {
+	return &chunkHeaderWriter{check: func(b []byte) error {
+		h, err := ParseChunkHeader(b)
+		if err != nil {
+			return err
+		}
+		return h.Check(fileID, chunkID, size)
+	}}
+}
+
+func (w *chunkHeaderWriter) Write(p []byte) (int, error) {
+	n := 0
+	if len(w.header) < ChunkHeaderSize {
+		n = min(ChunkHeaderSize-len(w.header), len(p))
+		w.header = append(w.header, p[:n]...)
+		if len(w.header) == ChunkHeaderSize && w.check != nil {
+			if err := w.check(w.header); err != nil {
+				return n, err
+			}
+		}
+	}
+	if n == len(p) {
+		return n, nil
+	}
+	m, err := w.w.Write(p[n:])
+	w.data += int64(m)
+	return n + m, err
+}
+
+// finish checks that a whole header and size bytes of data were written
+func (w *chunkHeaderWriter) finish(size int64) error {
+	if len(w.header) < ChunkHeaderSize {
+		_, err := ParseChunkHeader(w.header)
+		return err
+	}
+	if w.data != size {
+		return fmt.Errorf("%w: chunk is truncated, %d of %d bytes", ErrBadChunkHeader, w.data, size)
+	}
+	return nil
+}
@@ -0,0 +1,87 @@
+package drivemanager
+
+import (
+	"SE/internal/models"
+	"SE/internal/oauth"
+	"SE/internal/store"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"golang.org/x/oauth2"
+)
+
+// newAccountClient builds an auto-refreshing HTTP client for a stored drive account
+func newAccountClient(ctx context.Context, accountID primitive.ObjectID) (*http.Client, error) {
+	// Get drive account
+	account, err := store.GetDriveAccountByID(ctx, accountID)
+	if err != nil {
+		return nil, err
+	}
+	return clientForAccount(ctx, account)
+}
+
+// clientForAccount builds an HTTP client from the account's OAuth token or service account key,
+// or one backed by a local directory for local drives
+func clientForAccount(ctx context.Context, account *models.DriveAccount) (*http.Client, error) {
+	if account.AccountType == models.DriveAccountTypeLocal {
+		if !localDrivesEnabled {
+			return nil, errors.New("local drives are disabled")
+		}
+		return newLocalDriveClient(account.ID, account.DisplayName), nil
+	}
+
+	if driveHTTPClient != nil {
+		ctx = context.WithValue(ctx, oauth2.HTTPClient, driveHTTPClient)
+	}
+
+	if account.AccountType == models.DriveAccountTypeServiceAccount {
+		// Decrypt service account key
+		keyData, err := oauth.Decrypt(account.EncryptedCredentials)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decrypt service account key: %w", err)
+		}
+		return oauth.NewServiceAccountClient(ctx, keyData, account.ImpersonateEmail)
+	}
+
+	// Decrypt OAuth token
+	tokenData, err := oauth.Decrypt(account.EncryptedToken)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt token: %w", err)
+	}
+
+	// Unmarshal token
+	var token oauth2.Token
+	if err := json.Unmarshal(tokenData, &token); err != nil {
+		return nil, fmt.Errorf("failed to parse token: %w", err)
+	}
+
+	// Create HTTP client with auto-refresh, keeping refreshed tokens so the next client
+	// doesn't have to refresh again
+	return oauth.NewClient(ctx, &token, func(tok *oauth2.Token) {
+		saveRefreshedToken(account.ID, tok)
+	}), nil
+}
+
+// saveRefreshedToken persists a token obtained through the refresh token, best effort
+func saveRefreshedToken(accountID primitive.ObjectID, tok *oauth2.Token) {
+	data, err := json.Marshal(tok)
+	if err != nil {
+		return
+	}
+	enc, err := oauth.Encrypt(data)
+	if err != nil {
+		log.Printf("Failed to encrypt refreshed token for account %s: %v", accountID.Hex(), err)
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), driveCallTimeout)
+	defer cancel()
+	if err := store.UpdateDriveAccountToken(ctx, accountID, enc, time.Now().UTC()); err != nil {
+		log.Printf("Failed to save refreshed token for account %s: %v", accountID.Hex(), err)
+	}
+}
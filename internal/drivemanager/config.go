@@ -0,0 +1,165 @@
+package drivemanager
+
+import (
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	// deleteToTrash moves chunk files to the Drive trash instead of deleting them permanently
+	deleteToTrash bool
+
+	// driveCallTimeout bounds metadata calls (about, delete, trash)
+	driveCallTimeout time.Duration
+	// driveTransferTimeout bounds a single chunk transfer
+	driveTransferTimeout time.Duration
+	// driveHTTPClient is the base client used underneath the OAuth2 transport
+	driveHTTPClient *http.Client
+
+	// driveAPIRetries is how many times a Drive call is retried on 429/5xx or network errors
+	driveAPIRetries int
+
+	// maxParallelUploads is how many chunks of one file are uploaded concurrently
+	maxParallelUploads int
+	// downloadSlots bounds chunk downloads running at once across the server
+	downloadSlots chan struct{}
+
+	// uploadPartSize is the size of each PUT in a resumable upload
+	uploadPartSize int64
+	// uploadPartRetries is how many times a single failed part is retried
+	uploadPartRetries int
+	// chunkUploadAttempts is how many times a chunk is uploaded from scratch before it is given up on
+	chunkUploadAttempts int
+
+	// dailyAPIQuota is the number of Drive API requests budgeted per day across all accounts
+	dailyAPIQuota int64
+	// backgroundQuotaPct is the share of dailyAPIQuota after which background work pauses
+	backgroundQuotaPct float64
+
+	// sharedDriveCapacity is the nominal capacity planned for a Shared Drive account
+	sharedDriveCapacity int64
+
+	// localDrivesEnabled allows linking drives kept in localDriveDir instead of Google Drive
+	localDrivesEnabled bool
+	localDriveDir      string
+	// localDriveCapacity is the quota reported for each local drive
+	localDriveCapacity int64
+)
+
+func InitDriveConfig() {
+	// Deletion mode: "permanent" (default) or "trash"
+	mode := strings.ToLower(os.Getenv("DRIVE_DELETE_MODE"))
+	deleteToTrash = mode == "trash"
+
+	callSecs, _ := strconv.Atoi(os.Getenv("DRIVE_CALL_TIMEOUT_SECONDS"))
+	if callSecs == 0 {
+		callSecs = 30
+	}
+	driveCallTimeout = time.Duration(callSecs) * time.Second
+
+	transferMins, _ := strconv.Atoi(os.Getenv("DRIVE_TRANSFER_TIMEOUT_MINUTES"))
+	if transferMins == 0 {
+		transferMins = 60
+	}
+	driveTransferTimeout = time.Duration(transferMins) * time.Minute
+
+	driveAPIRetries, _ = strconv.Atoi(os.Getenv("DRIVE_API_RETRIES"))
+	if driveAPIRetries == 0 {
+		driveAPIRetries = 5
+	}
+
+	maxParallelUploads, _ = strconv.Atoi(os.Getenv("MAX_PARALLEL_UPLOADS"))
+	if maxParallelUploads <= 0 {
+		maxParallelUploads = 3
+	}
+
+	// Chunk downloads at once across every restore and streamed download
+	maxChunkDownloads, _ := strconv.Atoi(os.Getenv("MAX_CONCURRENT_CHUNK_DOWNLOADS"))
+	if maxChunkDownloads <= 0 {
+		maxChunkDownloads = 12
+	}
+	downloadSlots = make(chan struct{}, maxChunkDownloads)
+
+	// Resumable upload part size in MB, clamped to 8-32
+	partMB, _ := strconv.Atoi(os.Getenv("DRIVE_UPLOAD_PART_MB"))
+	if partMB == 0 {
+		partMB = 16
+	}
+	partMB = min(max(partMB, 8), 32)
+	uploadPartSize = int64(partMB) * 1024 * 1024
+
+	uploadPartRetries, _ = strconv.Atoi(os.Getenv("DRIVE_UPLOAD_PART_RETRIES"))
+	if uploadPartRetries == 0 {
+		uploadPartRetries = 5
+	}
+
+	chunkUploadAttempts, _ = strconv.Atoi(os.Getenv("CHUNK_UPLOAD_ATTEMPTS"))
+	if chunkUploadAttempts <= 0 {
+		chunkUploadAttempts = 3
+	}
+
+	dailyAPIQuota, _ = strconv.ParseInt(os.Getenv("DRIVE_DAILY_QUOTA"), 10, 64)
+	if dailyAPIQuota == 0 {
+		dailyAPIQuota = 1000000
+	}
+	backgroundQuotaPct, _ = strconv.ParseFloat(os.Getenv("DRIVE_QUOTA_BACKGROUND_PCT"), 64)
+	if backgroundQuotaPct == 0 {
+		backgroundQuotaPct = 80
+	}
+
+	sharedGB, _ := strconv.ParseInt(os.Getenv("SHARED_DRIVE_CAPACITY_GB"), 10, 64)
+	if sharedGB == 0 {
+		sharedGB = 100
+	}
+	sharedDriveCapacity = sharedGB * 1024 * 1024 * 1024
+
+	// Local drives are for demos and tests; on by default with the in-memory store
+	localDrivesEnabled = os.Getenv("LOCAL_DRIVES") == "true" || os.Getenv("STORE_DRIVER") == "memory"
+	localDriveDir = os.Getenv("LOCAL_DRIVE_DIR")
+	if localDriveDir == "" {
+		localDriveDir = filepath.Join(os.TempDir(), "se-local-drives")
+	}
+	localGB, _ := strconv.ParseInt(os.Getenv("LOCAL_DRIVE_CAPACITY_GB"), 10, 64)
+	if localGB == 0 {
+		localGB = 15
+	}
+	localDriveCapacity = localGB * 1024 * 1024 * 1024
+
+	// Global bandwidth cap across all drives, in KB/s (0 = unlimited)
+	globalKBps, _ := strconv.Atoi(os.Getenv("DRIVE_BANDWIDTH_LIMIT_KB_PER_SEC"))
+	if globalKBps > 0 {
+		globalLimiter = newLimiter(globalKBps * 1024)
+	}
+
+	// Per-account caps: "<account_id>=<KB/s>,<account_id>=<KB/s>"
+	accountLimits = make(map[string]int)
+	for _, entry := range strings.Split(os.Getenv("DRIVE_BANDWIDTH_LIMITS"), ",") {
+		id, kbps, ok := strings.Cut(strings.TrimSpace(entry), "=")
+		if !ok {
+			continue
+		}
+		if n, err := strconv.Atoi(strings.TrimSpace(kbps)); err == nil && n > 0 {
+			accountLimits[strings.TrimSpace(id)] = n * 1024
+		}
+	}
+
+	// Transport-level timeouts catch hung TLS handshakes and servers that never answer
+	driveHTTPClient = &http.Client{
+		Transport: &http.Transport{
+			Proxy: http.ProxyFromEnvironment,
+			DialContext: (&net.Dialer{
+				Timeout:   10 * time.Second,
+				KeepAlive: 30 * time.Second,
+			}).DialContext,
+			TLSHandshakeTimeout:   10 * time.Second,
+			ResponseHeaderTimeout: driveCallTimeout,
+			IdleConnTimeout:       90 * time.Second,
+			MaxIdleConnsPerHost:   10,
+		},
+	}
+}
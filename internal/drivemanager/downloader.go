@@ -0,0 +1,181 @@
+package drivemanager
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// DownloadChunkFromDrive downloads a chunk file from Google Drive into destPath, returning the
+// hex SHA-256 of what it wrote, hashed on the way so the file needn't be read back
+func DownloadChunkFromDrive(ctx context.Context, accountID primitive.ObjectID, driveFileID, destPath string) (string, error) {
+	return downloadChunk(ctx, accountID, driveFileID, destPath, nil)
+}
+
+// DownloadHeadedChunk downloads a chunk file stored with a header into destPath, leaving the
+// header out, and returns the SHA-256 of the data like DownloadChunkFromDrive. It fails with
+// ErrBadChunkHeader unless the header names chunk chunkID of fileID and is followed by all size
+// bytes of its data.
+func DownloadHeadedChunk(ctx context.Context, accountID primitive.ObjectID, driveFileID string, fileID primitive.ObjectID, chunkID int, size int64, destPath string) (string, error) {
+	hw := newCheckedHeaderWriter(fileID, chunkID, size)
+	checksum, err := downloadChunk(ctx, accountID, driveFileID, destPath, hw)
+	if err == nil {
+		err = hw.finish(size)
+	}
+	if err != nil {
+		os.Remove(destPath)
+		return "", err
+	}
+	return checksum, nil
+}
+
+// StreamChunk writes the data of a chunk file to w as it arrives from the drive. A headed chunk
+// has its header checked before any data reaches w, and its size once it ends; see
+// DownloadHeadedChunk.
+func StreamChunk(ctx context.Context, accountID primitive.ObjectID, driveFileID string, fileID primitive.ObjectID, chunkID int, size int64, headed bool, w io.Writer) error {
+	if !headed {
+		return downloadChunkTo(ctx, accountID, driveFileID, "", w)
+	}
+	hw := newCheckedHeaderWriter(fileID, chunkID, size)
+	hw.w = w
+	if err := downloadChunkTo(ctx, accountID, driveFileID, "", hw); err != nil {
+		return err
+	}
+	return hw.finish(size)
+}
+
+// StreamChunkRange writes length bytes of a chunk's data starting at off to w, skipping the
+// header of a headed chunk. Only part of the chunk is fetched, so neither its header nor its
+// checksum can be checked; a short read is still an error.
+func StreamChunkRange(ctx context.Context, accountID primitive.ObjectID, driveFileID string, headed bool, off, length int64, w io.Writer) error {
+	if headed {
+		off += ChunkHeaderSize
+	}
+	cw := &countingWriter{w: w}
+	if err := downloadChunkTo(ctx, accountID, driveFileID, fmt.Sprintf("bytes=%d-%d", off, off+length-1), cw); err != nil {
+		return err
+	}
+	if cw.n != length {
+		return fmt.Errorf("%w: chunk is truncated, got %d of %d bytes from offset %d", ErrBadChunkHeader, cw.n, length, off)
+	}
+	return nil
+}
+
+// CheckChunkFile makes sure a chunk file is still on its drive without downloading all of it:
+// only a headed chunk's header is fetched and checked, or the first byte of one without. A
+// file that is gone fails with an error IsNotFound recognizes.
+func CheckChunkFile(ctx context.Context, accountID primitive.ObjectID, driveFileID string, fileID primitive.ObjectID, chunkID int, size int64, headed bool) error {
+	if !headed {
+		return downloadChunkTo(ctx, accountID, driveFileID, "bytes=0-0", io.Discard)
+	}
+	var buf bytes.Buffer
+	if err := downloadChunkTo(ctx, accountID, driveFileID, fmt.Sprintf("bytes=0-%d", ChunkHeaderSize-1), &buf); err != nil {
+		return err
+	}
+	h, err := ParseChunkHeader(buf.Bytes())
+	if err != nil {
+		return err
+	}
+	return h.Check(fileID, chunkID, size)
+}
+
+// downloadChunk downloads a drive file into destPath, through hw when it is set, and returns
+// the hex SHA-256 of what reached destPath
+func downloadChunk(ctx context.Context, accountID primitive.ObjectID, driveFileID, destPath string, hw *chunkHeaderWriter) (string, error) {
+	out, err := os.Create(destPath)
+	if err != nil {
+		return "", err
+	}
+	defer out.Close()
+
+	hash := sha256.New()
+	var w io.Writer = io.MultiWriter(out, hash)
+	if hw != nil {
+		hw.w = w
+		w = hw
+	}
+	if err := downloadChunkTo(ctx, accountID, driveFileID, "", w); err != nil {
+		os.Remove(destPath)
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// downloadChunkTo copies a drive file, or the byte range rng of it when set, to w. It waits for
+// one of the MAX_CONCURRENT_CHUNK_DOWNLOADS slots first and holds it until w has everything.
+func downloadChunkTo(ctx context.Context, accountID primitive.ObjectID, driveFileID, rng string, w io.Writer) error {
+	if downloadSlots != nil {
+		select {
+		case downloadSlots <- struct{}{}:
+			defer func() { <-downloadSlots }()
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	client, err := newAccountClient(ctx, accountID)
+	if err != nil {
+		return err
+	}
+
+	// Download, bounded by the transfer timeout
+	callCtx, cancel := context.WithTimeout(ctx, driveTransferTimeout)
+	defer cancel()
+
+	downloadURL := DirectFileURL(driveFileID)
+	resp, err := doWithRetry(callCtx, client, accountID, opDownload, 0, func(ctx context.Context) (*http.Request, error) {
+		req, err := http.NewRequestWithContext(ctx, "GET", downloadURL, nil)
+		if err == nil && rng != "" {
+			req.Header.Set("Range", rng)
+		}
+		return req, err
+	})
+	if err != nil {
+		return fmt.Errorf("failed to download from drive: %w", err)
+	}
+	defer resp.Body.Close()
+
+	want := http.StatusOK
+	if rng != "" {
+		want = http.StatusPartialContent
+	}
+	if resp.StatusCode != want {
+		statusErr := newDriveStatusError(resp)
+		if resp.StatusCode == http.StatusForbidden && statusErr.reason() == "downloadQuotaExceeded" {
+			quotaErr := &DownloadQuotaError{}
+			if statusErr.RetryAfter != "" {
+				quotaErr.RetryAfter = retryDelay(0, statusErr.RetryAfter)
+			}
+			return fmt.Errorf("failed to download from drive: %w", quotaErr)
+		}
+		return fmt.Errorf("failed to download from drive: %w", statusErr)
+	}
+
+	if _, err := io.Copy(w, newThrottledReader(callCtx, accountID, resp.Body)); err != nil {
+		if errors.Is(err, ErrBadChunkHeader) {
+			return err
+		}
+		return fmt.Errorf("failed to download from drive: %w", err)
+	}
+	return nil
+}
+
+// countingWriter counts the bytes written through it
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,56 @@
+package drivemanager
+
+import (
+	"SE/internal/models"
+	"SE/internal/store"
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"golang.org/x/oauth2"
+)
+
+// ErrNoDirectAccess is returned for drives a client can't download from itself, like local drives
+var ErrNoDirectAccess = errors.New("drive can't be accessed directly")
+
+// DirectAccess lets a client download files of a drive account straight from Google Drive
+type DirectAccess struct {
+	Authorization string // value of the Authorization header to send
+	ExpiresAt     time.Time
+}
+
+// DirectFileURL is where a drive file's content is downloaded with a DirectAccess
+func DirectFileURL(driveFileID string) string {
+	return fmt.Sprintf("https://www.googleapis.com/drive/v3/files/%s?alt=media&supportsAllDrives=true", driveFileID)
+}
+
+// DirectAccessFor returns the account's current access token for a client to use. It expires
+// with the token, usually within an hour, and grants whatever the token's scopes do.
+func DirectAccessFor(ctx context.Context, accountID primitive.ObjectID) (*DirectAccess, error) {
+	account, err := store.GetDriveAccountByID(ctx, accountID)
+	if err != nil {
+		return nil, err
+	}
+	if account.AccountType == models.DriveAccountTypeLocal {
+		return nil, ErrNoDirectAccess
+	}
+	client, err := clientForAccount(ctx, account)
+	if err != nil {
+		return nil, err
+	}
+	transport, ok := client.Transport.(*oauth2.Transport)
+	if !ok {
+		return nil, ErrNoDirectAccess
+	}
+	tok, err := transport.Source.Token()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get access token: %w", err)
+	}
+	access := &DirectAccess{Authorization: tok.Type() + " " + tok.AccessToken, ExpiresAt: tok.Expiry}
+	if tok.Expiry.IsZero() {
+		access.ExpiresAt = time.Now().Add(time.Hour)
+	}
+	return access, nil
+}
@@ -0,0 +1,82 @@
+package drivemanager
+
+import (
+	"SE/internal/models"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// DriveChunkFile is a chunk file found on a drive
+type DriveChunkFile struct {
+	ID          string    `json:"drive_file_id"`
+	Name        string    `json:"name"`
+	Size        int64     `json:"size"`
+	CreatedTime time.Time `json:"created_at"`
+}
+
+type driveListResponse struct {
+	NextPageToken string `json:"nextPageToken"`
+	Files         []struct {
+		ID          string    `json:"id"`
+		Name        string    `json:"name"`
+		Size        int64     `json:"size,string"`
+		CreatedTime time.Time `json:"createdTime"`
+	} `json:"files"`
+}
+
+// ListChunkFiles lists the untrashed chunk files on a drive account, i.e. files named like chunkFilename
+func ListChunkFiles(ctx context.Context, account *models.DriveAccount) ([]DriveChunkFile, error) {
+	client, err := clientForAccount(ctx, account)
+	if err != nil {
+		return nil, err
+	}
+
+	// Drive matches "contains" on name prefixes, so filter the suffix here
+	params := url.Values{
+		"q":        {"name contains 'chunk_' and trashed = false"},
+		"fields":   {"nextPageToken,files(id,name,size,createdTime)"},
+		"pageSize": {"1000"},
+	}
+	if account.SharedDriveID != "" {
+		params.Set("corpora", "drive")
+		params.Set("driveId", account.SharedDriveID)
+		params.Set("includeItemsFromAllDrives", "true")
+		params.Set("supportsAllDrives", "true")
+	}
+
+	var files []DriveChunkFile
+	for {
+		listURL := "https://www.googleapis.com/drive/v3/files?" + params.Encode()
+		resp, err := doWithRetry(ctx, client, account.ID, opList, driveCallTimeout, func(ctx context.Context) (*http.Request, error) {
+			return http.NewRequestWithContext(ctx, "GET", listURL, nil)
+		})
+		if err != nil {
+			return nil, fmt.Errorf("drive API call failed: %w", err)
+		}
+		var page driveListResponse
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			return nil, fmt.Errorf("drive API returned status %d", resp.StatusCode)
+		}
+		err = json.NewDecoder(resp.Body).Decode(&page)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode response: %w", err)
+		}
+
+		for _, f := range page.Files {
+			if strings.HasPrefix(f.Name, "chunk_") && strings.HasSuffix(f.Name, ".2xpfm") {
+				files = append(files, DriveChunkFile{ID: f.ID, Name: f.Name, Size: f.Size, CreatedTime: f.CreatedTime})
+			}
+		}
+		if page.NextPageToken == "" {
+			return files, nil
+		}
+		params.Set("pageToken", page.NextPageToken)
+	}
+}
@@ -0,0 +1,435 @@
+package drivemanager
+
+import (
+	"crypto/md5"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// localDriveMu serializes file operations of all local drives
+var localDriveMu sync.Mutex
+
+// LocalDrivesEnabled reports whether drive accounts stored in a local directory may be linked
+func LocalDrivesEnabled() bool {
+	return localDrivesEnabled
+}
+
+// localDrive stands in for Google Drive for demos and tests. It keeps files in a directory on
+// this machine and answers the part of the Drive v3 API this package calls: about, multipart
+// and resumable uploads, downloads, deletion and trashing.
+type localDrive struct {
+	dir      string // files/, trash/ and uploads/ live here
+	name     string
+	capacity int64
+}
+
+func newLocalDriveClient(accountID primitive.ObjectID, name string) *http.Client {
+	return &http.Client{Transport: &localDrive{
+		dir:      filepath.Join(localDriveDir, accountID.Hex()),
+		name:     name,
+		capacity: localDriveCapacity,
+	}}
+}
+
+func (d *localDrive) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Body != nil {
+		defer req.Body.Close()
+	}
+	if err := req.Context().Err(); err != nil {
+		return nil, err
+	}
+	for _, sub := range []string{"files", "trash", "uploads", "names"} {
+		if err := os.MkdirAll(filepath.Join(d.dir, sub), 0o700); err != nil {
+			return nil, err
+		}
+	}
+
+	localDriveMu.Lock()
+	defer localDriveMu.Unlock()
+
+	q := req.URL.Query()
+	p := req.URL.Path
+	switch {
+	case p == "/drive/v3/about" && req.Method == "GET":
+		return d.about(req)
+	case p == "/drive/v3/files" && req.Method == "GET":
+		return d.list(req)
+	case p == "/upload/drive/v3/files" && q.Get("upload_id") != "":
+		return d.resumablePart(req, q.Get("upload_id"))
+	case p == "/upload/drive/v3/files" && req.Method == "POST" && q.Get("uploadType") == "resumable":
+		return d.startResumable(req)
+	case p == "/upload/drive/v3/files" && req.Method == "POST":
+		return d.multipartUpload(req)
+	case strings.HasPrefix(p, "/drive/v3/files/"):
+		id := strings.TrimPrefix(p, "/drive/v3/files/")
+		if id == "" || strings.ContainsAny(id, `/\.`) {
+			return driveError(req, http.StatusNotFound, "notFound")
+		}
+		return d.file(req, id)
+	}
+	return driveError(req, http.StatusNotFound, "notFound")
+}
+
+func (d *localDrive) about(req *http.Request) (*http.Response, error) {
+	usage, err := d.usage()
+	if err != nil {
+		return nil, err
+	}
+	var about driveAboutResponse
+	about.User.DisplayName = d.name
+	about.StorageQuota.Limit = d.capacity
+	about.StorageQuota.Usage = usage
+	return jsonResponse(req, http.StatusOK, about)
+}
+
+// usage is the size of all stored and trashed files; trash counts against the quota like on Drive
+func (d *localDrive) usage() (int64, error) {
+	var total int64
+	for _, sub := range []string{"files", "trash"} {
+		err := filepath.WalkDir(filepath.Join(d.dir, sub), func(_ string, e fs.DirEntry, err error) error {
+			if err != nil || e.IsDir() {
+				return err
+			}
+			info, err := e.Info()
+			if err == nil {
+				total += info.Size()
+			}
+			return err
+		})
+		if err != nil {
+			return 0, err
+		}
+	}
+	return total, nil
+}
+
+func (d *localDrive) hasRoom(size int64) (bool, error) {
+	usage, err := d.usage()
+	if err != nil {
+		return false, err
+	}
+	return usage+size <= d.capacity, nil
+}
+
+func (d *localDrive) multipartUpload(req *http.Request) (*http.Response, error) {
+	_, params, err := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	if err != nil || params["boundary"] == "" {
+		return driveError(req, http.StatusBadRequest, "badContent")
+	}
+	mr := multipart.NewReader(req.Body, params["boundary"])
+	// The first part is the metadata, the second the content
+	metaPart, err := mr.NextPart()
+	if err != nil {
+		return driveError(req, http.StatusBadRequest, "badContent")
+	}
+	var meta struct {
+		Name string `json:"name"`
+	}
+	json.NewDecoder(metaPart).Decode(&meta)
+	content, err := mr.NextPart()
+	if err != nil {
+		return driveError(req, http.StatusBadRequest, "badContent")
+	}
+
+	id := primitive.NewObjectID().Hex()
+	tmp := filepath.Join(d.dir, "uploads", id+".multipart")
+	size, err := writeLocalFile(tmp, content)
+	if err != nil {
+		return nil, err
+	}
+	if ok, err := d.hasRoom(size); err != nil || !ok {
+		os.Remove(tmp)
+		if err != nil {
+			return nil, err
+		}
+		return driveError(req, http.StatusForbidden, "storageQuotaExceeded")
+	}
+	if err := os.Rename(tmp, filepath.Join(d.dir, "files", id)); err != nil {
+		return nil, err
+	}
+	os.WriteFile(filepath.Join(d.dir, "names", id), []byte(meta.Name), 0o600)
+	return d.storedFile(req, id)
+}
+
+func (d *localDrive) startResumable(req *http.Request) (*http.Response, error) {
+	size, _ := strconv.ParseInt(req.Header.Get("X-Upload-Content-Length"), 10, 64)
+	if ok, err := d.hasRoom(size); err != nil || !ok {
+		if err != nil {
+			return nil, err
+		}
+		return driveError(req, http.StatusForbidden, "storageQuotaExceeded")
+	}
+	uploadID := primitive.NewObjectID().Hex()
+	if err := os.WriteFile(filepath.Join(d.dir, "uploads", uploadID), nil, 0o600); err != nil {
+		return nil, err
+	}
+	var meta struct {
+		Name string `json:"name"`
+	}
+	json.NewDecoder(req.Body).Decode(&meta)
+	os.WriteFile(filepath.Join(d.dir, "uploads", uploadID+".name"), []byte(meta.Name), 0o600)
+
+	resp, err := jsonResponse(req, http.StatusOK, struct{}{})
+	if err != nil {
+		return nil, err
+	}
+	loc := *req.URL
+	loc.RawQuery = url.Values{"uploadType": {"resumable"}, "upload_id": {uploadID}}.Encode()
+	resp.Header.Set("Location", loc.String())
+	return resp, nil
+}
+
+// resumablePart handles PUT (a part or a status query) and DELETE on a resumable upload session
+func (d *localDrive) resumablePart(req *http.Request, uploadID string) (*http.Response, error) {
+	if strings.ContainsAny(uploadID, `/\.`) {
+		return driveError(req, http.StatusNotFound, "notFound")
+	}
+	partial := filepath.Join(d.dir, "uploads", uploadID)
+	// The file ID is kept next to the session once it completes, so status queries still answer
+	if id, err := os.ReadFile(partial + ".done"); err == nil {
+		if req.Method == "DELETE" {
+			return driveError(req, 499, "cancelled")
+		}
+		return d.storedFile(req, string(id))
+	}
+	info, err := os.Stat(partial)
+	if err != nil {
+		return driveError(req, http.StatusNotFound, "notFound")
+	}
+	if req.Method == "DELETE" {
+		os.Remove(partial)
+		os.Remove(partial + ".name")
+		return driveError(req, 499, "cancelled")
+	}
+	if req.Method != "PUT" {
+		return driveError(req, http.StatusMethodNotAllowed, "badRequest")
+	}
+
+	// "bytes start-end/total", or "bytes */total" to ask how much was received
+	spec := strings.TrimPrefix(req.Header.Get("Content-Range"), "bytes ")
+	rng, totalStr, ok := strings.Cut(spec, "/")
+	total, err := strconv.ParseInt(totalStr, 10, 64)
+	if !ok || err != nil {
+		return driveError(req, http.StatusBadRequest, "badContent")
+	}
+	received := info.Size()
+	if rng != "*" {
+		startStr, _, _ := strings.Cut(rng, "-")
+		start, err := strconv.ParseInt(startStr, 10, 64)
+		if err != nil {
+			return driveError(req, http.StatusBadRequest, "badContent")
+		}
+		// Only accept the part that continues the upload; the client resumes from the Range we report
+		if start == received {
+			f, err := os.OpenFile(partial, os.O_WRONLY|os.O_APPEND, 0o600)
+			if err != nil {
+				return nil, err
+			}
+			n, err := io.Copy(f, req.Body)
+			received += n
+			if cerr := f.Close(); err == nil {
+				err = cerr
+			}
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if received >= total {
+		id := primitive.NewObjectID().Hex()
+		if err := os.Rename(partial, filepath.Join(d.dir, "files", id)); err != nil {
+			return nil, err
+		}
+		if err := os.WriteFile(partial+".done", []byte(id), 0o600); err != nil {
+			return nil, err
+		}
+		os.Rename(partial+".name", filepath.Join(d.dir, "names", id))
+		return d.storedFile(req, id)
+	}
+	resp, err := jsonResponse(req, http.StatusPermanentRedirect, struct{}{})
+	if err != nil {
+		return nil, err
+	}
+	if received > 0 {
+		resp.Header.Set("Range", fmt.Sprintf("bytes=0-%d", received-1))
+	}
+	return resp, nil
+}
+
+// file handles download, delete and trash/untrash of a stored file
+func (d *localDrive) file(req *http.Request, id string) (*http.Response, error) {
+	stored := filepath.Join(d.dir, "files", id)
+	trashed := filepath.Join(d.dir, "trash", id)
+
+	switch req.Method {
+	case "GET":
+		if req.URL.Query().Get("alt") != "media" {
+			return driveError(req, http.StatusBadRequest, "badRequest")
+		}
+		f, err := os.Open(stored)
+		if err != nil {
+			if f, err = os.Open(trashed); err != nil {
+				return driveError(req, http.StatusNotFound, "notFound")
+			}
+		}
+		info, err := f.Stat()
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		resp := &http.Response{
+			StatusCode:    http.StatusOK,
+			Status:        http.StatusText(http.StatusOK),
+			Header:        http.Header{"Content-Type": {"application/octet-stream"}},
+			Body:          f,
+			ContentLength: info.Size(),
+			Request:       req,
+		}
+		// A single "bytes=from-to" range, the only form the downloader sends
+		if rng := req.Header.Get("Range"); rng != "" {
+			var from, to int64
+			if _, err := fmt.Sscanf(rng, "bytes=%d-%d", &from, &to); err != nil || from > to || from >= info.Size() {
+				f.Close()
+				return driveError(req, http.StatusRequestedRangeNotSatisfiable, "requestedRangeNotSatisfiable")
+			}
+			to = min(to, info.Size()-1)
+			resp.StatusCode, resp.Status = http.StatusPartialContent, http.StatusText(http.StatusPartialContent)
+			resp.Header.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", from, to, info.Size()))
+			resp.Body = struct {
+				io.Reader
+				io.Closer
+			}{io.NewSectionReader(f, from, to-from+1), f}
+			resp.ContentLength = to - from + 1
+		}
+		return resp, nil
+	case "DELETE":
+		if os.Remove(stored) != nil && os.Remove(trashed) != nil {
+			return driveError(req, http.StatusNotFound, "notFound")
+		}
+		os.Remove(filepath.Join(d.dir, "names", id))
+		return &http.Response{StatusCode: http.StatusNoContent, Header: http.Header{}, Body: http.NoBody, Request: req}, nil
+	case "PATCH":
+		var update struct {
+			Trashed *bool `json:"trashed"`
+		}
+		if err := json.NewDecoder(req.Body).Decode(&update); err != nil {
+			return driveError(req, http.StatusBadRequest, "badContent")
+		}
+		if update.Trashed != nil {
+			from, to := trashed, stored
+			if *update.Trashed {
+				from, to = stored, trashed
+			}
+			if _, err := os.Stat(to); err != nil {
+				if os.Rename(from, to) != nil {
+					return driveError(req, http.StatusNotFound, "notFound")
+				}
+			}
+		}
+		return jsonResponse(req, http.StatusOK, driveFileResponse{ID: id})
+	}
+	return driveError(req, http.StatusMethodNotAllowed, "badRequest")
+}
+
+// list answers a files.list call with every untrashed file; the query is not evaluated
+func (d *localDrive) list(req *http.Request) (*http.Response, error) {
+	entries, err := os.ReadDir(filepath.Join(d.dir, "files"))
+	if err != nil {
+		return nil, err
+	}
+	type listedFile struct {
+		ID          string    `json:"id"`
+		Name        string    `json:"name"`
+		Size        int64     `json:"size,string"`
+		CreatedTime time.Time `json:"createdTime"`
+	}
+	files := make([]listedFile, 0, len(entries))
+	for _, e := range entries {
+		info, err := e.Info()
+		if err != nil || !info.Mode().IsRegular() {
+			continue
+		}
+		name, _ := os.ReadFile(filepath.Join(d.dir, "names", e.Name()))
+		files = append(files, listedFile{ID: e.Name(), Name: string(name), Size: info.Size(), CreatedTime: info.ModTime().UTC()})
+	}
+	return jsonResponse(req, http.StatusOK, map[string]interface{}{"files": files})
+}
+
+// storedFile answers an upload with the new file's ID and the MD5 of what was written, as Drive does
+func (d *localDrive) storedFile(req *http.Request, id string) (*http.Response, error) {
+	f, err := os.Open(filepath.Join(d.dir, "files", id))
+	if err != nil {
+		// Trashed or deleted since; the upload itself still completed
+		return jsonResponse(req, http.StatusOK, driveFileResponse{ID: id})
+	}
+	defer f.Close()
+	hash := md5.New()
+	if _, err := io.Copy(hash, f); err != nil {
+		return nil, err
+	}
+	return jsonResponse(req, http.StatusOK, driveFileResponse{ID: id, MD5Checksum: fmt.Sprintf("%x", hash.Sum(nil))})
+}
+
+func writeLocalFile(path string, r io.Reader) (int64, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o600)
+	if err != nil {
+		return 0, err
+	}
+	n, err := io.Copy(f, r)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(path)
+	}
+	return n, err
+}
+
+func jsonResponse(req *http.Request, status int, v any) (*http.Response, error) {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	return &http.Response{
+		StatusCode:    status,
+		Status:        fmt.Sprintf("%d %s", status, http.StatusText(status)),
+		Header:        http.Header{"Content-Type": {"application/json; charset=UTF-8"}},
+		Body:          io.NopCloser(strings.NewReader(string(body))),
+		ContentLength: int64(len(body)),
+		Request:       req,
+	}, nil
+}
+
+// driveError answers in Drive's JSON error format, so reason() works on it
+func driveError(req *http.Request, status int, reason string) (*http.Response, error) {
+	var body struct {
+		Error struct {
+			Code    int    `json:"code"`
+			Message string `json:"message"`
+			Errors  []struct {
+				Reason string `json:"reason"`
+			} `json:"errors"`
+		} `json:"error"`
+	}
+	body.Error.Code = status
+	body.Error.Message = reason
+	body.Error.Errors = []struct {
+		Reason string `json:"reason"`
+	}{{Reason: reason}}
+	return jsonResponse(req, status, body)
+}
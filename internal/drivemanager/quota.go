@@ -0,0 +1,190 @@
+package drivemanager
+
+import (
+	"SE/internal/metrics"
+	"SE/internal/models"
+	"SE/internal/store"
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Drive API operations, as counted for quota tracking
+const (
+	opAbout        = "about"
+	opUpload       = "upload"
+	opUploadPart   = "upload_part"
+	opUploadStatus = "upload_status"
+	opDownload     = "download"
+	opDelete       = "delete"
+	opUpdate       = "update"
+	opList         = "list"
+)
+
+var apiCalls = metrics.NewCounterVec("drive_api_calls_total", "Drive API requests by drive account and operation.", "account", "operation")
+
+func init() {
+	metrics.NewGaugeFunc("drive_api_calls_today", "Drive API requests made so far in the current quota day.", func() float64 {
+		return float64(TodayAPICalls())
+	})
+}
+
+// quotaLocation is where Google resets daily quotas (midnight Pacific time)
+var quotaLocation = func() *time.Location {
+	loc, err := time.LoadLocation("America/Los_Angeles")
+	if err != nil {
+		return time.UTC
+	}
+	return loc
+}()
+
+func quotaDay(t time.Time) string {
+	return t.In(quotaLocation).Format("2006-01-02")
+}
+
+type usageKey struct {
+	day       string
+	accountID primitive.ObjectID
+	op        string
+}
+
+var (
+	usageMu      sync.Mutex
+	usageDay     string
+	usageToday   int64                  // all calls in usageDay, including ones already persisted
+	usagePending = map[usageKey]int64{} // not yet written to the store
+)
+
+// recordAPICall counts one request against the daily quota
+func recordAPICall(accountID primitive.ObjectID, op string) {
+	apiCalls.Inc(accountID.Hex(), op)
+
+	day := quotaDay(time.Now())
+	usageMu.Lock()
+	defer usageMu.Unlock()
+	if day != usageDay {
+		usageDay = day
+		usageToday = 0
+	}
+	usageToday++
+	usagePending[usageKey{day, accountID, op}]++
+}
+
+// CurrentQuotaDay returns the quota day usage is currently counted under
+func CurrentQuotaDay() string {
+	return quotaDay(time.Now())
+}
+
+// DailyAPIQuota returns the configured daily request budget
+func DailyAPIQuota() int64 {
+	return dailyAPIQuota
+}
+
+// TodayAPICalls returns how many Drive API requests were made in the current quota day
+func TodayAPICalls() int64 {
+	usageMu.Lock()
+	defer usageMu.Unlock()
+	if usageDay != quotaDay(time.Now()) {
+		return 0
+	}
+	return usageToday
+}
+
+// BackgroundWorkAllowed reports whether non-critical background jobs (scans, GC) may call
+// Drive, i.e. today's usage is still below DRIVE_QUOTA_BACKGROUND_PCT of the daily quota
+func BackgroundWorkAllowed() bool {
+	return float64(TodayAPICalls()) < float64(dailyAPIQuota)*backgroundQuotaPct/100
+}
+
+// LoadAPIUsage restores today's call count from the store so the quota survives restarts
+func LoadAPIUsage(ctx context.Context) error {
+	day := quotaDay(time.Now())
+	usage, err := store.GetDriveAPIUsage(ctx, day)
+	if err != nil {
+		return err
+	}
+
+	var total int64
+	for _, u := range usage {
+		total += u.Count
+	}
+
+	usageMu.Lock()
+	defer usageMu.Unlock()
+	if usageDay != day {
+		usageDay = day
+		usageToday = 0
+	}
+	usageToday += total
+	return nil
+}
+
+// APIUsage returns per-account, per-operation call counts for a day, including unflushed calls
+func APIUsage(ctx context.Context, day string) ([]models.DriveAPIUsage, error) {
+	usage, err := store.GetDriveAPIUsage(ctx, day)
+	if err != nil {
+		return nil, err
+	}
+
+	index := make(map[usageKey]int, len(usage))
+	for i, u := range usage {
+		index[usageKey{u.Day, u.AccountID, u.Operation}] = i
+	}
+
+	usageMu.Lock()
+	defer usageMu.Unlock()
+	for k, n := range usagePending {
+		if k.day != day {
+			continue
+		}
+		if i, ok := index[k]; ok {
+			usage[i].Count += n
+			continue
+		}
+		usage = append(usage, models.DriveAPIUsage{Day: k.day, AccountID: k.accountID, Operation: k.op, Count: n})
+	}
+	return usage, nil
+}
+
+// RunUsageFlusher periodically persists call counts until ctx is done
+func RunUsageFlusher(ctx context.Context) {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			flushUsage(context.WithoutCancel(ctx))
+			return
+		case <-ticker.C:
+			flushUsage(ctx)
+		}
+	}
+}
+
+func flushUsage(ctx context.Context) {
+	usageMu.Lock()
+	pending := usagePending
+	usagePending = map[usageKey]int64{}
+	usageMu.Unlock()
+
+	if len(pending) == 0 {
+		return
+	}
+
+	deltas := make([]models.DriveAPIUsage, 0, len(pending))
+	for k, n := range pending {
+		deltas = append(deltas, models.DriveAPIUsage{Day: k.day, AccountID: k.accountID, Operation: k.op, Count: n})
+	}
+	if err := store.AddDriveAPIUsage(ctx, deltas); err != nil {
+		log.Printf("Failed to persist Drive API usage: %v", err)
+		// Put the counts back for the next attempt
+		usageMu.Lock()
+		for k, n := range pending {
+			usagePending[k] += n
+		}
+		usageMu.Unlock()
+	}
+}
@@ -0,0 +1,130 @@
+package drivemanager
+
+import (
+	"SE/internal/models"
+	"SE/internal/store"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// ErrInsufficientDriveSpace is returned when a drive no longer has room for the chunks planned on it
+var ErrInsufficientDriveSpace = errors.New("not enough free space on drive")
+
+// chunkReservation is a resumable upload session opened for a chunk before any bytes are sent
+type chunkReservation struct {
+	accountID primitive.ObjectID
+	client    *http.Client
+	uploadURL string
+}
+
+// reserveChunks re-checks each drive's free space against the pending chunks planned on it, then
+// opens a resumable upload session for every one of them. Drive checks quota when a session is
+// opened, so a drive that filled up since planning (e.g. another app writing to it) is caught here,
+// before any bytes are transferred. On failure the sessions opened so far are cancelled.
+func reserveChunks(ctx context.Context, plan []models.ChunkPlan, pending []int) (map[int]*chunkReservation, error) {
+	accounts := make(map[primitive.ObjectID]*models.DriveAccount)
+	clients := make(map[primitive.ObjectID]*http.Client)
+	needed := make(map[primitive.ObjectID]int64)
+	for _, i := range pending {
+		id := plan[i].DriveAccountID
+		needed[id] += storedChunkSize(ctx, plan[i].Size)
+		if _, ok := accounts[id]; ok {
+			continue
+		}
+		account, err := store.GetDriveAccountByID(ctx, id)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get drive account: %w", err)
+		}
+		client, err := clientForAccount(ctx, account)
+		if err != nil {
+			return nil, err
+		}
+		accounts[id], clients[id] = account, client
+	}
+
+	for id, need := range needed {
+		account := accounts[id]
+		// Shared drives report no per-drive quota
+		if account.SharedDriveID != "" {
+			continue
+		}
+		space, err := queryDriveSpace(ctx, clients[id], id)
+		if err != nil {
+			return nil, err
+		}
+		cacheDriveSpace(ctx, id, space)
+		if free := space.Limit - space.Usage; space.Limit > 0 && free < need {
+			return nil, fmt.Errorf("%w: %s has %d bytes free, %d needed", ErrInsufficientDriveSpace, accountName(*account), free, need)
+		}
+	}
+
+	var (
+		mu           sync.Mutex
+		firstErr     error
+		reservations = make(map[int]*chunkReservation, len(pending))
+	)
+	reserveCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < min(parallelUploads(ctx), len(pending)); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				chunk := plan[i]
+				account := accounts[chunk.DriveAccountID]
+				uploadURL, err := startResumableUpload(reserveCtx, clients[account.ID], account.ID, chunkMetadataJSON(account, chunkFilename(chunk.ChunkID)), storedChunkSize(ctx, chunk.Size))
+
+				mu.Lock()
+				if err != nil {
+					var statusErr *driveStatusError
+					if errors.As(err, &statusErr) && statusErr.reason() == "storageQuotaExceeded" {
+						err = fmt.Errorf("%w: %s", ErrInsufficientDriveSpace, accountName(*account))
+					}
+					if firstErr == nil {
+						firstErr = fmt.Errorf("failed to reserve chunk %d: %w", chunk.ChunkID, err)
+						cancel()
+					}
+				} else {
+					reservations[i] = &chunkReservation{accountID: account.ID, client: clients[account.ID], uploadURL: uploadURL}
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+
+feed:
+	for _, i := range pending {
+		select {
+		case jobs <- i:
+		case <-reserveCtx.Done():
+			break feed
+		}
+	}
+	close(jobs)
+	wg.Wait()
+
+	if firstErr == nil && ctx.Err() != nil {
+		firstErr = ctx.Err()
+	}
+	if firstErr != nil {
+		releaseReservations(ctx, reservations)
+		return nil, firstErr
+	}
+	return reservations, nil
+}
+
+// releaseReservations cancels upload sessions that were never completed
+func releaseReservations(ctx context.Context, reservations map[int]*chunkReservation) {
+	ctx = context.WithoutCancel(ctx)
+	for _, r := range reservations {
+		cancelResumableUpload(ctx, r.client, r.accountID, r.uploadURL)
+	}
+}
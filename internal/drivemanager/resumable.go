@@ -0,0 +1,201 @@
+package drivemanager
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// errUploadSessionGone means Drive no longer knows the resumable session and the upload must start over
+var errUploadSessionGone = errors.New("resumable upload session expired")
+
+// resumableUpload opens a resumable upload session and sends the file through it
+func resumableUpload(ctx context.Context, client *http.Client, accountID primitive.ObjectID, metadataJSON []byte, src io.ReaderAt, fileSize int64) (driveFileResponse, error) {
+	uploadURL, err := startResumableUpload(ctx, client, accountID, metadataJSON, fileSize)
+	if err != nil {
+		return driveFileResponse{}, err
+	}
+	return sendResumableUpload(ctx, client, accountID, uploadURL, src, fileSize)
+}
+
+// startResumableUpload opens a resumable upload session for a file of fileSize bytes and returns
+// its URL. Drive checks the account's storage quota at this point.
+func startResumableUpload(ctx context.Context, client *http.Client, accountID primitive.ObjectID, metadataJSON []byte, fileSize int64) (string, error) {
+	// The session URL keeps these parameters, so the final part is answered with the file's MD5
+	initiateURL := "https://www.googleapis.com/upload/drive/v3/files?uploadType=resumable&supportsAllDrives=true" + uploadFields
+	resp, err := doWithRetry(ctx, client, accountID, opUpload, driveCallTimeout, func(ctx context.Context) (*http.Request, error) {
+		req, err := http.NewRequestWithContext(ctx, "POST", initiateURL, bytes.NewReader(metadataJSON))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", "application/json; charset=UTF-8")
+		req.Header.Set("X-Upload-Content-Type", "application/octet-stream")
+		req.Header.Set("X-Upload-Content-Length", fmt.Sprintf("%d", fileSize))
+		return req, nil
+	})
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
+		return "", fmt.Errorf("resumable init failed: %w", newDriveStatusError(resp))
+	}
+
+	uploadURL := resp.Header.Get("Location")
+	if uploadURL == "" {
+		return "", fmt.Errorf("no upload URL returned")
+	}
+	return uploadURL, nil
+}
+
+// cancelResumableUpload discards a resumable upload session, best effort
+func cancelResumableUpload(ctx context.Context, client *http.Client, accountID primitive.ObjectID, uploadURL string) {
+	resp, err := doWithRetry(ctx, client, accountID, opUploadStatus, driveCallTimeout, func(ctx context.Context) (*http.Request, error) {
+		return http.NewRequestWithContext(ctx, "DELETE", uploadURL, nil)
+	})
+	if err == nil {
+		resp.Body.Close()
+	}
+}
+
+// sendResumableUpload sends the file in parts of uploadPartSize bytes through an open session.
+// A failed part is retried with exponential backoff, resuming from the offset Drive reports it has received.
+func sendResumableUpload(ctx context.Context, client *http.Client, accountID primitive.ObjectID, uploadURL string, src io.ReaderAt, fileSize int64) (driveFileResponse, error) {
+	var offset int64
+	var err error
+	for {
+		var file driveFileResponse
+		var next int64
+		for attempt := 0; ; attempt++ {
+			file, next, err = uploadPart(ctx, client, accountID, uploadURL, src, offset, fileSize)
+			if err == nil {
+				break
+			}
+			// Only network errors and 429/5xx are worth another try
+			var statusErr *driveStatusError
+			isStatus := errors.As(err, &statusErr)
+			if errors.Is(err, errUploadSessionGone) || ctx.Err() != nil || (isStatus && !isRetryableStatus(statusErr.StatusCode)) {
+				return driveFileResponse{}, fmt.Errorf("part at offset %d: %w", offset, err)
+			}
+			if attempt >= uploadPartRetries {
+				exhausted := &RetryExhaustedError{Attempts: attempt + 1, Err: err}
+				if isStatus {
+					exhausted.StatusCode = statusErr.StatusCode
+				}
+				return driveFileResponse{}, fmt.Errorf("part at offset %d: %w", offset, exhausted)
+			}
+
+			var retryAfter string
+			if isStatus {
+				retryAfter = statusErr.RetryAfter
+			}
+			if err := waitRetry(ctx, retryDelay(attempt, retryAfter)); err != nil {
+				return driveFileResponse{}, err
+			}
+
+			// Ask Drive how much it actually received before retrying
+			received, done, qerr := queryUploadStatus(ctx, client, accountID, uploadURL, fileSize)
+			if qerr != nil {
+				if errors.Is(qerr, errUploadSessionGone) {
+					return driveFileResponse{}, fmt.Errorf("part at offset %d: %w", offset, qerr)
+				}
+				continue
+			}
+			if done.ID != "" {
+				return done, nil
+			}
+			offset = received
+		}
+
+		if file.ID != "" {
+			return file, nil
+		}
+		offset = next
+	}
+}
+
+// uploadPart PUTs one part starting at offset. It returns the file once Drive reports the
+// upload complete, otherwise the offset of the next byte Drive expects.
+func uploadPart(ctx context.Context, client *http.Client, accountID primitive.ObjectID, uploadURL string, src io.ReaderAt, offset, fileSize int64) (driveFileResponse, int64, error) {
+	partLen := min(uploadPartSize, fileSize-offset)
+	section := io.NewSectionReader(src, offset, partLen)
+	partMD5, err := contentMD5(section)
+	if err != nil {
+		return driveFileResponse{}, 0, err
+	}
+	section.Seek(0, io.SeekStart)
+
+	req, err := http.NewRequestWithContext(ctx, "PUT", uploadURL, newThrottledReader(ctx, accountID, section))
+	if err != nil {
+		return driveFileResponse{}, 0, err
+	}
+	req.ContentLength = partLen
+	req.Header.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", offset, offset+partLen-1, fileSize))
+	req.Header.Set("Content-MD5", partMD5)
+
+	recordAPICall(accountID, opUploadPart)
+	resp, err := client.Do(req)
+	if err != nil {
+		return driveFileResponse{}, 0, err
+	}
+	defer resp.Body.Close()
+
+	return parseUploadResponse(resp, offset)
+}
+
+// queryUploadStatus asks Drive how many bytes of the upload it has persisted
+func queryUploadStatus(ctx context.Context, client *http.Client, accountID primitive.ObjectID, uploadURL string, fileSize int64) (int64, driveFileResponse, error) {
+	resp, err := doWithRetry(ctx, client, accountID, opUploadStatus, driveCallTimeout, func(ctx context.Context) (*http.Request, error) {
+		req, err := http.NewRequestWithContext(ctx, "PUT", uploadURL, nil)
+		if err != nil {
+			return nil, err
+		}
+		req.ContentLength = 0
+		req.Header.Set("Content-Range", fmt.Sprintf("bytes */%d", fileSize))
+		return req, nil
+	})
+	if err != nil {
+		return 0, driveFileResponse{}, err
+	}
+	defer resp.Body.Close()
+
+	file, next, err := parseUploadResponse(resp, 0)
+	return next, file, err
+}
+
+// parseUploadResponse interprets a response to a part upload or status query
+func parseUploadResponse(resp *http.Response, offset int64) (driveFileResponse, int64, error) {
+	switch {
+	case resp.StatusCode == http.StatusOK || resp.StatusCode == http.StatusCreated:
+		var fileResp driveFileResponse
+		if err := json.NewDecoder(resp.Body).Decode(&fileResp); err != nil {
+			return driveFileResponse{}, 0, err
+		}
+		return fileResp, 0, nil
+	case resp.StatusCode == http.StatusPermanentRedirect:
+		// "Range: bytes=0-N" means bytes up to N were received; no header means none were
+		next := int64(0)
+		if r := resp.Header.Get("Range"); r != "" {
+			_, end, ok := strings.Cut(r, "-")
+			n, err := strconv.ParseInt(end, 10, 64)
+			if !ok || err != nil {
+				return driveFileResponse{}, 0, fmt.Errorf("invalid Range header %q", r)
+			}
+			next = n + 1
+		}
+		return driveFileResponse{}, next, nil
+	case resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusGone:
+		return driveFileResponse{}, 0, errUploadSessionGone
+	default:
+		return driveFileResponse{}, 0, fmt.Errorf("upload part at offset %d failed: %w", offset, newDriveStatusError(resp))
+	}
+}
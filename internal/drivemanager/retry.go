@@ -0,0 +1,191 @@
+package drivemanager
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const (
+	retryBaseDelay = time.Second
+	retryMaxDelay  = 32 * time.Second
+)
+
+// RetryExhaustedError is returned when a Drive call still fails after every retry
+type RetryExhaustedError struct {
+	Attempts   int
+	StatusCode int // last HTTP status, 0 if the last attempt failed without a response
+	Err        error
+}
+
+func (e *RetryExhaustedError) Error() string {
+	if e.StatusCode != 0 {
+		return fmt.Sprintf("drive API still failing after %d attempts: status %d: %v", e.Attempts, e.StatusCode, e.Err)
+	}
+	return fmt.Sprintf("drive API still failing after %d attempts: %v", e.Attempts, e.Err)
+}
+
+func (e *RetryExhaustedError) Unwrap() error { return e.Err }
+
+// driveStatusError is a non-success response from Drive
+type driveStatusError struct {
+	StatusCode int
+	RetryAfter string
+	Body       string
+}
+
+func (e *driveStatusError) Error() string {
+	return fmt.Sprintf("status %d: %s", e.StatusCode, e.Body)
+}
+
+func newDriveStatusError(resp *http.Response) *driveStatusError {
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	return &driveStatusError{
+		StatusCode: resp.StatusCode,
+		RetryAfter: resp.Header.Get("Retry-After"),
+		Body:       string(body),
+	}
+}
+
+// reason returns the first error reason in Drive's JSON error body, if any
+func (e *driveStatusError) reason() string {
+	var body struct {
+		Error struct {
+			Errors []struct {
+				Reason string `json:"reason"`
+			} `json:"errors"`
+		} `json:"error"`
+	}
+	if json.Unmarshal([]byte(e.Body), &body) != nil || len(body.Error.Errors) == 0 {
+		return ""
+	}
+	return body.Error.Errors[0].Reason
+}
+
+// DownloadQuotaError is returned when Drive refuses a download because the file has been
+// downloaded too often recently. The quota recovers on its own after a while.
+type DownloadQuotaError struct {
+	RetryAfter time.Duration // Drive's suggested wait, 0 if it gave none
+}
+
+func (e *DownloadQuotaError) Error() string {
+	return "drive download quota exceeded for this file"
+}
+
+// IsNotFound reports whether err is Drive saying the file doesn't exist
+func IsNotFound(err error) bool {
+	var statusErr *driveStatusError
+	return errors.As(err, &statusErr) && statusErr.StatusCode == http.StatusNotFound
+}
+
+// isRetryableStatus reports whether Drive may succeed if the same call is repeated
+func isRetryableStatus(code int) bool {
+	switch code {
+	case http.StatusTooManyRequests, http.StatusInternalServerError, http.StatusBadGateway, http.StatusServiceUnavailable:
+		return true
+	}
+	return false
+}
+
+// retryDelay honors a Retry-After header (seconds or HTTP date), otherwise backs off
+// exponentially from retryBaseDelay with up to 50% jitter
+func retryDelay(attempt int, retryAfter string) time.Duration {
+	if retryAfter != "" {
+		if secs, err := strconv.Atoi(retryAfter); err == nil && secs >= 0 {
+			return time.Duration(secs) * time.Second
+		}
+		if t, err := http.ParseTime(retryAfter); err == nil {
+			return max(time.Until(t), 0)
+		}
+	}
+
+	delay := min(retryBaseDelay<<min(attempt, 10), retryMaxDelay)
+	return delay + time.Duration(rand.Int63n(int64(delay)/2+1))
+}
+
+// Backoff is how long to wait before retry attempt+1 of something that failed, like retryDelay
+func Backoff(attempt int) time.Duration {
+	return retryDelay(attempt, "")
+}
+
+// waitRetry sleeps for d unless ctx is done first
+func waitRetry(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// cancelOnClose releases a per-attempt context once the response body is closed
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (c *cancelOnClose) Close() error {
+	err := c.ReadCloser.Close()
+	c.cancel()
+	return err
+}
+
+// doWithRetry sends the request built by newReq, retrying network errors and 429/5xx responses.
+// Every attempt counts against accountID's quota under op. newReq is called for every attempt so request bodies can be replayed. A non-zero timeout bounds
+// each attempt rather than the whole call, so waiting out a Retry-After doesn't eat into it.
+// Any other response is returned to the caller as is.
+func doWithRetry(ctx context.Context, client *http.Client, accountID primitive.ObjectID, op string, timeout time.Duration, newReq func(ctx context.Context) (*http.Request, error)) (*http.Response, error) {
+	var lastErr error
+	var lastStatus int
+	for attempt := 0; attempt <= driveAPIRetries; attempt++ {
+		attemptCtx, cancel := ctx, context.CancelFunc(func() {})
+		if timeout > 0 {
+			attemptCtx, cancel = context.WithTimeout(ctx, timeout)
+		}
+
+		req, err := newReq(attemptCtx)
+		if err != nil {
+			cancel()
+			return nil, err
+		}
+
+		var retryAfter string
+		recordAPICall(accountID, op)
+		resp, err := client.Do(req)
+		if err != nil {
+			cancel()
+			if ctx.Err() != nil {
+				return nil, err
+			}
+			lastErr, lastStatus = err, 0
+		} else if isRetryableStatus(resp.StatusCode) {
+			statusErr := newDriveStatusError(resp)
+			resp.Body.Close()
+			cancel()
+			lastErr, lastStatus = statusErr, resp.StatusCode
+			retryAfter = statusErr.RetryAfter
+		} else {
+			resp.Body = &cancelOnClose{ReadCloser: resp.Body, cancel: cancel}
+			return resp, nil
+		}
+
+		if attempt == driveAPIRetries {
+			break
+		}
+		if err := waitRetry(ctx, retryDelay(attempt, retryAfter)); err != nil {
+			return nil, err
+		}
+	}
+
+	return nil, &RetryExhaustedError{Attempts: driveAPIRetries + 1, StatusCode: lastStatus, Err: lastErr}
+}
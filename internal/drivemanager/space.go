@@ -1,8 +1,9 @@
 package drivemanager
 
 import (
+	"SE/internal/cache"
 	"SE/internal/models"
-	"SE/internal/oauth"
+	"SE/internal/notify"
 	"SE/internal/store"
 	"context"
 	"encoding/json"
@@ -10,7 +11,6 @@ import (
 	"net/http"
 
 	"go.mongodb.org/mongo-driver/bson/primitive"
-	"golang.org/x/oauth2"
 )
 
 // GetUserDriveSpaces retrieves available space for all user's drive accounts
@@ -31,31 +31,43 @@ func GetUserDriveSpaces(ctx context.Context, userID primitive.ObjectID) ([]model
 		spaceInfo := models.DriveSpaceInfo{
 			AccountID:   account.ID,
 			DisplayName: account.DisplayName,
+			Label:       account.Label,
+			Color:       account.Color,
 			Available:   false,
+			Throughput:  AccountThroughput(account.ID),
 		}
 
-		// Decrypt OAuth token
-		tokenData, err := oauth.Decrypt(account.EncryptedToken)
-		if err != nil {
-			spaceInfo.Error = fmt.Sprintf("failed to decrypt token: %v", err)
-			spaces = append(spaces, spaceInfo)
-			continue
+		space, ok := cachedDriveSpace(ctx, account.ID)
+		if !ok {
+			client, err := clientForAccount(ctx, &account)
+			if err != nil {
+				spaceInfo.Error = err.Error()
+				spaces = append(spaces, spaceInfo)
+				continue
+			}
+
+			// Get space info from Google Drive API
+			space, err = queryDriveSpace(ctx, client, account.ID)
+			if err != nil {
+				spaceInfo.Error = fmt.Sprintf("failed to query drive: %v", err)
+				spaces = append(spaces, spaceInfo)
+				notify.Notify(notify.Event{
+					Type:      notify.EventDriveHealth,
+					UserID:    userID,
+					Title:     fmt.Sprintf("Drive account %s is unreachable", accountName(account)),
+					Message:   spaceInfo.Error,
+					DedupeKey: account.ID.Hex(),
+				})
+				continue
+			}
+			cacheDriveSpace(ctx, account.ID, space)
 		}
 
-		// Unmarshal token
-		var token oauth2.Token
-		if err := json.Unmarshal(tokenData, &token); err != nil {
-			spaceInfo.Error = fmt.Sprintf("failed to parse token: %v", err)
-			spaces = append(spaces, spaceInfo)
-			continue
-		}
-
-		// Get space info from Google Drive API
-		space, err := queryDriveSpace(&token)
-		if err != nil {
-			spaceInfo.Error = fmt.Sprintf("failed to query drive: %v", err)
-			spaces = append(spaces, spaceInfo)
-			continue
+		// Shared drives draw from the organisation's pooled storage and report no
+		// per-drive quota, so they are planned against a configured nominal capacity
+		if account.SharedDriveID != "" {
+			space.Limit = sharedDriveCapacity
+			space.Usage = 0
 		}
 
 		spaceInfo.OwnerName = space.OwnerName
@@ -71,6 +83,54 @@ func GetUserDriveSpaces(ctx context.Context, userID primitive.ObjectID) ([]model
 	return spaces, nil
 }
 
+// driveSpaceCacheKey is where a drive's quota is cached
+func driveSpaceCacheKey(accountID primitive.ObjectID) string {
+	return "drive_space:" + accountID.Hex()
+}
+
+// cachedDriveSpace returns the drive's quota if it was queried within DRIVE_SPACE_CACHE_SECONDS.
+// Planning can work from a slightly stale quota, since reserveChunks queries every drive again
+// before any bytes are sent.
+func cachedDriveSpace(ctx context.Context, accountID primitive.ObjectID) (*driveSpace, bool) {
+	b, ok := cache.Get(ctx, driveSpaceCacheKey(accountID))
+	if !ok {
+		return nil, false
+	}
+	var space driveSpace
+	if err := json.Unmarshal(b, &space); err != nil {
+		return nil, false
+	}
+	return &space, true
+}
+
+// cacheDriveSpace caches a quota just queried from the drive
+func cacheDriveSpace(ctx context.Context, accountID primitive.ObjectID, space *driveSpace) {
+	if b, err := json.Marshal(space); err == nil {
+		cache.Set(ctx, driveSpaceCacheKey(accountID), b, cache.DriveSpaceTTL())
+	}
+}
+
+// accountName returns the most descriptive name available for an account
+func accountName(account models.DriveAccount) string {
+	if account.Label != "" {
+		return account.Label
+	}
+	if account.DisplayName != "" {
+		return account.DisplayName + " (" + account.ID.Hex() + ")"
+	}
+	return account.ID.Hex()
+}
+
+// CheckAccountAccess verifies that the account's credentials can reach the Drive API
+func CheckAccountAccess(ctx context.Context, account *models.DriveAccount) error {
+	client, err := clientForAccount(ctx, account)
+	if err != nil {
+		return err
+	}
+	_, err = queryDriveSpace(ctx, client, account.ID)
+	return err
+}
+
 type driveAboutResponse struct {
 	User struct {
 		DisplayName  string `json:"displayName"`
@@ -82,16 +142,18 @@ type driveAboutResponse struct {
 	} `json:"storageQuota"`
 }
 
-// queryDriveSpace calls Google Drive API to get storage info
-func queryDriveSpace(token *oauth2.Token) (*struct {
+// driveSpace is a drive's storage quota and owner
+type driveSpace struct {
 	Limit, Usage          int64
 	OwnerName, OwnerEmail string
-}, error) {
-	// Create HTTP client with OAuth2 token (auto-refreshes using refresh_token)
-	client := oauth.NewClient(context.Background(), token)
+}
 
+// queryDriveSpace calls Google Drive API to get storage info
+func queryDriveSpace(ctx context.Context, client *http.Client, accountID primitive.ObjectID) (*driveSpace, error) {
 	// Call Drive API
-	resp, err := client.Get("https://www.googleapis.com/drive/v3/about?fields=user(displayName,emailAddress),storageQuota")
+	resp, err := doWithRetry(ctx, client, accountID, opAbout, driveCallTimeout, func(ctx context.Context) (*http.Request, error) {
+		return http.NewRequestWithContext(ctx, "GET", "https://www.googleapis.com/drive/v3/about?fields=user(displayName,emailAddress),storageQuota", nil)
+	})
 	if err != nil {
 		return nil, fmt.Errorf("drive API call failed: %w", err)
 	}
@@ -106,10 +168,7 @@ func queryDriveSpace(token *oauth2.Token) (*struct {
 		return nil, fmt.Errorf("failed to decode response: %w", err)
 	}
 
-	return &struct {
-		Limit, Usage          int64
-		OwnerName, OwnerEmail string
-	}{
+	return &driveSpace{
 		Limit:      about.StorageQuota.Limit,
 		Usage:      about.StorageQuota.Usage,
 		OwnerName:  about.User.DisplayName,
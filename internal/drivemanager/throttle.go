@@ -0,0 +1,171 @@
+package drivemanager
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"golang.org/x/time/rate"
+)
+
+// throttleBurst is the largest single read passed through a limiter
+const throttleBurst = 64 * 1024
+
+var (
+	// globalLimiter caps the combined transfer rate of all drives (nil = unlimited)
+	globalLimiter *rate.Limiter
+	// accountLimits holds per-account caps in bytes/sec from DRIVE_BANDWIDTH_LIMITS
+	accountLimits map[string]int
+
+	limitersMu      sync.Mutex
+	accountLimiters = make(map[string]*rate.Limiter)
+
+	metersMu      sync.Mutex
+	accountMeters = make(map[string]*TransferMeter)
+)
+
+func newLimiter(bytesPerSec int) *rate.Limiter {
+	return rate.NewLimiter(rate.Limit(bytesPerSec), throttleBurst)
+}
+
+// limiterFor returns the shared limiter of an account, or nil if it is not limited
+func limiterFor(accountID primitive.ObjectID) *rate.Limiter {
+	limit, ok := accountLimits[accountID.Hex()]
+	if !ok {
+		return nil
+	}
+
+	limitersMu.Lock()
+	defer limitersMu.Unlock()
+	l, ok := accountLimiters[accountID.Hex()]
+	if !ok {
+		l = newLimiter(limit)
+		accountLimiters[accountID.Hex()] = l
+	}
+	return l
+}
+
+// meterFor returns the throughput meter of an account
+func meterFor(accountID primitive.ObjectID) *TransferMeter {
+	metersMu.Lock()
+	defer metersMu.Unlock()
+	m, ok := accountMeters[accountID.Hex()]
+	if !ok {
+		m = NewTransferMeter()
+		accountMeters[accountID.Hex()] = m
+	}
+	return m
+}
+
+// AccountThroughput returns the current transfer rate of an account in bytes/sec
+func AccountThroughput(accountID primitive.ObjectID) float64 {
+	metersMu.Lock()
+	m, ok := accountMeters[accountID.Hex()]
+	metersMu.Unlock()
+	if !ok {
+		return 0
+	}
+	return m.Rate()
+}
+
+// TransferMeter measures throughput as a moving average over roughly the last few seconds
+type TransferMeter struct {
+	mu         sync.Mutex
+	windowFrom time.Time
+	windowSize int64
+	rate       float64
+	lastActive time.Time
+}
+
+const (
+	meterWindow = time.Second
+	meterIdle   = 5 * time.Second
+)
+
+func NewTransferMeter() *TransferMeter {
+	return &TransferMeter{windowFrom: time.Now()}
+}
+
+// Add records n transferred bytes
+func (m *TransferMeter) Add(n int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	m.windowSize += int64(n)
+	m.lastActive = now
+
+	if elapsed := now.Sub(m.windowFrom); elapsed >= meterWindow {
+		current := float64(m.windowSize) / elapsed.Seconds()
+		if m.rate == 0 {
+			m.rate = current
+		} else {
+			// Smooth over a few windows so the number doesn't jump around
+			m.rate = 0.7*m.rate + 0.3*current
+		}
+		m.windowFrom = now
+		m.windowSize = 0
+	}
+}
+
+// Rate returns the smoothed rate in bytes/sec, or 0 when idle
+func (m *TransferMeter) Rate() float64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if time.Since(m.lastActive) > meterIdle {
+		return 0
+	}
+	return m.rate
+}
+
+type transferMeterKey struct{}
+
+// WithTransferMeter attaches a meter to ctx; transfers made with ctx report their bytes to it
+func WithTransferMeter(ctx context.Context, m *TransferMeter) context.Context {
+	return context.WithValue(ctx, transferMeterKey{}, m)
+}
+
+// throttledReader applies the global and per-account limits and feeds the meters
+type throttledReader struct {
+	ctx      context.Context
+	r        io.Reader
+	limiters []*rate.Limiter
+	meters   []*TransferMeter
+}
+
+// newThrottledReader wraps r with the bandwidth limits and meters that apply to accountID
+func newThrottledReader(ctx context.Context, accountID primitive.ObjectID, r io.Reader) io.Reader {
+	tr := &throttledReader{ctx: ctx, r: r}
+	if globalLimiter != nil {
+		tr.limiters = append(tr.limiters, globalLimiter)
+	}
+	if l := limiterFor(accountID); l != nil {
+		tr.limiters = append(tr.limiters, l)
+	}
+	tr.meters = append(tr.meters, meterFor(accountID))
+	if m, ok := ctx.Value(transferMeterKey{}).(*TransferMeter); ok {
+		tr.meters = append(tr.meters, m)
+	}
+	return tr
+}
+
+func (t *throttledReader) Read(p []byte) (int, error) {
+	if len(t.limiters) > 0 && len(p) > throttleBurst {
+		p = p[:throttleBurst]
+	}
+
+	n, err := t.r.Read(p)
+	if n > 0 {
+		for _, l := range t.limiters {
+			if werr := l.WaitN(t.ctx, n); werr != nil {
+				return n, werr
+			}
+		}
+		for _, m := range t.meters {
+			m.Add(n)
+		}
+	}
+	return n, err
+}
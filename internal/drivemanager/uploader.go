@@ -1,90 +1,98 @@
 package drivemanager
 
 import (
+	"SE/internal/metrics"
 	"SE/internal/models"
-	"SE/internal/oauth"
 	"SE/internal/store"
 	"bytes"
 	"context"
+	"crypto/md5"
 	"crypto/sha256"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"log"
 	"mime/multipart"
 	"net/http"
 	"net/textproto"
-	"os"
+	"sort"
+	"sync"
 
 	"go.mongodb.org/mongo-driver/bson/primitive"
-	"golang.org/x/oauth2"
 )
 
-// UploadChunkToDrive uploads a file chunk to a specific Google Drive account
-func UploadChunkToDrive(ctx context.Context, accountID primitive.ObjectID, chunkPath, filename string) (string, error) {
+// UploadChunkToDrive uploads size bytes read from src as a file on a specific Google Drive account.
+// It returns the file ID and the MD5 Drive computed over what it received, empty if Drive reported none.
+func UploadChunkToDrive(ctx context.Context, accountID primitive.ObjectID, src io.ReaderAt, size int64, filename string) (string, string, error) {
 	// Get drive account
 	account, err := store.GetDriveAccountByID(ctx, accountID)
 	if err != nil {
-		return "", fmt.Errorf("failed to get drive account: %w", err)
+		return "", "", fmt.Errorf("failed to get drive account: %w", err)
 	}
 
-	// Decrypt OAuth token
-	tokenData, err := oauth.Decrypt(account.EncryptedToken)
+	// Create HTTP client for the account (OAuth token or service account key)
+	client, err := clientForAccount(ctx, account)
 	if err != nil {
-		return "", fmt.Errorf("failed to decrypt token: %w", err)
+		return "", "", err
 	}
 
-	// Unmarshal token
-	var token oauth2.Token
-	if err := json.Unmarshal(tokenData, &token); err != nil {
-		return "", fmt.Errorf("failed to parse token: %w", err)
+	// Upload to Drive, bounded by the transfer timeout
+	callCtx, cancel := context.WithTimeout(ctx, driveTransferTimeout)
+	defer cancel()
+	file, err := uploadFileToDrive(callCtx, client, account, src, size, filename)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to upload to drive: %w", err)
 	}
 
-	// Upload to Drive
-	fileID, err := uploadFileToDrive(&token, chunkPath, filename)
-	if err != nil {
-		return "", fmt.Errorf("failed to upload to drive: %w", err)
+	return file.ID, file.MD5Checksum, nil
+}
+
+// chunkMetadataJSON is the Drive file metadata for a chunk uploaded to account
+func chunkMetadataJSON(account *models.DriveAccount, filename string) []byte {
+	metadata := map[string]interface{}{
+		"name": filename,
+	}
+	if account.SharedDriveID != "" {
+		metadata["parents"] = []string{account.SharedDriveID}
 	}
+	metadataJSON, _ := json.Marshal(metadata)
+	return metadataJSON
+}
 
-	return fileID, nil
+func chunkFilename(chunkID int) string {
+	return fmt.Sprintf("chunk_%03d.2xpfm", chunkID)
 }
 
 type driveFileResponse struct {
-	ID   string `json:"id"`
-	Name string `json:"name"`
+	ID          string `json:"id"`
+	Name        string `json:"name"`
+	MD5Checksum string `json:"md5Checksum,omitempty"` // requested with uploadFields
 }
 
-// uploadFileToDrive performs the actual upload using Google Drive API
-func uploadFileToDrive(token *oauth2.Token, filePath, filename string) (string, error) {
-	// Open file
-	file, err := os.Open(filePath)
-	if err != nil {
-		return "", err
-	}
-	defer file.Close()
+// uploadFields asks Drive to answer an upload with the MD5 of what it stored
+const uploadFields = "&fields=id,md5Checksum"
 
-	fileStat, err := file.Stat()
-	if err != nil {
-		return "", err
-	}
+// ErrChecksumMismatch means Drive stored different bytes than were sent
+var ErrChecksumMismatch = errors.New("drive checksum does not match the chunk")
 
-	// Create HTTP client with OAuth2 token that auto-refreshes
-	ctx := context.Background()
-	client := oauth.NewClient(ctx, token)
+// checksumMismatches counts chunks Drive received corrupted
+var checksumMismatches = metrics.NewCounterVec("drive_chunk_checksum_mismatches_total",
+	"Chunks whose MD5 reported by Drive differed from what was sent, by drive account.", "account")
 
-	// Create metadata
-	metadata := map[string]interface{}{
-		"name": filename,
-	}
-	metadataJSON, _ := json.Marshal(metadata)
+// uploadFileToDrive performs the actual upload using Google Drive API
+func uploadFileToDrive(ctx context.Context, client *http.Client, account *models.DriveAccount, src io.ReaderAt, size int64, filename string) (driveFileResponse, error) {
+	metadataJSON := chunkMetadataJSON(account, filename)
 
 	// Use simple upload for files < 5MB, resumable for larger
-	if fileStat.Size() < 5*1024*1024 {
-		return simpleUpload(client, metadataJSON, file, fileStat.Size())
+	if size < 5*1024*1024 {
+		return simpleUpload(ctx, client, account.ID, metadataJSON, src, size)
 	}
-	return resumableUpload(client, metadataJSON, file, fileStat.Size())
+	return resumableUpload(ctx, client, account.ID, metadataJSON, src, size)
 }
 
-func simpleUpload(client *http.Client, metadataJSON []byte, file *os.File, fileSize int64) (string, error) {
+func simpleUpload(ctx context.Context, client *http.Client, accountID primitive.ObjectID, metadataJSON []byte, src io.ReaderAt, fileSize int64) (driveFileResponse, error) {
 	body := &bytes.Buffer{}
 	writer := multipart.NewWriter(body)
 
@@ -93,211 +101,450 @@ func simpleUpload(client *http.Client, metadataJSON []byte, file *os.File, fileS
 		"Content-Type": {"application/json; charset=UTF-8"},
 	})
 	if err != nil {
-		return "", err
+		return driveFileResponse{}, err
 	}
 	metadataPart.Write(metadataJSON)
 
-	// Add file content part
+	// Add file content part, with its MD5 for servers that check it
+	contentMD5, err := contentMD5(io.NewSectionReader(src, 0, fileSize))
+	if err != nil {
+		return driveFileResponse{}, err
+	}
 	filePart, err := writer.CreatePart(textproto.MIMEHeader{
 		"Content-Type": {"application/octet-stream"},
+		"Content-MD5":  {contentMD5},
 	})
 	if err != nil {
-		return "", err
+		return driveFileResponse{}, err
 	}
 
-	if _, err := io.Copy(filePart, file); err != nil {
-		return "", err
+	if _, err := io.Copy(filePart, io.NewSectionReader(src, 0, fileSize)); err != nil {
+		return driveFileResponse{}, err
 	}
 
 	writer.Close()
 
-	uploadURL := "https://www.googleapis.com/upload/drive/v3/files?uploadType=multipart"
-	req, err := http.NewRequest("POST", uploadURL, body)
+	uploadURL := "https://www.googleapis.com/upload/drive/v3/files?uploadType=multipart&supportsAllDrives=true" + uploadFields
+	bodyBytes := body.Bytes()
+	resp, err := doWithRetry(ctx, client, accountID, opUpload, 0, func(ctx context.Context) (*http.Request, error) {
+		req, err := http.NewRequestWithContext(ctx, "POST", uploadURL, newThrottledReader(ctx, accountID, bytes.NewReader(bodyBytes)))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", writer.FormDataContentType())
+		req.ContentLength = int64(len(bodyBytes))
+		return req, nil
+	})
 	if err != nil {
-		return "", err
-	}
-
-	req.Header.Set("Content-Type", writer.FormDataContentType())
-	req.ContentLength = int64(body.Len())
-
-	resp, err := client.Do(req)
-	if err != nil {
-		return "", err
+		return driveFileResponse{}, err
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
 		respBody, _ := io.ReadAll(resp.Body)
-		return "", fmt.Errorf("drive API returned status %d: %s", resp.StatusCode, string(respBody))
+		return driveFileResponse{}, fmt.Errorf("drive API returned status %d: %s", resp.StatusCode, string(respBody))
 	}
 
 	var fileResp driveFileResponse
 	if err := json.NewDecoder(resp.Body).Decode(&fileResp); err != nil {
-		return "", err
+		return driveFileResponse{}, err
 	}
 
-	return fileResp.ID, nil
+	return fileResp, nil
 }
 
-func resumableUpload(client *http.Client, metadataJSON []byte, file *os.File, fileSize int64) (string, error) {
-	// Step 1: Initiate resumable upload
-	initiateURL := "https://www.googleapis.com/upload/drive/v3/files?uploadType=resumable"
-	req, err := http.NewRequest("POST", initiateURL, bytes.NewReader(metadataJSON))
-	if err != nil {
-		return "", err
-	}
-	req.Header.Set("Content-Type", "application/json; charset=UTF-8")
-	req.Header.Set("X-Upload-Content-Type", "application/octet-stream")
-	req.Header.Set("X-Upload-Content-Length", fmt.Sprintf("%d", fileSize))
+// ErrUploadPaused is returned by UploadChunksToDrivers when it stopped because of a WithPause request
+var ErrUploadPaused = errors.New("upload paused")
 
-	resp, err := client.Do(req)
-	if err != nil {
-		return "", err
-	}
-	defer resp.Body.Close()
+type pauseKey struct{}
 
-	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
-		respBody, _ := io.ReadAll(resp.Body)
-		return "", fmt.Errorf("resumable init failed: status %d: %s", resp.StatusCode, string(respBody))
-	}
+// WithPause makes UploadChunksToDrivers stop starting chunks once pause is closed. Chunks already
+// in flight are finished, then it returns ErrUploadPaused.
+func WithPause(ctx context.Context, pause <-chan struct{}) context.Context {
+	return context.WithValue(ctx, pauseKey{}, pause)
+}
 
-	uploadURL := resp.Header.Get("Location")
-	if uploadURL == "" {
-		return "", fmt.Errorf("no upload URL returned")
+type parallelUploadsKey struct{}
+
+// PartialUploadError is returned by UploadChunksToDrivers under WithPartialUploads when some
+// chunks used up their attempts. The other chunks were uploaded and reported to onChunk.
+type PartialUploadError struct {
+	FailedChunks []int // chunk IDs
+	Err          error // the error of the first chunk that failed
+}
+
+func (e *PartialUploadError) Error() string {
+	return fmt.Sprintf("%d chunks failed to upload: %v", len(e.FailedChunks), e.Err)
+}
+
+func (e *PartialUploadError) Unwrap() error { return e.Err }
+
+type partialKey struct{}
+
+// WithPartialUploads makes UploadChunksToDrivers carry on with the other chunks when one fails
+// for good, returning a *PartialUploadError at the end instead of stopping at the first failure
+func WithPartialUploads(ctx context.Context) context.Context {
+	return context.WithValue(ctx, partialKey{}, true)
+}
+
+// WithParallelUploads lowers how many chunks UploadChunksToDrivers sends at once for uploads made with ctx.
+// n is capped by MAX_PARALLEL_UPLOADS; 0 keeps the configured value.
+func WithParallelUploads(ctx context.Context, n int) context.Context {
+	return context.WithValue(ctx, parallelUploadsKey{}, n)
+}
+
+func parallelUploads(ctx context.Context) int {
+	if n, ok := ctx.Value(parallelUploadsKey{}).(int); ok && n > 0 {
+		return min(n, maxParallelUploads)
 	}
+	return maxParallelUploads
+}
 
-	// Step 2: Upload file content
-	file.Seek(0, 0) // Reset to beginning
+// UploadChunksToDrivers uploads all chunks to their respective drives, reading chunk i from sources[i], up to maxParallelUploads
+// (or the WithParallelUploads limit) at a time. Chunks already present in done (keyed by chunk ID) are skipped. onChunk is called with each newly uploaded
+// chunk and the number of finished chunks. Every pending chunk is reserved on its drive before any is transferred, so a drive
+// that ran out of space fails the call up front. A chunk is attempted up to CHUNK_UPLOAD_ATTEMPTS times. If any chunk fails,
+// the chunks that did finish are left on their drives so the caller can resume with the rest or remove them with DeleteChunks;
+// unfinished reservations are cancelled.
+func UploadChunksToDrivers(ctx context.Context, sources []io.ReaderAt, plan []models.ChunkPlan, done map[int]models.ChunkMetadata, onChunk func(models.ChunkMetadata, int, int)) ([]models.ChunkMetadata, error) {
+	if len(sources) != len(plan) {
+		return nil, fmt.Errorf("mismatch: %d chunk sources but %d planned chunks", len(sources), len(plan))
+	}
+
+	uploadCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		mu       sync.Mutex
+		firstErr error
+		failed   []int
+		finished int
+		results  = make([]models.ChunkMetadata, len(plan))
+		pending  []int
+	)
+	partial, _ := ctx.Value(partialKey{}).(bool)
+	for _, i := range interleaveByAccount(plan) {
+		if meta, ok := done[plan[i].ChunkID]; ok {
+			results[i] = meta
+			finished++
+			continue
+		}
+		pending = append(pending, i)
+	}
 
-	uploadReq, err := http.NewRequest("PUT", uploadURL, file)
-	if err != nil {
-		return "", err
+	if len(pending) == 0 {
+		return results, nil
+	}
+	// A nil channel never fires when no pause was set up
+	pause, _ := ctx.Value(pauseKey{}).(<-chan struct{})
+	select {
+	case <-pause:
+		return nil, ErrUploadPaused
+	default:
 	}
-	uploadReq.Header.Set("Content-Length", fmt.Sprintf("%d", fileSize))
-	uploadReq.ContentLength = fileSize
 
-	uploadResp, err := client.Do(uploadReq)
+	reservations, err := reserveChunks(uploadCtx, plan, pending)
 	if err != nil {
-		return "", err
+		return nil, err
+	}
+	defer func() { releaseReservations(ctx, reservations) }()
+
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < min(parallelUploads(ctx), len(pending)); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				mu.Lock()
+				reservation := reservations[i]
+				mu.Unlock()
+				metadata, err := uploadChunkWithRetry(uploadCtx, plan[i], sources[i], reservation)
+
+				mu.Lock()
+				if err != nil {
+					if firstErr == nil {
+						firstErr = err
+					}
+					failed = append(failed, plan[i].ChunkID)
+					// In partial mode only a cancelled upload stops the others
+					if !partial || uploadCtx.Err() != nil {
+						cancel()
+					}
+				} else {
+					delete(reservations, i)
+					results[i] = metadata
+					finished++
+					if onChunk != nil {
+						onChunk(metadata, finished, len(plan))
+					}
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+
+	// Interleave accounts so concurrent workers hit different drives
+	paused := false
+feed:
+	for _, i := range pending {
+		select {
+		case <-pause:
+			paused = true
+			break feed
+		default:
+		}
+		select {
+		case jobs <- i:
+		case <-uploadCtx.Done():
+			break feed
+		case <-pause:
+			paused = true
+			break feed
+		}
 	}
-	defer uploadResp.Body.Close()
+	close(jobs)
+	wg.Wait()
 
-	if uploadResp.StatusCode != http.StatusOK && uploadResp.StatusCode != http.StatusCreated {
-		respBody, _ := io.ReadAll(uploadResp.Body)
-		return "", fmt.Errorf("upload failed: status %d: %s", uploadResp.StatusCode, string(respBody))
+	if firstErr == nil && ctx.Err() != nil {
+		firstErr = ctx.Err()
 	}
-
-	var fileResp driveFileResponse
-	if err := json.NewDecoder(uploadResp.Body).Decode(&fileResp); err != nil {
-		return "", err
+	if firstErr == nil && paused {
+		firstErr = ErrUploadPaused
+	}
+	if firstErr != nil && partial && !paused && ctx.Err() == nil {
+		sort.Ints(failed)
+		return nil, &PartialUploadError{FailedChunks: failed, Err: firstErr}
+	}
+	if firstErr != nil {
+		return nil, firstErr
 	}
 
-	return fileResp.ID, nil
+	return results, nil
 }
 
-// UploadChunksToDrivers uploads all chunks to their respective drives
-func UploadChunksToDrivers(ctx context.Context, chunkPaths []string, plan []models.ChunkPlan, progressCallback func(int, int)) ([]models.ChunkMetadata, error) {
-	if len(chunkPaths) != len(plan) {
-		return nil, fmt.Errorf("mismatch: %d chunk files but %d planned chunks", len(chunkPaths), len(plan))
+// uploadChunkWithRetry makes up to chunkUploadAttempts attempts at uploading a chunk, backing
+// off in between. Only the first attempt uses the reservation.
+func uploadChunkWithRetry(ctx context.Context, chunk models.ChunkPlan, src io.ReaderAt, reservation *chunkReservation) (models.ChunkMetadata, error) {
+	for attempt := 0; ; attempt++ {
+		metadata, err := uploadChunk(ctx, chunk, src, reservation)
+		if err == nil || errors.Is(err, ErrInsufficientDriveSpace) || attempt+1 >= chunkUploadAttempts || ctx.Err() != nil {
+			return metadata, err
+		}
+		log.Printf("Chunk %d failed (attempt %d/%d), retrying: %v", chunk.ChunkID, attempt+1, chunkUploadAttempts, err)
+		if reservation != nil {
+			cancelResumableUpload(context.WithoutCancel(ctx), reservation.client, reservation.accountID, reservation.uploadURL)
+			reservation = nil
+		}
+		if err := waitRetry(ctx, retryDelay(attempt, "")); err != nil {
+			return models.ChunkMetadata{}, err
+		}
 	}
+}
 
-	chunkMetadata := make([]models.ChunkMetadata, 0, len(plan))
-
-	for i, chunkPath := range chunkPaths {
-		if progressCallback != nil {
-			progressCallback(i+1, len(chunkPaths))
+// DeleteChunks removes uploaded chunks from their drives, best effort
+func DeleteChunks(ctx context.Context, chunks []models.ChunkMetadata) {
+	for _, chunk := range chunks {
+		accountID, err := primitive.ObjectIDFromHex(chunk.DriveAccountID)
+		if err != nil {
+			continue
+		}
+		if err := DeleteDriveFile(ctx, accountID, chunk.DriveFileID); err != nil {
+			log.Printf("Failed to delete chunk %d (%s): %v", chunk.ChunkID, chunk.DriveFileID, err)
 		}
+	}
+}
 
-		chunk := plan[i]
-		filename := fmt.Sprintf("chunk_%03d.2xpfm", chunk.ChunkID)
+// uploadChunk uploads a single planned chunk through its reservation and returns its key file metadata
+func uploadChunk(ctx context.Context, chunk models.ChunkPlan, src io.ReaderAt, reservation *chunkReservation) (models.ChunkMetadata, error) {
+	filename := chunkFilename(chunk.ChunkID)
 
-		// Upload to drive
-		driveFileID, err := UploadChunkToDrive(ctx, chunk.DriveAccountID, chunkPath, filename)
-		if err != nil {
-			// Cleanup on error: delete already uploaded chunks
-			for j := 0; j < i; j++ {
-				// Best effort cleanup
-				DeleteDriveFile(ctx, plan[j].DriveAccountID, chunkMetadata[j].DriveFileID)
-			}
-			return nil, fmt.Errorf("failed to upload chunk %d: %w", chunk.ChunkID, err)
-		}
+	// With headers on, the drive file is the header followed by the chunk's data
+	header := chunkHeader(ctx, chunk.ChunkID, chunk.Size)
+	stored, storedSize := src, chunk.Size
+	if header != nil {
+		stored, storedSize = &headedReaderAt{header: header, data: src, size: chunk.Size}, int64(len(header))+chunk.Size
+	}
 
-		// Calculate checksum
-		checksum, err := calculateFileChecksum(chunkPath)
-		if err != nil {
-			return nil, fmt.Errorf("failed to calculate checksum for chunk %d: %w", chunk.ChunkID, err)
-		}
+	// Upload to drive; start over if the reserved session expired
+	file, err := sendReserved(ctx, reservation, stored, storedSize)
+	if reservation == nil || errors.Is(err, errUploadSessionGone) {
+		file.ID, file.MD5Checksum, err = UploadChunkToDrive(ctx, chunk.DriveAccountID, stored, storedSize, filename)
+	}
+	if err != nil {
+		return models.ChunkMetadata{}, fmt.Errorf("failed to upload chunk %d: %w", chunk.ChunkID, err)
+	}
+	driveFileID := file.ID
 
-		metadata := models.ChunkMetadata{
-			ChunkID:        chunk.ChunkID,
-			DriveAccountID: chunk.DriveAccountID.Hex(),
-			DriveFileID:    driveFileID,
-			Filename:       filename,
-			StartOffset:    chunk.StartOffset,
-			EndOffset:      chunk.EndOffset,
-			Size:           chunk.Size,
-			Checksum:       checksum,
-		}
+	// Calculate checksums: SHA-256 of the data for the key file, MD5 to compare with what Drive stored
+	checksum, md5sum, err := calculateChecksums(header, io.NewSectionReader(src, 0, chunk.Size))
+	if err != nil {
+		// Not recorded anywhere yet, so remove it here
+		DeleteDriveFile(context.WithoutCancel(ctx), chunk.DriveAccountID, driveFileID)
+		return models.ChunkMetadata{}, fmt.Errorf("failed to calculate checksum for chunk %d: %w", chunk.ChunkID, err)
+	}
+	// A chunk corrupted on the way is only counted as uploaded once sent again intact
+	if file.MD5Checksum != "" && file.MD5Checksum != md5sum {
+		checksumMismatches.Inc(chunk.DriveAccountID.Hex())
+		DeleteDriveFile(context.WithoutCancel(ctx), chunk.DriveAccountID, driveFileID)
+		return models.ChunkMetadata{}, fmt.Errorf("chunk %d: %w: drive has md5 %s, sent %s", chunk.ChunkID, ErrChecksumMismatch, file.MD5Checksum, md5sum)
+	}
+
+	metadata := models.ChunkMetadata{
+		ChunkID:        chunk.ChunkID,
+		DriveAccountID: chunk.DriveAccountID.Hex(),
+		DriveFileID:    driveFileID,
+		Filename:       filename,
+		StartOffset:    chunk.StartOffset,
+		EndOffset:      chunk.EndOffset,
+		Size:           chunk.Size,
+		Checksum:       checksum,
+		ShardIndex:     chunk.ShardIndex,
+		Parity:         chunk.Parity,
+	}
+	if header != nil {
+		metadata.HeaderVersion = ChunkHeaderVersion
+	}
+	return metadata, nil
+}
+
+// sendReserved sends a chunk through its reserved upload session, bounded by the transfer timeout
+func sendReserved(ctx context.Context, reservation *chunkReservation, src io.ReaderAt, size int64) (driveFileResponse, error) {
+	if reservation == nil {
+		return driveFileResponse{}, nil
+	}
+	callCtx, cancel := context.WithTimeout(ctx, driveTransferTimeout)
+	defer cancel()
+	file, err := sendResumableUpload(callCtx, reservation.client, reservation.accountID, reservation.uploadURL, src, size)
+	if err != nil {
+		return driveFileResponse{}, fmt.Errorf("failed to upload to drive: %w", err)
+	}
+	return file, nil
+}
 
-		chunkMetadata = append(chunkMetadata, metadata)
+// interleaveByAccount orders plan indexes round-robin across drive accounts
+func interleaveByAccount(plan []models.ChunkPlan) []int {
+	var accounts []primitive.ObjectID
+	byAccount := make(map[primitive.ObjectID][]int)
+	for i, chunk := range plan {
+		if _, ok := byAccount[chunk.DriveAccountID]; !ok {
+			accounts = append(accounts, chunk.DriveAccountID)
+		}
+		byAccount[chunk.DriveAccountID] = append(byAccount[chunk.DriveAccountID], i)
 	}
 
-	return chunkMetadata, nil
+	order := make([]int, 0, len(plan))
+	for len(order) < len(plan) {
+		for _, id := range accounts {
+			if queue := byAccount[id]; len(queue) > 0 {
+				order = append(order, queue[0])
+				byAccount[id] = queue[1:]
+			}
+		}
+	}
+	return order
 }
 
-// DeleteDriveFile deletes a file from Google Drive
+// DeleteDriveFile deletes a file from Google Drive, or moves it to the Drive trash
+// when DRIVE_DELETE_MODE=trash
 func DeleteDriveFile(ctx context.Context, accountID primitive.ObjectID, fileID string) error {
-	// Get drive account
-	account, err := store.GetDriveAccountByID(ctx, accountID)
+	if deleteToTrash {
+		return setDriveFileTrashed(ctx, accountID, fileID, true)
+	}
+	return PurgeDriveFile(ctx, accountID, fileID)
+}
+
+// PurgeDriveFile deletes a file from Google Drive for good, also when it is in the trash.
+// Fails with an error IsNotFound recognizes if there is no such file.
+func PurgeDriveFile(ctx context.Context, accountID primitive.ObjectID, fileID string) error {
+	client, err := newAccountClient(ctx, accountID)
 	if err != nil {
 		return err
 	}
 
-	// Decrypt OAuth token
-	tokenData, err := oauth.Decrypt(account.EncryptedToken)
+	// Delete file
+	deleteURL := fmt.Sprintf("https://www.googleapis.com/drive/v3/files/%s?supportsAllDrives=true", fileID)
+	resp, err := doWithRetry(ctx, client, accountID, opDelete, driveCallTimeout, func(ctx context.Context) (*http.Request, error) {
+		return http.NewRequestWithContext(ctx, "DELETE", deleteURL, nil)
+	})
 	if err != nil {
 		return err
 	}
+	defer resp.Body.Close()
 
-	var token oauth2.Token
-	if err := json.Unmarshal(tokenData, &token); err != nil {
-		return err
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK {
+		return newDriveStatusError(resp)
 	}
 
-	// Create HTTP client with auto-refresh
-	client := oauth.NewClient(ctx, &token)
+	return nil
+}
 
-	// Delete file
-	deleteURL := fmt.Sprintf("https://www.googleapis.com/drive/v3/files/%s", fileID)
-	req, err := http.NewRequest("DELETE", deleteURL, nil)
+// UndeleteDriveFile restores a file from the Drive trash
+func UndeleteDriveFile(ctx context.Context, accountID primitive.ObjectID, fileID string) error {
+	return setDriveFileTrashed(ctx, accountID, fileID, false)
+}
+
+// RestoreTrashedChunks untrashes every chunk of a key file, returning the chunk IDs that could not be restored
+func RestoreTrashedChunks(ctx context.Context, chunks []models.ChunkMetadata) map[int]string {
+	failed := make(map[int]string)
+	for _, chunk := range chunks {
+		accountID, err := primitive.ObjectIDFromHex(chunk.DriveAccountID)
+		if err != nil {
+			failed[chunk.ChunkID] = "invalid drive account id"
+			continue
+		}
+		if err := UndeleteDriveFile(ctx, accountID, chunk.DriveFileID); err != nil {
+			failed[chunk.ChunkID] = err.Error()
+		}
+	}
+	return failed
+}
+
+func setDriveFileTrashed(ctx context.Context, accountID primitive.ObjectID, fileID string, trashed bool) error {
+	client, err := newAccountClient(ctx, accountID)
 	if err != nil {
 		return err
 	}
 
-	resp, err := client.Do(req)
+	body, _ := json.Marshal(map[string]bool{"trashed": trashed})
+	updateURL := fmt.Sprintf("https://www.googleapis.com/drive/v3/files/%s?supportsAllDrives=true", fileID)
+	resp, err := doWithRetry(ctx, client, accountID, opUpdate, driveCallTimeout, func(ctx context.Context) (*http.Request, error) {
+		req, err := http.NewRequestWithContext(ctx, "PATCH", updateURL, bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", "application/json; charset=UTF-8")
+		return req, nil
+	})
 	if err != nil {
 		return err
 	}
 	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("failed to delete file, status: %d", resp.StatusCode)
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to update trashed state, status: %d", resp.StatusCode)
 	}
 
 	return nil
 }
 
-func calculateFileChecksum(filePath string) (string, error) {
-	file, err := os.Open(filePath)
-	if err != nil {
-		return "", err
+// calculateChecksums returns the hex SHA-256 of r and the hex MD5 of header followed by r, in one pass
+func calculateChecksums(header []byte, r io.Reader) (string, string, error) {
+	sha := sha256.New()
+	md := md5.New()
+	md.Write(header)
+	if _, err := io.Copy(io.MultiWriter(sha, md), r); err != nil {
+		return "", "", err
 	}
-	defer file.Close()
 
-	hash := sha256.New()
-	if _, err := io.Copy(hash, file); err != nil {
+	return fmt.Sprintf("%x", sha.Sum(nil)), fmt.Sprintf("%x", md.Sum(nil)), nil
+}
+
+// contentMD5 is the base64 MD5 of r, as the Content-MD5 header carries it
+func contentMD5(r io.Reader) (string, error) {
+	md := md5.New()
+	if _, err := io.Copy(md, r); err != nil {
 		return "", err
 	}
-
-	return fmt.Sprintf("%x", hash.Sum(nil)), nil
+	return base64.StdEncoding.EncodeToString(md.Sum(nil)), nil
 }
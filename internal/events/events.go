@@ -0,0 +1,94 @@
+// Package events is a small in-process pub/sub used to push upload and download progress to
+// streaming clients.
+package events
+
+import (
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// subscriberBuffer is how many undelivered events a slow subscriber may have queued.
+// Beyond that the oldest is dropped; progress events supersede each other.
+const subscriberBuffer = 16
+
+// Download restore stages
+const (
+	StageFetching       = "fetching"
+	StageWaiting        = "waiting" // some chunks are held back by Drive's download quota
+	StageReconstructing = "reconstructing"
+	StageReady          = "ready"
+	StageFailed         = "failed"
+	StageCancelled      = "cancelled" // stopped with POST /api/files/download/cancel/:session_id
+)
+
+// DownloadProgress describes a stored file being restored from Drive
+type DownloadProgress struct {
+	FileID        string     `json:"file_id"`
+	SessionID     string     `json:"session_id,omitempty"` // the download it is about, to cancel it by
+	Stage         string     `json:"stage"`
+	ChunksDone    int        `json:"chunks_done"`
+	ChunksTotal   int        `json:"chunks_total"`
+	ChunksWaiting int        `json:"chunks_waiting,omitempty"`
+	RetryAt       *time.Time `json:"retry_at,omitempty"` // when the next held-back chunk is retried
+	Error         string     `json:"error,omitempty"`
+}
+
+var (
+	mu   sync.Mutex
+	subs = make(map[string]map[chan any]struct{})
+)
+
+// UploadTopic is the topic changes to an upload session are published on. Upload events
+// carry no payload; subscribers re-read the session from the store.
+func UploadTopic(sessionID primitive.ObjectID) string {
+	return "upload:" + sessionID.Hex()
+}
+
+// DownloadTopic is the topic restore progress of a stored file is published on
+func DownloadTopic(fileID primitive.ObjectID) string {
+	return "download:" + fileID.Hex()
+}
+
+// Subscribe returns a channel receiving events published on topic, and a function to unsubscribe
+func Subscribe(topic string) (<-chan any, func()) {
+	ch := make(chan any, subscriberBuffer)
+	mu.Lock()
+	if subs[topic] == nil {
+		subs[topic] = make(map[chan any]struct{})
+	}
+	subs[topic][ch] = struct{}{}
+	mu.Unlock()
+
+	return ch, func() {
+		mu.Lock()
+		defer mu.Unlock()
+		delete(subs[topic], ch)
+		if len(subs[topic]) == 0 {
+			delete(subs, topic)
+		}
+	}
+}
+
+// Publish delivers v to every subscriber of topic without blocking
+func Publish(topic string, v any) {
+	mu.Lock()
+	defer mu.Unlock()
+	for ch := range subs[topic] {
+		select {
+		case ch <- v:
+			continue
+		default:
+		}
+		// Full: drop the oldest so the latest state always gets through
+		select {
+		case <-ch:
+		default:
+		}
+		select {
+		case ch <- v:
+		default:
+		}
+	}
+}
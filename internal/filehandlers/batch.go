@@ -0,0 +1,335 @@
+package filehandlers
+
+import (
+	"SE/internal/drivemanager"
+	"SE/internal/fileprocessor"
+	"SE/internal/jobs"
+	"SE/internal/middleware"
+	"SE/internal/models"
+	"SE/internal/store"
+	"archive/zip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// batchFileRequest is one file in a batch initiate request
+type batchFileRequest struct {
+	Filename string `json:"filename"`
+	FileSize int64  `json:"file_size"`
+	Folder   string `json:"folder,omitempty"` // relative to the batch folder
+	Path     string `json:"path,omitempty"`   // relative path instead of folder and filename, e.g. for folder uploads
+}
+
+// splitRelativePath splits a client-relative path like "2024/summer/a.jpg" into its folder and filename
+func splitRelativePath(p string) (string, string, error) {
+	if strings.ContainsRune(p, '\\') {
+		return "", "", errors.New("path must use / as separator")
+	}
+	dir, name := path.Split(strings.Trim(p, "/"))
+	if name == "" || name == "." || name == ".." {
+		return "", "", errors.New("path must end in a filename")
+	}
+	return dir, name, nil
+}
+
+// initiateBatch creates a batch of upload sessions, one per file, all under folder
+func initiateBatch(w http.ResponseWriter, r *http.Request, userID primitive.ObjectID, files []batchFileRequest, folder string) {
+	batch := make([]fileprocessor.BatchFile, len(files))
+	for i, f := range files {
+		if f.Path != "" {
+			dir, name, err := splitRelativePath(f.Path)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("file %d: %v", i, err), http.StatusBadRequest)
+				return
+			}
+			f.Folder, f.Filename = path.Join(f.Folder, dir), name
+		}
+		if f.Filename == "" || f.FileSize <= 0 {
+			http.Error(w, fmt.Sprintf("file %d: filename and file_size are required", i), http.StatusBadRequest)
+			return
+		}
+		if strings.ContainsAny(f.Filename, `/\`) {
+			http.Error(w, fmt.Sprintf("file %d: filename must not contain a path, use folder", i), http.StatusBadRequest)
+			return
+		}
+		fileFolder, err := fileprocessor.NormalizeFolder(folder + "/" + f.Folder)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("file %d: %v", i, err), http.StatusBadRequest)
+			return
+		}
+		batch[i] = fileprocessor.BatchFile{Filename: f.Filename, Folder: fileFolder, Size: f.FileSize}
+	}
+
+	client := middleware.ClientInfo(r)
+	sessions, err := fileprocessor.CreateUploadBatch(r.Context(), userID, batch, &client)
+	if err != nil {
+		if errors.Is(err, fileprocessor.ErrQuotaExceeded) {
+			http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+			return
+		}
+		log.Printf("Failed to create upload batch: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	driveSpaces, err := drivemanager.GetUserDriveSpaces(r.Context(), userID)
+	if err != nil {
+		log.Printf("Failed to get drive spaces: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	entries := make([]map[string]interface{}, len(sessions))
+	for i, s := range sessions {
+		entries[i] = map[string]interface{}{
+			"session_id": s.ID.Hex(),
+			"filename":   s.OriginalFilename,
+			"folder":     s.Folder,
+			"path":       models.FilePath(s.Folder, s.OriginalFilename),
+			"upload_url": fmt.Sprintf("/api/files/upload/chunk?session_id=%s", s.ID.Hex()),
+		}
+	}
+
+	batchID := sessions[0].BatchID.Hex()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"batch_id":      batchID,
+		"sessions":      entries,
+		"status_url":    fmt.Sprintf("/api/files/upload/batch/%s", batchID),
+		"drive_spaces":  driveSpaces,
+		"max_file_size": fileprocessor.GetMaxFileSize(),
+	})
+}
+
+// finalizeBatch queues processing of every file in a batch with the same settings. All files
+// must be fully uploaded first.
+func finalizeBatch(w http.ResponseWriter, r *http.Request, userID primitive.ObjectID, req models.ProcessRequest) {
+	batchID, err := primitive.ObjectIDFromHex(req.BatchID)
+	if err != nil {
+		http.Error(w, "invalid batch_id", http.StatusBadRequest)
+		return
+	}
+	if req.Strategy == models.StrategyManual {
+		http.Error(w, "manual strategy is not supported for batches", http.StatusBadRequest)
+		return
+	}
+
+	sessions, err := store.GetBatchSessions(r.Context(), batchID)
+	if err != nil {
+		http.Error(w, "failed to get batch", http.StatusInternalServerError)
+		return
+	}
+	if len(sessions) == 0 || sessions[0].UserID != userID {
+		http.Error(w, "batch not found", http.StatusNotFound)
+		return
+	}
+
+	incomplete := 0
+	for _, s := range sessions {
+		if s.Status != "uploading" {
+			http.Error(w, fmt.Sprintf("%s is already %s", s.OriginalFilename, s.Status), http.StatusConflict)
+			return
+		}
+		if len(fileprocessor.MissingRanges(s.ReceivedRanges, s.TotalSize)) > 0 {
+			incomplete++
+		}
+	}
+	if incomplete > 0 {
+		http.Error(w, fmt.Sprintf("upload incomplete: %d of %d files still missing bytes", incomplete, len(sessions)), http.StatusBadRequest)
+		return
+	}
+
+	if err := applyPreferences(r.Context(), userID, &req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := fileprocessor.CheckQuota(r.Context(), userID, 0); err != nil {
+		if errors.Is(err, fileprocessor.ErrQuotaExceeded) {
+			http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+			return
+		}
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("Finalizing batch %s (%d files), strategy: %s", batchID.Hex(), len(sessions), req.Strategy)
+
+	// Each file is processed as its own job; one failing to queue doesn't hold back the rest
+	queued, failed := 0, 0
+	for _, s := range sessions {
+		fileReq := req
+		fileReq.SessionID = s.ID.Hex()
+		fileReq.BatchID = ""
+		if err := fileprocessor.UpdateSessionStatus(r.Context(), s.ID, "processing", 0, "Starting..."); err != nil {
+			log.Printf("Failed to update status of session %s: %v", s.ID.Hex(), err)
+			failed++
+			continue
+		}
+		if err := jobs.Enqueue(r.Context(), s.ID, userID, s.TotalSize, fileReq); err != nil {
+			log.Printf("Failed to enqueue processing job for session %s: %v", s.ID.Hex(), err)
+			fileprocessor.UpdateSessionStatus(r.Context(), s.ID, "failed", 0, "Failed to queue processing")
+			failed++
+			continue
+		}
+		queued++
+	}
+	if queued == 0 {
+		http.Error(w, "failed to queue processing", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"message":    "processing started",
+		"batch_id":   batchID.Hex(),
+		"queued":     queued,
+		"failed":     failed,
+		"status_url": fmt.Sprintf("/api/files/upload/batch/%s", batchID.Hex()),
+	})
+}
+
+// BatchHandler - GET /api/files/upload/batch/:batch_id and /api/files/upload/batch/:batch_id/keys
+func BatchHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("userID").(primitive.ObjectID)
+
+	idStr, action, _ := strings.Cut(r.URL.Path[len("/api/files/upload/batch/"):], "/")
+	batchID, err := primitive.ObjectIDFromHex(idStr)
+	if err != nil {
+		http.Error(w, "invalid batch_id", http.StatusBadRequest)
+		return
+	}
+
+	sessions, err := store.GetBatchSessions(r.Context(), batchID)
+	if err != nil {
+		http.Error(w, "failed to get batch", http.StatusInternalServerError)
+		return
+	}
+	if len(sessions) == 0 || sessions[0].UserID != userID {
+		http.Error(w, "batch not found", http.StatusNotFound)
+		return
+	}
+
+	switch action {
+	case "":
+		batchStatus(w, batchID, sessions)
+	case "keys":
+		batchKeys(w, batchID, sessions)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// batchStatus reports aggregated progress of a batch and the state of each file
+func batchStatus(w http.ResponseWriter, batchID primitive.ObjectID, sessions []*models.UploadSession) {
+	var uploaded, total int64
+	var weighted float64
+	counts := make(map[string]int)
+	files := make([]map[string]interface{}, len(sessions))
+	for i, s := range sessions {
+		uploaded += s.UploadedSize
+		total += s.TotalSize
+		weighted += s.ProcessingProgress * float64(s.TotalSize)
+		counts[s.Status]++
+		files[i] = map[string]interface{}{
+			"session_id":          s.ID.Hex(),
+			"filename":            s.OriginalFilename,
+			"folder":              s.Folder,
+			"status":              s.Status,
+			"uploaded_size":       s.UploadedSize,
+			"total_size":          s.TotalSize,
+			"processing_progress": s.ProcessingProgress,
+			"error_message":       s.ErrorMessage,
+		}
+	}
+
+	// The batch is as far along as its least advanced file
+	status := "complete"
+	switch {
+	case counts["uploading"] > 0:
+		status = "uploading"
+	case counts["processing"] > 0 || counts["paused"] > 0:
+		status = "processing"
+	case counts["failed"]+counts["infected"] == len(sessions):
+		status = "failed"
+	case counts["failed"]+counts["infected"] > 0:
+		status = "partially_failed"
+	}
+
+	var progress float64
+	if total > 0 {
+		progress = weighted / float64(total)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"batch_id":            batchID.Hex(),
+		"status":              status,
+		"files_total":         len(sessions),
+		"files_complete":      counts["complete"],
+		"files_failed":        counts["failed"] + counts["infected"],
+		"uploaded_size":       uploaded,
+		"total_size":          total,
+		"processing_progress": progress,
+		"files":               files,
+	})
+}
+
+// batchKeys sends the key files of every completed file in a batch as one zip, laid out by folder
+func batchKeys(w http.ResponseWriter, batchID primitive.ObjectID, sessions []*models.UploadSession) {
+	var complete []*models.UploadSession
+	for _, s := range sessions {
+		if s.Status == "complete" {
+			complete = append(complete, s)
+		}
+	}
+	if len(complete) == 0 {
+		http.Error(w, "no files in the batch have completed", http.StatusConflict)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", contentDisposition("batch_"+batchID.Hex()+"_keys.zip"))
+
+	zw := zip.NewWriter(w)
+	used := make(map[string]bool)
+	for _, s := range complete {
+		name := strings.TrimPrefix(path.Join(s.Folder, fileprocessor.KeyFileName(s.OriginalFilename)), "/")
+		for n := 2; used[name]; n++ {
+			name = strings.TrimPrefix(path.Join(s.Folder, fileprocessor.KeyFileName(fmt.Sprintf("%s (%d)", s.OriginalFilename, n))), "/")
+		}
+		used[name] = true
+
+		if err := addKeyFile(zw, name, keyFilePath(s)); err != nil {
+			// Headers are out already; a truncated zip is the best signal left
+			log.Printf("Failed to add key file of session %s to batch %s bundle: %v", s.ID.Hex(), batchID.Hex(), err)
+			return
+		}
+	}
+	if err := zw.Close(); err != nil {
+		log.Printf("Failed to finish batch %s key bundle: %v", batchID.Hex(), err)
+	}
+}
+
+func addKeyFile(zw *zip.Writer, name, keyPath string) error {
+	f, err := os.Open(keyPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	entry, err := zw.Create(name)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(entry, f)
+	return err
+}
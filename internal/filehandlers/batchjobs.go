@@ -0,0 +1,159 @@
+package filehandlers
+
+import (
+	"SE/internal/fileprocessor"
+	"SE/internal/store"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// maxBatchJobFiles is how many files one batch job can take
+const maxBatchJobFiles = 1000
+
+// BatchJobHandler - POST /api/files/batch
+// Starts applying one action to up to maxBatchJobFiles of the caller's files in the background:
+// delete, restore, tag, move or verify. Each file goes as it would through its own endpoint.
+func BatchJobHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("userID").(primitive.ObjectID)
+
+	var req struct {
+		Action  string   `json:"action"`
+		FileIDs []string `json:"file_ids"`
+		Tags    []string `json:"tags"`   // for tag
+		Folder  *string  `json:"folder"` // for move, "" or "/" for the root
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid request", http.StatusBadRequest)
+		return
+	}
+	if len(req.FileIDs) == 0 {
+		http.Error(w, "file_ids required", http.StatusBadRequest)
+		return
+	}
+	if len(req.FileIDs) > maxBatchJobFiles {
+		http.Error(w, fmt.Sprintf("at most %d files per batch job", maxBatchJobFiles), http.StatusBadRequest)
+		return
+	}
+	seen := make(map[primitive.ObjectID]bool, len(req.FileIDs))
+	fileIDs := make([]primitive.ObjectID, 0, len(req.FileIDs))
+	for _, v := range req.FileIDs {
+		id, err := primitive.ObjectIDFromHex(v)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid file id %q", v), http.StatusBadRequest)
+			return
+		}
+		if !seen[id] {
+			seen[id] = true
+			fileIDs = append(fileIDs, id)
+		}
+	}
+
+	var apply func(ctx context.Context, fileID primitive.ObjectID) error
+	switch req.Action {
+	case "delete":
+		apply = func(ctx context.Context, fileID primitive.ObjectID) error {
+			return trashFile(r.WithContext(ctx), userID, fileID)
+		}
+	case "restore":
+		apply = func(ctx context.Context, fileID primitive.ObjectID) error {
+			_, err := restoreTrashedFile(r.WithContext(ctx), userID, fileID)
+			return err
+		}
+	case "tag":
+		if len(req.Tags) == 0 {
+			http.Error(w, "tags required", http.StatusBadRequest)
+			return
+		}
+		tags, err := cleanTags(req.Tags)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		apply = func(ctx context.Context, fileID primitive.ObjectID) error {
+			_, err := updateFileTags(ctx, userID, fileID, tags, true)
+			return err
+		}
+	case "move":
+		if req.Folder == nil {
+			http.Error(w, "folder required", http.StatusBadRequest)
+			return
+		}
+		folder, err := fileprocessor.NormalizeFolder(*req.Folder)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		apply = func(ctx context.Context, fileID primitive.ObjectID) error {
+			found, err := store.MoveStoredFile(ctx, userID, fileID, folder)
+			if err != nil {
+				log.Printf("Failed to move file %s: %v", fileID.Hex(), err)
+				return errServer
+			}
+			if !found {
+				return errFileNotFound
+			}
+			return nil
+		}
+	case "verify":
+		apply = func(ctx context.Context, fileID primitive.ObjectID) error {
+			return batchVerify(ctx, userID, fileID)
+		}
+	default:
+		http.Error(w, "action must be delete, restore, tag, move or verify", http.StatusBadRequest)
+		return
+	}
+
+	job := fileprocessor.StartBatchJob(userID, req.Action, fileIDs, apply)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"job_id":      job.ID,
+		"action":      job.Action,
+		"status":      job.Status,
+		"files_total": job.FilesTotal,
+		"status_url":  "/api/files/batch/" + job.ID,
+	})
+}
+
+// BatchJobStatusHandler - GET /api/files/batch/:id
+// Reports a batch job's progress and the outcome for each of its files
+func BatchJobStatusHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("userID").(primitive.ObjectID)
+
+	job, ok := fileprocessor.GetBatchJob(userID, strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/files/batch/"), "/"))
+	if !ok {
+		http.Error(w, "batch job not found", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(job)
+}
+
+// batchVerify deep checks a file like POST /api/files/:id/verify?deep=true, and fails it
+// unless every chunk is ok
+func batchVerify(ctx context.Context, userID, fileID primitive.ObjectID) error {
+	file, err := store.GetStoredFile(ctx, fileID)
+	if err != nil {
+		return errServer
+	}
+	if file == nil || file.UserID != userID || (file.Status != "active" && file.Status != "incomplete") {
+		return errFileNotFound
+	}
+	v := fileprocessor.CheckFile(ctx, file)
+	bad := 0
+	for _, c := range v.Chunks {
+		if c.Result != "ok" {
+			bad++
+		}
+	}
+	if bad > 0 {
+		return fmt.Errorf("%d of %d chunks failed verification", bad, v.ChunksTotal)
+	}
+	return nil
+}
@@ -0,0 +1,82 @@
+package filehandlers
+
+import (
+	"SE/internal/fileprocessor"
+	"SE/internal/store"
+	"SE/internal/store/storetest"
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// runBatchJob starts a batch job as the user and waits for it to finish
+func runBatchJob(t *testing.T, userID primitive.ObjectID, req map[string]any) fileprocessor.BatchJob {
+	t.Helper()
+	w := serve(t, BatchJobHandler, storetest.Request("POST", "/api/files/batch", jsonBody(t, req), userID), http.StatusAccepted)
+	var started struct {
+		StatusURL string `json:"status_url"`
+	}
+	json.NewDecoder(w.Body).Decode(&started)
+	for deadline := time.Now().Add(10 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		w := serve(t, BatchJobStatusHandler, storetest.Request("GET", started.StatusURL, nil, userID), http.StatusOK)
+		var job fileprocessor.BatchJob
+		json.NewDecoder(w.Body).Decode(&job)
+		if job.Status == "done" {
+			return job
+		}
+	}
+	t.Fatalf("batch job %s didn't finish", started.StatusURL)
+	return fileprocessor.BatchJob{}
+}
+
+func TestBatchJobs(t *testing.T) {
+	user := setup(t)
+	a := uploadFile(t, user.ID, "a.bin", randomData(100000))
+	b := uploadFile(t, user.ID, "b.bin", randomData(100000))
+	stranger := storetest.User(t)
+	storetest.LocalDrives(t, stranger.ID, 1)
+	other := uploadFile(t, stranger.ID, "other.bin", randomData(1000))
+	ids := []string{a.ID.Hex(), b.ID.Hex(), other.ID.Hex()}
+
+	serve(t, BatchJobHandler, storetest.Request("POST", "/api/files/batch", jsonBody(t, map[string]any{"action": "copy", "file_ids": ids}), user.ID), http.StatusBadRequest)
+	serve(t, BatchJobHandler, storetest.Request("POST", "/api/files/batch", jsonBody(t, map[string]any{"action": "tag", "file_ids": ids}), user.ID), http.StatusBadRequest)
+	serve(t, BatchJobHandler, storetest.Request("POST", "/api/files/batch", jsonBody(t, map[string]any{"action": "move", "file_ids": []string{"nope"}, "folder": "/x"}), user.ID), http.StatusBadRequest)
+
+	// Another user's file fails without stopping the rest
+	job := runBatchJob(t, user.ID, map[string]any{"action": "tag", "file_ids": ids, "tags": []string{"Backup"}})
+	if job.FilesTotal != 3 || job.FilesDone != 2 || job.FilesFailed != 1 || job.Files[2].Status != "failed" || job.Files[2].Error != "file not found" {
+		t.Fatalf("tag job = %+v, want the caller's two files done", job)
+	}
+	job = runBatchJob(t, user.ID, map[string]any{"action": "move", "file_ids": ids[:2], "folder": "archive/2024"})
+	if job.FilesDone != 2 {
+		t.Fatalf("move job = %+v, want both files moved", job)
+	}
+	for _, id := range []primitive.ObjectID{a.ID, b.ID} {
+		f, _ := store.GetStoredFile(context.Background(), id)
+		if f.Folder != "/archive/2024" || len(f.Tags) != 1 || f.Tags[0] != "backup" {
+			t.Errorf("file %s in %q tagged %v, want /archive/2024 and backup", f.OriginalFilename, f.Folder, f.Tags)
+		}
+	}
+
+	if job = runBatchJob(t, user.ID, map[string]any{"action": "verify", "file_ids": ids[:2]}); job.FilesDone != 2 {
+		t.Errorf("verify job = %+v, want both files ok", job)
+	}
+
+	job = runBatchJob(t, user.ID, map[string]any{"action": "delete", "file_ids": []string{a.ID.Hex(), a.ID.Hex(), b.ID.Hex()}})
+	if job.FilesTotal != 2 || job.FilesDone != 2 {
+		t.Fatalf("delete job = %+v, want both files trashed once", job)
+	}
+	job = runBatchJob(t, user.ID, map[string]any{"action": "restore", "file_ids": ids})
+	if job.FilesDone != 2 || job.Files[2].Error != "file not found in trash" {
+		t.Fatalf("restore job = %+v, want both files restored", job)
+	}
+	if f, _ := store.GetStoredFile(context.Background(), a.ID); f.Status != "active" {
+		t.Errorf("restored file is %s, want active", f.Status)
+	}
+
+	serve(t, BatchJobStatusHandler, storetest.Request("GET", "/api/files/batch/"+primitive.NewObjectID().Hex(), nil, user.ID), http.StatusNotFound)
+}
@@ -0,0 +1,68 @@
+package filehandlers
+
+import (
+	"SE/internal/models"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// maxFilenameBytes is the longest name the as parameter may give a download
+const maxFilenameBytes = 255
+
+// contentDisposition is an attachment header for name per RFC 6266. Names that aren't plain
+// ASCII get an ASCII filename for old clients and the exact one as an RFC 5987 filename*.
+func contentDisposition(name string) string {
+	var fallback strings.Builder
+	for _, c := range name {
+		switch {
+		case c == '"' || c == '\\':
+			fallback.WriteByte('_')
+		case c < 0x20 || c == 0x7f:
+		case c > 0x7e:
+			fallback.WriteByte('_')
+		default:
+			fallback.WriteRune(c)
+		}
+	}
+	header := `attachment; filename="` + fallback.String() + `"`
+	if fallback.String() == name {
+		return header
+	}
+
+	var encoded strings.Builder
+	for _, b := range []byte(name) {
+		if isAttrChar(b) {
+			encoded.WriteByte(b)
+		} else {
+			fmt.Fprintf(&encoded, "%%%02X", b)
+		}
+	}
+	return header + "; filename*=UTF-8''" + encoded.String()
+}
+
+// isAttrChar reports whether b can appear unencoded in an RFC 5987 value
+func isAttrChar(b byte) bool {
+	switch {
+	case 'a' <= b && b <= 'z', 'A' <= b && b <= 'Z', '0' <= b && b <= '9':
+		return true
+	}
+	return strings.IndexByte("!#$&+-.^_`|~", b) >= 0
+}
+
+// downloadName is the name a file is downloaded as: its original filename, or the as
+// parameter, which lets a client tell apart files uploaded under the same name
+func downloadName(r *http.Request, file *models.StoredFile) (string, error) {
+	if !r.URL.Query().Has("as") {
+		return file.OriginalFilename, nil
+	}
+	as := strings.TrimSpace(r.URL.Query().Get("as"))
+	if as == "" || as == "." || as == ".." || len(as) > maxFilenameBytes || !utf8.ValidString(as) ||
+		strings.ContainsAny(as, `/\`) || strings.ContainsFunc(as, unicode.IsControl) {
+		return "", errors.New("invalid filename")
+	}
+	return as, nil
+}
@@ -0,0 +1,176 @@
+package filehandlers
+
+import (
+	"SE/internal/events"
+	"SE/internal/fileprocessor"
+	"SE/internal/models"
+	"SE/internal/store"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// eventsRefreshInterval is how often an open stream re-reads state, catching changes made
+// by another server instance, and keeps idle connections alive
+const eventsRefreshInterval = 15 * time.Second
+
+// uploadProgress is the SSE payload for an upload session
+type uploadProgress struct {
+	Status             string             `json:"status"`
+	UploadedSize       int64              `json:"uploaded_size"`
+	TotalSize          int64              `json:"total_size"`
+	MissingRanges      []models.ByteRange `json:"missing_ranges,omitempty"`
+	ProcessingProgress float64            `json:"processing_progress"`
+	Message            string             `json:"message,omitempty"` // current step, or the error once failed
+}
+
+func newUploadProgress(s *models.UploadSession) uploadProgress {
+	p := uploadProgress{
+		Status:             s.Status,
+		UploadedSize:       s.UploadedSize,
+		TotalSize:          s.TotalSize,
+		ProcessingProgress: s.ProcessingProgress,
+		Message:            s.ErrorMessage,
+	}
+	if s.Status == "uploading" {
+		p.MissingRanges = fileprocessor.MissingRanges(s.ReceivedRanges, s.TotalSize)
+	}
+	return p
+}
+
+// UploadEventsHandler - GET /api/files/upload/events/:session_id
+// Streams session progress as Server-Sent Events until processing completes or fails
+func UploadEventsHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("userID").(primitive.ObjectID)
+
+	sessionID, err := primitive.ObjectIDFromHex(r.URL.Path[len("/api/files/upload/events/"):])
+	if err != nil {
+		http.Error(w, "invalid session_id", http.StatusBadRequest)
+		return
+	}
+
+	session, err := store.GetUploadSession(r.Context(), sessionID)
+	if err != nil {
+		http.Error(w, "failed to get session", http.StatusInternalServerError)
+		return
+	}
+	if session == nil || session.UserID != userID {
+		http.Error(w, "session not found", http.StatusNotFound)
+		return
+	}
+
+	// Subscribe before sending the snapshot so no change falls in between
+	updates, unsubscribe := events.Subscribe(events.UploadTopic(sessionID))
+	defer unsubscribe()
+
+	rc := http.NewResponseController(w)
+	startEventStream(w)
+
+	var last uploadProgress
+	send := func(s *models.UploadSession) bool {
+		p := newUploadProgress(s)
+		if p.Status == last.Status && p.UploadedSize == last.UploadedSize &&
+			p.ProcessingProgress == last.ProcessingProgress && p.Message == last.Message && last.Status != "" {
+			return true
+		}
+		last = p
+		if writeEvent(w, "progress", p) != nil || rc.Flush() != nil {
+			return false
+		}
+		// The stream ends with the session's outcome
+		return s.Status != "complete" && s.Status != "failed" && s.Status != "infected"
+	}
+	if !send(session) {
+		return
+	}
+
+	ticker := time.NewTicker(eventsRefreshInterval)
+	defer ticker.Stop()
+	for {
+		tick := false
+		select {
+		case <-r.Context().Done():
+			return
+		case <-updates:
+		case <-ticker.C:
+			tick = true
+		}
+
+		session, err := store.GetUploadSession(r.Context(), sessionID)
+		if err == nil && session == nil {
+			writeEvent(w, "gone", map[string]string{"message": "session no longer exists"})
+			rc.Flush()
+			return
+		}
+		if err == nil && !send(session) {
+			return
+		}
+		if tick {
+			if _, err := fmt.Fprint(w, ": keepalive\n\n"); err != nil || rc.Flush() != nil {
+				return
+			}
+		}
+	}
+}
+
+// fileEvents handles GET /api/files/:id/events. Streams restore progress of a file while a
+// download of it is being prepared; the stream stays open until the client disconnects.
+func fileEvents(w http.ResponseWriter, r *http.Request, fileID primitive.ObjectID) {
+	userID := r.Context().Value("userID").(primitive.ObjectID)
+
+	file, err := store.GetStoredFile(r.Context(), fileID)
+	if err != nil {
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+	if file == nil || file.UserID != userID || file.Status != "active" {
+		http.Error(w, "file not found", http.StatusNotFound)
+		return
+	}
+
+	updates, unsubscribe := events.Subscribe(events.DownloadTopic(fileID))
+	defer unsubscribe()
+
+	rc := http.NewResponseController(w)
+	startEventStream(w)
+	if rc.Flush() != nil {
+		return
+	}
+
+	ticker := time.NewTicker(eventsRefreshInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case p := <-updates:
+			if writeEvent(w, "progress", p) != nil || rc.Flush() != nil {
+				return
+			}
+		case <-ticker.C:
+			if _, err := fmt.Fprint(w, ": keepalive\n\n"); err != nil || rc.Flush() != nil {
+				return
+			}
+		}
+	}
+}
+
+func startEventStream(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no") // don't let nginx buffer the stream
+	w.WriteHeader(http.StatusOK)
+}
+
+func writeEvent(w http.ResponseWriter, name string, v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", name, data)
+	return err
+}
@@ -0,0 +1,154 @@
+package filehandlers
+
+import (
+	"SE/internal/fileprocessor"
+	"SE/internal/store"
+	"archive/zip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// ExportHandler - POST /api/files/export
+// Starts reconstructing all of the user's files, into a staging area or onto a linked drive
+func ExportHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("userID").(primitive.ObjectID)
+
+	var req struct {
+		DriveAccountID string `json:"drive_account_id"` // empty to stage the files on the server
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+		http.Error(w, "invalid request", http.StatusBadRequest)
+		return
+	}
+
+	var accountID primitive.ObjectID
+	if req.DriveAccountID != "" {
+		id, err := primitive.ObjectIDFromHex(req.DriveAccountID)
+		if err != nil {
+			http.Error(w, "invalid drive account id", http.StatusBadRequest)
+			return
+		}
+		accounts, err := store.ListUserDriveAccounts(r.Context(), userID)
+		if err != nil {
+			http.Error(w, "server error", http.StatusInternalServerError)
+			return
+		}
+		for _, a := range accounts {
+			if a.ID == id {
+				accountID = id
+			}
+		}
+		if accountID.IsZero() {
+			http.Error(w, "drive account not found", http.StatusNotFound)
+			return
+		}
+	}
+
+	export, err := fileprocessor.StartExport(r.Context(), userID, accountID)
+	if errors.Is(err, fileprocessor.ErrExportRunning) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"error":      err.Error(),
+			"export_id":  export.ID,
+			"status_url": "/api/files/export/" + export.ID,
+		})
+		return
+	}
+	if err != nil {
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"export_id":   export.ID,
+		"status":      export.Status,
+		"files_total": export.FilesTotal,
+		"bytes_total": export.BytesTotal,
+		"status_url":  "/api/files/export/" + export.ID,
+	})
+}
+
+// ExportStatusHandler - GET /api/files/export/:id[/download]
+// Reports an export's progress, or downloads the files it staged as a zip
+func ExportStatusHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("userID").(primitive.ObjectID)
+
+	id, action, _ := strings.Cut(strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/files/export/"), "/"), "/")
+	export, ok := fileprocessor.GetExport(userID, id)
+	if !ok {
+		http.Error(w, "export not found", http.StatusNotFound)
+		return
+	}
+
+	switch action {
+	case "":
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(export)
+	case "download":
+		if export.DriveAccountID != "" {
+			http.Error(w, "export went to a drive", http.StatusConflict)
+			return
+		}
+		if export.Status != "done" {
+			http.Error(w, "export is still running", http.StatusConflict)
+			return
+		}
+		downloadExport(w, r, export)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// downloadExport streams the files a finished export staged as a zip
+func downloadExport(w http.ResponseWriter, r *http.Request, export fileprocessor.Export) {
+	files, ok := fileprocessor.ExportedFiles(r.Context().Value("userID").(primitive.ObjectID), export.ID)
+	if !ok {
+		http.Error(w, "export not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", contentDisposition("export-"+export.ID+".zip"))
+	zw := zip.NewWriter(w)
+	used := make(map[string]bool, len(files))
+	for _, f := range files {
+		// Same paths get numbered like in zip downloads
+		base := strings.TrimPrefix(f.Path, "/")
+		name := base
+		for n := 2; used[name]; n++ {
+			ext := path.Ext(base)
+			name = fmt.Sprintf("%s (%d)%s", strings.TrimSuffix(base, ext), n, ext)
+		}
+		used[name] = true
+
+		src, err := os.Open(f.Staged)
+		if err != nil {
+			log.Printf("Failed to open staged file %s of export %s: %v", f.Staged, export.ID, err)
+			panic(http.ErrAbortHandler)
+		}
+		header := &zip.FileHeader{Name: name, Method: zip.Store, Modified: f.CreatedAt}
+		header.SetMode(0o644)
+		err = copyZipEntry(zw, header, src)
+		src.Close()
+		if err != nil {
+			log.Printf("Failed to add staged file %s of export %s to zip: %v", f.Staged, export.ID, err)
+			panic(http.ErrAbortHandler)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		log.Printf("Failed to finish zip of export %s: %v", export.ID, err)
+		panic(http.ErrAbortHandler)
+	}
+}
@@ -0,0 +1,951 @@
+package filehandlers
+
+import (
+	"SE/internal/audit"
+	"SE/internal/fileprocessor"
+	"SE/internal/jobs"
+	"SE/internal/middleware"
+	"SE/internal/models"
+	"SE/internal/store"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// storedFileOut is the listing view of a stored file
+type storedFileOut struct {
+	ID               primitive.ObjectID `json:"id"`
+	OriginalFilename string             `json:"original_filename"`
+	Folder           string             `json:"folder"`
+	Path             string             `json:"path"`
+	OriginalSize     int64              `json:"original_size"`
+	Strategy         string             `json:"strategy"`
+	NumChunks        int                `json:"num_chunks"`
+	Pinned           bool               `json:"pinned"`
+	Tags             []string           `json:"tags,omitempty"`
+	Status           string             `json:"status"` // "incomplete" until its missing chunks are repaired
+	ContentType      string             `json:"content_type,omitempty"`
+	Media            *models.MediaInfo  `json:"media,omitempty"`
+	UploadClient     *models.ClientInfo `json:"upload_client,omitempty"`
+	CreatedAt        time.Time          `json:"created_at"`
+	DeletedAt        *time.Time         `json:"deleted_at,omitempty"` // trashed files only
+	PurgeAt          *time.Time         `json:"purge_at,omitempty"`   // when the trash is emptied of it
+}
+
+// ListStoredFilesHandler - GET /api/files/list
+func ListStoredFilesHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("userID").(primitive.ObjectID)
+
+	query, ok := parseFileListQuery(w, r, userID)
+	if !ok {
+		return
+	}
+	folder := query.Folder
+
+	files, err := store.ListUserStoredFiles(r.Context(), userID, query)
+	if err != nil {
+		log.Printf("Failed to list stored files: %v", err)
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+
+	out := storedFilesOut(files)
+
+	// ?view=tree nests the files in their folders instead of a flat list; both list the
+	// folders, empty ones included, unless the listing is recursive and flat
+	tree := r.URL.Query().Get("view") == "tree"
+	var folders map[string]*models.Folder
+	if tree || query.Shallow {
+		if folders, err = userFolders(r.Context(), userID); err != nil {
+			log.Printf("Failed to list folders: %v", err)
+			http.Error(w, "server error", http.StatusInternalServerError)
+			return
+		}
+	}
+	if tree {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"tree": buildFolderTree(folder, out, folders),
+		})
+		return
+	}
+
+	resp := map[string]interface{}{"files": out}
+	if query.Shallow {
+		resp["folders"] = subfolders(folders, folder)
+	}
+	if query.Limit > 0 && len(files) == query.Limit {
+		resp["next_cursor"] = store.CursorAfter(files[len(files)-1]).String()
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// storedFilesOut is the listing view of files
+func storedFilesOut(files []*models.StoredFile) []storedFileOut {
+	out := make([]storedFileOut, 0, len(files))
+	for _, f := range files {
+		out = append(out, storedFileOut{
+			ID:               f.ID,
+			OriginalFilename: f.OriginalFilename,
+			Folder:           f.Folder,
+			Path:             storedFilePath(f),
+			OriginalSize:     f.OriginalSize,
+			Strategy:         string(f.Strategy),
+			NumChunks:        len(f.Chunks),
+			Pinned:           f.Pinned,
+			Tags:             f.Tags,
+			Status:           f.Status,
+			ContentType:      f.ContentType,
+			Media:            f.Media,
+			UploadClient:     f.UploadClient,
+			CreatedAt:        f.CreatedAt,
+		})
+		if f.Status == "trashed" && f.DeletedAt != nil {
+			o := &out[len(out)-1]
+			o.DeletedAt = f.DeletedAt
+			if retention := fileprocessor.TrashRetention(); retention >= 0 {
+				purgeAt := f.DeletedAt.Add(retention)
+				o.PurgeAt = &purgeAt
+			}
+		}
+	}
+	return out
+}
+
+// parseFileListQuery reads the filters, order and page of a file listing
+func parseFileListQuery(w http.ResponseWriter, r *http.Request, userID primitive.ObjectID) (store.StoredFileQuery, bool) {
+	q := r.URL.Query()
+
+	// ?q= searches names, descriptions and metadata values; ?meta=key:value filters exactly (repeatable)
+	query := store.StoredFileQuery{Search: strings.TrimSpace(q.Get("q"))}
+	for _, m := range q["meta"] {
+		key, value, ok := strings.Cut(m, ":")
+		if !ok || !metadataKeyPattern.MatchString(key) {
+			http.Error(w, "meta must be key:value", http.StatusBadRequest)
+			return query, false
+		}
+		if query.Metadata == nil {
+			query.Metadata = make(map[string]string)
+		}
+		query.Metadata[key] = value
+	}
+	// ?tag= keeps files with the tag (repeatable, all must match)
+	for _, t := range q["tag"] {
+		tag, err := cleanTag(t)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return query, false
+		}
+		query.Tags = append(query.Tags, tag)
+	}
+	// ?folder= limits the listing to a subtree
+	folder, err := fileprocessor.NormalizeFolder(q.Get("folder"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return query, false
+	}
+	query.Folder = folder
+	// ?recursive=false leaves out the files in its subfolders
+	switch q.Get("recursive") {
+	case "", "true":
+	case "false":
+		query.Shallow = true
+	default:
+		http.Error(w, "recursive must be true or false", http.StatusBadRequest)
+		return query, false
+	}
+
+	switch query.Status = q.Get("status"); query.Status {
+	case "", "active", "incomplete":
+	default:
+		http.Error(w, "status must be active or incomplete", http.StatusBadRequest)
+		return query, false
+	}
+	// ?provider= keeps files with a chunk on one of the user's drives of that provider
+	if provider := q.Get("provider"); provider != "" {
+		accounts, err := store.ListUserDriveAccounts(r.Context(), userID)
+		if err != nil {
+			log.Printf("Failed to list drive accounts: %v", err)
+			http.Error(w, "server error", http.StatusInternalServerError)
+			return query, false
+		}
+		query.Drives = []primitive.ObjectID{}
+		for _, acc := range accounts {
+			if acc.Provider == provider {
+				query.Drives = append(query.Drives, acc.ID)
+			}
+		}
+	}
+	for _, bound := range []struct {
+		name string
+		t    *time.Time
+	}{{"since", &query.Since}, {"until", &query.Until}} {
+		if v := q.Get(bound.name); v != "" {
+			t, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				http.Error(w, bound.name+" must be an RFC 3339 time", http.StatusBadRequest)
+				return query, false
+			}
+			*bound.t = t
+		}
+	}
+
+	// Newest and largest first, names A-Z, unless ?order= says otherwise
+	switch query.Sort = q.Get("sort"); query.Sort {
+	case "", store.SortByCreated, store.SortBySize:
+	case store.SortByName:
+		query.Asc = true
+	default:
+		http.Error(w, "sort must be created, name or size", http.StatusBadRequest)
+		return query, false
+	}
+	switch q.Get("order") {
+	case "":
+	case "asc":
+		query.Asc = true
+	case "desc":
+		query.Asc = false
+	default:
+		http.Error(w, "order must be asc or desc", http.StatusBadRequest)
+		return query, false
+	}
+
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > 1000 {
+			http.Error(w, "limit must be 1-1000", http.StatusBadRequest)
+			return query, false
+		}
+		query.Limit = n
+	}
+	if v := q.Get("cursor"); v != "" {
+		cursor, err := store.ParseFileCursor(v)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return query, false
+		}
+		query.After = cursor
+	}
+	return query, true
+}
+
+// folderNode is one folder of the tree view of a listing
+type folderNode struct {
+	Name    string          `json:"name"`
+	Path    string          `json:"path"`
+	Folders []*folderNode   `json:"folders"`
+	Files   []storedFileOut `json:"files"`
+}
+
+// buildFolderTree nests files under root by their folder, along with the folders below root
+// that have no files listed. Folders are sorted by name; files keep the order of the listing.
+func buildFolderTree(root string, files []storedFileOut, folders map[string]*models.Folder) *folderNode {
+	tree := &folderNode{Name: path.Base("/" + root), Path: "/" + strings.TrimPrefix(root, "/"), Folders: []*folderNode{}, Files: []storedFileOut{}}
+	nodes := map[string]*folderNode{root: tree}
+
+	var nodeFor func(folder string) *folderNode
+	nodeFor = func(folder string) *folderNode {
+		if n, ok := nodes[folder]; ok {
+			return n
+		}
+		parent := nodeFor(strings.TrimSuffix(path.Dir(folder), "/"))
+		n := &folderNode{Name: path.Base(folder), Path: folder, Folders: []*folderNode{}, Files: []storedFileOut{}}
+		parent.Folders = append(parent.Folders, n)
+		nodes[folder] = n
+		return n
+	}
+
+	for p := range folders {
+		if p != root && (root == "" || strings.HasPrefix(p, root+"/")) {
+			nodeFor(p)
+		}
+	}
+	for _, f := range files {
+		n := nodeFor(f.Folder)
+		n.Files = append(n.Files, f)
+	}
+	for _, n := range nodes {
+		sort.Slice(n.Folders, func(i, j int) bool { return n.Folders[i].Name < n.Folders[j].Name })
+	}
+	return tree
+}
+
+// storedFilePath is the file's full path; files stored before paths were recorded derive it
+func storedFilePath(f *models.StoredFile) string {
+	if f.Path != "" {
+		return f.Path
+	}
+	return models.FilePath(f.Folder, f.OriginalFilename)
+}
+
+// FileResourceHandler - /api/files/:id[/<action>[/<action>]]
+// Dispatches per-file actions; unknown paths get 404
+func FileResourceHandler(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(r.URL.Path[len("/api/files/"):], "/"), "/")
+	if len(parts) > 3 {
+		http.NotFound(w, r)
+		return
+	}
+
+	fileID, err := primitive.ObjectIDFromHex(parts[0])
+	if err != nil {
+		http.Error(w, "invalid file id", http.StatusBadRequest)
+		return
+	}
+
+	if len(parts) == 1 {
+		switch r.Method {
+		case "GET":
+			getFileDetail(w, r, fileID)
+		case "PATCH":
+			updateFile(w, r, fileID)
+		case "DELETE":
+			deleteFile(w, r, fileID)
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+		return
+	}
+
+	// DELETE /api/files/:id/share/:user_id
+	if len(parts) == 3 && parts[1] == "share" {
+		if r.Method != "DELETE" {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		revokeFileShare(w, r, fileID, parts[2])
+		return
+	}
+
+	switch strings.Join(parts[1:], "/") {
+	case "download":
+		switch r.Method {
+		case "GET":
+			downloadFile(w, r, fileID)
+		case "DELETE":
+			discardDownload(w, r, fileID)
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	case "download/link":
+		if r.Method != "POST" {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		createDownloadLink(w, r, fileID)
+	case "download/chunks":
+		if r.Method != "GET" {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		chunkURLs(w, r, fileID)
+	case "events":
+		if r.Method != "GET" {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		fileEvents(w, r, fileID)
+	case "restore":
+		if r.Method != "POST" {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		restoreFile(w, r, fileID)
+	case "repair":
+		if r.Method != "POST" {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		repairFile(w, r, fileID)
+	case "health":
+		if r.Method != "GET" {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		fileHealth(w, r, fileID)
+	case "verify":
+		if r.Method != "POST" {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		verifyFileIntegrity(w, r, fileID)
+	case "public-links":
+		if r.Method != "POST" {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		createPublicLink(w, r, fileID)
+	case "share":
+		switch r.Method {
+		case "POST":
+			shareFile(w, r, fileID)
+		case "GET":
+			listFileShares(w, r, fileID)
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	case "tags":
+		switch r.Method {
+		case "POST":
+			tagFile(w, r, fileID, true)
+		case "DELETE":
+			tagFile(w, r, fileID, false)
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	case "pin":
+		switch r.Method {
+		case "PUT":
+			setFilePinned(w, r, fileID, true)
+		case "DELETE":
+			setFilePinned(w, r, fileID, false)
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// downloadFile handles GET /api/files/:id/download, for the owner and the users the file is
+// shared with. Supports Range requests.
+func downloadFile(w http.ResponseWriter, r *http.Request, fileID primitive.ObjectID) {
+	userID := r.Context().Value("userID").(primitive.ObjectID)
+
+	file, err := store.GetStoredFile(r.Context(), fileID)
+	if err != nil {
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+	if file == nil || (file.Status != "active" && file.Status != "incomplete") {
+		http.Error(w, "file not found", http.StatusNotFound)
+		return
+	}
+	allowed, err := canDownload(r.Context(), file, userID)
+	if err != nil {
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+	if !allowed {
+		http.Error(w, "file not found", http.StatusNotFound)
+		return
+	}
+	if file.Status == "incomplete" {
+		http.Error(w, "file is incomplete", http.StatusConflict)
+		return
+	}
+	name, err := downloadName(r, file)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	serveDownload(w, r, file, name)
+}
+
+// serveDownload sends an active file as name, streamed or reconstructed as the mode asks
+func serveDownload(w http.ResponseWriter, r *http.Request, file *models.StoredFile, name string) {
+	// A text file's Content-Type would otherwise put its first bytes in the request log
+	middleware.OmitResponseBody(r)
+
+	stream := fileprocessor.StreamDownloads()
+	switch r.URL.Query().Get("mode") {
+	case "stream":
+		stream = true
+	case "reconstruct":
+		stream = false
+	}
+	if stream && fileprocessor.CanStream(file) {
+		if f := fileprocessor.OpenCachedFile(file); f != nil {
+			defer f.Close()
+			serveRestoredFile(w, r, file, name, f, true)
+			return
+		}
+		// A single range is streamed from the chunks that hold it; multiple ranges and
+		// conditional ones are left to http.ServeContent on a reconstructed copy
+		rng := r.Header.Get("Range")
+		if !strings.HasPrefix(rng, "bytes=") {
+			// No range, or in a unit other than bytes, which is ignored
+			streamFile(w, r, file, name, 0, file.OriginalSize, false)
+			return
+		}
+		if !strings.Contains(rng, ",") && r.Header.Get("If-Range") == "" {
+			start, length, err := parseByteRange(rng, file.OriginalSize)
+			if err != nil {
+				w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", file.OriginalSize))
+				http.Error(w, "invalid range", http.StatusRequestedRangeNotSatisfiable)
+				return
+			}
+			streamFile(w, r, file, name, start, length, true)
+			return
+		}
+	}
+
+	f, hit, err := fileprocessor.OpenRestoredFile(r.Context(), file)
+	if errors.Is(err, fileprocessor.ErrRestoreCancelled) {
+		http.Error(w, "download cancelled", http.StatusConflict)
+		return
+	}
+	if errors.Is(err, fileprocessor.ErrDownloadDiskFull) {
+		log.Printf("Refused to restore file %s: %v", file.ID.Hex(), err)
+		w.Header().Set("Retry-After", "60")
+		http.Error(w, "server is short on disk space, try again later", http.StatusServiceUnavailable)
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to restore file %s: %v", file.ID.Hex(), err)
+		http.Error(w, "failed to restore file", http.StatusBadGateway)
+		return
+	}
+	defer f.Close()
+	serveRestoredFile(w, r, file, name, f, hit)
+}
+
+// serveRestoredFile sends a reconstructed file, honoring Range requests
+func serveRestoredFile(w http.ResponseWriter, r *http.Request, file *models.StoredFile, name string, f *os.File, hit bool) {
+	if err := store.RecordStoredFileDownload(r.Context(), file.ID, middleware.ClientInfo(r)); err != nil {
+		log.Printf("Failed to record download of file %s: %v", file.ID.Hex(), err)
+	}
+
+	cacheStatus := "MISS"
+	if hit {
+		cacheStatus = "HIT"
+	}
+	w.Header().Set("X-Cache", cacheStatus)
+	w.Header().Set("Content-Disposition", contentDisposition(name))
+	http.ServeContent(w, r, file.OriginalFilename, file.CreatedAt, f)
+}
+
+// streamFile sends length bytes of a file from start as its chunks arrive from the drives, as a
+// 206 when partial. Once the first byte is out the status can't change, so a failure part way
+// aborts the response and the client sees a download shorter than its Content-Length.
+func streamFile(w http.ResponseWriter, r *http.Request, file *models.StoredFile, name string, start, length int64, partial bool) {
+	if err := store.RecordStoredFileDownload(r.Context(), file.ID, middleware.ClientInfo(r)); err != nil {
+		log.Printf("Failed to record download of file %s: %v", file.ID.Hex(), err)
+	}
+
+	contentType := file.ContentType
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	h := w.Header()
+	h.Set("X-Cache", "BYPASS")
+	h.Set("Content-Type", contentType)
+	h.Set("Content-Disposition", contentDisposition(name))
+	h.Set("Accept-Ranges", "bytes")
+	h.Set("Content-Length", strconv.FormatInt(length, 10))
+	cw := &countingWriter{w: w, status: http.StatusOK}
+	if partial {
+		h.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, start+length-1, file.OriginalSize))
+		cw.status = http.StatusPartialContent
+	}
+
+	if err := fileprocessor.StreamFileRange(r.Context(), file, start, length, cw); err != nil {
+		log.Printf("Failed to stream file %s: %v", file.ID.Hex(), err)
+		if cw.n > 0 {
+			panic(http.ErrAbortHandler)
+		}
+		h.Del("Content-Length")
+		h.Del("Content-Range")
+		h.Del("Content-Disposition")
+		h.Del("X-Cache")
+		if errors.Is(err, fileprocessor.ErrRestoreCancelled) {
+			http.Error(w, "download cancelled", http.StatusConflict)
+			return
+		}
+		http.Error(w, "failed to restore file", http.StatusBadGateway)
+	}
+}
+
+// CancelDownloadHandler - POST /api/files/download/cancel/:session_id
+// Stops one running download of the caller's, as listed by ListDownloadSessionsHandler; its
+// request fails and the chunks it fetched are deleted. Other downloads of the file carry on.
+func CancelDownloadHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("userID").(primitive.ObjectID)
+	sessionID, err := primitive.ObjectIDFromHex(strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/files/download/cancel/"), "/"))
+	if err != nil {
+		http.Error(w, "invalid session_id", http.StatusBadRequest)
+		return
+	}
+
+	session, err := fileprocessor.CancelRestore(userID, sessionID)
+	switch {
+	case errors.Is(err, fileprocessor.ErrRestoreNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	case errors.Is(err, fileprocessor.ErrRestoreFinished):
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	log.Printf("Cancelled download session %s of file %s", sessionID.Hex(), session.FileID)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(session)
+}
+
+// discardDownload handles DELETE /api/files/:id/download. A client done downloading a file
+// removes its reconstructed copy now rather than leaving it until RESTORE_CACHE_TTL_MINUTES
+// pass without use.
+func discardDownload(w http.ResponseWriter, r *http.Request, fileID primitive.ObjectID) {
+	userID := r.Context().Value("userID").(primitive.ObjectID)
+
+	file, err := store.GetStoredFile(r.Context(), fileID)
+	if err != nil {
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+	if file == nil || file.UserID != userID {
+		http.Error(w, "file not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"file_id":   fileID.Hex(),
+		"discarded": fileprocessor.InvalidateRestoreCache(fileID),
+	})
+}
+
+// ListDownloadSessionsHandler - GET /api/files/download/sessions
+// Lists the caller's downloads this server is running or finished within the last hour
+func ListDownloadSessionsHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("userID").(primitive.ObjectID)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"sessions": fileprocessor.ListRestores(userID),
+	})
+}
+
+// parseByteRange parses a single "bytes=" range of a file of size bytes into its start and length
+func parseByteRange(spec string, size int64) (int64, int64, error) {
+	spec, ok := strings.CutPrefix(spec, "bytes=")
+	if !ok {
+		return 0, 0, errors.New("not a byte range")
+	}
+	first, last, ok := strings.Cut(strings.TrimSpace(spec), "-")
+	if !ok {
+		return 0, 0, errors.New("malformed range")
+	}
+	if first == "" {
+		// The last n bytes
+		n, err := strconv.ParseInt(last, 10, 64)
+		if err != nil || n <= 0 {
+			return 0, 0, errors.New("malformed range")
+		}
+		n = min(n, size)
+		return size - n, n, nil
+	}
+	start, err := strconv.ParseInt(first, 10, 64)
+	if err != nil || start < 0 || start >= size {
+		return 0, 0, errors.New("range starts past the end")
+	}
+	end := size - 1
+	if last != "" {
+		if end, err = strconv.ParseInt(last, 10, 64); err != nil || end < start {
+			return 0, 0, errors.New("malformed range")
+		}
+		end = min(end, size-1)
+	}
+	return start, end - start + 1, nil
+}
+
+// countingWriter counts the bytes written through it and sends status with the first write,
+// so that it can still change until then
+type countingWriter struct {
+	w      http.ResponseWriter
+	status int
+	n      int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	if c.status != 0 {
+		c.w.WriteHeader(c.status)
+		c.status = 0
+	}
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// setFilePinned handles PUT/DELETE /api/files/:id/pin. Only the owner can change it.
+func setFilePinned(w http.ResponseWriter, r *http.Request, fileID primitive.ObjectID, pinned bool) {
+	userID := r.Context().Value("userID").(primitive.ObjectID)
+
+	found, err := store.SetStoredFilePinned(r.Context(), userID, fileID, pinned)
+	if err != nil {
+		log.Printf("Failed to update pin for file %s: %v", fileID.Hex(), err)
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+	if !found {
+		http.Error(w, "file not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"id":     fileID.Hex(),
+		"pinned": pinned,
+	})
+}
+
+// Errors of the file actions that both their own endpoints and batch jobs run
+var (
+	// errFileNotFound is a file that isn't the caller's, or isn't in a state the action takes
+	errFileNotFound = errors.New("file not found")
+	errNotInTrash   = errors.New("file not found in trash")
+	errTooManyTags  = fmt.Errorf("at most %d tags allowed", maxTags)
+	// errServer is a store error, which is logged rather than shown
+	errServer = errors.New("server error")
+)
+
+// fileActionStatus is the HTTP status to answer an error of a file action with
+func fileActionStatus(err error) int {
+	switch {
+	case errors.Is(err, errFileNotFound), errors.Is(err, errNotInTrash):
+		return http.StatusNotFound
+	case errors.Is(err, errTooManyTags):
+		return http.StatusBadRequest
+	case errors.Is(err, fileprocessor.ErrQuotaExceeded):
+		return http.StatusRequestEntityTooLarge
+	}
+	return http.StatusInternalServerError
+}
+
+// deleteFile handles DELETE /api/files/:id. The file moves to the trash with its chunks left on
+// the drives; the purge deletes them once TRASH_RETENTION_DAYS have passed.
+func deleteFile(w http.ResponseWriter, r *http.Request, fileID primitive.ObjectID) {
+	userID := r.Context().Value("userID").(primitive.ObjectID)
+
+	if err := trashFile(r, userID, fileID); err != nil {
+		http.Error(w, err.Error(), fileActionStatus(err))
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// trashFile moves one of the user's files to the trash. r is for the audit log.
+func trashFile(r *http.Request, userID, fileID primitive.ObjectID) error {
+	file, err := store.GetStoredFile(r.Context(), fileID)
+	if err != nil {
+		return errServer
+	}
+	if file == nil || file.UserID != userID {
+		return errFileNotFound
+	}
+	found, err := store.TrashStoredFile(r.Context(), userID, fileID)
+	if err != nil {
+		log.Printf("Failed to trash file %s: %v", fileID.Hex(), err)
+		return errServer
+	}
+	if !found {
+		return errFileNotFound
+	}
+	audit.Record(r, models.AuditEvent{UserID: userID, Action: models.AuditFileDeleted, Target: fileID.Hex(), Detail: file.OriginalFilename})
+	return nil
+}
+
+// repairFile handles POST /api/files/:id/repair. Queues the upload of the chunks an incomplete
+// file is missing, reusing the chunks already on drives.
+func repairFile(w http.ResponseWriter, r *http.Request, fileID primitive.ObjectID) {
+	userID := r.Context().Value("userID").(primitive.ObjectID)
+
+	file, err := store.GetStoredFile(r.Context(), fileID)
+	if err != nil {
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+	if file == nil || file.UserID != userID || (file.Status != "active" && file.Status != "incomplete") {
+		http.Error(w, "file not found", http.StatusNotFound)
+		return
+	}
+	if file.Status != "incomplete" {
+		http.Error(w, "file is not incomplete", http.StatusConflict)
+		return
+	}
+
+	// The session holds the checkpoint of the uploaded chunks and the original upload
+	session, err := store.GetUploadSession(r.Context(), file.SessionID)
+	if err != nil {
+		http.Error(w, "failed to get session", http.StatusInternalServerError)
+		return
+	}
+	if session == nil {
+		http.Error(w, "upload session has expired", http.StatusGone)
+		return
+	}
+	if session.Status != "incomplete" {
+		http.Error(w, "repair already in progress", http.StatusConflict)
+		return
+	}
+	if _, err := os.Stat(session.TempFilePath); err != nil {
+		http.Error(w, "uploaded file is no longer available", http.StatusGone)
+		return
+	}
+	job, err := store.GetSessionJob(r.Context(), session.ID)
+	if err != nil {
+		http.Error(w, "failed to get processing job", http.StatusInternalServerError)
+		return
+	}
+	if job == nil {
+		http.Error(w, "session has no processing job", http.StatusConflict)
+		return
+	}
+
+	repairing, err := fileprocessor.RepairSession(r.Context(), session.ID)
+	if err != nil {
+		http.Error(w, "failed to repair", http.StatusInternalServerError)
+		return
+	}
+	if !repairing {
+		http.Error(w, "repair already in progress", http.StatusConflict)
+		return
+	}
+	if err := jobs.Enqueue(r.Context(), session.ID, userID, session.TotalSize, job.Request); err != nil {
+		log.Printf("Failed to queue repair of file %s: %v", fileID.Hex(), err)
+		fileprocessor.MarkIncomplete(r.Context(), session, session.ProcessingProgress, "Failed to queue repair")
+		http.Error(w, "failed to queue processing", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"session_id":     session.ID.Hex(),
+		"missing_chunks": file.MissingChunks,
+		"status_url":     fmt.Sprintf("/api/files/upload/status/%s", session.ID.Hex()),
+	})
+}
+
+// getFileDetail handles GET /api/files/:id
+func getFileDetail(w http.ResponseWriter, r *http.Request, fileID primitive.ObjectID) {
+	userID := r.Context().Value("userID").(primitive.ObjectID)
+
+	file, err := store.GetStoredFile(r.Context(), fileID)
+	if err != nil {
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+	if file == nil || file.UserID != userID || (file.Status != "active" && file.Status != "incomplete") {
+		http.Error(w, "file not found", http.StatusNotFound)
+		return
+	}
+
+	file.Path = storedFilePath(file)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(file)
+}
+
+// Limits on user-supplied file names and notes
+const (
+	maxFilenameLength      = 255
+	maxDescriptionLength   = 4096
+	maxMetadataEntries     = 32
+	maxMetadataValueLength = 1024
+)
+
+// cleanName trims a new file or folder name and checks it is a single path element; what
+// names it in errors
+func cleanName(what, name string) (string, error) {
+	name = strings.TrimSpace(name)
+	switch {
+	case name == "" || name == "." || name == "..":
+		return "", errors.New(what + " required")
+	case len(name) > maxFilenameLength:
+		return "", fmt.Errorf("%s longer than %d bytes", what, maxFilenameLength)
+	case strings.ContainsAny(name, "/\\\x00"):
+		return "", errors.New(what + " can't contain / or \\")
+	}
+	return name, nil
+}
+
+// metadataKeyPattern keeps keys usable as Mongo field names and query parameters
+var metadataKeyPattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+
+// updateFile handles PATCH /api/files/:id. Omitted fields are left unchanged; metadata is
+// replaced as a whole. A rename or move only changes the record: chunks are named by their
+// number on the drives, and key files find the file by its ID.
+func updateFile(w http.ResponseWriter, r *http.Request, fileID primitive.ObjectID) {
+	userID := r.Context().Value("userID").(primitive.ObjectID)
+
+	var req struct {
+		Filename    *string           `json:"filename"`
+		Folder      *string           `json:"folder"`
+		Description *string           `json:"description"`
+		Metadata    map[string]string `json:"metadata"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+	if req.Filename != nil {
+		name, err := cleanName("filename", *req.Filename)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		req.Filename = &name
+	}
+	if req.Folder != nil {
+		folder, err := fileprocessor.NormalizeFolder(*req.Folder)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		req.Folder = &folder
+	}
+	if req.Description != nil && len(*req.Description) > maxDescriptionLength {
+		http.Error(w, fmt.Sprintf("description longer than %d bytes", maxDescriptionLength), http.StatusBadRequest)
+		return
+	}
+	if len(req.Metadata) > maxMetadataEntries {
+		http.Error(w, fmt.Sprintf("at most %d metadata entries allowed", maxMetadataEntries), http.StatusBadRequest)
+		return
+	}
+	for k, v := range req.Metadata {
+		if !metadataKeyPattern.MatchString(k) {
+			http.Error(w, fmt.Sprintf("invalid metadata key %q", k), http.StatusBadRequest)
+			return
+		}
+		if len(v) > maxMetadataValueLength {
+			http.Error(w, fmt.Sprintf("metadata %q longer than %d bytes", k, maxMetadataValueLength), http.StatusBadRequest)
+			return
+		}
+	}
+
+	found := true
+	var err error
+	if req.Filename != nil {
+		found, err = store.RenameStoredFile(r.Context(), userID, fileID, *req.Filename)
+	}
+	if err == nil && found && req.Folder != nil {
+		found, err = store.MoveStoredFile(r.Context(), userID, fileID, *req.Folder)
+	}
+	if err == nil && found && (req.Filename == nil && req.Folder == nil || req.Description != nil || req.Metadata != nil) {
+		found, err = store.SetStoredFileNotes(r.Context(), userID, fileID, req.Description, req.Metadata)
+	}
+	if err != nil {
+		log.Printf("Failed to update file %s: %v", fileID.Hex(), err)
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+	if !found {
+		http.Error(w, "file not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"message": "file updated"})
+}
@@ -0,0 +1,422 @@
+package filehandlers
+
+import (
+	"SE/internal/drivemanager"
+	"SE/internal/fileprocessor"
+	"SE/internal/middleware"
+	"SE/internal/models"
+	"SE/internal/oauth"
+	"SE/internal/store"
+	"SE/internal/store/storetest"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestDownload(t *testing.T) {
+	user := setup(t)
+	data := randomData(1<<20 + 777)
+	file := uploadFile(t, user.ID, "report.pdf", data)
+	path := "/api/files/" + file.ID.Hex() + "/download"
+
+	w := serve(t, FileResourceHandler, storetest.Request("GET", path, nil, user.ID), http.StatusOK)
+	if !bytes.Equal(w.Body.Bytes(), data) {
+		t.Fatalf("downloaded %d bytes that differ from the %d uploaded", w.Body.Len(), len(data))
+	}
+	if cd := w.Header().Get("Content-Disposition"); !strings.Contains(cd, "report.pdf") {
+		t.Errorf("Content-Disposition %q, want the original filename", cd)
+	}
+
+	r := storetest.Request("GET", path, nil, user.ID)
+	r.Header.Set("Range", "bytes=1000-1999")
+	w = serve(t, FileResourceHandler, r, http.StatusPartialContent)
+	if !bytes.Equal(w.Body.Bytes(), data[1000:2000]) {
+		t.Errorf("range download of %d bytes differs from bytes 1000-1999", w.Body.Len())
+	}
+
+	// Another user can't see the file
+	other := storetest.User(t)
+	serve(t, FileResourceHandler, storetest.Request("GET", path, nil, other.ID), http.StatusNotFound)
+	serve(t, FileResourceHandler, storetest.Request("GET", "/api/files/"+file.ID.Hex(), nil, other.ID), http.StatusNotFound)
+}
+
+func TestDownloadKeptOutOfLog(t *testing.T) {
+	user := setup(t)
+	data := []byte(strings.Repeat("account,secret-balance\n", 100))
+	file := uploadFile(t, user.ID, "accounts.csv", data)
+
+	var logged bytes.Buffer
+	log.SetOutput(&logged)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+	for _, mode := range []string{"stream", "reconstruct"} {
+		w := serve(t, middleware.Logger(http.HandlerFunc(FileResourceHandler)).ServeHTTP, storetest.Request("GET", "/api/files/"+file.ID.Hex()+"/download?mode="+mode, nil, user.ID), http.StatusOK)
+		if !strings.HasPrefix(w.Header().Get("Content-Type"), "text/") {
+			t.Fatalf("%s download Content-Type %q, want text so the logger would log it", mode, w.Header().Get("Content-Type"))
+		}
+	}
+	if strings.Contains(logged.String(), "secret-balance") {
+		t.Errorf("file contents in the request log:\n%s", logged.String())
+	}
+}
+
+func TestFileNotesAndPin(t *testing.T) {
+	user := setup(t)
+	file := uploadFile(t, user.ID, "notes.txt", randomData(4096))
+	path := "/api/files/" + file.ID.Hex()
+
+	serve(t, FileResourceHandler, storetest.Request("PATCH", path, jsonBody(t, map[string]any{
+		"description": "quarterly numbers",
+		"metadata":    map[string]string{"project": "apollo"},
+	}), user.ID), http.StatusOK)
+	serve(t, FileResourceHandler, storetest.Request("PUT", path+"/pin", nil, user.ID), http.StatusOK)
+
+	got, err := store.GetStoredFile(context.Background(), file.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Description != "quarterly numbers" || got.Metadata["project"] != "apollo" || !got.Pinned {
+		t.Errorf("file = %q %v pinned %v, want the notes and pinned", got.Description, got.Metadata, got.Pinned)
+	}
+
+	serve(t, FileResourceHandler, storetest.Request("PATCH", path, jsonBody(t, map[string]any{
+		"metadata": map[string]string{"bad key": "x"},
+	}), user.ID), http.StatusBadRequest)
+	other := storetest.User(t)
+	serve(t, FileResourceHandler, storetest.Request("DELETE", path+"/pin", nil, other.ID), http.StatusNotFound)
+}
+
+func TestRenameFile(t *testing.T) {
+	user := setup(t)
+	file := uploadFile(t, user.ID, "draft.txt", randomData(5000))
+	path := "/api/files/" + file.ID.Hex()
+
+	serve(t, FileResourceHandler, storetest.Request("PATCH", path, jsonBody(t, map[string]any{"filename": " final $1.txt "}), user.ID), http.StatusOK)
+	got, err := store.GetStoredFile(context.Background(), file.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.OriginalFilename != "final $1.txt" || got.Path != "/final $1.txt" {
+		t.Errorf("renamed file = %q at %q, want final $1.txt at /final $1.txt", got.OriginalFilename, got.Path)
+	}
+	w := serve(t, FileResourceHandler, storetest.Request("GET", path+"/download", nil, user.ID), http.StatusOK)
+	if cd := w.Header().Get("Content-Disposition"); !strings.Contains(cd, "final") {
+		t.Errorf("Content-Disposition %q, want the new filename", cd)
+	}
+
+	for _, bad := range []string{"", " ", "..", "a/b.txt", `a\b.txt`, strings.Repeat("x", 256)} {
+		serve(t, FileResourceHandler, storetest.Request("PATCH", path, jsonBody(t, map[string]any{"filename": bad}), user.ID), http.StatusBadRequest)
+	}
+	other := storetest.User(t)
+	serve(t, FileResourceHandler, storetest.Request("PATCH", path, jsonBody(t, map[string]any{"filename": "mine.txt"}), other.ID), http.StatusNotFound)
+}
+
+func TestFileTags(t *testing.T) {
+	user := setup(t)
+	drive := storetest.LocalDrives(t, user.ID, 0)[0]
+	var files []*models.StoredFile
+	for _, name := range []string{"a.jpg", "b.jpg"} {
+		f := &models.StoredFile{UserID: user.ID, OriginalFilename: name, Chunks: []models.StoredChunk{{ChunkID: 1, DriveAccountID: drive.ID}}}
+		if err := store.CreateStoredFile(context.Background(), f); err != nil {
+			t.Fatal(err)
+		}
+		files = append(files, f)
+	}
+	path := "/api/files/" + files[0].ID.Hex() + "/tags"
+
+	tag := func(method, path string, tags []string, want []string) {
+		t.Helper()
+		w := serve(t, FileResourceHandler, storetest.Request(method, path, jsonBody(t, map[string]any{"tags": tags}), user.ID), http.StatusOK)
+		var resp struct {
+			Tags []string `json:"tags"`
+		}
+		json.NewDecoder(w.Body).Decode(&resp)
+		if !slices.Equal(resp.Tags, want) {
+			t.Errorf("%s %v: tags %v, want %v", method, tags, resp.Tags, want)
+		}
+	}
+	tag("POST", path, []string{" Backup-2024", "photos"}, []string{"backup-2024", "photos"})
+	tag("POST", path, []string{"photos", "trip"}, []string{"backup-2024", "photos", "trip"})
+	tag("DELETE", path, []string{"trip", "never-added"}, []string{"backup-2024", "photos"})
+	tag("POST", "/api/files/"+files[1].ID.Hex()+"/tags", []string{"photos"}, []string{"photos"})
+
+	for params, want := range map[string][]string{
+		"tag=photos":                 {"a.jpg", "b.jpg"},
+		"tag=photos&tag=backup-2024": {"a.jpg"},
+		"tag=PHOTOS&tag=trip":        nil,
+	} {
+		w := serve(t, ListStoredFilesHandler, storetest.Request("GET", "/api/files/list?sort=name&"+params, nil, user.ID), http.StatusOK)
+		var page struct {
+			Files []storedFileOut `json:"files"`
+		}
+		json.NewDecoder(w.Body).Decode(&page)
+		var names []string
+		for _, f := range page.Files {
+			names = append(names, f.OriginalFilename)
+		}
+		if !slices.Equal(names, want) {
+			t.Errorf("list %s = %v, want %v", params, names, want)
+		}
+	}
+
+	serve(t, FileResourceHandler, storetest.Request("POST", path, jsonBody(t, map[string]any{"tags": []string{"two words"}}), user.ID), http.StatusBadRequest)
+	serve(t, FileResourceHandler, storetest.Request("POST", path, jsonBody(t, map[string]any{"tags": []string{}}), user.ID), http.StatusBadRequest)
+	other := storetest.User(t)
+	serve(t, FileResourceHandler, storetest.Request("POST", path, jsonBody(t, map[string]any{"tags": []string{"mine"}}), other.ID), http.StatusNotFound)
+	serve(t, FileResourceHandler, storetest.Request("DELETE", path, jsonBody(t, map[string]any{"tags": []string{"photos"}}), other.ID), http.StatusNotFound)
+}
+
+func TestDeleteFile(t *testing.T) {
+	user := setup(t)
+	file := uploadFile(t, user.ID, "old.bin", randomData(100000))
+	path := "/api/files/" + file.ID.Hex()
+
+	other := storetest.User(t)
+	serve(t, FileResourceHandler, storetest.Request("DELETE", path, nil, other.ID), http.StatusNotFound)
+	serve(t, FileResourceHandler, storetest.Request("DELETE", path, nil, user.ID), http.StatusNoContent)
+
+	got, err := store.GetStoredFile(context.Background(), file.ID)
+	if err != nil || got == nil || got.Status != "trashed" || got.DeletedAt == nil {
+		t.Fatalf("file after delete = %+v (%v), want it in the trash", got, err)
+	}
+	for _, chunk := range file.Chunks {
+		if err := drivemanager.CheckChunkFile(context.Background(), chunk.DriveAccountID, chunk.DriveFileID, file.ID, chunk.ChunkID, chunk.Size, chunk.HeaderVersion > 0); err != nil {
+			t.Errorf("chunk %d of a trashed file: %v", chunk.ChunkID, err)
+		}
+	}
+	serve(t, FileResourceHandler, storetest.Request("GET", path, nil, user.ID), http.StatusNotFound)
+	serve(t, FileResourceHandler, storetest.Request("DELETE", path, nil, user.ID), http.StatusNotFound)
+	w := serve(t, ListStoredFilesHandler, storetest.Request("GET", "/api/files/list", nil, user.ID), http.StatusOK)
+	if strings.Contains(w.Body.String(), file.ID.Hex()) {
+		t.Error("trashed file in the file list")
+	}
+
+	w = serve(t, ListTrashHandler, storetest.Request("GET", "/api/files/trash", nil, user.ID), http.StatusOK)
+	var trash struct {
+		Files []storedFileOut `json:"files"`
+	}
+	json.NewDecoder(w.Body).Decode(&trash)
+	if len(trash.Files) != 1 || trash.Files[0].ID != file.ID || trash.Files[0].PurgeAt == nil {
+		t.Fatalf("trash = %+v, want the file with its purge time", trash.Files)
+	}
+
+	serve(t, FileResourceHandler, storetest.Request("POST", path+"/restore", nil, other.ID), http.StatusNotFound)
+	serve(t, FileResourceHandler, storetest.Request("POST", path+"/restore", nil, user.ID), http.StatusOK)
+	serve(t, FileResourceHandler, storetest.Request("POST", path+"/restore", nil, user.ID), http.StatusNotFound)
+	if got, _ := store.GetStoredFile(context.Background(), file.ID); got.Status != "active" || got.DeletedAt != nil {
+		t.Errorf("restored file is %s, deleted at %v; want it active", got.Status, got.DeletedAt)
+	}
+	serve(t, FileResourceHandler, storetest.Request("GET", path+"/download", nil, user.ID), http.StatusOK)
+}
+
+func TestSecretsSealedAtRest(t *testing.T) {
+	user := setup(t)
+	t.Setenv("TOKEN_ENC_KEY", base64.StdEncoding.EncodeToString(randomData(32)))
+	oauth.InitOAuthConfig()
+	t.Cleanup(func() { models.SetSecretCipher(nil, nil) })
+
+	data := randomData(200000)
+	file := uploadFile(t, user.ID, "sealed.bin", data)
+	raw, err := bson.Marshal(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if file.Obfuscation.Seed == "" || bytes.Contains(raw, []byte(file.Obfuscation.Seed)) {
+		t.Error("obfuscation seed stored in plain text")
+	}
+	session, _ := store.GetUploadSession(context.Background(), file.SessionID)
+	if raw, _ := bson.Marshal(session); session.KeyFilePath == "" || bytes.Contains(raw, []byte(session.KeyFilePath)) {
+		t.Error("key file path stored in plain text")
+	}
+
+	// Records written before sealing was on still read
+	models.SetSecretCipher(nil, nil)
+	var plain models.StoredFile
+	raw, _ = bson.Marshal(file)
+	oauth.InitOAuthConfig()
+	if err := bson.Unmarshal(raw, &plain); err != nil || plain.Obfuscation.Seed != file.Obfuscation.Seed {
+		t.Errorf("plain seed read back as %q (%v), want %q", plain.Obfuscation.Seed, err, file.Obfuscation.Seed)
+	}
+
+	w := serve(t, FileResourceHandler, storetest.Request("GET", "/api/files/"+file.ID.Hex()+"/download", nil, user.ID), http.StatusOK)
+	if !bytes.Equal(w.Body.Bytes(), data) {
+		t.Error("sealed file downloads differently")
+	}
+}
+
+func TestListFilesPaging(t *testing.T) {
+	user := setup(t)
+	drives := storetest.LocalDrives(t, user.ID, 0)
+	for i, name := range []string{"c.txt", "a.txt", "e.txt", "b.txt", "d.txt"} {
+		f := &models.StoredFile{UserID: user.ID, OriginalFilename: name, OriginalSize: int64(100 * (i + 1)),
+			Chunks: []models.StoredChunk{{ChunkID: 1, DriveAccountID: drives[i%2].ID}}}
+		if name == "d.txt" {
+			f.Status = "incomplete"
+		}
+		if err := store.CreateStoredFile(context.Background(), f); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// list follows next_cursor through every page and returns the names in order
+	list := func(params url.Values) []string {
+		t.Helper()
+		var names []string
+		for pages := 0; ; pages++ {
+			w := serve(t, ListStoredFilesHandler, storetest.Request("GET", "/api/files/list?"+params.Encode(), nil, user.ID), http.StatusOK)
+			var page struct {
+				Files []struct {
+					OriginalFilename string `json:"original_filename"`
+				} `json:"files"`
+				NextCursor string `json:"next_cursor"`
+			}
+			json.NewDecoder(w.Body).Decode(&page)
+			for _, f := range page.Files {
+				names = append(names, f.OriginalFilename)
+			}
+			if page.NextCursor == "" || pages > 10 {
+				return names
+			}
+			params.Set("cursor", page.NextCursor)
+		}
+	}
+
+	for _, tc := range []struct {
+		params url.Values
+		want   []string
+	}{
+		{url.Values{"sort": {"name"}, "limit": {"2"}}, []string{"a.txt", "b.txt", "c.txt", "d.txt", "e.txt"}},
+		{url.Values{"sort": {"name"}, "order": {"desc"}, "limit": {"3"}}, []string{"e.txt", "d.txt", "c.txt", "b.txt", "a.txt"}},
+		{url.Values{"sort": {"size"}, "limit": {"1"}}, []string{"d.txt", "b.txt", "e.txt", "a.txt", "c.txt"}},
+		{url.Values{"sort": {"size"}, "status": {"incomplete"}}, []string{"d.txt"}},
+		{url.Values{"sort": {"name"}, "provider": {"local"}, "status": {"active"}, "limit": {"2"}}, []string{"a.txt", "b.txt", "c.txt", "e.txt"}},
+		{url.Values{"provider": {"google"}}, nil},
+		{url.Values{"until": {"2000-01-01T00:00:00Z"}}, nil},
+	} {
+		if got := list(tc.params); !slices.Equal(got, tc.want) {
+			t.Errorf("list %s = %v, want %v", tc.params.Encode(), got, tc.want)
+		}
+	}
+
+	for _, bad := range []string{"sort=owner", "order=up", "limit=0", "status=deleted", "cursor=zzz", "since=yesterday"} {
+		serve(t, ListStoredFilesHandler, storetest.Request("GET", "/api/files/list?"+bad, nil, user.ID), http.StatusBadRequest)
+	}
+}
+
+// brokenStore fails to list files, the rest goes to the store it wraps
+type brokenStore struct{ store.Store }
+
+func (brokenStore) ListUserStoredFiles(context.Context, primitive.ObjectID, store.StoredFileQuery) ([]*models.StoredFile, error) {
+	return nil, errors.New("store unavailable")
+}
+
+func TestListFilesStoreError(t *testing.T) {
+	storetest.Setup(t)
+	fileprocessor.InitFileConfig()
+	store.Use(brokenStore{store.NewMemoryStore()})
+	user := storetest.User(t)
+
+	serve(t, ListStoredFilesHandler, storetest.Request("GET", "/api/files/list", nil, user.ID), http.StatusInternalServerError)
+}
+
+func TestSearchFiles(t *testing.T) {
+	user := setup(t)
+	drive := storetest.LocalDrives(t, user.ID, 0)[0]
+	for _, f := range []*models.StoredFile{
+		{OriginalFilename: "Report-2024.pdf", OriginalSize: 1000, Description: "Quarterly numbers"},
+		{OriginalFilename: "report-draft.txt", OriginalSize: 50},
+		{OriginalFilename: "photo.jpg", OriginalSize: 5000, Tags: []string{"holiday"}},
+		{OriginalFilename: "Annual Report.docx", OriginalSize: 200},
+	} {
+		f.UserID = user.ID
+		f.Chunks = []models.StoredChunk{{ChunkID: 1, DriveAccountID: drive.ID}}
+		if err := store.CreateStoredFile(context.Background(), f); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, tc := range []struct {
+		params string
+		want   []string
+	}{
+		{"prefix=rep", []string{"Report-2024.pdf", "report-draft.txt"}},
+		{"name=REPORT", []string{"Annual Report.docx", "Report-2024.pdf", "report-draft.txt"}},
+		{"text=quarterly", []string{"Report-2024.pdf"}},
+		{"text=holiday+numbers", []string{"Report-2024.pdf", "photo.jpg"}},
+		{"min_size=100&max_size=1000", []string{"Annual Report.docx", "Report-2024.pdf"}},
+		{"prefix=rep&max_size=100", []string{"report-draft.txt"}},
+		{"tag=holiday&min_size=6000", nil},
+	} {
+		w := serve(t, SearchFilesHandler, storetest.Request("GET", "/api/files/search?sort=name&"+tc.params, nil, user.ID), http.StatusOK)
+		var page struct {
+			Files []storedFileOut `json:"files"`
+		}
+		json.NewDecoder(w.Body).Decode(&page)
+		var names []string
+		for _, f := range page.Files {
+			names = append(names, f.OriginalFilename)
+		}
+		if !slices.Equal(names, tc.want) {
+			t.Errorf("search %s = %v, want %v", tc.params, names, tc.want)
+		}
+	}
+
+	for _, bad := range []string{"min_size=0", "max_size=big", "min_size=10&max_size=5", "sort=owner"} {
+		serve(t, SearchFilesHandler, storetest.Request("GET", "/api/files/search?"+bad, nil, user.ID), http.StatusBadRequest)
+	}
+}
+
+func TestParseByteRange(t *testing.T) {
+	for _, tc := range []struct {
+		spec          string
+		start, length int64
+		ok            bool
+	}{
+		{"bytes=0-99", 0, 100, true},
+		{"bytes=900-", 900, 100, true},
+		{"bytes=-10", 990, 10, true},
+		{"bytes=-5000", 0, 1000, true},
+		{"bytes=500-5000", 500, 500, true},
+		{"bytes=1000-", 0, 0, false},
+		{"bytes=20-10", 0, 0, false},
+		{"items=0-10", 0, 0, false},
+	} {
+		start, length, err := parseByteRange(tc.spec, 1000)
+		if (err == nil) != tc.ok || (tc.ok && (start != tc.start || length != tc.length)) {
+			t.Errorf("parseByteRange(%q, 1000) = %d, %d, %v, want %d, %d, ok %v", tc.spec, start, length, err, tc.start, tc.length, tc.ok)
+		}
+	}
+}
+
+func TestStreamedRangeDownload(t *testing.T) {
+	user := setup(t)
+	data := randomData(2<<20 + 4321)
+	file := uploadFile(t, user.ID, "video.mp4", data)
+	if len(file.Chunks) < 2 {
+		t.Fatalf("file has %d chunks, want several so ranges cross them", len(file.Chunks))
+	}
+	boundary := file.Chunks[0].EndOffset
+	size := int64(len(data))
+
+	// Ranges inside a chunk, across a chunk boundary (in obfuscated bytes, so roughly) and at both ends
+	for _, rng := range [][2]int64{{0, 0}, {10, 5000}, {boundary - 3000, boundary + 3000}, {size - 1, size - 1}, {0, size - 1}} {
+		r := storetest.Request("GET", "/api/files/"+file.ID.Hex()+"/download?mode=stream", nil, user.ID)
+		r.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", rng[0], rng[1]))
+		w := serve(t, FileResourceHandler, r, http.StatusPartialContent)
+		if !bytes.Equal(w.Body.Bytes(), data[rng[0]:rng[1]+1]) {
+			t.Errorf("streamed range %d-%d: got %d bytes that differ from the file", rng[0], rng[1], w.Body.Len())
+		}
+	}
+}
@@ -0,0 +1,237 @@
+package filehandlers
+
+import (
+	"SE/internal/fileprocessor"
+	"SE/internal/models"
+	"SE/internal/store"
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// folderOut is the listing view of a folder
+type folderOut struct {
+	Name      string     `json:"name"`
+	Path      string     `json:"path"`
+	CreatedAt *time.Time `json:"created_at,omitempty"` // set for folders the user created
+}
+
+// userFolders returns every folder of the user: those created, those files are in, and the
+// folders above them. Created folders map to their record, the others to nil.
+func userFolders(ctx context.Context, userID primitive.ObjectID) (map[string]*models.Folder, error) {
+	created, err := store.ListFolders(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	withFiles, err := store.ListFileFolders(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	folders := make(map[string]*models.Folder)
+	paths := withFiles
+	for _, f := range created {
+		folders[f.Path] = f
+		paths = append(paths, f.Path)
+	}
+	for _, p := range paths {
+		for ; p != "/"; p = path.Dir(p) {
+			if _, ok := folders[p]; !ok {
+				folders[p] = nil
+			}
+		}
+	}
+	return folders, nil
+}
+
+// subfolders returns the names of the folders directly in parent, sorted
+func subfolders(folders map[string]*models.Folder, parent string) []string {
+	names := []string{}
+	for p := range folders {
+		if strings.TrimSuffix(path.Dir(p), "/") == parent {
+			names = append(names, path.Base(p))
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// folderFromURL reads the folder path that follows /api/folders in the URL
+func folderFromURL(w http.ResponseWriter, r *http.Request) (string, bool) {
+	folder, err := fileprocessor.NormalizeFolder(strings.TrimPrefix(r.URL.Path, "/api/folders"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return "", false
+	}
+	if folder == "" {
+		http.Error(w, "folder path required", http.StatusBadRequest)
+		return "", false
+	}
+	return folder, true
+}
+
+// ListFoldersHandler - GET /api/folders
+func ListFoldersHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("userID").(primitive.ObjectID)
+
+	folders, err := userFolders(r.Context(), userID)
+	if err != nil {
+		log.Printf("Failed to list folders: %v", err)
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+
+	out := make([]folderOut, 0, len(folders))
+	for p, f := range folders {
+		o := folderOut{Name: path.Base(p), Path: p}
+		if f != nil {
+			o.CreatedAt = &f.CreatedAt
+		}
+		out = append(out, o)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Path < out[j].Path })
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"folders": out})
+}
+
+// CreateFolderHandler - POST /api/folders/{path}
+// Folders above it need not exist; they show up in listings like any other parent.
+func CreateFolderHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("userID").(primitive.ObjectID)
+	folderPath, ok := folderFromURL(w, r)
+	if !ok {
+		return
+	}
+	for _, name := range strings.Split(folderPath[1:], "/") {
+		if _, err := cleanName("folder name", name); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	folder, created, err := store.CreateFolder(r.Context(), userID, folderPath)
+	if err != nil {
+		log.Printf("Failed to create folder: %v", err)
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+	if !created {
+		http.Error(w, "folder already exists", http.StatusConflict)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(folderOut{Name: path.Base(folder.Path), Path: folder.Path, CreatedAt: &folder.CreatedAt})
+}
+
+// UpdateFolderHandler - PATCH /api/folders/{path}
+// Renames the folder with "name" and/or moves it under "parent" ("" or "/" for the root). Its
+// subfolders and files go with it.
+func UpdateFolderHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("userID").(primitive.ObjectID)
+	from, ok := folderFromURL(w, r)
+	if !ok {
+		return
+	}
+
+	var req struct {
+		Name   *string `json:"name"`
+		Parent *string `json:"parent"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+	name, parent := path.Base(from), strings.TrimSuffix(path.Dir(from), "/")
+	if req.Name != nil {
+		n, err := cleanName("folder name", *req.Name)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		name = n
+	}
+	if req.Parent != nil {
+		p, err := fileprocessor.NormalizeFolder(*req.Parent)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		parent = p
+	}
+	to := models.FilePath(parent, name)
+	if to != from && strings.HasPrefix(to, from+"/") {
+		http.Error(w, "folder can't be moved into itself", http.StatusBadRequest)
+		return
+	}
+
+	folders, err := userFolders(r.Context(), userID)
+	if err != nil {
+		log.Printf("Failed to list folders: %v", err)
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+	if _, ok := folders[from]; !ok {
+		http.Error(w, "folder not found", http.StatusNotFound)
+		return
+	}
+	var moved int64
+	if to != from {
+		if _, ok := folders[to]; ok {
+			http.Error(w, "a folder already exists at "+to, http.StatusConflict)
+			return
+		}
+		moved, err = store.MoveFolder(r.Context(), userID, from, to)
+		if err != nil {
+			log.Printf("Failed to move folder %s: %v", from, err)
+			http.Error(w, "server error", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"path":        to,
+		"files_moved": moved,
+	})
+}
+
+// DeleteFolderHandler - DELETE /api/folders/{path}
+// Only an empty folder can be deleted; its empty subfolders go with it.
+func DeleteFolderHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("userID").(primitive.ObjectID)
+	folderPath, ok := folderFromURL(w, r)
+	if !ok {
+		return
+	}
+
+	files, err := store.ListUserStoredFiles(r.Context(), userID, store.StoredFileQuery{Folder: folderPath, Limit: 1})
+	if err != nil {
+		log.Printf("Failed to list stored files: %v", err)
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+	if len(files) > 0 {
+		http.Error(w, "folder is not empty", http.StatusConflict)
+		return
+	}
+	deleted, err := store.DeleteFolder(r.Context(), userID, folderPath)
+	if err != nil {
+		log.Printf("Failed to delete folder %s: %v", folderPath, err)
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+	if !deleted {
+		http.Error(w, "folder not found", http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
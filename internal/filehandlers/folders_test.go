@@ -0,0 +1,105 @@
+package filehandlers
+
+import (
+	"SE/internal/models"
+	"SE/internal/store"
+	"SE/internal/store/storetest"
+	"context"
+	"encoding/json"
+	"net/http"
+	"slices"
+	"testing"
+)
+
+func TestFolders(t *testing.T) {
+	user := setup(t)
+	ctx := context.Background()
+	drive := storetest.LocalDrives(t, user.ID, 0)[0]
+	files := map[string]*models.StoredFile{}
+	for _, p := range [][2]string{{"/docs", "a.txt"}, {"/docs/sub", "b.txt"}, {"/other", "c.txt"}} {
+		f := &models.StoredFile{UserID: user.ID, OriginalFilename: p[1], Folder: p[0], Path: models.FilePath(p[0], p[1]),
+			Chunks: []models.StoredChunk{{ChunkID: 1, DriveAccountID: drive.ID}}}
+		if err := store.CreateStoredFile(ctx, f); err != nil {
+			t.Fatal(err)
+		}
+		files[p[1]] = f
+	}
+
+	serve(t, CreateFolderHandler, storetest.Request("POST", "/api/folders/docs/empty", nil, user.ID), http.StatusCreated)
+	serve(t, CreateFolderHandler, storetest.Request("POST", "/api/folders/docs/empty/", nil, user.ID), http.StatusConflict)
+	serve(t, CreateFolderHandler, storetest.Request("POST", "/api/folders/", nil, user.ID), http.StatusBadRequest)
+
+	paths := func() []string {
+		t.Helper()
+		w := serve(t, ListFoldersHandler, storetest.Request("GET", "/api/folders", nil, user.ID), http.StatusOK)
+		var resp struct {
+			Folders []folderOut `json:"folders"`
+		}
+		json.NewDecoder(w.Body).Decode(&resp)
+		var out []string
+		for _, f := range resp.Folders {
+			out = append(out, f.Path)
+		}
+		return out
+	}
+	if got, want := paths(), []string{"/docs", "/docs/empty", "/docs/sub", "/other"}; !slices.Equal(got, want) {
+		t.Errorf("folders = %v, want %v", got, want)
+	}
+
+	// One level of /docs: its own file and both subfolders
+	w := serve(t, ListStoredFilesHandler, storetest.Request("GET", "/api/files/list?folder=/docs&recursive=false", nil, user.ID), http.StatusOK)
+	var level struct {
+		Files   []storedFileOut `json:"files"`
+		Folders []string        `json:"folders"`
+	}
+	json.NewDecoder(w.Body).Decode(&level)
+	if len(level.Files) != 1 || level.Files[0].OriginalFilename != "a.txt" || !slices.Equal(level.Folders, []string{"empty", "sub"}) {
+		t.Errorf("/docs lists %+v and folders %v, want a.txt and [empty sub]", level.Files, level.Folders)
+	}
+	w = serve(t, ListStoredFilesHandler, storetest.Request("GET", "/api/files/list?view=tree", nil, user.ID), http.StatusOK)
+	var tree struct {
+		Tree folderNode `json:"tree"`
+	}
+	json.NewDecoder(w.Body).Decode(&tree)
+	if docs := tree.Tree.Folders[0]; docs.Path != "/docs" || len(docs.Folders) != 2 || docs.Folders[0].Path != "/docs/empty" {
+		t.Errorf("tree has %+v first, want /docs with the empty folder in it", docs)
+	}
+
+	// Renaming moves the subfolders and files along
+	w = serve(t, UpdateFolderHandler, storetest.Request("PATCH", "/api/folders/docs", jsonBody(t, map[string]any{"name": "papers"}), user.ID), http.StatusOK)
+	var moved struct {
+		Path       string `json:"path"`
+		FilesMoved int    `json:"files_moved"`
+	}
+	json.NewDecoder(w.Body).Decode(&moved)
+	if moved.Path != "/papers" || moved.FilesMoved != 2 {
+		t.Errorf("rename = %+v, want /papers with 2 files moved", moved)
+	}
+	if got, _ := store.GetStoredFile(ctx, files["b.txt"].ID); got.Folder != "/papers/sub" || got.Path != "/papers/sub/b.txt" {
+		t.Errorf("b.txt is in %q at %q, want /papers/sub", got.Folder, got.Path)
+	}
+	if got, want := paths(), []string{"/other", "/papers", "/papers/empty", "/papers/sub"}; !slices.Equal(got, want) {
+		t.Errorf("folders after rename = %v, want %v", got, want)
+	}
+	serve(t, UpdateFolderHandler, storetest.Request("PATCH", "/api/folders/papers", jsonBody(t, map[string]any{"parent": "/papers/sub"}), user.ID), http.StatusBadRequest)
+	serve(t, UpdateFolderHandler, storetest.Request("PATCH", "/api/folders/papers", jsonBody(t, map[string]any{"name": "other"}), user.ID), http.StatusConflict)
+	serve(t, UpdateFolderHandler, storetest.Request("PATCH", "/api/folders/docs", jsonBody(t, map[string]any{"name": "x"}), user.ID), http.StatusNotFound)
+
+	// A file moves on its own with PATCH /api/files/:id
+	serve(t, FileResourceHandler, storetest.Request("PATCH", "/api/files/"+files["c.txt"].ID.Hex(), jsonBody(t, map[string]any{"folder": "papers/empty"}), user.ID), http.StatusOK)
+	if got, _ := store.GetStoredFile(ctx, files["c.txt"].ID); got.Path != "/papers/empty/c.txt" {
+		t.Errorf("c.txt at %q, want /papers/empty/c.txt", got.Path)
+	}
+
+	serve(t, DeleteFolderHandler, storetest.Request("DELETE", "/api/folders/papers/empty", nil, user.ID), http.StatusConflict)
+	serve(t, FileResourceHandler, storetest.Request("PATCH", "/api/files/"+files["c.txt"].ID.Hex(), jsonBody(t, map[string]any{"folder": ""}), user.ID), http.StatusOK)
+	serve(t, DeleteFolderHandler, storetest.Request("DELETE", "/api/folders/papers/empty", nil, user.ID), http.StatusNoContent)
+	serve(t, DeleteFolderHandler, storetest.Request("DELETE", "/api/folders/papers/empty", nil, user.ID), http.StatusNotFound)
+	if got, want := paths(), []string{"/papers", "/papers/sub"}; !slices.Equal(got, want) {
+		t.Errorf("folders after delete = %v, want %v", got, want)
+	}
+
+	// Another user has none of them
+	other := storetest.User(t)
+	serve(t, UpdateFolderHandler, storetest.Request("PATCH", "/api/folders/papers", jsonBody(t, map[string]any{"name": "mine"}), other.ID), http.StatusNotFound)
+}
@@ -0,0 +1,140 @@
+package filehandlers
+
+import (
+	"SE/internal/fileprocessor"
+	"SE/internal/jobs"
+	"SE/internal/middleware"
+	"SE/internal/models"
+	"SE/internal/store"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// UploadFromURLHandler - POST /api/files/upload/from-url
+// The server fetches the file into a new upload session and processes it like a finalized upload
+func UploadFromURLHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("userID").(primitive.ObjectID)
+
+	var req struct {
+		URL      string `json:"url"`
+		Filename string `json:"filename,omitempty"` // defaults to the name the remote server gives the file
+		Folder   string `json:"folder,omitempty"`   // defaults to the user's default folder
+		models.ProcessRequest
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid request", http.StatusBadRequest)
+		return
+	}
+	if req.URL == "" {
+		http.Error(w, "url is required", http.StatusBadRequest)
+		return
+	}
+	if strings.ContainsAny(req.Filename, `/\`) || req.Filename == "." || req.Filename == ".." {
+		http.Error(w, "filename must not contain a path, use folder", http.StatusBadRequest)
+		return
+	}
+
+	if req.Folder == "" {
+		prefs, err := store.GetUserPreferences(r.Context(), userID)
+		if err != nil {
+			http.Error(w, "server error", http.StatusInternalServerError)
+			return
+		}
+		req.Folder = prefs.DefaultFolder
+	}
+	folder, err := fileprocessor.NormalizeFolder(req.Folder)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Settled now, so processing uses them once the fetch is done
+	processReq := req.ProcessRequest
+	processReq.BatchID = ""
+	if processReq.PlanID != "" {
+		http.Error(w, "plan_id can't be used for an upload from a url", http.StatusBadRequest)
+		return
+	}
+	if err := applyPreferences(r.Context(), userID, &processReq); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	remote, err := fileprocessor.OpenRemoteFile(req.URL)
+	if errors.Is(err, fileprocessor.ErrRemoteRejected) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to fetch %s: %v", req.URL, err)
+		http.Error(w, "failed to fetch url", http.StatusBadGateway)
+		return
+	}
+
+	filename := req.Filename
+	if filename == "" {
+		filename = remote.Filename
+	}
+	if filename == "" {
+		filename = "download"
+	}
+
+	client := middleware.ClientInfo(r)
+	session, err := fileprocessor.CreateURLUploadSession(r.Context(), userID, filename, folder, remote, &client)
+	if err != nil {
+		remote.Close()
+		if errors.Is(err, fileprocessor.ErrQuotaExceeded) {
+			http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+			return
+		}
+		log.Printf("Failed to create upload session: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	processReq.SessionID = session.ID.Hex()
+
+	go fetchAndProcess(session, remote, processReq)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"session_id":   session.ID.Hex(),
+		"path":         models.FilePath(session.Folder, session.OriginalFilename),
+		"size":         remote.Size,
+		"content_type": remote.ContentType,
+		"status_url":   fmt.Sprintf("/api/files/upload/status/%s", session.ID.Hex()),
+	})
+}
+
+// fetchAndProcess fills the session from the remote file, then queues it for processing
+func fetchAndProcess(session *models.UploadSession, remote *fileprocessor.RemoteFile, req models.ProcessRequest) {
+	ctx := context.Background()
+	defer remote.Close()
+
+	log.Printf("Fetching %s into session %s (%d bytes)", remote.URL, session.ID.Hex(), remote.Size)
+	if err := fileprocessor.FetchRemoteFile(ctx, session, remote); err != nil {
+		log.Printf("Fetch for session %s failed: %v", session.ID.Hex(), err)
+		os.Remove(session.TempFilePath)
+		fileprocessor.FailSession(ctx, session, 0, fmt.Sprintf("Fetch failed: %v", err))
+		return
+	}
+
+	if err := fileprocessor.UpdateSessionStatus(ctx, session.ID, "processing", 0, "Starting..."); err != nil {
+		log.Printf("Failed to update status to processing: %v", err)
+		return
+	}
+	if err := jobs.Enqueue(ctx, session.ID, session.UserID, session.TotalSize, req); err != nil {
+		log.Printf("Failed to enqueue processing job: %v", err)
+		fileprocessor.UpdateSessionStatus(ctx, session.ID, "failed", 0, "Failed to queue processing")
+		return
+	}
+	log.Printf("Queued processing job for fetched session %s", session.ID.Hex())
+}
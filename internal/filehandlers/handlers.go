@@ -1,31 +1,49 @@
 package filehandlers
 
 import (
+	"SE/internal/audit"
 	"SE/internal/drivemanager"
 	"SE/internal/fileprocessor"
+	"SE/internal/jobs"
+	"SE/internal/middleware"
 	"SE/internal/models"
 	"SE/internal/store"
 	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"hash/crc32"
 	"io"
 	"log"
 	"net/http"
 	"os"
 	"path/filepath"
+	"sort"
 	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
+// sessionMeters holds the transfer meter of every session currently uploading to drives
+var sessionMeters sync.Map // session ID hex -> *drivemanager.TransferMeter
+
 // InitiateUploadHandler - POST /api/files/upload/initiate
 func InitiateUploadHandler(w http.ResponseWriter, r *http.Request) {
 	userID := r.Context().Value("userID").(primitive.ObjectID)
 
 	// Parse request
 	var req struct {
-		Filename string `json:"filename"`
-		FileSize int64  `json:"file_size"`
+		Filename string             `json:"filename"`
+		FileSize int64              `json:"file_size"`
+		Folder   string             `json:"folder,omitempty"` // defaults to the user's default folder
+		Path     string             `json:"path,omitempty"`   // relative path inside folder, e.g. "2024/a.jpg", instead of filename
+		Files    []batchFileRequest `json:"files,omitempty"`  // several files as one batch, instead of filename and file_size
 	}
 
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
@@ -33,14 +51,52 @@ func InitiateUploadHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if req.Filename == "" || req.FileSize <= 0 {
+	// Subdirectories of the path go below the folder
+	subfolder := ""
+	if req.Path != "" {
+		var err error
+		if subfolder, req.Filename, err = splitRelativePath(req.Path); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	if len(req.Files) == 0 && (req.Filename == "" || req.FileSize <= 0) {
 		http.Error(w, "filename and file_size are required", http.StatusBadRequest)
 		return
 	}
 
+	if req.Folder == "" {
+		prefs, err := store.GetUserPreferences(r.Context(), userID)
+		if err != nil {
+			http.Error(w, "server error", http.StatusInternalServerError)
+			return
+		}
+		req.Folder = prefs.DefaultFolder
+	}
+	if len(req.Files) > 0 {
+		folder, err := fileprocessor.NormalizeFolder(req.Folder)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		initiateBatch(w, r, userID, req.Files, folder)
+		return
+	}
+	folder, err := fileprocessor.NormalizeFolder(req.Folder + "/" + subfolder)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
 	// Create upload session
-	session, err := fileprocessor.CreateUploadSession(r.Context(), userID, req.Filename, req.FileSize)
+	client := middleware.ClientInfo(r)
+	session, err := fileprocessor.CreateUploadSession(r.Context(), userID, req.Filename, folder, req.FileSize, &client)
 	if err != nil {
+		if errors.Is(err, fileprocessor.ErrQuotaExceeded) {
+			http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+			return
+		}
 		log.Printf("Failed to create upload session: %v", err)
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -57,6 +113,7 @@ func InitiateUploadHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]interface{}{
 		"session_id":    session.ID.Hex(),
+		"path":          models.FilePath(session.Folder, session.OriginalFilename),
 		"upload_url":    fmt.Sprintf("/api/files/upload/chunk?session_id=%s", session.ID.Hex()),
 		"drive_spaces":  driveSpaces,
 		"max_file_size": fileprocessor.GetMaxFileSize(),
@@ -81,7 +138,7 @@ func UploadChunkHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Get session
-	session, err := fileprocessor.GetSession(r.Context(), sessionID, userID)
+	session, err := fileprocessor.GetChunkSession(r.Context(), sessionID, userID)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
@@ -103,9 +160,140 @@ func UploadChunkHandler(w http.ResponseWriter, r *http.Request) {
 	// Get chunk offset
 	offsetStr := r.FormValue("offset")
 	offset, _ := strconv.ParseInt(offsetStr, 10, 64)
+	if offset < 0 || offset >= session.TotalSize {
+		http.Error(w, "offset out of range", http.StatusBadRequest)
+		return
+	}
+
+	// Optional client checksum of the chunk, verified before it is written
+	expectSHA256 := strings.ToLower(r.FormValue("sha256"))
+	expectCRC32C := strings.ToLower(r.FormValue("crc32c"))
+
+	writeChunk(w, r, session, offset, -1, file, expectSHA256, expectCRC32C)
+}
+
+// UploadChunkRawHandler - PUT /api/files/upload/chunk
+// Takes the chunk as the raw request body, placed by a Content-Range header, and streams it
+// straight to the temp file without multipart parsing
+func UploadChunkRawHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("userID").(primitive.ObjectID)
+
+	sessionID, err := primitive.ObjectIDFromHex(r.URL.Query().Get("session_id"))
+	if err != nil {
+		http.Error(w, "invalid session_id", http.StatusBadRequest)
+		return
+	}
+
+	session, err := fileprocessor.GetChunkSession(r.Context(), sessionID, userID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Content-Range: bytes <start>-<end>/<total or *>, end inclusive
+	start, end, total, ok := parseContentRange(r.Header.Get("Content-Range"))
+	if !ok {
+		http.Error(w, "valid Content-Range required", http.StatusBadRequest)
+		return
+	}
+	if start >= session.TotalSize || end >= session.TotalSize {
+		http.Error(w, "offset out of range", http.StatusRequestedRangeNotSatisfiable)
+		return
+	}
+	if total >= 0 && total != session.TotalSize {
+		http.Error(w, "content range total does not match session", http.StatusBadRequest)
+		return
+	}
+	length := end - start + 1
+	if r.ContentLength >= 0 && r.ContentLength != length {
+		http.Error(w, "Content-Length does not match Content-Range", http.StatusBadRequest)
+		return
+	}
+
+	expectSHA256 := strings.ToLower(r.Header.Get("X-Chunk-SHA256"))
+	expectCRC32C := strings.ToLower(r.Header.Get("X-Chunk-CRC32C"))
+
+	writeChunk(w, r, session, start, length, io.LimitReader(r.Body, length), expectSHA256, expectCRC32C)
+}
+
+// parseContentRange parses "bytes start-end/total". total is -1 when given as "*".
+func parseContentRange(header string) (start, end, total int64, ok bool) {
+	spec, found := strings.CutPrefix(header, "bytes ")
+	if !found {
+		return 0, 0, 0, false
+	}
+	rng, size, found := strings.Cut(spec, "/")
+	if !found {
+		return 0, 0, 0, false
+	}
+	first, last, found := strings.Cut(rng, "-")
+	if !found {
+		return 0, 0, 0, false
+	}
+	start, err1 := strconv.ParseInt(first, 10, 64)
+	end, err2 := strconv.ParseInt(last, 10, 64)
+	if err1 != nil || err2 != nil || start < 0 || end < start {
+		return 0, 0, 0, false
+	}
+	total = -1
+	if size != "*" {
+		var err error
+		if total, err = strconv.ParseInt(size, 10, 64); err != nil || total <= end {
+			return 0, 0, 0, false
+		}
+	}
+	return start, end, total, true
+}
+
+// writeChunk verifies body against any client checksum, copies it into the session's temp
+// file at offset and records the received range. A non-negative length is the exact number
+// of bytes the client promised; a shorter body is rejected.
+func writeChunk(w http.ResponseWriter, r *http.Request, session *models.UploadSession, offset, length int64, body io.Reader, expectSHA256, expectCRC32C string) {
+	if session.SourceURL != "" {
+		http.Error(w, "session is being fetched from a url", http.StatusConflict)
+		return
+	}
+
+	// A chunk with a checksum is staged and only written in place once it matches, so a bad
+	// resend can't overwrite a range that was received intact
+	if expectSHA256 != "" || expectCRC32C != "" {
+		scratch, err := os.CreateTemp(filepath.Dir(session.TempFilePath), filepath.Base(session.TempFilePath)+".chunk-*")
+		if err != nil {
+			http.Error(w, "failed to stage chunk", http.StatusInternalServerError)
+			return
+		}
+		defer os.Remove(scratch.Name())
+		defer scratch.Close()
+
+		ok, err := verifyChunk(io.TeeReader(body, scratch), expectSHA256, expectCRC32C)
+		if err != nil {
+			http.Error(w, "failed to verify chunk", http.StatusInternalServerError)
+			return
+		}
+		staged, err := scratch.Seek(0, io.SeekCurrent)
+		if err != nil {
+			http.Error(w, "failed to stage chunk", http.StatusInternalServerError)
+			return
+		}
+		if length >= 0 && staged != length {
+			http.Error(w, "request body shorter than Content-Range", http.StatusBadRequest)
+			return
+		}
+		if !ok {
+			// The range is left as it was, so the client can simply send the chunk again
+			log.Printf("Checksum mismatch for session %s at offset %d", session.ID.Hex(), offset)
+			http.Error(w, "chunk checksum mismatch, resend the chunk", http.StatusUnprocessableEntity)
+			return
+		}
+		if _, err := scratch.Seek(0, io.SeekStart); err != nil {
+			http.Error(w, "failed to stage chunk", http.StatusInternalServerError)
+			return
+		}
+		body = scratch
+	}
 
 	// Open or create temp file
-	tempFile, err := os.OpenFile(session.TempFilePath, os.O_CREATE|os.O_WRONLY, 0644)
+	tempFile, err := os.OpenFile(session.TempFilePath, os.O_CREATE|os.O_RDWR, 0644)
 	if err != nil {
 		http.Error(w, "failed to create temp file", http.StatusInternalServerError)
 		return
@@ -119,23 +307,22 @@ func UploadChunkHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Copy chunk data
-	written, err := io.Copy(tempFile, file)
+	written, err := io.Copy(tempFile, body)
 	if err != nil {
 		http.Error(w, "failed to write chunk", http.StatusInternalServerError)
 		return
 	}
+	if length >= 0 && written != length {
+		http.Error(w, "request body shorter than Content-Range", http.StatusBadRequest)
+		return
+	}
 
-	// Calculate progress based on highest offset reached
-	// offset is where chunk starts, written is how many bytes were written
-	highestByte := offset + written
-
-	// Only update if this chunk extends beyond current progress
-	// This handles out-of-order uploads correctly
-	if highestByte > session.UploadedSize {
-		if err := fileprocessor.UpdateSessionProgress(r.Context(), sessionID, highestByte); err != nil {
-			log.Printf("Failed to update session progress: %v", err)
-		}
-		session.UploadedSize = highestByte // Update local copy for response
+	// Record the received range; bytes past the declared size are not part of the file
+	session, err = fileprocessor.RecordReceivedRange(r.Context(), session.ID, offset, min(offset+written, session.TotalSize))
+	if err != nil {
+		log.Printf("Failed to record received range: %v", err)
+		http.Error(w, "failed to record chunk", http.StatusInternalServerError)
+		return
 	}
 
 	w.Header().Set("Content-Type", "application/json")
@@ -157,6 +344,15 @@ func FinalizeUploadHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if req.BatchID != "" {
+		if req.PlanID != "" {
+			http.Error(w, "plan_id applies to a single session", http.StatusBadRequest)
+			return
+		}
+		finalizeBatch(w, r, userID, req)
+		return
+	}
+
 	sessionID, err := primitive.ObjectIDFromHex(req.SessionID)
 	if err != nil {
 		http.Error(w, "invalid session_id", http.StatusBadRequest)
@@ -170,9 +366,44 @@ func FinalizeUploadHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Check upload is complete
-	if session.UploadedSize != session.TotalSize {
-		http.Error(w, fmt.Sprintf("upload incomplete: %d/%d bytes", session.UploadedSize, session.TotalSize), http.StatusBadRequest)
+	// Sessions fetched from a URL are finalized by the server once the fetch is done
+	if session.SourceURL != "" {
+		http.Error(w, "session is being fetched from a url", http.StatusConflict)
+		return
+	}
+	// The uploaded file of an infected session is gone
+	if session.Status == "infected" {
+		http.Error(w, "session was rejected as infected", http.StatusConflict)
+		return
+	}
+
+	// Check every byte was received, not just the last one
+	if missing := fileprocessor.MissingRanges(session.ReceivedRanges, session.TotalSize); len(missing) > 0 {
+		http.Error(w, fmt.Sprintf("upload incomplete: %d/%d bytes, %d missing ranges", session.UploadedSize, session.TotalSize, len(missing)), http.StatusBadRequest)
+		return
+	}
+
+	// An accepted preview fixes the plan's settings
+	if req.PlanID != "" {
+		if err := acceptPlanPreview(session, &req); err != nil {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+	}
+
+	// Fill in what the request left out from the user's preferences, so a resumed job uses the same settings
+	if err := applyPreferences(r.Context(), userID, &req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// The quota may have been lowered or filled by other uploads since initiate
+	if err := fileprocessor.CheckQuota(r.Context(), userID, 0); err != nil {
+		if errors.Is(err, fileprocessor.ErrQuotaExceeded) {
+			http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+			return
+		}
+		http.Error(w, "server error", http.StatusInternalServerError)
 		return
 	}
 
@@ -185,10 +416,14 @@ func FinalizeUploadHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	log.Printf("Starting background processing goroutine for session %s", sessionID.Hex())
-
-	// Process file asynchronously
-	go processAndUploadFile(context.Background(), session, req.Strategy, req.ManualChunkSizes, userID)
+	// Queue processing; the job survives server restarts
+	if err := jobs.Enqueue(r.Context(), sessionID, userID, session.TotalSize, req); err != nil {
+		log.Printf("Failed to enqueue processing job: %v", err)
+		fileprocessor.UpdateSessionStatus(r.Context(), sessionID, "failed", 0, "Failed to queue processing")
+		http.Error(w, "failed to queue processing", http.StatusInternalServerError)
+		return
+	}
+	log.Printf("Queued processing job for session %s", sessionID.Hex())
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]interface{}{
@@ -200,6 +435,22 @@ func FinalizeUploadHandler(w http.ResponseWriter, r *http.Request) {
 	log.Printf("Finalize response sent for session %s", sessionID.Hex())
 }
 
+// verifyChunk compares the chunk read back from disk with the checksums the client sent (hex, empty to skip)
+func verifyChunk(r io.Reader, wantSHA256, wantCRC32C string) (bool, error) {
+	sha := sha256.New()
+	crc := crc32.New(crc32.MakeTable(crc32.Castagnoli))
+	if _, err := io.Copy(io.MultiWriter(sha, crc), r); err != nil {
+		return false, err
+	}
+	if wantSHA256 != "" && hex.EncodeToString(sha.Sum(nil)) != wantSHA256 {
+		return false, nil
+	}
+	if wantCRC32C != "" && fmt.Sprintf("%08x", crc.Sum32()) != wantCRC32C {
+		return false, nil
+	}
+	return true, nil
+}
+
 // GetUploadStatusHandler - GET /api/files/upload/status/:id
 func GetUploadStatusHandler(w http.ResponseWriter, r *http.Request) {
 	userID := r.Context().Value("userID").(primitive.ObjectID)
@@ -229,14 +480,28 @@ func GetUploadStatusHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Byte ranges still to be uploaded, only meaningful while uploading
+	missing := []models.ByteRange{}
+	if session.Status == "uploading" {
+		missing = fileprocessor.MissingRanges(session.ReceivedRanges, session.TotalSize)
+	}
+
+	// Current drive transfer rate, 0 when not transferring
+	var throughput float64
+	if m, ok := sessionMeters.Load(sessionID.Hex()); ok {
+		throughput = m.(*drivemanager.TransferMeter).Rate()
+	}
+
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]interface{}{
-		"status":              session.Status,
-		"uploaded_size":       session.UploadedSize,
-		"total_size":          session.TotalSize,
-		"processing_progress": session.ProcessingProgress,
-		"error_message":       session.ErrorMessage,
-		"completed_at":        session.CompletedAt,
+		"status":                   session.Status,
+		"uploaded_size":            session.UploadedSize,
+		"total_size":               session.TotalSize,
+		"missing_ranges":           missing,
+		"processing_progress":      session.ProcessingProgress,
+		"error_message":            session.ErrorMessage,
+		"completed_at":             session.CompletedAt,
+		"throughput_bytes_per_sec": throughput,
 	})
 }
 
@@ -262,6 +527,11 @@ func CalculateChunkingHandler(w http.ResponseWriter, r *http.Request) {
 		FileSize         int64                   `json:"file_size"`
 		Strategy         models.ChunkingStrategy `json:"strategy"`
 		ManualChunkSizes []int64                 `json:"manual_chunk_sizes,omitempty"`
+		Erasure          *models.ErasureConfig   `json:"erasure,omitempty"`
+		// With a session, the plan covers its obfuscated file and is kept for finalize
+		SessionID              string  `json:"session_id,omitempty"`
+		ObfuscationProfile     string  `json:"obfuscation_profile,omitempty"`
+		ObfuscationOverheadPct float64 `json:"obfuscation_overhead_pct,omitempty"`
 	}
 
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
@@ -269,6 +539,40 @@ func CalculateChunkingHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	var session *models.UploadSession
+	if req.SessionID != "" {
+		sessionID, err := primitive.ObjectIDFromHex(req.SessionID)
+		if err != nil {
+			http.Error(w, "invalid session_id", http.StatusBadRequest)
+			return
+		}
+		session, err = fileprocessor.GetSession(r.Context(), sessionID, userID)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if session.Status != "uploading" {
+			http.Error(w, "session is already "+session.Status, http.StatusConflict)
+			return
+		}
+	}
+
+	// The same defaults finalize applies
+	settings := models.ProcessRequest{
+		Strategy:               req.Strategy,
+		ObfuscationProfile:     req.ObfuscationProfile,
+		ObfuscationOverheadPct: req.ObfuscationOverheadPct,
+	}
+	if err := applyPreferences(r.Context(), userID, &settings); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	req.Strategy = settings.Strategy
+	size := req.FileSize
+	if session != nil {
+		size = fileprocessor.ObfuscatedSize(session.TotalSize, settings.ObfuscationProfile, settings.ObfuscationOverheadPct)
+	}
+
 	// Get drive spaces
 	driveSpaces, err := drivemanager.GetUserDriveSpaces(r.Context(), userID)
 	if err != nil {
@@ -276,22 +580,171 @@ func CalculateChunkingHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	policy, err := store.GetUserPlacementPolicy(r.Context(), userID)
+	if err != nil {
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+
 	// Calculate chunking plan
-	plan, err := fileprocessor.CalculateChunkPlan(req.FileSize, driveSpaces, req.Strategy, req.ManualChunkSizes)
+	plan, err := fileprocessor.CalculateChunkPlan(size, driveSpaces, req.Strategy, req.ManualChunkSizes, req.Erasure, policy)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]interface{}{
+	out := map[string]interface{}{
 		"plan":       plan,
 		"num_chunks": len(plan),
-	})
+	}
+	if session != nil {
+		// Only the latest preview of a session can be accepted
+		preview := &models.PlanPreview{
+			ID:                     primitive.NewObjectID(),
+			Strategy:               req.Strategy,
+			ManualChunkSizes:       req.ManualChunkSizes,
+			Erasure:                req.Erasure,
+			ObfuscationProfile:     settings.ObfuscationProfile,
+			ProcessedSize:          size,
+			Plan:                   plan,
+			CreatedAt:              time.Now(),
+			ObfuscationOverheadPct: settings.ObfuscationOverheadPct,
+		}
+		if err := store.SetSessionPlanPreview(r.Context(), session.ID, preview); err != nil {
+			log.Printf("Failed to save plan preview for session %s: %v", session.ID.Hex(), err)
+			http.Error(w, "server error", http.StatusInternalServerError)
+			return
+		}
+		out["plan_id"] = preview.ID.Hex()
+		out["processed_size"] = size
+		out["strategy"] = req.Strategy
+		out["obfuscation_profile"] = settings.ObfuscationProfile
+		out["obfuscation_overhead_pct"] = settings.ObfuscationOverheadPct
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(out)
+}
+
+// acceptPlanPreview checks a finalize request's plan_id against the session's latest preview
+// and takes the settings the plan was made with
+func acceptPlanPreview(session *models.UploadSession, req *models.ProcessRequest) error {
+	preview := session.PlanPreview
+	if preview == nil || preview.ID.Hex() != req.PlanID {
+		return errors.New("plan_id is not the latest plan previewed for this session")
+	}
+	if req.Strategy != "" && req.Strategy != preview.Strategy {
+		return fmt.Errorf("strategy %q differs from the previewed plan's %q", req.Strategy, preview.Strategy)
+	}
+	if req.ObfuscationProfile != "" && req.ObfuscationProfile != preview.ObfuscationProfile {
+		return fmt.Errorf("obfuscation_profile %q differs from the previewed plan's %q", req.ObfuscationProfile, preview.ObfuscationProfile)
+	}
+	if req.ObfuscationOverheadPct != 0 && req.ObfuscationOverheadPct != preview.ObfuscationOverheadPct {
+		return fmt.Errorf("obfuscation_overhead_pct %g differs from the previewed plan's %g", req.ObfuscationOverheadPct, preview.ObfuscationOverheadPct)
+	}
+	req.Strategy = preview.Strategy
+	req.ManualChunkSizes = preview.ManualChunkSizes
+	req.Erasure = preview.Erasure
+	req.ObfuscationProfile = preview.ObfuscationProfile
+	req.ObfuscationOverheadPct = preview.ObfuscationOverheadPct
+	return nil
+}
+
+// applyPreferences fills the fields a finalize request left empty from the user's preferences
+func applyPreferences(ctx context.Context, userID primitive.ObjectID, req *models.ProcessRequest) error {
+	prefs, err := store.GetUserPreferences(ctx, userID)
+	if err != nil {
+		return err
+	}
+	if req.Strategy == "" {
+		req.Strategy = prefs.ChunkingStrategy
+	}
+	if req.ObfuscationProfile == "" {
+		req.ObfuscationProfile = prefs.ObfuscationProfile
+	}
+	if req.ObfuscationProfile == "" {
+		req.ObfuscationProfile = fileprocessor.DefaultObfuscationProfile
+	}
+	if !fileprocessor.ValidObfuscationProfile(req.ObfuscationProfile) {
+		return errors.New("invalid obfuscation_profile")
+	}
+	if req.ObfuscationOverheadPct == 0 {
+		req.ObfuscationOverheadPct = prefs.ObfuscationOverheadPct
+	}
+	if req.ObfuscationOverheadPct == 0 {
+		req.ObfuscationOverheadPct = fileprocessor.DefaultObfuscationOverheadPct()
+	}
+	if !fileprocessor.ValidObfuscationOverhead(req.ObfuscationOverheadPct) {
+		return errors.New("invalid obfuscation_overhead_pct")
+	}
+	if req.ParallelUploads == 0 {
+		req.ParallelUploads = prefs.ParallelUploads
+	}
+	if req.ParallelUploads < 0 {
+		return errors.New("parallel_uploads must not be negative")
+	}
+	return nil
+}
+
+// ProcessJob runs the processing pipeline for a queued job. It is safe to run again for a
+// job that was interrupted: a session that already completed is left alone.
+func ProcessJob(ctx context.Context, job *models.ProcessingJob) error {
+	session, err := store.GetUploadSession(ctx, job.SessionID)
+	if err != nil {
+		return err
+	}
+	if session == nil {
+		return errors.New("session not found")
+	}
+	if session.Status == "complete" {
+		return nil
+	}
+	if _, err := os.Stat(session.TempFilePath); err != nil {
+		msg := "Uploaded file is no longer available"
+		fileprocessor.FailSession(ctx, session, 0, msg)
+		return errors.New(msg)
+	}
+
+	if job.Attempts > 1 {
+		fileprocessor.UpdateSessionStatus(ctx, session.ID, "processing", 0, "Resuming after interruption...")
+	}
+	processAndUploadFile(ctx, session, job.Request, job.UserID)
+
+	// The pipeline reports failures on the session
+	session, err = store.GetUploadSession(ctx, job.SessionID)
+	if err != nil {
+		return err
+	}
+	if session != nil && session.Status == "failed" {
+		return errors.New(session.ErrorMessage)
+	}
+	return nil
+}
+
+// FailJobSession marks the session of a job that could not be completed as failed
+func FailJobSession(ctx context.Context, job *models.ProcessingJob, reason string) {
+	session, err := store.GetUploadSession(ctx, job.SessionID)
+	if err != nil || session == nil {
+		return
+	}
+	failSessionAndDiscard(ctx, session, reason)
+}
+
+// failSessionAndDiscard marks a session failed, deleting the chunks its checkpoint has on drives
+func failSessionAndDiscard(ctx context.Context, session *models.UploadSession, reason string) {
+	if session.Checkpoint != nil {
+		uploaded := make(map[int]models.ChunkMetadata, len(session.Checkpoint.Chunks))
+		for _, chunk := range session.Checkpoint.Chunks {
+			uploaded[chunk.ChunkID] = chunk
+		}
+		discardUploadedChunks(ctx, session.ID, uploaded)
+	}
+	fileprocessor.FailSession(ctx, session, session.ProcessingProgress, reason)
+	fileprocessor.ScheduleCleanup(ctx, session.ID)
 }
 
 // processAndUploadFile handles the entire processing pipeline
-func processAndUploadFile(ctx context.Context, session *models.UploadSession, strategy models.ChunkingStrategy, manualSizes []int64, userID primitive.ObjectID) {
+func processAndUploadFile(ctx context.Context, session *models.UploadSession, req models.ProcessRequest, userID primitive.ObjectID) {
 	sessionID := session.ID
 
 	defer func() {
@@ -299,81 +752,234 @@ func processAndUploadFile(ctx context.Context, session *models.UploadSession, st
 		fileprocessor.ScheduleCleanup(ctx, sessionID)
 	}()
 
-	// Step 1: Obfuscate file (10%)
+	// Step 1: Set up obfuscation (10%). Noise is injected on the fly as chunks are read,
+	// so the only file on disk is the original upload.
 	log.Printf("Starting obfuscation for session %s", sessionID.Hex())
 	fileprocessor.UpdateSessionStatus(ctx, sessionID, "processing", 10, "Injecting noise...")
 
-	seed, err := fileprocessor.GenerateObfuscationSeed()
+	// A checkpoint from an interrupted run pins the seed and plan so its uploaded chunks stay valid
+	checkpoint := session.Checkpoint
+	var seed []byte
+	var err error
+	if checkpoint != nil {
+		seed, err = base64.StdEncoding.DecodeString(string(checkpoint.Seed))
+	} else {
+		seed, err = fileprocessor.GenerateObfuscationSeed()
+	}
 	if err != nil {
-		log.Printf("Failed to generate seed: %v", err)
-		fileprocessor.UpdateSessionStatus(ctx, sessionID, "failed", 10, fmt.Sprintf("Failed to generate seed: %v", err))
+		log.Printf("Failed to prepare seed: %v", err)
+		fileprocessor.FailSession(ctx, session, 10, fmt.Sprintf("Failed to prepare seed: %v", err))
 		return
 	}
 
-	obfuscatedPath := session.TempFilePath + ".obfuscated"
-	obfMetadata, processedSize, err := fileprocessor.ObfuscateFile(session.TempFilePath, obfuscatedPath, seed)
+	originalFile, err := os.Open(session.TempFilePath)
 	if err != nil {
-		log.Printf("Obfuscation failed: %v", err)
-		fileprocessor.UpdateSessionStatus(ctx, sessionID, "failed", 10, fmt.Sprintf("Obfuscation failed: %v", err))
+		log.Printf("Failed to open uploaded file: %v", err)
+		fileprocessor.FailSession(ctx, session, 10, fmt.Sprintf("Failed to open uploaded file: %v", err))
 		return
 	}
-	defer os.Remove(obfuscatedPath)
-	log.Printf("Obfuscation complete for session %s, size: %d", sessionID.Hex(), processedSize)
-
-	// Step 2: Get drive spaces (20%)
-	log.Printf("Checking drive spaces for session %s", sessionID.Hex())
-	fileprocessor.UpdateSessionStatus(ctx, sessionID, "processing", 20, "Checking drive spaces...")
+	defer originalFile.Close()
+
+	// A file resumed from a checkpoint was scanned before its chunks were uploaded
+	if checkpoint == nil && fileprocessor.ScanningEnabled() {
+		fileprocessor.UpdateSessionStatus(ctx, sessionID, "processing", 5, "Scanning for malware...")
+		var result fileprocessor.ScanResult
+		err = fileprocessor.RunStage(ctx, sessionID, "malware scan", func(stageCtx context.Context) error {
+			var err error
+			result, err = fileprocessor.ScanFile(stageCtx, io.NewSectionReader(originalFile, 0, session.TotalSize))
+			return err
+		})
+		if err != nil {
+			log.Printf("Malware scan failed for session %s: %v", sessionID.Hex(), err)
+			fileprocessor.FailSession(ctx, session, 5, fmt.Sprintf("Malware scan failed: %v", err))
+			return
+		}
+		if result.Infected {
+			log.Printf("Session %s rejected: %s", sessionID.Hex(), result.Signature)
+			fileprocessor.RejectInfected(ctx, session, 5, result.Signature)
+			return
+		}
+	}
+	contentType, media := fileprocessor.DetectMedia(originalFile, session.TotalSize, session.OriginalFilename)
 
-	driveSpaces, err := drivemanager.GetUserDriveSpaces(ctx, userID)
+	obfuscated, obfMetadata, err := fileprocessor.NewObfuscatedReader(originalFile, session.TotalSize, seed, req.ObfuscationProfile, req.ObfuscationOverheadPct)
 	if err != nil {
-		log.Printf("Failed to get drive spaces: %v", err)
-		fileprocessor.UpdateSessionStatus(ctx, sessionID, "failed", 20, fmt.Sprintf("Failed to get drive spaces: %v", err))
+		log.Printf("Obfuscation failed: %v", err)
+		fileprocessor.FailSession(ctx, session, 10, fmt.Sprintf("Obfuscation failed: %v", err))
 		return
 	}
-	log.Printf("Found %d drives for session %s", len(driveSpaces), sessionID.Hex())
+	processedSize := obfuscated.Size()
+	log.Printf("Obfuscation ready for session %s, size: %d", sessionID.Hex(), processedSize)
+
+	// The file ID is named in every chunk's header, so it is fixed before any chunk is uploaded.
+	// A repaired file keeps the ID it was recorded under as incomplete.
+	fileID := session.FileID
+	if checkpoint != nil && !checkpoint.FileID.IsZero() {
+		fileID = checkpoint.FileID
+	}
+	if fileID.IsZero() {
+		fileID = primitive.NewObjectID()
+	}
 
-	// Step 3: Calculate chunking plan (30%)
-	log.Printf("Calculating chunking plan for session %s", sessionID.Hex())
-	fileprocessor.UpdateSessionStatus(ctx, sessionID, "processing", 30, "Calculating chunk distribution...")
+	var plan []models.ChunkPlan
+	if checkpoint != nil {
+		plan = checkpoint.Plan
+		log.Printf("Resuming session %s from checkpoint: %d/%d chunks already uploaded", sessionID.Hex(), len(checkpoint.Chunks), len(plan))
+	} else if req.PlanID != "" {
+		// Steps 2-3: the user accepted a previewed plan; free space is re-checked when chunks are reserved
+		fileprocessor.UpdateSessionStatus(ctx, sessionID, "processing", 30, "Using the accepted chunk plan...")
+		preview := session.PlanPreview
+		if preview == nil || preview.ID.Hex() != req.PlanID || preview.ProcessedSize != processedSize {
+			fileprocessor.FailSession(ctx, session, 30, "The accepted chunk plan no longer matches the upload")
+			return
+		}
+		plan = preview.Plan
+		log.Printf("Using accepted plan %s: %d chunks for session %s", req.PlanID, len(plan), sessionID.Hex())
 
-	plan, err := fileprocessor.CalculateChunkPlan(processedSize, driveSpaces, strategy, manualSizes)
-	if err != nil {
-		log.Printf("Chunking calculation failed: %v", err)
-		fileprocessor.UpdateSessionStatus(ctx, sessionID, "failed", 30, fmt.Sprintf("Chunking calculation failed: %v", err))
-		return
-	}
-	log.Printf("Chunking plan created: %d chunks for session %s", len(plan), sessionID.Hex())
+		if err := store.SetSessionCheckpoint(ctx, sessionID, &models.ProcessingCheckpoint{Seed: obfMetadata.Seed, FileID: fileID, Plan: plan}); err != nil {
+			log.Printf("Failed to save checkpoint for session %s: %v", sessionID.Hex(), err)
+		}
+	} else {
+		// Step 2: Get drive spaces (20%)
+		log.Printf("Checking drive spaces for session %s", sessionID.Hex())
+		fileprocessor.UpdateSessionStatus(ctx, sessionID, "processing", 20, "Checking drive spaces...")
+
+		var driveSpaces []models.DriveSpaceInfo
+		err = fileprocessor.RunStage(ctx, sessionID, "drive spaces", func(stageCtx context.Context) error {
+			var err error
+			driveSpaces, err = drivemanager.GetUserDriveSpaces(stageCtx, userID)
+			return err
+		})
+		if err != nil {
+			log.Printf("Failed to get drive spaces: %v", err)
+			fileprocessor.FailSession(ctx, session, 20, fmt.Sprintf("Failed to get drive spaces: %v", err))
+			return
+		}
+		log.Printf("Found %d drives for session %s", len(driveSpaces), sessionID.Hex())
 
-	// Step 4: Split file into chunks (50%)
-	log.Printf("Splitting file for session %s", sessionID.Hex())
-	fileprocessor.UpdateSessionStatus(ctx, sessionID, "processing", 50, "Splitting file into chunks...")
+		// Step 3: Calculate chunking plan (30%)
+		log.Printf("Calculating chunking plan for session %s", sessionID.Hex())
+		fileprocessor.UpdateSessionStatus(ctx, sessionID, "processing", 30, "Calculating chunk distribution...")
 
-	chunkDir := filepath.Dir(obfuscatedPath)
-	chunkPaths, err := fileprocessor.SplitFile(obfuscatedPath, chunkDir, plan)
-	if err != nil {
-		log.Printf("File splitting failed: %v", err)
-		fileprocessor.UpdateSessionStatus(ctx, sessionID, "failed", 50, fmt.Sprintf("File splitting failed: %v", err))
-		return
+		policy, err := store.GetUserPlacementPolicy(ctx, userID)
+		if err != nil {
+			log.Printf("Failed to load placement policy: %v", err)
+			fileprocessor.FailSession(ctx, session, 30, fmt.Sprintf("Failed to load placement policy: %v", err))
+			return
+		}
+
+		plan, err = fileprocessor.CalculateChunkPlan(processedSize, driveSpaces, req.Strategy, req.ManualChunkSizes, req.Erasure, policy)
+		if err != nil {
+			log.Printf("Chunking calculation failed: %v", err)
+			fileprocessor.FailSession(ctx, session, 30, fmt.Sprintf("Chunking calculation failed: %v", err))
+			return
+		}
+		log.Printf("Chunking plan created: %d chunks for session %s", len(plan), sessionID.Hex())
+
+		if err := store.SetSessionCheckpoint(ctx, sessionID, &models.ProcessingCheckpoint{Seed: obfMetadata.Seed, FileID: fileID, Plan: plan}); err != nil {
+			log.Printf("Failed to save checkpoint for session %s: %v", sessionID.Hex(), err)
+		}
 	}
-	defer func() {
-		for _, path := range chunkPaths {
-			os.Remove(path)
+
+	// Step 4: Prepare chunk streams (50%)
+	log.Printf("Preparing chunks for session %s", sessionID.Hex())
+	fileprocessor.UpdateSessionStatus(ctx, sessionID, "processing", 50, "Preparing chunks...")
+
+	chunkDir := filepath.Dir(session.TempFilePath)
+	var chunkSources []io.ReaderAt
+	var erasureMeta *models.ErasureMetadata
+	if req.Strategy == models.StrategyErasure {
+		erasureMeta = &models.ErasureMetadata{ShardSize: plan[0].Size}
+		for _, chunk := range plan {
+			if chunk.Parity {
+				erasureMeta.ParityShards++
+			} else {
+				erasureMeta.DataShards++
+			}
 		}
-	}()
-	log.Printf("File split into %d chunks for session %s", len(chunkPaths), sessionID.Hex())
+		// Parity shards are the only thing written to disk. A timed-out attempt removes its
+		// partial parity files before the stage is retried.
+		var cleanup func()
+		err = fileprocessor.RunStage(ctx, sessionID, "erasure encoding", func(stageCtx context.Context) error {
+			var err error
+			chunkSources, cleanup, err = fileprocessor.ErasureShardSources(stageCtx, obfuscated, processedSize, chunkDir, plan, erasureMeta.DataShards, erasureMeta.ParityShards)
+			return err
+		})
+		if err != nil {
+			log.Printf("Erasure encoding failed: %v", err)
+			fileprocessor.FailSession(ctx, session, 50, fmt.Sprintf("Erasure encoding failed: %v", err))
+			return
+		}
+		defer cleanup()
+	} else {
+		for _, chunk := range plan {
+			chunkSources = append(chunkSources, io.NewSectionReader(obfuscated, chunk.StartOffset, chunk.Size))
+		}
+	}
+	log.Printf("Prepared %d chunks for session %s", len(chunkSources), sessionID.Hex())
 
 	// Step 5: Upload chunks to drives (90%)
 	log.Printf("Uploading chunks to drives for session %s", sessionID.Hex())
 	fileprocessor.UpdateSessionStatus(ctx, sessionID, "processing", 70, "Uploading chunks to drives...")
 
-	chunkMetadata, err := drivemanager.UploadChunksToDrivers(ctx, chunkPaths, plan, func(current, total int) {
-		progress := 70 + (20 * float64(current) / float64(total))
-		log.Printf("Upload progress for session %s: chunk %d/%d (%.1f%%)", sessionID.Hex(), current, total, progress)
-		fileprocessor.UpdateSessionStatus(ctx, sessionID, "processing", progress, fmt.Sprintf("Uploading chunk %d/%d...", current, total))
+	meter := drivemanager.NewTransferMeter()
+	sessionMeters.Store(sessionID.Hex(), meter)
+	defer sessionMeters.Delete(sessionID.Hex())
+	uploadCtx := drivemanager.WithParallelUploads(drivemanager.WithTransferMeter(ctx, meter), req.ParallelUploads)
+	pause, stopWatching := watchPause(ctx, sessionID)
+	defer stopWatching()
+	uploadCtx = drivemanager.WithPause(uploadCtx, pause)
+	if req.AllowPartial {
+		uploadCtx = drivemanager.WithPartialUploads(uploadCtx)
+	}
+	// Chunks of a run checkpointed before headers existed stay headerless, like the ones already uploaded
+	if checkpoint == nil || !checkpoint.FileID.IsZero() {
+		uploadCtx = drivemanager.WithChunkHeaders(uploadCtx, fileID)
+	}
+
+	// Every finished chunk is checkpointed, so a stage retry or a resumed job only uploads the rest
+	uploaded := make(map[int]models.ChunkMetadata)
+	if checkpoint != nil {
+		for _, chunk := range checkpoint.Chunks {
+			uploaded[chunk.ChunkID] = chunk
+		}
+	}
+
+	var chunkMetadata []models.ChunkMetadata
+	err = fileprocessor.RunStage(uploadCtx, sessionID, "upload chunks", func(stageCtx context.Context) error {
+		var err error
+		chunkMetadata, err = drivemanager.UploadChunksToDrivers(stageCtx, chunkSources, plan, uploaded, func(chunk models.ChunkMetadata, current, total int) {
+			uploaded[chunk.ChunkID] = chunk
+			if err := store.AddCheckpointChunk(ctx, sessionID, chunk); err != nil {
+				log.Printf("Failed to checkpoint chunk %d for session %s: %v", chunk.ChunkID, sessionID.Hex(), err)
+			}
+			progress := 70 + (20 * float64(current) / float64(total))
+			log.Printf("Upload progress for session %s: %d/%d chunks done (%.1f%%)", sessionID.Hex(), current, total, progress)
+			fileprocessor.UpdateSessionStatus(ctx, sessionID, "processing", progress, fmt.Sprintf("Uploaded %d/%d chunks...", current, total))
+		})
+		return err
 	})
+	if errors.Is(err, drivemanager.ErrUploadPaused) {
+		// The checkpoint keeps the chunks already on drives for when the session is resumed
+		log.Printf("Upload for session %s paused with %d/%d chunks on drives", sessionID.Hex(), len(uploaded), len(plan))
+		progress := 70 + (20 * float64(len(uploaded)) / float64(len(plan)))
+		fileprocessor.PauseSession(ctx, sessionID, progress, fmt.Sprintf("Paused after %d/%d chunks", len(uploaded), len(plan)))
+		return
+	}
 	if err != nil {
+		if ctx.Err() != nil {
+			// Interrupted rather than failed: keep the checkpoint for whoever resumes the job
+			log.Printf("Upload for session %s interrupted: %v", sessionID.Hex(), err)
+			return
+		}
+		var partialErr *drivemanager.PartialUploadError
+		if errors.As(err, &partialErr) && len(uploaded) > 0 {
+			recordIncompleteFile(ctx, session, fileID, req, processedSize, contentType, media, obfMetadata, uploaded, erasureMeta, partialErr)
+			return
+		}
 		log.Printf("Upload failed: %v", err)
-		fileprocessor.UpdateSessionStatus(ctx, sessionID, "failed", 70, fmt.Sprintf("Upload failed: %v", err))
+		discardUploadedChunks(ctx, sessionID, uploaded)
+		fileprocessor.FailSession(ctx, session, 70, fmt.Sprintf("Upload failed: %v", err))
 		return
 	}
 	log.Printf("All chunks uploaded for session %s", sessionID.Hex())
@@ -382,27 +988,71 @@ func processAndUploadFile(ctx context.Context, session *models.UploadSession, st
 	log.Printf("Generating key file for session %s", sessionID.Hex())
 	fileprocessor.UpdateSessionStatus(ctx, sessionID, "processing", 95, "Generating key file...")
 
-	keyFilePath := filepath.Join(chunkDir, session.OriginalFilename+".2xpfm.key")
+	keyFilePath := filepath.Join(chunkDir, fileprocessor.KeyFileName(session.OriginalFilename))
 	if err := fileprocessor.GenerateKeyFile(
+		fileID,
 		session.OriginalFilename,
 		session.TotalSize,
 		processedSize,
 		obfMetadata,
 		chunkMetadata,
+		erasureMeta,
 		keyFilePath,
 	); err != nil {
 		log.Printf("Key file generation failed: %v", err)
-		fileprocessor.UpdateSessionStatus(ctx, sessionID, "failed", 95, fmt.Sprintf("Key file generation failed: %v", err))
+		fileprocessor.FailSession(ctx, session, 95, fmt.Sprintf("Key file generation failed: %v", err))
 		return
 	}
 
-	// Store key file path in session for download
-	store.UpdateSessionKeyFile(ctx, sessionID, keyFilePath)
-
-	// Step 7: Complete (100%)
+	// Step 7: Complete (100%). The stored file, so it can be listed and managed later, and the
+	// completed session with its key file are written together.
+	storedFile := fileprocessor.NewStoredFile(fileID, session, req.Strategy, processedSize, obfMetadata, chunkMetadata, erasureMeta)
+	storedFile.ContentType, storedFile.Media = contentType, media
+	if err := fileprocessor.CompleteSession(ctx, session, req.Strategy, storedFile, keyFilePath); err != nil {
+		log.Printf("Failed to record stored file: %v", err)
+		fileprocessor.FailSession(ctx, session, 95, fmt.Sprintf("Failed to record stored file: %v", err))
+		return
+	}
 	log.Printf("Processing complete for session %s. Key file: %s", sessionID.Hex(), keyFilePath)
-	fileprocessor.CompleteSession(ctx, sessionID)
-	fileprocessor.UpdateSessionStatus(ctx, sessionID, "complete", 100, "")
+}
+
+// recordIncompleteFile stores the chunks that made it to drives as an incomplete file and keeps
+// the session's checkpoint, so a repair only has to upload the chunks that failed
+func recordIncompleteFile(ctx context.Context, session *models.UploadSession, fileID primitive.ObjectID, req models.ProcessRequest, processedSize int64, contentType string, media *models.MediaInfo,
+	obfMetadata *models.ObfuscationMetadata, uploaded map[int]models.ChunkMetadata, erasureMeta *models.ErasureMetadata, partialErr *drivemanager.PartialUploadError) {
+	chunks := make([]models.ChunkMetadata, 0, len(uploaded))
+	for _, chunk := range uploaded {
+		chunks = append(chunks, chunk)
+	}
+	sort.Slice(chunks, func(i, j int) bool { return chunks[i].ChunkID < chunks[j].ChunkID })
+	total := len(chunks) + len(partialErr.FailedChunks)
+
+	storedFile := fileprocessor.NewStoredFile(fileID, session, req.Strategy, processedSize, obfMetadata, chunks, erasureMeta)
+	storedFile.ContentType, storedFile.Media = contentType, media
+	storedFile.Status = "incomplete"
+	storedFile.MissingChunks = partialErr.FailedChunks
+	if err := store.ReplaceStoredFile(ctx, storedFile); err != nil {
+		log.Printf("Failed to record incomplete file: %v", err)
+		discardUploadedChunks(ctx, session.ID, uploaded)
+		fileprocessor.FailSession(ctx, session, 70, fmt.Sprintf("Failed to record incomplete file: %v", err))
+		return
+	}
+	store.UpdateSessionFileID(ctx, session.ID, fileID)
+
+	log.Printf("Upload for session %s incomplete: %d/%d chunks on drives: %v", session.ID.Hex(), len(chunks), total, partialErr)
+	progress := 70 + (20 * float64(len(chunks)) / float64(total))
+	fileprocessor.MarkIncomplete(ctx, session, progress, fmt.Sprintf("Stored %d/%d chunks: %v", len(chunks), total, partialErr.Err))
+}
+
+// discardUploadedChunks removes the chunks of a run that is being given up and drops its checkpoint
+func discardUploadedChunks(ctx context.Context, sessionID primitive.ObjectID, uploaded map[int]models.ChunkMetadata) {
+	chunks := make([]models.ChunkMetadata, 0, len(uploaded))
+	for _, chunk := range uploaded {
+		chunks = append(chunks, chunk)
+	}
+	// Detach from ctx so an expired stage deadline doesn't also abort the cleanup
+	drivemanager.DeleteChunks(context.WithoutCancel(ctx), chunks)
+	store.ClearSessionCheckpoint(ctx, sessionID)
 }
 
 // DownloadKeyFileHandler - GET /api/files/download-key/:session_id
@@ -436,12 +1086,7 @@ func DownloadKeyFileHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Get key file path from session
-	keyFilePath := session.KeyFilePath
-	if keyFilePath == "" {
-		// Fallback: construct from temp path
-		keyFilePath = filepath.Dir(session.TempFilePath) + "/" + session.OriginalFilename + ".2xpfm.key"
-	}
+	keyFilePath := keyFilePath(session)
 
 	// Check if file exists
 	if _, err := os.Stat(keyFilePath); os.IsNotExist(err) {
@@ -455,12 +1100,190 @@ func DownloadKeyFileHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "failed to read key file", http.StatusInternalServerError)
 		return
 	}
+	audit.Record(r, models.AuditEvent{UserID: userID, Action: models.AuditKeyDownloaded, Target: session.ID.Hex(), Detail: session.OriginalFilename})
 
 	// Set headers for download
 	w.Header().Set("Content-Type", "application/json")
-	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%s.2xpfm.key", session.OriginalFilename))
+	w.Header().Set("Content-Disposition", contentDisposition(fileprocessor.KeyFileName(session.OriginalFilename)))
 	w.Header().Set("Content-Length", fmt.Sprintf("%d", len(data)))
 
 	// Send file
 	w.Write(data)
 }
+
+// keyFilePath is where the key file of a completed session is kept
+func keyFilePath(session *models.UploadSession) string {
+	if session.KeyFilePath != "" {
+		return string(session.KeyFilePath)
+	}
+	// Fallback: construct from temp path
+	return filepath.Join(filepath.Dir(session.TempFilePath), fileprocessor.KeyFileName(session.OriginalFilename))
+}
+
+// UndeleteFileHandler - POST /api/files/undelete
+// Body is the key file; restores its chunks from the Drive trash
+func UndeleteFileHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("userID").(primitive.ObjectID)
+
+	var keyFile models.KeyFile
+	if err := json.NewDecoder(r.Body).Decode(&keyFile); err != nil {
+		http.Error(w, "invalid key file", http.StatusBadRequest)
+		return
+	}
+	if len(keyFile.Chunks) == 0 {
+		http.Error(w, "key file has no chunks", http.StatusBadRequest)
+		return
+	}
+
+	// Only allow restoring chunks that live on the caller's own drives
+	accounts, err := store.ListUserDriveAccounts(r.Context(), userID)
+	if err != nil {
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+	owned := make(map[string]bool, len(accounts))
+	for _, a := range accounts {
+		owned[a.ID.Hex()] = true
+	}
+	for _, chunk := range keyFile.Chunks {
+		if !owned[chunk.DriveAccountID] {
+			http.Error(w, fmt.Sprintf("chunk %d belongs to a drive account that is not linked", chunk.ChunkID), http.StatusForbidden)
+			return
+		}
+	}
+
+	failed := drivemanager.RestoreTrashedChunks(r.Context(), keyFile.Chunks)
+	audit.Record(r, models.AuditEvent{UserID: userID, Action: models.AuditFileUndeleted, Target: keyFile.FileID, Detail: keyFile.OriginalFilename})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"restored": len(keyFile.Chunks) - len(failed),
+		"failed":   failed,
+	})
+}
+
+// RestoreFromKeyHandler - POST /api/files/restore-from-key
+// Body is the key file; recreates the file's record from it if its chunks are still on the drives
+func RestoreFromKeyHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("userID").(primitive.ObjectID)
+
+	var req struct {
+		models.KeyFile
+		// Drive accounts linked again since the key file was made, old ID to new ID
+		DriveAccounts map[string]string `json:"drive_accounts"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid key file", http.StatusBadRequest)
+		return
+	}
+	keyFile := req.KeyFile
+	for i, chunk := range keyFile.Chunks {
+		if id, ok := req.DriveAccounts[chunk.DriveAccountID]; ok {
+			keyFile.Chunks[i].DriveAccountID = id
+		}
+	}
+	if err := fileprocessor.CheckKeyFile(&keyFile); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	file, err := fileprocessor.StoredFileFromKeyFile(&keyFile, userID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Like undelete, only chunks on the caller's own drives
+	accounts, err := store.ListUserDriveAccounts(r.Context(), userID)
+	if err != nil {
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+	owned := make(map[primitive.ObjectID]bool, len(accounts))
+	for _, a := range accounts {
+		owned[a.ID] = true
+	}
+	for _, chunk := range file.Chunks {
+		if !owned[chunk.DriveAccountID] {
+			http.Error(w, fmt.Sprintf("chunk %d belongs to a drive account that is not linked", chunk.ChunkID), http.StatusForbidden)
+			return
+		}
+	}
+
+	// A trashed or deleted record is brought back; any other is already there, or someone else's
+	if file.ID.IsZero() {
+		file.ID = primitive.NewObjectID()
+	}
+	existing, err := store.GetStoredFile(r.Context(), file.ID)
+	if err != nil {
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+	if existing != nil && (existing.UserID != userID || (existing.Status != "trashed" && existing.Status != "deleted")) {
+		http.Error(w, "file already exists", http.StatusConflict)
+		return
+	}
+	if existing != nil {
+		file.Folder, file.Path = existing.Folder, existing.Path
+		file.Description, file.Metadata = existing.Description, existing.Metadata
+	}
+	if err := fileprocessor.CheckQuota(r.Context(), userID, file.OriginalSize); err != nil {
+		if errors.Is(err, fileprocessor.ErrQuotaExceeded) {
+			http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+			return
+		}
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+
+	var checks []store.ChunkCheck
+	missing := map[int]string{} // chunk ID to "missing" or "corrupt"
+	for _, chunk := range file.Chunks {
+		err := drivemanager.CheckChunkFile(r.Context(), chunk.DriveAccountID, chunk.DriveFileID, file.ID, chunk.ChunkID, chunk.Size, chunk.HeaderVersion > 0)
+		var health string
+		switch {
+		case err == nil:
+			continue
+		case drivemanager.IsNotFound(err):
+			health = models.ChunkMissing
+		case errors.Is(err, drivemanager.ErrBadChunkHeader):
+			health = models.ChunkCorrupt
+		default:
+			log.Printf("Failed to check chunk %d of file %s: %v", chunk.ChunkID, file.ID.Hex(), err)
+			http.Error(w, "failed to reach drive", http.StatusBadGateway)
+			return
+		}
+		missing[chunk.ChunkID] = health
+		checks = append(checks, store.ChunkCheck{ChunkID: chunk.ChunkID, DriveFileID: chunk.DriveFileID, Health: health})
+	}
+	// Erasure-coded files can do without up to their parity shards
+	allowed := 0
+	if file.Erasure != nil {
+		allowed = file.Erasure.ParityShards
+	}
+	if len(missing) > allowed {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"error":   "chunks are missing from the drives",
+			"missing": missing,
+		})
+		return
+	}
+
+	if err := store.ReplaceStoredFile(r.Context(), file); err != nil {
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+	if len(checks) > 0 {
+		if err := store.RecordChunkChecks(r.Context(), file.ID, checks, time.Now().UTC()); err != nil {
+			log.Printf("Failed to record missing chunks of file %s: %v", file.ID.Hex(), err)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"file":    file,
+		"missing": missing,
+	})
+}
@@ -0,0 +1,301 @@
+package filehandlers
+
+import (
+	"SE/internal/cache"
+	"SE/internal/fileprocessor"
+	"SE/internal/models"
+	"SE/internal/store"
+	"SE/internal/store/storetest"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestMain(m *testing.M) {
+	os.Exit(storetest.Run(m))
+}
+
+// setup starts a test with an empty store and a user with two local drives
+func setup(t *testing.T) *models.User {
+	t.Helper()
+	storetest.Setup(t)
+	fileprocessor.InitFileConfig()
+	user := storetest.User(t)
+	storetest.LocalDrives(t, user.ID, 2)
+	return user
+}
+
+// serve runs a handler as the user and fails the test unless it answers with status want
+func serve(t *testing.T, h http.HandlerFunc, r *http.Request, want int) *httptest.ResponseRecorder {
+	t.Helper()
+	w := httptest.NewRecorder()
+	h(w, r)
+	if w.Code != want {
+		t.Fatalf("%s %s: status %d, want %d: %s", r.Method, r.URL, w.Code, want, w.Body)
+	}
+	return w
+}
+
+// jsonBody encodes v as a request body
+func jsonBody(t *testing.T, v any) *bytes.Reader {
+	t.Helper()
+	b, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return bytes.NewReader(b)
+}
+
+// randomData returns n random bytes
+func randomData(n int) []byte {
+	data := make([]byte, n)
+	rand.Read(data)
+	return data
+}
+
+// processQueued runs the queued processing job the way a worker would
+func processQueued(t *testing.T) {
+	t.Helper()
+	ctx := context.Background()
+	job, err := store.ClaimJob(ctx, "test", time.Minute, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if job == nil {
+		t.Fatal("no job queued")
+	}
+	if err := ProcessJob(ctx, job); err != nil {
+		t.Fatalf("process job: %v", err)
+	}
+	if err := store.FinishJob(ctx, job.ID, "test", models.JobDone, ""); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// uploadFile runs data through initiate, upload, finalize and processing and returns the stored file
+func uploadFile(t *testing.T, userID primitive.ObjectID, filename string, data []byte) *models.StoredFile {
+	t.Helper()
+	size := int64(len(data))
+	w := serve(t, InitiateUploadHandler, storetest.Request("POST", "/api/files/upload/initiate",
+		jsonBody(t, map[string]any{"filename": filename, "file_size": size}), userID), http.StatusOK)
+	var initiated struct {
+		SessionID string `json:"session_id"`
+	}
+	json.NewDecoder(w.Body).Decode(&initiated)
+
+	// Out of order, to exercise range tracking
+	half := size / 2
+	for _, part := range [][2]int64{{half, size}, {0, half}} {
+		r := storetest.Request("PUT", "/api/files/upload/chunk?session_id="+initiated.SessionID, bytes.NewReader(data[part[0]:part[1]]), userID)
+		r.Header.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", part[0], part[1]-1, size))
+		serve(t, UploadChunkRawHandler, r, http.StatusOK)
+	}
+
+	serve(t, FinalizeUploadHandler, storetest.Request("POST", "/api/files/upload/finalize",
+		jsonBody(t, map[string]string{"session_id": initiated.SessionID, "strategy": "balanced"}), userID), http.StatusOK)
+	processQueued(t)
+
+	sessionID, _ := primitive.ObjectIDFromHex(initiated.SessionID)
+	session, err := store.GetUploadSession(context.Background(), sessionID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if session.Status != "complete" {
+		t.Fatalf("session %s, want complete: %s", session.Status, session.ErrorMessage)
+	}
+	file, err := store.GetStoredFile(context.Background(), session.FileID)
+	if err != nil || file == nil {
+		t.Fatalf("stored file %s: %v", session.FileID.Hex(), err)
+	}
+	return file
+}
+
+func TestUploadPipeline(t *testing.T) {
+	user := setup(t)
+	data := randomData(3<<20 + 12345)
+
+	file := uploadFile(t, user.ID, "pipeline.bin", data)
+	if file.OriginalFilename != "pipeline.bin" || file.OriginalSize != int64(len(data)) || file.Status != "active" {
+		t.Fatalf("stored file = %s %d bytes %s, want pipeline.bin %d bytes active", file.OriginalFilename, file.OriginalSize, file.Status, len(data))
+	}
+	// Balanced spreads the chunks over both drives
+	drives := make(map[primitive.ObjectID]bool)
+	for _, chunk := range file.Chunks {
+		if chunk.DriveFileID == "" {
+			t.Errorf("chunk %d has no drive file", chunk.ChunkID)
+		}
+		drives[chunk.DriveAccountID] = true
+	}
+	if len(drives) != 2 {
+		t.Errorf("chunks on %d drives, want 2", len(drives))
+	}
+
+	w := serve(t, ListStoredFilesHandler, storetest.Request("GET", "/api/files/list", nil, user.ID), http.StatusOK)
+	var list struct {
+		Files []struct {
+			ID string `json:"id"`
+		} `json:"files"`
+	}
+	json.NewDecoder(w.Body).Decode(&list)
+	if len(list.Files) != 1 || list.Files[0].ID != file.ID.Hex() {
+		t.Fatalf("file list = %+v, want %s", list.Files, file.ID.Hex())
+	}
+}
+
+func TestFinalizeIncompleteUpload(t *testing.T) {
+	user := setup(t)
+	session := storetest.Session(t, user.ID, "partial.bin", randomData(1000))
+	store.CompactSessionRanges(context.Background(), session.ID, 1, []models.ByteRange{{Start: 0, End: 600}}, 600)
+
+	w := serve(t, FinalizeUploadHandler, storetest.Request("POST", "/api/files/upload/finalize",
+		jsonBody(t, map[string]string{"session_id": session.ID.Hex()}), user.ID), http.StatusBadRequest)
+	if !strings.Contains(w.Body.String(), "upload incomplete") {
+		t.Errorf("body %q, want upload incomplete", w.Body)
+	}
+	if job, _ := store.ClaimJob(context.Background(), "test", time.Minute, false); job != nil {
+		t.Error("incomplete upload was queued for processing")
+	}
+}
+
+func TestUploadChunkOtherUsersSession(t *testing.T) {
+	user := setup(t)
+	session := storetest.Session(t, user.ID, "mine.bin", nil)
+	other := storetest.User(t)
+
+	r := storetest.Request("PUT", "/api/files/upload/chunk?session_id="+session.ID.Hex(), strings.NewReader("abc"), other.ID)
+	r.Header.Set("Content-Range", "bytes 0-2/3")
+	serve(t, UploadChunkRawHandler, r, http.StatusBadRequest)
+}
+
+func TestBadChunkResend(t *testing.T) {
+	user := setup(t)
+	data := randomData(1000)
+	session := storetest.Session(t, user.ID, "resend.bin", data)
+	put := func(chunk []byte, sum [32]byte, want int) {
+		t.Helper()
+		r := storetest.Request("PUT", "/api/files/upload/chunk?session_id="+session.ID.Hex(), bytes.NewReader(chunk), user.ID)
+		r.Header.Set("Content-Range", fmt.Sprintf("bytes 0-%d/%d", len(chunk)-1, len(data)))
+		r.Header.Set("X-Chunk-SHA256", hex.EncodeToString(sum[:]))
+		serve(t, UploadChunkRawHandler, r, want)
+	}
+
+	// A resend of a chunk that was corrupted on the way is refused without touching the range
+	// it would have overwritten
+	put(randomData(500), sha256.Sum256(data[:500]), http.StatusUnprocessableEntity)
+	got, err := os.ReadFile(session.TempFilePath)
+	if err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("temp file changed by a chunk with a bad checksum: %v", err)
+	}
+	put(data[:500], sha256.Sum256(data[:500]), http.StatusOK)
+	session, err = store.GetUploadSession(context.Background(), session.ID)
+	if err != nil || session.UploadedSize != int64(len(data)) {
+		t.Errorf("session has %d of %d bytes, want all: %v", session.UploadedSize, len(data), err)
+	}
+	// Staged chunks don't outlive their request
+	if entries, _ := os.ReadDir(filepath.Dir(session.TempFilePath)); len(entries) != 1 {
+		t.Errorf("%d files next to the temp file, want none", len(entries)-1)
+	}
+}
+
+func TestDeleteUploadSession(t *testing.T) {
+	user := setup(t)
+	session := storetest.Session(t, user.ID, "abandoned.bin", randomData(100))
+
+	serve(t, DeleteUploadSessionHandler, storetest.Request("DELETE", "/api/files/upload/sessions/"+session.ID.Hex(), nil, user.ID), http.StatusNoContent)
+	if s, _ := store.GetUploadSession(context.Background(), session.ID); s != nil {
+		t.Error("session still stored")
+	}
+	if _, err := os.Stat(session.TempFilePath); !os.IsNotExist(err) {
+		t.Errorf("uploaded temp file left behind (stat: %v)", err)
+	}
+	serve(t, GetUploadStatusHandler, storetest.Request("GET", "/api/files/upload/status/"+session.ID.Hex(), nil, user.ID), http.StatusNotFound)
+}
+
+// mapCache is a Cache in a map that counts its hits
+type mapCache struct {
+	mu   sync.Mutex
+	m    map[string][]byte
+	hits int
+}
+
+func (c *mapCache) Get(ctx context.Context, key string) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	b, ok := c.m[key]
+	if ok {
+		c.hits++
+	}
+	return b, ok
+}
+
+func (c *mapCache) Set(ctx context.Context, key string, value []byte, ttl time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.m[key] = value
+}
+
+func (c *mapCache) Delete(ctx context.Context, keys ...string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, k := range keys {
+		delete(c.m, k)
+	}
+}
+
+func TestUploadWithCache(t *testing.T) {
+	user := setup(t)
+	if err := cache.InitCache(); err != nil {
+		t.Fatal(err)
+	}
+	c := &mapCache{m: make(map[string][]byte)}
+	cache.SetCache(c)
+	t.Cleanup(func() { cache.SetCache(nil) })
+
+	data := randomData(2<<20 + 99)
+	file := uploadFile(t, user.ID, "cached.bin", data)
+	if c.hits == 0 {
+		t.Error("chunk uploads never read the session from the cache")
+	}
+	if _, ok := c.m["upload_session:"+file.SessionID.Hex()]; ok {
+		t.Error("session still cached after it was finalized")
+	}
+	w := serve(t, FileResourceHandler, storetest.Request("GET", "/api/files/"+file.ID.Hex()+"/download", nil, user.ID), http.StatusOK)
+	if !bytes.Equal(w.Body.Bytes(), data) {
+		t.Error("file uploaded with the cache on downloads differently")
+	}
+}
+
+func TestParseContentRange(t *testing.T) {
+	for _, tc := range []struct {
+		header            string
+		start, end, total int64
+		ok                bool
+	}{
+		{"bytes 0-99/100", 0, 99, 100, true},
+		{"bytes 100-199/*", 100, 199, -1, true},
+		{"bytes 0-100/100", 0, 0, 0, false}, // past the end
+		{"bytes 5-4/100", 0, 0, 0, false},
+		{"bytes -1-4/100", 0, 0, 0, false},
+		{"0-99/100", 0, 0, 0, false},
+		{"bytes 0-99", 0, 0, 0, false},
+	} {
+		start, end, total, ok := parseContentRange(tc.header)
+		if ok != tc.ok || start != tc.start || end != tc.end || total != tc.total {
+			t.Errorf("parseContentRange(%q) = %d, %d, %d, %v, want %d, %d, %d, %v", tc.header, start, end, total, ok, tc.start, tc.end, tc.total, tc.ok)
+		}
+	}
+}
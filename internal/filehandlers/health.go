@@ -0,0 +1,147 @@
+package filehandlers
+
+import (
+	"SE/internal/fileprocessor"
+	"SE/internal/models"
+	"SE/internal/store"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// chunkHealth is what the integrity scrubber last found for one chunk
+type chunkHealth struct {
+	ChunkID        int        `json:"chunk_id"`
+	Health         string     `json:"health"` // "ok", "corrupt", "missing" or "unchecked"
+	LastCheckedAt  *time.Time `json:"last_checked_at,omitempty"`
+	LastVerifiedAt *time.Time `json:"last_verified_at,omitempty"`
+}
+
+// fileHealth handles GET /api/files/:id/health. The file is "damaged" if any chunk was found
+// corrupt or missing, "healthy" if every chunk checked so far was fine, and "unchecked"
+// until the scrubber has checked one.
+func fileHealth(w http.ResponseWriter, r *http.Request, fileID primitive.ObjectID) {
+	userID := r.Context().Value("userID").(primitive.ObjectID)
+
+	file, err := store.GetStoredFile(r.Context(), fileID)
+	if err != nil {
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+	if file == nil || file.UserID != userID || (file.Status != "active" && file.Status != "incomplete") {
+		http.Error(w, "file not found", http.StatusNotFound)
+		return
+	}
+
+	status := "unchecked"
+	checked := 0
+	corrupt, missing := []int{}, []int{}
+	chunks := make([]chunkHealth, 0, len(file.Chunks))
+	for _, c := range file.Chunks {
+		health := c.Health
+		switch health {
+		case "":
+			health = "unchecked"
+		case models.ChunkCorrupt:
+			corrupt = append(corrupt, c.ChunkID)
+		case models.ChunkMissing:
+			missing = append(missing, c.ChunkID)
+		}
+		if c.Health != "" {
+			checked++
+			status = "healthy"
+		}
+		chunks = append(chunks, chunkHealth{ChunkID: c.ChunkID, Health: health, LastCheckedAt: c.LastCheckedAt, LastVerifiedAt: c.LastVerifiedAt})
+	}
+	if len(corrupt)+len(missing) > 0 {
+		status = "damaged"
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"file_id":          fileID.Hex(),
+		"status":           status,
+		"last_scrubbed_at": file.LastScrubbedAt,
+		"checked_chunks":   checked,
+		"total_chunks":     len(file.Chunks),
+		"corrupt_chunks":   corrupt,
+		"missing_chunks":   missing,
+		"chunks":           chunks,
+	})
+}
+
+// verifyFileIntegrity handles POST /api/files/:id/verify. It checks that every chunk's drive
+// is still linked. With deep=true it instead starts downloading every chunk to compare it with
+// its checksum, and returns where to follow that.
+func verifyFileIntegrity(w http.ResponseWriter, r *http.Request, fileID primitive.ObjectID) {
+	userID := r.Context().Value("userID").(primitive.ObjectID)
+
+	file, err := store.GetStoredFile(r.Context(), fileID)
+	if err != nil {
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+	if file == nil || file.UserID != userID || (file.Status != "active" && file.Status != "incomplete") {
+		http.Error(w, "file not found", http.StatusNotFound)
+		return
+	}
+
+	if r.URL.Query().Get("deep") == "true" {
+		v, started := fileprocessor.StartVerification(file)
+		w.Header().Set("Content-Type", "application/json")
+		if started {
+			w.WriteHeader(http.StatusAccepted)
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"verification_id": v.ID,
+			"status":          v.Status,
+			"status_url":      "/api/files/verify/" + v.ID,
+		})
+		return
+	}
+
+	user, err := store.GetUserByID(r.Context(), userID)
+	if err != nil || user == nil {
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+	linked := make(map[primitive.ObjectID]bool, len(user.DriveAccounts))
+	for _, acc := range user.DriveAccounts {
+		linked[acc.ID] = true
+	}
+	type chunkLink struct {
+		ChunkID        int    `json:"chunk_id"`
+		DriveAccountID string `json:"drive_account_id"`
+		Linked         bool   `json:"linked"`
+	}
+	ok := true
+	chunks := make([]chunkLink, 0, len(file.Chunks))
+	for _, c := range file.Chunks {
+		chunks = append(chunks, chunkLink{ChunkID: c.ChunkID, DriveAccountID: c.DriveAccountID.Hex(), Linked: linked[c.DriveAccountID]})
+		ok = ok && linked[c.DriveAccountID]
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"file_id": fileID.Hex(),
+		"ok":      ok,
+		"chunks":  chunks,
+	})
+}
+
+// VerificationStatusHandler - GET /api/files/verify/:verification_id
+// Reports the progress and per-chunk results of a deep verification
+func VerificationStatusHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("userID").(primitive.ObjectID)
+
+	v, ok := fileprocessor.GetVerification(userID, strings.TrimPrefix(r.URL.Path, "/api/files/verify/"))
+	if !ok {
+		http.Error(w, "verification not found", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,261 @@
+package filehandlers
+
+import (
+	"SE/internal/auth"
+	"SE/internal/drivemanager"
+	"SE/internal/middleware"
+	"SE/internal/models"
+	"SE/internal/store"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// createDownloadLink handles POST /api/files/:id/download/link. The link works without a JWT
+// until it expires, so it can be handed to a browser or another device.
+func createDownloadLink(w http.ResponseWriter, r *http.Request, fileID primitive.ObjectID) {
+	userID := r.Context().Value("userID").(primitive.ObjectID)
+
+	var req struct {
+		ExpiresInMinutes int  `json:"expires_in_minutes"` // 0 for the default
+		OneTime          bool `json:"one_time"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+		http.Error(w, "invalid request", http.StatusBadRequest)
+		return
+	}
+	lifetime, limit := auth.DownloadLinkLifetimes()
+	if req.ExpiresInMinutes < 0 {
+		http.Error(w, "expires_in_minutes must not be negative", http.StatusBadRequest)
+		return
+	}
+	if req.ExpiresInMinutes > 0 {
+		lifetime = time.Duration(req.ExpiresInMinutes) * time.Minute
+	}
+	if lifetime > limit {
+		http.Error(w, fmt.Sprintf("expires_in_minutes must be at most %d", int(limit.Minutes())), http.StatusBadRequest)
+		return
+	}
+
+	file, err := store.GetStoredFile(r.Context(), fileID)
+	if err != nil {
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+	if file == nil || file.UserID != userID || (file.Status != "active" && file.Status != "incomplete") {
+		http.Error(w, "file not found", http.StatusNotFound)
+		return
+	}
+	if file.Status == "incomplete" {
+		http.Error(w, "file is incomplete", http.StatusConflict)
+		return
+	}
+
+	link := &auth.DownloadLink{
+		UserID:    userID,
+		FileID:    fileID,
+		OneTime:   req.OneTime,
+		ExpiresAt: time.Now().UTC().Add(lifetime).Truncate(time.Second),
+	}
+	token, err := auth.SignDownloadLink(link)
+	if err != nil {
+		log.Printf("Failed to sign download link for file %s: %v", fileID.Hex(), err)
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+
+	// The link works for anyone who has it, the log included
+	middleware.OmitResponseBody(r)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"file_id":    fileID.Hex(),
+		"url":        linkURL(token),
+		"expires_at": link.ExpiresAt,
+		"one_time":   link.OneTime,
+	})
+}
+
+// SignedDownloadHandler - GET /api/links/:token
+// Downloads the file a signed link was made for; the link stands in for the JWT
+func SignedDownloadHandler(w http.ResponseWriter, r *http.Request) {
+	token := strings.TrimPrefix(r.URL.Path, "/api/links/")
+	middleware.RedactPath(r, token)
+	link, err := auth.ParseDownloadLink(token)
+	if err != nil {
+		http.Error(w, "invalid or expired link", http.StatusForbidden)
+		return
+	}
+
+	file, err := store.GetStoredFile(r.Context(), link.FileID)
+	if err != nil {
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+	// A file deleted since the link was made is gone for the link too
+	if file == nil || file.UserID != link.UserID || file.Status != "active" {
+		http.Error(w, "file not found", http.StatusNotFound)
+		return
+	}
+
+	if link.ChunkID != 0 {
+		serveChunk(w, r, file, link.ChunkID)
+		return
+	}
+	// Checked first so a bad name doesn't use up a one-time link
+	name, err := downloadName(r, file)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if link.OneTime {
+		ok, err := store.UseDownloadLink(r.Context(), link.ID, link.ExpiresAt)
+		if err != nil {
+			http.Error(w, "server error", http.StatusInternalServerError)
+			return
+		}
+		if !ok {
+			http.Error(w, "link already used", http.StatusGone)
+			return
+		}
+	}
+	serveDownload(w, r, file, name)
+}
+
+// linkURL is where a signed link token is used
+func linkURL(token string) string {
+	return strings.TrimSuffix(os.Getenv("BASE_URL"), "/") + "/api/links/" + token
+}
+
+// chunkURL is one chunk of a file as handed to a client reconstructing it itself
+type chunkURL struct {
+	ChunkID     int    `json:"chunk_id"`
+	StartOffset int64  `json:"start_offset"`
+	EndOffset   int64  `json:"end_offset"`
+	Size        int64  `json:"size"`
+	Checksum    string `json:"checksum"`
+	ShardIndex  int    `json:"shard_index,omitempty"`
+	Parity      bool   `json:"parity,omitempty"`
+	// HeaderSize bytes before the chunk's data at URL are its header, to skip
+	HeaderSize    int64  `json:"header_size"`
+	URL           string `json:"url"`
+	Authorization string `json:"authorization,omitempty"` // Authorization header URL needs
+}
+
+// chunkURLs handles GET /api/files/:id/download/chunks. It hands out where each chunk can be
+// downloaded so a client with the key file can rebuild the file without it passing through
+// here. Drive chunks come with the account's short-lived access token; chunks on drives a
+// client can't reach, like local drives, get a signed link to this server instead.
+func chunkURLs(w http.ResponseWriter, r *http.Request, fileID primitive.ObjectID) {
+	userID := r.Context().Value("userID").(primitive.ObjectID)
+
+	file, err := store.GetStoredFile(r.Context(), fileID)
+	if err != nil {
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+	if file == nil || file.UserID != userID || (file.Status != "active" && file.Status != "incomplete") {
+		http.Error(w, "file not found", http.StatusNotFound)
+		return
+	}
+	if file.Status == "incomplete" {
+		http.Error(w, "file is incomplete", http.StatusConflict)
+		return
+	}
+
+	// Everything handed out works until the first of it expires
+	linkLifetime, _ := auth.DownloadLinkLifetimes()
+	expiresAt := time.Now().UTC().Add(linkLifetime).Truncate(time.Second)
+	access := make(map[primitive.ObjectID]*drivemanager.DirectAccess)
+	for _, chunk := range file.Chunks {
+		if _, seen := access[chunk.DriveAccountID]; seen {
+			continue
+		}
+		a, err := drivemanager.DirectAccessFor(r.Context(), chunk.DriveAccountID)
+		if errors.Is(err, drivemanager.ErrNoDirectAccess) {
+			access[chunk.DriveAccountID] = nil
+			continue
+		}
+		if err != nil {
+			log.Printf("Failed to get direct access to drive account %s: %v", chunk.DriveAccountID.Hex(), err)
+			http.Error(w, "failed to access drive", http.StatusBadGateway)
+			return
+		}
+		access[chunk.DriveAccountID] = a
+		if a.ExpiresAt.Before(expiresAt) {
+			expiresAt = a.ExpiresAt.UTC().Truncate(time.Second)
+		}
+	}
+
+	chunks := make([]chunkURL, 0, len(file.Chunks))
+	for _, chunk := range file.Chunks {
+		c := chunkURL{
+			ChunkID:     chunk.ChunkID,
+			StartOffset: chunk.StartOffset,
+			EndOffset:   chunk.EndOffset,
+			Size:        chunk.Size,
+			Checksum:    chunk.Checksum,
+			ShardIndex:  chunk.ShardIndex,
+			Parity:      chunk.Parity,
+		}
+		if a := access[chunk.DriveAccountID]; a != nil {
+			c.URL = drivemanager.DirectFileURL(chunk.DriveFileID)
+			c.Authorization = a.Authorization
+			if chunk.HeaderVersion > 0 {
+				c.HeaderSize = drivemanager.ChunkHeaderSize
+			}
+		} else {
+			// Served by serveChunk, which leaves the header out
+			token, err := auth.SignDownloadLink(&auth.DownloadLink{UserID: userID, FileID: fileID, ChunkID: chunk.ChunkID, ExpiresAt: expiresAt})
+			if err != nil {
+				log.Printf("Failed to sign chunk link for file %s: %v", fileID.Hex(), err)
+				http.Error(w, "server error", http.StatusInternalServerError)
+				return
+			}
+			c.URL = linkURL(token)
+		}
+		chunks = append(chunks, c)
+	}
+
+	// Drive access tokens and chunk links work for anyone who has them, the log included
+	middleware.OmitResponseBody(r)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"file_id":    fileID.Hex(),
+		"expires_at": expiresAt,
+		"chunks":     chunks,
+	})
+}
+
+// serveChunk sends the data of one chunk of a file, for a chunk link made by chunkURLs
+func serveChunk(w http.ResponseWriter, r *http.Request, file *models.StoredFile, chunkID int) {
+	idx := slices.IndexFunc(file.Chunks, func(c models.StoredChunk) bool { return c.ChunkID == chunkID })
+	if idx < 0 {
+		http.Error(w, "chunk not found", http.StatusNotFound)
+		return
+	}
+	chunk := file.Chunks[idx]
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Length", strconv.FormatInt(chunk.Size, 10))
+	cw := &countingWriter{w: w, status: http.StatusOK}
+	err := drivemanager.StreamChunk(r.Context(), chunk.DriveAccountID, chunk.DriveFileID, file.ID, chunk.ChunkID, chunk.Size, chunk.HeaderVersion > 0, cw)
+	if err != nil {
+		log.Printf("Failed to serve chunk %d of file %s: %v", chunkID, file.ID.Hex(), err)
+		if cw.n > 0 {
+			panic(http.ErrAbortHandler)
+		}
+		w.Header().Del("Content-Length")
+		http.Error(w, "failed to download chunk", http.StatusBadGateway)
+	}
+}
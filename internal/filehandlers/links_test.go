@@ -0,0 +1,112 @@
+package filehandlers
+
+import (
+	"SE/internal/auth"
+	"SE/internal/middleware"
+	"SE/internal/models"
+	"SE/internal/oauth"
+	"SE/internal/store"
+	"SE/internal/store/storetest"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+// initLinkSigning sets up the keys download links are signed with
+func initLinkSigning(t *testing.T) {
+	t.Helper()
+	t.Setenv("JWT_SECRET", "links-test-secret")
+	if err := auth.InitJWTKeys(); err != nil {
+		t.Fatal(err)
+	}
+	auth.InitTokenConfig()
+}
+
+// logged runs h through the request logger and returns what it logged
+func logged(t *testing.T, h http.HandlerFunc, r *http.Request, want int) (*httptest.ResponseRecorder, string) {
+	t.Helper()
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+	w := serve(t, middleware.Logger(h).ServeHTTP, r, want)
+	return w, buf.String()
+}
+
+func TestDownloadLinkKeptOutOfLog(t *testing.T) {
+	user := setup(t)
+	initLinkSigning(t)
+	data := randomData(50000)
+	file := uploadFile(t, user.ID, "linked.bin", data)
+
+	w, out := logged(t, FileResourceHandler, storetest.Request("POST", "/api/files/"+file.ID.Hex()+"/download/link", nil, user.ID), http.StatusCreated)
+	var link struct {
+		URL string `json:"url"`
+	}
+	json.NewDecoder(w.Body).Decode(&link)
+	token := strings.TrimPrefix(link.URL, "/api/links/")
+	if token == link.URL || token == "" {
+		t.Fatalf("link URL = %q, want /api/links/<token>", link.URL)
+	}
+	if strings.Contains(out, token) {
+		t.Errorf("download link in the request log of its creation:\n%s", out)
+	}
+
+	w, out = logged(t, SignedDownloadHandler, httptest.NewRequest("GET", link.URL, nil), http.StatusOK)
+	if !bytes.Equal(w.Body.Bytes(), data) {
+		t.Error("download link serves different bytes")
+	}
+	if strings.Contains(out, token) || !strings.Contains(out, "/api/links/<redacted>") {
+		t.Errorf("download link in the request log of its download:\n%s", out)
+	}
+}
+
+func TestChunkURLsKeptOutOfLog(t *testing.T) {
+	user := setup(t)
+	t.Setenv("TOKEN_ENC_KEY", base64.StdEncoding.EncodeToString(randomData(32)))
+	oauth.InitOAuthConfig()
+	t.Cleanup(func() { models.SetSecretCipher(nil, nil) })
+	initLinkSigning(t)
+	ctx := context.Background()
+
+	// A Drive account whose access token is still good, so handing it out needs no refresh
+	tok, _ := json.Marshal(&oauth2.Token{AccessToken: "drive-access-token", TokenType: "Bearer", Expiry: time.Now().Add(time.Hour)})
+	sealed, err := oauth.Encrypt(tok)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.AddDriveAccountToUser(ctx, user.ID, models.DriveAccount{Provider: "google", AccountType: models.DriveAccountTypeOAuth, EncryptedToken: sealed}); err != nil {
+		t.Fatal(err)
+	}
+	drives := storetest.LocalDrives(t, user.ID, 0)
+	file := &models.StoredFile{UserID: user.ID, OriginalFilename: "split.bin", OriginalSize: 200, Chunks: []models.StoredChunk{
+		{ChunkID: 1, DriveAccountID: drives[2].ID, DriveFileID: "drive-file", Size: 100},
+		{ChunkID: 2, DriveAccountID: drives[0].ID, StartOffset: 100, EndOffset: 200, Size: 100},
+	}}
+	if err := store.CreateStoredFile(ctx, file); err != nil {
+		t.Fatal(err)
+	}
+
+	w, out := logged(t, FileResourceHandler, storetest.Request("GET", "/api/files/"+file.ID.Hex()+"/download/chunks", nil, user.ID), http.StatusOK)
+
+	var resp struct {
+		Chunks []chunkURL `json:"chunks"`
+	}
+	json.NewDecoder(w.Body).Decode(&resp)
+	if len(resp.Chunks) != 2 || resp.Chunks[0].Authorization != "Bearer drive-access-token" || !strings.Contains(resp.Chunks[1].URL, "/api/links/") {
+		t.Fatalf("chunks = %+v, want the Drive chunk with its token and the local one through a link", resp.Chunks)
+	}
+	linkToken := resp.Chunks[1].URL[strings.LastIndex(resp.Chunks[1].URL, "/")+1:]
+	if strings.Contains(out, "drive-access-token") || strings.Contains(out, linkToken) {
+		t.Errorf("Drive access token or chunk link in the request log:\n%s", out)
+	}
+}
@@ -0,0 +1,141 @@
+package filehandlers
+
+import (
+	"SE/internal/events"
+	"SE/internal/fileprocessor"
+	"SE/internal/jobs"
+	"SE/internal/models"
+	"SE/internal/store"
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// pauseCheckInterval is how often a running upload looks for a pause requested on another instance
+const pauseCheckInterval = 5 * time.Second
+
+// PauseUploadHandler - POST /api/files/upload/pause/:session_id
+// Processing stops once the chunks currently being sent are on their drives
+func PauseUploadHandler(w http.ResponseWriter, r *http.Request) {
+	session, ok := ownedSession(w, r, "/api/files/upload/pause/")
+	if !ok {
+		return
+	}
+
+	paused, err := fileprocessor.RequestPause(r.Context(), session.ID)
+	if err != nil {
+		http.Error(w, "failed to pause", http.StatusInternalServerError)
+		return
+	}
+	if !paused {
+		http.Error(w, "session is not processing", http.StatusConflict)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(map[string]string{
+		"session_id": session.ID.Hex(),
+		"status":     "pausing",
+	})
+}
+
+// ResumeUploadHandler - POST /api/files/upload/resume/:session_id
+// Queues a paused session again; it continues with the chunks not yet on a drive
+func ResumeUploadHandler(w http.ResponseWriter, r *http.Request) {
+	session, ok := ownedSession(w, r, "/api/files/upload/resume/")
+	if !ok {
+		return
+	}
+	if session.Status != "paused" {
+		http.Error(w, "session is not paused", http.StatusConflict)
+		return
+	}
+
+	// Resume with the settings the session was finalized with
+	job, err := store.GetSessionJob(r.Context(), session.ID)
+	if err != nil {
+		http.Error(w, "failed to get processing job", http.StatusInternalServerError)
+		return
+	}
+	if job == nil {
+		http.Error(w, "session has no processing job", http.StatusConflict)
+		return
+	}
+
+	resumed, err := fileprocessor.ResumeSession(r.Context(), session.ID)
+	if err != nil {
+		http.Error(w, "failed to resume", http.StatusInternalServerError)
+		return
+	}
+	if !resumed {
+		http.Error(w, "session is not paused", http.StatusConflict)
+		return
+	}
+	if err := jobs.Enqueue(r.Context(), session.ID, session.UserID, session.TotalSize, job.Request); err != nil {
+		log.Printf("Failed to queue resumed session %s: %v", session.ID.Hex(), err)
+		fileprocessor.UpdateSessionStatus(r.Context(), session.ID, "failed", session.ProcessingProgress, "Failed to queue processing")
+		http.Error(w, "failed to queue processing", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(map[string]string{
+		"session_id": session.ID.Hex(),
+		"status":     "processing",
+	})
+}
+
+// ownedSession loads the session named by the path after prefix, writing an error if it isn't the caller's
+func ownedSession(w http.ResponseWriter, r *http.Request, prefix string) (*models.UploadSession, bool) {
+	userID := r.Context().Value("userID").(primitive.ObjectID)
+
+	sessionID, err := primitive.ObjectIDFromHex(r.URL.Path[len(prefix):])
+	if err != nil {
+		http.Error(w, "invalid session_id", http.StatusBadRequest)
+		return nil, false
+	}
+	session, err := store.GetUploadSession(r.Context(), sessionID)
+	if err != nil {
+		http.Error(w, "failed to get session", http.StatusInternalServerError)
+		return nil, false
+	}
+	if session == nil || session.UserID != userID {
+		http.Error(w, "session not found", http.StatusNotFound)
+		return nil, false
+	}
+	return session, true
+}
+
+// watchPause returns a channel that is closed once a pause is requested for the session, and a
+// function to stop watching
+func watchPause(ctx context.Context, sessionID primitive.ObjectID) (<-chan struct{}, func()) {
+	pause := make(chan struct{})
+	ctx, cancel := context.WithCancel(ctx)
+	updates, unsubscribe := events.Subscribe(events.UploadTopic(sessionID))
+
+	jobs.Go(func() {
+		defer unsubscribe()
+		ticker := time.NewTicker(pauseCheckInterval)
+		defer ticker.Stop()
+		for {
+			session, err := store.GetUploadSession(ctx, sessionID)
+			if err == nil && session != nil && session.PauseRequested {
+				close(pause)
+				return
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-updates:
+			case <-ticker.C:
+			}
+		}
+	})
+	return pause, cancel
+}
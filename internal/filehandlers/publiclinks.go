@@ -0,0 +1,260 @@
+package filehandlers
+
+import (
+	"SE/internal/audit"
+	"SE/internal/middleware"
+	"SE/internal/models"
+	"SE/internal/store"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// publicLinkOut is the owner's view of a public link. URL, which holds the token, is only
+// known when the link is created.
+type publicLinkOut struct {
+	ID           primitive.ObjectID `json:"id"`
+	FileID       primitive.ObjectID `json:"file_id"`
+	URL          string             `json:"url,omitempty"`
+	HasPassword  bool               `json:"has_password"`
+	MaxDownloads int                `json:"max_downloads,omitempty"`
+	Downloads    int                `json:"downloads"`
+	ExpiresAt    *time.Time         `json:"expires_at,omitempty"`
+	Expired      bool               `json:"expired"` // past its expiry or out of downloads
+	CreatedAt    time.Time          `json:"created_at"`
+}
+
+func newPublicLinkOut(link *models.PublicLink) publicLinkOut {
+	return publicLinkOut{
+		ID:           link.ID,
+		FileID:       link.FileID,
+		HasPassword:  len(link.PasswordHash) > 0,
+		MaxDownloads: link.MaxDownloads,
+		Downloads:    link.Downloads,
+		ExpiresAt:    link.ExpiresAt,
+		Expired:      (link.ExpiresAt != nil && !time.Now().Before(*link.ExpiresAt)) || (link.MaxDownloads > 0 && link.Downloads >= link.MaxDownloads),
+		CreatedAt:    link.CreatedAt,
+	}
+}
+
+// hashPublicLinkToken is how public link tokens are stored, so a leaked database doesn't hand
+// out the files
+func hashPublicLinkToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// createPublicLink handles POST /api/files/:id/public-links. Anyone with the link can download
+// the file, after the password if it has one, until it expires or runs out of downloads.
+func createPublicLink(w http.ResponseWriter, r *http.Request, fileID primitive.ObjectID) {
+	userID := r.Context().Value("userID").(primitive.ObjectID)
+	// Neither the password nor the token in the response goes in the request log
+	middleware.OmitRequestBody(r)
+	middleware.OmitResponseBody(r)
+
+	var req struct {
+		Password       string `json:"password"`
+		MaxDownloads   int    `json:"max_downloads"`    // 0 for no limit
+		ExpiresInHours int    `json:"expires_in_hours"` // 0 never expires
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+		http.Error(w, "invalid request", http.StatusBadRequest)
+		return
+	}
+	if req.MaxDownloads < 0 {
+		http.Error(w, "max_downloads must not be negative", http.StatusBadRequest)
+		return
+	}
+	if req.ExpiresInHours < 0 {
+		http.Error(w, "expires_in_hours must not be negative", http.StatusBadRequest)
+		return
+	}
+	// bcrypt only looks at the first 72 bytes
+	if len(req.Password) > 72 {
+		http.Error(w, "password must be at most 72 bytes", http.StatusBadRequest)
+		return
+	}
+
+	file, ok := ownedFile(w, r, fileID)
+	if !ok {
+		return
+	}
+	if file.Status == "incomplete" {
+		http.Error(w, "file is incomplete", http.StatusConflict)
+		return
+	}
+
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+	token := base64.RawURLEncoding.EncodeToString(buf)
+	link := &models.PublicLink{
+		TokenHash:    hashPublicLinkToken(token),
+		FileID:       fileID,
+		UserID:       userID,
+		MaxDownloads: req.MaxDownloads,
+	}
+	if req.Password != "" {
+		hash, err := bcrypt.GenerateFromPassword([]byte(req.Password), bcrypt.DefaultCost)
+		if err != nil {
+			http.Error(w, "server error", http.StatusInternalServerError)
+			return
+		}
+		link.PasswordHash = hash
+	}
+	if req.ExpiresInHours > 0 {
+		exp := time.Now().UTC().Add(time.Duration(req.ExpiresInHours) * time.Hour).Truncate(time.Second)
+		link.ExpiresAt = &exp
+	}
+	if err := store.CreatePublicLink(r.Context(), link); err != nil {
+		log.Printf("Failed to create public link for file %s: %v", fileID.Hex(), err)
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+	audit.Record(r, models.AuditEvent{UserID: userID, Action: models.AuditPublicLinkCreated, Target: fileID.Hex(), Detail: file.OriginalFilename})
+
+	out := newPublicLinkOut(link)
+	out.URL = strings.TrimSuffix(os.Getenv("BASE_URL"), "/") + "/api/public/" + token
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(out)
+}
+
+// ListPublicLinksHandler - GET /api/public-links?file_id=
+// The caller's public links, only those to file_id if given, newest first
+func ListPublicLinksHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("userID").(primitive.ObjectID)
+
+	var fileID primitive.ObjectID
+	if v := r.URL.Query().Get("file_id"); v != "" {
+		var err error
+		if fileID, err = primitive.ObjectIDFromHex(v); err != nil {
+			http.Error(w, "invalid file_id", http.StatusBadRequest)
+			return
+		}
+	}
+	links, err := store.ListPublicLinks(r.Context(), userID, fileID)
+	if err != nil {
+		log.Printf("Failed to list public links: %v", err)
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+
+	out := make([]publicLinkOut, 0, len(links))
+	for _, l := range links {
+		out = append(out, newPublicLinkOut(l))
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"links": out})
+}
+
+// DeletePublicLinkHandler - DELETE /api/public-links/:id
+// Revokes a public link; downloads already started through it finish
+func DeletePublicLinkHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("userID").(primitive.ObjectID)
+
+	linkID, err := primitive.ObjectIDFromHex(strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/public-links/"), "/"))
+	if err != nil {
+		http.Error(w, "invalid link id", http.StatusBadRequest)
+		return
+	}
+	deleted, err := store.DeletePublicLink(r.Context(), userID, linkID)
+	if err != nil {
+		log.Printf("Failed to delete public link %s: %v", linkID.Hex(), err)
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+	if !deleted {
+		http.Error(w, "link not found", http.StatusNotFound)
+		return
+	}
+	audit.Record(r, models.AuditEvent{UserID: userID, Action: models.AuditPublicLinkRevoked, Target: linkID.Hex()})
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// PublicDownloadHandler - GET or POST /api/public/:token
+// Downloads the file of a public link without an account. A password goes in the
+// X-Link-Password header, or in a password form field when POSTed from a browser.
+func PublicDownloadHandler(w http.ResponseWriter, r *http.Request) {
+	token := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/public/"), "/")
+	// The token is as good as the link, and a form may carry the password
+	middleware.RedactPath(r, token)
+	middleware.OmitRequestBody(r)
+	if token == "" {
+		http.Error(w, "link not found", http.StatusNotFound)
+		return
+	}
+	link, err := store.GetPublicLink(r.Context(), hashPublicLinkToken(token))
+	if err != nil {
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+	if link == nil {
+		http.Error(w, "link not found", http.StatusNotFound)
+		return
+	}
+	if link.ExpiresAt != nil && !time.Now().Before(*link.ExpiresAt) {
+		http.Error(w, "link expired", http.StatusGone)
+		return
+	}
+	if link.MaxDownloads > 0 && link.Downloads >= link.MaxDownloads {
+		http.Error(w, "link has no downloads left", http.StatusGone)
+		return
+	}
+
+	if len(link.PasswordHash) > 0 {
+		password := r.Header.Get("X-Link-Password")
+		if password == "" && r.Method == "POST" {
+			password = r.PostFormValue("password")
+		}
+		if password == "" {
+			http.Error(w, "password required", http.StatusUnauthorized)
+			return
+		}
+		if bcrypt.CompareHashAndPassword(link.PasswordHash, []byte(password)) != nil {
+			http.Error(w, "wrong password", http.StatusForbidden)
+			return
+		}
+	}
+
+	file, err := store.GetStoredFile(r.Context(), link.FileID)
+	if err != nil {
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+	// A trashed file comes back to its links if it is restored
+	if file == nil || file.UserID != link.UserID || file.Status != "active" {
+		http.Error(w, "file not found", http.StatusNotFound)
+		return
+	}
+	// Checked first so a bad name doesn't use up a download
+	name, err := downloadName(r, file)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	ok, err := store.UsePublicLink(r.Context(), link.ID)
+	if err != nil {
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+	if !ok {
+		http.Error(w, "link has no downloads left", http.StatusGone)
+		return
+	}
+	serveDownload(w, r, file, name)
+}
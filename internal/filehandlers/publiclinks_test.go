@@ -0,0 +1,83 @@
+package filehandlers
+
+import (
+	"SE/internal/middleware"
+	"SE/internal/store/storetest"
+	"bytes"
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestPublicLinks(t *testing.T) {
+	user := setup(t)
+	data := randomData(100000)
+	file := uploadFile(t, user.ID, "public.bin", data)
+	path := "/api/files/" + file.ID.Hex() + "/public-links"
+
+	serve(t, FileResourceHandler, storetest.Request("POST", path, jsonBody(t, map[string]any{"max_downloads": -1}), user.ID), http.StatusBadRequest)
+	serve(t, FileResourceHandler, storetest.Request("POST", path, nil, storetest.User(t).ID), http.StatusNotFound)
+	var logged bytes.Buffer
+	log.SetOutput(&logged)
+	w := serve(t, middleware.Logger(http.HandlerFunc(FileResourceHandler)).ServeHTTP, storetest.Request("POST", path, jsonBody(t, map[string]any{"password": "s3cret", "max_downloads": 2}), user.ID), http.StatusCreated)
+	log.SetOutput(os.Stderr)
+	var link publicLinkOut
+	json.NewDecoder(w.Body).Decode(&link)
+	u, err := url.Parse(link.URL)
+	if err != nil || !strings.HasPrefix(u.Path, "/api/public/") || !link.HasPassword {
+		t.Fatalf("link = %+v, want a password-protected /api/public/ URL", link)
+	}
+	token := strings.TrimPrefix(u.Path, "/api/public/")
+	if strings.Contains(logged.String(), token) || strings.Contains(logged.String(), "s3cret") {
+		t.Errorf("link token or password in the request log:\n%s", logged.String())
+	}
+
+	// No account needed, only the password
+	download := func(password string, want int) *httptest.ResponseRecorder {
+		t.Helper()
+		r := httptest.NewRequest("GET", u.Path, nil)
+		if password != "" {
+			r.Header.Set("X-Link-Password", password)
+		}
+		return serve(t, PublicDownloadHandler, r, want)
+	}
+	download("", http.StatusUnauthorized)
+	download("wrong", http.StatusForbidden)
+	if w := download("s3cret", http.StatusOK); !bytes.Equal(w.Body.Bytes(), data) {
+		t.Error("public link downloads different bytes")
+	}
+	form := httptest.NewRequest("POST", u.Path, strings.NewReader("password=s3cret"))
+	form.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	logged.Reset()
+	log.SetOutput(&logged)
+	serve(t, middleware.Logger(http.HandlerFunc(PublicDownloadHandler)).ServeHTTP, form, http.StatusOK)
+	log.SetOutput(os.Stderr)
+	if strings.Contains(logged.String(), token) || strings.Contains(logged.String(), "s3cret") || !strings.Contains(logged.String(), "/api/public/<redacted>") {
+		t.Errorf("link token or password in the download's request log:\n%s", logged.String())
+	}
+	download("s3cret", http.StatusGone)
+	serve(t, PublicDownloadHandler, httptest.NewRequest("GET", "/api/public/no-such-token", nil), http.StatusNotFound)
+
+	// The owner lists and revokes links
+	w = serve(t, FileResourceHandler, storetest.Request("POST", path, jsonBody(t, map[string]any{"expires_in_hours": 1}), user.ID), http.StatusCreated)
+	var open publicLinkOut
+	json.NewDecoder(w.Body).Decode(&open)
+	w = serve(t, ListPublicLinksHandler, storetest.Request("GET", "/api/public-links?file_id="+file.ID.Hex(), nil, user.ID), http.StatusOK)
+	var list struct {
+		Links []publicLinkOut `json:"links"`
+	}
+	json.NewDecoder(w.Body).Decode(&list)
+	if len(list.Links) != 2 || list.Links[0].ID != open.ID || list.Links[0].URL != "" || !list.Links[1].Expired || list.Links[1].Downloads != 2 {
+		t.Errorf("links = %+v, want the open one, then the used up one, without their URLs", list.Links)
+	}
+	openURL, _ := url.Parse(open.URL)
+	serve(t, PublicDownloadHandler, httptest.NewRequest("GET", openURL.Path, nil), http.StatusOK)
+	serve(t, DeletePublicLinkHandler, storetest.Request("DELETE", "/api/public-links/"+open.ID.Hex(), nil, storetest.User(t).ID), http.StatusNotFound)
+	serve(t, DeletePublicLinkHandler, storetest.Request("DELETE", "/api/public-links/"+open.ID.Hex(), nil, user.ID), http.StatusNoContent)
+	serve(t, PublicDownloadHandler, httptest.NewRequest("GET", openURL.Path, nil), http.StatusNotFound)
+}
@@ -0,0 +1,60 @@
+package filehandlers
+
+import (
+	"SE/internal/jobs"
+	"SE/internal/models"
+	"SE/internal/store"
+	"context"
+	"log"
+	"os"
+	"time"
+)
+
+// recoveryGrace skips sessions that only just moved to processing, whose job another server
+// may be about to enqueue
+const recoveryGrace = 30 * time.Second
+
+// RecoverSessions sweeps sessions left in "processing" by a crash or deploy. Sessions whose job
+// is still queued or running are left to the queue, which resumes them once their lease
+// expires. A session whose job finished without the session doing so is requeued while its
+// uploaded file is still there; one without a job, or without its file, is marked failed and
+// its partially uploaded chunks are deleted from the drives.
+func RecoverSessions(ctx context.Context) error {
+	sessions, err := store.GetStalledSessions(ctx, time.Now().Add(-recoveryGrace))
+	if err != nil {
+		return err
+	}
+
+	var resumed, requeued, failed int
+	for _, session := range sessions {
+		job, err := store.GetSessionJob(ctx, session.ID)
+		if err != nil {
+			log.Printf("Recovery: failed to look up job for session %s: %v", session.ID.Hex(), err)
+			continue
+		}
+		if job != nil && (job.Status == models.JobQueued || job.Status == models.JobRunning) {
+			resumed++
+			continue
+		}
+
+		if job != nil && session.TempFilePath != "" {
+			if _, err := os.Stat(session.TempFilePath); err == nil {
+				if err := jobs.Enqueue(ctx, session.ID, session.UserID, session.TotalSize, job.Request); err != nil {
+					log.Printf("Recovery: failed to requeue session %s: %v", session.ID.Hex(), err)
+					continue
+				}
+				requeued++
+				continue
+			}
+		}
+
+		log.Printf("Recovery: session %s was left processing with nothing to resume it, marking failed", session.ID.Hex())
+		failSessionAndDiscard(ctx, session, "Processing was interrupted by a server restart")
+		failed++
+	}
+
+	if len(sessions) > 0 {
+		log.Printf("Recovery: %d sessions left processing: %d resumed by the job queue, %d requeued, %d failed", len(sessions), resumed, requeued, failed)
+	}
+	return nil
+}
@@ -0,0 +1,60 @@
+package filehandlers
+
+import (
+	"SE/internal/store"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// SearchFilesHandler - GET /api/files/search
+// Takes the filters, order and paging of GET /api/files/list, plus ?name= (part of the
+// filename), ?prefix= (start of the filename), ?text= (words in the filename, description or
+// tags) and ?min_size=/?max_size= in bytes.
+func SearchFilesHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("userID").(primitive.ObjectID)
+
+	query, ok := parseFileListQuery(w, r, userID)
+	if !ok {
+		return
+	}
+	q := r.URL.Query()
+	query.Name = strings.TrimSpace(q.Get("name"))
+	query.NamePrefix = strings.TrimLeft(q.Get("prefix"), " ")
+	query.Text = strings.TrimSpace(q.Get("text"))
+	for _, bound := range []struct {
+		name string
+		n    *int64
+	}{{"min_size", &query.MinSize}, {"max_size", &query.MaxSize}} {
+		if v := q.Get(bound.name); v != "" {
+			n, err := strconv.ParseInt(v, 10, 64)
+			if err != nil || n < 1 {
+				http.Error(w, bound.name+" must be a positive number of bytes", http.StatusBadRequest)
+				return
+			}
+			*bound.n = n
+		}
+	}
+	if query.MaxSize > 0 && query.MinSize > query.MaxSize {
+		http.Error(w, "min_size is above max_size", http.StatusBadRequest)
+		return
+	}
+
+	files, err := store.ListUserStoredFiles(r.Context(), userID, query)
+	if err != nil {
+		log.Printf("Failed to search stored files: %v", err)
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+
+	resp := map[string]interface{}{"files": storedFilesOut(files)}
+	if query.Limit > 0 && len(files) == query.Limit {
+		resp["next_cursor"] = store.CursorAfter(files[len(files)-1]).String()
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
@@ -0,0 +1,231 @@
+package filehandlers
+
+import (
+	"SE/internal/audit"
+	"SE/internal/events"
+	"SE/internal/fileprocessor"
+	"SE/internal/models"
+	"SE/internal/store"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// sessionOut is an upload session as listed to its owner
+type sessionOut struct {
+	ID                 primitive.ObjectID `json:"id"`
+	UserID             primitive.ObjectID `json:"user_id,omitzero"` // admin listings only
+	OriginalFilename   string             `json:"original_filename"`
+	Folder             string             `json:"folder,omitempty"`
+	BatchID            primitive.ObjectID `json:"batch_id,omitzero"`
+	Status             string             `json:"status"`
+	UploadedSize       int64              `json:"uploaded_size"`
+	TotalSize          int64              `json:"total_size"`
+	ProcessingProgress float64            `json:"processing_progress"`
+	ErrorMessage       string             `json:"error_message,omitempty"`
+	FileID             primitive.ObjectID `json:"file_id,omitzero"`
+	Client             *models.ClientInfo `json:"client,omitempty"`
+	CreatedAt          time.Time          `json:"created_at"`
+	ExpiresAt          time.Time          `json:"expires_at"`
+	CompletedAt        *time.Time         `json:"completed_at,omitempty"`
+}
+
+// ListUploadSessionsHandler - GET /api/files/upload/sessions?status=
+// The caller's active and recent upload sessions, newest first
+func ListUploadSessionsHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("userID").(primitive.ObjectID)
+
+	sessions, err := store.ListUserSessions(r.Context(), userID, r.URL.Query().Get("status"))
+	if err != nil {
+		log.Printf("Failed to list upload sessions: %v", err)
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+
+	out := make([]sessionOut, 0, len(sessions))
+	for _, s := range sessions {
+		out = append(out, sessionOut{
+			ID:                 s.ID,
+			OriginalFilename:   s.OriginalFilename,
+			Folder:             s.Folder,
+			BatchID:            s.BatchID,
+			Status:             s.Status,
+			UploadedSize:       s.UploadedSize,
+			TotalSize:          s.TotalSize,
+			ProcessingProgress: s.ProcessingProgress,
+			ErrorMessage:       s.ErrorMessage,
+			FileID:             s.FileID,
+			Client:             s.Client,
+			CreatedAt:          s.CreatedAt,
+			ExpiresAt:          s.ExpiresAt,
+			CompletedAt:        s.CompletedAt,
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"sessions": out,
+	})
+}
+
+// AdminSessionsHandler - GET /api/admin/sessions?user_id=&status=&limit=
+// Upload sessions of one or all users, newest first, for operators looking into stuck uploads
+func AdminSessionsHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	limit := 100
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > 1000 {
+			http.Error(w, "limit must be 1-1000", http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+
+	var sessions []*models.UploadSession
+	var err error
+	if v := q.Get("user_id"); v != "" {
+		userID, idErr := primitive.ObjectIDFromHex(v)
+		if idErr != nil {
+			http.Error(w, "invalid user id", http.StatusBadRequest)
+			return
+		}
+		sessions, err = store.ListUserSessions(r.Context(), userID, q.Get("status"))
+		if len(sessions) > limit {
+			sessions = sessions[:limit]
+		}
+	} else {
+		sessions, err = store.ListSessions(r.Context(), q.Get("status"), limit)
+	}
+	if err != nil {
+		log.Printf("Failed to list upload sessions: %v", err)
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+
+	out := make([]sessionOut, 0, len(sessions))
+	for _, s := range sessions {
+		out = append(out, sessionOut{
+			ID:                 s.ID,
+			UserID:             s.UserID,
+			OriginalFilename:   s.OriginalFilename,
+			Folder:             s.Folder,
+			BatchID:            s.BatchID,
+			Status:             s.Status,
+			UploadedSize:       s.UploadedSize,
+			TotalSize:          s.TotalSize,
+			ProcessingProgress: s.ProcessingProgress,
+			ErrorMessage:       s.ErrorMessage,
+			FileID:             s.FileID,
+			Client:             s.Client,
+			CreatedAt:          s.CreatedAt,
+			ExpiresAt:          s.ExpiresAt,
+			CompletedAt:        s.CompletedAt,
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"sessions": out,
+	})
+}
+
+// DeleteUploadSessionHandler - DELETE /api/files/upload/sessions/:session_id
+// Discards an abandoned session with its uploaded file and any chunks it left on drives
+func DeleteUploadSessionHandler(w http.ResponseWriter, r *http.Request) {
+	session, ok := ownedSession(w, r, "/api/files/upload/sessions/")
+	if !ok {
+		return
+	}
+	switch session.Status {
+	case "processing":
+		http.Error(w, "session is processing; pause it first", http.StatusConflict)
+		return
+	case "complete":
+		http.Error(w, "session is complete", http.StatusConflict)
+		return
+	}
+
+	deleted, err := store.DeleteIdleUploadSession(r.Context(), session.ID)
+	if err != nil {
+		log.Printf("Failed to delete upload session %s: %v", session.ID.Hex(), err)
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+	if !deleted {
+		http.Error(w, "session is processing; pause it first", http.StatusConflict)
+		return
+	}
+
+	// Chunks of an incomplete file belong to its stored file, which stays
+	if session.Checkpoint != nil && session.FileID.IsZero() {
+		uploaded := make(map[int]models.ChunkMetadata, len(session.Checkpoint.Chunks))
+		for _, chunk := range session.Checkpoint.Chunks {
+			uploaded[chunk.ChunkID] = chunk
+		}
+		discardUploadedChunks(r.Context(), session.ID, uploaded)
+	}
+	if session.TempFilePath != "" {
+		os.Remove(session.TempFilePath)
+	}
+	events.Publish(events.UploadTopic(session.ID), nil)
+	audit.Record(r, models.AuditEvent{UserID: session.UserID, Action: models.AuditUploadDeleted, Target: session.ID.Hex(), Detail: session.OriginalFilename})
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// ExtendUploadSessionHandler - POST /api/files/upload/extend/:session_id
+// Pushes back when an unfinished session expires; body {"hours": n} is optional
+func ExtendUploadSessionHandler(w http.ResponseWriter, r *http.Request) {
+	session, ok := ownedSession(w, r, "/api/files/upload/extend/")
+	if !ok {
+		return
+	}
+
+	var req struct {
+		Hours int `json:"hours,omitempty"`
+	}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "invalid request", http.StatusBadRequest)
+			return
+		}
+	}
+	if req.Hours < 0 {
+		http.Error(w, "hours must be positive", http.StatusBadRequest)
+		return
+	}
+
+	extended, err := fileprocessor.ExtendSession(r.Context(), session.ID, time.Duration(req.Hours)*time.Hour)
+	if errors.Is(err, fileprocessor.ErrExtensionTooLong) {
+		http.Error(w, fmt.Sprintf("hours must be at most %d", int(fileprocessor.MaxSessionExtension().Hours())), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to extend upload session %s: %v", session.ID.Hex(), err)
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+	if extended == nil {
+		if !time.Now().Before(session.ExpiresAt) {
+			http.Error(w, "session expired", http.StatusConflict)
+			return
+		}
+		http.Error(w, "session is "+session.Status, http.StatusConflict)
+		return
+	}
+	events.Publish(events.UploadTopic(session.ID), nil)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"session_id": extended.ID,
+		"expires_at": extended.ExpiresAt,
+	})
+}
@@ -0,0 +1,218 @@
+package filehandlers
+
+import (
+	"SE/internal/audit"
+	"SE/internal/models"
+	"SE/internal/store"
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// shareUser is a user a file is shared with or by
+type shareUser struct {
+	ID    primitive.ObjectID `json:"id"`
+	Email string             `json:"email"`
+}
+
+// shareOut is the owner's view of a share
+type shareOut struct {
+	FileID    primitive.ObjectID `json:"file_id"`
+	User      shareUser          `json:"user"`
+	CreatedAt time.Time          `json:"created_at"`
+}
+
+// sharedFileOut is the view of a file someone shared with the caller. It leaves out where the
+// owner keeps the file and uploaded it from.
+type sharedFileOut struct {
+	ID               primitive.ObjectID `json:"id"`
+	OriginalFilename string             `json:"original_filename"`
+	OriginalSize     int64              `json:"original_size"`
+	ContentType      string             `json:"content_type,omitempty"`
+	Status           string             `json:"status"`
+	Owner            shareUser          `json:"owner"`
+	SharedAt         time.Time          `json:"shared_at"`
+	CreatedAt        time.Time          `json:"created_at"`
+}
+
+// canDownload tells whether userID may download file: they own it, or it is shared with them
+func canDownload(ctx context.Context, file *models.StoredFile, userID primitive.ObjectID) (bool, error) {
+	if file.UserID == userID {
+		return true, nil
+	}
+	share, err := store.GetFileShare(ctx, file.ID, userID)
+	return share != nil, err
+}
+
+// ownedFile returns the caller's active or incomplete file, writing the error if there is none
+func ownedFile(w http.ResponseWriter, r *http.Request, fileID primitive.ObjectID) (*models.StoredFile, bool) {
+	userID := r.Context().Value("userID").(primitive.ObjectID)
+
+	file, err := store.GetStoredFile(r.Context(), fileID)
+	if err != nil {
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return nil, false
+	}
+	if file == nil || file.UserID != userID || (file.Status != "active" && file.Status != "incomplete") {
+		http.Error(w, "file not found", http.StatusNotFound)
+		return nil, false
+	}
+	return file, true
+}
+
+// shareFile handles POST /api/files/:id/share, which lets the registered user with the email in
+// the body download the file. The response is the same whether or not the email has an account,
+// or already has the file, so it can't be used to find out who is registered.
+func shareFile(w http.ResponseWriter, r *http.Request, fileID primitive.ObjectID) {
+	userID := r.Context().Value("userID").(primitive.ObjectID)
+
+	var req struct {
+		Email string `json:"email"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || strings.TrimSpace(req.Email) == "" {
+		http.Error(w, "email required", http.StatusBadRequest)
+		return
+	}
+	file, ok := ownedFile(w, r, fileID)
+	if !ok {
+		return
+	}
+	email := strings.ToLower(strings.TrimSpace(req.Email))
+	grantee, err := store.FindUserByEmail(r.Context(), email)
+	if err != nil {
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+	if grantee != nil && grantee.ID == userID {
+		http.Error(w, "can't share a file with yourself", http.StatusBadRequest)
+		return
+	}
+
+	if grantee != nil {
+		_, created, err := store.CreateFileShare(r.Context(), userID, fileID, grantee.ID)
+		if err != nil {
+			log.Printf("Failed to share file %s: %v", fileID.Hex(), err)
+			http.Error(w, "server error", http.StatusInternalServerError)
+			return
+		}
+		if created {
+			audit.Record(r, models.AuditEvent{UserID: userID, Action: models.AuditFileShared, Target: fileID.Hex(), Detail: file.OriginalFilename + " with " + grantee.Email})
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"file_id": fileID.Hex(),
+		"email":   email,
+		"message": "the file is shared if the email has an account",
+	})
+}
+
+// listFileShares handles GET /api/files/:id/share, who the owner shared the file with
+func listFileShares(w http.ResponseWriter, r *http.Request, fileID primitive.ObjectID) {
+	if _, ok := ownedFile(w, r, fileID); !ok {
+		return
+	}
+	shares, err := store.ListFileShares(r.Context(), fileID)
+	if err != nil {
+		log.Printf("Failed to list shares of file %s: %v", fileID.Hex(), err)
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+
+	out := make([]shareOut, 0, len(shares))
+	for _, s := range shares {
+		user, err := store.GetUserByID(r.Context(), s.UserID)
+		if err != nil {
+			http.Error(w, "server error", http.StatusInternalServerError)
+			return
+		}
+		if user == nil {
+			continue
+		}
+		out = append(out, shareOut{FileID: fileID, User: shareUser{ID: user.ID, Email: user.Email}, CreatedAt: s.CreatedAt})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"shares": out})
+}
+
+// revokeFileShare handles DELETE /api/files/:id/share/:user_id
+func revokeFileShare(w http.ResponseWriter, r *http.Request, fileID primitive.ObjectID, granteeHex string) {
+	userID := r.Context().Value("userID").(primitive.ObjectID)
+
+	granteeID, err := primitive.ObjectIDFromHex(granteeHex)
+	if err != nil {
+		http.Error(w, "invalid user id", http.StatusBadRequest)
+		return
+	}
+	revoked, err := store.DeleteFileShare(r.Context(), userID, fileID, granteeID)
+	if err != nil {
+		log.Printf("Failed to revoke share of file %s: %v", fileID.Hex(), err)
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+	if !revoked {
+		http.Error(w, "share not found", http.StatusNotFound)
+		return
+	}
+	audit.Record(r, models.AuditEvent{UserID: userID, Action: models.AuditShareRevoked, Target: fileID.Hex(), Detail: granteeHex})
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// ListSharedFilesHandler - GET /api/files/shared
+// Lists the files other users shared with the caller, newest share first. Files in their
+// owner's trash are left out until they are restored.
+func ListSharedFilesHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("userID").(primitive.ObjectID)
+
+	shares, err := store.ListUserShares(r.Context(), userID)
+	if err != nil {
+		log.Printf("Failed to list shared files: %v", err)
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+
+	owners := make(map[primitive.ObjectID]*models.User)
+	out := make([]sharedFileOut, 0, len(shares))
+	for _, s := range shares {
+		file, err := store.GetStoredFile(r.Context(), s.FileID)
+		if err != nil {
+			http.Error(w, "server error", http.StatusInternalServerError)
+			return
+		}
+		if file == nil || file.UserID != s.OwnerID || (file.Status != "active" && file.Status != "incomplete") {
+			continue
+		}
+		owner, seen := owners[s.OwnerID]
+		if !seen {
+			if owner, err = store.GetUserByID(r.Context(), s.OwnerID); err != nil {
+				http.Error(w, "server error", http.StatusInternalServerError)
+				return
+			}
+			owners[s.OwnerID] = owner
+		}
+		if owner == nil {
+			continue
+		}
+		out = append(out, sharedFileOut{
+			ID:               file.ID,
+			OriginalFilename: file.OriginalFilename,
+			OriginalSize:     file.OriginalSize,
+			ContentType:      file.ContentType,
+			Status:           file.Status,
+			Owner:            shareUser{ID: owner.ID, Email: owner.Email},
+			SharedAt:         s.CreatedAt,
+			CreatedAt:        file.CreatedAt,
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"files": out})
+}
@@ -0,0 +1,67 @@
+package filehandlers
+
+import (
+	"SE/internal/store/storetest"
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestShareFile(t *testing.T) {
+	owner := setup(t)
+	data := randomData(100000)
+	file := uploadFile(t, owner.ID, "shared.bin", data)
+	path := "/api/files/" + file.ID.Hex()
+	friend, stranger := storetest.User(t), storetest.User(t)
+
+	serve(t, FileResourceHandler, storetest.Request("GET", path+"/download", nil, friend.ID), http.StatusNotFound)
+	// Unknown emails look the same as known ones
+	nobody := serve(t, FileResourceHandler, storetest.Request("POST", path+"/share", jsonBody(t, map[string]any{"email": "nobody@example.com"}), owner.ID), http.StatusAccepted)
+	serve(t, FileResourceHandler, storetest.Request("POST", path+"/share", jsonBody(t, map[string]any{"email": owner.Email}), owner.ID), http.StatusBadRequest)
+	serve(t, FileResourceHandler, storetest.Request("POST", path+"/share", jsonBody(t, map[string]any{"email": stranger.Email}), friend.ID), http.StatusNotFound)
+	known := serve(t, FileResourceHandler, storetest.Request("POST", path+"/share", jsonBody(t, map[string]any{"email": " " + strings.ToUpper(friend.Email)}), owner.ID), http.StatusAccepted)
+	if strings.ReplaceAll(known.Body.String(), friend.Email, "nobody@example.com") != nobody.Body.String() {
+		t.Errorf("sharing with a user answered %s, with no user %s", known.Body, nobody.Body)
+	}
+	serve(t, FileResourceHandler, storetest.Request("POST", path+"/share", jsonBody(t, map[string]any{"email": friend.Email}), owner.ID), http.StatusAccepted)
+
+	w := serve(t, FileResourceHandler, storetest.Request("GET", path+"/share", nil, owner.ID), http.StatusOK)
+	var shares struct {
+		Shares []shareOut `json:"shares"`
+	}
+	json.NewDecoder(w.Body).Decode(&shares)
+	if len(shares.Shares) != 1 || shares.Shares[0].User.ID != friend.ID {
+		t.Errorf("shares = %+v, want the friend's", shares.Shares)
+	}
+
+	w = serve(t, ListSharedFilesHandler, storetest.Request("GET", "/api/files/shared", nil, friend.ID), http.StatusOK)
+	var shared struct {
+		Files []sharedFileOut `json:"files"`
+	}
+	json.NewDecoder(w.Body).Decode(&shared)
+	if len(shared.Files) != 1 || shared.Files[0].ID != file.ID || shared.Files[0].Owner.Email != owner.Email {
+		t.Fatalf("shared with friend = %+v, want the file from its owner", shared.Files)
+	}
+	w = serve(t, FileResourceHandler, storetest.Request("GET", path+"/download", nil, friend.ID), http.StatusOK)
+	if !bytes.Equal(w.Body.Bytes(), data) {
+		t.Error("friend downloaded different bytes")
+	}
+	// Sharing lets the friend download, nothing else
+	serve(t, FileResourceHandler, storetest.Request("DELETE", path, nil, friend.ID), http.StatusNotFound)
+	serve(t, FileResourceHandler, storetest.Request("GET", path+"/download", nil, stranger.ID), http.StatusNotFound)
+
+	// A trashed file drops out of the list until it is restored
+	serve(t, FileResourceHandler, storetest.Request("DELETE", path, nil, owner.ID), http.StatusNoContent)
+	serve(t, FileResourceHandler, storetest.Request("GET", path+"/download", nil, friend.ID), http.StatusNotFound)
+	w = serve(t, ListSharedFilesHandler, storetest.Request("GET", "/api/files/shared", nil, friend.ID), http.StatusOK)
+	if strings.Contains(w.Body.String(), file.ID.Hex()) {
+		t.Error("trashed file still listed as shared")
+	}
+	serve(t, FileResourceHandler, storetest.Request("POST", path+"/restore", nil, owner.ID), http.StatusOK)
+
+	serve(t, FileResourceHandler, storetest.Request("DELETE", path+"/share/"+friend.ID.Hex(), nil, friend.ID), http.StatusNotFound)
+	serve(t, FileResourceHandler, storetest.Request("DELETE", path+"/share/"+friend.ID.Hex(), nil, owner.ID), http.StatusNoContent)
+	serve(t, FileResourceHandler, storetest.Request("GET", path+"/download", nil, friend.ID), http.StatusNotFound)
+}
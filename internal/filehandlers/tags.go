@@ -0,0 +1,113 @@
+package filehandlers
+
+import (
+	"SE/internal/store"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// maxTags is how many tags a file can have
+const maxTags = 32
+
+// tagPattern is what a tag looks like once lowercased, e.g. "backup-2024"
+var tagPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_.:-]{0,63}$`)
+
+// cleanTag trims and lowercases a tag, so tags differing only in case are the same tag
+func cleanTag(tag string) (string, error) {
+	tag = strings.ToLower(strings.TrimSpace(tag))
+	if !tagPattern.MatchString(tag) {
+		return "", fmt.Errorf("invalid tag %q: use 1-64 letters, digits, _ . : or -", tag)
+	}
+	return tag, nil
+}
+
+// cleanTags cleans each of tags with cleanTag
+func cleanTags(tags []string) ([]string, error) {
+	cleaned := make([]string, 0, len(tags))
+	for _, t := range tags {
+		tag, err := cleanTag(t)
+		if err != nil {
+			return nil, err
+		}
+		cleaned = append(cleaned, tag)
+	}
+	return cleaned, nil
+}
+
+// tagFile handles POST and DELETE /api/files/:id/tags, which add and remove the tags in the
+// body. Tags the file already has, or doesn't have, are ignored.
+func tagFile(w http.ResponseWriter, r *http.Request, fileID primitive.ObjectID, add bool) {
+	userID := r.Context().Value("userID").(primitive.ObjectID)
+
+	var req struct {
+		Tags []string `json:"tags"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || len(req.Tags) == 0 {
+		http.Error(w, "tags required", http.StatusBadRequest)
+		return
+	}
+	tags, err := cleanTags(req.Tags)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	have, err := updateFileTags(r.Context(), userID, fileID, tags, add)
+	if err != nil {
+		http.Error(w, err.Error(), fileActionStatus(err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"id":   fileID.Hex(),
+		"tags": have,
+	})
+}
+
+// updateFileTags adds cleaned tags to one of the user's files, or removes them, and returns the
+// tags it has now. Only active files take new tags, up to maxTags.
+func updateFileTags(ctx context.Context, userID, fileID primitive.ObjectID, tags []string, add bool) ([]string, error) {
+	var (
+		have  []string
+		found bool
+		err   error
+	)
+	if add {
+		file, ferr := store.GetStoredFile(ctx, fileID)
+		if ferr != nil {
+			return nil, errServer
+		}
+		if file == nil || file.UserID != userID || file.Status != "active" {
+			return nil, errFileNotFound
+		}
+		all := make(map[string]bool)
+		for _, tag := range append(file.Tags, tags...) {
+			all[tag] = true
+		}
+		if len(all) > maxTags {
+			return nil, errTooManyTags
+		}
+		have, found, err = store.AddStoredFileTags(ctx, userID, fileID, tags)
+	} else {
+		have, found, err = store.RemoveStoredFileTags(ctx, userID, fileID, tags)
+	}
+	if err != nil {
+		log.Printf("Failed to update tags of file %s: %v", fileID.Hex(), err)
+		return nil, errServer
+	}
+	if !found {
+		return nil, errFileNotFound
+	}
+	if have == nil {
+		have = []string{}
+	}
+	return have, nil
+}
@@ -0,0 +1,92 @@
+package filehandlers
+
+import (
+	"SE/internal/audit"
+	"SE/internal/fileprocessor"
+	"SE/internal/models"
+	"SE/internal/store"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// ListTrashHandler - GET /api/files/trash
+// Lists the caller's trashed files with when they were trashed and when the purge deletes them.
+// Takes the filters, order and paging of GET /api/files/list, except status and view.
+func ListTrashHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("userID").(primitive.ObjectID)
+
+	query, ok := parseFileListQuery(w, r, userID)
+	if !ok {
+		return
+	}
+	query.Status = "trashed"
+
+	files, err := store.ListUserStoredFiles(r.Context(), userID, query)
+	if err != nil {
+		log.Printf("Failed to list trashed files: %v", err)
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+
+	resp := map[string]interface{}{"files": storedFilesOut(files)}
+	if query.Limit > 0 && len(files) == query.Limit {
+		resp["next_cursor"] = store.CursorAfter(files[len(files)-1]).String()
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// restoreFile handles POST /api/files/:id/restore, which takes a file out of the trash. It
+// counts toward the storage quota again, so it must fit.
+func restoreFile(w http.ResponseWriter, r *http.Request, fileID primitive.ObjectID) {
+	userID := r.Context().Value("userID").(primitive.ObjectID)
+
+	file, err := restoreTrashedFile(r, userID, fileID)
+	if err != nil {
+		http.Error(w, err.Error(), fileActionStatus(err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"id":     fileID.Hex(),
+		"path":   storedFilePath(file),
+		"status": file.Status,
+	})
+}
+
+// restoreTrashedFile takes one of the user's files out of the trash if it fits the quota, and
+// returns it restored. r is for the audit log.
+func restoreTrashedFile(r *http.Request, userID, fileID primitive.ObjectID) (*models.StoredFile, error) {
+	file, err := store.GetStoredFile(r.Context(), fileID)
+	if err != nil {
+		return nil, errServer
+	}
+	if file == nil || file.UserID != userID || file.Status != "trashed" {
+		return nil, errNotInTrash
+	}
+	if err := fileprocessor.CheckQuota(r.Context(), userID, file.OriginalSize); err != nil {
+		if errors.Is(err, fileprocessor.ErrQuotaExceeded) {
+			return nil, err
+		}
+		return nil, errServer
+	}
+
+	found, err := store.RestoreStoredFile(r.Context(), userID, fileID)
+	if err != nil {
+		log.Printf("Failed to restore file %s: %v", fileID.Hex(), err)
+		return nil, errServer
+	}
+	if !found {
+		return nil, errNotInTrash
+	}
+	if file, err = store.GetStoredFile(r.Context(), fileID); err != nil || file == nil {
+		return nil, errServer
+	}
+	audit.Record(r, models.AuditEvent{UserID: userID, Action: models.AuditFileRestored, Target: fileID.Hex(), Detail: file.OriginalFilename})
+	return file, nil
+}
@@ -0,0 +1,203 @@
+package filehandlers
+
+import (
+	"SE/internal/fileprocessor"
+	"SE/internal/middleware"
+	"SE/internal/models"
+	"SE/internal/store"
+	"archive/zip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// zipEntry is one file of a zip download
+type zipEntry struct {
+	file    *models.StoredFile
+	name    string // path inside the archive
+	fromKey bool   // known only from a key file, so not cached or recorded
+}
+
+// DownloadZipHandler - POST /api/files/download/zip
+// Streams a zip of several files, given by ID or by key file, reconstructing each in turn
+func DownloadZipHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("userID").(primitive.ObjectID)
+
+	var req struct {
+		FileIDs  []string         `json:"file_ids"`
+		KeyFiles []models.KeyFile `json:"key_files"`
+		Name     string           `json:"name"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid request", http.StatusBadRequest)
+		return
+	}
+	total := len(req.FileIDs) + len(req.KeyFiles)
+	if total == 0 {
+		http.Error(w, "file_ids or key_files required", http.StatusBadRequest)
+		return
+	}
+	if total > fileprocessor.MaxBatchFiles() {
+		http.Error(w, fmt.Sprintf("at most %d files per zip", fileprocessor.MaxBatchFiles()), http.StatusBadRequest)
+		return
+	}
+
+	entries := make([]zipEntry, 0, total)
+	for _, id := range req.FileIDs {
+		fileID, err := primitive.ObjectIDFromHex(id)
+		if err != nil {
+			http.Error(w, "invalid file id", http.StatusBadRequest)
+			return
+		}
+		file, err := store.GetStoredFile(r.Context(), fileID)
+		if err != nil {
+			http.Error(w, "server error", http.StatusInternalServerError)
+			return
+		}
+		if file == nil || file.UserID != userID || (file.Status != "active" && file.Status != "incomplete") {
+			http.Error(w, fmt.Sprintf("file %s not found", id), http.StatusNotFound)
+			return
+		}
+		if file.Status == "incomplete" {
+			http.Error(w, fmt.Sprintf("file %s is incomplete", id), http.StatusConflict)
+			return
+		}
+		entries = append(entries, zipEntry{file: file, name: strings.TrimPrefix(models.FilePath(file.Folder, file.OriginalFilename), "/")})
+	}
+
+	if len(req.KeyFiles) > 0 {
+		// Like undelete, key files only reach chunks on the caller's own drives
+		accounts, err := store.ListUserDriveAccounts(r.Context(), userID)
+		if err != nil {
+			http.Error(w, "server error", http.StatusInternalServerError)
+			return
+		}
+		owned := make(map[primitive.ObjectID]bool, len(accounts))
+		for _, a := range accounts {
+			owned[a.ID] = true
+		}
+		for i := range req.KeyFiles {
+			keyFile := &req.KeyFiles[i]
+			if err := fileprocessor.CheckKeyFile(keyFile); err != nil {
+				http.Error(w, fmt.Sprintf("key file %d: %v", i+1, err), http.StatusBadRequest)
+				return
+			}
+			file, err := fileprocessor.StoredFileFromKeyFile(keyFile, userID)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("key file %d: %v", i+1, err), http.StatusBadRequest)
+				return
+			}
+			for _, chunk := range file.Chunks {
+				if !owned[chunk.DriveAccountID] {
+					http.Error(w, fmt.Sprintf("key file %d: chunk %d belongs to a drive account that is not linked", i+1, chunk.ChunkID), http.StatusForbidden)
+					return
+				}
+			}
+			entries = append(entries, zipEntry{file: file, name: path.Base(models.FilePath("", file.OriginalFilename)), fromKey: true})
+		}
+	}
+
+	// Same paths get numbered like the batch key bundle
+	used := make(map[string]bool, len(entries))
+	for i := range entries {
+		name := entries[i].name
+		for n := 2; used[name]; n++ {
+			ext := path.Ext(entries[i].name)
+			name = fmt.Sprintf("%s (%d)%s", strings.TrimSuffix(entries[i].name, ext), n, ext)
+		}
+		used[name] = true
+		entries[i].name = name
+	}
+
+	zipName := req.Name
+	if zipName == "" {
+		zipName = "files"
+	}
+	if !strings.HasSuffix(zipName, ".zip") {
+		zipName += ".zip"
+	}
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", contentDisposition(path.Base(zipName)))
+
+	// Nothing goes out until the first entry has content, so a failure before that is still a 502
+	cw := &countingWriter{w: w, status: http.StatusOK}
+	zw := zip.NewWriter(cw)
+	for _, e := range entries {
+		if err := writeZipEntry(r, zw, e); err != nil {
+			log.Printf("Failed to add file %s to zip download: %v", e.file.ID.Hex(), err)
+			if cw.n > 0 {
+				// Headers are out; cut the connection so the client sees a broken archive
+				panic(http.ErrAbortHandler)
+			}
+			w.Header().Del("Content-Disposition")
+			if errors.Is(err, fileprocessor.ErrDownloadDiskFull) {
+				w.Header().Set("Retry-After", "60")
+				http.Error(w, "server is short on disk space, try again later", http.StatusServiceUnavailable)
+				return
+			}
+			http.Error(w, "failed to restore file", http.StatusBadGateway)
+			return
+		}
+		if !e.fromKey {
+			if err := store.RecordStoredFileDownload(r.Context(), e.file.ID, middleware.ClientInfo(r)); err != nil {
+				log.Printf("Failed to record download of file %s: %v", e.file.ID.Hex(), err)
+			}
+		}
+	}
+	if err := zw.Close(); err != nil {
+		log.Printf("Failed to finish zip download: %v", err)
+		panic(http.ErrAbortHandler)
+	}
+}
+
+// writeZipEntry adds one file to the archive, streaming it from its chunks when it can. Files
+// are stored uncompressed: their content is usually compressed already.
+func writeZipEntry(r *http.Request, zw *zip.Writer, e zipEntry) error {
+	header := &zip.FileHeader{Name: e.name, Method: zip.Store, Modified: e.file.CreatedAt}
+	header.SetMode(0o644)
+
+	var f *os.File
+	var err error
+	switch {
+	case e.fromKey && fileprocessor.CanStream(e.file):
+		return streamZipEntry(r, zw, header, e.file)
+	case e.fromKey:
+		f, err = fileprocessor.OpenRestoredCopy(r.Context(), e.file)
+	case fileprocessor.CanStream(e.file):
+		if f = fileprocessor.OpenCachedFile(e.file); f == nil {
+			return streamZipEntry(r, zw, header, e.file)
+		}
+	default:
+		f, _, err = fileprocessor.OpenRestoredFile(r.Context(), e.file)
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return copyZipEntry(zw, header, f)
+}
+
+func streamZipEntry(r *http.Request, zw *zip.Writer, header *zip.FileHeader, file *models.StoredFile) error {
+	entry, err := zw.CreateHeader(header)
+	if err != nil {
+		return err
+	}
+	return fileprocessor.StreamFile(r.Context(), file, entry)
+}
+
+func copyZipEntry(zw *zip.Writer, header *zip.FileHeader, src io.Reader) error {
+	entry, err := zw.CreateHeader(header)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(entry, src)
+	return err
+}
@@ -0,0 +1,118 @@
+package fileprocessor
+
+import (
+	"context"
+	"log"
+	"slices"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// batchJobTTL is how long a finished batch job can still be looked up
+const batchJobTTL = time.Hour
+
+// BatchJob applies one action to many of a user's files, one file at a time, in the
+// background. Batch jobs are only known to the process that runs them.
+type BatchJob struct {
+	ID          string         `json:"id"`
+	Action      string         `json:"action"`
+	Status      string         `json:"status"` // "running" or "done"
+	FilesTotal  int            `json:"files_total"`
+	FilesDone   int            `json:"files_done"`
+	FilesFailed int            `json:"files_failed"`
+	Files       []BatchJobFile `json:"files"`
+	StartedAt   time.Time      `json:"started_at"`
+	FinishedAt  *time.Time     `json:"finished_at,omitempty"`
+	ExpiresAt   *time.Time     `json:"expires_at,omitempty"` // when a finished batch job is forgotten
+	userID      primitive.ObjectID
+}
+
+// BatchJobFile is one file of a batch job
+type BatchJobFile struct {
+	FileID string `json:"file_id"`
+	Status string `json:"status"` // "pending", "done" or "failed"
+	Error  string `json:"error,omitempty"`
+}
+
+var (
+	batchJobsMu sync.Mutex
+	batchJobs   = make(map[string]*BatchJob)
+)
+
+// StartBatchJob starts calling apply on each of the user's files in turn. An error from apply
+// fails that file and the job goes on with the next one.
+func StartBatchJob(userID primitive.ObjectID, action string, fileIDs []primitive.ObjectID, apply func(ctx context.Context, fileID primitive.ObjectID) error) BatchJob {
+	job := &BatchJob{
+		ID:         primitive.NewObjectID().Hex(),
+		Action:     action,
+		Status:     "running",
+		FilesTotal: len(fileIDs),
+		Files:      make([]BatchJobFile, len(fileIDs)),
+		StartedAt:  time.Now().UTC(),
+		userID:     userID,
+	}
+	for i, id := range fileIDs {
+		job.Files[i] = BatchJobFile{FileID: id.Hex(), Status: "pending"}
+	}
+
+	batchJobsMu.Lock()
+	defer batchJobsMu.Unlock()
+	pruneBatchJobs()
+	batchJobs[job.ID] = job
+	go runBatchJob(context.Background(), job, fileIDs, apply)
+	return job.snapshot()
+}
+
+// GetBatchJob returns a batch job of the user's
+func GetBatchJob(userID primitive.ObjectID, id string) (BatchJob, bool) {
+	batchJobsMu.Lock()
+	defer batchJobsMu.Unlock()
+	pruneBatchJobs()
+	j, ok := batchJobs[id]
+	if !ok || j.userID != userID {
+		return BatchJob{}, false
+	}
+	return j.snapshot(), true
+}
+
+// pruneBatchJobs forgets batch jobs that expired. The caller holds batchJobsMu.
+func pruneBatchJobs() {
+	for id, j := range batchJobs {
+		if j.ExpiresAt != nil && time.Now().After(*j.ExpiresAt) {
+			delete(batchJobs, id)
+		}
+	}
+}
+
+// snapshot copies j for use outside batchJobsMu
+func (j *BatchJob) snapshot() BatchJob {
+	s := *j
+	s.Files = slices.Clone(j.Files)
+	return s
+}
+
+func runBatchJob(ctx context.Context, job *BatchJob, fileIDs []primitive.ObjectID, apply func(ctx context.Context, fileID primitive.ObjectID) error) {
+	for i, id := range fileIDs {
+		err := apply(ctx, id)
+
+		batchJobsMu.Lock()
+		f := &job.Files[i]
+		if err != nil {
+			log.Printf("Batch job %s: failed to %s file %s: %v", job.ID, job.Action, id.Hex(), err)
+			f.Status, f.Error = "failed", err.Error()
+			job.FilesFailed++
+		} else {
+			f.Status = "done"
+			job.FilesDone++
+		}
+		batchJobsMu.Unlock()
+	}
+
+	batchJobsMu.Lock()
+	now := time.Now().UTC()
+	expires := now.Add(batchJobTTL)
+	job.Status, job.FinishedAt, job.ExpiresAt = "done", &now, &expires
+	batchJobsMu.Unlock()
+}
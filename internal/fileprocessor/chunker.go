@@ -4,17 +4,16 @@ import (
 	"SE/internal/models"
 	"errors"
 	"fmt"
-	"io"
-	"os"
 	"sort"
 )
 
-// CalculateChunkPlan determines how to split file across drives
-func CalculateChunkPlan(fileSize int64, driveSpaces []models.DriveSpaceInfo, strategy models.ChunkingStrategy, manualSizes []int64) ([]models.ChunkPlan, error) {
-	// Filter available drives
+// CalculateChunkPlan determines how to split file across drives, honoring the user's placement policy
+func CalculateChunkPlan(fileSize int64, driveSpaces []models.DriveSpaceInfo, strategy models.ChunkingStrategy, manualSizes []int64, erasure *models.ErasureConfig, policy models.PlacementPolicy) ([]models.ChunkPlan, error) {
+	// Filter available drives, leaving room for chunk headers
 	availableDrives := make([]models.DriveSpaceInfo, 0)
 	var totalAvailable int64
 	for _, d := range driveSpaces {
+		d.FreeSpace = usableSpace(d.FreeSpace)
 		if d.Available && d.FreeSpace > 0 {
 			availableDrives = append(availableDrives, d)
 			totalAvailable += d.FreeSpace
@@ -30,18 +29,36 @@ func CalculateChunkPlan(fileSize int64, driveSpaces []models.DriveSpaceInfo, str
 		return nil, fmt.Errorf("insufficient total space: need %d bytes, have %d bytes", fileSize, totalAvailable)
 	}
 
-	switch strategy {
-	case models.StrategyGreedy:
-		return calculateGreedyPlan(fileSize, availableDrives)
-	case models.StrategyBalanced:
-		return calculateBalancedPlan(fileSize, availableDrives)
-	case models.StrategyProportional:
-		return calculateProportionalPlan(fileSize, availableDrives)
-	case models.StrategyManual:
-		return calculateManualPlan(fileSize, availableDrives, manualSizes)
-	default:
+	s, ok := LookupStrategy(strategy)
+	if !ok {
 		return nil, errors.New("invalid chunking strategy")
 	}
+
+	// Size-based strategies plan against capped space so no drive exceeds the max share
+	in := PlanInput{FileSize: fileSize, Drives: availableDrives, ManualSizes: manualSizes, Erasure: erasure}
+	if s.Capped() {
+		in.Drives = capDriveSpace(availableDrives, fileSize, policy)
+		var cappedTotal int64
+		for _, d := range in.Drives {
+			cappedTotal += d.FreeSpace
+		}
+		if cappedTotal < fileSize {
+			return nil, fmt.Errorf("placement policy allows at most %.1f%% of a file per drive: not enough drives with free space", policy.MaxSharePct)
+		}
+	}
+
+	plan, err := s.Plan(in)
+	if err != nil {
+		return nil, err
+	}
+	if plan, err = applyChunkSizeLimits(plan, in.Drives); err != nil {
+		return nil, err
+	}
+
+	if err := ValidatePlacement(plan, fileSize, policy); err != nil {
+		return nil, err
+	}
+	return plan, nil
 }
 
 // calculateGreedyPlan fills largest drive first
@@ -86,6 +103,50 @@ func calculateGreedyPlan(fileSize int64, drives []models.DriveSpaceInfo) ([]mode
 	return chunks, nil
 }
 
+// calculateMinDrivesPlan spreads the file over as few drives as possible: it fills the largest
+// drives until the rest fits on one more, then puts the rest on the smallest drive that holds it,
+// leaving the roomier ones free for files that need them
+func calculateMinDrivesPlan(fileSize int64, drives []models.DriveSpaceInfo) ([]models.ChunkPlan, error) {
+	sort.Slice(drives, func(i, j int) bool {
+		return drives[i].FreeSpace > drives[j].FreeSpace
+	})
+
+	chunks := make([]models.ChunkPlan, 0)
+	remaining := fileSize
+	offset := int64(0)
+	for i, drive := range drives {
+		if remaining <= drive.FreeSpace {
+			// The rest fits on one drive; drives are sorted, so search back from the smallest
+			last := drive
+			for j := len(drives) - 1; j > i; j-- {
+				if drives[j].FreeSpace >= remaining {
+					last = drives[j]
+					break
+				}
+			}
+			return append(chunks, models.ChunkPlan{
+				ChunkID:        len(chunks) + 1,
+				DriveAccountID: last.AccountID,
+				Size:           remaining,
+				StartOffset:    offset,
+				EndOffset:      offset + remaining,
+			}), nil
+		}
+
+		chunks = append(chunks, models.ChunkPlan{
+			ChunkID:        len(chunks) + 1,
+			DriveAccountID: drive.AccountID,
+			Size:           drive.FreeSpace,
+			StartOffset:    offset,
+			EndOffset:      offset + drive.FreeSpace,
+		})
+		remaining -= drive.FreeSpace
+		offset += drive.FreeSpace
+	}
+
+	return nil, fmt.Errorf("failed to allocate all chunks, %d bytes remaining", remaining)
+}
+
 // calculateBalancedPlan tries to balance chunks across drives
 func calculateBalancedPlan(fileSize int64, drives []models.DriveSpaceInfo) ([]models.ChunkPlan, error) {
 	numDrives := len(drives)
@@ -231,61 +292,65 @@ func calculateManualPlan(fileSize int64, drives []models.DriveSpaceInfo, manualS
 	return chunks, nil
 }
 
-// SplitFile splits a file into chunks according to plan
-func SplitFile(inputPath string, outputDir string, plan []models.ChunkPlan) ([]string, error) {
-	// Open input file
-	inFile, err := os.Open(inputPath)
-	if err != nil {
-		return nil, err
+// calculateErasurePlan places k data shards and m parity shards on distinct drives
+func calculateErasurePlan(fileSize int64, drives []models.DriveSpaceInfo, cfg *models.ErasureConfig) ([]models.ChunkPlan, error) {
+	parity := erasureParityShards
+	data := len(drives) - parity
+	if cfg != nil {
+		if cfg.ParityShards > 0 {
+			parity = cfg.ParityShards
+			data = len(drives) - parity
+		}
+		if cfg.DataShards > 0 {
+			data = cfg.DataShards
+		}
 	}
-	defer inFile.Close()
 
-	chunkPaths := make([]string, 0, len(plan))
+	if data < 1 || parity < 1 {
+		return nil, fmt.Errorf("erasure coding needs at least 1 data and 1 parity shard, got %d+%d", data, parity)
+	}
+	// Without a fixed shard count, use fewer data shards rather than ones below the minimum size
+	if minChunkSize > 0 && (cfg == nil || cfg.DataShards == 0) {
+		data = max(min(data, int(fileSize/minChunkSize)), 1)
+	}
+	if data+parity > len(drives) {
+		return nil, fmt.Errorf("erasure coding with %d+%d shards needs %d drives, have %d", data, parity, data+parity, len(drives))
+	}
 
-	for _, chunk := range plan {
-		// Create chunk file
-		chunkFilename := fmt.Sprintf("chunk_%03d.2xpfm", chunk.ChunkID)
-		chunkPath := fmt.Sprintf("%s/%s", outputDir, chunkFilename)
+	// Every shard has the same size; the last data shard is zero-padded
+	shardSize := (fileSize + int64(data) - 1) / int64(data)
+	if maxChunkSize > 0 && shardSize > maxChunkSize {
+		return nil, fmt.Errorf("erasure shards of %d bytes exceed the maximum chunk size of %d bytes: use more data shards", shardSize, maxChunkSize)
+	}
 
-		chunkFile, err := os.Create(chunkPath)
-		if err != nil {
-			// Cleanup on error
-			for _, path := range chunkPaths {
-				os.Remove(path)
-			}
-			return nil, err
-		}
+	// Use the roomiest drives, one shard per drive
+	sort.Slice(drives, func(i, j int) bool {
+		return drives[i].FreeSpace > drives[j].FreeSpace
+	})
 
-		// Seek to start offset
-		_, err = inFile.Seek(chunk.StartOffset, 0)
-		if err != nil {
-			chunkFile.Close()
-			for _, path := range chunkPaths {
-				os.Remove(path)
-			}
-			return nil, err
+	chunks := make([]models.ChunkPlan, 0, data+parity)
+	for i := 0; i < data+parity; i++ {
+		drive := drives[i]
+		if drive.FreeSpace < shardSize {
+			return nil, fmt.Errorf("drive %s has %d bytes free, shard needs %d", drive.AccountID.Hex(), drive.FreeSpace, shardSize)
 		}
 
-		// Copy chunk data
-		written, err := io.CopyN(chunkFile, inFile, chunk.Size)
-		chunkFile.Close()
-
-		if err != nil {
-			for _, path := range chunkPaths {
-				os.Remove(path)
-			}
-			return nil, err
+		chunk := models.ChunkPlan{
+			ChunkID:        i + 1,
+			DriveAccountID: drive.AccountID,
+			Size:           shardSize,
+			ShardIndex:     i,
+			Parity:         i >= data,
 		}
-
-		if written != chunk.Size {
-			for _, path := range chunkPaths {
-				os.Remove(path)
+		if !chunk.Parity {
+			chunk.StartOffset = int64(i) * shardSize
+			chunk.EndOffset = chunk.StartOffset + shardSize
+			if chunk.EndOffset > fileSize {
+				chunk.EndOffset = fileSize
 			}
-			return nil, fmt.Errorf("chunk %d: expected %d bytes, wrote %d bytes", chunk.ChunkID, chunk.Size, written)
 		}
-
-		chunkPaths = append(chunkPaths, chunkPath)
+		chunks = append(chunks, chunk)
 	}
 
-	return chunkPaths, nil
+	return chunks, nil
 }
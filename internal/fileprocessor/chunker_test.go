@@ -0,0 +1,44 @@
+package fileprocessor
+
+import (
+	"SE/internal/models"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestCalculateChunkPlan(t *testing.T) {
+	InitFileConfig()
+	drives := []models.DriveSpaceInfo{
+		{AccountID: primitive.NewObjectID(), FreeSpace: 50 << 20, Available: true},
+		{AccountID: primitive.NewObjectID(), FreeSpace: 20 << 20, Available: true},
+		{AccountID: primitive.NewObjectID(), FreeSpace: 1 << 30, Available: false},
+	}
+	fileSize := int64(30<<20 + 17)
+
+	for _, strategy := range []models.ChunkingStrategy{models.StrategyGreedy, models.StrategyBalanced, models.StrategyProportional, models.StrategyMinDrives} {
+		plan, err := CalculateChunkPlan(fileSize, drives, strategy, nil, nil, models.PlacementPolicy{})
+		if err != nil {
+			t.Errorf("%s: %v", strategy, err)
+			continue
+		}
+		// The chunks cover the file in order and stay on available drives
+		var offset int64
+		for _, c := range plan {
+			if c.StartOffset != offset || c.EndOffset-c.StartOffset != c.Size || c.Size <= 0 {
+				t.Errorf("%s: chunk %d is %d-%d (%d bytes), want it to start at %d", strategy, c.ChunkID, c.StartOffset, c.EndOffset, c.Size, offset)
+			}
+			if c.DriveAccountID == drives[2].AccountID {
+				t.Errorf("%s: chunk %d on an unavailable drive", strategy, c.ChunkID)
+			}
+			offset = c.EndOffset
+		}
+		if offset != fileSize {
+			t.Errorf("%s: plan covers %d bytes, want %d", strategy, offset, fileSize)
+		}
+	}
+
+	if _, err := CalculateChunkPlan(100<<20, drives, models.StrategyGreedy, nil, nil, models.PlacementPolicy{}); err == nil {
+		t.Error("planned a file bigger than the free space")
+	}
+}
@@ -0,0 +1,123 @@
+package fileprocessor
+
+import (
+	"SE/internal/drivemanager"
+	"SE/internal/models"
+	"fmt"
+	"slices"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// usableSpace is how much chunk data fits in free bytes of a drive once every chunk that may
+// end up there has its header. Strategies put at most one chunk on a drive, but oversized
+// chunks are split into pieces of at most MAX_CHUNK_SIZE_MB on the same drive.
+func usableSpace(free int64) int64 {
+	chunks := int64(1)
+	if maxChunkSize > 0 {
+		chunks = max((free+maxChunkSize-1)/maxChunkSize, 1)
+	}
+	return free - chunks*drivemanager.ChunkHeaderSize
+}
+
+// applyChunkSizeLimits reshapes a plan so no chunk is bigger than MAX_CHUNK_SIZE_MB or, unless
+// the file is that small, smaller than MIN_CHUNK_SIZE_MB. Undersized chunks are merged into a
+// neighbour or topped up from one, within the space drives has left; oversized ones are split
+// evenly on the same drive. Erasure shards are sized by calculateErasurePlan and left alone.
+func applyChunkSizeLimits(plan []models.ChunkPlan, drives []models.DriveSpaceInfo) ([]models.ChunkPlan, error) {
+	if (maxChunkSize == 0 && minChunkSize == 0) || slices.ContainsFunc(plan, func(c models.ChunkPlan) bool { return c.Parity }) {
+		return plan, nil
+	}
+
+	spare := make(map[primitive.ObjectID]int64, len(drives))
+	for _, d := range drives {
+		spare[d.AccountID] += d.FreeSpace
+	}
+	plan = slices.Clone(plan)
+	for _, c := range plan {
+		spare[c.DriveAccountID] -= c.Size
+	}
+
+	// move shifts n bytes at the boundary between adjacent chunks from one to the other
+	move := func(from, to int, n int64) {
+		if from < to {
+			plan[from].EndOffset -= n
+			plan[to].StartOffset -= n
+		} else {
+			plan[from].StartOffset += n
+			plan[to].EndOffset += n
+		}
+		plan[from].Size -= n
+		plan[to].Size += n
+		spare[plan[from].DriveAccountID] += n
+		spare[plan[to].DriveAccountID] -= n
+	}
+
+	if minChunkSize > 0 {
+		for i := 0; i < len(plan) && len(plan) > 1; {
+			if plan[i].Size >= minChunkSize {
+				i++
+				continue
+			}
+			var neighbours []int
+			if i > 0 {
+				neighbours = append(neighbours, i-1)
+			}
+			if i < len(plan)-1 {
+				neighbours = append(neighbours, i+1)
+			}
+
+			fixed := false
+			for _, j := range neighbours {
+				if plan[j].DriveAccountID == plan[i].DriveAccountID || spare[plan[j].DriveAccountID] >= plan[i].Size {
+					move(i, j, plan[i].Size)
+					plan = slices.Delete(plan, i, i+1)
+					fixed = true
+					break
+				}
+			}
+			if fixed {
+				continue
+			}
+			need := minChunkSize - plan[i].Size
+			for _, j := range neighbours {
+				if plan[j].Size-need >= minChunkSize && spare[plan[i].DriveAccountID] >= need {
+					move(j, i, need)
+					fixed = true
+					break
+				}
+			}
+			if !fixed {
+				return nil, fmt.Errorf("chunk of %d bytes is below the minimum chunk size of %d bytes and no drive has room to avoid it", plan[i].Size, minChunkSize)
+			}
+			i++
+		}
+	}
+
+	if maxChunkSize > 0 {
+		split := make([]models.ChunkPlan, 0, len(plan))
+		for _, c := range plan {
+			n := (c.Size + maxChunkSize - 1) / maxChunkSize
+			offset := c.StartOffset
+			for k := int64(0); k < n; k++ {
+				size := c.Size / n
+				if k < c.Size%n {
+					size++
+				}
+				split = append(split, models.ChunkPlan{
+					DriveAccountID: c.DriveAccountID,
+					Size:           size,
+					StartOffset:    offset,
+					EndOffset:      offset + size,
+				})
+				offset += size
+			}
+		}
+		plan = split
+	}
+
+	for i := range plan {
+		plan[i].ChunkID = i + 1
+	}
+	return plan, nil
+}
@@ -0,0 +1,10 @@
+//go:build !unix
+
+package fileprocessor
+
+import "errors"
+
+// freeDiskSpace is not implemented on this platform
+func freeDiskSpace(path string) (int64, error) {
+	return 0, errors.New("free space check not supported on this platform")
+}
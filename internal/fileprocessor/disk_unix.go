@@ -0,0 +1,14 @@
+//go:build unix
+
+package fileprocessor
+
+import "syscall"
+
+// freeDiskSpace returns the bytes available to unprivileged users on the filesystem holding path
+func freeDiskSpace(path string) (int64, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(path, &st); err != nil {
+		return 0, err
+	}
+	return int64(st.Bavail) * int64(st.Bsize), nil
+}
@@ -0,0 +1,277 @@
+package fileprocessor
+
+import (
+	"SE/internal/models"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/klauspost/reedsolomon"
+)
+
+// ErasureShardSources returns a reader for every shard in plan order. Data shards are read
+// straight from src, zero-padded to the shard size. Parity shards have to be computed up front,
+// so they are written to files in workDir; the caller removes them with the returned cleanup func.
+// Encoding stops with ctx's error once ctx is done.
+func ErasureShardSources(ctx context.Context, src io.ReaderAt, size int64, workDir string, plan []models.ChunkPlan, dataShards, parityShards int) ([]io.ReaderAt, func(), error) {
+	if len(plan) != dataShards+parityShards {
+		return nil, nil, fmt.Errorf("plan has %d shards, expected %d+%d", len(plan), dataShards, parityShards)
+	}
+
+	enc, err := reedsolomon.NewStream(dataShards, parityShards)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	shardSize := plan[0].Size
+	shards := make([]io.ReaderAt, dataShards+parityShards)
+	dataReaders := make([]io.Reader, dataShards)
+	for i := 0; i < dataShards; i++ {
+		shards[i] = &paddedSection{src: src, start: int64(i) * shardSize, length: shardSize, srcSize: size}
+		dataReaders[i] = &contextReader{ctx: ctx, r: io.NewSectionReader(shards[i], 0, shardSize)}
+	}
+
+	parityPaths := make([]string, parityShards)
+	for _, chunk := range plan {
+		if chunk.Parity {
+			parityPaths[chunk.ShardIndex-dataShards] = filepath.Join(workDir, fmt.Sprintf("chunk_%03d.2xpfm", chunk.ChunkID))
+		}
+	}
+	cleanup := func() {
+		for _, path := range parityPaths {
+			os.Remove(path)
+		}
+	}
+
+	parityFiles, err := createShardFiles(parityPaths)
+	if err != nil {
+		cleanup()
+		return nil, nil, err
+	}
+	err = enc.Encode(dataReaders, toWriters(parityFiles))
+	closeShardFiles(parityFiles)
+	if err != nil {
+		cleanup()
+		// The encoder's stream errors don't unwrap, and RunStage needs to see a deadline
+		if ctx.Err() != nil {
+			return nil, nil, ctx.Err()
+		}
+		return nil, nil, fmt.Errorf("failed to encode parity shards: %w", err)
+	}
+
+	parityReaders, err := openShardFiles(parityPaths)
+	if err != nil {
+		cleanup()
+		return nil, nil, err
+	}
+	for i, f := range parityReaders {
+		shards[dataShards+i] = f
+	}
+	closeAndCleanup := func() {
+		closeShardFiles(parityReaders)
+		cleanup()
+	}
+
+	// Return in plan order
+	sources := make([]io.ReaderAt, 0, len(plan))
+	for _, chunk := range plan {
+		sources = append(sources, shards[chunk.ShardIndex])
+	}
+	return sources, closeAndCleanup, nil
+}
+
+// paddedSection reads length bytes of src from start, with zeros past the end of src
+type paddedSection struct {
+	src     io.ReaderAt
+	start   int64
+	length  int64
+	srcSize int64
+}
+
+func (s *paddedSection) ReadAt(p []byte, off int64) (int, error) {
+	if off >= s.length {
+		return 0, io.EOF
+	}
+	if remaining := s.length - off; int64(len(p)) > remaining {
+		p = p[:remaining]
+	}
+
+	n := 0
+	if pos := s.start + off; pos < s.srcSize {
+		want := int(min(int64(len(p)), s.srcSize-pos))
+		m, err := s.src.ReadAt(p[:want], pos)
+		n = m
+		if err != nil && err != io.EOF {
+			return n, err
+		}
+		if m < want {
+			return n, io.ErrUnexpectedEOF
+		}
+	}
+	clear(p[n:])
+	n = len(p)
+
+	if off+int64(n) >= s.length {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// contextReader fails reads once ctx is done, so a long encode can be abandoned
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (c *contextReader) Read(p []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return c.r.Read(p)
+}
+
+// ReconstructErasureFile rebuilds the original file from available shards.
+// shardPaths is indexed by shard index; missing shards are given as "".
+func ReconstructErasureFile(shardPaths []string, outputPath string, dataShards, parityShards int, size int64) error {
+	if len(shardPaths) != dataShards+parityShards {
+		return fmt.Errorf("got %d shard paths, expected %d+%d", len(shardPaths), dataShards, parityShards)
+	}
+
+	enc, err := reedsolomon.NewStream(dataShards, parityShards)
+	if err != nil {
+		return err
+	}
+
+	// Rebuild missing data shards next to the output file. Parity is only needed as input.
+	missing := make([]string, len(shardPaths))
+	present := 0
+	for i, path := range shardPaths {
+		if path != "" {
+			present++
+		} else if i < dataShards {
+			missing[i] = fmt.Sprintf("%s.shard%03d", outputPath, i)
+		}
+	}
+	if present < dataShards {
+		return fmt.Errorf("need %d shards to reconstruct, only %d available", dataShards, present)
+	}
+	defer func() {
+		for _, path := range missing {
+			if path != "" {
+				os.Remove(path)
+			}
+		}
+	}()
+
+	if present < len(shardPaths) {
+		valid := make([]io.Reader, len(shardPaths))
+		fill := make([]io.Writer, len(shardPaths))
+		var opened []*os.File
+		for i, path := range shardPaths {
+			if path == "" {
+				if missing[i] == "" {
+					continue
+				}
+				f, err := os.Create(missing[i])
+				if err != nil {
+					closeShardFiles(opened)
+					return err
+				}
+				opened = append(opened, f)
+				fill[i] = f
+				continue
+			}
+			f, err := os.Open(path)
+			if err != nil {
+				closeShardFiles(opened)
+				return err
+			}
+			opened = append(opened, f)
+			valid[i] = f
+		}
+		err = enc.Reconstruct(valid, fill)
+		closeShardFiles(opened)
+		if err != nil {
+			return fmt.Errorf("failed to reconstruct shards: %w", err)
+		}
+	}
+
+	// Join data shards into the output
+	dataPaths := make([]string, dataShards)
+	for i := 0; i < dataShards; i++ {
+		dataPaths[i] = shardPaths[i]
+		if dataPaths[i] == "" {
+			dataPaths[i] = missing[i]
+		}
+	}
+	dataReaders, err := openShardFiles(dataPaths)
+	if err != nil {
+		return err
+	}
+	defer closeShardFiles(dataReaders)
+
+	outFile, err := os.Create(outputPath)
+	if err != nil {
+		return err
+	}
+	defer outFile.Close()
+
+	readers := make([]io.Reader, len(shardPaths))
+	copy(readers, toReaders(dataReaders))
+	if err := enc.Join(outFile, readers, size); err != nil {
+		os.Remove(outputPath)
+		return fmt.Errorf("failed to join shards: %w", err)
+	}
+
+	return nil
+}
+
+func createShardFiles(paths []string) ([]*os.File, error) {
+	files := make([]*os.File, 0, len(paths))
+	for _, path := range paths {
+		f, err := os.Create(path)
+		if err != nil {
+			closeShardFiles(files)
+			return nil, err
+		}
+		files = append(files, f)
+	}
+	return files, nil
+}
+
+func openShardFiles(paths []string) ([]*os.File, error) {
+	files := make([]*os.File, 0, len(paths))
+	for _, path := range paths {
+		f, err := os.Open(path)
+		if err != nil {
+			closeShardFiles(files)
+			return nil, err
+		}
+		files = append(files, f)
+	}
+	return files, nil
+}
+
+func closeShardFiles(files []*os.File) {
+	for _, f := range files {
+		f.Close()
+	}
+}
+
+func toReaders(files []*os.File) []io.Reader {
+	readers := make([]io.Reader, len(files))
+	for i, f := range files {
+		readers[i] = f
+	}
+	return readers
+}
+
+func toWriters(files []*os.File) []io.Writer {
+	writers := make([]io.Writer, len(files))
+	for i, f := range files {
+		writers[i] = f
+	}
+	return writers
+}
@@ -0,0 +1,140 @@
+package fileprocessor
+
+import (
+	"SE/internal/models"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/klauspost/reedsolomon"
+)
+
+// erasurePlan lays out dataShards+parityShards shards of a size-byte file like calculateErasurePlan
+func erasurePlan(size int64, dataShards, parityShards int) []models.ChunkPlan {
+	shardSize := (size + int64(dataShards) - 1) / int64(dataShards)
+	plan := make([]models.ChunkPlan, dataShards+parityShards)
+	for i := range plan {
+		plan[i] = models.ChunkPlan{ChunkID: i + 1, Size: shardSize, ShardIndex: i, Parity: i >= dataShards}
+	}
+	return plan
+}
+
+func TestErasureShardSourcesCancelled(t *testing.T) {
+	dir := t.TempDir()
+	data := bytes.Repeat([]byte("erasure"), 10000)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, _, err := ErasureShardSources(ctx, bytes.NewReader(data), int64(len(data)), dir, erasurePlan(int64(len(data)), 3, 2), 3, 2)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("encoding with a cancelled context = %v, want context.Canceled", err)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+		t.Errorf("cancelled encoding left %d files behind", len(entries))
+	}
+}
+
+func TestErasureShardSources(t *testing.T) {
+	data := bytes.Repeat([]byte("0123456789"), 1001)
+	size := int64(len(data))
+	plan := erasurePlan(size, 3, 2)
+	// Shards are uploaded in plan order, which needn't be shard order
+	plan[0], plan[4] = plan[4], plan[0]
+
+	sources, cleanup, err := ErasureShardSources(context.Background(), bytes.NewReader(data), size, t.TempDir(), plan, 3, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+	if len(sources) != len(plan) {
+		t.Fatalf("got %d sources, want %d", len(sources), len(plan))
+	}
+
+	shardSize := plan[0].Size
+	shards := make([][]byte, len(plan))
+	for i, chunk := range plan {
+		shards[chunk.ShardIndex] = make([]byte, shardSize)
+		if _, err := sources[i].ReadAt(shards[chunk.ShardIndex], 0); err != nil && !errors.Is(err, io.EOF) {
+			t.Fatalf("shard %d: %v", chunk.ShardIndex, err)
+		}
+	}
+
+	// Data shards are the file in order, the last one zero-padded
+	joined := bytes.Join(shards[:3], nil)
+	if !bytes.Equal(joined[:size], data) || bytes.Count(joined[size:], []byte{0}) != len(joined)-int(size) {
+		t.Error("data shards aren't the file split in order and zero-padded")
+	}
+	enc, _ := reedsolomon.New(3, 2)
+	if ok, err := enc.Verify(shards); !ok || err != nil {
+		t.Errorf("parity shards don't verify: %v", err)
+	}
+}
+
+func TestReconstructErasureFile(t *testing.T) {
+	dir := t.TempDir()
+	data := bytes.Repeat([]byte("reconstruct me"), 3333)
+	size := int64(len(data))
+	plan := erasurePlan(size, 4, 2)
+
+	sources, cleanup, err := ErasureShardSources(context.Background(), bytes.NewReader(data), size, dir, plan, 4, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	paths := make([]string, len(plan))
+	for i, chunk := range plan {
+		paths[chunk.ShardIndex] = filepath.Join(dir, fmt.Sprintf("shard_%d", chunk.ShardIndex))
+		f, err := os.Create(paths[chunk.ShardIndex])
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.Copy(f, io.NewSectionReader(sources[i], 0, chunk.Size))
+		f.Close()
+	}
+	cleanup()
+
+	tests := []struct {
+		name    string
+		missing []int
+		wantErr bool
+	}{
+		{"all shards", nil, false},
+		{"one data shard", []int{1}, false},
+		{"two data shards", []int{0, 3}, false},
+		{"data and parity", []int{2, 5}, false},
+		{"parity only", []int{4, 5}, false},
+		{"too many", []int{0, 1, 4}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			available := slices.Clone(paths)
+			for _, i := range tt.missing {
+				available[i] = ""
+			}
+			out := filepath.Join(t.TempDir(), "out")
+			err := ReconstructErasureFile(available, out, 4, 2, size)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("reconstructed a file from too few shards")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, _ := os.ReadFile(out)
+			if !bytes.Equal(got, data) {
+				t.Errorf("reconstructed %d bytes, want the original %d", len(got), len(data))
+			}
+			// Rebuilt data shards are temporary
+			if entries, _ := os.ReadDir(filepath.Dir(out)); len(entries) != 1 {
+				t.Errorf("reconstruction left %d files, want only the output", len(entries))
+			}
+		})
+	}
+}
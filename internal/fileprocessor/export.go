@@ -0,0 +1,220 @@
+package fileprocessor
+
+import (
+	"SE/internal/drivemanager"
+	"SE/internal/models"
+	"SE/internal/store"
+	"context"
+	"errors"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// ErrExportRunning is returned when the user already has an export running
+var ErrExportRunning = errors.New("an export is already running")
+
+// Export reconstructs every active file of a user, one at a time, into a staging directory
+// or, when DriveAccountID is set, as plain files onto that drive. Exports are only known to
+// the process that runs them.
+type Export struct {
+	ID             string       `json:"id"`
+	Status         string       `json:"status"` // "running" or "done"
+	DriveAccountID string       `json:"drive_account_id,omitempty"`
+	FilesTotal     int          `json:"files_total"`
+	FilesDone      int          `json:"files_done"`
+	FilesFailed    int          `json:"files_failed"`
+	BytesTotal     int64        `json:"bytes_total"`
+	BytesDone      int64        `json:"bytes_done"`
+	Files          []ExportFile `json:"files"`
+	StartedAt      time.Time    `json:"started_at"`
+	FinishedAt     *time.Time   `json:"finished_at,omitempty"`
+	ExpiresAt      *time.Time   `json:"expires_at,omitempty"` // when a finished export and its staged files are removed
+	userID         primitive.ObjectID
+	dir            string
+}
+
+// ExportFile is one file of an export
+type ExportFile struct {
+	FileID      string `json:"file_id"`
+	Path        string `json:"path"`
+	Size        int64  `json:"size"`
+	Status      string `json:"status"` // "pending", "done" or "failed"
+	Error       string `json:"error,omitempty"`
+	DriveFileID string `json:"drive_file_id,omitempty"`
+	staged      string // where the file was reconstructed, for staging exports
+	createdAt   time.Time
+}
+
+var (
+	exportsMu sync.Mutex
+	exports   = make(map[string]*Export)
+)
+
+// StartExport starts exporting every active file of the user, to the drive account if it's
+// not zero and to the staging directory otherwise
+func StartExport(ctx context.Context, userID, driveAccountID primitive.ObjectID) (Export, error) {
+	files, err := store.ListUserStoredFiles(ctx, userID, store.StoredFileQuery{})
+	if err != nil {
+		return Export{}, err
+	}
+
+	exportsMu.Lock()
+	defer exportsMu.Unlock()
+	pruneExports()
+	for _, e := range exports {
+		if e.userID == userID && e.Status == "running" {
+			return e.snapshot(), ErrExportRunning
+		}
+	}
+
+	export := &Export{
+		ID:        primitive.NewObjectID().Hex(),
+		Status:    "running",
+		Files:     []ExportFile{},
+		StartedAt: time.Now().UTC(),
+		userID:    userID,
+	}
+	export.dir = filepath.Join(exportDir, export.ID)
+	if !driveAccountID.IsZero() {
+		export.DriveAccountID = driveAccountID.Hex()
+	}
+	active := []*models.StoredFile{}
+	for _, f := range files {
+		// Incomplete files can't be reconstructed
+		if f.Status != "active" {
+			continue
+		}
+		active = append(active, f)
+		export.Files = append(export.Files, ExportFile{
+			FileID:    f.ID.Hex(),
+			Path:      models.FilePath(f.Folder, f.OriginalFilename),
+			Size:      f.OriginalSize,
+			Status:    "pending",
+			createdAt: f.CreatedAt,
+		})
+		export.BytesTotal += f.OriginalSize
+	}
+	export.FilesTotal = len(active)
+	exports[export.ID] = export
+	go runExport(context.Background(), export, active, driveAccountID)
+	return export.snapshot(), nil
+}
+
+// GetExport returns an export of the user's
+func GetExport(userID primitive.ObjectID, id string) (Export, bool) {
+	exportsMu.Lock()
+	defer exportsMu.Unlock()
+	pruneExports()
+	e, ok := exports[id]
+	if !ok || e.userID != userID {
+		return Export{}, false
+	}
+	return e.snapshot(), true
+}
+
+// ExportedFile is a file staged by an export
+type ExportedFile struct {
+	Path      string // as in the user's files, e.g. "/photos/a.jpg"
+	Staged    string // where it is on disk
+	CreatedAt time.Time
+}
+
+// ExportedFiles lists the files an export of the user's has staged so far
+func ExportedFiles(userID primitive.ObjectID, id string) ([]ExportedFile, bool) {
+	exportsMu.Lock()
+	defer exportsMu.Unlock()
+	e, ok := exports[id]
+	if !ok || e.userID != userID {
+		return nil, false
+	}
+	files := []ExportedFile{}
+	for _, f := range e.Files {
+		if f.staged != "" {
+			files = append(files, ExportedFile{Path: f.Path, Staged: f.staged, CreatedAt: f.createdAt})
+		}
+	}
+	return files, true
+}
+
+// pruneExports forgets exports that finished more than EXPORT_RETENTION_HOURS ago and
+// removes what they staged. The caller holds exportsMu.
+func pruneExports() {
+	for id, e := range exports {
+		if e.ExpiresAt != nil && time.Now().After(*e.ExpiresAt) {
+			os.RemoveAll(e.dir)
+			delete(exports, id)
+		}
+	}
+}
+
+// snapshot copies e for use outside exportsMu
+func (e *Export) snapshot() Export {
+	s := *e
+	s.Files = slices.Clone(e.Files)
+	return s
+}
+
+func runExport(ctx context.Context, export *Export, files []*models.StoredFile, driveAccountID primitive.ObjectID) {
+	for i, file := range files {
+		driveFileID, staged, err := exportFile(ctx, export, file, driveAccountID)
+
+		exportsMu.Lock()
+		f := &export.Files[i]
+		if err != nil {
+			log.Printf("Export %s: failed to export file %s: %v", export.ID, file.ID.Hex(), err)
+			f.Status, f.Error = "failed", err.Error()
+			export.FilesFailed++
+		} else {
+			f.Status, f.DriveFileID, f.staged = "done", driveFileID, staged
+			export.FilesDone++
+			export.BytesDone += file.OriginalSize
+		}
+		exportsMu.Unlock()
+	}
+	if !driveAccountID.IsZero() {
+		os.RemoveAll(export.dir)
+	}
+
+	exportsMu.Lock()
+	now := time.Now().UTC()
+	expires := now.Add(exportRetention)
+	export.Status, export.FinishedAt, export.ExpiresAt = "done", &now, &expires
+	exportsMu.Unlock()
+}
+
+// exportFile reconstructs one file into the export's staging directory, and moves it on to
+// the drive for a drive export. It returns the drive file or the staged file.
+func exportFile(ctx context.Context, export *Export, file *models.StoredFile, driveAccountID primitive.ObjectID) (string, string, error) {
+	if err := os.MkdirAll(export.dir, 0755); err != nil {
+		return "", "", err
+	}
+	// Staged by ID, as two files can have the same path
+	staged := filepath.Join(export.dir, file.ID.Hex())
+	if err := RestoreFile(ctx, file, staged); err != nil {
+		os.Remove(staged)
+		return "", "", err
+	}
+	if driveAccountID.IsZero() {
+		return "", staged, nil
+	}
+
+	defer os.Remove(staged)
+	f, err := os.Open(staged)
+	if err != nil {
+		return "", "", err
+	}
+	defer f.Close()
+	name := strings.TrimPrefix(models.FilePath(file.Folder, file.OriginalFilename), "/")
+	driveFileID, _, err := drivemanager.UploadChunkToDrive(ctx, driveAccountID, f, file.OriginalSize, name)
+	if err != nil {
+		return "", "", err
+	}
+	return driveFileID, "", nil
+}
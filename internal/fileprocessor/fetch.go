@@ -0,0 +1,261 @@
+package fileprocessor
+
+import (
+	"SE/internal/models"
+	"SE/internal/store"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"syscall"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// ErrRemoteRejected is returned for remote files that can't be fetched because of what they
+// are or where they live, as opposed to the fetch itself failing
+var ErrRemoteRejected = errors.New("remote file rejected")
+
+var errPrivateAddress = fmt.Errorf("%w: address is not public", ErrRemoteRejected)
+
+// fetchProgressInterval is how often a running fetch records the bytes received so far
+const fetchProgressInterval = time.Second
+
+// fetchClient fetches remote files. Every connection, including after a redirect, is checked
+// against the resolved address so a public name can't point the server at its own network.
+var fetchClient = &http.Client{
+	Transport: &http.Transport{
+		// No proxy, so the dialer sees the real destination
+		Proxy: nil,
+		DialContext: (&net.Dialer{
+			Timeout: 30 * time.Second,
+			Control: func(network, address string, c syscall.RawConn) error {
+				if fetchAllowPrivate {
+					return nil
+				}
+				host, _, err := net.SplitHostPort(address)
+				if err != nil {
+					return err
+				}
+				if !publicAddress(net.ParseIP(host)) {
+					return errPrivateAddress
+				}
+				return nil
+			},
+		}).DialContext,
+		TLSHandshakeTimeout:   30 * time.Second,
+		ResponseHeaderTimeout: 60 * time.Second,
+	},
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		if len(via) >= 10 {
+			return errors.New("too many redirects")
+		}
+		if req.URL.Scheme != "http" && req.URL.Scheme != "https" {
+			return fmt.Errorf("%w: redirect to a non-http URL", ErrRemoteRejected)
+		}
+		return nil
+	},
+}
+
+// blockedNets are ranges outside the net.IP checks that can still lead to internal hosts
+var blockedNets = func() []*net.IPNet {
+	var nets []*net.IPNet
+	for _, cidr := range []string{
+		"0.0.0.0/8",     // "this network", which reaches the local host
+		"100.64.0.0/10", // carrier-grade NAT
+		"198.18.0.0/15", // benchmarking, used inside some networks
+		"240.0.0.0/4",   // reserved
+		"64:ff9b::/96",  // NAT64, which maps to any IPv4 address
+	} {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		nets = append(nets, n)
+	}
+	return nets
+}()
+
+// publicAddress reports whether a fetch may connect to ip
+func publicAddress(ip net.IP) bool {
+	if ip == nil || ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsMulticast() {
+		return false
+	}
+	for _, n := range blockedNets {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// RemoteFile is a remote resource whose response headers passed the fetch limits
+type RemoteFile struct {
+	URL         string
+	Size        int64
+	ContentType string
+	Filename    string // from Content-Disposition or the URL path, empty if neither names the file
+	body        io.ReadCloser
+	cancel      context.CancelFunc
+}
+
+// Close abandons the fetch
+func (f *RemoteFile) Close() error {
+	f.cancel()
+	return f.body.Close()
+}
+
+// OpenRemoteFile starts fetching an http(s) URL. The fetch runs for at most URL_FETCH_TIMEOUT_MINUTES
+// regardless of the caller's context, so it can outlive the request that started it. The remote
+// server must report the size, within MAX_FILE_SIZE_GB, and a type allowed by URL_FETCH_ALLOWED_TYPES;
+// otherwise the error wraps ErrRemoteRejected.
+func OpenRemoteFile(rawURL string) (*RemoteFile, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("%w: url must be an http or https URL", ErrRemoteRejected)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), fetchTimeout)
+	req, err := http.NewRequestWithContext(ctx, "GET", u.String(), nil)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	resp, err := fetchClient.Do(req)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	f := &RemoteFile{
+		URL:         u.String(),
+		Size:        resp.ContentLength,
+		ContentType: resp.Header.Get("Content-Type"),
+		Filename:    remoteFilename(resp),
+		body:        resp.Body,
+		cancel:      cancel,
+	}
+	if err := checkRemoteFile(resp, f); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+func checkRemoteFile(resp *http.Response, f *RemoteFile) error {
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%w: remote server returned %s", ErrRemoteRejected, resp.Status)
+	}
+	if f.Size < 0 {
+		return fmt.Errorf("%w: remote server did not report a size", ErrRemoteRejected)
+	}
+	if f.Size == 0 {
+		return fmt.Errorf("%w: remote file is empty", ErrRemoteRejected)
+	}
+	if f.Size > maxFileSizeBytes {
+		return fmt.Errorf("%w: file size %d exceeds maximum allowed %d bytes", ErrRemoteRejected, f.Size, maxFileSizeBytes)
+	}
+	if len(fetchAllowedTypes) > 0 {
+		mediaType, _, _ := mime.ParseMediaType(f.ContentType)
+		allowed := false
+		for _, t := range fetchAllowedTypes {
+			if mediaType == t || (strings.HasSuffix(t, "/") && strings.HasPrefix(mediaType, t)) {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return fmt.Errorf("%w: content type %q is not allowed", ErrRemoteRejected, mediaType)
+		}
+	}
+	return nil
+}
+
+// remoteFilename is the name the server gives the file, or the last segment of the final URL
+func remoteFilename(resp *http.Response) string {
+	name := ""
+	if _, params, err := mime.ParseMediaType(resp.Header.Get("Content-Disposition")); err == nil {
+		name = params["filename"]
+	}
+	if name == "" && resp.Request != nil {
+		name = resp.Request.URL.Path
+	}
+	name = path.Base(strings.ReplaceAll(name, `\`, "/"))
+	if name == "." || name == ".." || name == "/" {
+		return ""
+	}
+	return name
+}
+
+// CreateURLUploadSession creates an upload session filled by fetching a remote file. It stays
+// alive for the whole fetch, which may take longer than an ordinary session is kept.
+func CreateURLUploadSession(ctx context.Context, userID primitive.ObjectID, filename, folder string, remote *RemoteFile, client *models.ClientInfo) (*models.UploadSession, error) {
+	if err := checkConcurrentUploads(ctx, userID); err != nil {
+		return nil, err
+	}
+	if err := CheckQuota(ctx, userID, remote.Size); err != nil {
+		return nil, err
+	}
+
+	session := newUploadSession(userID, filename, folder, remote.Size, client)
+	session.SourceURL = remote.URL
+	session.ErrorMessage = "Fetching from URL..."
+	session.ExpiresAt = session.ExpiresAt.Add(fetchTimeout)
+	if err := store.CreateUploadSession(ctx, session); err != nil {
+		return nil, err
+	}
+	return session, nil
+}
+
+// FetchRemoteFile copies a remote file into the session's temp file, recording the bytes
+// received as it goes so progress shows on the status endpoint and event stream
+func FetchRemoteFile(ctx context.Context, session *models.UploadSession, remote *RemoteFile) error {
+	tempFile, err := os.OpenFile(session.TempFilePath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	defer tempFile.Close()
+
+	// Read one byte past the reported size to catch a server sending more than it said
+	body := io.LimitReader(remote.body, remote.Size+1)
+	buf := make([]byte, 1<<20)
+	var written, recorded int64
+	lastRecord := time.Now()
+	for {
+		n, readErr := body.Read(buf)
+		if n > 0 {
+			if written+int64(n) > remote.Size {
+				return errors.New("remote server sent more than its reported size")
+			}
+			if _, err := tempFile.Write(buf[:n]); err != nil {
+				return err
+			}
+			written += int64(n)
+		}
+		if written > recorded && (time.Since(lastRecord) >= fetchProgressInterval || written == remote.Size) {
+			if _, err := RecordReceivedRange(ctx, session.ID, recorded, written); err != nil {
+				return err
+			}
+			recorded, lastRecord = written, time.Now()
+		}
+		if readErr == io.EOF {
+			break
+		}
+		if readErr != nil {
+			return readErr
+		}
+	}
+	if written != remote.Size {
+		return fmt.Errorf("remote server sent %d of %d bytes", written, remote.Size)
+	}
+	return nil
+}
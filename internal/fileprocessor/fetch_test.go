@@ -0,0 +1,47 @@
+package fileprocessor
+
+import (
+	"net"
+	"testing"
+)
+
+func TestPublicAddress(t *testing.T) {
+	for _, tc := range []struct {
+		ip   string
+		want bool
+	}{
+		{"93.184.216.34", true},
+		{"2606:2800:220:1:248:1893:25c8:1946", true},
+		{"127.0.0.1", false},
+		{"::1", false},
+		{"10.1.2.3", false},
+		{"172.16.0.1", false},
+		{"192.168.1.1", false},
+		{"fd00::1", false},
+		{"169.254.169.254", false},
+		{"fe80::1", false},
+		{"224.0.0.1", false},
+		{"0.0.0.0", false},
+		{"::", false},
+		{"0.1.2.3", false},
+		{"100.64.0.1", false},
+		{"100.127.255.254", false},
+		{"100.128.0.1", true},
+		{"198.18.0.1", false},
+		{"198.19.255.254", false},
+		{"198.20.0.1", true},
+		{"240.0.0.1", false},
+		{"255.255.255.255", false},
+		{"64:ff9b::a00:1", false},
+		{"64:ff9b::7f00:1", false},
+		{"::ffff:100.64.0.1", false},
+		{"::ffff:127.0.0.1", false},
+	} {
+		if got := publicAddress(net.ParseIP(tc.ip)); got != tc.want {
+			t.Errorf("publicAddress(%s) = %v, want %v", tc.ip, got, tc.want)
+		}
+	}
+	if publicAddress(nil) {
+		t.Error("publicAddress(nil) = true, want false")
+	}
+}
@@ -6,24 +6,35 @@ import (
 	"fmt"
 	"os"
 	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
+// KeyFileName is the name of the key file of a file called filename
+func KeyFileName(filename string) string {
+	return filename + keyFileSuffix
+}
+
 // GenerateKeyFile creates the key file with all metadata
 func GenerateKeyFile(
+	fileID primitive.ObjectID,
 	originalFilename string,
 	originalSize int64,
 	processedSize int64,
 	obfuscation *models.ObfuscationMetadata,
 	chunks []models.ChunkMetadata,
+	erasure *models.ErasureMetadata,
 	outputPath string,
 ) error {
 	keyFile := models.KeyFile{
 		Version:          "1.0",
+		FileID:           fileID.Hex(),
 		OriginalFilename: originalFilename,
 		OriginalSize:     originalSize,
 		ProcessedSize:    processedSize,
 		Obfuscation:      *obfuscation,
 		Chunks:           chunks,
+		Erasure:          erasure,
 		CreatedAt:        time.Now(),
 	}
 
@@ -52,20 +63,114 @@ func ValidateKeyFile(keyFilePath string) (*models.KeyFile, error) {
 	if err := json.Unmarshal(data, &keyFile); err != nil {
 		return nil, fmt.Errorf("failed to parse key file: %w", err)
 	}
+	if err := CheckKeyFile(&keyFile); err != nil {
+		return nil, err
+	}
+	return &keyFile, nil
+}
 
-	// Basic validation
+// CheckKeyFile checks that a decoded key file has what a restore needs
+func CheckKeyFile(keyFile *models.KeyFile) error {
 	if keyFile.Version == "" {
-		return nil, fmt.Errorf("invalid key file: missing version")
+		return fmt.Errorf("invalid key file: missing version")
 	}
 	if keyFile.OriginalFilename == "" {
-		return nil, fmt.Errorf("invalid key file: missing original filename")
+		return fmt.Errorf("invalid key file: missing original filename")
 	}
 	if len(keyFile.Chunks) == 0 {
-		return nil, fmt.Errorf("invalid key file: no chunks")
+		return fmt.Errorf("invalid key file: no chunks")
 	}
 	if keyFile.Obfuscation.Seed == "" {
-		return nil, fmt.Errorf("invalid key file: missing obfuscation seed")
+		return fmt.Errorf("invalid key file: missing obfuscation seed")
+	}
+	if keyFile.Erasure != nil && len(keyFile.Chunks) != keyFile.Erasure.DataShards+keyFile.Erasure.ParityShards {
+		return fmt.Errorf("invalid key file: expected %d erasure shards, found %d",
+			keyFile.Erasure.DataShards+keyFile.Erasure.ParityShards, len(keyFile.Chunks))
 	}
+	if keyFile.OriginalSize <= 0 || keyFile.ProcessedSize <= 0 {
+		return fmt.Errorf("invalid key file: missing sizes")
+	}
+	return nil
+}
 
-	return &keyFile, nil
+// NewStoredFile builds the database record for a successfully distributed file
+func NewStoredFile(
+	fileID primitive.ObjectID,
+	session *models.UploadSession,
+	strategy models.ChunkingStrategy,
+	processedSize int64,
+	obfuscation *models.ObfuscationMetadata,
+	chunks []models.ChunkMetadata,
+	erasure *models.ErasureMetadata,
+) *models.StoredFile {
+	return &models.StoredFile{
+		ID:               fileID,
+		UserID:           session.UserID,
+		SessionID:        session.ID,
+		OriginalFilename: session.OriginalFilename,
+		Folder:           session.Folder,
+		Path:             models.FilePath(session.Folder, session.OriginalFilename),
+		UploadClient:     session.Client,
+		OriginalSize:     session.TotalSize,
+		ProcessedSize:    processedSize,
+		Strategy:         strategy,
+		Obfuscation:      *obfuscation,
+		Chunks:           storedChunks(chunks),
+		Erasure:          erasure,
+		Status:           "active",
+	}
+}
+
+// StoredFileFromKeyFile builds a file record from a checked key file, enough to restore the file
+// without the server's copy of it
+func StoredFileFromKeyFile(keyFile *models.KeyFile, userID primitive.ObjectID) (*models.StoredFile, error) {
+	fileID, err := primitive.ObjectIDFromHex(keyFile.FileID)
+	if err != nil && keyFile.FileID != "" {
+		return nil, fmt.Errorf("invalid key file: bad file_id")
+	}
+	for _, c := range keyFile.Chunks {
+		if _, err := primitive.ObjectIDFromHex(c.DriveAccountID); err != nil {
+			return nil, fmt.Errorf("invalid key file: chunk %d has a bad drive_account_id", c.ChunkID)
+		}
+		// Headers name the file, so headed chunks can't be checked without its ID
+		if c.HeaderVersion > 0 && fileID.IsZero() {
+			return nil, fmt.Errorf("invalid key file: missing file_id")
+		}
+	}
+	return &models.StoredFile{
+		ID:               fileID,
+		UserID:           userID,
+		OriginalFilename: keyFile.OriginalFilename,
+		Path:             models.FilePath("", keyFile.OriginalFilename),
+		OriginalSize:     keyFile.OriginalSize,
+		ProcessedSize:    keyFile.ProcessedSize,
+		Obfuscation:      keyFile.Obfuscation,
+		Chunks:           storedChunks(keyFile.Chunks),
+		Erasure:          keyFile.Erasure,
+		Status:           "active",
+		CreatedAt:        keyFile.CreatedAt,
+	}, nil
+}
+
+// storedChunks converts key file chunk entries into their database form
+func storedChunks(chunks []models.ChunkMetadata) []models.StoredChunk {
+	stored := make([]models.StoredChunk, 0, len(chunks))
+	for _, c := range chunks {
+		accountID, _ := primitive.ObjectIDFromHex(c.DriveAccountID)
+		stored = append(stored, models.StoredChunk{
+			ChunkID:        c.ChunkID,
+			DriveAccountID: accountID,
+			DriveFileID:    c.DriveFileID,
+			Filename:       c.Filename,
+			StartOffset:    c.StartOffset,
+			EndOffset:      c.EndOffset,
+			Size:           c.Size,
+			Checksum:       c.Checksum,
+			HeaderVersion:  c.HeaderVersion,
+			ShardIndex:     c.ShardIndex,
+			Parity:         c.Parity,
+		})
+	}
+
+	return stored
 }
@@ -0,0 +1,144 @@
+package fileprocessor
+
+import (
+	"SE/internal/models"
+	"encoding/binary"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"io"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"strings"
+)
+
+// sniffLen is how much of the file content type detection looks at
+const sniffLen = 512
+
+// DetectMedia sniffs the content type of an uploaded file and reads what it can of its media
+// metadata: dimensions of GIF, JPEG and PNG images, duration of MP4/QuickTime video and WAV
+// audio. The type falls back to the file extension when the content says nothing specific.
+func DetectMedia(r io.ReaderAt, size int64, filename string) (string, *models.MediaInfo) {
+	head := make([]byte, min(size, sniffLen))
+	n, _ := r.ReadAt(head, 0)
+	contentType := http.DetectContentType(head[:n])
+	if contentType == "application/octet-stream" || strings.HasPrefix(contentType, "text/plain") {
+		if byExt := mime.TypeByExtension(strings.ToLower(filepath.Ext(filename))); byExt != "" {
+			contentType = byExt
+		}
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	var info *models.MediaInfo
+	switch {
+	case strings.HasPrefix(mediaType, "image/"):
+		if cfg, _, err := image.DecodeConfig(io.NewSectionReader(r, 0, size)); err == nil {
+			info = &models.MediaInfo{Width: cfg.Width, Height: cfg.Height}
+		}
+	case mediaType == "video/mp4" || mediaType == "video/quicktime" || mediaType == "audio/mp4":
+		if d, ok := mp4Duration(r, size); ok {
+			info = &models.MediaInfo{DurationSeconds: d}
+		}
+	case mediaType == "audio/wave" || mediaType == "audio/wav" || mediaType == "audio/x-wav":
+		if d, ok := wavDuration(r, size); ok {
+			info = &models.MediaInfo{DurationSeconds: d}
+		}
+	}
+	return contentType, info
+}
+
+// mp4Duration reads the duration from the movie header (moov/mvhd) of an ISO media file
+func mp4Duration(r io.ReaderAt, size int64) (float64, bool) {
+	moov, moovSize, ok := findBox(r, 0, size, "moov")
+	if !ok {
+		return 0, false
+	}
+	mvhd, _, ok := findBox(r, moov, moov+moovSize, "mvhd")
+	if !ok {
+		return 0, false
+	}
+	// Version 1 has 64-bit times and duration, version 0 32-bit ones
+	var hdr [32]byte
+	if _, err := r.ReadAt(hdr[:], mvhd); err != nil {
+		return 0, false
+	}
+	var timescale uint32
+	var duration uint64
+	if hdr[0] == 1 {
+		timescale = binary.BigEndian.Uint32(hdr[20:24])
+		duration = binary.BigEndian.Uint64(hdr[24:32])
+	} else {
+		timescale = binary.BigEndian.Uint32(hdr[12:16])
+		duration = uint64(binary.BigEndian.Uint32(hdr[16:20]))
+	}
+	if timescale == 0 {
+		return 0, false
+	}
+	return float64(duration) / float64(timescale), true
+}
+
+// findBox looks for a box of the given type among the boxes in [start, end) and returns the
+// offset and size of its payload
+func findBox(r io.ReaderAt, start, end int64, boxType string) (int64, int64, bool) {
+	var hdr [16]byte
+	for off := start; off+8 <= end; {
+		if _, err := r.ReadAt(hdr[:8], off); err != nil {
+			return 0, 0, false
+		}
+		boxSize := int64(binary.BigEndian.Uint32(hdr[:4]))
+		headerLen := int64(8)
+		switch boxSize {
+		case 0: // runs to the end
+			boxSize = end - off
+		case 1: // 64-bit size follows the type
+			if _, err := r.ReadAt(hdr[8:16], off+8); err != nil {
+				return 0, 0, false
+			}
+			boxSize = int64(binary.BigEndian.Uint64(hdr[8:16]))
+			headerLen = 16
+		}
+		if boxSize < headerLen || off+boxSize > end {
+			return 0, 0, false
+		}
+		if string(hdr[4:8]) == boxType {
+			return off + headerLen, boxSize - headerLen, true
+		}
+		off += boxSize
+	}
+	return 0, 0, false
+}
+
+// wavDuration divides the size of a RIFF WAVE file's data chunk by its byte rate
+func wavDuration(r io.ReaderAt, size int64) (float64, bool) {
+	var hdr [12]byte
+	if _, err := r.ReadAt(hdr[:], 0); err != nil || string(hdr[:4]) != "RIFF" || string(hdr[8:12]) != "WAVE" {
+		return 0, false
+	}
+	var byteRate uint32
+	var chunk [16]byte
+	for off := int64(12); off+8 <= size; {
+		if _, err := r.ReadAt(chunk[:8], off); err != nil {
+			return 0, false
+		}
+		chunkSize := int64(binary.LittleEndian.Uint32(chunk[4:8]))
+		switch string(chunk[:4]) {
+		case "fmt ":
+			if _, err := r.ReadAt(chunk[:], off+8); err != nil {
+				return 0, false
+			}
+			byteRate = binary.LittleEndian.Uint32(chunk[8:12])
+		case "data":
+			if byteRate == 0 {
+				return 0, false
+			}
+			// Streams written without knowing their length leave the size unset
+			dataSize := min(chunkSize, size-off-8)
+			return float64(dataSize) / float64(byteRate), true
+		}
+		// Chunks are padded to an even size
+		off += 8 + chunkSize + chunkSize%2
+	}
+	return 0, false
+}
@@ -0,0 +1,155 @@
+package fileprocessor
+
+import (
+	"SE/internal/models"
+	"encoding/base64"
+	"errors"
+	"io"
+	"sort"
+
+	"golang.org/x/crypto/chacha20"
+)
+
+// ObfuscatedReader presents the obfuscated form of a file without writing it anywhere.
+// It is an io.ReaderAt, so any byte range (a chunk, a retried upload part) can be produced
+// on demand straight from the original file.
+type ObfuscatedReader struct {
+	src       io.ReaderAt
+	size      int64
+	seed      []byte
+	blockSize int64
+	// noiseStarts[k] is where noise block k begins in the obfuscated stream
+	noiseStarts []int64
+	// noiseBase is the keystream position of the first noise byte
+	noiseBase int64
+}
+
+// NewObfuscatedReader derives the noise layout for src from seed using the configured
+// block size and the overhead of the given profile scaling basePct, and returns the reader with the metadata
+// needed to reverse it
+func NewObfuscatedReader(src io.ReaderAt, originalSize int64, seed []byte, profile string, basePct float64) (*ObfuscatedReader, *models.ObfuscationMetadata, error) {
+	if originalSize <= 0 {
+		return nil, nil, errors.New("cannot obfuscate an empty file")
+	}
+
+	metadata := &models.ObfuscationMetadata{
+		Algorithm:   "ChaCha20-DRBG",
+		Seed:        models.Secret(base64.StdEncoding.EncodeToString(seed)),
+		BlockSize:   defaultBlockSize,
+		OverheadPct: profileOverheadPct(profile, basePct),
+		MinGap:      defaultMinGap,
+	}
+
+	offsets, err := injectionOffsets(seed, originalSize, *metadata)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	blockSize := int64(defaultBlockSize)
+	noiseStarts := make([]int64, len(offsets))
+	for k, offset := range offsets {
+		noiseStarts[k] = offset + int64(k)*blockSize
+	}
+
+	return &ObfuscatedReader{
+		src:         src,
+		size:        originalSize + int64(len(offsets))*blockSize,
+		seed:        seed,
+		blockSize:   blockSize,
+		noiseStarts: noiseStarts,
+		noiseBase:   int64(len(offsets)) * 8,
+	}, metadata, nil
+}
+
+// ObfuscatedSize is the size of the obfuscated stream of a file, known before the seed is
+func ObfuscatedSize(originalSize int64, profile string, basePct float64) int64 {
+	targetOverhead := int64(float64(originalSize) * (profileOverheadPct(profile, basePct) / 100.0))
+	numInjections := max(targetOverhead/int64(defaultBlockSize), 1)
+	return originalSize + numInjections*int64(defaultBlockSize)
+}
+
+// injectionOffsets re-derives the sorted original-file offsets before which noise blocks go
+func injectionOffsets(seed []byte, originalSize int64, meta models.ObfuscationMetadata) ([]int64, error) {
+	nonce := make([]byte, 12)
+	cipher, err := chacha20.NewUnauthenticatedCipher(seed, nonce)
+	if err != nil {
+		return nil, err
+	}
+
+	targetOverhead := int64(float64(originalSize) * (meta.OverheadPct / 100.0))
+	numInjections := targetOverhead / int64(meta.BlockSize)
+	if numInjections == 0 {
+		numInjections = 1
+	}
+	return generateInjectionOffsets(cipher, originalSize, numInjections, int64(meta.MinGap)), nil
+}
+
+// Size is the length of the obfuscated stream
+func (o *ObfuscatedReader) Size() int64 {
+	return o.size
+}
+
+// ReadAt fills p with obfuscated bytes starting at off
+func (o *ObfuscatedReader) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("negative offset")
+	}
+	if off >= o.size {
+		return 0, io.EOF
+	}
+
+	n := 0
+	for n < len(p) && off < o.size {
+		// Last noise block starting at or before off
+		k := sort.Search(len(o.noiseStarts), func(i int) bool { return o.noiseStarts[i] > off }) - 1
+
+		var m int
+		var err error
+		if k >= 0 && off < o.noiseStarts[k]+o.blockSize {
+			// Inside noise block k
+			end := o.noiseStarts[k] + o.blockSize
+			m = int(min(int64(len(p)-n), end-off))
+			err = o.noise(p[n:n+m], int64(k)*o.blockSize+off-o.noiseStarts[k])
+		} else {
+			// Original data: everything before off except the k+1 noise blocks
+			end := o.size
+			if k+1 < len(o.noiseStarts) {
+				end = o.noiseStarts[k+1]
+			}
+			m = int(min(int64(len(p)-n), end-off))
+			m, err = o.src.ReadAt(p[n:n+m], off-int64(k+1)*o.blockSize)
+			if err == io.EOF && m > 0 {
+				err = nil
+			}
+		}
+		n += m
+		off += int64(m)
+		if err != nil {
+			return n, err
+		}
+	}
+
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// noise writes the noise bytes at position pos (counted over all noise blocks) into p
+func (o *ObfuscatedReader) noise(p []byte, pos int64) error {
+	nonce := make([]byte, 12)
+	cipher, err := chacha20.NewUnauthenticatedCipher(o.seed, nonce)
+	if err != nil {
+		return err
+	}
+
+	// Jump to the 64-byte keystream block holding pos, then skip into it
+	stream := o.noiseBase + pos
+	cipher.SetCounter(uint32(stream / 64))
+	skip := make([]byte, stream%64)
+	cipher.XORKeyStream(skip, skip)
+
+	clear(p)
+	cipher.XORKeyStream(p, p)
+	return nil
+}
@@ -40,71 +40,56 @@ func init() {
 	defaultMinGap = minGap
 }
 
-// GenerateObfuscationSeed creates a 32-byte CSPRNG seed
-func GenerateObfuscationSeed() ([]byte, error) {
-	seed := make([]byte, 32)
-	if _, err := rand.Read(seed); err != nil {
-		return nil, err
-	}
-	return seed, nil
+// Obfuscation profiles scale the configured noise overhead
+var obfuscationProfiles = map[string]float64{
+	"light":    0.5,
+	"standard": 1,
+	"heavy":    2,
 }
 
-// ObfuscateFile injects noise into a file using ChaCha20-DRBG
-func ObfuscateFile(inputPath, outputPath string, seed []byte) (*models.ObfuscationMetadata, int64, error) {
-	// Open input file
-	inFile, err := os.Open(inputPath)
-	if err != nil {
-		return nil, 0, err
-	}
-	defer inFile.Close()
-
-	// Get file size
-	stat, err := inFile.Stat()
-	if err != nil {
-		return nil, 0, err
-	}
-	originalSize := stat.Size()
+// DefaultObfuscationProfile is used when neither the request nor the user's preferences name one
+const DefaultObfuscationProfile = "standard"
 
-	// Create output file
-	outFile, err := os.Create(outputPath)
-	if err != nil {
-		return nil, 0, err
-	}
-	defer outFile.Close()
+// ValidObfuscationProfile reports whether name is a known profile
+func ValidObfuscationProfile(name string) bool {
+	_, ok := obfuscationProfiles[name]
+	return ok
+}
 
-	// Initialize ChaCha20 cipher for deterministic random generation
-	nonce := make([]byte, 12) // ChaCha20 nonce
-	cipher, err := chacha20.NewUnauthenticatedCipher(seed, nonce)
-	if err != nil {
-		return nil, 0, err
-	}
+// DefaultObfuscationOverheadPct is the base noise overhead when neither the request nor the
+// user's preferences set one
+func DefaultObfuscationOverheadPct() float64 {
+	return defaultOverheadPct
+}
 
-	// Calculate injection points
-	targetOverhead := int64(float64(originalSize) * (defaultOverheadPct / 100.0))
-	numInjections := targetOverhead / int64(defaultBlockSize)
-	if numInjections == 0 {
-		numInjections = 1
-	}
+// maxObfuscationOverheadPct is the most base overhead a user may choose
+const maxObfuscationOverheadPct = 100
 
-	// Generate injection offsets deterministically
-	injectionOffsets := generateInjectionOffsets(cipher, originalSize, numInjections, int64(defaultMinGap))
+// ValidObfuscationOverhead reports whether pct can be a base noise overhead
+func ValidObfuscationOverhead(pct float64) bool {
+	return pct > 0 && pct <= maxObfuscationOverheadPct
+}
 
-	// Perform streaming injection
-	processedSize, err := streamInjectNoise(inFile, outFile, cipher, injectionOffsets, defaultBlockSize)
-	if err != nil {
-		os.Remove(outputPath)
-		return nil, 0, err
+// profileOverheadPct returns the noise overhead for a profile, scaling basePct or, when it is
+// zero, the configured default. Unknown names get the unscaled overhead.
+func profileOverheadPct(profile string, basePct float64) float64 {
+	scale, ok := obfuscationProfiles[profile]
+	if !ok {
+		scale = 1
 	}
-
-	metadata := &models.ObfuscationMetadata{
-		Algorithm:   "ChaCha20-DRBG",
-		Seed:        base64.StdEncoding.EncodeToString(seed),
-		BlockSize:   defaultBlockSize,
-		OverheadPct: defaultOverheadPct,
-		MinGap:      defaultMinGap,
+	if basePct == 0 {
+		basePct = defaultOverheadPct
 	}
+	return basePct * scale
+}
 
-	return metadata, processedSize, nil
+// GenerateObfuscationSeed creates a 32-byte CSPRNG seed
+func GenerateObfuscationSeed() ([]byte, error) {
+	seed := make([]byte, 32)
+	if _, err := rand.Read(seed); err != nil {
+		return nil, err
+	}
+	return seed, nil
 }
 
 // generateInjectionOffsets creates deterministic injection points
@@ -118,7 +103,7 @@ func generateInjectionOffsets(cipher *chacha20.Cipher, fileSize int64, numInject
 
 	// Convert to offsets
 	maxOffset := fileSize - minGap
-	if maxOffset < 0 {
+	if maxOffset <= 0 {
 		maxOffset = fileSize
 	}
 
@@ -150,83 +135,6 @@ func generateInjectionOffsets(cipher *chacha20.Cipher, fileSize int64, numInject
 	return offsets
 }
 
-// streamInjectNoise performs streaming noise injection
-func streamInjectNoise(inFile, outFile *os.File, cipher *chacha20.Cipher, offsets []int64, blockSize int) (int64, error) {
-	var totalWritten int64
-	var currentOffset int64
-	buffer := make([]byte, 32*1024) // 32KB read buffer
-	noiseBlock := make([]byte, blockSize)
-
-	offsetIdx := 0
-	nextInjectionPoint := int64(0)
-	if len(offsets) > 0 {
-		nextInjectionPoint = offsets[0]
-	}
-
-	for {
-		n, err := inFile.Read(buffer)
-		if n > 0 {
-			// Check if we need to inject noise before this chunk
-			for offsetIdx < len(offsets) && nextInjectionPoint >= currentOffset && nextInjectionPoint < currentOffset+int64(n) {
-				// Write data up to injection point
-				relativePos := nextInjectionPoint - currentOffset
-				if relativePos > 0 {
-					written, writeErr := outFile.Write(buffer[:relativePos])
-					if writeErr != nil {
-						return totalWritten, writeErr
-					}
-					totalWritten += int64(written)
-				}
-
-				// Generate and inject noise
-				src := make([]byte, blockSize)
-				cipher.XORKeyStream(noiseBlock, src)
-				written, writeErr := outFile.Write(noiseBlock)
-				if writeErr != nil {
-					return totalWritten, writeErr
-				}
-				totalWritten += int64(written)
-
-				// Move to next chunk
-				buffer = buffer[relativePos:]
-				n -= int(relativePos)
-				currentOffset = nextInjectionPoint
-
-				// Move to next injection point
-				offsetIdx++
-				if offsetIdx < len(offsets) {
-					nextInjectionPoint = offsets[offsetIdx]
-				} else {
-					nextInjectionPoint = -1 // No more injections
-				}
-			}
-
-			// Write remaining data
-			if n > 0 {
-				written, writeErr := outFile.Write(buffer[:n])
-				if writeErr != nil {
-					return totalWritten, writeErr
-				}
-				totalWritten += int64(written)
-			}
-
-			currentOffset += int64(n)
-		}
-
-		if err == io.EOF {
-			break
-		}
-		if err != nil {
-			return totalWritten, err
-		}
-
-		// Reset buffer
-		buffer = make([]byte, 32*1024)
-	}
-
-	return totalWritten, nil
-}
-
 // CalculateProcessedSize estimates final size after obfuscation
 func CalculateProcessedSize(originalSize int64) int64 {
 	overhead := int64(float64(originalSize) * (defaultOverheadPct / 100.0))
@@ -248,3 +156,58 @@ func CalculateChecksum(filePath string) (string, error) {
 
 	return fmt.Sprintf("%x", hash.Sum(nil)), nil
 }
+
+// DeobfuscateFile strips the injected noise from an obfuscated file, recreating the original.
+// The injection points are re-derived from the seed and parameters recorded at upload time.
+func DeobfuscateFile(inputPath, outputPath string, meta models.ObfuscationMetadata, originalSize int64) error {
+	seed, err := base64.StdEncoding.DecodeString(string(meta.Seed))
+	if err != nil {
+		return fmt.Errorf("invalid obfuscation seed: %w", err)
+	}
+
+	injectionOffsets, err := injectionOffsets(seed, originalSize, meta)
+	if err != nil {
+		return err
+	}
+
+	inFile, err := os.Open(inputPath)
+	if err != nil {
+		return err
+	}
+	defer inFile.Close()
+
+	outFile, err := os.Create(outputPath)
+	if err != nil {
+		return err
+	}
+	defer outFile.Close()
+
+	// Noise block k was written before original byte offsets[k], so it starts at
+	// offsets[k] + k*blockSize in the obfuscated stream
+	blockSize := int64(meta.BlockSize)
+	var pos int64
+	for k, offset := range injectionOffsets {
+		noiseStart := offset + int64(k)*blockSize
+		if _, err := io.CopyN(outFile, inFile, noiseStart-pos); err != nil {
+			os.Remove(outputPath)
+			return fmt.Errorf("failed to copy data: %w", err)
+		}
+		if _, err := io.CopyN(io.Discard, inFile, blockSize); err != nil {
+			os.Remove(outputPath)
+			return fmt.Errorf("failed to skip noise block: %w", err)
+		}
+		pos = noiseStart + blockSize
+	}
+
+	written, err := io.Copy(outFile, inFile)
+	if err != nil {
+		os.Remove(outputPath)
+		return err
+	}
+	if total := pos - int64(len(injectionOffsets))*blockSize + written; total != originalSize {
+		os.Remove(outputPath)
+		return fmt.Errorf("deobfuscated size %d does not match original size %d", total, originalSize)
+	}
+
+	return nil
+}
@@ -0,0 +1,51 @@
+package fileprocessor
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestObfuscationRoundTrip(t *testing.T) {
+	InitFileConfig()
+	// 4096 is the minimum gap between injections, which once divided by zero
+	for _, size := range []int{1, 100, 4095, 4096, 4097, 1<<20 + 3} {
+		data := make([]byte, size)
+		rand.Read(data)
+		seed, err := GenerateObfuscationSeed()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		obf, meta, err := NewObfuscatedReader(bytes.NewReader(data), int64(size), seed, DefaultObfuscationProfile, DefaultObfuscationOverheadPct())
+		if err != nil {
+			t.Fatalf("size %d: %v", size, err)
+		}
+		if want := ObfuscatedSize(int64(size), DefaultObfuscationProfile, DefaultObfuscationOverheadPct()); obf.Size() != want {
+			t.Errorf("size %d: obfuscated to %d bytes, ObfuscatedSize says %d", size, obf.Size(), want)
+		}
+		obfuscated, err := io.ReadAll(io.NewSectionReader(obf, 0, obf.Size()))
+		if err != nil {
+			t.Fatalf("size %d: %v", size, err)
+		}
+
+		dir := t.TempDir()
+		in, out := filepath.Join(dir, "obfuscated"), filepath.Join(dir, "restored")
+		if err := os.WriteFile(in, obfuscated, 0o600); err != nil {
+			t.Fatal(err)
+		}
+		if err := DeobfuscateFile(in, out, *meta, int64(size)); err != nil {
+			t.Fatalf("size %d: deobfuscate: %v", size, err)
+		}
+		restored, err := os.ReadFile(out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(restored, data) {
+			t.Errorf("size %d: restored %d bytes that differ from the original", size, len(restored))
+		}
+	}
+}
@@ -0,0 +1,66 @@
+package fileprocessor
+
+import (
+	"SE/internal/models"
+	"fmt"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// maxShareBytes is the most of a file of fileSize bytes one drive may hold under policy, -1 if unlimited
+func maxShareBytes(fileSize int64, policy models.PlacementPolicy) int64 {
+	if policy.MaxSharePct <= 0 || policy.MaxSharePct >= 100 {
+		return -1
+	}
+	return int64(float64(fileSize) * policy.MaxSharePct / 100)
+}
+
+// capDriveSpace limits every drive's usable space to the policy's max share so the
+// size-based planners never put more than that on one drive
+func capDriveSpace(drives []models.DriveSpaceInfo, fileSize int64, policy models.PlacementPolicy) []models.DriveSpaceInfo {
+	limit := maxShareBytes(fileSize, policy)
+	if limit < 0 {
+		return drives
+	}
+
+	capped := make([]models.DriveSpaceInfo, len(drives))
+	copy(capped, drives)
+	for i := range capped {
+		if capped[i].FreeSpace > limit {
+			capped[i].FreeSpace = limit
+		}
+	}
+	return capped
+}
+
+// ValidatePlacement checks a chunk placement against the user's placement policy.
+// Parity shards are not counted towards a drive's share since they reveal nothing on their own.
+func ValidatePlacement(plan []models.ChunkPlan, fileSize int64, policy models.PlacementPolicy) error {
+	perDrive := make(map[primitive.ObjectID]int64)
+	chunksPerDrive := make(map[primitive.ObjectID]int)
+	for _, chunk := range plan {
+		chunksPerDrive[chunk.DriveAccountID]++
+		if !chunk.Parity {
+			perDrive[chunk.DriveAccountID] += chunk.EndOffset - chunk.StartOffset
+		}
+	}
+
+	if policy.DistinctDrives {
+		for accountID, n := range chunksPerDrive {
+			if n > 1 {
+				return fmt.Errorf("placement policy: %d chunks placed on drive %s, at most one allowed", n, accountID.Hex())
+			}
+		}
+	}
+
+	if limit := maxShareBytes(fileSize, policy); limit >= 0 {
+		for accountID, size := range perDrive {
+			if size > limit {
+				return fmt.Errorf("placement policy: drive %s would hold %.1f%% of the file, limit is %.1f%%",
+					accountID.Hex(), float64(size)*100/float64(fileSize), policy.MaxSharePct)
+			}
+		}
+	}
+
+	return nil
+}
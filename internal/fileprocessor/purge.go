@@ -0,0 +1,137 @@
+package fileprocessor
+
+import (
+	"SE/internal/drivemanager"
+	"SE/internal/models"
+	"SE/internal/store"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+const (
+	// purgeInterval is how often RunPurger looks for trashed files past their retention
+	purgeInterval = time.Hour
+	// purgeFilesPerRun bounds the Drive calls of one run; the rest wait for the next
+	purgeFilesPerRun = 50
+)
+
+// TrashRetention is how long files stay in the trash, negative if they stay for good
+func TrashRetention() time.Duration {
+	return trashRetention
+}
+
+// RunPurger periodically empties the trash of files that have been in it for
+// TRASH_RETENTION_DAYS, deleting their chunks and records, obfuscation seeds included. It blocks
+// until ctx is cancelled. TRASH_RETENTION_DAYS=0 purges trashed files at the next run, and a
+// negative value keeps them for good.
+func RunPurger(ctx context.Context) {
+	if trashRetention < 0 {
+		return
+	}
+	ticker := time.NewTicker(purgeInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if !drivemanager.BackgroundWorkAllowed() {
+				continue
+			}
+			if n, err := PurgeDeletedFiles(ctx); err != nil {
+				log.Printf("Purge: %v", err)
+			} else if n > 0 {
+				log.Printf("Purge: emptied %d files from the trash", n)
+			}
+		}
+	}
+}
+
+// PurgeDeletedFiles deletes the files trashed more than TRASH_RETENTION_DAYS ago and returns
+// how many it removed. Each chunk still on its drive, in the Drive trash included, is deleted
+// for good and checked to be gone before the record goes. A file with a chunk that can't be
+// removed or checked stays in the trash until a later run.
+func PurgeDeletedFiles(ctx context.Context) (int, error) {
+	if trashRetention < 0 {
+		return 0, nil
+	}
+	files, err := store.ListPurgeableFiles(ctx, time.Now().Add(-trashRetention), purgeFilesPerRun)
+	if err != nil {
+		return 0, err
+	}
+	purged := 0
+	for _, file := range files {
+		if ctx.Err() != nil {
+			return purged, ctx.Err()
+		}
+		if err := purgeFile(ctx, file); err != nil {
+			log.Printf("Purge: keeping trashed file %s for now: %v", file.ID.Hex(), err)
+			continue
+		}
+		purged++
+	}
+	return purged, nil
+}
+
+// purgeFile makes sure none of the file's chunks is left on a drive, then removes its record
+func purgeFile(ctx context.Context, file *models.StoredFile) error {
+	left := 0
+	for _, chunk := range file.Chunks {
+		if err := purgeChunk(ctx, file, chunk); err != nil {
+			log.Printf("Purge: chunk %d of file %s: %v", chunk.ChunkID, file.ID.Hex(), err)
+			left++
+		}
+	}
+	if left > 0 {
+		return fmt.Errorf("%d of %d chunks may still be on drives", left, len(file.Chunks))
+	}
+	if err := store.DeleteFileShares(ctx, file.ID); err != nil {
+		return err
+	}
+	if err := store.DeleteFilePublicLinks(ctx, file.ID); err != nil {
+		return err
+	}
+	return store.PurgeStoredFile(ctx, file.ID)
+}
+
+// purgeChunk deletes a chunk for good if it is still on its drive, and checks it is gone
+func purgeChunk(ctx context.Context, file *models.StoredFile, chunk models.StoredChunk) error {
+	// A drive that was unlinked can't be reached any more
+	if _, err := store.GetDriveAccountByID(ctx, chunk.DriveAccountID); err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return nil
+		}
+		return err
+	}
+	check := func() (bool, error) {
+		err := drivemanager.CheckChunkFile(ctx, chunk.DriveAccountID, chunk.DriveFileID, file.ID, chunk.ChunkID, chunk.Size, chunk.HeaderVersion > 0)
+		switch {
+		case drivemanager.IsNotFound(err):
+			return false, nil
+		case err == nil, errors.Is(err, drivemanager.ErrBadChunkHeader):
+			return true, nil
+		}
+		return false, err
+	}
+
+	present, err := check()
+	if err != nil || !present {
+		return err
+	}
+	if err := drivemanager.PurgeDriveFile(ctx, chunk.DriveAccountID, chunk.DriveFileID); err != nil && !drivemanager.IsNotFound(err) {
+		return err
+	}
+	if present, err = check(); err != nil {
+		return err
+	}
+	if present {
+		return errors.New("still on the drive after deleting it")
+	}
+	return nil
+}
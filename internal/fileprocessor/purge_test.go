@@ -0,0 +1,101 @@
+package fileprocessor
+
+import (
+	"SE/internal/drivemanager"
+	"SE/internal/models"
+	"SE/internal/store"
+	"SE/internal/store/storetest"
+	"bytes"
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestMain(m *testing.M) {
+	os.Exit(storetest.Run(m))
+}
+
+func TestPurgeDeletedFiles(t *testing.T) {
+	t.Setenv("DRIVE_DELETE_MODE", "trash")
+	storetest.Setup(t)
+	InitFileConfig()
+	ctx := context.Background()
+	user := storetest.User(t)
+	drive := storetest.LocalDrives(t, user.ID, 1)[0]
+
+	data := []byte("chunk data")
+	driveFileID, _, err := drivemanager.UploadChunkToDrive(ctx, drive.ID, bytes.NewReader(data), int64(len(data)), "chunk_1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	newFile := func(accountID primitive.ObjectID, driveFileID string) *models.StoredFile {
+		f := &models.StoredFile{UserID: user.ID, OriginalFilename: driveFileID, Chunks: []models.StoredChunk{
+			{ChunkID: 1, DriveAccountID: accountID, DriveFileID: driveFileID, Size: int64(len(data))},
+		}}
+		if err := store.CreateStoredFile(ctx, f); err != nil {
+			t.Fatal(err)
+		}
+		return f
+	}
+	trashed := newFile(drive.ID, driveFileID)
+	gone := newFile(drive.ID, "no-such-file")
+	unlinked := newFile(primitive.NewObjectID(), "on-an-unlinked-drive")
+	kept := newFile(drive.ID, "kept-chunk")
+	for _, f := range []*models.StoredFile{trashed, gone, unlinked} {
+		if ok, err := store.TrashStoredFile(ctx, user.ID, f.ID); !ok || err != nil {
+			t.Fatalf("trash %s: %v %v", f.OriginalFilename, ok, err)
+		}
+	}
+	// A chunk left in the Drive trash is deleted for good too
+	if err := drivemanager.DeleteDriveFile(ctx, drive.ID, driveFileID); err != nil {
+		t.Fatal(err)
+	}
+
+	if n, err := PurgeDeletedFiles(ctx); n != 0 || err != nil {
+		t.Fatalf("purged %d files within their retention (%v)", n, err)
+	}
+
+	trashRetention = 0
+	if n, err := PurgeDeletedFiles(ctx); n != 3 || err != nil {
+		t.Fatalf("purged %d files (%v), want 3", n, err)
+	}
+	for _, f := range []*models.StoredFile{trashed, gone, unlinked} {
+		if got, _ := store.GetStoredFile(ctx, f.ID); got != nil {
+			t.Errorf("%s still stored", f.OriginalFilename)
+		}
+	}
+	if got, _ := store.GetStoredFile(ctx, kept.ID); got == nil || got.Status != "active" {
+		t.Errorf("active file = %+v, want it left alone", got)
+	}
+	if err := drivemanager.CheckChunkFile(ctx, drive.ID, driveFileID, trashed.ID, 1, int64(len(data)), false); !drivemanager.IsNotFound(err) {
+		t.Errorf("trashed chunk still on the drive (check: %v)", err)
+	}
+}
+
+func TestTrashRetentionConfig(t *testing.T) {
+	for _, tc := range []struct {
+		trash, deleted string // "-" leaves the variable unset
+		want           time.Duration
+	}{
+		{"-", "-", 30 * 24 * time.Hour},
+		{"", "-", 30 * 24 * time.Hour},
+		{"0", "-", 0},
+		{"-1", "-", -24 * time.Hour},
+		{"-", "7", 7 * 24 * time.Hour},
+		{"2", "7", 2 * 24 * time.Hour},
+	} {
+		for name, v := range map[string]string{"TRASH_RETENTION_DAYS": tc.trash, "DELETED_FILE_RETENTION_DAYS": tc.deleted} {
+			t.Setenv(name, v)
+			if v == "-" {
+				os.Unsetenv(name)
+			}
+		}
+		InitFileConfig()
+		if trashRetention != tc.want {
+			t.Errorf("TRASH_RETENTION_DAYS=%q DELETED_FILE_RETENTION_DAYS=%q: retention %v, want %v", tc.trash, tc.deleted, trashRetention, tc.want)
+		}
+	}
+}
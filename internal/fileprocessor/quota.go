@@ -0,0 +1,47 @@
+package fileprocessor
+
+import (
+	"SE/internal/models"
+	"SE/internal/store"
+	"context"
+	"errors"
+	"fmt"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// ErrQuotaExceeded is returned when an upload would take a user past their storage quota
+var ErrQuotaExceeded = errors.New("storage quota exceeded")
+
+// UserQuota is the user's storage quota in bytes, 0 for unlimited
+func UserQuota(user *models.User) int64 {
+	switch {
+	case user == nil || user.StorageQuota == 0:
+		return defaultUserQuota
+	case user.StorageQuota < 0:
+		return 0
+	}
+	return user.StorageQuota
+}
+
+// CheckQuota fails with ErrQuotaExceeded if the user's stored files, pending uploads and extra
+// more bytes don't fit in their quota
+func CheckQuota(ctx context.Context, userID primitive.ObjectID, extra int64) error {
+	user, err := store.GetUserByID(ctx, userID)
+	if err != nil {
+		return err
+	}
+	quota := UserQuota(user)
+	if quota == 0 {
+		return nil
+	}
+	usage, err := store.GetUserStorageUsage(ctx, userID)
+	if err != nil {
+		return err
+	}
+	used := usage.StoredBytes + usage.PendingBytes
+	if used+extra > quota {
+		return fmt.Errorf("%w: %d of %d bytes stored or uploading, %d more requested", ErrQuotaExceeded, used, quota, extra)
+	}
+	return nil
+}
@@ -0,0 +1,37 @@
+package fileprocessor
+
+import (
+	"SE/internal/store"
+	"SE/internal/store/storetest"
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestCheckQuota(t *testing.T) {
+	storetest.Setup(t)
+	InitFileConfig()
+	ctx := context.Background()
+	user := storetest.User(t)
+	if _, err := store.SetUserStorageQuota(ctx, user.ID, 1000); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := CheckQuota(ctx, user.ID, 1000); err != nil {
+		t.Fatalf("CheckQuota of the whole quota: %v", err)
+	}
+	// A pending upload counts against the quota
+	storetest.Session(t, user.ID, "pending.bin", make([]byte, 600))
+	if err := CheckQuota(ctx, user.ID, 400); err != nil {
+		t.Errorf("CheckQuota up to the quota: %v", err)
+	}
+	if err := CheckQuota(ctx, user.ID, 401); !errors.Is(err, ErrQuotaExceeded) {
+		t.Errorf("CheckQuota past the quota = %v, want ErrQuotaExceeded", err)
+	}
+
+	// -1 is unlimited
+	store.SetUserStorageQuota(ctx, user.ID, -1)
+	if err := CheckQuota(ctx, user.ID, 1<<40); err != nil {
+		t.Errorf("CheckQuota with no quota: %v", err)
+	}
+}
@@ -0,0 +1,55 @@
+package fileprocessor
+
+import (
+	"SE/internal/models"
+	"sort"
+)
+
+// MergeRanges returns the ranges sorted by start with overlapping and adjacent ranges joined
+func MergeRanges(ranges []models.ByteRange) []models.ByteRange {
+	sorted := make([]models.ByteRange, 0, len(ranges))
+	for _, r := range ranges {
+		if r.End > r.Start {
+			sorted = append(sorted, r)
+		}
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Start < sorted[j].Start })
+
+	merged := make([]models.ByteRange, 0, len(sorted))
+	for _, r := range sorted {
+		if n := len(merged); n > 0 && r.Start <= merged[n-1].End {
+			merged[n-1].End = max(merged[n-1].End, r.End)
+			continue
+		}
+		merged = append(merged, r)
+	}
+	return merged
+}
+
+// ReceivedBytes sums merged ranges
+func ReceivedBytes(merged []models.ByteRange) int64 {
+	var n int64
+	for _, r := range merged {
+		n += r.End - r.Start
+	}
+	return n
+}
+
+// MissingRanges returns the gaps in [0, total) not covered by the received ranges
+func MissingRanges(received []models.ByteRange, total int64) []models.ByteRange {
+	missing := []models.ByteRange{}
+	var pos int64
+	for _, r := range MergeRanges(received) {
+		if r.Start >= total {
+			break
+		}
+		if r.Start > pos {
+			missing = append(missing, models.ByteRange{Start: pos, End: r.Start})
+		}
+		pos = max(pos, r.End)
+	}
+	if pos < total {
+		missing = append(missing, models.ByteRange{Start: pos, End: total})
+	}
+	return missing
+}
@@ -0,0 +1,39 @@
+package fileprocessor
+
+import (
+	"SE/internal/models"
+	"reflect"
+	"testing"
+)
+
+func TestMergeRanges(t *testing.T) {
+	for _, tc := range []struct {
+		in, want []models.ByteRange
+	}{
+		{nil, []models.ByteRange{}},
+		{[]models.ByteRange{{Start: 10, End: 20}, {Start: 0, End: 10}}, []models.ByteRange{{Start: 0, End: 20}}},
+		{[]models.ByteRange{{Start: 0, End: 15}, {Start: 5, End: 10}, {Start: 30, End: 40}}, []models.ByteRange{{Start: 0, End: 15}, {Start: 30, End: 40}}},
+		{[]models.ByteRange{{Start: 5, End: 5}, {Start: 8, End: 3}}, []models.ByteRange{}},
+	} {
+		if got := MergeRanges(tc.in); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("MergeRanges(%v) = %v, want %v", tc.in, got, tc.want)
+		}
+	}
+}
+
+func TestMissingRanges(t *testing.T) {
+	for _, tc := range []struct {
+		in    []models.ByteRange
+		total int64
+		want  []models.ByteRange
+	}{
+		{nil, 100, []models.ByteRange{{Start: 0, End: 100}}},
+		{[]models.ByteRange{{Start: 0, End: 100}}, 100, []models.ByteRange{}},
+		{[]models.ByteRange{{Start: 60, End: 80}, {Start: 10, End: 30}}, 100, []models.ByteRange{{Start: 0, End: 10}, {Start: 30, End: 60}, {Start: 80, End: 100}}},
+		{[]models.ByteRange{{Start: 0, End: 50}, {Start: 120, End: 200}}, 100, []models.ByteRange{{Start: 50, End: 100}}},
+	} {
+		if got := MissingRanges(tc.in, tc.total); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("MissingRanges(%v, %d) = %v, want %v", tc.in, tc.total, got, tc.want)
+		}
+	}
+}
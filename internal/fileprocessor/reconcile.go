@@ -0,0 +1,100 @@
+package fileprocessor
+
+import (
+	"SE/internal/drivemanager"
+	"SE/internal/models"
+	"context"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// reconcileGrace is how old an unreferenced chunk file must be to count as orphaned; younger
+// ones may belong to an upload that hasn't recorded them yet
+const reconcileGrace = time.Hour
+
+// ReconcileReport compares the chunk files on one drive account with the chunks the database
+// references there
+type ReconcileReport struct {
+	AccountID  primitive.ObjectID            `json:"account_id"`
+	Label      string                        `json:"label,omitempty"`
+	Consistent int                           `json:"consistent"` // on the drive and referenced by a stored file
+	InFlight   int                           `json:"in_flight"`  // on the drive, recorded by an upload not yet stored
+	Recent     int                           `json:"recent"`     // unreferenced but younger than the grace period
+	Orphaned   []drivemanager.DriveChunkFile `json:"orphaned"`   // on the drive, referenced by nothing
+	Missing    []MissingChunk                `json:"missing"`    // referenced, but not on the drive
+	Error      string                        `json:"error,omitempty"`
+}
+
+// MissingChunk is a chunk of a stored file whose drive file is gone
+type MissingChunk struct {
+	FileID           primitive.ObjectID `json:"file_id"`
+	OriginalFilename string             `json:"original_filename"`
+	ChunkID          int                `json:"chunk_id"`
+	DriveFileID      string             `json:"drive_file_id"`
+}
+
+// ReconcileAccount lists the chunk files on account and classifies them against the chunks of
+// files, the user's stored files, and the checkpoints of sessions, the user's uploads
+func ReconcileAccount(ctx context.Context, account *models.DriveAccount, files []*models.StoredFile, sessions []*models.UploadSession) ReconcileReport {
+	report := ReconcileReport{
+		AccountID: account.ID,
+		Label:     account.Label,
+		Orphaned:  []drivemanager.DriveChunkFile{},
+		Missing:   []MissingChunk{},
+	}
+
+	onDrive, err := drivemanager.ListChunkFiles(ctx, account)
+	if err != nil {
+		report.Error = err.Error()
+		return report
+	}
+	present := make(map[string]bool, len(onDrive))
+	for _, f := range onDrive {
+		present[f.ID] = true
+	}
+
+	stored := make(map[string]bool)
+	for _, file := range files {
+		for _, chunk := range file.Chunks {
+			if chunk.DriveAccountID != account.ID || chunk.DriveFileID == "" {
+				continue
+			}
+			stored[chunk.DriveFileID] = true
+			if !present[chunk.DriveFileID] {
+				report.Missing = append(report.Missing, MissingChunk{
+					FileID:           file.ID,
+					OriginalFilename: file.OriginalFilename,
+					ChunkID:          chunk.ChunkID,
+					DriveFileID:      chunk.DriveFileID,
+				})
+			}
+		}
+	}
+	inFlight := make(map[string]bool)
+	for _, session := range sessions {
+		if session.Checkpoint == nil {
+			continue
+		}
+		for _, chunk := range session.Checkpoint.Chunks {
+			if chunk.DriveAccountID == account.ID.Hex() {
+				inFlight[chunk.DriveFileID] = true
+			}
+		}
+	}
+
+	cutoff := time.Now().Add(-reconcileGrace)
+	for _, f := range onDrive {
+		switch {
+		case stored[f.ID]:
+			report.Consistent++
+		case inFlight[f.ID]:
+			report.InFlight++
+		case f.CreatedTime.After(cutoff):
+			report.Recent++
+		default:
+			report.Orphaned = append(report.Orphaned, f)
+		}
+	}
+	return report
+}
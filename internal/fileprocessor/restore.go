@@ -0,0 +1,451 @@
+package fileprocessor
+
+import (
+	"SE/internal/drivemanager"
+	"SE/internal/events"
+	"SE/internal/models"
+	"SE/internal/store"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// restoreProgress tracks running restores for the stuck downloads gauge, CancelRestore and
+// ListRestores
+type restoreProgress struct {
+	id             primitive.ObjectID
+	fileID         primitive.ObjectID
+	userID         primitive.ObjectID
+	filename       string
+	streamed       bool
+	startedAt      time.Time
+	finishedAt     time.Time
+	latest         events.DownloadProgress // last progress published
+	cancel         context.CancelCauseFunc
+	cancelled      bool      // by CancelRestore; latest stays at the cancelled stage
+	last           time.Time // last progress
+	waitUntil      time.Time // end of a Drive download quota cool-down, which is not a stall
+	reconstructing bool      // fetching is done; rebuilding the file reports no progress
+}
+
+// Errors of CancelRestore, and what a restore it stopped fails with
+var (
+	ErrRestoreCancelled = errors.New("download cancelled")
+	ErrRestoreNotFound  = errors.New("download session not found")
+	ErrRestoreFinished  = errors.New("download already finished")
+)
+
+var (
+	activeRestoresMu sync.Mutex
+	activeRestores   = make(map[*restoreProgress]bool)
+)
+
+// countStuckRestores counts restores without progress since cutoff
+func countStuckRestores(cutoff time.Time) int {
+	activeRestoresMu.Lock()
+	defer activeRestoresMu.Unlock()
+	n := 0
+	for p := range activeRestores {
+		if !p.reconstructing && p.last.Before(cutoff) && p.waitUntil.Before(cutoff) {
+			n++
+		}
+	}
+	return n
+}
+
+// trackRestore registers a restore of a file, or a streamed download of it, returning the
+// context it runs under and a func to call when it ends
+func trackRestore(ctx context.Context, file *models.StoredFile, streamed bool) (context.Context, *restoreProgress, func()) {
+	ctx, cancel := context.WithCancelCause(ctx)
+	now := time.Now()
+	progress := &restoreProgress{
+		id:        primitive.NewObjectID(),
+		fileID:    file.ID,
+		userID:    file.UserID,
+		filename:  file.OriginalFilename,
+		streamed:  streamed,
+		startedAt: now,
+		latest:    events.DownloadProgress{FileID: file.ID.Hex(), Stage: events.StageFetching, ChunksTotal: len(file.Chunks)},
+		cancel:    cancel,
+		last:      now,
+	}
+	activeRestoresMu.Lock()
+	activeRestores[progress] = true
+	activeRestoresMu.Unlock()
+	return context.WithValue(ctx, restoreProgressKey{}, progress), progress, func() {
+		activeRestoresMu.Lock()
+		delete(activeRestores, progress)
+		progress.finishedAt = time.Now()
+		pruneRecentRestores()
+		recentRestores = append(recentRestores, progress)
+		activeRestoresMu.Unlock()
+		cancel(nil)
+	}
+}
+
+// CancelRestore stops one running restore or streamed download of a user's file, by the ID
+// ListRestores gives it, for downloads whose connection the caller doesn't control (e.g. one
+// handed to the browser's download manager). Other downloads of the file carry on. Its fetched
+// chunks are deleted, it fails with ErrRestoreCancelled and it is listed as cancelled from now
+// on. It returns the session as it now stands.
+func CancelRestore(userID, sessionID primitive.ObjectID) (RestoreStatus, error) {
+	activeRestoresMu.Lock()
+	defer activeRestoresMu.Unlock()
+	for p := range activeRestores {
+		if p.id == sessionID && p.userID == userID {
+			p.cancel(ErrRestoreCancelled)
+			p.cancelled = true
+			p.latest = events.DownloadProgress{FileID: p.fileID.Hex(), Stage: events.StageCancelled, ChunksDone: p.latest.ChunksDone, ChunksTotal: p.latest.ChunksTotal}
+			return p.status(), nil
+		}
+	}
+	for _, p := range recentRestores {
+		if p.id == sessionID && p.userID == userID {
+			return p.status(), ErrRestoreFinished
+		}
+	}
+	return RestoreStatus{}, ErrRestoreNotFound
+}
+
+// restoreFailed reports a restore that ended with err, telling a cancelled one apart
+func restoreFailed(ctx context.Context, file *models.StoredFile, err error) error {
+	if errors.Is(context.Cause(ctx), ErrRestoreCancelled) {
+		err = ErrRestoreCancelled
+		publishRestore(ctx, file, events.StageCancelled, 0, nil)
+		return err
+	}
+	publishRestore(ctx, file, events.StageFailed, 0, err)
+	return err
+}
+
+// ErrDownloadDiskFull is what a restore fails with when DOWNLOAD_TEMP_DIR has no room for it
+// beside the restores already running
+var ErrDownloadDiskFull = errors.New("not enough disk space to restore the file")
+
+var (
+	restoreDiskMu sync.Mutex
+	// restoreDiskReserved is what running restores may still write, at most
+	restoreDiskReserved int64
+)
+
+// restoreParallelism is how many chunks a restore of the user's fetches at once: their
+// parallel_downloads preference, capped by RESTORE_PARALLEL_DOWNLOADS
+func restoreParallelism(ctx context.Context, userID primitive.ObjectID) int {
+	prefs, err := store.GetUserPreferences(ctx, userID)
+	if err != nil {
+		log.Printf("Failed to load preferences of user %s, restoring with default parallelism: %v", userID.Hex(), err)
+		return restoreParallelFetches
+	}
+	if prefs.ParallelDownloads > 0 {
+		return min(prefs.ParallelDownloads, restoreParallelFetches)
+	}
+	return restoreParallelFetches
+}
+
+// restoreDiskNeed is the most disk a restore of file takes: the obfuscated stream, the output
+// and the chunk files waiting to be copied into the stream, parallel at a time
+func restoreDiskNeed(file *models.StoredFile, parallel int) int64 {
+	need := file.ProcessedSize + file.OriginalSize
+	if file.Erasure != nil {
+		// Every fetched shard is kept until the data is rebuilt
+		for _, c := range file.Chunks {
+			need += c.Size
+		}
+		return need
+	}
+	var largest int64
+	for _, c := range file.Chunks {
+		largest = max(largest, c.Size)
+	}
+	return need + int64(min(parallel, len(file.Chunks)))*largest
+}
+
+// reserveRestoreDisk sets aside the disk a restore of file needs, failing with
+// ErrDownloadDiskFull if the free space left over by running restores falls short. The
+// returned func gives it back.
+func reserveRestoreDisk(file *models.StoredFile, parallel int) (func(), error) {
+	need := restoreDiskNeed(file, parallel)
+	restoreDiskMu.Lock()
+	defer restoreDiskMu.Unlock()
+	// Platforms that can't report free space go unchecked
+	if free, err := freeDiskSpace(downloadTempDir); err == nil && free-restoreDiskReserved < need {
+		return nil, fmt.Errorf("%w: needs %d bytes, %d free and %d held by other restores", ErrDownloadDiskFull, need, free, restoreDiskReserved)
+	}
+	restoreDiskReserved += need
+	return func() {
+		restoreDiskMu.Lock()
+		restoreDiskReserved -= need
+		restoreDiskMu.Unlock()
+	}, nil
+}
+
+// RestoreFile downloads every chunk of a stored file, verifies it and rebuilds the original into outputPath
+func RestoreFile(ctx context.Context, file *models.StoredFile, outputPath string) error {
+	parallel := restoreParallelism(ctx, file.UserID)
+	release, err := reserveRestoreDisk(file, parallel)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	workDir, err := os.MkdirTemp(downloadTempDir, file.ID.Hex()+"-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(workDir)
+
+	ctx, progress, done := trackRestore(ctx, file, false)
+	defer done()
+
+	obfuscatedPath := filepath.Join(workDir, "obfuscated")
+	if file.Erasure != nil {
+		err = restoreErasureChunks(ctx, file, workDir, obfuscatedPath, parallel)
+	} else {
+		err = restoreSplitChunks(ctx, file, workDir, obfuscatedPath, parallel)
+	}
+	if err == nil {
+		activeRestoresMu.Lock()
+		progress.reconstructing = true
+		activeRestoresMu.Unlock()
+		publishRestore(ctx, file, events.StageReconstructing, 0, nil)
+		err = DeobfuscateFile(obfuscatedPath, outputPath, file.Obfuscation, file.OriginalSize)
+	}
+	if err != nil {
+		return restoreFailed(ctx, file, err)
+	}
+	publishRestore(ctx, file, events.StageReady, len(file.Chunks), nil)
+	return nil
+}
+
+// restoreProgressKey carries the restore's *restoreProgress in its context
+type restoreProgressKey struct{}
+
+// noteRestoreProgress records progress of the restore running under ctx
+func noteRestoreProgress(ctx context.Context, retryAt *time.Time) {
+	p, ok := ctx.Value(restoreProgressKey{}).(*restoreProgress)
+	if !ok {
+		return
+	}
+	activeRestoresMu.Lock()
+	p.last = time.Now()
+	if retryAt != nil {
+		p.waitUntil = *retryAt
+	}
+	activeRestoresMu.Unlock()
+}
+
+// publishRestore reports restore progress to anyone streaming the file's events
+func publishRestore(ctx context.Context, file *models.StoredFile, stage string, chunksDone int, err error) {
+	p := events.DownloadProgress{
+		FileID:      file.ID.Hex(),
+		Stage:       stage,
+		ChunksDone:  chunksDone,
+		ChunksTotal: len(file.Chunks),
+	}
+	if err != nil {
+		p.Error = err.Error()
+	}
+	publishDownload(ctx, file.ID, p)
+}
+
+// publishDownload records p as the latest progress of the restore running under ctx, for
+// ListRestores, and sends it to anyone streaming the file's events
+func publishDownload(ctx context.Context, fileID primitive.ObjectID, p events.DownloadProgress) {
+	if rp, ok := ctx.Value(restoreProgressKey{}).(*restoreProgress); ok {
+		p.SessionID = rp.id.Hex()
+		activeRestoresMu.Lock()
+		if !rp.cancelled || p.Stage == events.StageCancelled {
+			rp.latest = p
+		}
+		activeRestoresMu.Unlock()
+	}
+	events.Publish(events.DownloadTopic(fileID), p)
+}
+
+// fetchChunk downloads a chunk of file and checks it against its header, when it was stored
+// with one, and the recorded checksum
+func fetchChunk(ctx context.Context, file *models.StoredFile, chunk models.StoredChunk, destPath string) error {
+	// The checksum is taken as the chunk is written rather than by reading it back
+	var checksum string
+	var err error
+	if chunk.HeaderVersion > 0 {
+		checksum, err = drivemanager.DownloadHeadedChunk(ctx, chunk.DriveAccountID, chunk.DriveFileID, file.ID, chunk.ChunkID, chunk.Size, destPath)
+	} else {
+		checksum, err = drivemanager.DownloadChunkFromDrive(ctx, chunk.DriveAccountID, chunk.DriveFileID, destPath)
+	}
+	if err != nil {
+		return err
+	}
+	if checksum != chunk.Checksum {
+		os.Remove(destPath)
+		return fmt.Errorf("chunk %d checksum mismatch", chunk.ChunkID)
+	}
+	return nil
+}
+
+// fetchResult is the outcome of one attempt at fetching a chunk
+type fetchResult struct {
+	index int
+	path  string
+	err   error
+}
+
+// fetchChunks downloads chunks concurrently into workDir until need of them have verified,
+// calling onFetched for each one in turn. A chunk refused by Drive's download quota is retried
+// after a cool-down while the other chunks keep flowing, and the delay is reported in the
+// restore progress. A chunk that fails otherwise is retried with backoff up to
+// CHUNK_DOWNLOAD_ATTEMPTS times, behind the chunks still queued, so spare erasure shards are
+// tried first. Chunks that run out of attempts are tolerated as long as need can still be met.
+// At most parallel chunks are fetched at once.
+func fetchChunks(ctx context.Context, file *models.StoredFile, chunks []models.StoredChunk, workDir string, need, parallel int, onFetched func(i int, path string) error) error {
+	ctx, cancel := context.WithCancel(ctx)
+	var wg sync.WaitGroup
+	var timers []*time.Timer
+	defer func() {
+		for _, t := range timers {
+			t.Stop()
+		}
+		cancel()
+		wg.Wait()
+	}()
+
+	// Buffered so neither fetchers nor timers ever block once we've returned
+	results := make(chan fetchResult, len(chunks))
+	retries := make(chan int, len(chunks))
+
+	queue := make([]int, len(chunks)) // chunks ready to be fetched, in order
+	for i := range queue {
+		queue[i] = i
+	}
+	retryAt := make(map[int]time.Time) // chunks waiting out a download quota cool-down
+	quotaHits := make(map[int]int)
+	attempts := make(map[int]int) // failed attempts other than quota refusals
+	inFlight, fetched, failed := 0, 0, 0
+
+	report := func() {
+		p := events.DownloadProgress{
+			FileID:      file.ID.Hex(),
+			Stage:       events.StageFetching,
+			ChunksDone:  fetched,
+			ChunksTotal: len(file.Chunks),
+		}
+		if len(retryAt) > 0 {
+			var next time.Time
+			for _, t := range retryAt {
+				if next.IsZero() || t.Before(next) {
+					next = t
+				}
+			}
+			p.ChunksWaiting = len(retryAt)
+			p.RetryAt = &next
+			if inFlight == 0 {
+				p.Stage = events.StageWaiting
+			}
+		}
+		noteRestoreProgress(ctx, p.RetryAt)
+		publishDownload(ctx, file.ID, p)
+	}
+
+	for fetched < need {
+		// Keep just enough chunks in flight to reach need, within the parallelism limit
+		for len(queue) > 0 && inFlight < parallel && fetched+inFlight < need {
+			i := queue[0]
+			queue = queue[1:]
+			inFlight++
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				path := filepath.Join(workDir, chunks[i].Filename)
+				results <- fetchResult{index: i, path: path, err: fetchChunk(ctx, file, chunks[i], path)}
+			}()
+		}
+		report()
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case i := <-retries:
+			delete(retryAt, i)
+			queue = append(queue, i)
+		case res := <-results:
+			inFlight--
+			chunk := chunks[res.index]
+			var quotaErr *drivemanager.DownloadQuotaError
+			switch {
+			case res.err == nil:
+				if err := onFetched(res.index, res.path); err != nil {
+					return err
+				}
+				fetched++
+			case ctx.Err() != nil:
+				return ctx.Err()
+			case errors.As(res.err, &quotaErr) && quotaHits[res.index] < downloadQuotaRetries:
+				quotaHits[res.index]++
+				delay := max(downloadQuotaCooldown, quotaErr.RetryAfter)
+				retryAt[res.index] = time.Now().Add(delay)
+				log.Printf("Chunk %d of file %s hit the Drive download quota, retrying in %s (%d/%d)",
+					chunk.ChunkID, file.ID.Hex(), delay, quotaHits[res.index], downloadQuotaRetries)
+				i := res.index
+				timers = append(timers, time.AfterFunc(delay, func() { retries <- i }))
+			case attempts[res.index]+1 < chunkDownloadAttempts:
+				attempts[res.index]++
+				delay := drivemanager.Backoff(attempts[res.index] - 1)
+				log.Printf("Chunk %d of file %s failed (attempt %d/%d), retrying in %s: %v",
+					chunk.ChunkID, file.ID.Hex(), attempts[res.index], chunkDownloadAttempts, delay.Round(time.Millisecond), res.err)
+				i := res.index
+				timers = append(timers, time.AfterFunc(delay, func() { retries <- i }))
+			default:
+				failed++
+				if len(chunks)-failed < need {
+					return fmt.Errorf("chunk %d: %w", chunk.ChunkID, res.err)
+				}
+				log.Printf("Chunk %d of file %s unavailable: %v", chunk.ChunkID, file.ID.Hex(), res.err)
+			}
+		}
+	}
+	return nil
+}
+
+// restoreSplitChunks fetches plain chunks and writes each at its offset in the output
+func restoreSplitChunks(ctx context.Context, file *models.StoredFile, workDir, outputPath string, parallel int) error {
+	out, err := os.Create(outputPath)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	return fetchChunks(ctx, file, file.Chunks, workDir, len(file.Chunks), parallel, func(i int, chunkPath string) error {
+		in, err := os.Open(chunkPath)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(io.NewOffsetWriter(out, file.Chunks[i].StartOffset), in)
+		in.Close()
+		os.Remove(chunkPath)
+		return err
+	})
+}
+
+// restoreErasureChunks fetches shards and rebuilds the data from whichever ones verify
+func restoreErasureChunks(ctx context.Context, file *models.StoredFile, workDir, outputPath string, parallel int) error {
+	k, m := file.Erasure.DataShards, file.Erasure.ParityShards
+	shardPaths := make([]string, k+m)
+	// Only k shards are needed; the rest are fetched only to replace ones that fail
+	err := fetchChunks(ctx, file, file.Chunks, workDir, k, parallel, func(i int, chunkPath string) error {
+		shardPaths[file.Chunks[i].ShardIndex] = chunkPath
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	return ReconstructErasureFile(shardPaths, outputPath, k, m, file.ProcessedSize)
+}
@@ -0,0 +1,50 @@
+package fileprocessor
+
+import (
+	"SE/internal/events"
+	"SE/internal/models"
+	"context"
+	"errors"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestCancelRestore(t *testing.T) {
+	file := &models.StoredFile{ID: primitive.NewObjectID(), UserID: primitive.NewObjectID(), OriginalFilename: "movie.mkv", Chunks: make([]models.StoredChunk, 3)}
+	mine, progress, doneMine := trackRestore(context.Background(), file, false)
+	// Someone else downloading the same file, e.g. through a share
+	theirs, _, doneTheirs := trackRestore(context.Background(), file, true)
+	defer doneTheirs()
+
+	if _, err := CancelRestore(primitive.NewObjectID(), progress.id); !errors.Is(err, ErrRestoreNotFound) {
+		t.Errorf("cancel by another user = %v, want ErrRestoreNotFound", err)
+	}
+	if _, err := CancelRestore(file.UserID, primitive.NewObjectID()); !errors.Is(err, ErrRestoreNotFound) {
+		t.Errorf("cancel of an unknown session = %v, want ErrRestoreNotFound", err)
+	}
+
+	session, err := CancelRestore(file.UserID, progress.id)
+	if err != nil || session.ID != progress.id.Hex() || session.Stage != events.StageCancelled {
+		t.Fatalf("cancel = %+v, %v, want the session cancelled", session, err)
+	}
+	if !errors.Is(context.Cause(mine), ErrRestoreCancelled) {
+		t.Errorf("cancelled restore's context ended with %v", context.Cause(mine))
+	}
+	if theirs.Err() != nil {
+		t.Error("the other download of the file was cancelled too")
+	}
+
+	// Progress still in flight doesn't undo the cancelled stage
+	publishRestore(mine, file, events.StageFetching, 1, nil)
+	for _, s := range ListRestores(file.UserID) {
+		if s.ID == progress.id.Hex() && s.Stage != events.StageCancelled {
+			t.Errorf("cancelled session listed at stage %s", s.Stage)
+		}
+	}
+
+	doneMine()
+	if _, err := CancelRestore(file.UserID, progress.id); !errors.Is(err, ErrRestoreFinished) {
+		t.Errorf("cancel of a finished session = %v, want ErrRestoreFinished", err)
+	}
+}
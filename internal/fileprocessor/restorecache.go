@@ -0,0 +1,252 @@
+package fileprocessor
+
+import (
+	"SE/internal/metrics"
+	"SE/internal/models"
+	"container/list"
+	"context"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+var (
+	cacheHits      = metrics.NewCounter("restore_cache_hits_total", "Downloads served from the restore cache.")
+	cacheMisses    = metrics.NewCounter("restore_cache_misses_total", "Downloads that had to fetch chunks from Drive.")
+	cacheEvictions = metrics.NewCounter("restore_cache_evictions_total", "Files evicted from the restore cache.")
+)
+
+func init() {
+	metrics.NewGaugeFunc("restore_cache_bytes", "Bytes currently held in the restore cache.", func() float64 {
+		restoreCache.mu.Lock()
+		defer restoreCache.mu.Unlock()
+		return float64(restoreCache.size)
+	})
+}
+
+// cacheEntry is one reconstructed file kept on disk
+type cacheEntry struct {
+	fileID   primitive.ObjectID
+	userID   primitive.ObjectID
+	path     string
+	size     int64
+	lastUsed time.Time
+}
+
+// lruCache is a size-bounded on-disk LRU of reconstructed files with per-user quotas
+type lruCache struct {
+	mu        sync.Mutex
+	dir       string
+	maxBytes  int64
+	userQuota int64
+	ttl       time.Duration
+
+	size     int64
+	userSize map[primitive.ObjectID]int64
+	order    *list.List // front is most recently used
+	entries  map[primitive.ObjectID]*list.Element
+}
+
+var restoreCache = &lruCache{
+	userSize: make(map[primitive.ObjectID]int64),
+	order:    list.New(),
+	entries:  make(map[primitive.ObjectID]*list.Element),
+}
+
+// initRestoreCache resets the cache directory; entries don't survive restarts
+func initRestoreCache(dir string, maxBytes, userQuota int64, ttl time.Duration) {
+	restoreCache.mu.Lock()
+	defer restoreCache.mu.Unlock()
+	restoreCache.dir = dir
+	restoreCache.maxBytes = maxBytes
+	restoreCache.userQuota = userQuota
+	restoreCache.ttl = ttl
+	os.RemoveAll(dir)
+	os.MkdirAll(dir, 0700)
+}
+
+// OpenRestoredFile returns a reader over the original content of a stored file, reconstructing it
+// from Drive unless a cached copy exists. The bool reports a cache hit. The caller closes the file.
+func OpenRestoredFile(ctx context.Context, file *models.StoredFile) (*os.File, bool, error) {
+	if f := restoreCache.open(file.ID); f != nil {
+		cacheHits.Inc()
+		return f, true, nil
+	}
+	cacheMisses.Inc()
+
+	tmp, err := os.CreateTemp(restoreCache.dir, file.ID.Hex()+"-*.tmp")
+	if err != nil {
+		return nil, false, err
+	}
+	tmpPath := tmp.Name()
+	tmp.Close()
+
+	if err := RestoreFile(ctx, file, tmpPath); err != nil {
+		os.Remove(tmpPath)
+		return nil, false, err
+	}
+
+	path, cached := restoreCache.add(file.ID, file.UserID, tmpPath, file.OriginalSize)
+	f, err := os.Open(path)
+	if !cached {
+		// Too large to cache: the open handle keeps the data readable after the unlink
+		os.Remove(path)
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	return f, false, nil
+}
+
+// OpenRestoredCopy reconstructs a file like OpenRestoredFile but never through the cache, for
+// files known only from a key file. The copy is gone once the returned file is closed.
+func OpenRestoredCopy(ctx context.Context, file *models.StoredFile) (*os.File, error) {
+	tmp, err := os.CreateTemp(downloadTempDir, "copy-*.tmp")
+	if err != nil {
+		return nil, err
+	}
+	tmpPath := tmp.Name()
+	tmp.Close()
+	defer os.Remove(tmpPath)
+
+	if err := RestoreFile(ctx, file, tmpPath); err != nil {
+		return nil, err
+	}
+	return os.Open(tmpPath)
+}
+
+// OpenCachedFile returns the cached original content of a stored file, nil if it isn't cached.
+// The caller closes the file.
+func OpenCachedFile(file *models.StoredFile) *os.File {
+	f := restoreCache.open(file.ID)
+	if f != nil {
+		cacheHits.Inc()
+	}
+	return f
+}
+
+// InvalidateRestoreCache drops a file from the cache, e.g. after it was deleted or once the
+// client is done downloading it. It reports whether the file was cached.
+func InvalidateRestoreCache(fileID primitive.ObjectID) bool {
+	restoreCache.mu.Lock()
+	defer restoreCache.mu.Unlock()
+	el, ok := restoreCache.entries[fileID]
+	if ok {
+		restoreCache.remove(el)
+	}
+	return ok
+}
+
+// cachedUntil returns when the cached copy of a file expires unless it's used again, nil if
+// there is none
+func (c *lruCache) cachedUntil(fileID primitive.ObjectID) *time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.entries[fileID]
+	if !ok {
+		return nil
+	}
+	until := el.Value.(*cacheEntry).lastUsed.Add(c.ttl)
+	if time.Now().After(until) {
+		return nil
+	}
+	return &until
+}
+
+// open returns the cached file, or nil on a miss or expired entry
+func (c *lruCache) open(fileID primitive.ObjectID) *os.File {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.entries[fileID]
+	if !ok {
+		return nil
+	}
+	entry := el.Value.(*cacheEntry)
+	if time.Since(entry.lastUsed) > c.ttl {
+		c.remove(el)
+		return nil
+	}
+
+	f, err := os.Open(entry.path)
+	if err != nil {
+		c.remove(el)
+		return nil
+	}
+	entry.lastUsed = time.Now()
+	c.order.MoveToFront(el)
+	return f
+}
+
+// add moves a restored file into the cache, evicting as needed. It returns the file's
+// final path and whether it was kept; files that can never fit are not cached.
+func (c *lruCache) add(fileID, userID primitive.ObjectID, tmpPath string, size int64) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if size > c.maxBytes || size > c.userQuota {
+		return tmpPath, false
+	}
+
+	// A concurrent download may have cached it meanwhile
+	if el, ok := c.entries[fileID]; ok {
+		c.remove(el)
+	}
+
+	c.expire()
+	for c.userSize[userID]+size > c.userQuota {
+		c.evictOldest(func(e *cacheEntry) bool { return e.userID == userID })
+	}
+	for c.size+size > c.maxBytes {
+		c.evictOldest(nil)
+	}
+
+	path := filepath.Join(c.dir, fileID.Hex())
+	if err := os.Rename(tmpPath, path); err != nil {
+		return tmpPath, false
+	}
+
+	entry := &cacheEntry{fileID: fileID, userID: userID, path: path, size: size, lastUsed: time.Now()}
+	c.entries[fileID] = c.order.PushFront(entry)
+	c.size += size
+	c.userSize[userID] += size
+	return path, true
+}
+
+// expire drops entries unused for longer than the ttl
+func (c *lruCache) expire() {
+	for el := c.order.Back(); el != nil; {
+		prev := el.Prev()
+		if time.Since(el.Value.(*cacheEntry).lastUsed) > c.ttl {
+			c.remove(el)
+		}
+		el = prev
+	}
+}
+
+// evictOldest removes the least recently used entry matching match (any entry if nil)
+func (c *lruCache) evictOldest(match func(*cacheEntry) bool) {
+	for el := c.order.Back(); el != nil; el = el.Prev() {
+		if match == nil || match(el.Value.(*cacheEntry)) {
+			c.remove(el)
+			cacheEvictions.Inc()
+			return
+		}
+	}
+}
+
+func (c *lruCache) remove(el *list.Element) {
+	entry := el.Value.(*cacheEntry)
+	c.order.Remove(el)
+	delete(c.entries, entry.fileID)
+	c.size -= entry.size
+	c.userSize[entry.userID] -= entry.size
+	if c.userSize[entry.userID] <= 0 {
+		delete(c.userSize, entry.userID)
+	}
+	// Readers that already opened the file keep their handle
+	os.Remove(entry.path)
+}
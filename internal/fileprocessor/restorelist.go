@@ -0,0 +1,86 @@
+package fileprocessor
+
+import (
+	"SE/internal/events"
+	"slices"
+	"sort"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// recentRestoreTTL is how long a finished restore stays in ListRestores
+const recentRestoreTTL = time.Hour
+
+// recentRestores holds finished restores, oldest first, under activeRestoresMu
+var recentRestores []*restoreProgress
+
+// pruneRecentRestores drops finished restores older than recentRestoreTTL. The caller holds
+// activeRestoresMu.
+func pruneRecentRestores() {
+	cutoff := time.Now().Add(-recentRestoreTTL)
+	n := 0
+	for n < len(recentRestores) && !recentRestores[n].finishedAt.After(cutoff) {
+		n++
+	}
+	recentRestores = slices.Delete(recentRestores, 0, n)
+}
+
+// RestoreStatus is a download this server is running, or ran within the last hour: a
+// reconstruction, or a streamed download when Mode is "stream"
+type RestoreStatus struct {
+	ID       string `json:"id"`
+	Filename string `json:"filename"`
+	Mode     string `json:"mode"`
+	events.DownloadProgress
+	StartedAt  time.Time  `json:"started_at"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+	ExpiresAt  *time.Time `json:"expires_at,omitempty"` // when a finished one leaves the list
+	// Until when the reconstructed file can be downloaded again without fetching its chunks
+	CachedUntil *time.Time `json:"cached_until,omitempty"`
+}
+
+// status describes the restore for ListRestores. The caller holds activeRestoresMu.
+func (p *restoreProgress) status() RestoreStatus {
+	s := RestoreStatus{
+		ID:               p.id.Hex(),
+		Filename:         p.filename,
+		Mode:             "reconstruct",
+		DownloadProgress: p.latest,
+		StartedAt:        p.startedAt,
+	}
+	// The ID is already there
+	s.SessionID = ""
+	if p.streamed {
+		s.Mode = "stream"
+	}
+	if !p.finishedAt.IsZero() {
+		finished, expires := p.finishedAt, p.finishedAt.Add(recentRestoreTTL)
+		s.FinishedAt, s.ExpiresAt = &finished, &expires
+		s.CachedUntil = restoreCache.cachedUntil(p.fileID)
+	}
+	return s
+}
+
+// ListRestores returns the downloads of a user's files that are running or recently finished,
+// newest first. They are only known to the process that ran them.
+func ListRestores(userID primitive.ObjectID) []RestoreStatus {
+	activeRestoresMu.Lock()
+	defer activeRestoresMu.Unlock()
+
+	pruneRecentRestores()
+
+	list := []RestoreStatus{}
+	for p := range activeRestores {
+		if p.userID == userID {
+			list = append(list, p.status())
+		}
+	}
+	for _, p := range recentRestores {
+		if p.userID == userID {
+			list = append(list, p.status())
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].StartedAt.After(list[j].StartedAt) })
+	return list
+}
@@ -0,0 +1,175 @@
+package fileprocessor
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// Scanner checks uploaded content for malware before it is chunked
+type Scanner interface {
+	Scan(ctx context.Context, r io.Reader) (ScanResult, error)
+}
+
+// ScanResult is the verdict on one file
+type ScanResult struct {
+	Infected  bool
+	Signature string // name of the matched signature when infected
+}
+
+// scanner scans every upload before processing, nil when scanning is off
+var scanner Scanner
+
+// InitScanner sets up scanning with clamd when CLAMAV_ADDR is set
+func InitScanner() error {
+	scanner = nil
+	addr := os.Getenv("CLAMAV_ADDR")
+	if addr == "" {
+		return nil
+	}
+	clam, err := NewClamAVScanner(addr)
+	if err != nil {
+		return err
+	}
+	scanner = clam
+	return nil
+}
+
+// PingScanner checks that the scanner is reachable, when it can tell
+func PingScanner(ctx context.Context) error {
+	if p, ok := scanner.(interface{ Ping(context.Context) error }); ok {
+		return p.Ping(ctx)
+	}
+	return nil
+}
+
+// SetScanner replaces the scanner uploads are checked with; nil turns scanning off
+func SetScanner(s Scanner) {
+	scanner = s
+}
+
+// ScanningEnabled reports whether uploads are scanned
+func ScanningEnabled() bool {
+	return scanner != nil
+}
+
+// ScanFile runs the configured scanner over r
+func ScanFile(ctx context.Context, r io.Reader) (ScanResult, error) {
+	if scanner == nil {
+		return ScanResult{}, nil
+	}
+	return scanner.Scan(ctx, r)
+}
+
+// clamdChunkSize is how much of the file each INSTREAM chunk carries
+const clamdChunkSize = 1 << 20
+
+// ClamAVScanner streams files to a clamd daemon with the INSTREAM command
+type ClamAVScanner struct {
+	Network string // "tcp" or "unix"
+	Address string
+}
+
+// NewClamAVScanner parses CLAMAV_ADDR: "tcp://host:port", "unix:///path/to/clamd.sock" or "host:port"
+func NewClamAVScanner(addr string) (*ClamAVScanner, error) {
+	switch {
+	case strings.HasPrefix(addr, "unix://"):
+		return &ClamAVScanner{Network: "unix", Address: strings.TrimPrefix(addr, "unix://")}, nil
+	case strings.HasPrefix(addr, "tcp://"):
+		addr = strings.TrimPrefix(addr, "tcp://")
+	}
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		return nil, fmt.Errorf("CLAMAV_ADDR %q must be host:port, tcp://host:port or unix:///path", addr)
+	}
+	return &ClamAVScanner{Network: "tcp", Address: addr}, nil
+}
+
+// Ping checks that the daemon answers
+func (c *ClamAVScanner) Ping(ctx context.Context) error {
+	reply, err := c.command(ctx, "zPING\x00", nil)
+	if err != nil {
+		return err
+	}
+	if reply != "PONG" {
+		return fmt.Errorf("clamd answered %q to PING", reply)
+	}
+	return nil
+}
+
+// Scan streams r to clamd and parses its verdict
+func (c *ClamAVScanner) Scan(ctx context.Context, r io.Reader) (ScanResult, error) {
+	reply, err := c.command(ctx, "zINSTREAM\x00", func(conn net.Conn) error {
+		buf := make([]byte, 4+clamdChunkSize)
+		for {
+			n, readErr := io.ReadFull(r, buf[4:])
+			if n > 0 {
+				binary.BigEndian.PutUint32(buf[:4], uint32(n))
+				if _, err := conn.Write(buf[:4+n]); err != nil {
+					return err
+				}
+			}
+			if readErr == io.EOF || readErr == io.ErrUnexpectedEOF {
+				break
+			}
+			if readErr != nil {
+				return readErr
+			}
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+		}
+		// A zero-length chunk ends the stream
+		_, err := conn.Write([]byte{0, 0, 0, 0})
+		return err
+	})
+	if err != nil {
+		return ScanResult{}, err
+	}
+
+	// "stream: OK", "stream: <signature> FOUND" or "<reason> ERROR"
+	reply = strings.TrimPrefix(reply, "stream: ")
+	switch {
+	case reply == "OK":
+		return ScanResult{}, nil
+	case strings.HasSuffix(reply, " FOUND"):
+		return ScanResult{Infected: true, Signature: strings.TrimSuffix(reply, " FOUND")}, nil
+	}
+	return ScanResult{}, fmt.Errorf("clamd: %s", reply)
+}
+
+// command sends a null-terminated clamd command, then whatever send writes, and reads the reply
+func (c *ClamAVScanner) command(ctx context.Context, cmd string, send func(net.Conn) error) (string, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, c.Network, c.Address)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	// Unblock reads and writes when the context ends
+	stop := context.AfterFunc(ctx, func() { conn.SetDeadline(time.Now()) })
+	defer stop()
+
+	if _, err := conn.Write([]byte(cmd)); err != nil {
+		return "", err
+	}
+	if send != nil {
+		if err := send(conn); err != nil {
+			return "", err
+		}
+	}
+	reply, err := bufio.NewReader(conn).ReadString(0)
+	if err != nil && !(errors.Is(err, io.EOF) && reply != "") {
+		if ctx.Err() != nil {
+			return "", ctx.Err()
+		}
+		return "", err
+	}
+	return strings.TrimSpace(strings.TrimSuffix(reply, "\x00")), nil
+}
@@ -0,0 +1,118 @@
+package fileprocessor
+
+import (
+	"SE/internal/drivemanager"
+	"SE/internal/metrics"
+	"SE/internal/models"
+	"SE/internal/store"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"slices"
+	"time"
+)
+
+var chunksScrubbed = metrics.NewCounterVec("scrub_chunks_checked_total", "Chunks checked by the integrity scrubber, by what was found.", "health")
+
+// RunScrubber periodically downloads a sample of stored chunks and checks them against their
+// checksums, so chunks lost or damaged on a drive are noticed before someone needs the file.
+// Each run takes the files checked longest ago and, of those, the chunks checked longest ago.
+// It blocks until ctx is cancelled; a negative SCRUB_INTERVAL_MINUTES turns it off.
+func RunScrubber(ctx context.Context) {
+	if scrubInterval < 0 {
+		return
+	}
+	ticker := time.NewTicker(scrubInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			// Scrubbing can wait for a day with Drive API budget to spare
+			if !drivemanager.BackgroundWorkAllowed() {
+				continue
+			}
+			if err := scrubFiles(ctx); err != nil {
+				log.Printf("Scrubber: %v", err)
+			}
+		}
+	}
+}
+
+func scrubFiles(ctx context.Context) error {
+	files, err := store.ListFilesToScrub(ctx, scrubFilesPerRun)
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err := scrubFile(ctx, file); err != nil {
+			log.Printf("Scrubber: failed to record checks of file %s: %v", file.ID.Hex(), err)
+		}
+	}
+	return nil
+}
+
+// scrubFile checks up to SCRUB_CHUNKS_PER_FILE chunks of file and records what it found.
+// Chunks that couldn't be checked, e.g. because the drive was unreachable, keep their
+// previous health.
+func scrubFile(ctx context.Context, file *models.StoredFile) error {
+	chunks := slices.Clone(file.Chunks)
+	// Never checked first, then the longest ago; ties in random order
+	rand.Shuffle(len(chunks), func(i, j int) { chunks[i], chunks[j] = chunks[j], chunks[i] })
+	slices.SortStableFunc(chunks, func(a, b models.StoredChunk) int {
+		switch {
+		case a.LastCheckedAt == nil && b.LastCheckedAt == nil:
+			return 0
+		case a.LastCheckedAt == nil:
+			return -1
+		case b.LastCheckedAt == nil:
+			return 1
+		}
+		return a.LastCheckedAt.Compare(*b.LastCheckedAt)
+	})
+	if len(chunks) > scrubChunksPerFile {
+		chunks = chunks[:scrubChunksPerFile]
+	}
+
+	checks := make([]store.ChunkCheck, 0, len(chunks))
+	for _, chunk := range chunks {
+		health, err := checkChunk(ctx, file, chunk)
+		if err != nil {
+			log.Printf("Scrubber: could not check chunk %d of file %s: %v", chunk.ChunkID, file.ID.Hex(), err)
+			continue
+		}
+		if health != models.ChunkOK {
+			log.Printf("Scrubber: chunk %d of file %s is %s", chunk.ChunkID, file.ID.Hex(), health)
+		}
+		chunksScrubbed.Inc(health)
+		checks = append(checks, store.ChunkCheck{ChunkID: chunk.ChunkID, DriveFileID: chunk.DriveFileID, Health: health})
+	}
+	// Recorded even with no checks, so a file whose drives are down doesn't hold up the others
+	return store.RecordChunkChecks(ctx, file.ID, checks, time.Now().UTC())
+}
+
+// checkChunk downloads a chunk and returns its health. An error means it couldn't be told.
+func checkChunk(ctx context.Context, file *models.StoredFile, chunk models.StoredChunk) (string, error) {
+	hash := sha256.New()
+	err := drivemanager.StreamChunk(ctx, chunk.DriveAccountID, chunk.DriveFileID, file.ID, chunk.ChunkID, chunk.Size, chunk.HeaderVersion > 0, hash)
+	switch {
+	case drivemanager.IsNotFound(err):
+		return models.ChunkMissing, nil
+	case errors.Is(err, drivemanager.ErrBadChunkHeader):
+		return models.ChunkCorrupt, nil
+	case err != nil:
+		return "", err
+	}
+	if fmt.Sprintf("%x", hash.Sum(nil)) != chunk.Checksum {
+		return models.ChunkCorrupt, nil
+	}
+	return models.ChunkOK, nil
+}
@@ -1,14 +1,20 @@
 package fileprocessor
 
 import (
+	"SE/internal/events"
+	"SE/internal/metrics"
 	"SE/internal/models"
+	"SE/internal/notify"
 	"SE/internal/store"
 	"context"
 	"errors"
 	"fmt"
+	"log"
 	"os"
+	"path"
 	"path/filepath"
 	"strconv"
+	"strings"
 	"time"
 
 	"go.mongodb.org/mongo-driver/bson/primitive"
@@ -16,10 +22,37 @@ import (
 
 var (
 	uploadTempDir           string
+	downloadTempDir         string
 	maxFileSizeBytes        int64
 	sessionExpiryDuration   time.Duration
+	maxSessionExtension     time.Duration
 	maxConcurrentPerUser    int
 	tempFileCleanupDuration time.Duration
+	erasureParityShards     int
+	keyFileSuffix           string
+	maxChunkSize            int64
+	minChunkSize            int64
+	stageTimeout            time.Duration
+	stageRetries            int
+	sessionStallDuration    time.Duration
+	stuckThreshold          time.Duration
+	restoreParallelFetches  int
+	chunkDownloadAttempts   int
+	downloadQuotaCooldown   time.Duration
+	downloadQuotaRetries    int
+	streamDownloads         bool
+	maxBatchFiles           int
+	incompleteRetention     time.Duration
+	defaultUserQuota        int64
+	fetchTimeout            time.Duration
+	fetchAllowedTypes       []string
+	fetchAllowPrivate       bool
+	scrubInterval           time.Duration
+	scrubFilesPerRun        int
+	scrubChunksPerFile      int
+	exportDir               string
+	exportRetention         time.Duration
+	trashRetention          time.Duration
 )
 
 func InitFileConfig() {
@@ -39,6 +72,10 @@ func InitFileConfig() {
 	}
 	maxFileSizeBytes = maxGB * 1024 * 1024 * 1024
 
+	// Storage quota per user, 0 for unlimited; users can have their own set by an admin
+	quotaGB, _ := strconv.ParseInt(os.Getenv("USER_QUOTA_GB"), 10, 64)
+	defaultUserQuota = quotaGB * 1024 * 1024 * 1024
+
 	// Timeout for session, essential to kill uploads.
 	expiryHours, _ := strconv.Atoi(os.Getenv("SESSION_EXPIRY_HOURS"))
 	if expiryHours == 0 {
@@ -46,18 +83,219 @@ func InitFileConfig() {
 	}
 	sessionExpiryDuration = time.Duration(expiryHours) * time.Hour
 
+	// Longest a user can push a session's expiry out by at once
+	extensionHours, _ := strconv.Atoi(os.Getenv("SESSION_MAX_EXTENSION_HOURS"))
+	if extensionHours == 0 {
+		extensionHours = 24
+	}
+	maxSessionExtension = time.Duration(extensionHours) * time.Hour
+
 	// Max concurrent uploads
 	maxConcurrentPerUser, _ = strconv.Atoi(os.Getenv("MAX_CONCURRENT_UPLOADS_PER_USER"))
 	if maxConcurrentPerUser == 0 {
 		maxConcurrentPerUser = 1 //default only one is allowed.
 	}
 
+	// Max files in one batch upload
+	maxBatchFiles, _ = strconv.Atoi(os.Getenv("MAX_BATCH_FILES"))
+	if maxBatchFiles == 0 {
+		maxBatchFiles = 100
+	}
+
 	// Cleanup duration: deletes the uploaded file adfter some time.
 	cleanupMins, _ := strconv.Atoi(os.Getenv("TEMP_FILE_CLEANUP_MINUTES"))
 	if cleanupMins == 0 {
 		cleanupMins = 10
 	}
 	tempFileCleanupDuration = time.Duration(cleanupMins) * time.Minute
+
+	// How long an incomplete file's upload is kept around for a repair
+	retentionHours, _ := strconv.Atoi(os.Getenv("INCOMPLETE_RETENTION_HOURS"))
+	if retentionHours == 0 {
+		retentionHours = 72
+	}
+	incompleteRetention = time.Duration(retentionHours) * time.Hour
+
+	// Limits on files the server fetches from a URL
+	fetchMins, _ := strconv.Atoi(os.Getenv("URL_FETCH_TIMEOUT_MINUTES"))
+	if fetchMins == 0 {
+		fetchMins = 120
+	}
+	fetchTimeout = time.Duration(fetchMins) * time.Minute
+	fetchAllowedTypes = nil
+	for _, t := range strings.Split(os.Getenv("URL_FETCH_ALLOWED_TYPES"), ",") {
+		if t = strings.ToLower(strings.TrimSpace(t)); t != "" {
+			fetchAllowedTypes = append(fetchAllowedTypes, t)
+		}
+	}
+	fetchAllowPrivate = os.Getenv("URL_FETCH_ALLOW_PRIVATE") == "true"
+
+	// Default number of parity shards for the erasure strategy
+	erasureParityShards, _ = strconv.Atoi(os.Getenv("ERASURE_PARITY_SHARDS"))
+	if erasureParityShards == 0 {
+		erasureParityShards = 1
+	}
+
+	// Appended to the original filename to name its key file
+	keyFileSuffix = os.Getenv("KEY_FILE_SUFFIX")
+	if keyFileSuffix == "" || strings.ContainsAny(keyFileSuffix, `/\`) {
+		keyFileSuffix = ".2xpfm.key"
+	}
+
+	// Chunk size bounds every strategy keeps to, 0 for none. Big chunks make Drive uploads
+	// fragile, tiny ones waste key file entries. The minimum is kept to at most half the maximum
+	// so that splitting an oversized chunk evenly never leaves pieces below it.
+	maxChunkMB, _ := strconv.ParseInt(os.Getenv("MAX_CHUNK_SIZE_MB"), 10, 64)
+	minChunkMB, _ := strconv.ParseInt(os.Getenv("MIN_CHUNK_SIZE_MB"), 10, 64)
+	maxChunkSize = max(maxChunkMB, 0) * 1024 * 1024
+	minChunkSize = max(minChunkMB, 0) * 1024 * 1024
+	if maxChunkSize > 0 && minChunkSize > maxChunkSize/2 {
+		minChunkSize = maxChunkSize / 2
+	}
+
+	// Deadline for a single processing stage (drive space check, chunk uploads)
+	stageMins, _ := strconv.Atoi(os.Getenv("PROCESSING_STAGE_TIMEOUT_MINUTES"))
+	if stageMins == 0 {
+		stageMins = 120
+	}
+	stageTimeout = time.Duration(stageMins) * time.Minute
+
+	// How often a stage that hit its deadline is retried
+	stageRetries, _ = strconv.Atoi(os.Getenv("PROCESSING_STAGE_RETRIES"))
+	if stageRetries == 0 {
+		stageRetries = 2
+	}
+
+	// Processing sessions without a heartbeat for this long are marked failed by the watchdog
+	stallMins, _ := strconv.Atoi(os.Getenv("SESSION_STALL_MINUTES"))
+	if stallMins == 0 {
+		stallMins = 10
+	}
+	sessionStallDuration = time.Duration(stallMins) * time.Minute
+
+	// Sessions and downloads without progress for this long count as stuck in the metrics
+	stuckMins, _ := strconv.Atoi(os.Getenv("STUCK_THRESHOLD_MINUTES"))
+	if stuckMins == 0 {
+		stuckMins = 5
+	}
+	stuckThreshold = time.Duration(stuckMins) * time.Minute
+
+	// Scratch space for chunks fetched while restoring a file
+	downloadTempDir = os.Getenv("DOWNLOAD_TEMP_DIR")
+	if downloadTempDir == "" {
+		downloadTempDir = "/tmp/2xpfm_downloads"
+	}
+	os.MkdirAll(downloadTempDir, 0755)
+
+	// Chunks of one file fetched concurrently while restoring
+	restoreParallelFetches, _ = strconv.Atoi(os.Getenv("RESTORE_PARALLEL_DOWNLOADS"))
+	if restoreParallelFetches <= 0 {
+		restoreParallelFetches = 3
+	}
+
+	// A chunk that fails to download or verify is tried this many times before it counts as lost
+	chunkDownloadAttempts, _ = strconv.Atoi(os.Getenv("CHUNK_DOWNLOAD_ATTEMPTS"))
+	if chunkDownloadAttempts <= 0 {
+		chunkDownloadAttempts = 3
+	}
+
+	// A chunk refused by Drive's per-file download quota is retried after this cool-down
+	// (or Drive's Retry-After if longer), up to DOWNLOAD_QUOTA_RETRIES times
+	cooldownMins, _ := strconv.Atoi(os.Getenv("DOWNLOAD_QUOTA_COOLDOWN_MINUTES"))
+	if cooldownMins == 0 {
+		cooldownMins = 15
+	}
+	downloadQuotaCooldown = time.Duration(cooldownMins) * time.Minute
+	downloadQuotaRetries, _ = strconv.Atoi(os.Getenv("DOWNLOAD_QUOTA_RETRIES"))
+	if downloadQuotaRetries == 0 {
+		downloadQuotaRetries = 4
+	}
+
+	// "stream" sends downloads straight from the drives instead of reconstructing them first
+	streamDownloads = os.Getenv("DOWNLOAD_MODE") == "stream"
+
+	// The integrity scrubber checks a few chunks of the least recently checked files each run
+	scrubMins, _ := strconv.Atoi(os.Getenv("SCRUB_INTERVAL_MINUTES"))
+	if scrubMins == 0 {
+		scrubMins = 60
+	}
+	scrubInterval = time.Duration(scrubMins) * time.Minute
+	scrubFilesPerRun, _ = strconv.Atoi(os.Getenv("SCRUB_FILES_PER_RUN"))
+	if scrubFilesPerRun <= 0 {
+		scrubFilesPerRun = 10
+	}
+	scrubChunksPerFile, _ = strconv.Atoi(os.Getenv("SCRUB_CHUNKS_PER_FILE"))
+	if scrubChunksPerFile <= 0 {
+		scrubChunksPerFile = 1
+	}
+
+	// Staging area of bulk exports, kept for EXPORT_RETENTION_HOURS after they finish
+	exportDir = os.Getenv("EXPORT_DIR")
+	if exportDir == "" {
+		exportDir = "/tmp/2xpfm_exports"
+	}
+	exportHours, _ := strconv.Atoi(os.Getenv("EXPORT_RETENTION_HOURS"))
+	if exportHours == 0 {
+		exportHours = 24
+	}
+	exportRetention = time.Duration(exportHours) * time.Hour
+
+	// Trashed files, chunks and obfuscation seeds included, are purged after TRASH_RETENTION_DAYS;
+	// DELETED_FILE_RETENTION_DAYS is its older name. Unlike most settings, 0 is a value here:
+	// the trash is emptied at every purge run.
+	retentionDays := 30
+	for _, name := range []string{"DELETED_FILE_RETENTION_DAYS", "TRASH_RETENTION_DAYS"} {
+		if v, ok := os.LookupEnv(name); ok {
+			if days, err := strconv.Atoi(strings.TrimSpace(v)); err == nil {
+				retentionDays = days
+			}
+		}
+	}
+	trashRetention = time.Duration(retentionDays) * 24 * time.Hour
+
+	// Restore cache: recently reconstructed files, bounded overall and per user
+	cacheDir := os.Getenv("RESTORE_CACHE_DIR")
+	if cacheDir == "" {
+		cacheDir = "/tmp/2xpfm_restore_cache"
+	}
+	cacheGB, _ := strconv.ParseInt(os.Getenv("RESTORE_CACHE_MAX_GB"), 10, 64)
+	if cacheGB == 0 {
+		cacheGB = 5
+	}
+	userQuotaMB, _ := strconv.ParseInt(os.Getenv("RESTORE_CACHE_USER_QUOTA_MB"), 10, 64)
+	if userQuotaMB == 0 {
+		userQuotaMB = 1024
+	}
+	cacheMins, _ := strconv.Atoi(os.Getenv("RESTORE_CACHE_TTL_MINUTES"))
+	if cacheMins == 0 {
+		cacheMins = 60
+	}
+	initRestoreCache(cacheDir, cacheGB*1024*1024*1024, userQuotaMB*1024*1024, time.Duration(cacheMins)*time.Minute)
+}
+
+// MaxBatchFiles is the most files one batch upload or zip download may have
+func MaxBatchFiles() int {
+	return maxBatchFiles
+}
+
+// CheckTempDir verifies the upload temp dir is writable and returns its free space in bytes,
+// or -1 when free space can't be determined on this platform
+func CheckTempDir() (string, int64, error) {
+	if err := os.MkdirAll(uploadTempDir, 0755); err != nil {
+		return uploadTempDir, 0, err
+	}
+	probe, err := os.CreateTemp(uploadTempDir, ".selfcheck-*")
+	if err != nil {
+		return uploadTempDir, 0, fmt.Errorf("temp dir not writable: %w", err)
+	}
+	probe.Close()
+	os.Remove(probe.Name())
+
+	free, err := freeDiskSpace(uploadTempDir)
+	if err != nil {
+		return uploadTempDir, -1, nil
+	}
+	return uploadTempDir, free, nil
 }
 
 // You fucking java users thats how it is meant to be done. Learn from below.
@@ -65,29 +303,92 @@ func GetMaxFileSize() int64 {
 	return maxFileSizeBytes
 }
 
-func CreateUploadSession(ctx context.Context, userID primitive.ObjectID, filename string, totalSize int64) (*models.UploadSession, error) {
+func CreateUploadSession(ctx context.Context, userID primitive.ObjectID, filename, folder string, totalSize int64, client *models.ClientInfo) (*models.UploadSession, error) {
 	// Check file size limit
 	if totalSize > maxFileSizeBytes {
 		return nil, fmt.Errorf("file size %d exceeds maximum allowed %d bytes", totalSize, maxFileSizeBytes)
 	}
 
 	// Check concurrent uploads
+	if err := checkConcurrentUploads(ctx, userID); err != nil {
+		return nil, err
+	}
+	if err := CheckQuota(ctx, userID, totalSize); err != nil {
+		return nil, err
+	}
+
+	session := newUploadSession(userID, filename, folder, totalSize, client)
+	if err := store.CreateUploadSession(ctx, session); err != nil {
+		return nil, err
+	}
+
+	return session, nil
+}
+
+// BatchFile is one file of a batch upload
+type BatchFile struct {
+	Filename string
+	Folder   string
+	Size     int64
+}
+
+// CreateUploadBatch creates one upload session per file, grouped under a new batch ID.
+// The batch counts as a single upload against the concurrency limit.
+func CreateUploadBatch(ctx context.Context, userID primitive.ObjectID, files []BatchFile, client *models.ClientInfo) ([]*models.UploadSession, error) {
+	if len(files) > maxBatchFiles {
+		return nil, fmt.Errorf("batch of %d files exceeds maximum of %d", len(files), maxBatchFiles)
+	}
+	for _, f := range files {
+		if f.Size > maxFileSizeBytes {
+			return nil, fmt.Errorf("%s: file size %d exceeds maximum allowed %d bytes", f.Filename, f.Size, maxFileSizeBytes)
+		}
+	}
+
+	if err := checkConcurrentUploads(ctx, userID); err != nil {
+		return nil, err
+	}
+	var total int64
+	for _, f := range files {
+		total += f.Size
+	}
+	if err := CheckQuota(ctx, userID, total); err != nil {
+		return nil, err
+	}
+
+	batchID := primitive.NewObjectID()
+	sessions := make([]*models.UploadSession, len(files))
+	for i, f := range files {
+		sessions[i] = newUploadSession(userID, f.Filename, f.Folder, f.Size, client)
+		sessions[i].BatchID = batchID
+	}
+	if err := store.CreateUploadSessions(ctx, sessions); err != nil {
+		return nil, err
+	}
+	return sessions, nil
+}
+
+func checkConcurrentUploads(ctx context.Context, userID primitive.ObjectID) error {
 	activeSessions, err := store.CountActiveUserSessions(ctx, userID)
 	if err != nil {
-		return nil, err
+		return err
 	}
 	if activeSessions >= maxConcurrentPerUser {
-		return nil, fmt.Errorf("maximum concurrent uploads (%d) reached", maxConcurrentPerUser)
+		return fmt.Errorf("maximum concurrent uploads (%d) reached", maxConcurrentPerUser)
 	}
+	return nil
+}
 
+func newUploadSession(userID primitive.ObjectID, filename, folder string, totalSize int64, client *models.ClientInfo) *models.UploadSession {
 	// Create temp file path
 	sessionID := primitive.NewObjectID()
 	tempPath := filepath.Join(uploadTempDir, fmt.Sprintf("%s_%s", sessionID.Hex(), filename))
 
-	session := &models.UploadSession{
+	return &models.UploadSession{
 		ID:               sessionID,
 		UserID:           userID,
 		OriginalFilename: filename,
+		Folder:           folder,
+		Client:           client,
 		TempFilePath:     tempPath,
 		TotalSize:        totalSize,
 		UploadedSize:     0,
@@ -95,12 +396,24 @@ func CreateUploadSession(ctx context.Context, userID primitive.ObjectID, filenam
 		CreatedAt:        time.Now(),
 		ExpiresAt:        time.Now().Add(sessionExpiryDuration),
 	}
+}
 
-	if err := store.CreateUploadSession(ctx, session); err != nil {
-		return nil, err
+// NormalizeFolder cleans a folder path into "/a/b" form; the root folder is ""
+func NormalizeFolder(folder string) (string, error) {
+	folder = strings.TrimSpace(folder)
+	if strings.ContainsRune(folder, '\\') {
+		return "", errors.New("folder must use / as separator")
 	}
-
-	return session, nil
+	for _, part := range strings.Split(folder, "/") {
+		if part == ".." {
+			return "", errors.New("folder must not contain ..")
+		}
+	}
+	cleaned := path.Clean("/" + folder)
+	if cleaned == "/" {
+		return "", nil
+	}
+	return cleaned, nil
 }
 
 func GetSession(ctx context.Context, sessionID primitive.ObjectID, userID primitive.ObjectID) (*models.UploadSession, error) {
@@ -108,6 +421,21 @@ func GetSession(ctx context.Context, sessionID primitive.ObjectID, userID primit
 	if err != nil {
 		return nil, err
 	}
+	return checkSession(session, userID)
+}
+
+// GetChunkSession is GetSession for the chunk upload handlers, which may be served a cached
+// session whose received ranges and uploaded size are behind
+func GetChunkSession(ctx context.Context, sessionID primitive.ObjectID, userID primitive.ObjectID) (*models.UploadSession, error) {
+	session, err := store.GetCachedUploadSession(ctx, sessionID)
+	if err != nil {
+		return nil, err
+	}
+	return checkSession(session, userID)
+}
+
+// checkSession returns the session if it exists, is the user's and hasn't expired
+func checkSession(session *models.UploadSession, userID primitive.ObjectID) (*models.UploadSession, error) {
 	if session == nil {
 		return nil, errors.New("session not found")
 	}
@@ -120,43 +448,211 @@ func GetSession(ctx context.Context, sessionID primitive.ObjectID, userID primit
 	return session, nil
 }
 
-func UpdateSessionProgress(ctx context.Context, sessionID primitive.ObjectID, uploadedSize int64) error {
-	return store.UpdateSessionUploadProgress(ctx, sessionID, uploadedSize)
+// ErrExtensionTooLong is returned when an extension is longer than SESSION_MAX_EXTENSION_HOURS
+var ErrExtensionTooLong = errors.New("extension too long")
+
+// extendableStatuses are the statuses a session can still make progress from
+var extendableStatuses = []string{"uploading", "processing", "paused", "incomplete"}
+
+// ExtendSession moves a session's expiry out to d from now, or SESSION_EXPIRY_HOURS when d is 0.
+// An expiry already later than that is kept. Returns nil if the session has expired or is done.
+func ExtendSession(ctx context.Context, sessionID primitive.ObjectID, d time.Duration) (*models.UploadSession, error) {
+	if d == 0 {
+		d = sessionExpiryDuration
+	}
+	if d > maxSessionExtension {
+		return nil, ErrExtensionTooLong
+	}
+	return store.ExtendSessionExpiry(ctx, sessionID, time.Now().Add(d), extendableStatuses)
+}
+
+// MaxSessionExtension is the longest extension ExtendSession allows
+func MaxSessionExtension() time.Duration {
+	return maxSessionExtension
+}
+
+// RecordReceivedRange marks [start, end) of the upload as received and returns the session
+// with its merged ranges and uploaded size
+func RecordReceivedRange(ctx context.Context, sessionID primitive.ObjectID, start, end int64) (*models.UploadSession, error) {
+	session, err := store.AddSessionReceivedRange(ctx, sessionID, models.ByteRange{Start: start, End: end})
+	if err != nil {
+		return nil, err
+	}
+	seen := len(session.ReceivedRanges)
+	session.ReceivedRanges = MergeRanges(session.ReceivedRanges)
+	session.UploadedSize = ReceivedBytes(session.ReceivedRanges)
+	if err := store.CompactSessionRanges(ctx, sessionID, seen, session.ReceivedRanges, session.UploadedSize); err != nil {
+		return nil, err
+	}
+	events.Publish(events.UploadTopic(sessionID), nil)
+	return session, nil
 }
 
 func UpdateSessionStatus(ctx context.Context, sessionID primitive.ObjectID, status string, progress float64, errorMsg string) error {
-	return store.UpdateSessionStatus(ctx, sessionID, status, progress, errorMsg)
+	err := store.UpdateSessionStatus(ctx, sessionID, status, progress, errorMsg)
+	events.Publish(events.UploadTopic(sessionID), nil)
+	return err
+}
+
+// RequestPause asks the processing run of a session to stop once its chunks in flight are on
+// their drives. Returns false if the session isn't processing.
+func RequestPause(ctx context.Context, sessionID primitive.ObjectID) (bool, error) {
+	ok, err := store.RequestSessionPause(ctx, sessionID)
+	if ok {
+		events.Publish(events.UploadTopic(sessionID), nil)
+	}
+	return ok, err
+}
+
+// PauseSession records that processing stopped at a pause request
+func PauseSession(ctx context.Context, sessionID primitive.ObjectID, progress float64, message string) error {
+	err := store.PauseSession(ctx, sessionID, progress, message)
+	events.Publish(events.UploadTopic(sessionID), nil)
+	return err
+}
+
+// ResumeSession moves a paused session back to processing. Returns false if it isn't paused.
+func ResumeSession(ctx context.Context, sessionID primitive.ObjectID) (bool, error) {
+	ok, err := store.ResumeSession(ctx, sessionID)
+	if ok {
+		events.Publish(events.UploadTopic(sessionID), nil)
+	}
+	return ok, err
+}
+
+// MarkIncomplete records that a session stored only some of its chunks. The session, its
+// checkpoint and the uploaded file are kept for INCOMPLETE_RETENTION_HOURS so it can be repaired.
+func MarkIncomplete(ctx context.Context, session *models.UploadSession, progress float64, message string) error {
+	err := store.MarkSessionIncomplete(ctx, session.ID, progress, message, time.Now().Add(incompleteRetention))
+	events.Publish(events.UploadTopic(session.ID), nil)
+	notify.Notify(notify.Event{
+		Type:    notify.EventUploadFailed,
+		UserID:  session.UserID,
+		Title:   fmt.Sprintf("Upload of %s is incomplete", session.OriginalFilename),
+		Message: message,
+	})
+	ScheduleCleanupAfter(ctx, session.ID, incompleteRetention)
+	return err
+}
+
+// RepairSession moves an incomplete session back to processing. Returns false if it isn't incomplete.
+func RepairSession(ctx context.Context, sessionID primitive.ObjectID) (bool, error) {
+	ok, err := store.RepairSession(ctx, sessionID)
+	if ok {
+		events.Publish(events.UploadTopic(sessionID), nil)
+	}
+	return ok, err
 }
 
-func CompleteSession(ctx context.Context, sessionID primitive.ObjectID) error {
-	now := time.Now()
-	return store.CompleteSession(ctx, sessionID, &now)
+// FailSession marks a session failed and notifies its owner
+func FailSession(ctx context.Context, session *models.UploadSession, progress float64, errorMsg string) error {
+	err := store.UpdateSessionStatus(ctx, session.ID, "failed", progress, errorMsg)
+	events.Publish(events.UploadTopic(session.ID), nil)
+	notify.Notify(notify.Event{
+		Type:    notify.EventUploadFailed,
+		UserID:  session.UserID,
+		Title:   fmt.Sprintf("Upload of %s failed", session.OriginalFilename),
+		Message: errorMsg,
+	})
+	return err
+}
+
+// RejectInfected marks a session whose upload matched a malware signature as infected, deletes
+// the uploaded file and notifies its owner. Nothing of the file has reached a drive.
+func RejectInfected(ctx context.Context, session *models.UploadSession, progress float64, signature string) error {
+	msg := "Infected: " + signature
+	err := store.UpdateSessionStatus(ctx, session.ID, "infected", progress, msg)
+	if session.TempFilePath != "" {
+		os.Remove(session.TempFilePath)
+	}
+	events.Publish(events.UploadTopic(session.ID), nil)
+	notify.Notify(notify.Event{
+		Type:    notify.EventUploadFailed,
+		UserID:  session.UserID,
+		Title:   fmt.Sprintf("Upload of %s was rejected: malware found", session.OriginalFilename),
+		Message: msg,
+	})
+	return err
 }
 
-func CleanupExpiredSessions(ctx context.Context) error {
+// uploadLatency is the end-to-end time of an upload, from initiate to complete
+var uploadLatency = metrics.NewHistogramVec("upload_duration_seconds",
+	"Time from upload initiation to completion, by file size and chunking strategy.",
+	[]float64{10, 30, 60, 300, 900, 1800, 3600, 7200, 14400, 43200, 86400},
+	"size", "strategy")
+
+// uploadSizeBuckets are the file size ranges upload latency is reported by
+var uploadSizeBuckets = []struct {
+	max   int64
+	label string
+}{
+	{10 << 20, "0-10MB"},
+	{100 << 20, "10-100MB"},
+	{1 << 30, "100MB-1GB"},
+	{10 << 30, "1-10GB"},
+	{100 << 30, "10-100GB"},
+}
+
+func uploadSizeBucket(size int64) string {
+	for _, b := range uploadSizeBuckets {
+		if size <= b.max {
+			return b.label
+		}
+	}
+	return "100GB+"
+}
+
+// CompleteSession records the session's stored file and key file, marks the session complete
+// and records its end-to-end latency. A session with a file ID replaces its incomplete file.
+func CompleteSession(ctx context.Context, session *models.UploadSession, strategy models.ChunkingStrategy, file *models.StoredFile, keyFilePath string) error {
+	if err := store.CompleteSession(ctx, session.ID, file, keyFilePath, !session.FileID.IsZero()); err != nil {
+		return err
+	}
+	events.Publish(events.UploadTopic(session.ID), nil)
+	uploadLatency.Observe(time.Since(session.CreatedAt).Seconds(), uploadSizeBucket(session.TotalSize), string(strategy))
+	return nil
+}
+
+// CleanupExpiredSessions deletes expired sessions that were still uploading or processing,
+// with their temp files, and returns how many it deleted
+func CleanupExpiredSessions(ctx context.Context) (int, error) {
 	// Get expired sessions
 	sessions, err := store.GetExpiredSessions(ctx)
 	if err != nil {
-		return err
+		return 0, err
 	}
 
+	removed := 0
 	for _, session := range sessions {
 		// Delete temp file
 		if session.TempFilePath != "" {
 			os.Remove(session.TempFilePath)
 		}
 		// Delete session from DB
-		store.DeleteUploadSession(ctx, session.ID)
+		if err := store.DeleteUploadSession(ctx, session.ID); err != nil {
+			log.Printf("Failed to delete expired session %s: %v", session.ID.Hex(), err)
+			continue
+		}
+		removed++
 	}
 
-	return nil
+	return removed, nil
 }
 
 func ScheduleCleanup(ctx context.Context, sessionID primitive.ObjectID) {
+	ScheduleCleanupAfter(ctx, sessionID, tempFileCleanupDuration)
+}
+
+// ScheduleCleanupAfter deletes the session's temp file after d, unless by then the session is
+// being processed again or is incomplete and still waiting for a repair
+func ScheduleCleanupAfter(ctx context.Context, sessionID primitive.ObjectID, d time.Duration) {
 	go func() {
-		time.Sleep(tempFileCleanupDuration)
+		time.Sleep(d)
 		session, err := store.GetUploadSession(ctx, sessionID)
-		if err != nil || session == nil {
+		if err != nil || session == nil || session.Status == "processing" {
+			return
+		}
+		if session.Status == "incomplete" && time.Now().Before(session.ExpiresAt) {
 			return
 		}
 		// Delete temp file
@@ -0,0 +1,66 @@
+package fileprocessor
+
+import "SE/internal/models"
+
+// Strategy decides how a file is split across drives. New policies implement it and are added
+// with RegisterStrategy; CalculateChunkPlan picks one by name.
+type Strategy interface {
+	// Plan splits in.FileSize bytes across in.Drives, which all have room for some of it
+	Plan(in PlanInput) ([]models.ChunkPlan, error)
+	// Capped reports whether the strategy plans against drive space capped by the placement
+	// policy's max share. Strategies that pick their own sizes, like manual and erasure, don't.
+	Capped() bool
+}
+
+// PlanInput is what a strategy plans from
+type PlanInput struct {
+	FileSize    int64
+	Drives      []models.DriveSpaceInfo
+	ManualSizes []int64               // manual only
+	Erasure     *models.ErasureConfig // erasure only
+}
+
+// strategies holds every registered strategy by name
+var strategies = map[models.ChunkingStrategy]Strategy{}
+
+// RegisterStrategy makes s selectable as name, replacing any strategy already registered under it
+func RegisterStrategy(name models.ChunkingStrategy, s Strategy) {
+	strategies[name] = s
+}
+
+// LookupStrategy returns the strategy registered as name
+func LookupStrategy(name models.ChunkingStrategy) (Strategy, bool) {
+	s, ok := strategies[name]
+	return s, ok
+}
+
+// sizeStrategy adapts the plain size-based planners, which plan against capped space
+type sizeStrategy func(fileSize int64, drives []models.DriveSpaceInfo) ([]models.ChunkPlan, error)
+
+func (f sizeStrategy) Plan(in PlanInput) ([]models.ChunkPlan, error) {
+	return f(in.FileSize, in.Drives)
+}
+func (f sizeStrategy) Capped() bool { return true }
+
+type manualStrategy struct{}
+
+func (manualStrategy) Plan(in PlanInput) ([]models.ChunkPlan, error) {
+	return calculateManualPlan(in.FileSize, in.Drives, in.ManualSizes)
+}
+func (manualStrategy) Capped() bool { return false }
+
+type erasureStrategy struct{}
+
+func (erasureStrategy) Plan(in PlanInput) ([]models.ChunkPlan, error) {
+	return calculateErasurePlan(in.FileSize, in.Drives, in.Erasure)
+}
+func (erasureStrategy) Capped() bool { return false }
+
+func init() {
+	RegisterStrategy(models.StrategyGreedy, sizeStrategy(calculateGreedyPlan))
+	RegisterStrategy(models.StrategyBalanced, sizeStrategy(calculateBalancedPlan))
+	RegisterStrategy(models.StrategyProportional, sizeStrategy(calculateProportionalPlan))
+	RegisterStrategy(models.StrategyMinDrives, sizeStrategy(calculateMinDrivesPlan))
+	RegisterStrategy(models.StrategyManual, manualStrategy{})
+	RegisterStrategy(models.StrategyErasure, erasureStrategy{})
+}
@@ -0,0 +1,241 @@
+package fileprocessor
+
+import (
+	"SE/internal/drivemanager"
+	"SE/internal/events"
+	"SE/internal/models"
+	"cmp"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"slices"
+	"sort"
+	"time"
+)
+
+// CanStream reports whether a file can be streamed straight from its chunks. Erasure files
+// can't: a missing data shard is rebuilt from the others, which needs them all on disk.
+func CanStream(file *models.StoredFile) bool {
+	return file.Erasure == nil
+}
+
+// StreamDownloads reports whether downloads stream by default (DOWNLOAD_MODE=stream)
+func StreamDownloads() bool {
+	return streamDownloads
+}
+
+// StreamFile writes the original content of a stored file to w without reconstructing it on
+// disk: chunks are pulled from their drives in order and the noise is dropped as they arrive.
+// A chunk's checksum can only be verified once it has been written, so an error after the
+// first write leaves w with a partial file; the caller must make that visible, e.g. by
+// aborting the response.
+func StreamFile(ctx context.Context, file *models.StoredFile, w io.Writer) error {
+	return StreamFileRange(ctx, file, 0, file.OriginalSize, w)
+}
+
+// StreamFileRange is StreamFile for length bytes of the original content starting at start.
+// The range is mapped through the noise layout onto the obfuscated stream, and only the chunks
+// it covers are fetched. Chunks covered only in part are read with a ranged request and can't
+// be verified against their checksum.
+func StreamFileRange(ctx context.Context, file *models.StoredFile, start, length int64, w io.Writer) error {
+	if !CanStream(file) {
+		return errors.New("erasure coded files can't be streamed")
+	}
+	if start < 0 || length <= 0 || start+length > file.OriginalSize {
+		return fmt.Errorf("range %d+%d is outside the file's %d bytes", start, length, file.OriginalSize)
+	}
+	seed, err := base64.StdEncoding.DecodeString(string(file.Obfuscation.Seed))
+	if err != nil {
+		return fmt.Errorf("invalid obfuscation seed: %w", err)
+	}
+	offsets, err := injectionOffsets(seed, file.OriginalSize, file.Obfuscation)
+	if err != nil {
+		return err
+	}
+
+	ctx, _, done := trackRestore(ctx, file, true)
+	defer done()
+
+	blockSize := int64(file.Obfuscation.BlockSize)
+	d := newDeobfuscatingWriter(w, offsets, blockSize, start)
+	last := start + length - 1
+	end := last + int64(noiseBlocksBefore(offsets, last))*blockSize + 1
+	err = streamChunks(ctx, file, d.pos, end, d)
+	if err == nil && d.written != length {
+		err = fmt.Errorf("deobfuscated size %d does not match requested size %d", d.written, length)
+	}
+	if err != nil {
+		return restoreFailed(ctx, file, err)
+	}
+	publishRestore(ctx, file, events.StageReady, len(file.Chunks), nil)
+	return nil
+}
+
+// noiseBlocksBefore counts the noise blocks written before original byte x
+func noiseBlocksBefore(offsets []int64, x int64) int {
+	return sort.Search(len(offsets), func(k int) bool { return offsets[k] > x })
+}
+
+// streamChunks writes bytes [from, to) of the obfuscated stream of file to w, chunk by chunk
+func streamChunks(ctx context.Context, file *models.StoredFile, from, to int64, w io.Writer) error {
+	chunks := slices.Clone(file.Chunks)
+	slices.SortFunc(chunks, func(a, b models.StoredChunk) int { return cmp.Compare(a.StartOffset, b.StartOffset) })
+
+	var pos int64
+	for _, chunk := range chunks {
+		if chunk.StartOffset != pos {
+			return fmt.Errorf("chunk %d starts at %d, expected %d", chunk.ChunkID, chunk.StartOffset, pos)
+		}
+		pos = chunk.EndOffset
+	}
+	if pos != file.ProcessedSize {
+		return fmt.Errorf("chunks end at %d, file is %d bytes", pos, file.ProcessedSize)
+	}
+
+	for done, chunk := range chunks {
+		if chunk.EndOffset <= from || chunk.StartOffset >= to {
+			continue
+		}
+		publishRestore(ctx, file, events.StageFetching, done, nil)
+
+		lo := max(from, chunk.StartOffset) - chunk.StartOffset
+		hi := min(to, chunk.EndOffset) - chunk.StartOffset
+		headed := chunk.HeaderVersion > 0
+		if lo > 0 || hi < chunk.Size {
+			err := withChunkRetry(ctx, file, chunk, w, func(w io.Writer) error {
+				return drivemanager.StreamChunkRange(ctx, chunk.DriveAccountID, chunk.DriveFileID, headed, lo, hi-lo, io.MultiWriter(w, restoreProgressWriter{ctx}))
+			})
+			if err != nil {
+				return fmt.Errorf("chunk %d: %w", chunk.ChunkID, err)
+			}
+			continue
+		}
+
+		hash := sha256.New()
+		err := withChunkRetry(ctx, file, chunk, w, func(w io.Writer) error {
+			hash.Reset()
+			return drivemanager.StreamChunk(ctx, chunk.DriveAccountID, chunk.DriveFileID, file.ID, chunk.ChunkID, chunk.Size, headed, io.MultiWriter(w, hash, restoreProgressWriter{ctx}))
+		})
+		if err != nil {
+			return fmt.Errorf("chunk %d: %w", chunk.ChunkID, err)
+		}
+		if fmt.Sprintf("%x", hash.Sum(nil)) != chunk.Checksum {
+			return fmt.Errorf("chunk %d checksum mismatch", chunk.ChunkID)
+		}
+	}
+	return nil
+}
+
+// withChunkRetry runs fetch, which streams a chunk to the w it is given. Drive refuses a chunk
+// over its download quota before sending anything, so that is waited out and retried like in
+// fetchChunks. Other failures are retried with backoff up to CHUNK_DOWNLOAD_ATTEMPTS times, as
+// long as none of the chunk reached w: bytes already passed on can't be taken back.
+func withChunkRetry(ctx context.Context, file *models.StoredFile, chunk models.StoredChunk, w io.Writer, fetch func(w io.Writer) error) error {
+	quotaHits, failures := 0, 0
+	for {
+		cw := &countingWriter{w: w}
+		err := fetch(cw)
+		if err == nil || ctx.Err() != nil {
+			return err
+		}
+
+		var quotaErr *drivemanager.DownloadQuotaError
+		var delay time.Duration
+		switch {
+		case errors.As(err, &quotaErr) && quotaHits < downloadQuotaRetries:
+			quotaHits++
+			delay = max(downloadQuotaCooldown, quotaErr.RetryAfter)
+			retryAt := time.Now().Add(delay)
+			log.Printf("Chunk %d of file %s hit the Drive download quota, retrying in %s (%d/%d)",
+				chunk.ChunkID, file.ID.Hex(), delay, quotaHits, downloadQuotaRetries)
+			noteRestoreProgress(ctx, &retryAt)
+		case cw.n == 0 && failures+1 < chunkDownloadAttempts:
+			failures++
+			delay = drivemanager.Backoff(failures - 1)
+			log.Printf("Chunk %d of file %s failed (attempt %d/%d), retrying in %s: %v",
+				chunk.ChunkID, file.ID.Hex(), failures, chunkDownloadAttempts, delay.Round(time.Millisecond), err)
+		default:
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(delay):
+		}
+	}
+}
+
+// countingWriter counts the bytes written through it
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// restoreProgressWriter notes progress of the restore under ctx on every write, so a slow
+// client reading a big chunk doesn't count as a stuck restore
+type restoreProgressWriter struct{ ctx context.Context }
+
+func (p restoreProgressWriter) Write(b []byte) (int, error) {
+	noteRestoreProgress(p.ctx, nil)
+	return len(b), nil
+}
+
+// deobfuscatingWriter passes an obfuscated stream on to w without its noise blocks
+type deobfuscatingWriter struct {
+	w         io.Writer
+	blockSize int64
+	// noiseStarts[k] is where noise block k begins in the obfuscated stream
+	noiseStarts []int64
+	pos         int64 // position in the obfuscated stream
+	next        int   // first noise block not yet passed
+	written     int64
+}
+
+// newDeobfuscatingWriter expects the obfuscated stream from where original byte start is
+func newDeobfuscatingWriter(w io.Writer, offsets []int64, blockSize, start int64) *deobfuscatingWriter {
+	noiseStarts := make([]int64, len(offsets))
+	for k, offset := range offsets {
+		noiseStarts[k] = offset + int64(k)*blockSize
+	}
+	next := noiseBlocksBefore(offsets, start)
+	return &deobfuscatingWriter{w: w, blockSize: blockSize, noiseStarts: noiseStarts, next: next, pos: start + int64(next)*blockSize}
+}
+
+func (d *deobfuscatingWriter) Write(p []byte) (int, error) {
+	n := 0
+	for n < len(p) {
+		rest := int64(len(p) - n)
+		if d.next < len(d.noiseStarts) && d.pos >= d.noiseStarts[d.next] {
+			// Inside a noise block: skip it
+			skip := min(rest, d.noiseStarts[d.next]+d.blockSize-d.pos)
+			d.pos += skip
+			n += int(skip)
+			if d.pos == d.noiseStarts[d.next]+d.blockSize {
+				d.next++
+			}
+			continue
+		}
+		data := rest
+		if d.next < len(d.noiseStarts) {
+			data = min(data, d.noiseStarts[d.next]-d.pos)
+		}
+		m, err := d.w.Write(p[n : n+int(data)])
+		d.pos += int64(m)
+		d.written += int64(m)
+		n += m
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
@@ -0,0 +1,154 @@
+package fileprocessor
+
+import (
+	"SE/internal/models"
+	"SE/internal/store"
+	"context"
+	"log"
+	"slices"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// verificationTTL is how long a finished verification can still be looked up
+const verificationTTL = time.Hour
+
+// Verification is a deep check of a file: every chunk is downloaded from its drive and
+// compared with its checksum, in the background. Verifications are only known to the
+// process that runs them.
+type Verification struct {
+	ID          string              `json:"id"`
+	FileID      string              `json:"file_id"`
+	Status      string              `json:"status"` // "running" or "done"
+	ChunksDone  int                 `json:"chunks_done"`
+	ChunksTotal int                 `json:"chunks_total"`
+	Chunks      []ChunkVerification `json:"chunks"`
+	StartedAt   time.Time           `json:"started_at"`
+	FinishedAt  *time.Time          `json:"finished_at,omitempty"`
+	userID      primitive.ObjectID
+}
+
+// ChunkVerification is the outcome of checking one chunk
+type ChunkVerification struct {
+	ChunkID        int    `json:"chunk_id"`
+	DriveAccountID string `json:"drive_account_id"`
+	// "pending", "ok", "corrupt", "missing" or "error" when it couldn't be told
+	Result string `json:"result"`
+	Error  string `json:"error,omitempty"`
+}
+
+var (
+	verificationsMu sync.Mutex
+	verifications   = make(map[string]*Verification)
+)
+
+// StartVerification starts a deep check of file and returns it as started. A check of the
+// file already running is returned instead of starting another one, with started false.
+func StartVerification(file *models.StoredFile) (v Verification, started bool) {
+	verificationsMu.Lock()
+	defer verificationsMu.Unlock()
+
+	for id, running := range verifications {
+		if running.FinishedAt != nil && time.Since(*running.FinishedAt) > verificationTTL {
+			delete(verifications, id)
+			continue
+		}
+		if running.FileID == file.ID.Hex() && running.Status == "running" {
+			return running.snapshot(), false
+		}
+	}
+
+	verification := newVerification(file)
+	verifications[verification.ID] = verification
+	go verifyFile(context.Background(), verification, file)
+	return verification.snapshot(), true
+}
+
+// CheckFile deep checks file like StartVerification, but waits for the result and doesn't
+// keep it for lookup
+func CheckFile(ctx context.Context, file *models.StoredFile) Verification {
+	v := newVerification(file)
+	verifyFile(ctx, v, file)
+	verificationsMu.Lock()
+	defer verificationsMu.Unlock()
+	return v.snapshot()
+}
+
+func newVerification(file *models.StoredFile) *Verification {
+	v := &Verification{
+		ID:          primitive.NewObjectID().Hex(),
+		FileID:      file.ID.Hex(),
+		Status:      "running",
+		ChunksTotal: len(file.Chunks),
+		Chunks:      make([]ChunkVerification, len(file.Chunks)),
+		StartedAt:   time.Now().UTC(),
+		userID:      file.UserID,
+	}
+	for i, chunk := range file.Chunks {
+		v.Chunks[i] = ChunkVerification{ChunkID: chunk.ChunkID, DriveAccountID: chunk.DriveAccountID.Hex(), Result: "pending"}
+	}
+	return v
+}
+
+// GetVerification returns a verification of one of the user's files
+func GetVerification(userID primitive.ObjectID, id string) (Verification, bool) {
+	verificationsMu.Lock()
+	defer verificationsMu.Unlock()
+	v, ok := verifications[id]
+	if !ok || v.userID != userID {
+		return Verification{}, false
+	}
+	return v.snapshot(), true
+}
+
+// snapshot copies v for use outside verificationsMu
+func (v *Verification) snapshot() Verification {
+	s := *v
+	s.Chunks = slices.Clone(v.Chunks)
+	return s
+}
+
+// verifyFile checks the chunks of file, RESTORE_PARALLEL_DOWNLOADS at a time, and records
+// what it found as the chunks' health too
+func verifyFile(ctx context.Context, v *Verification, file *models.StoredFile) {
+	var (
+		wg     sync.WaitGroup
+		mu     sync.Mutex
+		checks []store.ChunkCheck
+	)
+	slots := make(chan struct{}, restoreParallelFetches)
+	for i, chunk := range file.Chunks {
+		wg.Add(1)
+		slots <- struct{}{}
+		go func() {
+			defer func() { <-slots; wg.Done() }()
+
+			health, err := checkChunk(ctx, file, chunk)
+			result := ChunkVerification{ChunkID: chunk.ChunkID, DriveAccountID: chunk.DriveAccountID.Hex(), Result: health}
+			if err != nil {
+				result.Result, result.Error = "error", err.Error()
+			} else {
+				mu.Lock()
+				checks = append(checks, store.ChunkCheck{ChunkID: chunk.ChunkID, DriveFileID: chunk.DriveFileID, Health: health})
+				mu.Unlock()
+			}
+
+			verificationsMu.Lock()
+			v.Chunks[i] = result
+			v.ChunksDone++
+			verificationsMu.Unlock()
+		}()
+	}
+	wg.Wait()
+
+	if err := store.RecordChunkChecks(ctx, file.ID, checks, time.Now().UTC()); err != nil {
+		log.Printf("Failed to record verification of file %s: %v", file.ID.Hex(), err)
+	}
+
+	verificationsMu.Lock()
+	now := time.Now().UTC()
+	v.Status, v.FinishedAt = "done", &now
+	verificationsMu.Unlock()
+}
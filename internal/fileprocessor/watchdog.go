@@ -0,0 +1,147 @@
+package fileprocessor
+
+import (
+	"SE/internal/metrics"
+	"SE/internal/models"
+	"SE/internal/store"
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"math"
+	"path/filepath"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// heartbeatInterval is how often a running stage refreshes the session heartbeat
+const heartbeatInterval = time.Minute
+
+// Gauges for alerting on pipeline stalls, read at scrape time
+func init() {
+	metrics.NewGaugeFunc("upload_sessions_stuck", "Processing sessions without a heartbeat for STUCK_THRESHOLD_MINUTES.", func() float64 {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		n, err := store.CountStalledSessions(ctx, time.Now().Add(-stuckThreshold))
+		if err != nil {
+			return math.NaN()
+		}
+		return float64(n)
+	})
+	metrics.NewGaugeFunc("downloads_stuck", "File restores without progress for STUCK_THRESHOLD_MINUTES, not counting Drive quota cool-downs.", func() float64 {
+		return float64(countStuckRestores(time.Now().Add(-stuckThreshold)))
+	})
+	metrics.NewGaugeFunc("upload_temp_dir_bytes", "Bytes of files under UPLOAD_TEMP_DIR.", func() float64 {
+		return float64(dirSize(uploadTempDir))
+	})
+	metrics.NewGaugeFunc("download_temp_dir_bytes", "Bytes of files under DOWNLOAD_TEMP_DIR.", func() float64 {
+		return float64(dirSize(downloadTempDir))
+	})
+}
+
+// dirSize sums the sizes of the regular files under dir, skipping what it can't read
+func dirSize(dir string) int64 {
+	if dir == "" {
+		return 0
+	}
+	var total int64
+	filepath.WalkDir(dir, func(_ string, d fs.DirEntry, err error) error {
+		if err != nil || !d.Type().IsRegular() {
+			return nil
+		}
+		if info, err := d.Info(); err == nil {
+			total += info.Size()
+		}
+		return nil
+	})
+	return total
+}
+
+// RunStage runs fn under the configured stage deadline, keeping the session heartbeat
+// fresh while it runs. A stage that hits its deadline is retried up to PROCESSING_STAGE_RETRIES times.
+func RunStage(ctx context.Context, sessionID primitive.ObjectID, name string, fn func(ctx context.Context) error) error {
+	var err error
+	for attempt := 0; attempt <= stageRetries; attempt++ {
+		if attempt > 0 {
+			log.Printf("Stage %q for session %s timed out, retrying (%d/%d)", name, sessionID.Hex(), attempt, stageRetries)
+		}
+
+		err = runStageOnce(ctx, sessionID, fn)
+		if err == nil || !errors.Is(err, context.DeadlineExceeded) || ctx.Err() != nil {
+			return err
+		}
+	}
+	return fmt.Errorf("stage %q exceeded its %s deadline %d times: %w", name, stageTimeout, stageRetries+1, err)
+}
+
+func runStageOnce(ctx context.Context, sessionID primitive.ObjectID, fn func(ctx context.Context) error) error {
+	stageCtx, cancel := context.WithTimeout(ctx, stageTimeout)
+	defer cancel()
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		ticker := time.NewTicker(heartbeatInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				store.TouchUploadSession(context.Background(), sessionID)
+			}
+		}
+	}()
+
+	return fn(stageCtx)
+}
+
+// RunWatchdog periodically marks processing sessions whose heartbeat has gone stale as failed,
+// and keeps the others from expiring while they're processed. It blocks until ctx is cancelled.
+func RunWatchdog(ctx context.Context) {
+	ticker := time.NewTicker(heartbeatInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := failStalledSessions(ctx); err != nil {
+				log.Printf("Watchdog: %v", err)
+			}
+			// A large file can take longer to process than SESSION_EXPIRY_HOURS
+			if _, err := store.ExtendProcessingSessions(ctx, time.Now().Add(sessionExpiryDuration)); err != nil {
+				log.Printf("Watchdog: failed to extend processing sessions: %v", err)
+			}
+		}
+	}
+}
+
+func failStalledSessions(ctx context.Context) error {
+	sessions, err := store.GetStalledSessions(ctx, time.Now().Add(-sessionStallDuration))
+	if err != nil {
+		return err
+	}
+
+	for _, session := range sessions {
+		// Sessions waiting in the job queue, or whose worker went away, will be picked up again
+		job, err := store.GetSessionJob(ctx, session.ID)
+		if err != nil {
+			log.Printf("Watchdog: failed to look up job for session %s: %v", session.ID.Hex(), err)
+			continue
+		}
+		if job != nil && (job.Status == models.JobQueued || (job.Status == models.JobRunning && time.Now().After(job.LeaseExpiresAt))) {
+			continue
+		}
+
+		log.Printf("Watchdog: session %s has not made progress since %s, marking failed", session.ID.Hex(), session.UpdatedAt.Format(time.RFC3339))
+		msg := fmt.Sprintf("Processing stalled: no progress for %s", sessionStallDuration)
+		if err := FailSession(ctx, session, session.ProcessingProgress, msg); err != nil {
+			log.Printf("Watchdog: failed to mark session %s: %v", session.ID.Hex(), err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,287 @@
+package handlers
+
+import (
+	"SE/internal/auth"
+	"SE/internal/drivemanager"
+	"SE/internal/fileprocessor"
+	"SE/internal/models"
+	"SE/internal/store"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// DriveQuotaHandler - GET /api/admin/drive-quota?day=YYYY-MM-DD
+// Daily Drive API call counts per account and operation; day defaults to the current quota day
+func DriveQuotaHandler(w http.ResponseWriter, r *http.Request) {
+	day := r.URL.Query().Get("day")
+	if day == "" {
+		day = drivemanager.CurrentQuotaDay()
+	} else if _, err := time.Parse("2006-01-02", day); err != nil {
+		http.Error(w, "day must be YYYY-MM-DD", http.StatusBadRequest)
+		return
+	}
+
+	usage, err := drivemanager.APIUsage(r.Context(), day)
+	if err != nil {
+		log.Printf("Failed to load Drive API usage: %v", err)
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+
+	type accountUsage struct {
+		AccountID  primitive.ObjectID `json:"account_id"`
+		Total      int64              `json:"total"`
+		Operations map[string]int64   `json:"operations"`
+	}
+
+	byAccount := make(map[primitive.ObjectID]*accountUsage)
+	var total int64
+	for _, u := range usage {
+		a, ok := byAccount[u.AccountID]
+		if !ok {
+			a = &accountUsage{AccountID: u.AccountID, Operations: make(map[string]int64)}
+			byAccount[u.AccountID] = a
+		}
+		a.Operations[u.Operation] += u.Count
+		a.Total += u.Count
+		total += u.Count
+	}
+
+	accounts := make([]*accountUsage, 0, len(byAccount))
+	for _, a := range byAccount {
+		accounts = append(accounts, a)
+	}
+	sort.Slice(accounts, func(i, j int) bool { return accounts[i].Total > accounts[j].Total })
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"day":                day,
+		"total":              total,
+		"daily_quota":        drivemanager.DailyAPIQuota(),
+		"background_allowed": drivemanager.BackgroundWorkAllowed(),
+		"accounts":           accounts,
+	})
+}
+
+// ListUsersHandler - GET /api/admin/users
+// Every user with their role and linked drive count, newest first
+func ListUsersHandler(w http.ResponseWriter, r *http.Request) {
+	users, err := store.ListUsers(r.Context())
+	if err != nil {
+		log.Printf("Failed to list users: %v", err)
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+
+	type userOut struct {
+		ID            primitive.ObjectID `json:"id"`
+		Email         string             `json:"email"`
+		Role          string             `json:"role"`
+		Admin         bool               `json:"admin"` // by role or ADMIN_EMAILS
+		HasPassword   bool               `json:"has_password"`
+		DriveAccounts int                `json:"drive_accounts"`
+		StorageQuota  int64              `json:"storage_quota,omitempty"`
+		CreatedAt     time.Time          `json:"created_at"`
+	}
+	out := make([]userOut, 0, len(users))
+	for _, u := range users {
+		role := u.Role
+		if role == "" {
+			role = models.RoleUser
+		}
+		out = append(out, userOut{
+			ID:            u.ID,
+			Email:         u.Email,
+			Role:          role,
+			Admin:         auth.IsAdmin(u),
+			HasPassword:   len(u.PasswordsHash) > 0,
+			DriveAccounts: len(u.DriveAccounts),
+			StorageQuota:  u.StorageQuota,
+			CreatedAt:     u.CreatedAt,
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"users": out})
+}
+
+// AdminUserHandler - PUT /api/admin/users/:id/quota, PUT /api/admin/users/:id/role
+// Changes one user's settings
+func AdminUserHandler(w http.ResponseWriter, r *http.Request) {
+	id, action, _ := strings.Cut(strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/admin/users/"), "/"), "/")
+	userID, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		http.Error(w, "invalid user id", http.StatusBadRequest)
+		return
+	}
+
+	switch action {
+	case "quota":
+		setUserQuota(w, r, userID)
+	case "role":
+		setUserRole(w, r, userID)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// setUserQuota overrides a user's storage quota; 0 restores the USER_QUOTA_GB default, -1 makes it unlimited
+func setUserQuota(w http.ResponseWriter, r *http.Request, userID primitive.ObjectID) {
+	var req struct {
+		QuotaBytes *int64 `json:"quota_bytes"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.QuotaBytes == nil {
+		http.Error(w, "quota_bytes is required", http.StatusBadRequest)
+		return
+	}
+	if *req.QuotaBytes < -1 {
+		http.Error(w, "quota_bytes must be -1 or more", http.StatusBadRequest)
+		return
+	}
+
+	found, err := store.SetUserStorageQuota(r.Context(), userID, *req.QuotaBytes)
+	if err != nil {
+		log.Printf("Failed to set quota of user %s: %v", userID.Hex(), err)
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+	if !found {
+		http.Error(w, "user not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"user_id":     userID.Hex(),
+		"quota_bytes": *req.QuotaBytes,
+	})
+}
+
+// setUserRole makes a user an admin or a regular user
+func setUserRole(w http.ResponseWriter, r *http.Request, userID primitive.ObjectID) {
+	var req struct {
+		Role string `json:"role"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+	if req.Role != models.RoleUser && req.Role != models.RoleAdmin {
+		http.Error(w, "role must be user or admin", http.StatusBadRequest)
+		return
+	}
+
+	found, err := store.SetUserRole(r.Context(), userID, req.Role)
+	if err != nil {
+		log.Printf("Failed to set role of user %s: %v", userID.Hex(), err)
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+	if !found {
+		http.Error(w, "user not found", http.StatusNotFound)
+		return
+	}
+	adminID := r.Context().Value("userID").(primitive.ObjectID)
+	log.Printf("Admin %s set the role of user %s to %s", adminID.Hex(), userID.Hex(), req.Role)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"user_id": userID.Hex(),
+		"role":    req.Role,
+	})
+}
+
+// CleanupHandler - POST /api/admin/cleanup
+// Removes expired upload sessions and their uploaded files, and empties the trash of files past
+// their retention, now instead of waiting for the next scheduled run
+func CleanupHandler(w http.ResponseWriter, r *http.Request) {
+	removed, err := fileprocessor.CleanupExpiredSessions(r.Context())
+	if err != nil {
+		log.Printf("Forced cleanup failed: %v", err)
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+	purged, err := fileprocessor.PurgeDeletedFiles(r.Context())
+	if err != nil {
+		log.Printf("Forced purge failed: %v", err)
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"expired_sessions_removed": removed,
+		"deleted_files_purged":     purged,
+	})
+}
+
+// ReportHandler - POST /api/admin/reports
+// Grouped counts and byte totals over stored files or upload sessions
+func ReportHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Source  string   `json:"source"`
+		GroupBy []string `json:"group_by"`
+		UserID  string   `json:"user_id,omitempty"`
+		Status  string   `json:"status,omitempty"`
+		From    string   `json:"from,omitempty"` // RFC 3339 or YYYY-MM-DD
+		To      string   `json:"to,omitempty"`
+		Limit   int      `json:"limit,omitempty"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+
+	q := store.ReportQuery{Source: req.Source, GroupBy: req.GroupBy, Status: req.Status, Limit: req.Limit}
+	if req.UserID != "" {
+		id, err := primitive.ObjectIDFromHex(req.UserID)
+		if err != nil {
+			http.Error(w, "invalid user_id", http.StatusBadRequest)
+			return
+		}
+		q.UserID = &id
+	}
+	var err error
+	if q.From, err = parseReportTime(req.From); err != nil {
+		http.Error(w, "from must be RFC 3339 or YYYY-MM-DD", http.StatusBadRequest)
+		return
+	}
+	if q.To, err = parseReportTime(req.To); err != nil {
+		http.Error(w, "to must be RFC 3339 or YYYY-MM-DD", http.StatusBadRequest)
+		return
+	}
+
+	rows, err := store.RunReport(r.Context(), q)
+	if err != nil {
+		if errors.Is(err, store.ErrInvalidReport) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		log.Printf("Report failed: %v", err)
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"source": req.Source,
+		"rows":   rows,
+	})
+}
+
+func parseReportTime(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	return time.Parse("2006-01-02", s)
+}
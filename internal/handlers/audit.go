@@ -0,0 +1,96 @@
+package handlers
+
+import (
+	"SE/internal/store"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// AuditLogHandler - GET /api/audit?action=&since=&until=&before=&limit=
+// The caller's own audit events, newest first
+func AuditLogHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("userID").(primitive.ObjectID)
+
+	query, ok := parseAuditQuery(w, r)
+	if !ok {
+		return
+	}
+	query.UserID = userID
+	writeAuditEvents(w, r, query)
+}
+
+// AdminAuditLogHandler - GET /api/admin/audit?user_id=&action=&since=&until=&before=&limit=
+// Audit events of all users, or of one with user_id, newest first
+func AdminAuditLogHandler(w http.ResponseWriter, r *http.Request) {
+	query, ok := parseAuditQuery(w, r)
+	if !ok {
+		return
+	}
+	if v := r.URL.Query().Get("user_id"); v != "" {
+		userID, err := primitive.ObjectIDFromHex(v)
+		if err != nil {
+			http.Error(w, "invalid user id", http.StatusBadRequest)
+			return
+		}
+		query.UserID = userID
+	}
+	writeAuditEvents(w, r, query)
+}
+
+// parseAuditQuery reads the filters and page of an audit log request
+func parseAuditQuery(w http.ResponseWriter, r *http.Request) (store.AuditQuery, bool) {
+	q := r.URL.Query()
+	query := store.AuditQuery{Action: q.Get("action"), Limit: 100}
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > 1000 {
+			http.Error(w, "limit must be 1-1000", http.StatusBadRequest)
+			return query, false
+		}
+		query.Limit = n
+	}
+	if v := q.Get("before"); v != "" {
+		id, err := primitive.ObjectIDFromHex(v)
+		if err != nil {
+			http.Error(w, "invalid before", http.StatusBadRequest)
+			return query, false
+		}
+		query.Before = id
+	}
+	for _, bound := range []struct {
+		name string
+		t    *time.Time
+	}{{"since", &query.Since}, {"until", &query.Until}} {
+		if v := q.Get(bound.name); v != "" {
+			t, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				http.Error(w, bound.name+" must be an RFC 3339 time", http.StatusBadRequest)
+				return query, false
+			}
+			*bound.t = t
+		}
+	}
+	return query, true
+}
+
+// writeAuditEvents answers with a page of audit events and, if it is full, where the next starts
+func writeAuditEvents(w http.ResponseWriter, r *http.Request, query store.AuditQuery) {
+	events, err := store.ListAuditEvents(r.Context(), query)
+	if err != nil {
+		log.Printf("Failed to list audit events: %v", err)
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+
+	out := map[string]interface{}{"events": events}
+	if len(events) == query.Limit {
+		out["next_before"] = events[len(events)-1].ID.Hex()
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(out)
+}
@@ -1,11 +1,23 @@
 package handlers
 
 import (
+	"SE/internal/audit"
+	"SE/internal/drivemanager"
+	"SE/internal/fileprocessor"
+	"SE/internal/models"
+	"SE/internal/notify"
+	"SE/internal/oauth"
 	"SE/internal/store"
 	"encoding/json"
+	"fmt"
+	"log"
 	"net/http"
+	"regexp"
+	"strings"
+	"time"
 
 	"go.mongodb.org/mongo-driver/bson/primitive"
+	"golang.org/x/oauth2"
 )
 
 func ListDriveAccountsHandler(w http.ResponseWriter, r *http.Request) {
@@ -19,22 +31,509 @@ func ListDriveAccountsHandler(w http.ResponseWriter, r *http.Request) {
 
 	// do not return encrypted token in response
 	type DriveAccountOut struct {
-		ID          primitive.ObjectID `json:"id"`
-		Provider    string             `json:"provider"`
-		DisplayName string             `json:"display_name"`
-		CreatedAt   interface{}        `json:"created_at"`
+		ID            primitive.ObjectID `json:"id"`
+		Provider      string             `json:"provider"`
+		AccountType   string             `json:"account_type"`
+		DisplayName   string             `json:"display_name"`
+		Label         string             `json:"label,omitempty"`
+		Color         string             `json:"color,omitempty"`
+		SharedDriveID string             `json:"shared_drive_id,omitempty"`
+		Token         *driveTokenInfo    `json:"token,omitempty"`
+		CreatedAt     interface{}        `json:"created_at"`
 	}
 
 	out := make([]DriveAccountOut, 0, len(accts))
 	for _, a := range accts {
+		accountType := a.AccountType
+		if accountType == "" {
+			accountType = models.DriveAccountTypeOAuth
+		}
 		out = append(out, DriveAccountOut{
-			ID:          a.ID,
-			Provider:    a.Provider,
-			DisplayName: a.DisplayName,
-			CreatedAt:   a.CreatedAt,
+			ID:            a.ID,
+			Provider:      a.Provider,
+			AccountType:   accountType,
+			DisplayName:   a.DisplayName,
+			Label:         a.Label,
+			Color:         a.Color,
+			SharedDriveID: a.SharedDriveID,
+			Token:         tokenInfo(a),
+			CreatedAt:     a.CreatedAt,
 		})
 	}
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(out)
 }
+
+// driveTokenInfo describes the stored OAuth token of a drive account
+type driveTokenInfo struct {
+	AccessTokenExpiry *time.Time `json:"access_token_expiry,omitempty"`
+	HasRefreshToken   bool       `json:"has_refresh_token"`
+	LastRefreshedAt   *time.Time `json:"last_refreshed_at,omitempty"`
+	// Without a refresh token uploads start failing once the access token expires
+	NeedsRelink bool   `json:"needs_relink"`
+	Error       string `json:"error,omitempty"`
+}
+
+// tokenInfo reports on the token of an OAuth account, nil for other account types
+func tokenInfo(a models.DriveAccount) *driveTokenInfo {
+	if a.AccountType != "" && a.AccountType != models.DriveAccountTypeOAuth {
+		return nil
+	}
+	info := &driveTokenInfo{LastRefreshedAt: a.TokenRefreshedAt}
+	data, err := oauth.Decrypt(a.EncryptedToken)
+	var tok oauth2.Token
+	if err == nil {
+		err = json.Unmarshal(data, &tok)
+	}
+	if err != nil {
+		info.NeedsRelink = true
+		info.Error = "stored token is unreadable"
+		return info
+	}
+	if !tok.Expiry.IsZero() {
+		expiry := tok.Expiry.UTC()
+		info.AccessTokenExpiry = &expiry
+	}
+	info.HasRefreshToken = tok.RefreshToken != ""
+	info.NeedsRelink = !info.HasRefreshToken
+	return info
+}
+
+// AddServiceAccountHandler - POST /api/drive/service-account
+// Links a Google service account (optionally impersonating a Workspace user) as a drive account
+func AddServiceAccountHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("userID").(primitive.ObjectID)
+
+	var req struct {
+		Credentials      json.RawMessage `json:"credentials"` // service account key JSON
+		ImpersonateEmail string          `json:"impersonate_email,omitempty"`
+		SharedDriveID    string          `json:"shared_drive_id,omitempty"`
+		DisplayName      string          `json:"display_name,omitempty"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+	if len(req.Credentials) == 0 {
+		http.Error(w, "credentials required", http.StatusBadRequest)
+		return
+	}
+
+	enc, err := oauth.Encrypt(req.Credentials)
+	if err != nil {
+		http.Error(w, "encrypt failed", http.StatusInternalServerError)
+		return
+	}
+
+	displayName := req.DisplayName
+	if displayName == "" {
+		displayName = "Google Drive (service account)"
+	}
+
+	acct := models.DriveAccount{
+		Provider:             "google",
+		AccountType:          models.DriveAccountTypeServiceAccount,
+		DisplayName:          displayName,
+		EncryptedCredentials: enc,
+		ImpersonateEmail:     req.ImpersonateEmail,
+		SharedDriveID:        req.SharedDriveID,
+	}
+
+	// Make sure the key actually works before saving it
+	if err := drivemanager.CheckAccountAccess(r.Context(), &acct); err != nil {
+		http.Error(w, fmt.Sprintf("service account check failed: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	if err := store.AddDriveAccountToUser(r.Context(), userID, acct); err != nil {
+		log.Printf("Failed to save service account: %v", err)
+		http.Error(w, "db save failed", http.StatusInternalServerError)
+		return
+	}
+	audit.Record(r, models.AuditEvent{UserID: userID, Action: models.AuditDriveLinked, Detail: models.DriveAccountTypeServiceAccount})
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]string{"message": "service account linked"})
+}
+
+// AddLocalDriveHandler - POST /api/drive/local
+// Links a drive kept in a directory on the server, for demos and tests without Google credentials
+func AddLocalDriveHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("userID").(primitive.ObjectID)
+
+	if !drivemanager.LocalDrivesEnabled() {
+		http.Error(w, "local drives are disabled", http.StatusNotFound)
+		return
+	}
+
+	var req struct {
+		DisplayName string `json:"display_name,omitempty"`
+	}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+	}
+
+	displayName := req.DisplayName
+	if displayName == "" {
+		displayName = "Local drive"
+	}
+
+	acct := models.DriveAccount{
+		Provider:    "local",
+		AccountType: models.DriveAccountTypeLocal,
+		DisplayName: displayName,
+	}
+	if err := store.AddDriveAccountToUser(r.Context(), userID, acct); err != nil {
+		log.Printf("Failed to save local drive: %v", err)
+		http.Error(w, "db save failed", http.StatusInternalServerError)
+		return
+	}
+	audit.Record(r, models.AuditEvent{UserID: userID, Action: models.AuditDriveLinked, Detail: models.DriveAccountTypeLocal})
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]string{"message": "local drive linked"})
+}
+
+// maxLabelLength bounds user-chosen drive account labels
+const maxLabelLength = 64
+
+var colorPattern = regexp.MustCompile(`^#[0-9a-fA-F]{6}$`)
+
+// UpdateDriveAccountHandler - PATCH /api/drive/accounts/:id
+// Sets a user-visible label and color so linked accounts can be told apart
+func UpdateDriveAccountHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("userID").(primitive.ObjectID)
+
+	accountID, err := primitive.ObjectIDFromHex(r.URL.Path[len("/api/drive/accounts/"):])
+	if err != nil {
+		http.Error(w, "invalid account id", http.StatusBadRequest)
+		return
+	}
+
+	var req struct {
+		Label *string `json:"label"`
+		Color *string `json:"color"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+
+	if req.Label != nil {
+		trimmed := strings.TrimSpace(*req.Label)
+		if len(trimmed) > maxLabelLength {
+			http.Error(w, fmt.Sprintf("label must be at most %d characters", maxLabelLength), http.StatusBadRequest)
+			return
+		}
+		req.Label = &trimmed
+	}
+	if req.Color != nil && *req.Color != "" && !colorPattern.MatchString(*req.Color) {
+		http.Error(w, "color must be a hex value like #1a73e8", http.StatusBadRequest)
+		return
+	}
+
+	found, err := store.UpdateDriveAccountLabel(r.Context(), userID, accountID, req.Label, req.Color)
+	if err != nil {
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+	if !found {
+		http.Error(w, "account not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"message": "account updated"})
+}
+
+// GetNotificationChannelsHandler - GET /api/notifications/channels
+func GetNotificationChannelsHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("userID").(primitive.ObjectID)
+
+	channels, err := store.GetUserNotificationChannels(r.Context(), userID)
+	if err != nil {
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"channels":        channels,
+		"available_types": notify.ChannelTypes(),
+	})
+}
+
+// maxNotificationChannels bounds how many channels a user can configure
+const maxNotificationChannels = 10
+
+// SetNotificationChannelsHandler - PUT /api/notifications/channels
+// Replaces the caller's notification channels
+func SetNotificationChannelsHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("userID").(primitive.ObjectID)
+
+	var req struct {
+		Channels []models.NotificationChannel `json:"channels"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+	if len(req.Channels) > maxNotificationChannels {
+		http.Error(w, fmt.Sprintf("at most %d channels allowed", maxNotificationChannels), http.StatusBadRequest)
+		return
+	}
+
+	for i, c := range req.Channels {
+		if _, err := notify.NewChannel(c.Type, c.Target); err != nil {
+			http.Error(w, fmt.Sprintf("channel %d: %v", i+1, err), http.StatusBadRequest)
+			return
+		}
+		for _, e := range c.Events {
+			if !notify.KnownEvent(e) {
+				http.Error(w, fmt.Sprintf("channel %d: unknown event %q", i+1, e), http.StatusBadRequest)
+				return
+			}
+		}
+	}
+	if req.Channels == nil {
+		req.Channels = []models.NotificationChannel{}
+	}
+
+	if err := store.SetUserNotificationChannels(r.Context(), userID, req.Channels); err != nil {
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"message": "notification channels updated"})
+}
+
+// GetPlacementPolicyHandler - GET /api/placement/policy
+func GetPlacementPolicyHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("userID").(primitive.ObjectID)
+
+	policy, err := store.GetUserPlacementPolicy(r.Context(), userID)
+	if err != nil {
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(policy)
+}
+
+// SetPlacementPolicyHandler - PUT /api/placement/policy
+// Replaces the caller's chunk placement rules; applied to every plan computed afterwards
+func SetPlacementPolicyHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("userID").(primitive.ObjectID)
+
+	var policy models.PlacementPolicy
+	if err := json.NewDecoder(r.Body).Decode(&policy); err != nil {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+	if policy.MaxSharePct < 0 || policy.MaxSharePct > 100 {
+		http.Error(w, "max_share_pct must be between 0 and 100", http.StatusBadRequest)
+		return
+	}
+
+	if err := store.SetUserPlacementPolicy(r.Context(), userID, policy); err != nil {
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"message": "placement policy updated"})
+}
+
+// ReconcileHandler - GET /api/drive/reconcile?account_id=
+// Compares the chunk files on each of the user's drives (or just account_id) with the chunks
+// their stored files and uploads reference, reporting orphaned and missing chunks
+func ReconcileHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("userID").(primitive.ObjectID)
+	ctx := r.Context()
+
+	var onlyAccount primitive.ObjectID
+	if id := r.URL.Query().Get("account_id"); id != "" {
+		var err error
+		if onlyAccount, err = primitive.ObjectIDFromHex(id); err != nil {
+			http.Error(w, "invalid account_id", http.StatusBadRequest)
+			return
+		}
+	}
+
+	accts, err := store.ListUserDriveAccounts(ctx, userID)
+	if err != nil {
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+	files, err := store.ListUserStoredFiles(ctx, userID, store.StoredFileQuery{})
+	if err != nil {
+		log.Printf("Failed to list stored files for reconciliation: %v", err)
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+	// Trashed files keep their chunks until the purge
+	trashed, err := store.ListUserStoredFiles(ctx, userID, store.StoredFileQuery{Status: "trashed"})
+	if err != nil {
+		log.Printf("Failed to list trashed files for reconciliation: %v", err)
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+	files = append(files, trashed...)
+	sessions, err := store.ListUserSessions(ctx, userID, "")
+	if err != nil {
+		log.Printf("Failed to list sessions for reconciliation: %v", err)
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+
+	reports := []fileprocessor.ReconcileReport{}
+	for i := range accts {
+		if !onlyAccount.IsZero() && accts[i].ID != onlyAccount {
+			continue
+		}
+		reports = append(reports, fileprocessor.ReconcileAccount(ctx, &accts[i], files, sessions))
+	}
+	if !onlyAccount.IsZero() && len(reports) == 0 {
+		http.Error(w, "drive account not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"accounts": reports,
+	})
+}
+
+// UsageHandler - GET /api/usage
+// Bytes the caller has stored and uploading against their storage quota
+func UsageHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("userID").(primitive.ObjectID)
+
+	user, err := store.GetUserByID(r.Context(), userID)
+	if err != nil {
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+	usage, err := store.GetUserStorageUsage(r.Context(), userID)
+	if err != nil {
+		log.Printf("Failed to get storage usage: %v", err)
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+
+	// quota_bytes and remaining_bytes are null when unlimited
+	out := map[string]interface{}{
+		"stored_bytes":    usage.StoredBytes,
+		"stored_files":    usage.StoredFiles,
+		"pending_bytes":   usage.PendingBytes,
+		"quota_bytes":     nil,
+		"remaining_bytes": nil,
+	}
+	if quota := fileprocessor.UserQuota(user); quota > 0 {
+		out["quota_bytes"] = quota
+		out["remaining_bytes"] = max(0, quota-usage.StoredBytes-usage.PendingBytes)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(out)
+}
+
+// GetPreferencesHandler - GET /api/preferences
+func GetPreferencesHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("userID").(primitive.ObjectID)
+
+	prefs, err := store.GetUserPreferences(r.Context(), userID)
+	if err != nil {
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(prefs)
+}
+
+// SetPreferencesHandler - PUT /api/preferences
+// Replaces the caller's defaults; requests that omit a field use these from then on
+func SetPreferencesHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("userID").(primitive.ObjectID)
+
+	var prefs models.UserPreferences
+	if err := json.NewDecoder(r.Body).Decode(&prefs); err != nil {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+	savePreferences(w, r, userID, prefs)
+}
+
+// PatchPreferencesHandler - PATCH /api/preferences
+// Changes only the defaults named in the body; an empty value clears one
+func PatchPreferencesHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("userID").(primitive.ObjectID)
+
+	prefs, err := store.GetUserPreferences(r.Context(), userID)
+	if err != nil {
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+	// Decoding over the current preferences leaves the fields the body omits alone
+	if err := json.NewDecoder(r.Body).Decode(&prefs); err != nil {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+	savePreferences(w, r, userID, prefs)
+}
+
+// savePreferences validates prefs and stores them as the user's
+func savePreferences(w http.ResponseWriter, r *http.Request, userID primitive.ObjectID, prefs models.UserPreferences) {
+	if prefs.ChunkingStrategy != "" {
+		// manual needs per-file sizes, so it can't be a default
+		if _, ok := fileprocessor.LookupStrategy(prefs.ChunkingStrategy); !ok || prefs.ChunkingStrategy == models.StrategyManual {
+			http.Error(w, "invalid chunking_strategy", http.StatusBadRequest)
+			return
+		}
+	}
+	if prefs.ObfuscationProfile != "" && !fileprocessor.ValidObfuscationProfile(prefs.ObfuscationProfile) {
+		http.Error(w, "invalid obfuscation_profile", http.StatusBadRequest)
+		return
+	}
+	if prefs.ObfuscationOverheadPct != 0 && !fileprocessor.ValidObfuscationOverhead(prefs.ObfuscationOverheadPct) {
+		http.Error(w, "invalid obfuscation_overhead_pct", http.StatusBadRequest)
+		return
+	}
+	if prefs.ParallelUploads < 0 {
+		http.Error(w, "parallel_uploads must not be negative", http.StatusBadRequest)
+		return
+	}
+	if prefs.ParallelDownloads < 0 {
+		http.Error(w, "parallel_downloads must not be negative", http.StatusBadRequest)
+		return
+	}
+	for _, e := range prefs.NotifyEvents {
+		if !notify.KnownEvent(e) {
+			http.Error(w, fmt.Sprintf("unknown event %q", e), http.StatusBadRequest)
+			return
+		}
+	}
+	folder, err := fileprocessor.NormalizeFolder(prefs.DefaultFolder)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	prefs.DefaultFolder = folder
+
+	if err := store.SetUserPreferences(r.Context(), userID, prefs); err != nil {
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(prefs)
+}
@@ -0,0 +1,259 @@
+// Package jobs runs background processing of finalized uploads off a durable queue, so work
+// that was in flight when the server stopped is picked up again on the next start.
+package jobs
+
+import (
+	"SE/internal/metrics"
+	"SE/internal/models"
+	"SE/internal/store"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// pollInterval is how often an idle worker looks for new jobs
+const pollInterval = 5 * time.Second
+
+var (
+	numWorkers    int
+	leaseDuration time.Duration
+	maxAttempts   int
+	fastLaneSize  int64
+	fastWorkers   int
+
+	// wake lets Enqueue nudge an idle worker instead of waiting for the next poll
+	wake = make(chan struct{}, 1)
+
+	// background counts the workers of Run and the goroutines started with Go, for Shutdown
+	background sync.WaitGroup
+	// stopRuns cancels the Run calls in progress
+	stopRunsMu sync.Mutex
+	stopRuns   = map[string]context.CancelFunc{}
+)
+
+// Queue depth, for alerting when workers fall behind or stop
+func init() {
+	metrics.NewGaugeFunc("processing_jobs_queued", "Processing jobs waiting for a worker.", func() float64 {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		n, err := store.CountQueuedJobs(ctx)
+		if err != nil {
+			return math.NaN()
+		}
+		return float64(n)
+	})
+}
+
+// Processor runs a single job. A returned error marks the job failed.
+type Processor func(ctx context.Context, job *models.ProcessingJob) error
+
+// FailoverFunc is called for a job that has been claimed too many times without finishing
+type FailoverFunc func(ctx context.Context, job *models.ProcessingJob, reason string)
+
+func InitJobConfig() {
+	// Number of uploads processed concurrently by this server
+	numWorkers, _ = strconv.Atoi(os.Getenv("PROCESSING_WORKERS"))
+	if numWorkers == 0 {
+		numWorkers = 2
+	}
+
+	// How long a claimed job stays owned by a worker without a lease renewal
+	leaseSecs, _ := strconv.Atoi(os.Getenv("JOB_LEASE_SECONDS"))
+	if leaseSecs == 0 {
+		leaseSecs = 120
+	}
+	leaseDuration = time.Duration(leaseSecs) * time.Second
+
+	// How many times a job may be claimed (e.g. across restarts) before it is failed over
+	maxAttempts, _ = strconv.Atoi(os.Getenv("JOB_MAX_ATTEMPTS"))
+	if maxAttempts == 0 {
+		maxAttempts = 3
+	}
+
+	// Files up to this size are processed in the fast lane, ahead of larger ones
+	fastLaneMB, _ := strconv.ParseInt(os.Getenv("FAST_LANE_MAX_MB"), 10, 64)
+	if fastLaneMB == 0 {
+		fastLaneMB = 100
+	}
+	fastLaneSize = fastLaneMB * 1024 * 1024
+
+	// Workers that only take fast-lane jobs, so a small file never waits behind large ones.
+	// At least one worker is always left for the rest; -1 reserves none.
+	fastWorkers, _ = strconv.Atoi(os.Getenv("FAST_LANE_WORKERS"))
+	if fastWorkers == 0 {
+		fastWorkers = 1
+	}
+	fastWorkers = max(min(fastWorkers, numWorkers-1), 0)
+}
+
+// Enqueue records a processing job for a finalized session of size bytes
+func Enqueue(ctx context.Context, sessionID, userID primitive.ObjectID, size int64, req models.ProcessRequest) error {
+	job := &models.ProcessingJob{
+		SessionID: sessionID,
+		UserID:    userID,
+		Request:   req,
+		Size:      size,
+		FastLane:  size <= fastLaneSize,
+	}
+	if err := store.EnqueueJob(ctx, job); err != nil {
+		return err
+	}
+	select {
+	case wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// Run starts the workers and blocks until ctx is cancelled. Jobs left running by a previous
+// process are reclaimed once their lease expires.
+func Run(ctx context.Context, process Processor, failover FailoverFunc) {
+	owner := newOwnerID()
+	log.Printf("Job queue: starting %d workers (%d fast-lane) as %s", numWorkers, fastWorkers, owner)
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	stopRunsMu.Lock()
+	stopRuns[owner] = cancel
+	stopRunsMu.Unlock()
+	defer func() {
+		stopRunsMu.Lock()
+		delete(stopRuns, owner)
+		stopRunsMu.Unlock()
+	}()
+
+	var wg sync.WaitGroup
+	for i := 0; i < numWorkers; i++ {
+		wg.Add(1)
+		fastOnly := i < fastWorkers
+		Go(func() {
+			defer wg.Done()
+			worker(ctx, owner, fastOnly, process, failover)
+		})
+	}
+	wg.Wait()
+}
+
+// Go runs f in a goroutine of background processing, one that may outlive the job that
+// started it, such as a watch on the job's session. Shutdown waits for it to return.
+func Go(f func()) {
+	background.Add(1)
+	go func() {
+		defer background.Done()
+		f()
+	}()
+}
+
+// Shutdown stops the workers of every Run in progress and waits until they, and the
+// goroutines started with Go, have returned. Tests call it before swapping the store out from
+// under them.
+func Shutdown() {
+	stopRunsMu.Lock()
+	for _, cancel := range stopRuns {
+		cancel()
+	}
+	stopRunsMu.Unlock()
+	background.Wait()
+}
+
+func worker(ctx context.Context, owner string, fastOnly bool, process Processor, failover FailoverFunc) {
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+
+	for {
+		// Drain the queue before going idle
+		for ctx.Err() == nil {
+			job, err := store.ClaimJob(ctx, owner, leaseDuration, fastOnly)
+			if err != nil {
+				log.Printf("Job queue: claim failed: %v", err)
+				break
+			}
+			if job == nil {
+				break
+			}
+			runJob(ctx, owner, job, process, failover)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-wake:
+		}
+	}
+}
+
+func runJob(ctx context.Context, owner string, job *models.ProcessingJob, process Processor, failover FailoverFunc) {
+	if job.Attempts > maxAttempts {
+		reason := fmt.Sprintf("Processing was interrupted %d times, giving up", job.Attempts-1)
+		log.Printf("Job queue: job %s for session %s exceeded %d attempts, failing over", job.ID.Hex(), job.SessionID.Hex(), maxAttempts)
+		failover(ctx, job, reason)
+		finish(job, owner, models.JobFailed, reason)
+		return
+	}
+	if job.Attempts > 1 {
+		log.Printf("Job queue: resuming job %s for session %s (attempt %d/%d)", job.ID.Hex(), job.SessionID.Hex(), job.Attempts, maxAttempts)
+	}
+
+	jobCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// Keep the lease alive while processing; stop if another worker took the job over
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		ticker := time.NewTicker(leaseDuration / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				held, err := store.RenewJobLease(context.Background(), job.ID, owner, leaseDuration)
+				if err != nil {
+					log.Printf("Job queue: failed to renew lease on job %s: %v", job.ID.Hex(), err)
+					continue
+				}
+				if !held {
+					log.Printf("Job queue: lost lease on job %s, stopping", job.ID.Hex())
+					cancel()
+					return
+				}
+			}
+		}
+	}()
+
+	if err := process(jobCtx, job); err != nil {
+		if ctx.Err() != nil {
+			// Shutting down: leave the job running so its lease expires and it is resumed
+			return
+		}
+		log.Printf("Job queue: job %s for session %s failed: %v", job.ID.Hex(), job.SessionID.Hex(), err)
+		finish(job, owner, models.JobFailed, err.Error())
+		return
+	}
+	finish(job, owner, models.JobDone, "")
+}
+
+func finish(job *models.ProcessingJob, owner, status, errMsg string) {
+	if err := store.FinishJob(context.Background(), job.ID, owner, status, errMsg); err != nil {
+		log.Printf("Job queue: failed to record %s for job %s: %v", status, job.ID.Hex(), err)
+	}
+}
+
+// newOwnerID identifies this process as a lease holder
+func newOwnerID() string {
+	host, _ := os.Hostname()
+	b := make([]byte, 4)
+	rand.Read(b)
+	return fmt.Sprintf("%s-%d-%s", host, os.Getpid(), hex.EncodeToString(b))
+}
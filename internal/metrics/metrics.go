@@ -0,0 +1,218 @@
+// Package metrics keeps process-wide counters and serves them in the Prometheus text format.
+package metrics
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// metric is anything that can write itself in the exposition format
+type metric interface {
+	write(sb *strings.Builder)
+}
+
+var (
+	registryMu sync.Mutex
+	registry   = make(map[string]metric)
+)
+
+func register(name string, m metric) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	if _, ok := registry[name]; ok {
+		panic("metrics: duplicate metric " + name)
+	}
+	registry[name] = m
+}
+
+// Counter is a monotonically increasing value
+type Counter struct {
+	name, help string
+	value      atomic.Int64
+}
+
+// NewCounter creates and registers a counter
+func NewCounter(name, help string) *Counter {
+	c := &Counter{name: name, help: help}
+	register(name, c)
+	return c
+}
+
+func (c *Counter) Inc()        { c.value.Add(1) }
+func (c *Counter) Add(n int64) { c.value.Add(n) }
+func (c *Counter) Value() int64 {
+	return c.value.Load()
+}
+
+func (c *Counter) write(sb *strings.Builder) {
+	writeHeader(sb, c.name, c.help, "counter")
+	fmt.Fprintf(sb, "%s %d\n", c.name, c.value.Load())
+}
+
+// CounterVec is a family of counters partitioned by label values
+type CounterVec struct {
+	name, help string
+	labels     []string
+
+	mu     sync.Mutex
+	values map[string]*atomic.Int64 // rendered label set -> value
+}
+
+// NewCounterVec creates and registers a counter family with the given label names
+func NewCounterVec(name, help string, labels ...string) *CounterVec {
+	c := &CounterVec{name: name, help: help, labels: labels, values: make(map[string]*atomic.Int64)}
+	register(name, c)
+	return c
+}
+
+// Inc increments the counter for the given label values, in the order of the label names
+func (c *CounterVec) Inc(labelValues ...string) {
+	key := labelKey(c.name, c.labels, labelValues)
+
+	c.mu.Lock()
+	v, ok := c.values[key]
+	if !ok {
+		v = new(atomic.Int64)
+		c.values[key] = v
+	}
+	c.mu.Unlock()
+	v.Add(1)
+}
+
+func (c *CounterVec) write(sb *strings.Builder) {
+	writeHeader(sb, c.name, c.help, "counter")
+	c.mu.Lock()
+	keys := make([]string, 0, len(c.values))
+	for k := range c.values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Fprintf(sb, "%s{%s} %d\n", c.name, k, c.values[k].Load())
+	}
+	c.mu.Unlock()
+}
+
+// labelKey renders a label set, e.g. `strategy="balanced",size="0-10MB"`
+func labelKey(name string, labels, values []string) string {
+	if len(values) != len(labels) {
+		panic("metrics: wrong number of label values for " + name)
+	}
+	pairs := make([]string, len(labels))
+	for i, l := range labels {
+		pairs[i] = fmt.Sprintf("%s=%q", l, values[i])
+	}
+	return strings.Join(pairs, ",")
+}
+
+// HistogramVec is a family of histograms partitioned by label values
+type HistogramVec struct {
+	name, help string
+	labels     []string
+	buckets    []float64 // upper bounds, ascending
+
+	mu     sync.Mutex
+	values map[string]*histogram // rendered label set -> histogram
+}
+
+type histogram struct {
+	counts []int64 // observations per bucket, not cumulative
+	count  int64
+	sum    float64
+}
+
+// NewHistogramVec creates and registers a histogram family with the given bucket upper bounds
+// and label names
+func NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	h := &HistogramVec{name: name, help: help, labels: labels, buckets: buckets, values: make(map[string]*histogram)}
+	register(name, h)
+	return h
+}
+
+// Observe records v for the given label values, in the order of the label names
+func (h *HistogramVec) Observe(v float64, labelValues ...string) {
+	key := labelKey(h.name, h.labels, labelValues)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	hist, ok := h.values[key]
+	if !ok {
+		hist = &histogram{counts: make([]int64, len(h.buckets))}
+		h.values[key] = hist
+	}
+	for i, upper := range h.buckets {
+		if v <= upper {
+			hist.counts[i]++
+			break
+		}
+	}
+	hist.count++
+	hist.sum += v
+}
+
+func (h *HistogramVec) write(sb *strings.Builder) {
+	writeHeader(sb, h.name, h.help, "histogram")
+	h.mu.Lock()
+	keys := make([]string, 0, len(h.values))
+	for k := range h.values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		hist := h.values[k]
+		var cumulative int64
+		for i, upper := range h.buckets {
+			cumulative += hist.counts[i]
+			fmt.Fprintf(sb, "%s_bucket{%s,le=\"%g\"} %d\n", h.name, k, upper, cumulative)
+		}
+		fmt.Fprintf(sb, "%s_bucket{%s,le=\"+Inf\"} %d\n", h.name, k, hist.count)
+		fmt.Fprintf(sb, "%s_sum{%s} %g\n", h.name, k, hist.sum)
+		fmt.Fprintf(sb, "%s_count{%s} %d\n", h.name, k, hist.count)
+	}
+	h.mu.Unlock()
+}
+
+// GaugeFunc reports the value returned by fn at scrape time
+type GaugeFunc struct {
+	name, help string
+	fn         func() float64
+}
+
+// NewGaugeFunc creates and registers a gauge backed by fn
+func NewGaugeFunc(name, help string, fn func() float64) *GaugeFunc {
+	g := &GaugeFunc{name: name, help: help, fn: fn}
+	register(name, g)
+	return g
+}
+
+func (g *GaugeFunc) write(sb *strings.Builder) {
+	writeHeader(sb, g.name, g.help, "gauge")
+	fmt.Fprintf(sb, "%s %g\n", g.name, g.fn())
+}
+
+func writeHeader(sb *strings.Builder, name, help, kind string) {
+	fmt.Fprintf(sb, "# HELP %s %s\n", name, help)
+	fmt.Fprintf(sb, "# TYPE %s %s\n", name, kind)
+}
+
+// Handler - GET /metrics
+func Handler(w http.ResponseWriter, r *http.Request) {
+	registryMu.Lock()
+	names := make([]string, 0, len(registry))
+	for name := range registry {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var sb strings.Builder
+	for _, name := range names {
+		registry[name].write(&sb)
+	}
+	registryMu.Unlock()
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.Write([]byte(sb.String()))
+}
@@ -1,8 +1,10 @@
 package middleware
 
 import (
+	"SE/internal/models"
 	"bufio"
 	"bytes"
+	"context"
 	"io"
 	"log"
 	"net"
@@ -110,6 +112,10 @@ func Logger(next http.Handler) http.Handler {
             reqBodyPreview = "<omitted>"
         }
 
+        // Handlers can keep secrets out of the log with OmitRequestBody, OmitResponseBody and RedactPath
+        opts := &logOptions{}
+        r = r.WithContext(context.WithValue(r.Context(), logOptionsKey{}, opts))
+
         next.ServeHTTP(lrw, r)
 
         duration := time.Since(start)
@@ -120,6 +126,12 @@ func Logger(next http.Handler) http.Handler {
         if query != "" {
             path = path + "?" + query
         }
+        for _, secret := range opts.redact {
+            path = strings.ReplaceAll(path, secret, "<redacted>")
+        }
+        if opts.omitRequestBody {
+            reqBodyPreview = "<omitted>"
+        }
 
         ip := clientIP(r)
 
@@ -130,7 +142,7 @@ func Logger(next http.Handler) http.Handler {
         // Decide whether to log response body content based on content type
         resCT := lrw.Header().Get("Content-Type")
         var resBodyPreview string
-        if shouldLogBody(resCT) {
+        if shouldLogBody(resCT) && !opts.omitResponseBody {
             resBodyPreview = previewBytes(lrw.bodyBuf.Bytes(), responseLogLimit, resCT)
         } else {
             resBodyPreview = "<omitted>"
@@ -148,6 +160,46 @@ func Logger(next http.Handler) http.Handler {
     })
 }
 
+// logOptionsKey is the request context key of the logOptions handlers set
+type logOptionsKey struct{}
+
+// logOptions is what a handler keeps out of the request log
+type logOptions struct {
+	omitRequestBody  bool
+	omitResponseBody bool
+	redact           []string // secrets in the path or query, such as a link token
+}
+
+// requestLogOptions returns the log options of r, nil if it doesn't go through Logger
+func requestLogOptions(r *http.Request) *logOptions {
+	opts, _ := r.Context().Value(logOptionsKey{}).(*logOptions)
+	return opts
+}
+
+// OmitResponseBody keeps the response body of r out of the request log whatever its content
+// type, for file contents and secrets. It must be called from the handler's goroutine.
+func OmitResponseBody(r *http.Request) {
+	if opts := requestLogOptions(r); opts != nil {
+		opts.omitResponseBody = true
+	}
+}
+
+// OmitRequestBody keeps the request body of r out of the request log, for passwords and
+// tokens sent in it. It must be called from the handler's goroutine.
+func OmitRequestBody(r *http.Request) {
+	if opts := requestLogOptions(r); opts != nil {
+		opts.omitRequestBody = true
+	}
+}
+
+// RedactPath logs the path and query of r with secret, such as a token in the URL, replaced
+// by <redacted>. It must be called from the handler's goroutine.
+func RedactPath(r *http.Request, secret string) {
+	if opts := requestLogOptions(r); opts != nil && secret != "" {
+		opts.redact = append(opts.redact, secret)
+	}
+}
+
 // clientIP tries to read the client IP from common proxy headers, falling back to RemoteAddr.
 func clientIP(r *http.Request) string {
     // X-Forwarded-For may contain multiple IPs, take the first
@@ -164,6 +216,24 @@ func clientIP(r *http.Request) string {
     return r.RemoteAddr
 }
 
+// ClientInfo describes the caller: client name and version from the X-Client-Name and
+// X-Client-Version headers, source IP and user agent.
+func ClientInfo(r *http.Request) models.ClientInfo {
+	return models.ClientInfo{
+		Name:      truncate(r.Header.Get("X-Client-Name"), 100),
+		Version:   truncate(r.Header.Get("X-Client-Version"), 50),
+		IP:        clientIP(r),
+		UserAgent: truncate(r.UserAgent(), 300),
+	}
+}
+
+func truncate(s string, n int) string {
+	if len(s) > n {
+		return strings.ToValidUTF8(s[:n], "")
+	}
+	return s
+}
+
 // --- helpers for body logging ---
 
 const (
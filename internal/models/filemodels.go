@@ -1,6 +1,7 @@
 package models
 
 import (
+	"path"
 	"time"
 
 	"go.mongodb.org/mongo-driver/bson/primitive"
@@ -8,19 +9,59 @@ import (
 
 // UploadSession tracks an ongoing file upload
 type UploadSession struct {
-	ID                 primitive.ObjectID `bson:"_id,omitempty" json:"id"`
-	UserID             primitive.ObjectID `bson:"user_id" json:"user_id"`
-	OriginalFilename   string             `bson:"original_filename" json:"original_filename"`
-	TempFilePath       string             `bson:"temp_file_path" json:"temp_file_path"`
-	KeyFilePath        string             `bson:"key_file_path,omitempty" json:"key_file_path,omitempty"`
-	TotalSize          int64              `bson:"total_size" json:"total_size"`
-	UploadedSize       int64              `bson:"uploaded_size" json:"uploaded_size"`
-	Status             string             `bson:"status" json:"status"` // "uploading", "processing", "complete", "failed"
-	ProcessingProgress float64            `bson:"processing_progress" json:"processing_progress"`
-	ErrorMessage       string             `bson:"error_message,omitempty" json:"error_message,omitempty"`
-	CreatedAt          time.Time          `bson:"created_at" json:"created_at"`
-	ExpiresAt          time.Time          `bson:"expires_at" json:"expires_at"`
-	CompletedAt        *time.Time         `bson:"completed_at,omitempty" json:"completed_at,omitempty"`
+	ID                 primitive.ObjectID    `bson:"_id,omitempty" json:"id"`
+	UserID             primitive.ObjectID    `bson:"user_id" json:"user_id"`
+	OriginalFilename   string                `bson:"original_filename" json:"original_filename"`
+	Folder             string                `bson:"folder,omitempty" json:"folder,omitempty"`
+	BatchID            primitive.ObjectID    `bson:"batch_id,omitempty" json:"batch_id,omitempty"`     // set for files uploaded as one batch
+	Client             *ClientInfo           `bson:"client,omitempty" json:"client,omitempty"`         // who started the upload
+	SourceURL          string                `bson:"source_url,omitempty" json:"source_url,omitempty"` // set when the server fetches the file itself
+	TempFilePath       string                `bson:"temp_file_path" json:"temp_file_path"`
+	KeyFilePath        Secret                `bson:"key_file_path,omitempty" json:"key_file_path,omitempty"`
+	TotalSize          int64                 `bson:"total_size" json:"total_size"`
+	UploadedSize       int64                 `bson:"uploaded_size" json:"uploaded_size"` // Distinct bytes received
+	ReceivedRanges     []ByteRange           `bson:"received_ranges,omitempty" json:"-"`
+	Status             string                `bson:"status" json:"status"` // "uploading", "processing", "paused", "incomplete", "complete", "failed", "infected"
+	PauseRequested     bool                  `bson:"pause_requested,omitempty" json:"pause_requested,omitempty"`
+	ProcessingProgress float64               `bson:"processing_progress" json:"processing_progress"`
+	ErrorMessage       string                `bson:"error_message,omitempty" json:"error_message,omitempty"`
+	CreatedAt          time.Time             `bson:"created_at" json:"created_at"`
+	UpdatedAt          time.Time             `bson:"updated_at,omitempty" json:"updated_at,omitempty"` // Heartbeat while processing
+	ExpiresAt          time.Time             `bson:"expires_at" json:"expires_at"`
+	CompletedAt        *time.Time            `bson:"completed_at,omitempty" json:"completed_at,omitempty"`
+	FileID             primitive.ObjectID    `bson:"file_id,omitempty" json:"file_id,omitempty"` // StoredFile created on completion
+	Checkpoint         *ProcessingCheckpoint `bson:"checkpoint,omitempty" json:"-"`              // Upload progress kept for retries
+	PlanPreview        *PlanPreview          `bson:"plan_preview,omitempty" json:"-"`            // Latest plan previewed for this upload
+}
+
+// PlanPreview is a chunk plan shown to the user before finalizing. Finalizing with its ID
+// uploads exactly this plan instead of planning again.
+type PlanPreview struct {
+	ID                 primitive.ObjectID `bson:"_id"`
+	Strategy           ChunkingStrategy   `bson:"strategy"`
+	ManualChunkSizes   []int64            `bson:"manual_chunk_sizes,omitempty"`
+	Erasure            *ErasureConfig     `bson:"erasure,omitempty"`
+	ObfuscationProfile string             `bson:"obfuscation_profile"`
+	ProcessedSize      int64              `bson:"processed_size"` // the plan covers the obfuscated file
+	Plan               []ChunkPlan        `bson:"plan"`
+	CreatedAt          time.Time          `bson:"created_at"`
+	// ObfuscationOverheadPct is the base overhead the profile scaled
+	ObfuscationOverheadPct float64 `bson:"obfuscation_overhead_pct,omitempty"`
+}
+
+// ByteRange is a half-open range [Start, End) of a file
+type ByteRange struct {
+	Start int64 `bson:"start" json:"start"`
+	End   int64 `bson:"end" json:"end"`
+}
+
+// ProcessingCheckpoint records the obfuscation seed, chunk plan and every chunk already on a
+// drive, so an interrupted processing run resumes with the remaining chunks
+type ProcessingCheckpoint struct {
+	Seed   Secret             `bson:"seed"`              // base64
+	FileID primitive.ObjectID `bson:"file_id,omitempty"` // named in the chunk headers; unset by checkpoints that predate them
+	Plan   []ChunkPlan        `bson:"plan"`
+	Chunks []ChunkMetadata    `bson:"chunks"`
 }
 
 // ChunkingStrategy defines how to split the file
@@ -31,12 +72,22 @@ const (
 	StrategyBalanced     ChunkingStrategy = "balanced"     // Balance across drives
 	StrategyProportional ChunkingStrategy = "proportional" // Proportional to space
 	StrategyManual       ChunkingStrategy = "manual"       // User-defined sizes
+	StrategyErasure      ChunkingStrategy = "erasure"      // Reed-Solomon data + parity shards
+	StrategyMinDrives    ChunkingStrategy = "min_drives"   // Fewest drives the file fits on
 )
 
+// ErasureConfig holds the Reed-Solomon shard counts for the erasure strategy
+type ErasureConfig struct {
+	DataShards   int `bson:"data_shards" json:"data_shards"`
+	ParityShards int `bson:"parity_shards" json:"parity_shards"`
+}
+
 // DriveSpaceInfo represents available space on a drive
 type DriveSpaceInfo struct {
 	AccountID   primitive.ObjectID `json:"account_id"`
 	DisplayName string             `json:"display_name"`
+	Label       string             `json:"label,omitempty"`
+	Color       string             `json:"color,omitempty"`
 	TotalSpace  int64              `json:"total_space"`
 	UsedSpace   int64              `json:"used_space"`
 	FreeSpace   int64              `json:"free_space"`
@@ -44,6 +95,7 @@ type DriveSpaceInfo struct {
 	Error       string             `json:"error,omitempty"`
 	OwnerName   string             `json:"owner_name,omitempty"`  // Add this
 	OwnerEmail  string             `json:"owner_email,omitempty"` // Add this
+	Throughput  float64            `json:"throughput_bytes_per_sec"`
 }
 
 // ChunkPlan defines how a chunk should be distributed
@@ -53,12 +105,14 @@ type ChunkPlan struct {
 	Size           int64              `json:"size"`
 	StartOffset    int64              `json:"start_offset"`
 	EndOffset      int64              `json:"end_offset"`
+	ShardIndex     int                `json:"shard_index,omitempty"` // Erasure strategy only
+	Parity         bool               `json:"parity,omitempty"`      // Erasure strategy only
 }
 
 // ObfuscationMetadata for key file
 type ObfuscationMetadata struct {
 	Algorithm   string  `json:"algorithm"`
-	Seed        string  `json:"seed"` // base64
+	Seed        Secret  `json:"seed"` // base64
 	BlockSize   int     `json:"block_size"`
 	OverheadPct float64 `json:"overhead_pct"`
 	MinGap      int     `json:"min_gap"`
@@ -73,23 +127,183 @@ type ChunkMetadata struct {
 	StartOffset    int64  `json:"start_offset"`
 	EndOffset      int64  `json:"end_offset"`
 	Size           int64  `json:"size"`
-	Checksum       string `json:"checksum"`
+	Checksum       string `json:"checksum"`                 // SHA-256 of the data, without the header
+	HeaderVersion  int    `json:"header_version,omitempty"` // chunk file format; 0 for chunks stored without a header
+	ShardIndex     int    `json:"shard_index,omitempty"`
+	Parity         bool   `json:"parity,omitempty"`
+}
+
+// ErasureMetadata for key file, present only for erasure-coded files
+type ErasureMetadata struct {
+	DataShards   int   `json:"data_shards"`
+	ParityShards int   `json:"parity_shards"`
+	ShardSize    int64 `json:"shard_size"`
 }
 
 // KeyFile structure - what user downloads
 type KeyFile struct {
 	Version          string              `json:"version"`
+	FileID           string              `json:"file_id,omitempty"`
 	OriginalFilename string              `json:"original_filename"`
 	OriginalSize     int64               `json:"original_size"`
 	ProcessedSize    int64               `json:"processed_size"`
 	Obfuscation      ObfuscationMetadata `json:"obfuscation"`
 	Chunks           []ChunkMetadata     `json:"chunks"`
+	Erasure          *ErasureMetadata    `json:"erasure,omitempty"`
 	CreatedAt        time.Time           `json:"created_at"`
 }
 
 // ProcessRequest - what user sends to finalize
 type ProcessRequest struct {
-	SessionID        string           `json:"session_id"`
-	Strategy         ChunkingStrategy `json:"strategy"`
-	ManualChunkSizes []int64          `json:"manual_chunk_sizes,omitempty"` // Only for manual strategy
+	SessionID        string           `bson:"session_id" json:"session_id"`
+	BatchID          string           `bson:"-" json:"batch_id,omitempty"` // finalizes every session of a batch instead
+	Strategy         ChunkingStrategy `bson:"strategy" json:"strategy"`
+	ManualChunkSizes []int64          `bson:"manual_chunk_sizes,omitempty" json:"manual_chunk_sizes,omitempty"` // Only for manual strategy
+	Erasure          *ErasureConfig   `bson:"erasure,omitempty" json:"erasure,omitempty"`                       // Only for erasure strategy
+	// Left empty, these fall back to the user's preferences
+	ObfuscationProfile string `bson:"obfuscation_profile,omitempty" json:"obfuscation_profile,omitempty"`
+	ParallelUploads    int    `bson:"parallel_uploads,omitempty" json:"parallel_uploads,omitempty"`
+	// Base noise overhead the profile scales; OBFUSCATION_OVERHEAD_PCT when neither this nor the preferences set it
+	ObfuscationOverheadPct float64 `bson:"obfuscation_overhead_pct,omitempty" json:"obfuscation_overhead_pct,omitempty"`
+	// Keep the chunks that made it when others keep failing, recording the file as incomplete
+	AllowPartial bool `bson:"allow_partial,omitempty" json:"allow_partial,omitempty"`
+	// Upload the plan previewed with this ID rather than planning again
+	PlanID string `bson:"plan_id,omitempty" json:"plan_id,omitempty"`
+}
+
+// FilePath joins a folder and filename into a full path in the user's folder tree
+func FilePath(folder, filename string) string {
+	return path.Join("/", folder, filename)
+}
+
+// Folder is a folder a user created. Folders also exist without one while files are stored in
+// them; the record keeps a folder that has no files yet.
+type Folder struct {
+	ID        primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+	UserID    primitive.ObjectID `bson:"user_id" json:"-"`
+	Path      string             `bson:"path" json:"path"` // e.g. "/photos/2024"
+	CreatedAt time.Time          `bson:"created_at" json:"created_at"`
+}
+
+// FileShare grants another user access to download a stored file, until the owner revokes it
+type FileShare struct {
+	ID        primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+	FileID    primitive.ObjectID `bson:"file_id" json:"file_id"`
+	OwnerID   primitive.ObjectID `bson:"owner_id" json:"owner_id"`
+	UserID    primitive.ObjectID `bson:"user_id" json:"user_id"` // who it is shared with
+	CreatedAt time.Time          `bson:"created_at" json:"created_at"`
+}
+
+// PublicLink lets anyone with its token download a stored file without an account, until it
+// expires, runs out of downloads or the owner revokes it
+type PublicLink struct {
+	ID           primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+	TokenHash    string             `bson:"token_hash" json:"-"` // the token itself is only shown when the link is created
+	FileID       primitive.ObjectID `bson:"file_id" json:"file_id"`
+	UserID       primitive.ObjectID `bson:"user_id" json:"-"`
+	PasswordHash []byte             `bson:"password_hash,omitempty" json:"-"`
+	MaxDownloads int                `bson:"max_downloads,omitempty" json:"max_downloads,omitempty"` // 0 for no limit
+	Downloads    int                `bson:"downloads" json:"downloads"`
+	ExpiresAt    *time.Time         `bson:"expires_at,omitempty" json:"expires_at,omitempty"`
+	CreatedAt    time.Time          `bson:"created_at" json:"created_at"`
+}
+
+// StoredFile is a file that has been processed and distributed across drives
+type StoredFile struct {
+	ID               primitive.ObjectID  `bson:"_id,omitempty" json:"id"`
+	UserID           primitive.ObjectID  `bson:"user_id" json:"user_id"`
+	SessionID        primitive.ObjectID  `bson:"session_id" json:"session_id"`
+	OriginalFilename string              `bson:"original_filename" json:"original_filename"`
+	NameLower        string              `bson:"name_lower,omitempty" json:"-"`            // lowercased filename for prefix search; unset on files stored before it
+	Folder           string              `bson:"folder,omitempty" json:"folder,omitempty"` // e.g. "/photos/2024", empty for the root
+	Path             string              `bson:"path,omitempty" json:"path"`               // folder and filename, e.g. "/photos/2024/a.jpg"
+	OriginalSize     int64               `bson:"original_size" json:"original_size"`
+	ProcessedSize    int64               `bson:"processed_size" json:"processed_size"`
+	Strategy         ChunkingStrategy    `bson:"strategy" json:"strategy"`
+	Obfuscation      ObfuscationMetadata `bson:"obfuscation" json:"-"` // seed never leaves the server through the API
+	Chunks           []StoredChunk       `bson:"chunks" json:"chunks"`
+	Erasure          *ErasureMetadata    `bson:"erasure,omitempty" json:"erasure,omitempty"`
+	Status           string              `bson:"status" json:"status"` // "active", "incomplete", "trashed"; "deleted" before the trash, with its chunks gone
+	// Sniffed from the content when it was processed
+	ContentType string     `bson:"content_type,omitempty" json:"content_type,omitempty"`
+	Media       *MediaInfo `bson:"media,omitempty" json:"media,omitempty"`
+	// Chunks that could not be uploaded to an incomplete file; POST /api/files/:id/repair retries them
+	MissingChunks []int `bson:"missing_chunks,omitempty" json:"missing_chunks,omitempty"`
+	// Pinned files are excluded from automatic tiering, rebalancing and GC candidate lists
+	Pinned bool `bson:"pinned" json:"pinned"`
+	// User notes and machine-readable context, e.g. {"source_host": "nas01"}
+	Description string            `bson:"description,omitempty" json:"description,omitempty"`
+	Metadata    map[string]string `bson:"metadata,omitempty" json:"metadata,omitempty"`
+	// Labels to find the file by, e.g. "backup-2024", in the order they were added
+	Tags []string `bson:"tags,omitempty" json:"tags,omitempty"`
+	// Where the file was uploaded from and last downloaded to
+	UploadClient       *ClientInfo `bson:"upload_client,omitempty" json:"upload_client,omitempty"`
+	LastDownloadClient *ClientInfo `bson:"last_download_client,omitempty" json:"last_download_client,omitempty"`
+	LastDownloadedAt   *time.Time  `bson:"last_downloaded_at,omitempty" json:"last_downloaded_at,omitempty"`
+	// When the integrity scrubber last checked some of the file's chunks
+	LastScrubbedAt *time.Time `bson:"last_scrubbed_at,omitempty" json:"last_scrubbed_at,omitempty"`
+	CreatedAt      time.Time  `bson:"created_at" json:"created_at"`
+	// When the owner moved the file to the trash; it is purged TRASH_RETENTION_DAYS later
+	DeletedAt *time.Time `bson:"deleted_at,omitempty" json:"deleted_at,omitempty"`
+}
+
+// MediaInfo is what could be read of an image, video or audio file; unknown fields are zero
+type MediaInfo struct {
+	Width           int     `bson:"width,omitempty" json:"width,omitempty"`
+	Height          int     `bson:"height,omitempty" json:"height,omitempty"`
+	DurationSeconds float64 `bson:"duration_seconds,omitempty" json:"duration_seconds,omitempty"`
+}
+
+// StoredChunk records where one chunk of a StoredFile lives
+type StoredChunk struct {
+	ChunkID        int                `bson:"chunk_id" json:"chunk_id"`
+	DriveAccountID primitive.ObjectID `bson:"drive_account_id" json:"drive_account_id"`
+	DriveFileID    string             `bson:"drive_file_id" json:"drive_file_id"`
+	Filename       string             `bson:"filename" json:"filename"`
+	StartOffset    int64              `bson:"start_offset" json:"start_offset"`
+	EndOffset      int64              `bson:"end_offset" json:"end_offset"`
+	Size           int64              `bson:"size" json:"size"`
+	Checksum       string             `bson:"checksum" json:"checksum"`
+	HeaderVersion  int                `bson:"header_version,omitempty" json:"header_version,omitempty"`
+	ShardIndex     int                `bson:"shard_index,omitempty" json:"shard_index,omitempty"`
+	Parity         bool               `bson:"parity,omitempty" json:"parity,omitempty"`
+	// What the integrity scrubber found when it last downloaded the chunk, empty until then
+	Health         string     `bson:"health,omitempty" json:"health,omitempty"`
+	LastCheckedAt  *time.Time `bson:"last_checked_at,omitempty" json:"last_checked_at,omitempty"`
+	LastVerifiedAt *time.Time `bson:"last_verified_at,omitempty" json:"last_verified_at,omitempty"` // last time it matched its checksum
+}
+
+// Chunk health as found by the integrity scrubber
+const (
+	ChunkOK      = "ok"
+	ChunkCorrupt = "corrupt" // doesn't match its checksum or header
+	ChunkMissing = "missing" // the drive file is gone
+)
+
+// Processing job states
+const (
+	JobQueued  = "queued"
+	JobRunning = "running"
+	JobDone    = "done"
+	JobFailed  = "failed"
+)
+
+// ProcessingJob is a durable unit of background processing for a finalized upload session.
+// A worker holds a lease on a running job and keeps renewing it; a job whose lease ran out
+// (e.g. the server restarted) is picked up again by the next free worker. Fast-lane jobs are
+// claimed ahead of the others.
+type ProcessingJob struct {
+	ID             primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+	SessionID      primitive.ObjectID `bson:"session_id" json:"session_id"`
+	UserID         primitive.ObjectID `bson:"user_id" json:"user_id"`
+	Request        ProcessRequest     `bson:"request" json:"request"`
+	Size           int64              `bson:"size" json:"size"`
+	FastLane       bool               `bson:"fast_lane,omitempty" json:"fast_lane,omitempty"` // small enough for the fast lane
+	Status         string             `bson:"status" json:"status"`
+	Attempts       int                `bson:"attempts" json:"attempts"`
+	LeaseOwner     string             `bson:"lease_owner,omitempty" json:"-"`
+	LeaseExpiresAt time.Time          `bson:"lease_expires_at,omitempty" json:"lease_expires_at,omitempty"`
+	Error          string             `bson:"error,omitempty" json:"error,omitempty"`
+	CreatedAt      time.Time          `bson:"created_at" json:"created_at"`
+	UpdatedAt      time.Time          `bson:"updated_at" json:"updated_at"`
 }
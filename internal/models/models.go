@@ -6,28 +6,165 @@ import (
 	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
+// Drive account credential types
+const (
+	DriveAccountTypeOAuth          = "oauth"           // linked through the OAuth consent flow
+	DriveAccountTypeServiceAccount = "service_account" // service account key, optionally with domain-wide delegation
+	DriveAccountTypeLocal          = "local"           // directory on the server standing in for Drive, for demos and tests
+)
+
 // DriveAccount represents and is used to store configuration of a drive account.
 type DriveAccount struct {
-	ID             primitive.ObjectID `bson:"_id,omitempty" json:"id"`
-	Provider       string             `bson:"provider" json:"provider"` // "google"
-	DisplayName    string             `bson:"display_name,omitempty" json:"display_name"`
-	EncryptedToken []byte             `bson:"encrypted_token" json:"-"` // store encrypted oauth2 token JSON
-	CreatedAt      time.Time          `bson:"created_at" json:"created_at"`
+	ID                   primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+	Provider             string             `bson:"provider" json:"provider"`                             // "google"
+	AccountType          string             `bson:"account_type,omitempty" json:"account_type,omitempty"` // empty means oauth
+	DisplayName          string             `bson:"display_name,omitempty" json:"display_name"`
+	Label                string             `bson:"label,omitempty" json:"label,omitempty"`                         // user-chosen name
+	Color                string             `bson:"color,omitempty" json:"color,omitempty"`                         // "#RRGGBB"
+	EncryptedToken       []byte             `bson:"encrypted_token" json:"-"`                                       // store encrypted oauth2 token JSON
+	TokenRefreshedAt     *time.Time         `bson:"token_refreshed_at,omitempty" json:"-"`                          // last successful access token refresh
+	EncryptedCredentials []byte             `bson:"encrypted_credentials,omitempty" json:"-"`                       // encrypted service account key JSON
+	ImpersonateEmail     string             `bson:"impersonate_email,omitempty" json:"impersonate_email,omitempty"` // domain-wide delegation subject
+	SharedDriveID        string             `bson:"shared_drive_id,omitempty" json:"shared_drive_id,omitempty"`     // upload into this Shared Drive
+	CreatedAt            time.Time          `bson:"created_at" json:"created_at"`
+}
+
+// NotificationChannel is a user-configured destination for alerts
+type NotificationChannel struct {
+	Type   string   `bson:"type" json:"type"`                         // "slack", "discord", "telegram"
+	Target string   `bson:"target" json:"target"`                     // webhook URL or Telegram chat ID
+	Events []string `bson:"events,omitempty" json:"events,omitempty"` // empty means all events
+}
+
+// PlacementPolicy limits how chunks of a single file may be spread over a user's drives,
+// bounding how much of a file one compromised drive reveals
+type PlacementPolicy struct {
+	DistinctDrives bool    `bson:"distinct_drives" json:"distinct_drives"`                 // never two chunks of a file on one drive
+	MaxSharePct    float64 `bson:"max_share_pct,omitempty" json:"max_share_pct,omitempty"` // max % of a file on one drive, 0 = no limit
+}
+
+// ClientInfo identifies the device and software that made a request
+type ClientInfo struct {
+	Name      string `bson:"name,omitempty" json:"name,omitempty"`       // X-Client-Name, e.g. "backup-cli"
+	Version   string `bson:"version,omitempty" json:"version,omitempty"` // X-Client-Version
+	IP        string `bson:"ip,omitempty" json:"ip,omitempty"`
+	UserAgent string `bson:"user_agent,omitempty" json:"user_agent,omitempty"`
+}
+
+// UserPreferences are per-user defaults applied when a request leaves the field out
+type UserPreferences struct {
+	ChunkingStrategy   ChunkingStrategy `bson:"chunking_strategy,omitempty" json:"chunking_strategy,omitempty"`
+	ObfuscationProfile string           `bson:"obfuscation_profile,omitempty" json:"obfuscation_profile,omitempty"` // "light", "standard", "heavy"
+	ParallelUploads    int              `bson:"parallel_uploads,omitempty" json:"parallel_uploads,omitempty"`       // capped by MAX_PARALLEL_UPLOADS
+	NotifyEvents       []string         `bson:"notify_events,omitempty" json:"notify_events,omitempty"`             // for channels without their own event list
+	DefaultFolder      string           `bson:"default_folder,omitempty" json:"default_folder,omitempty"`
+	// ObfuscationOverheadPct replaces OBFUSCATION_OVERHEAD_PCT as the noise overhead the profiles scale
+	ObfuscationOverheadPct float64 `bson:"obfuscation_overhead_pct,omitempty" json:"obfuscation_overhead_pct,omitempty"`
+	// ParallelDownloads is how many chunks a restore fetches at once, capped by RESTORE_PARALLEL_DOWNLOADS
+	ParallelDownloads int `bson:"parallel_downloads,omitempty" json:"parallel_downloads,omitempty"`
 }
 
 // User is our standard user object stored in MongoDB.
 type User struct {
-	ID            primitive.ObjectID `bson:"_id,omitempty" json:"id"`
-	Email         string             `bson:"email" json:"email"`
-	PasswordsHash []byte             `bson:"passwords_hash" json:"-"`
-	DriveAccounts []DriveAccount     `bson:"drive_accounts" json:"drive_accounts"` // Fixed field name
-	CreatedAt     time.Time          `bson:"created_at" json:"created_at"`
+	ID                   primitive.ObjectID    `bson:"_id,omitempty" json:"id"`
+	Email                string                `bson:"email" json:"email"`
+	PasswordsHash        []byte                `bson:"passwords_hash" json:"-"`
+	DriveAccounts        []DriveAccount        `bson:"drive_accounts" json:"drive_accounts"` // Fixed field name
+	NotificationChannels []NotificationChannel `bson:"notification_channels,omitempty" json:"notification_channels,omitempty"`
+	PlacementPolicy      *PlacementPolicy      `bson:"placement_policy,omitempty" json:"placement_policy,omitempty"`
+	Preferences          *UserPreferences      `bson:"preferences,omitempty" json:"preferences,omitempty"`
+	StorageQuota         int64                 `bson:"storage_quota,omitempty" json:"storage_quota,omitempty"` // bytes; 0 uses USER_QUOTA_GB, -1 is unlimited
+	Role                 string                `bson:"role,omitempty" json:"role,omitempty"`                   // RoleUser when empty
+	// EmailVerified is set once an identity provider vouched for the email, e.g. Google sign-in
+	EmailVerified bool      `bson:"email_verified,omitempty" json:"email_verified,omitempty"`
+	CreatedAt     time.Time `bson:"created_at" json:"created_at"`
+	// TokensValidAfter refuses access tokens issued before it; set when the password changes
+	TokensValidAfter *time.Time `bson:"tokens_valid_after,omitempty" json:"-"`
 }
 
+// User roles. Users whose verified email is in ADMIN_EMAILS are admins whatever their role.
+const (
+	RoleUser  = "user"
+	RoleAdmin = "admin"
+)
+
 // OAuthState is used to temporarily store OAuth state values so the user can be tracked back after OAuth flow
 type OAuthState struct {
 	CreatedAt time.Time          `bson:"created_at" json:"created_at"`
 	State     string             `bson:"state" json:"state"`
 	UserID    primitive.ObjectID `bson:"user_id" json:"user_id"`
 	Provider  string             `bson:"provider" json:"provider"`
+	// SharedDriveID is carried through the flow for accounts that upload into a Shared Drive
+	SharedDriveID string `bson:"shared_drive_id,omitempty" json:"shared_drive_id,omitempty"`
+	// NonceHash is the SHA-256 of the nonce cookie given to the client that started the flow
+	NonceHash string `bson:"nonce_hash,omitempty" json:"-"`
+	// InviteHash is the hashed invite code a Google sign-in signs up with in invite-only mode
+	InviteHash string `bson:"invite_hash,omitempty" json:"-"`
+}
+
+// Invite lets one person sign up while REGISTRATION_MODE is invite-only
+type Invite struct {
+	ID        primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+	CodeHash  string             `bson:"code_hash" json:"-"` // SHA-256 of the code; the code itself is only shown when created
+	Note      string             `bson:"note,omitempty" json:"note,omitempty"`
+	CreatedBy primitive.ObjectID `bson:"created_by" json:"created_by"`
+	CreatedAt time.Time          `bson:"created_at" json:"created_at"`
+	ExpiresAt *time.Time         `bson:"expires_at,omitempty" json:"expires_at,omitempty"`
+	UsedBy    string             `bson:"used_by,omitempty" json:"used_by,omitempty"` // email of the account it created
+	UsedAt    *time.Time         `bson:"used_at,omitempty" json:"used_at,omitempty"`
+}
+
+// RefreshToken is one of a chain of refresh tokens started by a login. Each is good for one
+// refresh, which hands out the next one in its family; the family shares one expiry.
+type RefreshToken struct {
+	ID        primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+	TokenHash string             `bson:"token_hash" json:"-"` // SHA-256 of the token, which is only handed out
+	FamilyID  primitive.ObjectID `bson:"family_id" json:"family_id"`
+	UserID    primitive.ObjectID `bson:"user_id" json:"user_id"`
+	CreatedAt time.Time          `bson:"created_at" json:"created_at"`
+	ExpiresAt time.Time          `bson:"expires_at" json:"expires_at"`
+	UsedAt    *time.Time         `bson:"used_at,omitempty" json:"used_at,omitempty"`
+	RevokedAt *time.Time         `bson:"revoked_at,omitempty" json:"revoked_at,omitempty"`
+	// LoginAt is when the family's login happened, and Client who asked for this token of it
+	LoginAt time.Time   `bson:"login_at" json:"login_at"`
+	Client  *ClientInfo `bson:"client,omitempty" json:"client,omitempty"`
+}
+
+// AuditEvent is a security-relevant action, kept for AUDIT_RETENTION_DAYS
+type AuditEvent struct {
+	ID        primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+	UserID    primitive.ObjectID `bson:"user_id,omitempty" json:"user_id,omitzero"` // zero for a failed login to an unknown email
+	Email     string             `bson:"email,omitempty" json:"email,omitempty"`    // the email a login was for
+	Action    string             `bson:"action" json:"action"`
+	Target    string             `bson:"target,omitempty" json:"target,omitempty"` // the session acted on, or the file for undeletes
+	Detail    string             `bson:"detail,omitempty" json:"detail,omitempty"`
+	Client    ClientInfo         `bson:"client" json:"client"`
+	CreatedAt time.Time          `bson:"created_at" json:"created_at"`
+	ExpiresAt time.Time          `bson:"expires_at" json:"-"`
+}
+
+// Audit event actions
+const (
+	AuditLoginSucceeded    = "login_succeeded"
+	AuditLoginFailed       = "login_failed"
+	AuditPasswordChanged   = "password_changed"
+	AuditSessionRevoked    = "session_revoked"
+	AuditDriveLinked       = "drive_linked"
+	AuditUploadDeleted     = "upload_deleted"
+	AuditFileDeleted       = "file_deleted" // moved to the trash
+	AuditFileRestored      = "file_restored"
+	AuditFileShared        = "file_shared"
+	AuditShareRevoked      = "share_revoked"
+	AuditPublicLinkCreated = "public_link_created"
+	AuditPublicLinkRevoked = "public_link_revoked"
+	AuditFileUndeleted     = "file_undeleted"
+	AuditKeyDownloaded     = "key_downloaded"
+)
+
+// DriveAPIUsage counts Drive API requests made for one account and operation on one quota day
+type DriveAPIUsage struct {
+	Day       string             `bson:"day" json:"day"` // "2006-01-02" in Google's quota timezone (Pacific)
+	AccountID primitive.ObjectID `bson:"account_id" json:"account_id"`
+	Operation string             `bson:"operation" json:"operation"`
+	Count     int64              `bson:"count" json:"count"`
 }
@@ -0,0 +1,73 @@
+package models
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+	"go.mongodb.org/mongo-driver/x/bsonx/bsoncore"
+)
+
+// Secret is a string that is encrypted at rest: it is sealed when marshalled to BSON, so the
+// store, its backups and the cache only hold ciphertext, and opened again when unmarshalled.
+// Values written before sealing was on read back as they are. JSON is left as plain text.
+type Secret string
+
+// sealedPrefix marks a sealed Secret in BSON
+const sealedPrefix = "sealed:"
+
+// sealSecret and openSecret encrypt and decrypt Secrets, nil until SetSecretCipher
+var sealSecret, openSecret func([]byte) ([]byte, error)
+
+// SetSecretCipher sets how Secrets are encrypted and decrypted; nil stores them in plain text
+func SetSecretCipher(seal, open func([]byte) ([]byte, error)) {
+	sealSecret, openSecret = seal, open
+}
+
+// MarshalBSONValue seals the secret
+func (s Secret) MarshalBSONValue() (bsontype.Type, []byte, error) {
+	v := string(s)
+	if sealSecret != nil && v != "" {
+		ct, err := sealSecret([]byte(v))
+		if err != nil {
+			return 0, nil, fmt.Errorf("seal secret: %w", err)
+		}
+		v = sealedPrefix + base64.StdEncoding.EncodeToString(ct)
+	}
+	return bsontype.String, bsoncore.AppendString(nil, v), nil
+}
+
+// UnmarshalBSONValue opens a sealed secret and takes a plain one as it is
+func (s *Secret) UnmarshalBSONValue(t bsontype.Type, data []byte) error {
+	if t == bsontype.Null || t == bsontype.Undefined {
+		*s = ""
+		return nil
+	}
+	if t != bsontype.String {
+		return fmt.Errorf("secret stored as %s, want a string", t)
+	}
+	v, _, ok := bsoncore.ReadString(data)
+	if !ok {
+		return errors.New("malformed secret")
+	}
+	sealed, ok := strings.CutPrefix(v, sealedPrefix)
+	if !ok {
+		*s = Secret(v)
+		return nil
+	}
+	if openSecret == nil {
+		return errors.New("secret is sealed but no key is set")
+	}
+	ct, err := base64.StdEncoding.DecodeString(sealed)
+	if err != nil {
+		return fmt.Errorf("open secret: %w", err)
+	}
+	plain, err := openSecret(ct)
+	if err != nil {
+		return fmt.Errorf("open secret: %w", err)
+	}
+	*s = Secret(plain)
+	return nil
+}
@@ -0,0 +1,121 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+func init() {
+	Register("slack", newSlackChannel)
+	Register("discord", newDiscordChannel)
+	Register("telegram", newTelegramChannel)
+}
+
+var httpClient = &http.Client{}
+
+// postJSON sends body as JSON and treats any non-2xx answer as an error
+func postJSON(ctx context.Context, target string, body interface{}) error {
+	payload, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", target, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		// Webhook URLs and bot tokens are secrets; don't let them end up in logs
+		var uerr *url.Error
+		if errors.As(err, &uerr) {
+			return uerr.Err
+		}
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		respBody, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("status %d: %s", resp.StatusCode, string(respBody))
+	}
+	return nil
+}
+
+func validateWebhookURL(raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil || u.Scheme != "https" || u.Host == "" {
+		return errors.New("webhook URL must be an absolute https URL")
+	}
+	return nil
+}
+
+// Slack incoming webhook
+type slackChannel struct{ webhookURL string }
+
+func newSlackChannel(target string) (Channel, error) {
+	if err := validateWebhookURL(target); err != nil {
+		return nil, err
+	}
+	return &slackChannel{webhookURL: target}, nil
+}
+
+func (c *slackChannel) Name() string { return "slack" }
+
+func (c *slackChannel) Send(ctx context.Context, e Event) error {
+	return postJSON(ctx, c.webhookURL, map[string]string{"text": formatText(e)})
+}
+
+// Discord webhook
+type discordChannel struct{ webhookURL string }
+
+func newDiscordChannel(target string) (Channel, error) {
+	if err := validateWebhookURL(target); err != nil {
+		return nil, err
+	}
+	return &discordChannel{webhookURL: target}, nil
+}
+
+func (c *discordChannel) Name() string { return "discord" }
+
+func (c *discordChannel) Send(ctx context.Context, e Event) error {
+	// Discord rejects messages over 2000 characters
+	text := formatText(e)
+	if len(text) > 2000 {
+		text = text[:1997] + "..."
+	}
+	return postJSON(ctx, c.webhookURL, map[string]string{"content": text})
+}
+
+// Telegram bot message; the target is a chat ID and the bot token comes from NOTIFY_TELEGRAM_BOT_TOKEN
+type telegramChannel struct {
+	botToken string
+	chatID   string
+}
+
+func newTelegramChannel(target string) (Channel, error) {
+	token := os.Getenv("NOTIFY_TELEGRAM_BOT_TOKEN")
+	if token == "" {
+		return nil, errors.New("NOTIFY_TELEGRAM_BOT_TOKEN is not configured")
+	}
+	if strings.TrimSpace(target) == "" {
+		return nil, errors.New("telegram chat ID required")
+	}
+	return &telegramChannel{botToken: token, chatID: target}, nil
+}
+
+func (c *telegramChannel) Name() string { return "telegram" }
+
+func (c *telegramChannel) Send(ctx context.Context, e Event) error {
+	endpoint := fmt.Sprintf("https://api.telegram.org/bot%s/sendMessage", c.botToken)
+	return postJSON(ctx, endpoint, map[string]string{"chat_id": c.chatID, "text": formatText(e)})
+}
@@ -0,0 +1,223 @@
+package notify
+
+import (
+	"SE/internal/models"
+	"SE/internal/store"
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Event types
+const (
+	EventUploadFailed   = "upload_failed"
+	EventIntegrityAlert = "integrity_alert"
+	EventDriveHealth    = "drive_health"
+)
+
+// KnownEvent reports whether name is an event type channels can subscribe to
+func KnownEvent(name string) bool {
+	switch name {
+	case EventUploadFailed, EventIntegrityAlert, EventDriveHealth:
+		return true
+	}
+	return false
+}
+
+// Event is a single notification
+type Event struct {
+	Type    string
+	UserID  primitive.ObjectID // zero for deployment-wide events
+	Title   string
+	Message string
+	// DedupeKey suppresses repeats of the same event within the dedupe window (optional)
+	DedupeKey string
+	Time      time.Time
+}
+
+// Channel delivers events to one destination
+type Channel interface {
+	Name() string
+	Send(ctx context.Context, e Event) error
+}
+
+// Factory builds a channel from its target (webhook URL, chat ID...)
+type Factory func(target string) (Channel, error)
+
+var (
+	factoriesMu sync.RWMutex
+	factories   = make(map[string]Factory)
+
+	// deployment-wide channels configured from env
+	globalChannels []Channel
+	// events sent to deployment channels; empty means all
+	globalEvents map[string]bool
+	dedupeWindow time.Duration
+
+	dedupeMu   sync.Mutex
+	recentKeys = make(map[string]time.Time)
+)
+
+// Register makes a channel type available by name. Called from init() of each channel implementation.
+func Register(channelType string, f Factory) {
+	factoriesMu.Lock()
+	defer factoriesMu.Unlock()
+	factories[channelType] = f
+}
+
+// NewChannel builds a channel of a registered type
+func NewChannel(channelType, target string) (Channel, error) {
+	factoriesMu.RLock()
+	f, ok := factories[channelType]
+	factoriesMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown notification channel type %q", channelType)
+	}
+	return f(target)
+}
+
+// ChannelTypes lists the registered channel types
+func ChannelTypes() []string {
+	factoriesMu.RLock()
+	defer factoriesMu.RUnlock()
+	types := make([]string, 0, len(factories))
+	for t := range factories {
+		types = append(types, t)
+	}
+	return types
+}
+
+func InitNotifyConfig() {
+	globalChannels = nil
+	if url := os.Getenv("NOTIFY_SLACK_WEBHOOK_URL"); url != "" {
+		addGlobalChannel("slack", url)
+	}
+	if url := os.Getenv("NOTIFY_DISCORD_WEBHOOK_URL"); url != "" {
+		addGlobalChannel("discord", url)
+	}
+	if chatID := os.Getenv("NOTIFY_TELEGRAM_CHAT_ID"); chatID != "" {
+		addGlobalChannel("telegram", chatID)
+	}
+
+	globalEvents = make(map[string]bool)
+	for _, e := range strings.Split(os.Getenv("NOTIFY_EVENTS"), ",") {
+		if e = strings.TrimSpace(e); e != "" {
+			globalEvents[e] = true
+		}
+	}
+
+	mins, _ := strconv.Atoi(os.Getenv("NOTIFY_DEDUPE_MINUTES"))
+	if mins == 0 {
+		mins = 60
+	}
+	dedupeWindow = time.Duration(mins) * time.Minute
+}
+
+func addGlobalChannel(channelType, target string) {
+	ch, err := NewChannel(channelType, target)
+	if err != nil {
+		log.Printf("Notify: skipping %s channel: %v", channelType, err)
+		return
+	}
+	globalChannels = append(globalChannels, ch)
+}
+
+// Notify delivers an event asynchronously to the deployment channels and, for user events,
+// to the user's own channels. Delivery failures are logged, never returned.
+func Notify(e Event) {
+	if e.Time.IsZero() {
+		e.Time = time.Now().UTC()
+	}
+	if e.DedupeKey != "" && isDuplicate(e.Type+"|"+e.DedupeKey) {
+		return
+	}
+
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+
+		if len(globalEvents) == 0 || globalEvents[e.Type] {
+			for _, ch := range globalChannels {
+				send(ctx, ch, e)
+			}
+		}
+
+		if e.UserID.IsZero() {
+			return
+		}
+		userChannels, err := store.GetUserNotificationChannels(ctx, e.UserID)
+		if err != nil {
+			log.Printf("Notify: failed to load channels for user %s: %v", e.UserID.Hex(), err)
+			return
+		}
+		prefs, err := store.GetUserPreferences(ctx, e.UserID)
+		if err != nil {
+			log.Printf("Notify: failed to load preferences for user %s: %v", e.UserID.Hex(), err)
+		}
+		for _, uc := range userChannels {
+			if !wantsEvent(uc, prefs.NotifyEvents, e.Type) {
+				continue
+			}
+			ch, err := NewChannel(uc.Type, uc.Target)
+			if err != nil {
+				log.Printf("Notify: user %s: %v", e.UserID.Hex(), err)
+				continue
+			}
+			send(ctx, ch, e)
+		}
+	}()
+}
+
+func send(ctx context.Context, ch Channel, e Event) {
+	if err := ch.Send(ctx, e); err != nil {
+		log.Printf("Notify: %s delivery of %s failed: %v", ch.Name(), e.Type, err)
+	}
+}
+
+// wantsEvent checks the channel's own event list, falling back to the user's default list
+func wantsEvent(c models.NotificationChannel, defaults []string, eventType string) bool {
+	events := c.Events
+	if len(events) == 0 {
+		events = defaults
+	}
+	if len(events) == 0 {
+		return true
+	}
+	for _, e := range events {
+		if e == eventType {
+			return true
+		}
+	}
+	return false
+}
+
+func isDuplicate(key string) bool {
+	dedupeMu.Lock()
+	defer dedupeMu.Unlock()
+
+	now := time.Now()
+	if last, ok := recentKeys[key]; ok && now.Sub(last) < dedupeWindow {
+		return true
+	}
+	recentKeys[key] = now
+
+	// Drop stale keys so the map doesn't grow forever
+	for k, t := range recentKeys {
+		if now.Sub(t) >= dedupeWindow {
+			delete(recentKeys, k)
+		}
+	}
+	return false
+}
+
+// formatText renders an event as a short plain-text message
+func formatText(e Event) string {
+	return fmt.Sprintf("[%s] %s\n%s", e.Type, e.Title, e.Message)
+}
@@ -0,0 +1,66 @@
+package oauth
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+)
+
+const defaultFinishedPage = `<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>{{if .ProductName}}{{.ProductName}} - {{end}}Drive linked</title></head>
+<body>
+<h1>OAuth flow completed</h1>
+<p>You can close this window and return to {{if .ProductName}}{{.ProductName}}{{else}}the application{{end}}.</p>
+</body>
+</html>
+`
+
+var (
+	// finishedPage is shown once a Drive is linked; OAUTH_FINISHED_TEMPLATE replaces it
+	finishedPage = template.Must(template.New("finished").Parse(defaultFinishedPage))
+	// productName is the PRODUCT_NAME the page is rendered with
+	productName string
+	// finishedRedirect sends the browser to the operator's own page instead, when set
+	finishedRedirect string
+)
+
+// InitFinishedPage loads the branding of the page a completed OAuth flow lands on
+func InitFinishedPage() error {
+	productName = os.Getenv("PRODUCT_NAME")
+	finishedRedirect = os.Getenv("OAUTH_FINISHED_REDIRECT")
+
+	if path := os.Getenv("OAUTH_FINISHED_TEMPLATE"); path != "" {
+		t, err := template.ParseFiles(path)
+		if err != nil {
+			return fmt.Errorf("OAUTH_FINISHED_TEMPLATE: %w", err)
+		}
+		finishedPage = t
+	}
+	return nil
+}
+
+// finishedURL is where the callback sends the browser once the drive is saved
+func finishedURL() string {
+	if finishedRedirect != "" {
+		return finishedRedirect
+	}
+	return strings.TrimSuffix(os.Getenv("BASE_URL"), "/") + "/oauth/finished"
+}
+
+// FinishedHandler - GET /oauth/finished
+// Tells the user the Drive is linked and they can go back to the application
+func FinishedHandler(w http.ResponseWriter, r *http.Request) {
+	var buf bytes.Buffer
+	if err := finishedPage.Execute(&buf, struct{ ProductName string }{productName}); err != nil {
+		log.Printf("render oauth finished page: %v", err)
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write(buf.Bytes())
+}
@@ -0,0 +1,226 @@
+package oauth
+
+import (
+	"SE/internal/audit"
+	"SE/internal/auth"
+	"SE/internal/middleware"
+	"SE/internal/models"
+	"SE/internal/store"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+)
+
+// OAuth state providers of Google sign-in: the flow itself, and the one-time code it hands the
+// client to trade for tokens
+const (
+	loginProvider     = "google-login"
+	loginCodeProvider = "google-login-code"
+)
+
+var (
+	// loginConf only asks Google who the user is
+	loginConf *oauth2.Config
+	// loginRedirect is the client page a finished sign-in is sent to; sign-in is off without it
+	loginRedirect *url.URL
+)
+
+// errUnverifiedEmail is returned for Google accounts without a verified email
+var errUnverifiedEmail = errors.New("google account has no verified email")
+
+// initLoginConfig sets up Google sign-in with the same OAuth client as Drive linking
+func initLoginConfig(baseURL string) {
+	loginConf = &oauth2.Config{
+		ClientID:     oauthConf.ClientID,
+		ClientSecret: oauthConf.ClientSecret,
+		Endpoint:     google.Endpoint,
+		Scopes:       []string{"openid", "email"},
+		RedirectURL:  baseURL + "/oauth2/callback",
+	}
+
+	loginRedirect = nil
+	if raw := os.Getenv("GOOGLE_LOGIN_REDIRECT"); raw != "" {
+		u, err := url.Parse(raw)
+		if err != nil || u.Scheme == "" || u.Host == "" {
+			log.Fatalf("GOOGLE_LOGIN_REDIRECT %q must be an absolute URL", raw)
+		}
+		loginRedirect = u
+	}
+}
+
+// GoogleLoginHandler - GET /api/auth/google
+// Sends the browser to Google to sign in; invite_code is used if it signs up in invite-only mode
+func GoogleLoginHandler(w http.ResponseWriter, r *http.Request) {
+	if loginRedirect == nil {
+		http.Error(w, "google sign-in is not configured", http.StatusNotFound)
+		return
+	}
+
+	state, err := randomState()
+	if err != nil {
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+	nonce, err := randomState()
+	if err != nil {
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+
+	var inviteHash string
+	if code := r.URL.Query().Get("invite_code"); strings.TrimSpace(code) != "" {
+		inviteHash = auth.HashInviteCode(code)
+	}
+	if err := store.InsertOAuthState(r.Context(), &models.OAuthState{
+		State:      state,
+		Provider:   loginProvider,
+		NonceHash:  hashNonce(nonce),
+		InviteHash: inviteHash,
+	}); err != nil {
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+	http.SetCookie(w, stateCookie(state, nonce, int(stateCookieTTL/time.Second)))
+
+	http.Redirect(w, r, loginConf.AuthCodeURL(state, oauth2.SetAuthURLParam("prompt", "select_account")), http.StatusFound)
+}
+
+// finishGoogleLogin completes a sign-in at the OAuth callback. The user with the Google
+// account's verified email is signed in, or signed up if there is none, and the browser is
+// sent to GOOGLE_LOGIN_REDIRECT with a one-time code, or with an error.
+func finishGoogleLogin(w http.ResponseWriter, r *http.Request, stored *models.OAuthState, code string) {
+	tok, err := loginConf.Exchange(r.Context(), code)
+	if err != nil {
+		log.Printf("Sign-in token exchange failed: %v", err)
+		http.Error(w, "token exchange failed", http.StatusInternalServerError)
+		return
+	}
+	email, err := idTokenEmail(tok)
+	if errors.Is(err, errUnverifiedEmail) {
+		redirectLogin(w, r, "error", "unverified_email")
+		return
+	}
+	if err != nil {
+		log.Printf("Sign-in ID token rejected: %v", err)
+		http.Error(w, "invalid id token", http.StatusBadGateway)
+		return
+	}
+
+	u, err := auth.ExternalLogin(r.Context(), email, stored.InviteHash)
+	switch {
+	case errors.Is(err, auth.ErrRegistrationClosed):
+		audit.Record(r, models.AuditEvent{Email: email, Action: models.AuditLoginFailed, Detail: "google: registration closed"})
+		redirectLogin(w, r, "error", "registration_closed")
+		return
+	case errors.Is(err, auth.ErrInviteRequired):
+		audit.Record(r, models.AuditEvent{Email: email, Action: models.AuditLoginFailed, Detail: "google: invite required"})
+		redirectLogin(w, r, "error", "invite_required")
+		return
+	case errors.Is(err, auth.ErrInvalidInvite):
+		audit.Record(r, models.AuditEvent{Email: email, Action: models.AuditLoginFailed, Detail: "google: invalid invite"})
+		redirectLogin(w, r, "error", "invalid_invite")
+		return
+	case errors.Is(err, auth.ErrUnverifiedAccount):
+		audit.Record(r, models.AuditEvent{Email: email, Action: models.AuditLoginFailed, Detail: "google: unverified password account"})
+		redirectLogin(w, r, "error", "password_account")
+		return
+	case err != nil:
+		log.Printf("Sign-in of %s failed: %v", email, err)
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+
+	// The tokens themselves don't go in a URL, where they'd end up in history and logs
+	loginCode, err := randomState()
+	if err != nil {
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+	if err := store.InsertOAuthState(r.Context(), &models.OAuthState{
+		State:    loginCode,
+		UserID:   u.ID,
+		Provider: loginCodeProvider,
+	}); err != nil {
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+	log.Printf("User %s signed in with Google", u.ID.Hex())
+	audit.Record(r, models.AuditEvent{UserID: u.ID, Email: email, Action: models.AuditLoginSucceeded, Detail: "google"})
+	redirectLogin(w, r, "code", loginCode)
+}
+
+// idTokenEmail returns the verified email of the ID token in a sign-in's token response. The
+// token came straight from Google's token endpoint over TLS, so its claims are checked but
+// not its signature.
+func idTokenEmail(tok *oauth2.Token) (string, error) {
+	raw, _ := tok.Extra("id_token").(string)
+	if raw == "" {
+		return "", errors.New("no id_token in token response")
+	}
+	claims := jwt.MapClaims{}
+	if _, _, err := jwt.NewParser().ParseUnverified(raw, claims); err != nil {
+		return "", err
+	}
+	if iss, _ := claims.GetIssuer(); iss != "https://accounts.google.com" && iss != "accounts.google.com" {
+		return "", errors.New("unexpected issuer " + iss)
+	}
+	if aud, _ := claims.GetAudience(); !slices.Contains(aud, loginConf.ClientID) {
+		return "", errors.New("id token is for another client")
+	}
+	if exp, _ := claims.GetExpirationTime(); exp == nil || exp.Before(time.Now()) {
+		return "", errors.New("id token expired")
+	}
+
+	// Google sends email_verified as a bool, and has sent it as a string
+	email, _ := claims["email"].(string)
+	verified := claims["email_verified"] == true || claims["email_verified"] == "true"
+	if email == "" || !verified {
+		return "", errUnverifiedEmail
+	}
+	return email, nil
+}
+
+// redirectLogin sends the browser to GOOGLE_LOGIN_REDIRECT with one query parameter added
+func redirectLogin(w http.ResponseWriter, r *http.Request, key, value string) {
+	u := *loginRedirect
+	q := u.Query()
+	q.Set(key, value)
+	u.RawQuery = q.Encode()
+	http.Redirect(w, r, u.String(), http.StatusSeeOther)
+}
+
+// GoogleLoginTokenHandler - POST /api/auth/google/token
+// Trades the one-time code of a finished Google sign-in for tokens, like a login
+func GoogleLoginTokenHandler(w http.ResponseWriter, r *http.Request) {
+	// The code is as good as a password until it is used
+	middleware.OmitRequestBody(r)
+	var req struct {
+		Code       string `json:"code"`
+		RememberMe bool   `json:"remember_me"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Code == "" {
+		http.Error(w, "code is required", http.StatusBadRequest)
+		return
+	}
+
+	stored, err := store.FindAndDeleteState(r.Context(), req.Code)
+	if err != nil {
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+	if stored == nil || stored.Provider != loginCodeProvider {
+		http.Error(w, "invalid or expired code", http.StatusUnauthorized)
+		return
+	}
+	auth.RespondWithLogin(w, r, stored.UserID, req.RememberMe)
+}
@@ -1,21 +1,29 @@
 package oauth
 
 import (
+	"SE/internal/audit"
+	"SE/internal/middleware"
 	"SE/internal/models"
 	"SE/internal/store"
 	"context"
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
 	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
+	"net/url"
 	"os"
 	"strings"
+	"sync"
+	"time"
 
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"golang.org/x/oauth2"
@@ -25,17 +33,38 @@ import (
 var oauthConf *oauth2.Config
 var tokenEncKey []byte
 
+// requireStateCookie rejects callbacks from a browser without the nonce cookie of the flow
+var requireStateCookie bool
+
+// linkStartURL is BASE_URL/api/drive/link/start, where a browser starts a drive link itself
+var linkStartURL string
+
+// linkStartProvider is the provider of the one-time codes of start URLs, kept with the states
+const linkStartProvider = "google-link-start"
+
+// secureCookies is set when BASE_URL is https
+var secureCookies bool
+
+// stateCookieTTL matches how long OAuth states are kept
+const stateCookieTTL = 10 * time.Minute
+
+// driveScopes are requested for both OAuth-linked and service accounts
+var driveScopes = []string{
+	// drive.file allows upload/manage files created by the app
+	"https://www.googleapis.com/auth/drive.file",
+	// metadata.readonly is required to call about.get for storageQuota
+	"https://www.googleapis.com/auth/drive.metadata.readonly",
+}
+
 func InitOAuthConfig() {
 	// Decode base64-encoded TOKEN_ENC_KEY
-	keyStr := os.Getenv("TOKEN_ENC_KEY")
 	var err error
-	tokenEncKey, err = base64.StdEncoding.DecodeString(keyStr)
+	tokenEncKey, err = DecodeTokenEncKey(os.Getenv("TOKEN_ENC_KEY"))
 	if err != nil {
-		log.Fatalf("TOKEN_ENC_KEY must be valid base64: %v", err)
-	}
-	if len(tokenEncKey) != 32 {
-		log.Fatalf("TOKEN_ENC_KEY must decode to exactly 32 bytes for AES-256, got %d bytes", len(tokenEncKey))
+		log.Fatal(err)
 	}
+	// Obfuscation seeds and key file paths are sealed with the same key
+	models.SetSecretCipher(Encrypt, Decrypt)
 
 	// Ensure BASE_URL doesn't have trailing slash
 	baseURL := strings.TrimSuffix(os.Getenv("BASE_URL"), "/")
@@ -44,16 +73,18 @@ func InitOAuthConfig() {
 		ClientID:     os.Getenv("GOOGLE_CLIENT_ID"),
 		ClientSecret: os.Getenv("GOOGLE_CLIENT_SECRET"),
 		Endpoint:     google.Endpoint,
-		Scopes: []string{
-			// drive.file allows upload/manage files created by the app
-			"https://www.googleapis.com/auth/drive.file",
-			// metadata.readonly is required to call about.get for storageQuota
-			"https://www.googleapis.com/auth/drive.metadata.readonly",
-			"https://www.googleapis.com/auth/userinfo.email",
-		},
-		RedirectURL: baseURL + "/oauth2/callback",
+		Scopes:       append(append([]string{}, driveScopes...), "https://www.googleapis.com/auth/userinfo.email"),
+		RedirectURL:  baseURL + "/oauth2/callback",
 	}
 
+	initLoginConfig(baseURL)
+
+	// Clients that open auth_url rather than start_url may not have the cookie, so it is only
+	// required once a deployment's clients all start links through start_url
+	requireStateCookie = os.Getenv("OAUTH_REQUIRE_STATE_COOKIE") == "true"
+	linkStartURL = baseURL + "/api/drive/link/start"
+	secureCookies = strings.HasPrefix(baseURL, "https://")
+
 	// Debug: Print OAuth config (without secrets)
 	log.Printf("OAuth Config initialized:")
 	log.Printf("  - ClientID: %s", maskString(oauthConf.ClientID))
@@ -61,39 +92,137 @@ func InitOAuthConfig() {
 	log.Printf("  - Scopes: %v", oauthConf.Scopes)
 }
 
+// DecodeTokenEncKey decodes and validates the base64 AES-256 key used for token encryption
+func DecodeTokenEncKey(keyStr string) ([]byte, error) {
+	key, err := base64.StdEncoding.DecodeString(keyStr)
+	if err != nil {
+		return nil, fmt.Errorf("TOKEN_ENC_KEY must be valid base64: %w", err)
+	}
+	if len(key) != 32 {
+		return nil, fmt.Errorf("TOKEN_ENC_KEY must decode to exactly 32 bytes for AES-256, got %d bytes", len(key))
+	}
+	return key, nil
+}
+
+// ValidateClientConfig checks the Google OAuth client settings without contacting Google
+func ValidateClientConfig() error {
+	clientID := os.Getenv("GOOGLE_CLIENT_ID")
+	if !strings.HasSuffix(clientID, ".apps.googleusercontent.com") {
+		return errors.New("GOOGLE_CLIENT_ID does not look like a Google OAuth client ID (*.apps.googleusercontent.com)")
+	}
+	if os.Getenv("GOOGLE_CLIENT_SECRET") == "" {
+		return errors.New("GOOGLE_CLIENT_SECRET is empty")
+	}
+	base, err := url.Parse(os.Getenv("BASE_URL"))
+	if err != nil || (base.Scheme != "http" && base.Scheme != "https") || base.Host == "" {
+		return fmt.Errorf("BASE_URL %q must be an absolute http(s) URL", os.Getenv("BASE_URL"))
+	}
+	return nil
+}
+
 // GET /api/drive/link
-// returns JSON { auth_url: ... }
+// returns JSON { auth_url: ..., start_url: ... }
+// A cross-origin client never stores the nonce cookie set on this response, so a browser
+// should open start_url, which sets it on a top-level visit and goes on to Google
 func DriveLinkHandler(w http.ResponseWriter, r *http.Request) {
 	uid := r.Context().Value("userID").(primitive.ObjectID)
+	sharedDriveID := r.URL.Query().Get("shared_drive_id")
 
-	state, err := randomState()
+	state, err := startDriveLink(w, r, uid, sharedDriveID)
+	if err != nil {
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+	startCode, err := randomState()
 	if err != nil {
 		http.Error(w, "server error", http.StatusInternalServerError)
 		return
 	}
-
-	// store state -> user
 	if err := store.InsertOAuthState(r.Context(), &models.OAuthState{
-		State:    state,
-		UserID:   uid,
-		Provider: "google",
+		State:         startCode,
+		UserID:        uid,
+		Provider:      linkStartProvider,
+		SharedDriveID: sharedDriveID,
 	}); err != nil {
 		http.Error(w, "server error", http.StatusInternalServerError)
 		return
 	}
 
-	// Generate authorization URL with proper parameters
-	url := oauthConf.AuthCodeURL(
+	url := driveAuthURL(state)
+	log.Printf("Generated OAuth URL for user %s: %s", uid.Hex(), url)
+
+	// Whoever has the start URL can start a link into the user's account
+	middleware.OmitResponseBody(r)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"auth_url":  url,
+		"start_url": linkStartURL + "?code=" + startCode,
+	})
+}
+
+// GET /api/drive/link/start?code=...
+// Starts the drive link of a start_url in the browser that opens it: the nonce cookie is set
+// there and the browser is sent on to Google. The code works once.
+func DriveLinkStartHandler(w http.ResponseWriter, r *http.Request) {
+	code := r.URL.Query().Get("code")
+	middleware.RedactPath(r, code)
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Referrer-Policy", "no-referrer")
+	if code == "" {
+		http.Error(w, "missing code", http.StatusBadRequest)
+		return
+	}
+
+	stored, err := store.FindAndDeleteState(r.Context(), code)
+	if err != nil {
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+	if stored == nil || stored.Provider != linkStartProvider {
+		http.Error(w, "invalid or expired link", http.StatusBadRequest)
+		return
+	}
+
+	state, err := startDriveLink(w, r, stored.UserID, stored.SharedDriveID)
+	if err != nil {
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, driveAuthURL(state), http.StatusFound)
+}
+
+// startDriveLink stores the state of a new drive link flow of the user, bound to a nonce so
+// only the browser it sets the cookie of can complete it, and returns the state
+func startDriveLink(w http.ResponseWriter, r *http.Request, userID primitive.ObjectID, sharedDriveID string) (string, error) {
+	state, err := randomState()
+	if err != nil {
+		return "", err
+	}
+	nonce, err := randomState()
+	if err != nil {
+		return "", err
+	}
+	if err := store.InsertOAuthState(r.Context(), &models.OAuthState{
+		State:         state,
+		UserID:        userID,
+		Provider:      "google",
+		SharedDriveID: sharedDriveID,
+		NonceHash:     hashNonce(nonce),
+	}); err != nil {
+		return "", err
+	}
+	http.SetCookie(w, stateCookie(state, nonce, int(stateCookieTTL/time.Second)))
+	return state, nil
+}
+
+// driveAuthURL is the Google consent page of a drive link flow
+func driveAuthURL(state string) string {
+	return oauthConf.AuthCodeURL(
 		state,
 		oauth2.AccessTypeOffline,
 		// Ensure Google shows consent screen so we receive a refresh_token
 		oauth2.SetAuthURLParam("prompt", "consent"),
 	)
-
-	log.Printf("Generated OAuth URL for user %s: %s", uid.Hex(), url)
-
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]string{"auth_url": url})
 }
 
 // GET /oauth2/callback?state=...&code=...
@@ -117,6 +246,12 @@ func OauthCallbackHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// The code and state must not leak through caching or the Referer of the finished page
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Referrer-Policy", "no-referrer")
+	// The nonce is single-use whatever the outcome
+	http.SetCookie(w, stateCookie(state, "", -1))
+
 	// lookup and delete state
 	stored, err := store.FindAndDeleteState(r.Context(), state)
 	if err != nil {
@@ -124,12 +259,27 @@ func OauthCallbackHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "server error", http.StatusInternalServerError)
 		return
 	}
-	if stored == nil {
+	// Sign-in and start codes are kept with the states but are no flow of their own
+	if stored == nil || stored.Provider == loginCodeProvider || stored.Provider == linkStartProvider {
 		log.Printf("Invalid or expired state: %s", state)
 		http.Error(w, "invalid or expired state", http.StatusBadRequest)
 		return
 	}
 
+	// A flow finished in a browser other than the one that started it could link someone
+	// else's Drive to the starting user's account (login CSRF)
+	if !stateNonceMatches(r, stored) {
+		log.Printf("OAuth state %s rejected: nonce cookie missing or mismatched", state)
+		http.Error(w, "oauth flow was started in another browser", http.StatusForbidden)
+		return
+	}
+
+	// Google sign-ins come back through the same callback as Drive links
+	if stored.Provider == loginProvider {
+		finishGoogleLogin(w, r, stored, code)
+		return
+	}
+
 	log.Printf("OAuth callback for user %s, exchanging code...", stored.UserID.Hex())
 
 	// exchange code for token (use request context for proper cancellation)
@@ -141,6 +291,9 @@ func OauthCallbackHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	log.Printf("Token exchange successful for user %s", stored.UserID.Hex())
+	if tok.RefreshToken == "" {
+		log.Printf("Warning: no refresh token for user %s, the account must be relinked once the access token expires", stored.UserID.Hex())
+	}
 
 	// marshal token to JSON
 	b, err := json.Marshal(tok)
@@ -150,7 +303,7 @@ func OauthCallbackHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// encrypt token
-	enc, err := encrypt(b)
+	enc, err := Encrypt(b)
 	if err != nil {
 		log.Printf("Encryption failed: %v", err)
 		http.Error(w, "encrypt failed", http.StatusInternalServerError)
@@ -160,8 +313,10 @@ func OauthCallbackHandler(w http.ResponseWriter, r *http.Request) {
 	// create DriveAccount record
 	acct := models.DriveAccount{
 		Provider:       "google",
+		AccountType:    models.DriveAccountTypeOAuth,
 		DisplayName:    "Google Drive",
 		EncryptedToken: enc,
+		SharedDriveID:  stored.SharedDriveID,
 	}
 
 	if err := store.AddDriveAccountToUser(r.Context(), stored.UserID, acct); err != nil {
@@ -171,13 +326,14 @@ func OauthCallbackHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	log.Printf("Drive account added successfully for user %s", stored.UserID.Hex())
+	audit.Record(r, models.AuditEvent{UserID: stored.UserID, Action: models.AuditDriveLinked, Detail: models.DriveAccountTypeOAuth})
 
 	// redirect to completion page
-	http.Redirect(w, r, os.Getenv("BASE_URL")+"/oauth/finished", http.StatusSeeOther)
+	http.Redirect(w, r, finishedURL(), http.StatusSeeOther)
 }
 
 // AES-GCM encrypt helper
-func encrypt(plain []byte) ([]byte, error) {
+func Encrypt(plain []byte) ([]byte, error) {
 	if len(tokenEncKey) != 32 {
 		return nil, errors.New("invalid encryption key length")
 	}
@@ -240,6 +396,35 @@ func randomState() (string, error) {
 	return fmt.Sprintf("%x", b), nil
 }
 
+// stateCookie carries the nonce of one flow to the callback. SameSite=Lax lets it ride along on
+// Google's top-level redirect back, but not on cross-site subrequests.
+func stateCookie(state, nonce string, maxAge int) *http.Cookie {
+	return &http.Cookie{
+		Name:     "oauth_nonce_" + state,
+		Value:    nonce,
+		Path:     "/oauth2/callback",
+		MaxAge:   maxAge,
+		HttpOnly: true,
+		Secure:   secureCookies,
+		SameSite: http.SameSiteLaxMode,
+	}
+}
+
+// stateNonceMatches checks the request's nonce cookie against the state. Without the cookie the
+// flow passes unless OAUTH_REQUIRE_STATE_COOKIE=true and the state has a nonce.
+func stateNonceMatches(r *http.Request, stored *models.OAuthState) bool {
+	cookie, err := r.Cookie("oauth_nonce_" + stored.State)
+	if err != nil || cookie.Value == "" {
+		return stored.NonceHash == "" || !requireStateCookie
+	}
+	return subtle.ConstantTimeCompare([]byte(hashNonce(cookie.Value)), []byte(stored.NonceHash)) == 1
+}
+
+func hashNonce(nonce string) string {
+	sum := sha256.Sum256([]byte(nonce))
+	return hex.EncodeToString(sum[:])
+}
+
 // Helper to mask sensitive strings for logging
 func maskString(s string) string {
 	if len(s) <= 8 {
@@ -250,7 +435,47 @@ func maskString(s string) string {
 
 // NewClient returns an *http.Client that automatically refreshes the Google OAuth2 token
 // using the refresh_token as needed. Use this instead of oauth2.StaticTokenSource so
-// requests keep working after access tokens expire.
-func NewClient(ctx context.Context, tok *oauth2.Token) *http.Client {
-	return oauthConf.Client(ctx, tok)
+// requests keep working after access tokens expire. onRefresh, if set, is called with
+// every token obtained through a refresh so it can be persisted.
+func NewClient(ctx context.Context, tok *oauth2.Token, onRefresh func(*oauth2.Token)) *http.Client {
+	src := oauthConf.TokenSource(ctx, tok)
+	if onRefresh != nil {
+		src = &refreshNotifier{src: src, last: tok.AccessToken, onRefresh: onRefresh}
+	}
+	return oauth2.NewClient(ctx, src)
+}
+
+// refreshNotifier reports tokens from src that differ from the last one it saw
+type refreshNotifier struct {
+	src       oauth2.TokenSource
+	onRefresh func(*oauth2.Token)
+
+	mu   sync.Mutex
+	last string // access token
+}
+
+func (n *refreshNotifier) Token() (*oauth2.Token, error) {
+	tok, err := n.src.Token()
+	if err != nil {
+		return nil, err
+	}
+	n.mu.Lock()
+	refreshed := tok.AccessToken != n.last
+	n.last = tok.AccessToken
+	n.mu.Unlock()
+	if refreshed {
+		n.onRefresh(tok)
+	}
+	return tok, nil
+}
+
+// NewServiceAccountClient returns an *http.Client authenticated with a service account key.
+// When subject is set the service account impersonates that user via domain-wide delegation.
+func NewServiceAccountClient(ctx context.Context, keyJSON []byte, subject string) (*http.Client, error) {
+	conf, err := google.JWTConfigFromJSON(keyJSON, driveScopes...)
+	if err != nil {
+		return nil, fmt.Errorf("invalid service account key: %w", err)
+	}
+	conf.Subject = subject
+	return conf.Client(ctx), nil
 }
@@ -0,0 +1,90 @@
+package oauth_test
+
+import (
+	"SE/internal/models"
+	"SE/internal/oauth"
+	"SE/internal/store/storetest"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestMain(m *testing.M) {
+	os.Exit(storetest.Run(m))
+}
+
+// setup starts a test with an empty store and the OAuth config of a server at BASE_URL
+func setup(t *testing.T) *models.User {
+	t.Helper()
+	storetest.Setup(t)
+	t.Setenv("BASE_URL", "http://localhost:8080")
+	t.Setenv("TOKEN_ENC_KEY", base64.StdEncoding.EncodeToString(make([]byte, 32)))
+	oauth.InitOAuthConfig()
+	t.Cleanup(func() { models.SetSecretCipher(nil, nil) })
+	return storetest.User(t)
+}
+
+// call runs a handler and fails the test unless it answers with status want
+func call(t *testing.T, h http.HandlerFunc, r *http.Request, want int) *httptest.ResponseRecorder {
+	t.Helper()
+	w := httptest.NewRecorder()
+	h(w, r)
+	if w.Code != want {
+		t.Fatalf("%s %s: status %d, want %d: %s", r.Method, r.URL, w.Code, want, w.Body)
+	}
+	return w
+}
+
+// startURL asks for a drive link of the user and returns its start_url
+func startURL(t *testing.T, user *models.User) string {
+	t.Helper()
+	w := call(t, oauth.DriveLinkHandler, storetest.Request("GET", "/api/drive/link", nil, user.ID), http.StatusOK)
+	var resp struct {
+		AuthURL  string `json:"auth_url"`
+		StartURL string `json:"start_url"`
+	}
+	json.NewDecoder(w.Body).Decode(&resp)
+	if resp.AuthURL == "" || !strings.HasPrefix(resp.StartURL, "http://localhost:8080/api/drive/link/start?code=") {
+		t.Fatalf("drive link response = %+v, want an auth_url and a start_url", resp)
+	}
+	return strings.TrimPrefix(resp.StartURL, "http://localhost:8080")
+}
+
+func TestDriveLinkStart(t *testing.T) {
+	user := setup(t)
+	start := startURL(t, user)
+
+	// The browser opening start_url gets the nonce cookie of the flow it is sent to Google with
+	w := call(t, oauth.DriveLinkStartHandler, httptest.NewRequest("GET", start, nil), http.StatusFound)
+	loc, err := url.Parse(w.Header().Get("Location"))
+	if err != nil || loc.Host != "accounts.google.com" {
+		t.Fatalf("start redirects to %q, want Google", w.Header().Get("Location"))
+	}
+	state := loc.Query().Get("state")
+	var nonce *http.Cookie
+	for _, c := range w.Result().Cookies() {
+		if c.Name == "oauth_nonce_"+state {
+			nonce = c
+		}
+	}
+	if state == "" || nonce == nil || nonce.Value == "" || !nonce.HttpOnly {
+		t.Fatalf("start set no nonce cookie for state %q: %v", state, w.Result().Cookies())
+	}
+
+	// The code works once
+	call(t, oauth.DriveLinkStartHandler, httptest.NewRequest("GET", start, nil), http.StatusBadRequest)
+
+	// The flow can't be finished with another browser's cookie
+	r := httptest.NewRequest("GET", "/oauth2/callback?state="+state+"&code=google-code", nil)
+	r.AddCookie(&http.Cookie{Name: nonce.Name, Value: "someone-else"})
+	call(t, oauth.OauthCallbackHandler, r, http.StatusForbidden)
+
+	// A start code is no flow of its own
+	code := strings.TrimPrefix(startURL(t, user), "/api/drive/link/start?code=")
+	call(t, oauth.OauthCallbackHandler, httptest.NewRequest("GET", "/oauth2/callback?state="+code+"&code=google-code", nil), http.StatusBadRequest)
+}
@@ -0,0 +1,44 @@
+package store
+
+import (
+	"SE/internal/models"
+	"context"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Security audit log, removed once events expire
+var auditCol *mongo.Collection
+
+func initAuditCollection(ctx context.Context) {
+	auditCol = db.Collection("audit_log")
+	_, _ = auditCol.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "user_id", Value: 1}, {Key: "_id", Value: -1}}},
+		{Keys: bson.M{"expires_at": 1}, Options: options.Index().SetExpireAfterSeconds(0)},
+	})
+}
+
+// AuditQuery selects audit events, newest first
+type AuditQuery struct {
+	UserID primitive.ObjectID // zero for every user's
+	Action string             // "" for every action
+	Since  time.Time          // zero for no lower bound
+	Until  time.Time          // zero for no upper bound
+	Before primitive.ObjectID // only events older than this one, for the next page; zero from the newest
+	Limit  int
+}
+
+// InsertAuditEvent stores an audit event
+func InsertAuditEvent(ctx context.Context, e *models.AuditEvent) error {
+	e.ID = primitive.NewObjectID()
+	return backend.InsertAuditEvent(ctx, e)
+}
+
+// ListAuditEvents returns up to query.Limit audit events matching query, newest first
+func ListAuditEvents(ctx context.Context, query AuditQuery) ([]*models.AuditEvent, error) {
+	return backend.ListAuditEvents(ctx, query)
+}
@@ -0,0 +1,252 @@
+package store
+
+import (
+	"SE/internal/models"
+	"context"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Store keeps everything the server persists: users, their drive accounts, upload sessions,
+// stored files and what hangs off them, down to the job queue and the audit log. Mongo is the
+// default, STORE_DRIVER=memory keeps them in process memory, STORE_DRIVER=sqlite in a SQLite
+// file, and Use plugs in any other.
+// Lookups return nil without an error when there is no such document.
+type Store interface {
+	UserStore
+	OAuthStateStore
+	DriveAccountStore
+	UploadSessionStore
+	StoredFileStore
+	FolderStore
+	ShareStore
+	PublicLinkStore
+	DownloadLinkStore
+	JobStore
+	InviteStore
+	RefreshTokenStore
+	AuditStore
+	DriveAPIUsageStore
+	ReportStore
+}
+
+// UserStore keeps user accounts and the settings stored on them
+type UserStore interface {
+	FindUserByEmail(ctx context.Context, email string) (*models.User, error)
+	GetUserByID(ctx context.Context, userID primitive.ObjectID) (*models.User, error)
+	// ListUsers returns all users, newest first
+	ListUsers(ctx context.Context) ([]*models.User, error)
+	// CreateUser fails if the email is taken
+	CreateUser(ctx context.Context, u *models.User) error
+	SetUserNotificationChannels(ctx context.Context, userID primitive.ObjectID, channels []models.NotificationChannel) error
+	SetUserPlacementPolicy(ctx context.Context, userID primitive.ObjectID, policy models.PlacementPolicy) error
+	SetUserPreferences(ctx context.Context, userID primitive.ObjectID, prefs models.UserPreferences) error
+	// SetUserStorageQuota unsets the quota for 0; false if there is no such user
+	SetUserStorageQuota(ctx context.Context, userID primitive.ObjectID, quota int64) (bool, error)
+	SetUserPassword(ctx context.Context, userID primitive.ObjectID, passHash []byte, tokensValidAfter time.Time) error
+	// SetUserRole returns false if there is no such user
+	SetUserRole(ctx context.Context, userID primitive.ObjectID, role string) (bool, error)
+	SetUserEmailVerified(ctx context.Context, userID primitive.ObjectID) error
+}
+
+// DriveAccountStore keeps the drive accounts linked to users
+type DriveAccountStore interface {
+	AddDriveAccountToUser(ctx context.Context, userID primitive.ObjectID, acct models.DriveAccount) error
+	// GetDriveAccountByID returns an error, not nil, if there is no such account
+	GetDriveAccountByID(ctx context.Context, accountID primitive.ObjectID) (*models.DriveAccount, error)
+	UpdateDriveAccountToken(ctx context.Context, accountID primitive.ObjectID, encryptedToken []byte, refreshedAt time.Time) error
+	// UpdateDriveAccountLabel leaves nil fields alone; false if the account isn't the user's
+	UpdateDriveAccountLabel(ctx context.Context, userID, accountID primitive.ObjectID, label, color *string) (bool, error)
+}
+
+// UploadSessionStore keeps upload sessions, from the first chunk until processing is done.
+// Methods that change a session do nothing if it doesn't exist, unless they say otherwise.
+type UploadSessionStore interface {
+	// CreateUploadSessions inserts all of sessions or none of them
+	CreateUploadSessions(ctx context.Context, sessions []*models.UploadSession) error
+	GetBatchSessions(ctx context.Context, batchID primitive.ObjectID) ([]*models.UploadSession, error)
+	GetUploadSession(ctx context.Context, sessionID primitive.ObjectID) (*models.UploadSession, error)
+	// AddSessionReceivedRange returns an error if there is no such session
+	AddSessionReceivedRange(ctx context.Context, sessionID primitive.ObjectID, r models.ByteRange) (*models.UploadSession, error)
+	CompactSessionRanges(ctx context.Context, sessionID primitive.ObjectID, seen int, merged []models.ByteRange, uploadedSize int64) error
+	UpdateSessionStatus(ctx context.Context, sessionID primitive.ObjectID, status string, progress float64, errorMsg string) error
+	// CompleteSession creates the file, or replaces it with replace, and completes the session
+	// atomically
+	CompleteSession(ctx context.Context, sessionID primitive.ObjectID, file *models.StoredFile, keyFilePath string, replace bool, completedAt time.Time) error
+	CountActiveUserSessions(ctx context.Context, userID primitive.ObjectID) (int, error)
+	GetExpiredSessions(ctx context.Context) ([]*models.UploadSession, error)
+	ListUserSessions(ctx context.Context, userID primitive.ObjectID, status string) ([]*models.UploadSession, error)
+	ListSessions(ctx context.Context, status string, limit int) ([]*models.UploadSession, error)
+	DeleteIdleUploadSession(ctx context.Context, sessionID primitive.ObjectID) (bool, error)
+	DeleteUploadSession(ctx context.Context, sessionID primitive.ObjectID) error
+	UpdateSessionFileID(ctx context.Context, sessionID, fileID primitive.ObjectID) error
+	TouchUploadSession(ctx context.Context, sessionID primitive.ObjectID) error
+	ExtendSessionExpiry(ctx context.Context, sessionID primitive.ObjectID, until time.Time, statuses []string) (*models.UploadSession, error)
+	ExtendProcessingSessions(ctx context.Context, until time.Time) (int64, error)
+	RequestSessionPause(ctx context.Context, sessionID primitive.ObjectID) (bool, error)
+	PauseSession(ctx context.Context, sessionID primitive.ObjectID, progress float64, message string) error
+	ResumeSession(ctx context.Context, sessionID primitive.ObjectID) (bool, error)
+	MarkSessionIncomplete(ctx context.Context, sessionID primitive.ObjectID, progress float64, message string, expiresAt time.Time) error
+	RepairSession(ctx context.Context, sessionID primitive.ObjectID) (bool, error)
+	GetStalledSessions(ctx context.Context, cutoff time.Time) ([]*models.UploadSession, error)
+	CountStalledSessions(ctx context.Context, cutoff time.Time) (int64, error)
+	SetSessionPlanPreview(ctx context.Context, sessionID primitive.ObjectID, preview *models.PlanPreview) error
+	SetSessionCheckpoint(ctx context.Context, sessionID primitive.ObjectID, checkpoint *models.ProcessingCheckpoint) error
+	AddCheckpointChunk(ctx context.Context, sessionID primitive.ObjectID, chunk models.ChunkMetadata) error
+	ClearSessionCheckpoint(ctx context.Context, sessionID primitive.ObjectID) error
+}
+
+// StoredFileStore keeps the records of stored files and where their chunks are
+type StoredFileStore interface {
+	// CreateStoredFile fails if a file with the same ID exists
+	CreateStoredFile(ctx context.Context, file *models.StoredFile) error
+	ReplaceStoredFile(ctx context.Context, file *models.StoredFile) error
+	GetStoredFile(ctx context.Context, fileID primitive.ObjectID) (*models.StoredFile, error)
+	ListUserStoredFiles(ctx context.Context, userID primitive.ObjectID, query StoredFileQuery) ([]*models.StoredFile, error)
+	SetStoredFileNotes(ctx context.Context, userID, fileID primitive.ObjectID, description *string, metadata map[string]string) (bool, error)
+	SetStoredFilePinned(ctx context.Context, userID, fileID primitive.ObjectID, pinned bool) (bool, error)
+	// AddStoredFileTags adds the tags an active file of userID doesn't have yet and returns all
+	// of its tags; false if no such file
+	AddStoredFileTags(ctx context.Context, userID, fileID primitive.ObjectID, tags []string) ([]string, bool, error)
+	// RemoveStoredFileTags is AddStoredFileTags the other way round
+	RemoveStoredFileTags(ctx context.Context, userID, fileID primitive.ObjectID, tags []string) ([]string, bool, error)
+	// RenameStoredFile sets the filename of an active file of userID and the path made from it
+	RenameStoredFile(ctx context.Context, userID, fileID primitive.ObjectID, filename string) (bool, error)
+	// MoveStoredFile sets the folder of an active file of userID and the path made from it
+	MoveStoredFile(ctx context.Context, userID, fileID primitive.ObjectID, folder string) (bool, error)
+	RecordStoredFileDownload(ctx context.Context, fileID primitive.ObjectID, client models.ClientInfo) error
+	ListFilesToScrub(ctx context.Context, limit int) ([]*models.StoredFile, error)
+	// TrashStoredFile marks an active or incomplete file of userID trashed; false if no such file
+	TrashStoredFile(ctx context.Context, userID, fileID primitive.ObjectID, at time.Time) (bool, error)
+	// RestoreStoredFile makes a trashed file of userID incomplete if it has missing chunks and
+	// active otherwise; false if no such file
+	RestoreStoredFile(ctx context.Context, userID, fileID primitive.ObjectID) (bool, error)
+	// ListPurgeableFiles returns up to limit trashed or deleted files deleted before cutoff,
+	// longest deleted first
+	ListPurgeableFiles(ctx context.Context, cutoff time.Time, limit int) ([]*models.StoredFile, error)
+	// PurgeStoredFile removes the record of a trashed or deleted file
+	PurgeStoredFile(ctx context.Context, fileID primitive.ObjectID) error
+	RecordChunkChecks(ctx context.Context, fileID primitive.ObjectID, checks []ChunkCheck, at time.Time) error
+}
+
+// ShareStore keeps the files owners shared with other users
+type ShareStore interface {
+	// CreateFileShare returns false if the file is already shared with the user
+	CreateFileShare(ctx context.Context, share *models.FileShare) (bool, error)
+	GetFileShare(ctx context.Context, fileID, userID primitive.ObjectID) (*models.FileShare, error)
+	// ListFileShares returns who a file is shared with, oldest share first
+	ListFileShares(ctx context.Context, fileID primitive.ObjectID) ([]*models.FileShare, error)
+	// ListUserShares returns the shares with userID, newest first
+	ListUserShares(ctx context.Context, userID primitive.ObjectID) ([]*models.FileShare, error)
+	// DeleteFileShare returns false if ownerID hasn't shared the file with userID
+	DeleteFileShare(ctx context.Context, ownerID, fileID, userID primitive.ObjectID) (bool, error)
+	DeleteFileShares(ctx context.Context, fileID primitive.ObjectID) error
+}
+
+// PublicLinkStore keeps the public links owners made to their files
+type PublicLinkStore interface {
+	CreatePublicLink(ctx context.Context, link *models.PublicLink) error
+	GetPublicLink(ctx context.Context, tokenHash string) (*models.PublicLink, error)
+	// ListPublicLinks returns the user's links, or only those to fileID unless it is zero,
+	// newest first
+	ListPublicLinks(ctx context.Context, userID, fileID primitive.ObjectID) ([]*models.PublicLink, error)
+	// UsePublicLink counts a download; false if the link is gone, expired by now or used up
+	UsePublicLink(ctx context.Context, linkID primitive.ObjectID, now time.Time) (bool, error)
+	// DeletePublicLink returns false if the user has no such link
+	DeletePublicLink(ctx context.Context, userID, linkID primitive.ObjectID) (bool, error)
+	DeleteFilePublicLinks(ctx context.Context, fileID primitive.ObjectID) error
+}
+
+// FolderStore keeps the folders users created. Folder paths are normalized, e.g. "/a/b".
+type FolderStore interface {
+	// CreateFolder returns false if the user already has a folder at its path
+	CreateFolder(ctx context.Context, folder *models.Folder) (bool, error)
+	// ListFolders returns the user's folders sorted by path
+	ListFolders(ctx context.Context, userID primitive.ObjectID) ([]*models.Folder, error)
+	// ListFileFolders returns the folders the user's active and incomplete files are in
+	ListFileFolders(ctx context.Context, userID primitive.ObjectID) ([]string, error)
+	// MoveFolder moves the folder at from, its subfolders and every file in them to to, and
+	// returns how many files moved
+	MoveFolder(ctx context.Context, userID primitive.ObjectID, from, to string) (int64, error)
+	// DeleteFolder removes the folder and its subfolders, not their files; false if there were none
+	DeleteFolder(ctx context.Context, userID primitive.ObjectID, path string) (bool, error)
+}
+
+// OAuthStateStore keeps the state of OAuth flows in progress until they come back, for up to
+// 10 minutes
+type OAuthStateStore interface {
+	InsertOAuthState(ctx context.Context, state *models.OAuthState) error
+	// FindAndDeleteState returns the state and removes it, so it is only used once
+	FindAndDeleteState(ctx context.Context, state string) (*models.OAuthState, error)
+}
+
+// DownloadLinkStore remembers used one-time download links until they expire
+type DownloadLinkStore interface {
+	// UseDownloadLink returns false if the link was used already
+	UseDownloadLink(ctx context.Context, linkID string, expiresAt time.Time) (bool, error)
+}
+
+// JobStore is the processing job queue. Jobs are leased to one worker at a time.
+type JobStore interface {
+	EnqueueJob(ctx context.Context, job *models.ProcessingJob) error
+	// ClaimJob returns nil if there is nothing to do
+	ClaimJob(ctx context.Context, owner string, lease time.Duration, fastOnly bool) (*models.ProcessingJob, error)
+	// RenewJobLease returns false if owner lost the lease
+	RenewJobLease(ctx context.Context, jobID primitive.ObjectID, owner string, lease time.Duration) (bool, error)
+	// FinishJob does nothing unless owner holds the job
+	FinishJob(ctx context.Context, jobID primitive.ObjectID, owner, status, errMsg string) error
+	GetSessionJob(ctx context.Context, sessionID primitive.ObjectID) (*models.ProcessingJob, error)
+	CountQueuedJobs(ctx context.Context) (int64, error)
+}
+
+// InviteStore keeps signup invites
+type InviteStore interface {
+	CreateInvite(ctx context.Context, inv *models.Invite) error
+	// ListInvites returns all invites, newest first
+	ListInvites(ctx context.Context) ([]*models.Invite, error)
+	DeleteInvite(ctx context.Context, inviteID primitive.ObjectID) (bool, error)
+	// RedeemInvite returns false if there is no invite with the code hash unused and unexpired at now
+	RedeemInvite(ctx context.Context, codeHash, email string, now time.Time) (bool, error)
+	ReleaseInvite(ctx context.Context, codeHash string) error
+}
+
+// RefreshTokenStore keeps rotating refresh tokens until their family expires
+type RefreshTokenStore interface {
+	CreateRefreshToken(ctx context.Context, t *models.RefreshToken) error
+	GetRefreshToken(ctx context.Context, tokenHash string) (*models.RefreshToken, error)
+	// UseRefreshToken returns nil unless the token is unused, unrevoked and unexpired at now
+	UseRefreshToken(ctx context.Context, tokenHash string, now time.Time) (*models.RefreshToken, error)
+	RevokeRefreshTokenFamily(ctx context.Context, familyID primitive.ObjectID, now time.Time) error
+	IsRefreshTokenFamilyRevoked(ctx context.Context, familyID primitive.ObjectID) (bool, error)
+	RevokeUserRefreshTokens(ctx context.Context, userID primitive.ObjectID, now time.Time) error
+	// ListActiveRefreshTokens returns the user's tokens usable at now, newest login first
+	ListActiveRefreshTokens(ctx context.Context, userID primitive.ObjectID, now time.Time) ([]*models.RefreshToken, error)
+}
+
+// AuditStore keeps the security audit log until events expire
+type AuditStore interface {
+	InsertAuditEvent(ctx context.Context, e *models.AuditEvent) error
+	ListAuditEvents(ctx context.Context, query AuditQuery) ([]*models.AuditEvent, error)
+}
+
+// DriveAPIUsageStore keeps daily Drive API call counts by account and operation
+type DriveAPIUsageStore interface {
+	AddDriveAPIUsage(ctx context.Context, deltas []models.DriveAPIUsage) error
+	GetDriveAPIUsage(ctx context.Context, day string) ([]models.DriveAPIUsage, error)
+}
+
+// ReportStore sums up stored files and upload sessions, for quotas and admin reports
+type ReportStore interface {
+	GetUserStorageUsage(ctx context.Context, userID primitive.ObjectID) (StorageUsage, error)
+	RunReport(ctx context.Context, q ReportQuery) ([]ReportRow, error)
+}
+
+// backend is the Store the package functions go through
+var backend Store = mongoStore{}
+
+// Use makes s the Store behind the package functions, e.g. a fake in a unit test, instead of
+// the one InitStore picked
+func Use(s Store) {
+	backend = s
+}
@@ -0,0 +1,26 @@
+package store
+
+import (
+	"context"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// One-time download links that have been used, kept until they expire anyway
+var usedLinksCol *mongo.Collection
+
+func initUsedLinksCollection(ctx context.Context) {
+	usedLinksCol = db.Collection("used_download_links")
+	_, _ = usedLinksCol.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.M{"expires_at": 1},
+		Options: options.Index().SetExpireAfterSeconds(0),
+	})
+}
+
+// UseDownloadLink marks the one-time download link linkID as used. Returns false if it already was.
+func UseDownloadLink(ctx context.Context, linkID string, expiresAt time.Time) (bool, error) {
+	return backend.UseDownloadLink(ctx, linkID, expiresAt)
+}
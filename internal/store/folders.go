@@ -0,0 +1,60 @@
+package store
+
+import (
+	"SE/internal/models"
+	"context"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Folders users created
+var foldersCol *mongo.Collection
+
+func initFoldersCollection(ctx context.Context) {
+	foldersCol = db.Collection("folders")
+	_, _ = foldersCol.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "user_id", Value: 1}, {Key: "path", Value: 1}},
+		Options: options.Index().SetUnique(true),
+	})
+}
+
+// CreateFolder records a folder at path for the user. Returns false if there is one already.
+func CreateFolder(ctx context.Context, userID primitive.ObjectID, path string) (*models.Folder, bool, error) {
+	folder := &models.Folder{ID: primitive.NewObjectID(), UserID: userID, Path: path, CreatedAt: time.Now().UTC()}
+	created, err := backend.CreateFolder(ctx, folder)
+	return folder, created, err
+}
+
+// ListFolders returns the folders the user created, sorted by path
+func ListFolders(ctx context.Context, userID primitive.ObjectID) ([]*models.Folder, error) {
+	return backend.ListFolders(ctx, userID)
+}
+
+// ListFileFolders returns the folders the user's active and incomplete files are in, in no
+// particular order
+func ListFileFolders(ctx context.Context, userID primitive.ObjectID) ([]string, error) {
+	return backend.ListFileFolders(ctx, userID)
+}
+
+// MoveFolder moves a folder with its subfolders and files, deleted ones included, from one
+// path to another; the caller checks that nothing is at the new path. Returns how many files
+// moved.
+func MoveFolder(ctx context.Context, userID primitive.ObjectID, from, to string) (int64, error) {
+	return backend.MoveFolder(ctx, userID, from, to)
+}
+
+// DeleteFolder removes the folder records at path and below it; files are left alone.
+// Returns false if there were none.
+func DeleteFolder(ctx context.Context, userID primitive.ObjectID, path string) (bool, error) {
+	return backend.DeleteFolder(ctx, userID, path)
+}
+
+// inFolderPath tells whether p is folder or below it, for the stores that filter in Go
+func inFolderPath(p, folder string) bool {
+	return p == folder || strings.HasPrefix(p, folder+"/")
+}
@@ -0,0 +1,51 @@
+package store
+
+import (
+	"SE/internal/models"
+	"context"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Signup invites
+var invitesCol *mongo.Collection
+
+func initInvitesCollection(ctx context.Context) {
+	invitesCol = db.Collection("invites")
+	_, _ = invitesCol.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.M{"code_hash": 1},
+		Options: options.Index().SetUnique(true),
+	})
+}
+
+// CreateInvite stores a new invite
+func CreateInvite(ctx context.Context, inv *models.Invite) error {
+	inv.ID = primitive.NewObjectID()
+	inv.CreatedAt = time.Now().UTC()
+	return backend.CreateInvite(ctx, inv)
+}
+
+// ListInvites returns all invites, newest first
+func ListInvites(ctx context.Context) ([]*models.Invite, error) {
+	return backend.ListInvites(ctx)
+}
+
+// DeleteInvite revokes an invite. Returns false if there is no such invite.
+func DeleteInvite(ctx context.Context, inviteID primitive.ObjectID) (bool, error) {
+	return backend.DeleteInvite(ctx, inviteID)
+}
+
+// RedeemInvite marks the unused, unexpired invite with the given code hash as used by email.
+// Returns false if there is no such invite.
+func RedeemInvite(ctx context.Context, codeHash, email string) (bool, error) {
+	return backend.RedeemInvite(ctx, codeHash, email, time.Now().UTC())
+}
+
+// ReleaseInvite makes a redeemed invite usable again, when the signup it was redeemed for failed
+func ReleaseInvite(ctx context.Context, codeHash string) error {
+	return backend.ReleaseInvite(ctx, codeHash)
+}
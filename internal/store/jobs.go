@@ -0,0 +1,84 @@
+package store
+
+import (
+	"SE/internal/models"
+	"context"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Processing Job Queue
+var jobsCol *mongo.Collection
+
+func initJobsCollection(ctx context.Context) {
+	jobsCol = db.Collection("processing_jobs")
+	// Workers claim by status and lease, oldest first
+	_, _ = jobsCol.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{Key: "status", Value: 1}, {Key: "lease_expires_at", Value: 1}, {Key: "created_at", Value: 1}},
+	})
+	// Fast-lane jobs first
+	_, _ = jobsCol.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{Key: "status", Value: 1}, {Key: "fast_lane", Value: -1}, {Key: "created_at", Value: 1}},
+	})
+	_, _ = jobsCol.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.M{"session_id": 1},
+	})
+}
+
+func EnqueueJob(ctx context.Context, job *models.ProcessingJob) error {
+	now := time.Now()
+	job.ID = primitive.NewObjectID()
+	job.Status = models.JobQueued
+	job.CreatedAt = now
+	job.UpdatedAt = now
+	return backend.EnqueueJob(ctx, job)
+}
+
+// ClaimJob leases the oldest queued job, or a running job whose lease has expired, to owner.
+// Fast-lane jobs go first; fastOnly claims nothing else. Returns nil if there is nothing to do.
+func ClaimJob(ctx context.Context, owner string, lease time.Duration, fastOnly bool) (*models.ProcessingJob, error) {
+	return backend.ClaimJob(ctx, owner, lease, fastOnly)
+}
+
+// RenewJobLease extends the lease if owner still holds it. Returns false if the lease was lost.
+func RenewJobLease(ctx context.Context, jobID primitive.ObjectID, owner string, lease time.Duration) (bool, error) {
+	return backend.RenewJobLease(ctx, jobID, owner, lease)
+}
+
+// renewJob extends a job's lease, for the stores that update jobs in Go
+func renewJob(lease time.Duration) func(*models.ProcessingJob) {
+	return func(j *models.ProcessingJob) {
+		j.LeaseExpiresAt = time.Now().Add(lease)
+		j.UpdatedAt = time.Now()
+	}
+}
+
+// FinishJob records the final status of a job held by owner
+func FinishJob(ctx context.Context, jobID primitive.ObjectID, owner, status, errMsg string) error {
+	return backend.FinishJob(ctx, jobID, owner, status, errMsg)
+}
+
+// finishJob records a job's final status and releases its lease, for the stores that update
+// jobs in Go
+func finishJob(status, errMsg string) func(*models.ProcessingJob) {
+	return func(j *models.ProcessingJob) {
+		j.Status = status
+		j.Error = errMsg
+		j.UpdatedAt = time.Now()
+		j.LeaseOwner = ""
+		j.LeaseExpiresAt = time.Time{}
+	}
+}
+
+// GetSessionJob returns the most recent job for a session, nil if there is none
+func GetSessionJob(ctx context.Context, sessionID primitive.ObjectID) (*models.ProcessingJob, error) {
+	return backend.GetSessionJob(ctx, sessionID)
+}
+
+// CountQueuedJobs counts jobs waiting for a worker
+func CountQueuedJobs(ctx context.Context) (int64, error) {
+	return backend.CountQueuedJobs(ctx)
+}
@@ -0,0 +1,1351 @@
+package store
+
+import (
+	"SE/internal/models"
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// oauthStateTTL mirrors the TTL index on oauth_states
+const oauthStateTTL = 600 * time.Second
+
+type usageKey struct {
+	day       string
+	accountID primitive.ObjectID
+	op        string
+}
+
+// memoryStore is the in-memory counterpart of the Mongo collections, for STORE_DRIVER=memory.
+// Documents go in and come out as copies, so callers can't change stored state without going
+// through the store. Nothing survives a restart and only one process can use it, so it is
+// meant for tests and demos.
+type memoryStore struct {
+	mu       sync.Mutex
+	users    map[primitive.ObjectID]*models.User
+	states   map[string]*models.OAuthState
+	sessions map[primitive.ObjectID]*models.UploadSession
+	files    map[primitive.ObjectID]*models.StoredFile
+	folders  map[primitive.ObjectID]*models.Folder
+	shares   map[primitive.ObjectID]*models.FileShare
+	links    map[primitive.ObjectID]*models.PublicLink
+	jobs     map[primitive.ObjectID]*models.ProcessingJob
+	usage    map[usageKey]int64
+	invites  map[primitive.ObjectID]*models.Invite
+	// refreshTokens holds refresh tokens by hash
+	refreshTokens map[string]*models.RefreshToken
+	// usedLinks holds used one-time download links by ID, with when they expire
+	usedLinks map[string]time.Time
+	// auditEvents holds the audit log, oldest first
+	auditEvents []*models.AuditEvent
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{
+		users:         make(map[primitive.ObjectID]*models.User),
+		states:        make(map[string]*models.OAuthState),
+		sessions:      make(map[primitive.ObjectID]*models.UploadSession),
+		files:         make(map[primitive.ObjectID]*models.StoredFile),
+		folders:       make(map[primitive.ObjectID]*models.Folder),
+		shares:        make(map[primitive.ObjectID]*models.FileShare),
+		links:         make(map[primitive.ObjectID]*models.PublicLink),
+		jobs:          make(map[primitive.ObjectID]*models.ProcessingJob),
+		usage:         make(map[usageKey]int64),
+		invites:       make(map[primitive.ObjectID]*models.Invite),
+		refreshTokens: make(map[string]*models.RefreshToken),
+		usedLinks:     make(map[string]time.Time),
+	}
+}
+
+// UseMemory starts a new, empty in-memory store, as STORE_DRIVER=memory does at start-up.
+// Tests call it for a clean store without Mongo; see the storetest package.
+func UseMemory() {
+	backend = newMemoryStore()
+}
+
+// NewMemoryStore returns a new, empty in-memory store, for a test to wrap in a fake and pass
+// to Use
+func NewMemoryStore() Store {
+	return newMemoryStore()
+}
+
+// clone deep-copies a document through BSON, so it reads back exactly as it would from Mongo
+func clone[T any](v *T) *T {
+	data, err := bson.Marshal(v)
+	if err != nil {
+		panic(fmt.Sprintf("store: marshal %T: %v", v, err))
+	}
+	var out T
+	if err := bson.Unmarshal(data, &out); err != nil {
+		panic(fmt.Sprintf("store: unmarshal %T: %v", v, err))
+	}
+	return &out
+}
+
+// Users
+
+func (m *memoryStore) findUserByEmail(email string) *models.User {
+	for _, u := range m.users {
+		if u.Email == email {
+			return u
+		}
+	}
+	return nil
+}
+
+func (m *memoryStore) FindUserByEmail(ctx context.Context, email string) (*models.User, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if u := m.findUserByEmail(email); u != nil {
+		return clone(u), nil
+	}
+	return nil, nil
+}
+
+func (m *memoryStore) GetUserByID(ctx context.Context, userID primitive.ObjectID) (*models.User, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if u, ok := m.users[userID]; ok {
+		return clone(u), nil
+	}
+	return nil, nil
+}
+
+func (m *memoryStore) CreateUser(ctx context.Context, u *models.User) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.findUserByEmail(u.Email) != nil {
+		return errors.New("duplicate key: email already exists")
+	}
+	m.users[u.ID] = clone(u)
+	return nil
+}
+
+func (m *memoryStore) ListUsers(ctx context.Context) ([]*models.User, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	out := make([]*models.User, 0, len(m.users))
+	for _, u := range m.users {
+		out = append(out, clone(u))
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].CreatedAt.After(out[j].CreatedAt) })
+	return out, nil
+}
+
+// updateUser applies fn to a stored user. Returns false if there is no such user.
+func (m *memoryStore) updateUser(userID primitive.ObjectID, fn func(u *models.User)) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	u, ok := m.users[userID]
+	if !ok {
+		return false
+	}
+	fn(u)
+	m.users[userID] = clone(u)
+	return true
+}
+
+func (m *memoryStore) SetUserNotificationChannels(ctx context.Context, userID primitive.ObjectID, channels []models.NotificationChannel) error {
+	m.updateUser(userID, func(u *models.User) { u.NotificationChannels = channels })
+	return nil
+}
+
+func (m *memoryStore) SetUserPlacementPolicy(ctx context.Context, userID primitive.ObjectID, policy models.PlacementPolicy) error {
+	m.updateUser(userID, func(u *models.User) { u.PlacementPolicy = &policy })
+	return nil
+}
+
+func (m *memoryStore) SetUserPreferences(ctx context.Context, userID primitive.ObjectID, prefs models.UserPreferences) error {
+	m.updateUser(userID, func(u *models.User) { u.Preferences = &prefs })
+	return nil
+}
+
+func (m *memoryStore) SetUserStorageQuota(ctx context.Context, userID primitive.ObjectID, quota int64) (bool, error) {
+	return m.updateUser(userID, func(u *models.User) { u.StorageQuota = quota }), nil
+}
+
+func (m *memoryStore) SetUserPassword(ctx context.Context, userID primitive.ObjectID, passHash []byte, tokensValidAfter time.Time) error {
+	m.updateUser(userID, func(u *models.User) {
+		u.PasswordsHash = passHash
+		u.TokensValidAfter = &tokensValidAfter
+	})
+	return nil
+}
+
+func (m *memoryStore) SetUserRole(ctx context.Context, userID primitive.ObjectID, role string) (bool, error) {
+	return m.updateUser(userID, func(u *models.User) { u.Role = role }), nil
+}
+
+func (m *memoryStore) SetUserEmailVerified(ctx context.Context, userID primitive.ObjectID) error {
+	m.updateUser(userID, func(u *models.User) { u.EmailVerified = true })
+	return nil
+}
+
+func (m *memoryStore) InsertOAuthState(ctx context.Context, state *models.OAuthState) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.states[state.State] = clone(state)
+	return nil
+}
+
+func (m *memoryStore) FindAndDeleteState(ctx context.Context, state string) (*models.OAuthState, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s, ok := m.states[state]
+	if !ok {
+		return nil, nil
+	}
+	delete(m.states, state)
+	if time.Since(s.CreatedAt) > oauthStateTTL {
+		return nil, nil
+	}
+	return s, nil
+}
+
+// Drive accounts
+
+func (m *memoryStore) AddDriveAccountToUser(ctx context.Context, userID primitive.ObjectID, acct models.DriveAccount) error {
+	m.updateUser(userID, func(u *models.User) { u.DriveAccounts = append(u.DriveAccounts, acct) })
+	return nil
+}
+
+func (m *memoryStore) GetDriveAccountByID(ctx context.Context, accountID primitive.ObjectID) (*models.DriveAccount, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, u := range m.users {
+		for _, acc := range u.DriveAccounts {
+			if acc.ID == accountID {
+				return clone(&acc), nil
+			}
+		}
+	}
+	return nil, mongo.ErrNoDocuments
+}
+
+// updateDriveAccount applies fn to a drive account of any user. Returns false if there is no such account.
+func (m *memoryStore) updateDriveAccount(accountID primitive.ObjectID, fn func(acc *models.DriveAccount)) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for id, u := range m.users {
+		for i := range u.DriveAccounts {
+			if u.DriveAccounts[i].ID == accountID {
+				fn(&u.DriveAccounts[i])
+				m.users[id] = clone(u)
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (m *memoryStore) UpdateDriveAccountToken(ctx context.Context, accountID primitive.ObjectID, encryptedToken []byte, refreshedAt time.Time) error {
+	m.updateDriveAccount(accountID, func(acc *models.DriveAccount) {
+		acc.EncryptedToken = encryptedToken
+		acc.TokenRefreshedAt = &refreshedAt
+	})
+	return nil
+}
+
+func (m *memoryStore) UpdateDriveAccountLabel(ctx context.Context, userID, accountID primitive.ObjectID, label, color *string) (bool, error) {
+	found := false
+	m.updateUser(userID, func(u *models.User) {
+		for i := range u.DriveAccounts {
+			if u.DriveAccounts[i].ID == accountID {
+				found = true
+				if label != nil {
+					u.DriveAccounts[i].Label = *label
+				}
+				if color != nil {
+					u.DriveAccounts[i].Color = *color
+				}
+			}
+		}
+	})
+	return found, nil
+}
+
+// Upload sessions
+
+func (m *memoryStore) CreateUploadSessions(ctx context.Context, sessions []*models.UploadSession) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, s := range sessions {
+		if _, ok := m.sessions[s.ID]; ok {
+			return errors.New("duplicate key: session " + s.ID.Hex())
+		}
+	}
+	for _, s := range sessions {
+		m.sessions[s.ID] = clone(s)
+	}
+	return nil
+}
+
+func (m *memoryStore) GetUploadSession(ctx context.Context, sessionID primitive.ObjectID) (*models.UploadSession, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if s, ok := m.sessions[sessionID]; ok {
+		return clone(s), nil
+	}
+	return nil, nil
+}
+
+// findSessions returns copies of the sessions matching fn, ordered by ID
+func (m *memoryStore) findSessions(fn func(s *models.UploadSession) bool) []*models.UploadSession {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	out := []*models.UploadSession{}
+	for _, s := range m.sessions {
+		if fn(s) {
+			out = append(out, clone(s))
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].ID.Hex() < out[j].ID.Hex() })
+	return out
+}
+
+// updateSession applies fn to a stored session if it matches. fn returns whether it matched;
+// the result is false when the session doesn't exist or didn't match.
+func (m *memoryStore) updateSession(sessionID primitive.ObjectID, fn func(s *models.UploadSession) bool) (*models.UploadSession, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s, ok := m.sessions[sessionID]
+	if !ok || !fn(s) {
+		return nil, false
+	}
+	m.sessions[sessionID] = clone(s)
+	return clone(s), true
+}
+
+// setSession applies fn to a stored session, if there is one
+func (m *memoryStore) setSession(sessionID primitive.ObjectID, fn func(s *models.UploadSession)) error {
+	m.updateSession(sessionID, func(s *models.UploadSession) bool {
+		fn(s)
+		return true
+	})
+	return nil
+}
+
+func (m *memoryStore) GetBatchSessions(ctx context.Context, batchID primitive.ObjectID) ([]*models.UploadSession, error) {
+	return m.findSessions(func(s *models.UploadSession) bool { return s.BatchID == batchID }), nil
+}
+
+func (m *memoryStore) AddSessionReceivedRange(ctx context.Context, sessionID primitive.ObjectID, r models.ByteRange) (*models.UploadSession, error) {
+	session, ok := m.updateSession(sessionID, func(s *models.UploadSession) bool {
+		s.ReceivedRanges = append(s.ReceivedRanges, r)
+		return true
+	})
+	if !ok {
+		return nil, mongo.ErrNoDocuments
+	}
+	return session, nil
+}
+
+func (m *memoryStore) CompactSessionRanges(ctx context.Context, sessionID primitive.ObjectID, seen int, merged []models.ByteRange, uploadedSize int64) error {
+	return m.setSession(sessionID, func(s *models.UploadSession) {
+		s.UploadedSize = max(s.UploadedSize, uploadedSize)
+		if len(s.ReceivedRanges) == seen {
+			s.ReceivedRanges = merged
+		}
+	})
+}
+
+func (m *memoryStore) UpdateSessionStatus(ctx context.Context, sessionID primitive.ObjectID, status string, progress float64, errorMsg string) error {
+	return m.setSession(sessionID, func(s *models.UploadSession) {
+		s.Status = status
+		s.ProcessingProgress = progress
+		s.UpdatedAt = time.Now()
+		if errorMsg != "" {
+			s.ErrorMessage = errorMsg
+		}
+	})
+}
+
+func (m *memoryStore) CompleteSession(ctx context.Context, sessionID primitive.ObjectID, file *models.StoredFile, keyFilePath string, replace bool, completedAt time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.files[file.ID]; ok && !replace {
+		return errors.New("duplicate key: stored file " + file.ID.Hex())
+	}
+	m.files[file.ID] = clone(file)
+	if s, ok := m.sessions[sessionID]; ok {
+		completeSession(s, file.ID, keyFilePath, completedAt)
+		m.sessions[sessionID] = clone(s)
+	}
+	return nil
+}
+
+func (m *memoryStore) CountActiveUserSessions(ctx context.Context, userID primitive.ObjectID) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	count := 0
+	batches := make(map[primitive.ObjectID]bool)
+	for _, s := range m.sessions {
+		if s.UserID != userID || (s.Status != "uploading" && s.Status != "processing" && s.Status != "paused") {
+			continue
+		}
+		// A batch counts as a single upload
+		if s.BatchID.IsZero() {
+			count++
+		} else {
+			batches[s.BatchID] = true
+		}
+	}
+	return count + len(batches), nil
+}
+
+func (m *memoryStore) GetExpiredSessions(ctx context.Context) ([]*models.UploadSession, error) {
+	now := time.Now()
+	return m.findSessions(func(s *models.UploadSession) bool {
+		return s.ExpiresAt.Before(now) && (s.Status == "uploading" || s.Status == "processing")
+	}), nil
+}
+
+func (m *memoryStore) ListUserSessions(ctx context.Context, userID primitive.ObjectID, status string) ([]*models.UploadSession, error) {
+	sessions := m.findSessions(func(s *models.UploadSession) bool {
+		return s.UserID == userID && (status == "" || s.Status == status)
+	})
+	sort.Slice(sessions, func(i, j int) bool { return sessions[i].CreatedAt.After(sessions[j].CreatedAt) })
+	return sessions, nil
+}
+
+func (m *memoryStore) ListSessions(ctx context.Context, status string, limit int) ([]*models.UploadSession, error) {
+	sessions := m.findSessions(func(s *models.UploadSession) bool {
+		return status == "" || s.Status == status
+	})
+	sort.Slice(sessions, func(i, j int) bool { return sessions[i].CreatedAt.After(sessions[j].CreatedAt) })
+	if len(sessions) > limit {
+		sessions = sessions[:limit]
+	}
+	return sessions, nil
+}
+
+func (m *memoryStore) DeleteUploadSession(ctx context.Context, sessionID primitive.ObjectID) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.sessions, sessionID)
+	return nil
+}
+
+func (m *memoryStore) DeleteIdleUploadSession(ctx context.Context, sessionID primitive.ObjectID) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s, ok := m.sessions[sessionID]
+	if !ok || s.Status == "processing" {
+		return false, nil
+	}
+	delete(m.sessions, sessionID)
+	return true, nil
+}
+
+func (m *memoryStore) UpdateSessionFileID(ctx context.Context, sessionID, fileID primitive.ObjectID) error {
+	return m.setSession(sessionID, func(s *models.UploadSession) { s.FileID = fileID })
+}
+
+func (m *memoryStore) TouchUploadSession(ctx context.Context, sessionID primitive.ObjectID) error {
+	return m.setSession(sessionID, func(s *models.UploadSession) { s.UpdatedAt = time.Now() })
+}
+
+func (m *memoryStore) ExtendSessionExpiry(ctx context.Context, sessionID primitive.ObjectID, until time.Time, statuses []string) (*models.UploadSession, error) {
+	now := time.Now()
+	session, _ := m.updateSession(sessionID, func(s *models.UploadSession) bool {
+		if !slices.Contains(statuses, s.Status) || !s.ExpiresAt.After(now) {
+			return false
+		}
+		if until.After(s.ExpiresAt) {
+			s.ExpiresAt = until
+		}
+		return true
+	})
+	return session, nil
+}
+
+func (m *memoryStore) ExtendProcessingSessions(ctx context.Context, until time.Time) (int64, error) {
+	var n int64
+	for _, s := range m.findSessions(func(s *models.UploadSession) bool {
+		return s.Status == "processing" && s.ExpiresAt.Before(until)
+	}) {
+		if _, ok := m.updateSession(s.ID, func(s *models.UploadSession) bool {
+			if s.Status != "processing" || !s.ExpiresAt.Before(until) {
+				return false
+			}
+			s.ExpiresAt = until
+			return true
+		}); ok {
+			n++
+		}
+	}
+	return n, nil
+}
+
+func (m *memoryStore) RequestSessionPause(ctx context.Context, sessionID primitive.ObjectID) (bool, error) {
+	_, ok := m.updateSession(sessionID, func(s *models.UploadSession) bool {
+		if s.Status != "processing" {
+			return false
+		}
+		s.PauseRequested = true
+		return true
+	})
+	return ok, nil
+}
+
+func (m *memoryStore) PauseSession(ctx context.Context, sessionID primitive.ObjectID, progress float64, message string) error {
+	return m.setSession(sessionID, func(s *models.UploadSession) {
+		s.Status = "paused"
+		s.ProcessingProgress = progress
+		s.ErrorMessage = message
+		s.UpdatedAt = time.Now()
+		s.PauseRequested = false
+	})
+}
+
+func (m *memoryStore) ResumeSession(ctx context.Context, sessionID primitive.ObjectID) (bool, error) {
+	_, ok := m.updateSession(sessionID, func(s *models.UploadSession) bool {
+		if s.Status != "paused" {
+			return false
+		}
+		s.Status = "processing"
+		s.ErrorMessage = "Resuming..."
+		s.UpdatedAt = time.Now()
+		s.PauseRequested = false
+		return true
+	})
+	return ok, nil
+}
+
+func (m *memoryStore) MarkSessionIncomplete(ctx context.Context, sessionID primitive.ObjectID, progress float64, message string, expiresAt time.Time) error {
+	return m.setSession(sessionID, func(s *models.UploadSession) {
+		s.Status = "incomplete"
+		s.ProcessingProgress = progress
+		s.ErrorMessage = message
+		s.UpdatedAt = time.Now()
+		s.ExpiresAt = expiresAt
+		s.PauseRequested = false
+	})
+}
+
+func (m *memoryStore) RepairSession(ctx context.Context, sessionID primitive.ObjectID) (bool, error) {
+	_, ok := m.updateSession(sessionID, func(s *models.UploadSession) bool {
+		if s.Status != "incomplete" {
+			return false
+		}
+		s.Status = "processing"
+		s.ErrorMessage = "Repairing..."
+		s.UpdatedAt = time.Now()
+		return true
+	})
+	return ok, nil
+}
+
+func (m *memoryStore) GetStalledSessions(ctx context.Context, cutoff time.Time) ([]*models.UploadSession, error) {
+	return m.findSessions(func(s *models.UploadSession) bool {
+		return s.Status == "processing" && s.UpdatedAt.Before(cutoff)
+	}), nil
+}
+
+func (m *memoryStore) CountStalledSessions(ctx context.Context, cutoff time.Time) (int64, error) {
+	stalled, _ := m.GetStalledSessions(ctx, cutoff)
+	return int64(len(stalled)), nil
+}
+
+func (m *memoryStore) SetSessionPlanPreview(ctx context.Context, sessionID primitive.ObjectID, preview *models.PlanPreview) error {
+	return m.setSession(sessionID, func(s *models.UploadSession) { s.PlanPreview = preview })
+}
+
+func (m *memoryStore) SetSessionCheckpoint(ctx context.Context, sessionID primitive.ObjectID, checkpoint *models.ProcessingCheckpoint) error {
+	return m.setSession(sessionID, func(s *models.UploadSession) { s.Checkpoint = checkpoint })
+}
+
+func (m *memoryStore) AddCheckpointChunk(ctx context.Context, sessionID primitive.ObjectID, chunk models.ChunkMetadata) error {
+	m.updateSession(sessionID, func(s *models.UploadSession) bool {
+		if s.Checkpoint == nil {
+			return false
+		}
+		s.Checkpoint.Chunks = append(s.Checkpoint.Chunks, chunk)
+		return true
+	})
+	return nil
+}
+
+func (m *memoryStore) ClearSessionCheckpoint(ctx context.Context, sessionID primitive.ObjectID) error {
+	return m.setSession(sessionID, func(s *models.UploadSession) { s.Checkpoint = nil })
+}
+
+// Stored files
+
+func (m *memoryStore) CreateStoredFile(ctx context.Context, file *models.StoredFile) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.files[file.ID]; ok {
+		return errors.New("duplicate key: stored file " + file.ID.Hex())
+	}
+	m.files[file.ID] = clone(file)
+	return nil
+}
+
+func (m *memoryStore) ReplaceStoredFile(ctx context.Context, file *models.StoredFile) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.files[file.ID] = clone(file)
+	return nil
+}
+
+func (m *memoryStore) GetStoredFile(ctx context.Context, fileID primitive.ObjectID) (*models.StoredFile, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if f, ok := m.files[fileID]; ok {
+		return clone(f), nil
+	}
+	return nil, nil
+}
+
+func (m *memoryStore) ListUserStoredFiles(ctx context.Context, userID primitive.ObjectID, query StoredFileQuery) ([]*models.StoredFile, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	files := []*models.StoredFile{}
+	for _, f := range m.files {
+		if f.UserID == userID && query.matches(f) {
+			files = append(files, clone(f))
+		}
+	}
+	return query.page(files), nil
+}
+
+// updateStoredFile applies fn to an active file owned by userID. Returns false if no such file.
+func (m *memoryStore) updateStoredFile(userID, fileID primitive.ObjectID, fn func(f *models.StoredFile)) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	f, ok := m.files[fileID]
+	if !ok || f.UserID != userID || f.Status != "active" {
+		return false
+	}
+	fn(f)
+	m.files[fileID] = clone(f)
+	return true
+}
+
+func (m *memoryStore) SetStoredFileNotes(ctx context.Context, userID, fileID primitive.ObjectID, description *string, metadata map[string]string) (bool, error) {
+	return m.updateStoredFile(userID, fileID, func(f *models.StoredFile) {
+		if description != nil {
+			f.Description = *description
+		}
+		if metadata != nil {
+			f.Metadata = metadata
+		}
+	}), nil
+}
+
+func (m *memoryStore) SetStoredFilePinned(ctx context.Context, userID, fileID primitive.ObjectID, pinned bool) (bool, error) {
+	return m.updateStoredFile(userID, fileID, func(f *models.StoredFile) { f.Pinned = pinned }), nil
+}
+
+func (m *memoryStore) RenameStoredFile(ctx context.Context, userID, fileID primitive.ObjectID, filename string) (bool, error) {
+	return m.updateStoredFile(userID, fileID, func(f *models.StoredFile) {
+		f.OriginalFilename = filename
+		f.NameLower = strings.ToLower(filename)
+		f.Path = models.FilePath(f.Folder, filename)
+	}), nil
+}
+
+func (m *memoryStore) AddStoredFileTags(ctx context.Context, userID, fileID primitive.ObjectID, tags []string) ([]string, bool, error) {
+	var out []string
+	found := m.updateStoredFile(userID, fileID, func(f *models.StoredFile) {
+		f.Tags = addTags(f.Tags, tags)
+		out = f.Tags
+	})
+	return out, found, nil
+}
+
+func (m *memoryStore) RemoveStoredFileTags(ctx context.Context, userID, fileID primitive.ObjectID, tags []string) ([]string, bool, error) {
+	var out []string
+	found := m.updateStoredFile(userID, fileID, func(f *models.StoredFile) {
+		f.Tags = removeTags(f.Tags, tags)
+		out = f.Tags
+	})
+	return out, found, nil
+}
+
+func (m *memoryStore) MoveStoredFile(ctx context.Context, userID, fileID primitive.ObjectID, folder string) (bool, error) {
+	return m.updateStoredFile(userID, fileID, func(f *models.StoredFile) {
+		f.Folder = folder
+		f.Path = models.FilePath(folder, f.OriginalFilename)
+	}), nil
+}
+
+func (m *memoryStore) RecordStoredFileDownload(ctx context.Context, fileID primitive.ObjectID, client models.ClientInfo) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if f, ok := m.files[fileID]; ok {
+		now := time.Now().UTC()
+		f.LastDownloadClient = &client
+		f.LastDownloadedAt = &now
+		m.files[fileID] = clone(f)
+	}
+	return nil
+}
+
+func (m *memoryStore) TrashStoredFile(ctx context.Context, userID, fileID primitive.ObjectID, at time.Time) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	f, ok := m.files[fileID]
+	if !ok || f.UserID != userID || (f.Status != "active" && f.Status != "incomplete") {
+		return false, nil
+	}
+	f.Status = "trashed"
+	f.DeletedAt = &at
+	m.files[fileID] = clone(f)
+	return true, nil
+}
+
+func (m *memoryStore) RestoreStoredFile(ctx context.Context, userID, fileID primitive.ObjectID) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	f, ok := m.files[fileID]
+	if !ok || f.UserID != userID || f.Status != "trashed" {
+		return false, nil
+	}
+	f.Status = restoredStatus(f)
+	f.DeletedAt = nil
+	m.files[fileID] = clone(f)
+	return true, nil
+}
+
+func (m *memoryStore) ListPurgeableFiles(ctx context.Context, cutoff time.Time, limit int) ([]*models.StoredFile, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	files := []*models.StoredFile{}
+	for _, f := range m.files {
+		if slices.Contains(purgeableStatuses, f.Status) && f.DeletedAt != nil && f.DeletedAt.Before(cutoff) {
+			files = append(files, clone(f))
+		}
+	}
+	slices.SortFunc(files, func(a, b *models.StoredFile) int { return a.DeletedAt.Compare(*b.DeletedAt) })
+	if len(files) > limit {
+		files = files[:limit]
+	}
+	return files, nil
+}
+
+func (m *memoryStore) PurgeStoredFile(ctx context.Context, fileID primitive.ObjectID) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if f, ok := m.files[fileID]; ok && slices.Contains(purgeableStatuses, f.Status) {
+		delete(m.files, fileID)
+	}
+	return nil
+}
+
+func (m *memoryStore) ListFilesToScrub(ctx context.Context, limit int) ([]*models.StoredFile, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	files := []*models.StoredFile{}
+	for _, f := range m.files {
+		if f.Status == "active" {
+			files = append(files, clone(f))
+		}
+	}
+	slices.SortFunc(files, func(a, b *models.StoredFile) int {
+		switch {
+		case a.LastScrubbedAt == nil && b.LastScrubbedAt == nil:
+			return 0
+		case a.LastScrubbedAt == nil:
+			return -1
+		case b.LastScrubbedAt == nil:
+			return 1
+		}
+		return a.LastScrubbedAt.Compare(*b.LastScrubbedAt)
+	})
+	if len(files) > limit {
+		files = files[:limit]
+	}
+	return files, nil
+}
+
+func (m *memoryStore) RecordChunkChecks(ctx context.Context, fileID primitive.ObjectID, checks []ChunkCheck, at time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	f, ok := m.files[fileID]
+	if !ok {
+		return nil
+	}
+	f.LastScrubbedAt = &at
+	for _, check := range checks {
+		for i := range f.Chunks {
+			c := &f.Chunks[i]
+			if c.ChunkID != check.ChunkID || c.DriveFileID != check.DriveFileID {
+				continue
+			}
+			c.Health = check.Health
+			c.LastCheckedAt = &at
+			if check.Health == models.ChunkOK {
+				c.LastVerifiedAt = &at
+			}
+		}
+	}
+	m.files[fileID] = clone(f)
+	return nil
+}
+
+func (m *memoryStore) GetUserStorageUsage(ctx context.Context, userID primitive.ObjectID) (StorageUsage, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var usage StorageUsage
+	for _, f := range m.files {
+		if f.UserID == userID && (f.Status == "active" || f.Status == "incomplete") {
+			usage.StoredBytes += f.OriginalSize
+			usage.StoredFiles++
+		}
+	}
+	for _, s := range m.sessions {
+		if s.UserID == userID && (s.Status == "uploading" || s.Status == "processing" || s.Status == "paused") {
+			usage.PendingBytes += s.TotalSize
+		}
+	}
+	return usage, nil
+}
+
+// Folders
+
+func (m *memoryStore) CreateFolder(ctx context.Context, folder *models.Folder) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, f := range m.folders {
+		if f.UserID == folder.UserID && f.Path == folder.Path {
+			return false, nil
+		}
+	}
+	m.folders[folder.ID] = clone(folder)
+	return true, nil
+}
+
+func (m *memoryStore) ListFolders(ctx context.Context, userID primitive.ObjectID) ([]*models.Folder, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	out := []*models.Folder{}
+	for _, f := range m.folders {
+		if f.UserID == userID {
+			out = append(out, clone(f))
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Path < out[j].Path })
+	return out, nil
+}
+
+func (m *memoryStore) ListFileFolders(ctx context.Context, userID primitive.ObjectID) ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	seen := map[string]bool{}
+	out := []string{}
+	for _, f := range m.files {
+		if f.UserID == userID && f.Folder != "" && (f.Status == "active" || f.Status == "incomplete") && !seen[f.Folder] {
+			seen[f.Folder] = true
+			out = append(out, f.Folder)
+		}
+	}
+	return out, nil
+}
+
+func (m *memoryStore) MoveFolder(ctx context.Context, userID primitive.ObjectID, from, to string) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var n int64
+	for _, f := range m.files {
+		if f.UserID == userID && inFolderPath(f.Folder, from) {
+			f.Folder = to + f.Folder[len(from):]
+			f.Path = models.FilePath(f.Folder, f.OriginalFilename)
+			n++
+		}
+	}
+	for _, f := range m.folders {
+		if f.UserID == userID && inFolderPath(f.Path, from) {
+			f.Path = to + f.Path[len(from):]
+		}
+	}
+	return n, nil
+}
+
+func (m *memoryStore) DeleteFolder(ctx context.Context, userID primitive.ObjectID, path string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	deleted := false
+	for id, f := range m.folders {
+		if f.UserID == userID && inFolderPath(f.Path, path) {
+			delete(m.folders, id)
+			deleted = true
+		}
+	}
+	return deleted, nil
+}
+
+// File shares
+
+func (m *memoryStore) CreateFileShare(ctx context.Context, share *models.FileShare) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, s := range m.shares {
+		if s.FileID == share.FileID && s.UserID == share.UserID {
+			return false, nil
+		}
+	}
+	m.shares[share.ID] = clone(share)
+	return true, nil
+}
+
+func (m *memoryStore) GetFileShare(ctx context.Context, fileID, userID primitive.ObjectID) (*models.FileShare, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, s := range m.shares {
+		if s.FileID == fileID && s.UserID == userID {
+			return clone(s), nil
+		}
+	}
+	return nil, nil
+}
+
+func (m *memoryStore) ListFileShares(ctx context.Context, fileID primitive.ObjectID) ([]*models.FileShare, error) {
+	return m.findShares(func(s *models.FileShare) bool { return s.FileID == fileID }, true), nil
+}
+
+func (m *memoryStore) ListUserShares(ctx context.Context, userID primitive.ObjectID) ([]*models.FileShare, error) {
+	return m.findShares(func(s *models.FileShare) bool { return s.UserID == userID }, false), nil
+}
+
+// findShares returns the shares match selects, sorted by when they were created
+func (m *memoryStore) findShares(match func(*models.FileShare) bool, oldestFirst bool) []*models.FileShare {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	out := []*models.FileShare{}
+	for _, s := range m.shares {
+		if match(s) {
+			out = append(out, clone(s))
+		}
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if oldestFirst {
+			return out[i].CreatedAt.Before(out[j].CreatedAt)
+		}
+		return out[i].CreatedAt.After(out[j].CreatedAt)
+	})
+	return out
+}
+
+func (m *memoryStore) DeleteFileShare(ctx context.Context, ownerID, fileID, userID primitive.ObjectID) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for id, s := range m.shares {
+		if s.OwnerID == ownerID && s.FileID == fileID && s.UserID == userID {
+			delete(m.shares, id)
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (m *memoryStore) DeleteFileShares(ctx context.Context, fileID primitive.ObjectID) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for id, s := range m.shares {
+		if s.FileID == fileID {
+			delete(m.shares, id)
+		}
+	}
+	return nil
+}
+
+// Public links
+
+func (m *memoryStore) CreatePublicLink(ctx context.Context, link *models.PublicLink) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, l := range m.links {
+		if l.TokenHash == link.TokenHash {
+			return errors.New("public link token already exists")
+		}
+	}
+	m.links[link.ID] = clone(link)
+	return nil
+}
+
+func (m *memoryStore) GetPublicLink(ctx context.Context, tokenHash string) (*models.PublicLink, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, l := range m.links {
+		if l.TokenHash == tokenHash {
+			return clone(l), nil
+		}
+	}
+	return nil, nil
+}
+
+func (m *memoryStore) ListPublicLinks(ctx context.Context, userID, fileID primitive.ObjectID) ([]*models.PublicLink, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	out := []*models.PublicLink{}
+	for _, l := range m.links {
+		if l.UserID == userID && (fileID.IsZero() || l.FileID == fileID) {
+			out = append(out, clone(l))
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].CreatedAt.After(out[j].CreatedAt) })
+	return out, nil
+}
+
+func (m *memoryStore) UsePublicLink(ctx context.Context, linkID primitive.ObjectID, now time.Time) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	l, ok := m.links[linkID]
+	if !ok || !publicLinkUsable(l, now) {
+		return false, nil
+	}
+	l.Downloads++
+	return true, nil
+}
+
+func (m *memoryStore) DeletePublicLink(ctx context.Context, userID, linkID primitive.ObjectID) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	l, ok := m.links[linkID]
+	if !ok || l.UserID != userID {
+		return false, nil
+	}
+	delete(m.links, linkID)
+	return true, nil
+}
+
+func (m *memoryStore) DeleteFilePublicLinks(ctx context.Context, fileID primitive.ObjectID) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for id, l := range m.links {
+		if l.FileID == fileID {
+			delete(m.links, id)
+		}
+	}
+	return nil
+}
+
+// Drive API usage
+
+func (m *memoryStore) AddDriveAPIUsage(ctx context.Context, deltas []models.DriveAPIUsage) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, d := range deltas {
+		m.usage[usageKey{d.Day, d.AccountID, d.Operation}] += d.Count
+	}
+	return nil
+}
+
+func (m *memoryStore) GetDriveAPIUsage(ctx context.Context, day string) ([]models.DriveAPIUsage, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	usage := []models.DriveAPIUsage{}
+	for k, n := range m.usage {
+		if k.day == day {
+			usage = append(usage, models.DriveAPIUsage{Day: k.day, AccountID: k.accountID, Operation: k.op, Count: n})
+		}
+	}
+	return usage, nil
+}
+
+// Invites
+
+func (m *memoryStore) CreateInvite(ctx context.Context, inv *models.Invite) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.invites[inv.ID] = clone(inv)
+	return nil
+}
+
+func (m *memoryStore) ListInvites(ctx context.Context) ([]*models.Invite, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	out := make([]*models.Invite, 0, len(m.invites))
+	for _, inv := range m.invites {
+		out = append(out, clone(inv))
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].CreatedAt.After(out[j].CreatedAt) })
+	return out, nil
+}
+
+func (m *memoryStore) DeleteInvite(ctx context.Context, inviteID primitive.ObjectID) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.invites[inviteID]; !ok {
+		return false, nil
+	}
+	delete(m.invites, inviteID)
+	return true, nil
+}
+
+func (m *memoryStore) RedeemInvite(ctx context.Context, codeHash, email string, now time.Time) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, inv := range m.invites {
+		if inv.CodeHash != codeHash {
+			continue
+		}
+		if inv.UsedAt != nil || (inv.ExpiresAt != nil && !inv.ExpiresAt.After(now)) {
+			return false, nil
+		}
+		inv.UsedBy = email
+		inv.UsedAt = &now
+		return true, nil
+	}
+	return false, nil
+}
+
+func (m *memoryStore) ReleaseInvite(ctx context.Context, codeHash string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, inv := range m.invites {
+		if inv.CodeHash == codeHash {
+			inv.UsedBy = ""
+			inv.UsedAt = nil
+		}
+	}
+	return nil
+}
+
+// Refresh tokens
+
+func (m *memoryStore) CreateRefreshToken(ctx context.Context, t *models.RefreshToken) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.refreshTokens[t.TokenHash] = clone(t)
+	return nil
+}
+
+func (m *memoryStore) GetRefreshToken(ctx context.Context, tokenHash string) (*models.RefreshToken, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	t, ok := m.refreshTokens[tokenHash]
+	if !ok {
+		return nil, nil
+	}
+	return clone(t), nil
+}
+
+func (m *memoryStore) UseRefreshToken(ctx context.Context, tokenHash string, now time.Time) (*models.RefreshToken, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	// Expired tokens are dropped like the TTL index does
+	for hash, t := range m.refreshTokens {
+		if !t.ExpiresAt.After(now) {
+			delete(m.refreshTokens, hash)
+		}
+	}
+	t, ok := m.refreshTokens[tokenHash]
+	if !ok || t.UsedAt != nil || t.RevokedAt != nil {
+		return nil, nil
+	}
+	t.UsedAt = &now
+	return clone(t), nil
+}
+
+func (m *memoryStore) RevokeRefreshTokenFamily(ctx context.Context, familyID primitive.ObjectID, now time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, t := range m.refreshTokens {
+		if t.FamilyID == familyID && t.RevokedAt == nil {
+			t.RevokedAt = &now
+		}
+	}
+	return nil
+}
+
+func (m *memoryStore) IsRefreshTokenFamilyRevoked(ctx context.Context, familyID primitive.ObjectID) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, t := range m.refreshTokens {
+		if t.FamilyID == familyID && t.RevokedAt != nil {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (m *memoryStore) RevokeUserRefreshTokens(ctx context.Context, userID primitive.ObjectID, now time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, t := range m.refreshTokens {
+		if t.UserID == userID && t.RevokedAt == nil {
+			t.RevokedAt = &now
+		}
+	}
+	return nil
+}
+
+func (m *memoryStore) ListActiveRefreshTokens(ctx context.Context, userID primitive.ObjectID, now time.Time) ([]*models.RefreshToken, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	tokens := []*models.RefreshToken{}
+	for _, t := range m.refreshTokens {
+		if t.UserID == userID && t.UsedAt == nil && t.RevokedAt == nil && t.ExpiresAt.After(now) {
+			tokens = append(tokens, clone(t))
+		}
+	}
+	sort.Slice(tokens, func(i, j int) bool { return tokens[i].LoginAt.After(tokens[j].LoginAt) })
+	return tokens, nil
+}
+
+// Audit log
+
+func (m *memoryStore) InsertAuditEvent(ctx context.Context, e *models.AuditEvent) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	// Expired events are dropped like the TTL index does
+	now := time.Now()
+	m.auditEvents = slices.DeleteFunc(m.auditEvents, func(e *models.AuditEvent) bool { return !e.ExpiresAt.After(now) })
+	m.auditEvents = append(m.auditEvents, clone(e))
+	return nil
+}
+
+func (m *memoryStore) ListAuditEvents(ctx context.Context, query AuditQuery) ([]*models.AuditEvent, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	out := []*models.AuditEvent{}
+	for i := len(m.auditEvents) - 1; i >= 0 && len(out) < query.Limit; i-- {
+		e := m.auditEvents[i]
+		if (!query.UserID.IsZero() && e.UserID != query.UserID) ||
+			(query.Action != "" && e.Action != query.Action) ||
+			(!query.Before.IsZero() && e.ID.Hex() >= query.Before.Hex()) ||
+			(!query.Since.IsZero() && e.CreatedAt.Before(query.Since)) ||
+			(!query.Until.IsZero() && !e.CreatedAt.Before(query.Until)) {
+			continue
+		}
+		out = append(out, clone(e))
+	}
+	return out, nil
+}
+
+// Processing jobs
+
+func (m *memoryStore) EnqueueJob(ctx context.Context, job *models.ProcessingJob) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.jobs[job.ID] = clone(job)
+	return nil
+}
+
+func (m *memoryStore) ClaimJob(ctx context.Context, owner string, lease time.Duration, fastOnly bool) (*models.ProcessingJob, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	var next *models.ProcessingJob
+	for _, j := range m.jobs {
+		claimable := j.Status == models.JobQueued || (j.Status == models.JobRunning && j.LeaseExpiresAt.Before(now))
+		if !claimable || (fastOnly && !j.FastLane) {
+			continue
+		}
+		if next == nil || (j.FastLane && !next.FastLane) || (j.FastLane == next.FastLane && j.CreatedAt.Before(next.CreatedAt)) {
+			next = j
+		}
+	}
+	if next == nil {
+		return nil, nil
+	}
+	next.Status = models.JobRunning
+	next.LeaseOwner = owner
+	next.LeaseExpiresAt = now.Add(lease)
+	next.UpdatedAt = now
+	next.Attempts++
+	m.jobs[next.ID] = clone(next)
+	return clone(next), nil
+}
+
+func (m *memoryStore) RenewJobLease(ctx context.Context, jobID primitive.ObjectID, owner string, lease time.Duration) (bool, error) {
+	return m.updateJob(jobID, owner, true, renewJob(lease)), nil
+}
+
+func (m *memoryStore) FinishJob(ctx context.Context, jobID primitive.ObjectID, owner, status, errMsg string) error {
+	m.updateJob(jobID, owner, false, finishJob(status, errMsg))
+	return nil
+}
+
+// updateJob applies fn to a job held by owner. Returns false if the job or lease is gone.
+func (m *memoryStore) updateJob(jobID primitive.ObjectID, owner string, running bool, fn func(j *models.ProcessingJob)) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	j, ok := m.jobs[jobID]
+	if !ok || j.LeaseOwner != owner || (running && j.Status != models.JobRunning) {
+		return false
+	}
+	fn(j)
+	m.jobs[jobID] = clone(j)
+	return true
+}
+
+func (m *memoryStore) CountQueuedJobs(ctx context.Context) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var n int64
+	for _, j := range m.jobs {
+		if j.Status == models.JobQueued {
+			n++
+		}
+	}
+	return n, nil
+}
+
+func (m *memoryStore) GetSessionJob(ctx context.Context, sessionID primitive.ObjectID) (*models.ProcessingJob, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var latest *models.ProcessingJob
+	for _, j := range m.jobs {
+		if j.SessionID == sessionID && (latest == nil || j.CreatedAt.After(latest.CreatedAt)) {
+			latest = j
+		}
+	}
+	if latest == nil {
+		return nil, nil
+	}
+	return clone(latest), nil
+}
+
+// Reports
+
+func (m *memoryStore) RunReport(ctx context.Context, q ReportQuery) ([]ReportRow, error) {
+	m.mu.Lock()
+	var docs []reportDoc
+	switch q.Source {
+	case ReportStoredFiles:
+		for _, f := range m.files {
+			docs = append(docs, reportDoc{f.UserID, f.Status, f.CreatedAt, f.OriginalSize, f.Chunks})
+		}
+	case ReportSessions:
+		for _, s := range m.sessions {
+			docs = append(docs, reportDoc{s.UserID, s.Status, s.CreatedAt, s.TotalSize, nil})
+		}
+	default:
+		m.mu.Unlock()
+		return nil, fmt.Errorf("%w: unknown source %q", ErrInvalidReport, q.Source)
+	}
+	m.mu.Unlock()
+	return buildReport(q, docs)
+}
+
+// Download links
+
+func (m *memoryStore) UseDownloadLink(ctx context.Context, linkID string, expiresAt time.Time) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	// Expired links are dropped like the TTL index does
+	for id, exp := range m.usedLinks {
+		if !exp.After(now) {
+			delete(m.usedLinks, id)
+		}
+	}
+	if _, used := m.usedLinks[linkID]; used {
+		return false, nil
+	}
+	m.usedLinks[linkID] = expiresAt
+	return true, nil
+}
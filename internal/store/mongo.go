@@ -0,0 +1,1649 @@
+package store
+
+import (
+	"SE/internal/models"
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// mongoStore is the Store on the users, upload_sessions and stored_files collections
+type mongoStore struct{}
+
+// Users
+
+func (mongoStore) FindUserByEmail(ctx context.Context, email string) (*models.User, error) {
+	if usersCol == nil {
+		return nil, errors.New("users collection not initialized")
+	}
+	var u models.User
+	err := usersCol.FindOne(ctx, bson.M{"email": email}).Decode(&u)
+	if err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &u, nil
+}
+
+func (mongoStore) GetUserByID(ctx context.Context, userID primitive.ObjectID) (*models.User, error) {
+	if usersCol == nil {
+		return nil, errors.New("users collection not initialized")
+	}
+	var u models.User
+	err := usersCol.FindOne(ctx, bson.M{"_id": userID}).Decode(&u)
+	if err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &u, nil
+}
+
+func (mongoStore) ListUsers(ctx context.Context) ([]*models.User, error) {
+	if usersCol == nil {
+		return nil, errors.New("users collection not initialized")
+	}
+	cursor, err := usersCol.Find(ctx, bson.M{}, options.Find().SetSort(bson.M{"created_at": -1}))
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	users := []*models.User{}
+	if err := cursor.All(ctx, &users); err != nil {
+		return nil, err
+	}
+	return users, nil
+}
+
+func (mongoStore) CreateUser(ctx context.Context, u *models.User) error {
+	if usersCol == nil {
+		return errors.New("users collection not initialized")
+	}
+	_, err := usersCol.InsertOne(ctx, u)
+	return err
+}
+
+// setUserField sets one field of a user
+func (mongoStore) setUserField(ctx context.Context, userID primitive.ObjectID, field string, value interface{}) error {
+	if usersCol == nil {
+		return errors.New("users collection not initialized")
+	}
+	_, err := usersCol.UpdateOne(ctx, bson.M{"_id": userID}, bson.M{"$set": bson.M{field: value}})
+	return err
+}
+
+func (s mongoStore) SetUserNotificationChannels(ctx context.Context, userID primitive.ObjectID, channels []models.NotificationChannel) error {
+	return s.setUserField(ctx, userID, "notification_channels", channels)
+}
+
+func (s mongoStore) SetUserPlacementPolicy(ctx context.Context, userID primitive.ObjectID, policy models.PlacementPolicy) error {
+	return s.setUserField(ctx, userID, "placement_policy", policy)
+}
+
+func (s mongoStore) SetUserPreferences(ctx context.Context, userID primitive.ObjectID, prefs models.UserPreferences) error {
+	return s.setUserField(ctx, userID, "preferences", prefs)
+}
+
+func (mongoStore) SetUserStorageQuota(ctx context.Context, userID primitive.ObjectID, quota int64) (bool, error) {
+	if usersCol == nil {
+		return false, errors.New("users collection not initialized")
+	}
+	update := bson.M{"$set": bson.M{"storage_quota": quota}}
+	if quota == 0 {
+		update = bson.M{"$unset": bson.M{"storage_quota": ""}}
+	}
+	res, err := usersCol.UpdateOne(ctx, bson.M{"_id": userID}, update)
+	if err != nil {
+		return false, err
+	}
+	return res.MatchedCount > 0, nil
+}
+
+func (mongoStore) SetUserPassword(ctx context.Context, userID primitive.ObjectID, passHash []byte, tokensValidAfter time.Time) error {
+	if usersCol == nil {
+		return errors.New("users collection not initialized")
+	}
+	_, err := usersCol.UpdateOne(ctx, bson.M{"_id": userID}, bson.M{"$set": bson.M{
+		"passwords_hash":     passHash,
+		"tokens_valid_after": tokensValidAfter,
+	}})
+	return err
+}
+
+func (mongoStore) SetUserRole(ctx context.Context, userID primitive.ObjectID, role string) (bool, error) {
+	if usersCol == nil {
+		return false, errors.New("users collection not initialized")
+	}
+	res, err := usersCol.UpdateOne(ctx, bson.M{"_id": userID}, bson.M{"$set": bson.M{"role": role}})
+	if err != nil {
+		return false, err
+	}
+	return res.MatchedCount > 0, nil
+}
+
+func (mongoStore) SetUserEmailVerified(ctx context.Context, userID primitive.ObjectID) error {
+	if usersCol == nil {
+		return errors.New("users collection not initialized")
+	}
+	_, err := usersCol.UpdateOne(ctx, bson.M{"_id": userID}, bson.M{"$set": bson.M{"email_verified": true}})
+	return err
+}
+
+// Drive accounts, kept in their user's document
+
+func (mongoStore) AddDriveAccountToUser(ctx context.Context, userID primitive.ObjectID, acct models.DriveAccount) error {
+	if usersCol == nil {
+		return errors.New("users collection not initialized")
+	}
+	_, err := usersCol.UpdateOne(ctx, bson.M{"_id": userID}, bson.M{"$push": bson.M{"drive_accounts": acct}})
+	return err
+}
+
+func (mongoStore) GetDriveAccountByID(ctx context.Context, accountID primitive.ObjectID) (*models.DriveAccount, error) {
+	if usersCol == nil {
+		return nil, errors.New("users collection not initialized")
+	}
+	var u models.User
+	err := usersCol.FindOne(ctx, bson.M{"drive_accounts._id": accountID}).Decode(&u)
+	if err != nil {
+		return nil, err
+	}
+	for _, acc := range u.DriveAccounts {
+		if acc.ID == accountID {
+			return &acc, nil
+		}
+	}
+	return nil, errors.New("account not found")
+}
+
+func (mongoStore) UpdateDriveAccountToken(ctx context.Context, accountID primitive.ObjectID, encryptedToken []byte, refreshedAt time.Time) error {
+	if usersCol == nil {
+		return errors.New("users collection not initialized")
+	}
+	_, err := usersCol.UpdateOne(ctx,
+		bson.M{"drive_accounts._id": accountID},
+		bson.M{"$set": bson.M{
+			"drive_accounts.$.encrypted_token":    encryptedToken,
+			"drive_accounts.$.token_refreshed_at": refreshedAt,
+		}},
+	)
+	return err
+}
+
+func (mongoStore) UpdateDriveAccountLabel(ctx context.Context, userID, accountID primitive.ObjectID, label, color *string) (bool, error) {
+	if usersCol == nil {
+		return false, errors.New("users collection not initialized")
+	}
+	set := bson.M{}
+	if label != nil {
+		set["drive_accounts.$.label"] = *label
+	}
+	if color != nil {
+		set["drive_accounts.$.color"] = *color
+	}
+	filter := bson.M{"_id": userID, "drive_accounts._id": accountID}
+	if len(set) == 0 {
+		n, err := usersCol.CountDocuments(ctx, filter)
+		return n > 0, err
+	}
+	res, err := usersCol.UpdateOne(ctx, filter, bson.M{"$set": set})
+	if err != nil {
+		return false, err
+	}
+	return res.MatchedCount > 0, nil
+}
+
+// Upload sessions
+
+func (mongoStore) CreateUploadSessions(ctx context.Context, sessions []*models.UploadSession) error {
+	if sessionsCol == nil {
+		return errors.New("sessions collection not initialized")
+	}
+	docs := make([]interface{}, len(sessions))
+	for i, s := range sessions {
+		docs[i] = s
+	}
+	_, err := sessionsCol.InsertMany(ctx, docs)
+	return err
+}
+
+// findSessions returns the sessions matching filter
+func (mongoStore) findSessions(ctx context.Context, filter bson.M, opts ...*options.FindOptions) ([]*models.UploadSession, error) {
+	if sessionsCol == nil {
+		return nil, errors.New("sessions collection not initialized")
+	}
+	cursor, err := sessionsCol.Find(ctx, filter, opts...)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	sessions := []*models.UploadSession{}
+	if err := cursor.All(ctx, &sessions); err != nil {
+		return nil, err
+	}
+	return sessions, nil
+}
+
+// updateSession applies update to the sessions matching filter, and reports whether one matched
+func (mongoStore) updateSession(ctx context.Context, filter, update bson.M) (bool, error) {
+	if sessionsCol == nil {
+		return false, errors.New("sessions collection not initialized")
+	}
+	res, err := sessionsCol.UpdateOne(ctx, filter, update)
+	if err != nil {
+		return false, err
+	}
+	return res.MatchedCount > 0, nil
+}
+
+// setSession sets fields of a session
+func (s mongoStore) setSession(ctx context.Context, sessionID primitive.ObjectID, set bson.M) error {
+	_, err := s.updateSession(ctx, bson.M{"_id": sessionID}, bson.M{"$set": set})
+	return err
+}
+
+func (s mongoStore) GetBatchSessions(ctx context.Context, batchID primitive.ObjectID) ([]*models.UploadSession, error) {
+	return s.findSessions(ctx, bson.M{"batch_id": batchID}, options.Find().SetSort(bson.D{{Key: "_id", Value: 1}}))
+}
+
+func (mongoStore) GetUploadSession(ctx context.Context, sessionID primitive.ObjectID) (*models.UploadSession, error) {
+	if sessionsCol == nil {
+		return nil, errors.New("sessions collection not initialized")
+	}
+	var session models.UploadSession
+	err := sessionsCol.FindOne(ctx, bson.M{"_id": sessionID}).Decode(&session)
+	if err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &session, nil
+}
+
+func (mongoStore) AddSessionReceivedRange(ctx context.Context, sessionID primitive.ObjectID, r models.ByteRange) (*models.UploadSession, error) {
+	if sessionsCol == nil {
+		return nil, errors.New("sessions collection not initialized")
+	}
+	var session models.UploadSession
+	err := sessionsCol.FindOneAndUpdate(ctx,
+		bson.M{"_id": sessionID},
+		bson.M{"$push": bson.M{"received_ranges": r}},
+		options.FindOneAndUpdate().SetReturnDocument(options.After),
+	).Decode(&session)
+	if err != nil {
+		return nil, err
+	}
+	return &session, nil
+}
+
+func (s mongoStore) CompactSessionRanges(ctx context.Context, sessionID primitive.ObjectID, seen int, merged []models.ByteRange, uploadedSize int64) error {
+	_, err := s.updateSession(ctx, bson.M{"_id": sessionID}, bson.M{"$max": bson.M{"uploaded_size": uploadedSize}})
+	if err != nil || len(merged) == seen {
+		return err
+	}
+	_, err = s.updateSession(ctx,
+		bson.M{"_id": sessionID, "received_ranges": bson.M{"$size": seen}},
+		bson.M{"$set": bson.M{"received_ranges": merged}},
+	)
+	return err
+}
+
+func (s mongoStore) UpdateSessionStatus(ctx context.Context, sessionID primitive.ObjectID, status string, progress float64, errorMsg string) error {
+	set := bson.M{
+		"status":              status,
+		"processing_progress": progress,
+		"updated_at":          time.Now(),
+	}
+	if errorMsg != "" {
+		set["error_message"] = errorMsg
+	}
+	return s.setSession(ctx, sessionID, set)
+}
+
+func (s mongoStore) CompleteSession(ctx context.Context, sessionID primitive.ObjectID, file *models.StoredFile, keyFilePath string, replace bool, completedAt time.Time) error {
+	write := func(ctx context.Context) error {
+		var err error
+		if replace {
+			err = s.ReplaceStoredFile(ctx, file)
+		} else {
+			err = s.CreateStoredFile(ctx, file)
+		}
+		if err != nil {
+			return err
+		}
+		_, err = s.updateSession(ctx, bson.M{"_id": sessionID}, bson.M{
+			"$set": bson.M{
+				"status":              "complete",
+				"processing_progress": 100,
+				"updated_at":          completedAt,
+				"completed_at":        completedAt,
+				"file_id":             file.ID,
+				"key_file_path":       models.Secret(keyFilePath),
+			},
+			"$unset": bson.M{"checkpoint": ""},
+		})
+		return err
+	}
+	if !mongoTransactions {
+		return write(ctx)
+	}
+	session, err := mongoClient.StartSession()
+	if err != nil {
+		return err
+	}
+	defer session.EndSession(ctx)
+	_, err = session.WithTransaction(ctx, func(sc mongo.SessionContext) (interface{}, error) {
+		return nil, write(sc)
+	})
+	return err
+}
+
+func (mongoStore) CountActiveUserSessions(ctx context.Context, userID primitive.ObjectID) (int, error) {
+	if sessionsCol == nil {
+		return 0, errors.New("sessions collection not initialized")
+	}
+	active := bson.M{
+		"user_id": userID,
+		"status":  bson.M{"$in": []string{"uploading", "processing", "paused"}},
+	}
+	// A batch counts as a single upload
+	single := bson.M{"batch_id": bson.M{"$exists": false}}
+	for k, v := range active {
+		single[k] = v
+	}
+	count, err := sessionsCol.CountDocuments(ctx, single)
+	if err != nil {
+		return 0, err
+	}
+	active["batch_id"] = bson.M{"$exists": true}
+	batches, err := sessionsCol.Distinct(ctx, "batch_id", active)
+	if err != nil {
+		return 0, err
+	}
+	return int(count) + len(batches), nil
+}
+
+func (s mongoStore) GetExpiredSessions(ctx context.Context) ([]*models.UploadSession, error) {
+	return s.findSessions(ctx, bson.M{
+		"expires_at": bson.M{"$lt": time.Now()},
+		"status":     bson.M{"$in": []string{"uploading", "processing"}},
+	})
+}
+
+func (s mongoStore) ListUserSessions(ctx context.Context, userID primitive.ObjectID, status string) ([]*models.UploadSession, error) {
+	filter := bson.M{"user_id": userID}
+	if status != "" {
+		filter["status"] = status
+	}
+	return s.findSessions(ctx, filter, options.Find().SetSort(bson.M{"created_at": -1}))
+}
+
+func (s mongoStore) ListSessions(ctx context.Context, status string, limit int) ([]*models.UploadSession, error) {
+	filter := bson.M{}
+	if status != "" {
+		filter["status"] = status
+	}
+	return s.findSessions(ctx, filter, options.Find().SetSort(bson.M{"created_at": -1}).SetLimit(int64(limit)))
+}
+
+func (mongoStore) DeleteIdleUploadSession(ctx context.Context, sessionID primitive.ObjectID) (bool, error) {
+	if sessionsCol == nil {
+		return false, errors.New("sessions collection not initialized")
+	}
+	res, err := sessionsCol.DeleteOne(ctx, bson.M{"_id": sessionID, "status": bson.M{"$ne": "processing"}})
+	if err != nil {
+		return false, err
+	}
+	return res.DeletedCount > 0, nil
+}
+
+func (mongoStore) DeleteUploadSession(ctx context.Context, sessionID primitive.ObjectID) error {
+	if sessionsCol == nil {
+		return errors.New("sessions collection not initialized")
+	}
+	_, err := sessionsCol.DeleteOne(ctx, bson.M{"_id": sessionID})
+	return err
+}
+
+func (s mongoStore) UpdateSessionFileID(ctx context.Context, sessionID, fileID primitive.ObjectID) error {
+	return s.setSession(ctx, sessionID, bson.M{"file_id": fileID})
+}
+
+func (s mongoStore) TouchUploadSession(ctx context.Context, sessionID primitive.ObjectID) error {
+	return s.setSession(ctx, sessionID, bson.M{"updated_at": time.Now()})
+}
+
+func (mongoStore) ExtendSessionExpiry(ctx context.Context, sessionID primitive.ObjectID, until time.Time, statuses []string) (*models.UploadSession, error) {
+	if sessionsCol == nil {
+		return nil, errors.New("sessions collection not initialized")
+	}
+	var session models.UploadSession
+	err := sessionsCol.FindOneAndUpdate(ctx,
+		bson.M{
+			"_id":        sessionID,
+			"status":     bson.M{"$in": statuses},
+			"expires_at": bson.M{"$gt": time.Now()},
+		},
+		bson.M{"$max": bson.M{"expires_at": until}},
+		options.FindOneAndUpdate().SetReturnDocument(options.After),
+	).Decode(&session)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &session, nil
+}
+
+func (mongoStore) ExtendProcessingSessions(ctx context.Context, until time.Time) (int64, error) {
+	if sessionsCol == nil {
+		return 0, errors.New("sessions collection not initialized")
+	}
+	res, err := sessionsCol.UpdateMany(ctx,
+		bson.M{"status": "processing", "expires_at": bson.M{"$lt": until}},
+		bson.M{"$set": bson.M{"expires_at": until}},
+	)
+	if err != nil {
+		return 0, err
+	}
+	return res.ModifiedCount, nil
+}
+
+func (s mongoStore) RequestSessionPause(ctx context.Context, sessionID primitive.ObjectID) (bool, error) {
+	return s.updateSession(ctx,
+		bson.M{"_id": sessionID, "status": "processing"},
+		bson.M{"$set": bson.M{"pause_requested": true}},
+	)
+}
+
+func (s mongoStore) PauseSession(ctx context.Context, sessionID primitive.ObjectID, progress float64, message string) error {
+	_, err := s.updateSession(ctx,
+		bson.M{"_id": sessionID},
+		bson.M{
+			"$set": bson.M{
+				"status":              "paused",
+				"processing_progress": progress,
+				"error_message":       message,
+				"updated_at":          time.Now(),
+			},
+			"$unset": bson.M{"pause_requested": ""},
+		},
+	)
+	return err
+}
+
+func (s mongoStore) ResumeSession(ctx context.Context, sessionID primitive.ObjectID) (bool, error) {
+	return s.updateSession(ctx,
+		bson.M{"_id": sessionID, "status": "paused"},
+		bson.M{
+			"$set":   bson.M{"status": "processing", "error_message": "Resuming...", "updated_at": time.Now()},
+			"$unset": bson.M{"pause_requested": ""},
+		},
+	)
+}
+
+func (s mongoStore) MarkSessionIncomplete(ctx context.Context, sessionID primitive.ObjectID, progress float64, message string, expiresAt time.Time) error {
+	_, err := s.updateSession(ctx,
+		bson.M{"_id": sessionID},
+		bson.M{
+			"$set": bson.M{
+				"status":              "incomplete",
+				"processing_progress": progress,
+				"error_message":       message,
+				"updated_at":          time.Now(),
+				"expires_at":          expiresAt,
+			},
+			"$unset": bson.M{"pause_requested": ""},
+		},
+	)
+	return err
+}
+
+func (s mongoStore) RepairSession(ctx context.Context, sessionID primitive.ObjectID) (bool, error) {
+	return s.updateSession(ctx,
+		bson.M{"_id": sessionID, "status": "incomplete"},
+		bson.M{"$set": bson.M{"status": "processing", "error_message": "Repairing...", "updated_at": time.Now()}},
+	)
+}
+
+func (s mongoStore) GetStalledSessions(ctx context.Context, cutoff time.Time) ([]*models.UploadSession, error) {
+	return s.findSessions(ctx, bson.M{
+		"status":     "processing",
+		"updated_at": bson.M{"$lt": cutoff},
+	})
+}
+
+func (mongoStore) CountStalledSessions(ctx context.Context, cutoff time.Time) (int64, error) {
+	if sessionsCol == nil {
+		return 0, errors.New("sessions collection not initialized")
+	}
+	return sessionsCol.CountDocuments(ctx, bson.M{
+		"status":     "processing",
+		"updated_at": bson.M{"$lt": cutoff},
+	})
+}
+
+func (s mongoStore) SetSessionPlanPreview(ctx context.Context, sessionID primitive.ObjectID, preview *models.PlanPreview) error {
+	return s.setSession(ctx, sessionID, bson.M{"plan_preview": preview})
+}
+
+func (s mongoStore) SetSessionCheckpoint(ctx context.Context, sessionID primitive.ObjectID, checkpoint *models.ProcessingCheckpoint) error {
+	return s.setSession(ctx, sessionID, bson.M{"checkpoint": checkpoint})
+}
+
+func (s mongoStore) AddCheckpointChunk(ctx context.Context, sessionID primitive.ObjectID, chunk models.ChunkMetadata) error {
+	_, err := s.updateSession(ctx,
+		bson.M{"_id": sessionID, "checkpoint": bson.M{"$exists": true}},
+		bson.M{"$push": bson.M{"checkpoint.chunks": chunk}},
+	)
+	return err
+}
+
+func (s mongoStore) ClearSessionCheckpoint(ctx context.Context, sessionID primitive.ObjectID) error {
+	_, err := s.updateSession(ctx, bson.M{"_id": sessionID}, bson.M{"$unset": bson.M{"checkpoint": ""}})
+	return err
+}
+
+// Stored files
+
+func (mongoStore) CreateStoredFile(ctx context.Context, file *models.StoredFile) error {
+	if storedFilesCol == nil {
+		return errors.New("stored files collection not initialized")
+	}
+	_, err := storedFilesCol.InsertOne(ctx, file)
+	return err
+}
+
+func (mongoStore) ReplaceStoredFile(ctx context.Context, file *models.StoredFile) error {
+	if storedFilesCol == nil {
+		return errors.New("stored files collection not initialized")
+	}
+	_, err := storedFilesCol.ReplaceOne(ctx, bson.M{"_id": file.ID}, file, options.Replace().SetUpsert(true))
+	return err
+}
+
+func (mongoStore) GetStoredFile(ctx context.Context, fileID primitive.ObjectID) (*models.StoredFile, error) {
+	if storedFilesCol == nil {
+		return nil, errors.New("stored files collection not initialized")
+	}
+	var file models.StoredFile
+	err := storedFilesCol.FindOne(ctx, bson.M{"_id": fileID}).Decode(&file)
+	if err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &file, nil
+}
+
+// findStoredFiles returns the stored files matching filter
+func (mongoStore) findStoredFiles(ctx context.Context, filter bson.M, opts ...*options.FindOptions) ([]*models.StoredFile, error) {
+	if storedFilesCol == nil {
+		return nil, errors.New("stored files collection not initialized")
+	}
+	cursor, err := storedFilesCol.Find(ctx, filter, opts...)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	files := []*models.StoredFile{}
+	if err := cursor.All(ctx, &files); err != nil {
+		return nil, err
+	}
+	return files, nil
+}
+
+func (s mongoStore) ListUserStoredFiles(ctx context.Context, userID primitive.ObjectID, query StoredFileQuery) ([]*models.StoredFile, error) {
+	filter := bson.M{"user_id": userID, "status": bson.M{"$in": query.statuses()}}
+	for k, v := range query.Metadata {
+		filter["metadata."+k] = v
+	}
+	if len(query.Tags) > 0 {
+		filter["tags"] = bson.M{"$all": query.Tags}
+	}
+	if query.Drives != nil {
+		filter["chunks.drive_account_id"] = bson.M{"$in": query.Drives}
+	}
+	created := bson.M{}
+	if !query.Since.IsZero() {
+		created["$gte"] = query.Since
+	}
+	if !query.Until.IsZero() {
+		created["$lt"] = query.Until
+	}
+	if len(created) > 0 {
+		filter["created_at"] = created
+	}
+	switch {
+	case query.Shallow && query.Folder == "":
+		filter["folder"] = bson.M{"$in": bson.A{"", nil}}
+	case query.Shallow:
+		filter["folder"] = query.Folder
+	case query.Folder != "":
+		filter["folder"] = folderPattern(query.Folder)
+	}
+	if query.MinSize > 0 || query.MaxSize > 0 {
+		size := bson.M{}
+		if query.MinSize > 0 {
+			size["$gte"] = query.MinSize
+		}
+		if query.MaxSize > 0 {
+			size["$lte"] = query.MaxSize
+		}
+		filter["original_size"] = size
+	}
+	if query.Text != "" {
+		filter["$text"] = bson.M{"$search": query.Text}
+	}
+	var and bson.A
+	if query.Name != "" {
+		filter["original_filename"] = primitive.Regex{Pattern: regexp.QuoteMeta(query.Name), Options: "i"}
+	}
+	if query.NamePrefix != "" {
+		// name_lower keeps an anchored regex on the (user_id, name_lower) index; files stored
+		// before it was recorded are matched on their filename
+		and = append(and, bson.M{"$or": bson.A{
+			bson.M{"name_lower": primitive.Regex{Pattern: "^" + regexp.QuoteMeta(strings.ToLower(query.NamePrefix))}},
+			bson.M{"name_lower": bson.M{"$exists": false}, "original_filename": primitive.Regex{Pattern: "^" + regexp.QuoteMeta(query.NamePrefix), Options: "i"}},
+		}})
+	}
+	if query.Search != "" {
+		pattern := regexp.QuoteMeta(query.Search)
+		re := primitive.Regex{Pattern: pattern, Options: "i"}
+		filter["$or"] = bson.A{
+			bson.M{"original_filename": re},
+			bson.M{"description": re},
+			// Metadata keys are free-form, so match against every value
+			bson.M{"$expr": bson.M{"$anyElementTrue": bson.A{bson.M{"$map": bson.M{
+				"input": bson.M{"$objectToArray": bson.M{"$ifNull": bson.A{"$metadata", bson.M{}}}},
+				"in":    bson.M{"$regexMatch": bson.M{"input": "$$this.v", "regex": pattern, "options": "i"}},
+			}}}}},
+		}
+	}
+
+	field, dir, op := "created_at", -1, "$lt"
+	if query.Asc {
+		dir, op = 1, "$gt"
+	}
+	var after interface{}
+	if query.After != nil {
+		after = query.After.CreatedAt
+	}
+	switch query.Sort {
+	case SortByName:
+		field = "original_filename"
+		if query.After != nil {
+			after = query.After.Name
+		}
+	case SortBySize:
+		field = "original_size"
+		if query.After != nil {
+			after = query.After.Size
+		}
+	}
+	if query.After != nil {
+		and = append(and, bson.M{"$or": bson.A{
+			bson.M{field: bson.M{op: after}},
+			bson.M{field: after, "_id": bson.M{op: query.After.ID}},
+		}})
+	}
+	if len(and) > 0 {
+		filter["$and"] = and
+	}
+	opts := options.Find().SetSort(bson.D{{Key: field, Value: dir}, {Key: "_id", Value: dir}})
+	if query.Limit > 0 {
+		opts.SetLimit(int64(query.Limit))
+	}
+	return s.findStoredFiles(ctx, filter, opts)
+}
+
+// updateActiveStoredFile applies set to an active file owned by userID, and reports whether
+// there is one
+func (mongoStore) updateActiveStoredFile(ctx context.Context, userID, fileID primitive.ObjectID, set bson.M) (bool, error) {
+	if storedFilesCol == nil {
+		return false, errors.New("stored files collection not initialized")
+	}
+	filter := bson.M{"_id": fileID, "user_id": userID, "status": "active"}
+	if len(set) == 0 {
+		n, err := storedFilesCol.CountDocuments(ctx, filter)
+		return n > 0, err
+	}
+	res, err := storedFilesCol.UpdateOne(ctx, filter, bson.M{"$set": set})
+	if err != nil {
+		return false, err
+	}
+	return res.MatchedCount > 0, nil
+}
+
+func (s mongoStore) SetStoredFileNotes(ctx context.Context, userID, fileID primitive.ObjectID, description *string, metadata map[string]string) (bool, error) {
+	set := bson.M{}
+	if description != nil {
+		set["description"] = *description
+	}
+	if metadata != nil {
+		set["metadata"] = metadata
+	}
+	return s.updateActiveStoredFile(ctx, userID, fileID, set)
+}
+
+func (s mongoStore) SetStoredFilePinned(ctx context.Context, userID, fileID primitive.ObjectID, pinned bool) (bool, error) {
+	return s.updateActiveStoredFile(ctx, userID, fileID, bson.M{"pinned": pinned})
+}
+
+// RenameStoredFile builds the new path from the stored folder in the update itself; the name is
+// wrapped in $literal so one starting with "$" isn't read as a field
+func (mongoStore) RenameStoredFile(ctx context.Context, userID, fileID primitive.ObjectID, filename string) (bool, error) {
+	if storedFilesCol == nil {
+		return false, errors.New("stored files collection not initialized")
+	}
+	name := bson.M{"$literal": filename}
+	res, err := storedFilesCol.UpdateOne(ctx,
+		bson.M{"_id": fileID, "user_id": userID, "status": "active"},
+		mongo.Pipeline{{{Key: "$set", Value: bson.M{
+			"original_filename": name,
+			"name_lower":        bson.M{"$literal": strings.ToLower(filename)},
+			"path":              bson.M{"$concat": bson.A{bson.M{"$ifNull": bson.A{"$folder", ""}}, "/", name}},
+		}}}},
+	)
+	if err != nil {
+		return false, err
+	}
+	return res.MatchedCount > 0, nil
+}
+
+func (s mongoStore) AddStoredFileTags(ctx context.Context, userID, fileID primitive.ObjectID, tags []string) ([]string, bool, error) {
+	return s.updateStoredFileTags(ctx, userID, fileID, bson.M{"$addToSet": bson.M{"tags": bson.M{"$each": tags}}})
+}
+
+func (s mongoStore) RemoveStoredFileTags(ctx context.Context, userID, fileID primitive.ObjectID, tags []string) ([]string, bool, error) {
+	return s.updateStoredFileTags(ctx, userID, fileID, bson.M{"$pull": bson.M{"tags": bson.M{"$in": tags}}})
+}
+
+// updateStoredFileTags applies update to an active file owned by userID and returns its tags
+func (mongoStore) updateStoredFileTags(ctx context.Context, userID, fileID primitive.ObjectID, update bson.M) ([]string, bool, error) {
+	if storedFilesCol == nil {
+		return nil, false, errors.New("stored files collection not initialized")
+	}
+	var f models.StoredFile
+	err := storedFilesCol.FindOneAndUpdate(ctx,
+		bson.M{"_id": fileID, "user_id": userID, "status": "active"},
+		update,
+		options.FindOneAndUpdate().SetReturnDocument(options.After).SetProjection(bson.M{"tags": 1}),
+	).Decode(&f)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	return f.Tags, true, nil
+}
+
+func (mongoStore) MoveStoredFile(ctx context.Context, userID, fileID primitive.ObjectID, folder string) (bool, error) {
+	if storedFilesCol == nil {
+		return false, errors.New("stored files collection not initialized")
+	}
+	res, err := storedFilesCol.UpdateOne(ctx,
+		bson.M{"_id": fileID, "user_id": userID, "status": "active"},
+		mongo.Pipeline{{{Key: "$set", Value: bson.M{
+			"folder": bson.M{"$literal": folder},
+			"path":   bson.M{"$concat": bson.A{bson.M{"$literal": folder}, "/", "$original_filename"}},
+		}}}},
+	)
+	if err != nil {
+		return false, err
+	}
+	return res.MatchedCount > 0, nil
+}
+
+func (mongoStore) RecordStoredFileDownload(ctx context.Context, fileID primitive.ObjectID, client models.ClientInfo) error {
+	if storedFilesCol == nil {
+		return errors.New("stored files collection not initialized")
+	}
+	_, err := storedFilesCol.UpdateOne(ctx,
+		bson.M{"_id": fileID},
+		bson.M{"$set": bson.M{"last_download_client": client, "last_downloaded_at": time.Now().UTC()}},
+	)
+	return err
+}
+
+func (s mongoStore) ListFilesToScrub(ctx context.Context, limit int) ([]*models.StoredFile, error) {
+	return s.findStoredFiles(ctx, bson.M{"status": "active"},
+		options.Find().SetSort(bson.D{{Key: "last_scrubbed_at", Value: 1}}).SetLimit(int64(limit)),
+	)
+}
+
+func (mongoStore) TrashStoredFile(ctx context.Context, userID, fileID primitive.ObjectID, at time.Time) (bool, error) {
+	if storedFilesCol == nil {
+		return false, errors.New("stored files collection not initialized")
+	}
+	res, err := storedFilesCol.UpdateOne(ctx,
+		bson.M{"_id": fileID, "user_id": userID, "status": bson.M{"$in": bson.A{"active", "incomplete"}}},
+		bson.M{"$set": bson.M{"status": "trashed", "deleted_at": at}},
+	)
+	if err != nil {
+		return false, err
+	}
+	return res.MatchedCount > 0, nil
+}
+
+// RestoreStoredFile picks the status from missing_chunks in the update itself
+func (mongoStore) RestoreStoredFile(ctx context.Context, userID, fileID primitive.ObjectID) (bool, error) {
+	if storedFilesCol == nil {
+		return false, errors.New("stored files collection not initialized")
+	}
+	res, err := storedFilesCol.UpdateOne(ctx,
+		bson.M{"_id": fileID, "user_id": userID, "status": "trashed"},
+		mongo.Pipeline{
+			{{Key: "$set", Value: bson.M{"status": bson.M{"$cond": bson.A{
+				bson.M{"$gt": bson.A{bson.M{"$size": bson.M{"$ifNull": bson.A{"$missing_chunks", bson.A{}}}}, 0}},
+				"incomplete", "active",
+			}}}}},
+			{{Key: "$unset", Value: "deleted_at"}},
+		},
+	)
+	if err != nil {
+		return false, err
+	}
+	return res.MatchedCount > 0, nil
+}
+
+func (s mongoStore) ListPurgeableFiles(ctx context.Context, cutoff time.Time, limit int) ([]*models.StoredFile, error) {
+	return s.findStoredFiles(ctx, bson.M{"status": bson.M{"$in": purgeableStatuses}, "deleted_at": bson.M{"$lt": cutoff}},
+		options.Find().SetSort(bson.D{{Key: "deleted_at", Value: 1}}).SetLimit(int64(limit)),
+	)
+}
+
+func (mongoStore) PurgeStoredFile(ctx context.Context, fileID primitive.ObjectID) error {
+	if storedFilesCol == nil {
+		return errors.New("stored files collection not initialized")
+	}
+	_, err := storedFilesCol.DeleteOne(ctx, bson.M{"_id": fileID, "status": bson.M{"$in": purgeableStatuses}})
+	return err
+}
+
+func (mongoStore) RecordChunkChecks(ctx context.Context, fileID primitive.ObjectID, checks []ChunkCheck, at time.Time) error {
+	if storedFilesCol == nil {
+		return errors.New("stored files collection not initialized")
+	}
+	set := bson.M{"last_scrubbed_at": at}
+	filters := make([]interface{}, 0, len(checks))
+	for i, check := range checks {
+		id := fmt.Sprintf("c%d", i)
+		set["chunks.$["+id+"].health"] = check.Health
+		set["chunks.$["+id+"].last_checked_at"] = at
+		if check.Health == models.ChunkOK {
+			set["chunks.$["+id+"].last_verified_at"] = at
+		}
+		filters = append(filters, bson.M{id + ".chunk_id": check.ChunkID, id + ".drive_file_id": check.DriveFileID})
+	}
+	opts := options.Update()
+	if len(filters) > 0 {
+		opts.SetArrayFilters(options.ArrayFilters{Filters: filters})
+	}
+	_, err := storedFilesCol.UpdateOne(ctx, bson.M{"_id": fileID}, bson.M{"$set": set}, opts)
+	return err
+}
+
+// Folders
+
+func (mongoStore) CreateFolder(ctx context.Context, folder *models.Folder) (bool, error) {
+	if foldersCol == nil {
+		return false, errors.New("folders collection not initialized")
+	}
+	_, err := foldersCol.InsertOne(ctx, folder)
+	if mongo.IsDuplicateKeyError(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (mongoStore) ListFolders(ctx context.Context, userID primitive.ObjectID) ([]*models.Folder, error) {
+	if foldersCol == nil {
+		return nil, errors.New("folders collection not initialized")
+	}
+	cursor, err := foldersCol.Find(ctx, bson.M{"user_id": userID}, options.Find().SetSort(bson.M{"path": 1}))
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+	folders := []*models.Folder{}
+	if err := cursor.All(ctx, &folders); err != nil {
+		return nil, err
+	}
+	return folders, nil
+}
+
+func (mongoStore) ListFileFolders(ctx context.Context, userID primitive.ObjectID) ([]string, error) {
+	if storedFilesCol == nil {
+		return nil, errors.New("stored files collection not initialized")
+	}
+	values, err := storedFilesCol.Distinct(ctx, "folder", bson.M{
+		"user_id": userID,
+		"status":  bson.M{"$in": bson.A{"active", "incomplete"}},
+		"folder":  bson.M{"$nin": bson.A{"", nil}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	folders := make([]string, 0, len(values))
+	for _, v := range values {
+		if folder, ok := v.(string); ok {
+			folders = append(folders, folder)
+		}
+	}
+	return folders, nil
+}
+
+// folderPattern matches path and the paths below it
+func folderPattern(path string) bson.M {
+	return bson.M{"$regex": "^" + regexp.QuoteMeta(path) + "(/|$)"}
+}
+
+// MoveFolder swaps the from prefix for to in the update itself, so files of every status move
+// and a deleted file comes back in the folder's new place
+func (mongoStore) MoveFolder(ctx context.Context, userID primitive.ObjectID, from, to string) (int64, error) {
+	if storedFilesCol == nil || foldersCol == nil {
+		return 0, errors.New("folders collection not initialized")
+	}
+	moved := func(field string) bson.M {
+		return bson.M{"$concat": bson.A{bson.M{"$literal": to}, bson.M{"$substrBytes": bson.A{"$" + field, len(from), -1}}}}
+	}
+	res, err := storedFilesCol.UpdateMany(ctx, bson.M{"user_id": userID, "folder": folderPattern(from)}, mongo.Pipeline{
+		{{Key: "$set", Value: bson.M{"folder": moved("folder")}}},
+		{{Key: "$set", Value: bson.M{"path": bson.M{"$concat": bson.A{"$folder", "/", "$original_filename"}}}}},
+	})
+	if err != nil {
+		return 0, err
+	}
+	if _, err := foldersCol.UpdateMany(ctx, bson.M{"user_id": userID, "path": folderPattern(from)}, mongo.Pipeline{{{Key: "$set", Value: bson.M{"path": moved("path")}}}}); err != nil {
+		return res.ModifiedCount, err
+	}
+	return res.ModifiedCount, nil
+}
+
+func (mongoStore) DeleteFolder(ctx context.Context, userID primitive.ObjectID, path string) (bool, error) {
+	if foldersCol == nil {
+		return false, errors.New("folders collection not initialized")
+	}
+	res, err := foldersCol.DeleteMany(ctx, bson.M{"user_id": userID, "path": folderPattern(path)})
+	if err != nil {
+		return false, err
+	}
+	return res.DeletedCount > 0, nil
+}
+
+// File shares
+
+func (mongoStore) CreateFileShare(ctx context.Context, share *models.FileShare) (bool, error) {
+	if sharesCol == nil {
+		return false, errors.New("file shares collection not initialized")
+	}
+	_, err := sharesCol.InsertOne(ctx, share)
+	if mongo.IsDuplicateKeyError(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (mongoStore) GetFileShare(ctx context.Context, fileID, userID primitive.ObjectID) (*models.FileShare, error) {
+	if sharesCol == nil {
+		return nil, errors.New("file shares collection not initialized")
+	}
+	var share models.FileShare
+	err := sharesCol.FindOne(ctx, bson.M{"file_id": fileID, "user_id": userID}).Decode(&share)
+	if err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &share, nil
+}
+
+func (s mongoStore) ListFileShares(ctx context.Context, fileID primitive.ObjectID) ([]*models.FileShare, error) {
+	return s.findShares(ctx, bson.M{"file_id": fileID}, 1)
+}
+
+func (s mongoStore) ListUserShares(ctx context.Context, userID primitive.ObjectID) ([]*models.FileShare, error) {
+	return s.findShares(ctx, bson.M{"user_id": userID}, -1)
+}
+
+// findShares returns the shares matching filter, sorted by created_at in order
+func (mongoStore) findShares(ctx context.Context, filter bson.M, order int) ([]*models.FileShare, error) {
+	if sharesCol == nil {
+		return nil, errors.New("file shares collection not initialized")
+	}
+	cursor, err := sharesCol.Find(ctx, filter, options.Find().SetSort(bson.M{"created_at": order}))
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+	shares := []*models.FileShare{}
+	if err := cursor.All(ctx, &shares); err != nil {
+		return nil, err
+	}
+	return shares, nil
+}
+
+func (mongoStore) DeleteFileShare(ctx context.Context, ownerID, fileID, userID primitive.ObjectID) (bool, error) {
+	if sharesCol == nil {
+		return false, errors.New("file shares collection not initialized")
+	}
+	res, err := sharesCol.DeleteOne(ctx, bson.M{"owner_id": ownerID, "file_id": fileID, "user_id": userID})
+	if err != nil {
+		return false, err
+	}
+	return res.DeletedCount > 0, nil
+}
+
+func (mongoStore) DeleteFileShares(ctx context.Context, fileID primitive.ObjectID) error {
+	if sharesCol == nil {
+		return errors.New("file shares collection not initialized")
+	}
+	_, err := sharesCol.DeleteMany(ctx, bson.M{"file_id": fileID})
+	return err
+}
+
+// Public links
+
+func (mongoStore) CreatePublicLink(ctx context.Context, link *models.PublicLink) error {
+	if publicLinksCol == nil {
+		return errors.New("public links collection not initialized")
+	}
+	_, err := publicLinksCol.InsertOne(ctx, link)
+	return err
+}
+
+func (mongoStore) GetPublicLink(ctx context.Context, tokenHash string) (*models.PublicLink, error) {
+	if publicLinksCol == nil {
+		return nil, errors.New("public links collection not initialized")
+	}
+	var link models.PublicLink
+	err := publicLinksCol.FindOne(ctx, bson.M{"token_hash": tokenHash}).Decode(&link)
+	if err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &link, nil
+}
+
+func (mongoStore) ListPublicLinks(ctx context.Context, userID, fileID primitive.ObjectID) ([]*models.PublicLink, error) {
+	if publicLinksCol == nil {
+		return nil, errors.New("public links collection not initialized")
+	}
+	filter := bson.M{"user_id": userID}
+	if !fileID.IsZero() {
+		filter["file_id"] = fileID
+	}
+	cursor, err := publicLinksCol.Find(ctx, filter, options.Find().SetSort(bson.M{"created_at": -1}))
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+	links := []*models.PublicLink{}
+	if err := cursor.All(ctx, &links); err != nil {
+		return nil, err
+	}
+	return links, nil
+}
+
+// UsePublicLink checks the expiry and the download limit in the update's filter, so concurrent
+// downloads can't go past the limit
+func (mongoStore) UsePublicLink(ctx context.Context, linkID primitive.ObjectID, now time.Time) (bool, error) {
+	if publicLinksCol == nil {
+		return false, errors.New("public links collection not initialized")
+	}
+	res, err := publicLinksCol.UpdateOne(ctx, bson.M{
+		"_id": linkID,
+		"$and": bson.A{
+			bson.M{"$or": bson.A{bson.M{"expires_at": bson.M{"$exists": false}}, bson.M{"expires_at": bson.M{"$gt": now}}}},
+			bson.M{"$or": bson.A{bson.M{"max_downloads": bson.M{"$exists": false}}, bson.M{"$expr": bson.M{"$lt": bson.A{"$downloads", "$max_downloads"}}}}},
+		},
+	}, bson.M{"$inc": bson.M{"downloads": 1}})
+	if err != nil {
+		return false, err
+	}
+	return res.ModifiedCount > 0, nil
+}
+
+func (mongoStore) DeletePublicLink(ctx context.Context, userID, linkID primitive.ObjectID) (bool, error) {
+	if publicLinksCol == nil {
+		return false, errors.New("public links collection not initialized")
+	}
+	res, err := publicLinksCol.DeleteOne(ctx, bson.M{"_id": linkID, "user_id": userID})
+	if err != nil {
+		return false, err
+	}
+	return res.DeletedCount > 0, nil
+}
+
+func (mongoStore) DeleteFilePublicLinks(ctx context.Context, fileID primitive.ObjectID) error {
+	if publicLinksCol == nil {
+		return errors.New("public links collection not initialized")
+	}
+	_, err := publicLinksCol.DeleteMany(ctx, bson.M{"file_id": fileID})
+	return err
+}
+
+// OAuth states
+
+func (mongoStore) InsertOAuthState(ctx context.Context, state *models.OAuthState) error {
+	if stateCol == nil {
+		return errors.New("oauth states collection not initialized")
+	}
+	_, err := stateCol.InsertOne(ctx, state)
+	return err
+}
+
+func (mongoStore) FindAndDeleteState(ctx context.Context, state string) (*models.OAuthState, error) {
+	if stateCol == nil {
+		return nil, errors.New("oauth states collection not initialized")
+	}
+	var s models.OAuthState
+	err := stateCol.FindOneAndDelete(ctx, bson.M{"state": state}).Decode(&s)
+	if err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &s, nil
+}
+
+// Used download links
+
+func (mongoStore) UseDownloadLink(ctx context.Context, linkID string, expiresAt time.Time) (bool, error) {
+	if usedLinksCol == nil {
+		return false, errors.New("used download links collection not initialized")
+	}
+	_, err := usedLinksCol.InsertOne(ctx, bson.M{"_id": linkID, "expires_at": expiresAt.UTC(), "used_at": time.Now().UTC()})
+	if mongo.IsDuplicateKeyError(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// Processing jobs
+
+func (mongoStore) EnqueueJob(ctx context.Context, job *models.ProcessingJob) error {
+	if jobsCol == nil {
+		return errors.New("jobs collection not initialized")
+	}
+	_, err := jobsCol.InsertOne(ctx, job)
+	return err
+}
+
+func (mongoStore) ClaimJob(ctx context.Context, owner string, lease time.Duration, fastOnly bool) (*models.ProcessingJob, error) {
+	if jobsCol == nil {
+		return nil, errors.New("jobs collection not initialized")
+	}
+	now := time.Now()
+	filter := bson.M{"$or": []bson.M{
+		{"status": models.JobQueued},
+		{"status": models.JobRunning, "lease_expires_at": bson.M{"$lt": now}},
+	}}
+	if fastOnly {
+		filter["fast_lane"] = true
+	}
+	update := bson.M{
+		"$set": bson.M{
+			"status":           models.JobRunning,
+			"lease_owner":      owner,
+			"lease_expires_at": now.Add(lease),
+			"updated_at":       now,
+		},
+		"$inc": bson.M{"attempts": 1},
+	}
+	opts := options.FindOneAndUpdate().
+		SetSort(bson.D{{Key: "fast_lane", Value: -1}, {Key: "created_at", Value: 1}}).
+		SetReturnDocument(options.After)
+
+	var job models.ProcessingJob
+	err := jobsCol.FindOneAndUpdate(ctx, filter, update, opts).Decode(&job)
+	if err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &job, nil
+}
+
+func (mongoStore) RenewJobLease(ctx context.Context, jobID primitive.ObjectID, owner string, lease time.Duration) (bool, error) {
+	if jobsCol == nil {
+		return false, errors.New("jobs collection not initialized")
+	}
+	now := time.Now()
+	res, err := jobsCol.UpdateOne(ctx,
+		bson.M{"_id": jobID, "status": models.JobRunning, "lease_owner": owner},
+		bson.M{"$set": bson.M{"lease_expires_at": now.Add(lease), "updated_at": now}},
+	)
+	if err != nil {
+		return false, err
+	}
+	return res.MatchedCount > 0, nil
+}
+
+func (mongoStore) FinishJob(ctx context.Context, jobID primitive.ObjectID, owner, status, errMsg string) error {
+	if jobsCol == nil {
+		return errors.New("jobs collection not initialized")
+	}
+	_, err := jobsCol.UpdateOne(ctx,
+		bson.M{"_id": jobID, "lease_owner": owner},
+		bson.M{
+			"$set":   bson.M{"status": status, "error": errMsg, "updated_at": time.Now()},
+			"$unset": bson.M{"lease_owner": "", "lease_expires_at": ""},
+		},
+	)
+	return err
+}
+
+func (mongoStore) GetSessionJob(ctx context.Context, sessionID primitive.ObjectID) (*models.ProcessingJob, error) {
+	if jobsCol == nil {
+		return nil, errors.New("jobs collection not initialized")
+	}
+	var job models.ProcessingJob
+	err := jobsCol.FindOne(ctx,
+		bson.M{"session_id": sessionID},
+		options.FindOne().SetSort(bson.D{{Key: "created_at", Value: -1}}),
+	).Decode(&job)
+	if err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &job, nil
+}
+
+func (mongoStore) CountQueuedJobs(ctx context.Context) (int64, error) {
+	if jobsCol == nil {
+		return 0, errors.New("jobs collection not initialized")
+	}
+	return jobsCol.CountDocuments(ctx, bson.M{"status": models.JobQueued})
+}
+
+// Invites
+
+func (mongoStore) CreateInvite(ctx context.Context, inv *models.Invite) error {
+	if invitesCol == nil {
+		return errors.New("invites collection not initialized")
+	}
+	_, err := invitesCol.InsertOne(ctx, inv)
+	return err
+}
+
+func (mongoStore) ListInvites(ctx context.Context) ([]*models.Invite, error) {
+	if invitesCol == nil {
+		return nil, errors.New("invites collection not initialized")
+	}
+	cursor, err := invitesCol.Find(ctx, bson.M{}, options.Find().SetSort(bson.M{"created_at": -1}))
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	invites := []*models.Invite{}
+	if err := cursor.All(ctx, &invites); err != nil {
+		return nil, err
+	}
+	return invites, nil
+}
+
+func (mongoStore) DeleteInvite(ctx context.Context, inviteID primitive.ObjectID) (bool, error) {
+	if invitesCol == nil {
+		return false, errors.New("invites collection not initialized")
+	}
+	res, err := invitesCol.DeleteOne(ctx, bson.M{"_id": inviteID})
+	if err != nil {
+		return false, err
+	}
+	return res.DeletedCount > 0, nil
+}
+
+func (mongoStore) RedeemInvite(ctx context.Context, codeHash, email string, now time.Time) (bool, error) {
+	if invitesCol == nil {
+		return false, errors.New("invites collection not initialized")
+	}
+	res, err := invitesCol.UpdateOne(ctx, bson.M{
+		"code_hash": codeHash,
+		"used_at":   bson.M{"$exists": false},
+		"$or":       bson.A{bson.M{"expires_at": bson.M{"$exists": false}}, bson.M{"expires_at": bson.M{"$gt": now}}},
+	}, bson.M{"$set": bson.M{"used_by": email, "used_at": now}})
+	if err != nil {
+		return false, err
+	}
+	return res.ModifiedCount > 0, nil
+}
+
+func (mongoStore) ReleaseInvite(ctx context.Context, codeHash string) error {
+	if invitesCol == nil {
+		return errors.New("invites collection not initialized")
+	}
+	_, err := invitesCol.UpdateOne(ctx, bson.M{"code_hash": codeHash}, bson.M{"$unset": bson.M{"used_by": "", "used_at": ""}})
+	return err
+}
+
+// Refresh tokens
+
+func (mongoStore) CreateRefreshToken(ctx context.Context, t *models.RefreshToken) error {
+	if refreshTokensCol == nil {
+		return errors.New("refresh tokens collection not initialized")
+	}
+	_, err := refreshTokensCol.InsertOne(ctx, t)
+	return err
+}
+
+func (mongoStore) GetRefreshToken(ctx context.Context, tokenHash string) (*models.RefreshToken, error) {
+	if refreshTokensCol == nil {
+		return nil, errors.New("refresh tokens collection not initialized")
+	}
+	var t models.RefreshToken
+	err := refreshTokensCol.FindOne(ctx, bson.M{"token_hash": tokenHash}).Decode(&t)
+	if err == mongo.ErrNoDocuments {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+func (mongoStore) UseRefreshToken(ctx context.Context, tokenHash string, now time.Time) (*models.RefreshToken, error) {
+	if refreshTokensCol == nil {
+		return nil, errors.New("refresh tokens collection not initialized")
+	}
+	var t models.RefreshToken
+	err := refreshTokensCol.FindOneAndUpdate(ctx, bson.M{
+		"token_hash": tokenHash,
+		"used_at":    bson.M{"$exists": false},
+		"revoked_at": bson.M{"$exists": false},
+		"expires_at": bson.M{"$gt": now},
+	}, bson.M{"$set": bson.M{"used_at": now}}, options.FindOneAndUpdate().SetReturnDocument(options.After)).Decode(&t)
+	if err == mongo.ErrNoDocuments {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+func (mongoStore) RevokeRefreshTokenFamily(ctx context.Context, familyID primitive.ObjectID, now time.Time) error {
+	if refreshTokensCol == nil {
+		return errors.New("refresh tokens collection not initialized")
+	}
+	_, err := refreshTokensCol.UpdateMany(ctx, bson.M{
+		"family_id":  familyID,
+		"revoked_at": bson.M{"$exists": false},
+	}, bson.M{"$set": bson.M{"revoked_at": now}})
+	return err
+}
+
+func (mongoStore) IsRefreshTokenFamilyRevoked(ctx context.Context, familyID primitive.ObjectID) (bool, error) {
+	if refreshTokensCol == nil {
+		return false, errors.New("refresh tokens collection not initialized")
+	}
+	n, err := refreshTokensCol.CountDocuments(ctx, bson.M{
+		"family_id":  familyID,
+		"revoked_at": bson.M{"$exists": true},
+	}, options.Count().SetLimit(1))
+	return n > 0, err
+}
+
+func (mongoStore) RevokeUserRefreshTokens(ctx context.Context, userID primitive.ObjectID, now time.Time) error {
+	if refreshTokensCol == nil {
+		return errors.New("refresh tokens collection not initialized")
+	}
+	_, err := refreshTokensCol.UpdateMany(ctx, bson.M{
+		"user_id":    userID,
+		"revoked_at": bson.M{"$exists": false},
+	}, bson.M{"$set": bson.M{"revoked_at": now}})
+	return err
+}
+
+func (mongoStore) ListActiveRefreshTokens(ctx context.Context, userID primitive.ObjectID, now time.Time) ([]*models.RefreshToken, error) {
+	if refreshTokensCol == nil {
+		return nil, errors.New("refresh tokens collection not initialized")
+	}
+	cur, err := refreshTokensCol.Find(ctx, bson.M{
+		"user_id":    userID,
+		"used_at":    bson.M{"$exists": false},
+		"revoked_at": bson.M{"$exists": false},
+		"expires_at": bson.M{"$gt": now},
+	}, options.Find().SetSort(bson.D{{Key: "login_at", Value: -1}}))
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(ctx)
+	tokens := []*models.RefreshToken{}
+	if err := cur.All(ctx, &tokens); err != nil {
+		return nil, err
+	}
+	return tokens, nil
+}
+
+// Audit log
+
+func (mongoStore) InsertAuditEvent(ctx context.Context, e *models.AuditEvent) error {
+	if auditCol == nil {
+		return errors.New("audit collection not initialized")
+	}
+	_, err := auditCol.InsertOne(ctx, e)
+	return err
+}
+
+func (mongoStore) ListAuditEvents(ctx context.Context, query AuditQuery) ([]*models.AuditEvent, error) {
+	if auditCol == nil {
+		return nil, errors.New("audit collection not initialized")
+	}
+	filter := bson.M{}
+	if !query.UserID.IsZero() {
+		filter["user_id"] = query.UserID
+	}
+	if query.Action != "" {
+		filter["action"] = query.Action
+	}
+	if !query.Before.IsZero() {
+		filter["_id"] = bson.M{"$lt": query.Before}
+	}
+	created := bson.M{}
+	if !query.Since.IsZero() {
+		created["$gte"] = query.Since
+	}
+	if !query.Until.IsZero() {
+		created["$lt"] = query.Until
+	}
+	if len(created) > 0 {
+		filter["created_at"] = created
+	}
+
+	cur, err := auditCol.Find(ctx, filter, options.Find().SetSort(bson.M{"_id": -1}).SetLimit(int64(query.Limit)))
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(ctx)
+	events := []*models.AuditEvent{}
+	if err := cur.All(ctx, &events); err != nil {
+		return nil, err
+	}
+	return events, nil
+}
+
+// Drive API usage
+
+func (mongoStore) AddDriveAPIUsage(ctx context.Context, deltas []models.DriveAPIUsage) error {
+	if usageCol == nil {
+		return errors.New("usage collection not initialized")
+	}
+	if len(deltas) == 0 {
+		return nil
+	}
+
+	writes := make([]mongo.WriteModel, 0, len(deltas))
+	for _, d := range deltas {
+		writes = append(writes, mongo.NewUpdateOneModel().
+			SetFilter(bson.M{"day": d.Day, "account_id": d.AccountID, "operation": d.Operation}).
+			SetUpdate(bson.M{"$inc": bson.M{"count": d.Count}}).
+			SetUpsert(true))
+	}
+	_, err := usageCol.BulkWrite(ctx, writes, options.BulkWrite().SetOrdered(false))
+	return err
+}
+
+func (mongoStore) GetDriveAPIUsage(ctx context.Context, day string) ([]models.DriveAPIUsage, error) {
+	if usageCol == nil {
+		return nil, errors.New("usage collection not initialized")
+	}
+	cursor, err := usageCol.Find(ctx, bson.M{"day": day})
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	usage := []models.DriveAPIUsage{}
+	if err := cursor.All(ctx, &usage); err != nil {
+		return nil, err
+	}
+	return usage, nil
+}
+
+// Reports
+
+func (mongoStore) GetUserStorageUsage(ctx context.Context, userID primitive.ObjectID) (StorageUsage, error) {
+	if storedFilesCol == nil {
+		return StorageUsage{}, errors.New("stored files collection not initialized")
+	}
+	if sessionsCol == nil {
+		return StorageUsage{}, errors.New("sessions collection not initialized")
+	}
+
+	var usage StorageUsage
+	stored, err := sumField(ctx, storedFilesCol, bson.M{"user_id": userID, "status": bson.M{"$in": storedStatuses}}, "$original_size")
+	if err != nil {
+		return usage, err
+	}
+	usage.StoredBytes, usage.StoredFiles = stored.Bytes, stored.Count
+
+	pending, err := sumField(ctx, sessionsCol, bson.M{"user_id": userID, "status": bson.M{"$in": pendingStatuses}}, "$total_size")
+	if err != nil {
+		return usage, err
+	}
+	usage.PendingBytes = pending.Bytes
+	return usage, nil
+}
+
+// RunReport runs the query as an aggregation pipeline
+func (mongoStore) RunReport(ctx context.Context, q ReportQuery) ([]ReportRow, error) {
+	var col *mongo.Collection
+	sizeField := "$original_size"
+	switch q.Source {
+	case ReportStoredFiles:
+		col = storedFilesCol
+	case ReportSessions:
+		col = sessionsCol
+		sizeField = "$total_size"
+	default:
+		return nil, fmt.Errorf("%w: unknown source %q", ErrInvalidReport, q.Source)
+	}
+	if col == nil {
+		return nil, errors.New(q.Source + " collection not initialized")
+	}
+
+	match := bson.M{}
+	if q.UserID != nil {
+		match["user_id"] = *q.UserID
+	}
+	if q.Status != "" {
+		match["status"] = q.Status
+	}
+	created := bson.M{}
+	if !q.From.IsZero() {
+		created["$gte"] = q.From
+	}
+	if !q.To.IsZero() {
+		created["$lt"] = q.To
+	}
+	if len(created) > 0 {
+		match["created_at"] = created
+	}
+	pipeline := mongo.Pipeline{{{Key: "$match", Value: match}}}
+
+	// A document in the grouping order, so sorting on _id orders the rows the same every run
+	group := bson.D{}
+	byDrive := false
+	for _, g := range q.GroupBy {
+		var v interface{}
+		switch g {
+		case "user":
+			v = "$user_id"
+		case "status":
+			v = "$status"
+		case "drive":
+			if q.Source != ReportStoredFiles {
+				return nil, fmt.Errorf("%w: drive grouping needs source %s", ErrInvalidReport, ReportStoredFiles)
+			}
+			v = "$chunks.drive_account_id"
+			byDrive = true
+		case "day", "week", "month":
+			v = bson.M{"$dateToString": bson.M{"format": dateBucketFormats[g], "date": "$created_at"}}
+		default:
+			return nil, fmt.Errorf("%w: unknown grouping %q", ErrInvalidReport, g)
+		}
+		if !slices.ContainsFunc(group, func(e bson.E) bool { return e.Key == g }) {
+			group = append(group, bson.E{Key: g, Value: v})
+		}
+	}
+	if byDrive {
+		// One row per chunk, sized by the chunk
+		pipeline = append(pipeline, bson.D{{Key: "$unwind", Value: "$chunks"}})
+		sizeField = "$chunks.size"
+	}
+
+	limit := q.Limit
+	if limit <= 0 || limit > maxReportRows {
+		limit = maxReportRows
+	}
+	pipeline = append(pipeline,
+		bson.D{{Key: "$group", Value: bson.M{
+			"_id":   group,
+			"count": bson.M{"$sum": 1},
+			"bytes": bson.M{"$sum": sizeField},
+		}}},
+		bson.D{{Key: "$sort", Value: bson.D{{Key: "_id", Value: 1}}}},
+		bson.D{{Key: "$limit", Value: limit}},
+	)
+
+	cursor, err := col.Aggregate(ctx, pipeline)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	rows := []ReportRow{}
+	if err := cursor.All(ctx, &rows); err != nil {
+		return nil, err
+	}
+	return rows, nil
+}
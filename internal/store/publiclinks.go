@@ -0,0 +1,67 @@
+package store
+
+import (
+	"SE/internal/models"
+	"context"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Public links to stored files
+var publicLinksCol *mongo.Collection
+
+func initPublicLinksCollection(ctx context.Context) {
+	publicLinksCol = db.Collection("public_links")
+	_, _ = publicLinksCol.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{
+			Keys:    bson.M{"token_hash": 1},
+			Options: options.Index().SetUnique(true),
+		},
+		{Keys: bson.D{{Key: "user_id", Value: 1}, {Key: "created_at", Value: -1}}},
+		{Keys: bson.M{"file_id": 1}},
+	})
+}
+
+// CreatePublicLink stores a new public link
+func CreatePublicLink(ctx context.Context, link *models.PublicLink) error {
+	link.ID = primitive.NewObjectID()
+	link.CreatedAt = time.Now().UTC()
+	return backend.CreatePublicLink(ctx, link)
+}
+
+// GetPublicLink returns the link with the given token hash, nil if there is none
+func GetPublicLink(ctx context.Context, tokenHash string) (*models.PublicLink, error) {
+	return backend.GetPublicLink(ctx, tokenHash)
+}
+
+// ListPublicLinks returns the user's public links, only those to fileID unless it is zero,
+// newest first
+func ListPublicLinks(ctx context.Context, userID, fileID primitive.ObjectID) ([]*models.PublicLink, error) {
+	return backend.ListPublicLinks(ctx, userID, fileID)
+}
+
+// UsePublicLink counts a download through the link. Returns false if it has expired or has no
+// downloads left.
+func UsePublicLink(ctx context.Context, linkID primitive.ObjectID) (bool, error) {
+	return backend.UsePublicLink(ctx, linkID, time.Now().UTC())
+}
+
+// DeletePublicLink revokes a public link of the user. Returns false if there is no such link.
+func DeletePublicLink(ctx context.Context, userID, linkID primitive.ObjectID) (bool, error) {
+	return backend.DeletePublicLink(ctx, userID, linkID)
+}
+
+// DeleteFilePublicLinks revokes every public link to a file, for when it is purged
+func DeleteFilePublicLinks(ctx context.Context, fileID primitive.ObjectID) error {
+	return backend.DeleteFilePublicLinks(ctx, fileID)
+}
+
+// publicLinkUsable tells whether a link has a download left at now, for the stores that check
+// in Go
+func publicLinkUsable(link *models.PublicLink, now time.Time) bool {
+	return (link.ExpiresAt == nil || now.Before(*link.ExpiresAt)) && (link.MaxDownloads == 0 || link.Downloads < link.MaxDownloads)
+}
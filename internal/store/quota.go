@@ -0,0 +1,52 @@
+package store
+
+import (
+	"context"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// StorageUsage is what a user has stored and has on the way
+type StorageUsage struct {
+	StoredBytes  int64 // original size of active and incomplete files
+	StoredFiles  int64
+	PendingBytes int64 // size of uploads not yet recorded as a file
+}
+
+// storedStatuses are the stored file statuses that count towards a quota
+var storedStatuses = bson.A{"active", "incomplete"}
+
+// pendingStatuses are the session statuses whose file isn't stored yet
+var pendingStatuses = bson.A{"uploading", "processing", "paused"}
+
+// GetUserStorageUsage sums the user's stored files and pending uploads
+func GetUserStorageUsage(ctx context.Context, userID primitive.ObjectID) (StorageUsage, error) {
+	return backend.GetUserStorageUsage(ctx, userID)
+}
+
+type sumResult struct {
+	Count int64 `bson:"count"`
+	Bytes int64 `bson:"bytes"`
+}
+
+// sumField counts the documents matching filter and sums one of their fields
+func sumField(ctx context.Context, col *mongo.Collection, filter bson.M, field string) (sumResult, error) {
+	cursor, err := col.Aggregate(ctx, mongo.Pipeline{
+		{{Key: "$match", Value: filter}},
+		{{Key: "$group", Value: bson.M{"_id": nil, "count": bson.M{"$sum": 1}, "bytes": bson.M{"$sum": field}}}},
+	})
+	if err != nil {
+		return sumResult{}, err
+	}
+	defer cursor.Close(ctx)
+
+	var res sumResult
+	if cursor.Next(ctx) {
+		if err := cursor.Decode(&res); err != nil {
+			return sumResult{}, err
+		}
+	}
+	return res, cursor.Err()
+}
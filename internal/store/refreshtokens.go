@@ -0,0 +1,65 @@
+package store
+
+import (
+	"SE/internal/models"
+	"context"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Rotating refresh tokens, removed once their family expires
+var refreshTokensCol *mongo.Collection
+
+func initRefreshTokensCollection(ctx context.Context) {
+	refreshTokensCol = db.Collection("refresh_tokens")
+	_, _ = refreshTokensCol.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.M{"token_hash": 1}, Options: options.Index().SetUnique(true)},
+		{Keys: bson.M{"family_id": 1}},
+		{Keys: bson.M{"user_id": 1}},
+		{Keys: bson.M{"expires_at": 1}, Options: options.Index().SetExpireAfterSeconds(0)},
+	})
+}
+
+// CreateRefreshToken stores a new refresh token
+func CreateRefreshToken(ctx context.Context, t *models.RefreshToken) error {
+	t.ID = primitive.NewObjectID()
+	t.CreatedAt = time.Now().UTC()
+	return backend.CreateRefreshToken(ctx, t)
+}
+
+// GetRefreshToken returns the refresh token with the given hash, or nil
+func GetRefreshToken(ctx context.Context, tokenHash string) (*models.RefreshToken, error) {
+	return backend.GetRefreshToken(ctx, tokenHash)
+}
+
+// UseRefreshToken marks the unused, unrevoked, unexpired refresh token with the given hash as
+// used and returns it. Returns nil if there is no such token, so of two requests with the same
+// token only one gets it.
+func UseRefreshToken(ctx context.Context, tokenHash string) (*models.RefreshToken, error) {
+	return backend.UseRefreshToken(ctx, tokenHash, time.Now().UTC())
+}
+
+// RevokeRefreshTokenFamily revokes every refresh token of a family, ending the login it came from
+func RevokeRefreshTokenFamily(ctx context.Context, familyID primitive.ObjectID) error {
+	return backend.RevokeRefreshTokenFamily(ctx, familyID, time.Now().UTC())
+}
+
+// IsRefreshTokenFamilyRevoked reports whether the family was revoked, so its login has ended
+func IsRefreshTokenFamilyRevoked(ctx context.Context, familyID primitive.ObjectID) (bool, error) {
+	return backend.IsRefreshTokenFamilyRevoked(ctx, familyID)
+}
+
+// RevokeUserRefreshTokens revokes every refresh token of the user, ending all their logins
+func RevokeUserRefreshTokens(ctx context.Context, userID primitive.ObjectID) error {
+	return backend.RevokeUserRefreshTokens(ctx, userID, time.Now().UTC())
+}
+
+// ListActiveRefreshTokens returns the usable refresh token of each of the user's logins,
+// newest login first
+func ListActiveRefreshTokens(ctx context.Context, userID primitive.ObjectID) ([]*models.RefreshToken, error) {
+	return backend.ListActiveRefreshTokens(ctx, userID, time.Now().UTC())
+}
@@ -0,0 +1,150 @@
+package store
+
+import (
+	"SE/internal/models"
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// ErrInvalidReport is returned for report queries that can't be run
+var ErrInvalidReport = errors.New("invalid report query")
+
+// Report sources
+const (
+	ReportStoredFiles = "stored_files"
+	ReportSessions    = "sessions"
+)
+
+// maxReportRows bounds how many groups a report returns
+const maxReportRows = 10000
+
+// ReportQuery is a grouped count over stored files or upload sessions
+type ReportQuery struct {
+	Source  string              // ReportStoredFiles or ReportSessions
+	GroupBy []string            // any of "user", "status", "drive" (stored files only), "day", "week", "month"
+	UserID  *primitive.ObjectID // only this user's documents
+	Status  string              // only documents with this status
+	From    time.Time           // created at or after, zero for no bound
+	To      time.Time           // created before, zero for no bound
+	Limit   int                 // max groups, 0 for the maximum
+}
+
+// ReportRow is one group of a report. Grouping by drive counts chunks rather than files.
+type ReportRow struct {
+	Group map[string]interface{} `bson:"_id" json:"group"`
+	Count int64                  `bson:"count" json:"count"`
+	Bytes int64                  `bson:"bytes" json:"bytes"`
+}
+
+// dateBucketFormats are $dateToString formats for the date groupings
+var dateBucketFormats = map[string]string{
+	"day":   "%Y-%m-%d",
+	"week":  "%G-W%V",
+	"month": "%Y-%m",
+}
+
+// RunReport runs a report query
+func RunReport(ctx context.Context, q ReportQuery) ([]ReportRow, error) {
+	return backend.RunReport(ctx, q)
+}
+
+// reportDoc is the part of a stored file or session a report looks at
+type reportDoc struct {
+	userID    primitive.ObjectID
+	status    string
+	createdAt time.Time
+	size      int64
+	chunks    []models.StoredChunk
+}
+
+// buildReport groups docs in Go, for the stores that have no aggregation pipeline
+func buildReport(q ReportQuery, docs []reportDoc) ([]ReportRow, error) {
+	byDrive := false
+	for _, g := range q.GroupBy {
+		switch g {
+		case "user", "status", "day", "week", "month":
+		case "drive":
+			if q.Source != ReportStoredFiles {
+				return nil, fmt.Errorf("%w: drive grouping needs source %s", ErrInvalidReport, ReportStoredFiles)
+			}
+			byDrive = true
+		default:
+			return nil, fmt.Errorf("%w: unknown grouping %q", ErrInvalidReport, g)
+		}
+	}
+
+	groups := make(map[string]*ReportRow)
+	add := func(d reportDoc, chunk *models.StoredChunk, size int64) {
+		group := make(map[string]interface{}, len(q.GroupBy))
+		var key strings.Builder
+		for _, g := range q.GroupBy {
+			var v interface{}
+			switch g {
+			case "user":
+				v = d.userID
+			case "status":
+				v = d.status
+			case "drive":
+				v = chunk.DriveAccountID
+			case "day":
+				v = d.createdAt.UTC().Format("2006-01-02")
+			case "week":
+				year, week := d.createdAt.UTC().ISOWeek()
+				v = fmt.Sprintf("%d-W%02d", year, week)
+			case "month":
+				v = d.createdAt.UTC().Format("2006-01")
+			}
+			group[g] = v
+			if id, ok := v.(primitive.ObjectID); ok {
+				v = id.Hex()
+			}
+			fmt.Fprintf(&key, "%s=%v\x00", g, v)
+		}
+		row, ok := groups[key.String()]
+		if !ok {
+			row = &ReportRow{Group: group}
+			groups[key.String()] = row
+		}
+		row.Count++
+		row.Bytes += size
+	}
+	for _, d := range docs {
+		if q.UserID != nil && d.userID != *q.UserID {
+			continue
+		}
+		if q.Status != "" && d.status != q.Status {
+			continue
+		}
+		if (!q.From.IsZero() && d.createdAt.Before(q.From)) || (!q.To.IsZero() && !d.createdAt.Before(q.To)) {
+			continue
+		}
+		if !byDrive {
+			add(d, nil, d.size)
+			continue
+		}
+		for i := range d.chunks {
+			add(d, &d.chunks[i], d.chunks[i].Size)
+		}
+	}
+
+	keys := make([]string, 0, len(groups))
+	for k := range groups {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+	limit := q.Limit
+	if limit <= 0 || limit > maxReportRows {
+		limit = maxReportRows
+	}
+	rows := []ReportRow{}
+	for _, k := range keys[:min(limit, len(keys))] {
+		rows = append(rows, *groups[k])
+	}
+	return rows, nil
+}
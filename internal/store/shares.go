@@ -0,0 +1,59 @@
+package store
+
+import (
+	"SE/internal/models"
+	"context"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Files shared with other users
+var sharesCol *mongo.Collection
+
+func initSharesCollection(ctx context.Context) {
+	sharesCol = db.Collection("file_shares")
+	_, _ = sharesCol.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "file_id", Value: 1}, {Key: "user_id", Value: 1}},
+			Options: options.Index().SetUnique(true),
+		},
+		{Keys: bson.D{{Key: "user_id", Value: 1}, {Key: "created_at", Value: -1}}},
+	})
+}
+
+// CreateFileShare shares a file of ownerID with userID. Returns false if it already is.
+func CreateFileShare(ctx context.Context, ownerID, fileID, userID primitive.ObjectID) (*models.FileShare, bool, error) {
+	share := &models.FileShare{ID: primitive.NewObjectID(), FileID: fileID, OwnerID: ownerID, UserID: userID, CreatedAt: time.Now().UTC()}
+	created, err := backend.CreateFileShare(ctx, share)
+	return share, created, err
+}
+
+// GetFileShare returns the share of a file with userID, nil if it isn't shared with them
+func GetFileShare(ctx context.Context, fileID, userID primitive.ObjectID) (*models.FileShare, error) {
+	return backend.GetFileShare(ctx, fileID, userID)
+}
+
+// ListFileShares returns who a file is shared with, oldest share first
+func ListFileShares(ctx context.Context, fileID primitive.ObjectID) ([]*models.FileShare, error) {
+	return backend.ListFileShares(ctx, fileID)
+}
+
+// ListUserShares returns the files shared with userID, newest share first
+func ListUserShares(ctx context.Context, userID primitive.ObjectID) ([]*models.FileShare, error) {
+	return backend.ListUserShares(ctx, userID)
+}
+
+// DeleteFileShare revokes the share of a file of ownerID with userID. Returns false if there
+// was none.
+func DeleteFileShare(ctx context.Context, ownerID, fileID, userID primitive.ObjectID) (bool, error) {
+	return backend.DeleteFileShare(ctx, ownerID, fileID, userID)
+}
+
+// DeleteFileShares revokes every share of a file, for when it is purged
+func DeleteFileShares(ctx context.Context, fileID primitive.ObjectID) error {
+	return backend.DeleteFileShares(ctx, fileID)
+}
@@ -0,0 +1,1359 @@
+package store
+
+import (
+	"SE/internal/models"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	_ "modernc.org/sqlite"
+)
+
+// sqliteSweepInterval is how often expired documents are deleted, as often as Mongo's TTL monitor runs
+const sqliteSweepInterval = time.Minute
+
+// sqliteStore is the SQLite counterpart of the Mongo collections, for STORE_DRIVER=sqlite.
+// Each table keeps the whole document as BSON, next to the fields queries filter and sort on
+// as indexed columns. It is meant for single-node deployments: a server, and workers on the
+// same machine at most.
+type sqliteStore struct {
+	db   *sql.DB
+	stop chan struct{}
+}
+
+// sqliteSchema creates the tables and indexes; every statement can run again on an existing file
+var sqliteSchema = []string{
+	`CREATE TABLE IF NOT EXISTS users (id TEXT PRIMARY KEY, email TEXT NOT NULL UNIQUE, created_at INTEGER, doc BLOB NOT NULL)`,
+	`CREATE TABLE IF NOT EXISTS oauth_states (state TEXT PRIMARY KEY, created_at INTEGER, doc BLOB NOT NULL)`,
+	`CREATE TABLE IF NOT EXISTS upload_sessions (id TEXT PRIMARY KEY, user_id TEXT, batch_id TEXT, status TEXT, created_at INTEGER, updated_at INTEGER, expires_at INTEGER, total_size INTEGER, doc BLOB NOT NULL)`,
+	`CREATE INDEX IF NOT EXISTS upload_sessions_user ON upload_sessions (user_id, created_at)`,
+	`CREATE INDEX IF NOT EXISTS upload_sessions_batch ON upload_sessions (batch_id)`,
+	`CREATE INDEX IF NOT EXISTS upload_sessions_status ON upload_sessions (status, updated_at)`,
+	`CREATE INDEX IF NOT EXISTS upload_sessions_expires ON upload_sessions (expires_at)`,
+	`CREATE TABLE IF NOT EXISTS stored_files (id TEXT PRIMARY KEY, user_id TEXT, status TEXT, created_at INTEGER, last_scrubbed_at INTEGER, original_size INTEGER, doc BLOB NOT NULL)`,
+	`CREATE INDEX IF NOT EXISTS stored_files_user ON stored_files (user_id, created_at)`,
+	`CREATE INDEX IF NOT EXISTS stored_files_scrub ON stored_files (status, last_scrubbed_at)`,
+	`CREATE TABLE IF NOT EXISTS folders (id TEXT PRIMARY KEY, user_id TEXT, path TEXT, created_at INTEGER, doc BLOB NOT NULL, UNIQUE (user_id, path))`,
+	`CREATE TABLE IF NOT EXISTS file_shares (id TEXT PRIMARY KEY, file_id TEXT, owner_id TEXT, user_id TEXT, created_at INTEGER, doc BLOB NOT NULL, UNIQUE (file_id, user_id))`,
+	`CREATE INDEX IF NOT EXISTS file_shares_user ON file_shares (user_id, created_at)`,
+	`CREATE TABLE IF NOT EXISTS public_links (id TEXT PRIMARY KEY, token_hash TEXT NOT NULL UNIQUE, user_id TEXT, file_id TEXT, created_at INTEGER, doc BLOB NOT NULL)`,
+	`CREATE INDEX IF NOT EXISTS public_links_user ON public_links (user_id, created_at)`,
+	`CREATE INDEX IF NOT EXISTS public_links_file ON public_links (file_id)`,
+	`CREATE TABLE IF NOT EXISTS processing_jobs (id TEXT PRIMARY KEY, session_id TEXT, status TEXT, fast_lane INTEGER, lease_owner TEXT, lease_expires_at INTEGER, created_at INTEGER, doc BLOB NOT NULL)`,
+	`CREATE INDEX IF NOT EXISTS processing_jobs_claim ON processing_jobs (status, fast_lane, created_at)`,
+	`CREATE INDEX IF NOT EXISTS processing_jobs_session ON processing_jobs (session_id, created_at)`,
+	`CREATE TABLE IF NOT EXISTS invites (id TEXT PRIMARY KEY, code_hash TEXT NOT NULL UNIQUE, created_at INTEGER, doc BLOB NOT NULL)`,
+	`CREATE TABLE IF NOT EXISTS used_download_links (id TEXT PRIMARY KEY, expires_at INTEGER)`,
+	`CREATE INDEX IF NOT EXISTS used_download_links_expires ON used_download_links (expires_at)`,
+	`CREATE TABLE IF NOT EXISTS refresh_tokens (token_hash TEXT PRIMARY KEY, family_id TEXT, user_id TEXT, login_at INTEGER, expires_at INTEGER, doc BLOB NOT NULL)`,
+	`CREATE INDEX IF NOT EXISTS refresh_tokens_family ON refresh_tokens (family_id)`,
+	`CREATE INDEX IF NOT EXISTS refresh_tokens_user ON refresh_tokens (user_id)`,
+	`CREATE INDEX IF NOT EXISTS refresh_tokens_expires ON refresh_tokens (expires_at)`,
+	`CREATE TABLE IF NOT EXISTS audit_log (id TEXT PRIMARY KEY, user_id TEXT, action TEXT, created_at INTEGER, expires_at INTEGER, doc BLOB NOT NULL)`,
+	`CREATE INDEX IF NOT EXISTS audit_log_user ON audit_log (user_id, id)`,
+	`CREATE INDEX IF NOT EXISTS audit_log_expires ON audit_log (expires_at)`,
+	`CREATE TABLE IF NOT EXISTS drive_api_usage (day TEXT, account_id TEXT, operation TEXT, count INTEGER, PRIMARY KEY (day, account_id, operation))`,
+}
+
+// sqliteTTL lists what the sweeper deletes: the same documents Mongo's TTL indexes expire
+var sqliteTTL = []struct {
+	table, column string
+	after         time.Duration // how long after the column's time
+}{
+	{"upload_sessions", "expires_at", 0},
+	{"oauth_states", "created_at", oauthStateTTL},
+	{"used_download_links", "expires_at", 0},
+	{"refresh_tokens", "expires_at", 0},
+	{"audit_log", "expires_at", 0},
+}
+
+// SQLitePath is the database file, SQLITE_PATH or drive_backend.db in the working directory
+func SQLitePath() string {
+	if path := os.Getenv("SQLITE_PATH"); path != "" {
+		return path
+	}
+	return "drive_backend.db"
+}
+
+// openSQLite opens the database file, creating it and its tables if they don't exist. Its
+// directory must exist.
+func openSQLite(ctx context.Context, path string) (*sqliteStore, error) {
+	// Transactions take the write lock when they begin, so two processes can't both read a
+	// document and then overwrite each other's change
+	db, err := sql.Open("sqlite", "file:"+path+"?_txlock=immediate&_pragma=busy_timeout(10000)&_pragma=journal_mode(WAL)&_pragma=synchronous(NORMAL)")
+	if err != nil {
+		return nil, err
+	}
+	// One connection serializes this process's writes, which SQLite would do anyway
+	db.SetMaxOpenConns(1)
+	for _, stmt := range sqliteSchema {
+		if _, err := db.ExecContext(ctx, stmt); err != nil {
+			db.Close()
+			return nil, fmt.Errorf("sqlite schema: %w", err)
+		}
+	}
+	s := &sqliteStore{db: db, stop: make(chan struct{})}
+	go s.sweepLoop()
+	return s, nil
+}
+
+// CheckSQLite opens the SQLITE_PATH database without changing it and reports the tables
+// InitStore would still have to create. A missing file only needs a writable directory.
+func CheckSQLite(ctx context.Context) (string, []string, error) {
+	path := SQLitePath()
+	if _, err := os.Stat(path); errors.Is(err, os.ErrNotExist) {
+		dir := filepath.Dir(path)
+		f, err := os.CreateTemp(dir, ".sqlite-check-*")
+		if err != nil {
+			return path, nil, fmt.Errorf("%s doesn't exist and can't be created: %w", path, err)
+		}
+		f.Close()
+		os.Remove(f.Name())
+		return path, []string{"all tables"}, nil
+	}
+
+	db, err := sql.Open("sqlite", "file:"+path+"?mode=ro&_pragma=busy_timeout(10000)")
+	if err != nil {
+		return path, nil, err
+	}
+	defer db.Close()
+	rows, err := db.QueryContext(ctx, `SELECT name FROM sqlite_master WHERE type = 'table'`)
+	if err != nil {
+		return path, nil, err
+	}
+	defer rows.Close()
+	present := make(map[string]bool)
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return path, nil, err
+		}
+		present[name] = true
+	}
+	if err := rows.Err(); err != nil {
+		return path, nil, err
+	}
+	var missing []string
+	for _, stmt := range sqliteSchema {
+		if name, ok := strings.CutPrefix(stmt, "CREATE TABLE IF NOT EXISTS "); ok {
+			name, _, _ = strings.Cut(name, " ")
+			if !present[name] {
+				missing = append(missing, name)
+			}
+		}
+	}
+	return path, missing, nil
+}
+
+// sweepLoop deletes expired documents until the store is closed
+func (s *sqliteStore) sweepLoop() {
+	ticker := time.NewTicker(sqliteSweepInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-ticker.C:
+			if err := s.sweep(context.Background(), time.Now()); err != nil {
+				log.Printf("sqlite: sweep expired documents: %v", err)
+			}
+		}
+	}
+}
+
+// sweep deletes the documents that expired by now
+func (s *sqliteStore) sweep(ctx context.Context, now time.Time) error {
+	for _, ttl := range sqliteTTL {
+		if _, err := s.db.ExecContext(ctx, "DELETE FROM "+ttl.table+" WHERE "+ttl.column+" < ?", now.Add(-ttl.after).UnixMilli()); err != nil {
+			return fmt.Errorf("%s: %w", ttl.table, err)
+		}
+	}
+	return nil
+}
+
+func (s *sqliteStore) close() error {
+	close(s.stop)
+	return s.db.Close()
+}
+
+// sqlID is an ObjectID as a column value, NULL for the zero ID
+func sqlID(id primitive.ObjectID) interface{} {
+	if id.IsZero() {
+		return nil
+	}
+	return id.Hex()
+}
+
+// sqlTime is a time as a column value in Unix milliseconds, the precision BSON keeps, NULL for the zero time
+func sqlTime(t time.Time) interface{} {
+	if t.IsZero() {
+		return nil
+	}
+	return t.UnixMilli()
+}
+
+func sqlTimePtr(t *time.Time) interface{} {
+	if t == nil {
+		return nil
+	}
+	return sqlTime(*t)
+}
+
+// sqlQuerier is a database or a transaction
+type sqlQuerier interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+// sqliteTable keeps documents of type T: the document as BSON, and its columns for queries
+type sqliteTable[T any] struct {
+	name    string
+	columns []string                 // the primary key first
+	values  func(d *T) []interface{} // a document's column values, in the order of columns
+}
+
+var (
+	liteUsers = sqliteTable[models.User]{"users", []string{"id", "email", "created_at"}, func(u *models.User) []interface{} {
+		return []interface{}{u.ID.Hex(), u.Email, sqlTime(u.CreatedAt)}
+	}}
+	liteStates = sqliteTable[models.OAuthState]{"oauth_states", []string{"state", "created_at"}, func(s *models.OAuthState) []interface{} {
+		return []interface{}{s.State, sqlTime(s.CreatedAt)}
+	}}
+	liteSessions = sqliteTable[models.UploadSession]{"upload_sessions", []string{"id", "user_id", "batch_id", "status", "created_at", "updated_at", "expires_at", "total_size"}, func(s *models.UploadSession) []interface{} {
+		return []interface{}{s.ID.Hex(), sqlID(s.UserID), sqlID(s.BatchID), s.Status, sqlTime(s.CreatedAt), sqlTime(s.UpdatedAt), sqlTime(s.ExpiresAt), s.TotalSize}
+	}}
+	liteFiles = sqliteTable[models.StoredFile]{"stored_files", []string{"id", "user_id", "status", "created_at", "last_scrubbed_at", "original_size"}, func(f *models.StoredFile) []interface{} {
+		return []interface{}{f.ID.Hex(), sqlID(f.UserID), f.Status, sqlTime(f.CreatedAt), sqlTimePtr(f.LastScrubbedAt), f.OriginalSize}
+	}}
+	liteFolders = sqliteTable[models.Folder]{"folders", []string{"id", "user_id", "path", "created_at"}, func(f *models.Folder) []interface{} {
+		return []interface{}{f.ID.Hex(), sqlID(f.UserID), f.Path, sqlTime(f.CreatedAt)}
+	}}
+	liteShares = sqliteTable[models.FileShare]{"file_shares", []string{"id", "file_id", "owner_id", "user_id", "created_at"}, func(s *models.FileShare) []interface{} {
+		return []interface{}{s.ID.Hex(), sqlID(s.FileID), sqlID(s.OwnerID), sqlID(s.UserID), sqlTime(s.CreatedAt)}
+	}}
+	litePublicLinks = sqliteTable[models.PublicLink]{"public_links", []string{"id", "token_hash", "user_id", "file_id", "created_at"}, func(l *models.PublicLink) []interface{} {
+		return []interface{}{l.ID.Hex(), l.TokenHash, sqlID(l.UserID), sqlID(l.FileID), sqlTime(l.CreatedAt)}
+	}}
+	liteJobs = sqliteTable[models.ProcessingJob]{"processing_jobs", []string{"id", "session_id", "status", "fast_lane", "lease_owner", "lease_expires_at", "created_at"}, func(j *models.ProcessingJob) []interface{} {
+		return []interface{}{j.ID.Hex(), sqlID(j.SessionID), j.Status, j.FastLane, j.LeaseOwner, sqlTime(j.LeaseExpiresAt), sqlTime(j.CreatedAt)}
+	}}
+	liteInvites = sqliteTable[models.Invite]{"invites", []string{"id", "code_hash", "created_at"}, func(inv *models.Invite) []interface{} {
+		return []interface{}{inv.ID.Hex(), inv.CodeHash, sqlTime(inv.CreatedAt)}
+	}}
+	liteTokens = sqliteTable[models.RefreshToken]{"refresh_tokens", []string{"token_hash", "family_id", "user_id", "login_at", "expires_at"}, func(t *models.RefreshToken) []interface{} {
+		return []interface{}{t.TokenHash, sqlID(t.FamilyID), sqlID(t.UserID), sqlTime(t.LoginAt), sqlTime(t.ExpiresAt)}
+	}}
+	liteAudit = sqliteTable[models.AuditEvent]{"audit_log", []string{"id", "user_id", "action", "created_at", "expires_at"}, func(e *models.AuditEvent) []interface{} {
+		return []interface{}{e.ID.Hex(), sqlID(e.UserID), e.Action, sqlTime(e.CreatedAt), sqlTime(e.ExpiresAt)}
+	}}
+)
+
+// get returns the first document matching where, which may end in ORDER BY, or nil
+func (t sqliteTable[T]) get(ctx context.Context, q sqlQuerier, where string, args ...interface{}) (*T, error) {
+	var data []byte
+	err := q.QueryRowContext(ctx, "SELECT doc FROM "+t.name+" WHERE "+where+" LIMIT 1", args...).Scan(&data)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var d T
+	if err := bson.Unmarshal(data, &d); err != nil {
+		return nil, err
+	}
+	return &d, nil
+}
+
+// find returns the documents matching where, which may end in ORDER BY and LIMIT
+func (t sqliteTable[T]) find(ctx context.Context, q sqlQuerier, where string, args ...interface{}) ([]*T, error) {
+	rows, err := q.QueryContext(ctx, "SELECT doc FROM "+t.name+" WHERE "+where, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := []*T{}
+	for rows.Next() {
+		var data []byte
+		if err := rows.Scan(&data); err != nil {
+			return nil, err
+		}
+		var d T
+		if err := bson.Unmarshal(data, &d); err != nil {
+			return nil, err
+		}
+		out = append(out, &d)
+	}
+	return out, rows.Err()
+}
+
+// insert adds a document; verb is INSERT, or INSERT OR REPLACE to overwrite one with the same key
+func (t sqliteTable[T]) insert(ctx context.Context, q sqlQuerier, verb string, d *T) error {
+	data, err := bson.Marshal(d)
+	if err != nil {
+		return err
+	}
+	placeholders := strings.Repeat("?, ", len(t.columns)) + "?"
+	_, err = q.ExecContext(ctx, verb+" INTO "+t.name+" ("+strings.Join(t.columns, ", ")+", doc) VALUES ("+placeholders+")",
+		append(t.values(d), data)...)
+	return err
+}
+
+// save writes a changed document over the stored one
+func (t sqliteTable[T]) save(ctx context.Context, q sqlQuerier, d *T) error {
+	data, err := bson.Marshal(d)
+	if err != nil {
+		return err
+	}
+	values := t.values(d)
+	set := make([]string, 0, len(t.columns))
+	for _, c := range t.columns[1:] {
+		set = append(set, c+" = ?")
+	}
+	set = append(set, "doc = ?")
+	args := append(values[1:], data, values[0])
+	_, err = q.ExecContext(ctx, "UPDATE "+t.name+" SET "+strings.Join(set, ", ")+" WHERE "+t.columns[0]+" = ?", args...)
+	return err
+}
+
+// update applies fn to the first document matching where and saves it, in one transaction.
+// fn returns whether the document matched; the result is the saved document, or nil when
+// there was none or it didn't match.
+func (t sqliteTable[T]) update(ctx context.Context, db *sql.DB, fn func(d *T) bool, where string, args ...interface{}) (*T, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	d, err := t.get(ctx, tx, where, args...)
+	if err != nil || d == nil || !fn(d) {
+		return nil, err
+	}
+	if err := t.save(ctx, tx, d); err != nil {
+		return nil, err
+	}
+	return d, tx.Commit()
+}
+
+// updateAll applies fn to every document matching where and saves those it matched, in one
+// transaction. Returns how many it saved.
+func (t sqliteTable[T]) updateAll(ctx context.Context, db *sql.DB, fn func(d *T) bool, where string, args ...interface{}) (int64, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	docs, err := t.find(ctx, tx, where, args...)
+	if err != nil {
+		return 0, err
+	}
+	var n int64
+	for _, d := range docs {
+		if !fn(d) {
+			continue
+		}
+		if err := t.save(ctx, tx, d); err != nil {
+			return 0, err
+		}
+		n++
+	}
+	return n, tx.Commit()
+}
+
+// delete removes the documents matching where and returns how many there were
+func (t sqliteTable[T]) delete(ctx context.Context, q sqlQuerier, where string, args ...interface{}) (int64, error) {
+	res, err := q.ExecContext(ctx, "DELETE FROM "+t.name+" WHERE "+where, args...)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// count counts the documents matching where
+func (t sqliteTable[T]) count(ctx context.Context, q sqlQuerier, where string, args ...interface{}) (int64, error) {
+	var n int64
+	err := q.QueryRowContext(ctx, "SELECT COUNT(*) FROM "+t.name+" WHERE "+where, args...).Scan(&n)
+	return n, err
+}
+
+// Users
+
+func (s *sqliteStore) FindUserByEmail(ctx context.Context, email string) (*models.User, error) {
+	return liteUsers.get(ctx, s.db, "email = ?", email)
+}
+
+func (s *sqliteStore) GetUserByID(ctx context.Context, userID primitive.ObjectID) (*models.User, error) {
+	return liteUsers.get(ctx, s.db, "id = ?", userID.Hex())
+}
+
+func (s *sqliteStore) ListUsers(ctx context.Context) ([]*models.User, error) {
+	return liteUsers.find(ctx, s.db, "1 = 1 ORDER BY created_at DESC")
+}
+
+func (s *sqliteStore) CreateUser(ctx context.Context, u *models.User) error {
+	return liteUsers.insert(ctx, s.db, "INSERT", u)
+}
+
+// updateUser applies fn to a stored user. Returns false if there is no such user.
+func (s *sqliteStore) updateUser(ctx context.Context, userID primitive.ObjectID, fn func(u *models.User)) (bool, error) {
+	u, err := liteUsers.update(ctx, s.db, func(u *models.User) bool {
+		fn(u)
+		return true
+	}, "id = ?", userID.Hex())
+	return u != nil, err
+}
+
+func (s *sqliteStore) SetUserNotificationChannels(ctx context.Context, userID primitive.ObjectID, channels []models.NotificationChannel) error {
+	_, err := s.updateUser(ctx, userID, func(u *models.User) { u.NotificationChannels = channels })
+	return err
+}
+
+func (s *sqliteStore) SetUserPlacementPolicy(ctx context.Context, userID primitive.ObjectID, policy models.PlacementPolicy) error {
+	_, err := s.updateUser(ctx, userID, func(u *models.User) { u.PlacementPolicy = &policy })
+	return err
+}
+
+func (s *sqliteStore) SetUserPreferences(ctx context.Context, userID primitive.ObjectID, prefs models.UserPreferences) error {
+	_, err := s.updateUser(ctx, userID, func(u *models.User) { u.Preferences = &prefs })
+	return err
+}
+
+func (s *sqliteStore) SetUserStorageQuota(ctx context.Context, userID primitive.ObjectID, quota int64) (bool, error) {
+	return s.updateUser(ctx, userID, func(u *models.User) { u.StorageQuota = quota })
+}
+
+func (s *sqliteStore) SetUserPassword(ctx context.Context, userID primitive.ObjectID, passHash []byte, tokensValidAfter time.Time) error {
+	_, err := s.updateUser(ctx, userID, func(u *models.User) {
+		u.PasswordsHash = passHash
+		u.TokensValidAfter = &tokensValidAfter
+	})
+	return err
+}
+
+func (s *sqliteStore) SetUserRole(ctx context.Context, userID primitive.ObjectID, role string) (bool, error) {
+	return s.updateUser(ctx, userID, func(u *models.User) { u.Role = role })
+}
+
+func (s *sqliteStore) SetUserEmailVerified(ctx context.Context, userID primitive.ObjectID) error {
+	_, err := s.updateUser(ctx, userID, func(u *models.User) { u.EmailVerified = true })
+	return err
+}
+
+func (s *sqliteStore) InsertOAuthState(ctx context.Context, state *models.OAuthState) error {
+	return liteStates.insert(ctx, s.db, "INSERT OR REPLACE", state)
+}
+
+func (s *sqliteStore) FindAndDeleteState(ctx context.Context, state string) (*models.OAuthState, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	st, err := liteStates.get(ctx, tx, "state = ?", state)
+	if err != nil || st == nil {
+		return nil, err
+	}
+	if _, err := liteStates.delete(ctx, tx, "state = ?", state); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	// Expired but not swept yet
+	if time.Since(st.CreatedAt) > oauthStateTTL {
+		return nil, nil
+	}
+	return st, nil
+}
+
+// Drive accounts, kept in their user's document
+
+func (s *sqliteStore) AddDriveAccountToUser(ctx context.Context, userID primitive.ObjectID, acct models.DriveAccount) error {
+	_, err := s.updateUser(ctx, userID, func(u *models.User) { u.DriveAccounts = append(u.DriveAccounts, acct) })
+	return err
+}
+
+// GetDriveAccountByID looks through every user, of which a single-node deployment has few
+func (s *sqliteStore) GetDriveAccountByID(ctx context.Context, accountID primitive.ObjectID) (*models.DriveAccount, error) {
+	users, err := liteUsers.find(ctx, s.db, "1 = 1")
+	if err != nil {
+		return nil, err
+	}
+	for _, u := range users {
+		for _, acc := range u.DriveAccounts {
+			if acc.ID == accountID {
+				return &acc, nil
+			}
+		}
+	}
+	return nil, mongo.ErrNoDocuments
+}
+
+func (s *sqliteStore) UpdateDriveAccountToken(ctx context.Context, accountID primitive.ObjectID, encryptedToken []byte, refreshedAt time.Time) error {
+	_, err := liteUsers.updateAll(ctx, s.db, func(u *models.User) bool {
+		for i := range u.DriveAccounts {
+			if u.DriveAccounts[i].ID == accountID {
+				u.DriveAccounts[i].EncryptedToken = encryptedToken
+				u.DriveAccounts[i].TokenRefreshedAt = &refreshedAt
+				return true
+			}
+		}
+		return false
+	}, "1 = 1")
+	return err
+}
+
+func (s *sqliteStore) UpdateDriveAccountLabel(ctx context.Context, userID, accountID primitive.ObjectID, label, color *string) (bool, error) {
+	found := false
+	_, err := s.updateUser(ctx, userID, func(u *models.User) {
+		for i := range u.DriveAccounts {
+			if u.DriveAccounts[i].ID == accountID {
+				found = true
+				if label != nil {
+					u.DriveAccounts[i].Label = *label
+				}
+				if color != nil {
+					u.DriveAccounts[i].Color = *color
+				}
+			}
+		}
+	})
+	return found, err
+}
+
+// Upload sessions
+
+func (s *sqliteStore) CreateUploadSessions(ctx context.Context, sessions []*models.UploadSession) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, session := range sessions {
+		if err := liteSessions.insert(ctx, tx, "INSERT", session); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *sqliteStore) GetBatchSessions(ctx context.Context, batchID primitive.ObjectID) ([]*models.UploadSession, error) {
+	return liteSessions.find(ctx, s.db, "batch_id = ? ORDER BY id", batchID.Hex())
+}
+
+func (s *sqliteStore) GetUploadSession(ctx context.Context, sessionID primitive.ObjectID) (*models.UploadSession, error) {
+	return liteSessions.get(ctx, s.db, "id = ?", sessionID.Hex())
+}
+
+// updateSession applies fn to a stored session if it matches, like the memory store's
+func (s *sqliteStore) updateSession(ctx context.Context, sessionID primitive.ObjectID, fn func(s *models.UploadSession) bool) (*models.UploadSession, error) {
+	return liteSessions.update(ctx, s.db, fn, "id = ?", sessionID.Hex())
+}
+
+// setSession applies fn to a stored session, if there is one
+func (s *sqliteStore) setSession(ctx context.Context, sessionID primitive.ObjectID, fn func(s *models.UploadSession)) error {
+	_, err := s.updateSession(ctx, sessionID, func(s *models.UploadSession) bool {
+		fn(s)
+		return true
+	})
+	return err
+}
+
+func (s *sqliteStore) AddSessionReceivedRange(ctx context.Context, sessionID primitive.ObjectID, r models.ByteRange) (*models.UploadSession, error) {
+	session, err := s.updateSession(ctx, sessionID, func(s *models.UploadSession) bool {
+		s.ReceivedRanges = append(s.ReceivedRanges, r)
+		return true
+	})
+	if err == nil && session == nil {
+		err = mongo.ErrNoDocuments
+	}
+	return session, err
+}
+
+func (s *sqliteStore) CompactSessionRanges(ctx context.Context, sessionID primitive.ObjectID, seen int, merged []models.ByteRange, uploadedSize int64) error {
+	return s.setSession(ctx, sessionID, func(s *models.UploadSession) {
+		s.UploadedSize = max(s.UploadedSize, uploadedSize)
+		if len(s.ReceivedRanges) == seen {
+			s.ReceivedRanges = merged
+		}
+	})
+}
+
+func (s *sqliteStore) UpdateSessionStatus(ctx context.Context, sessionID primitive.ObjectID, status string, progress float64, errorMsg string) error {
+	return s.setSession(ctx, sessionID, func(s *models.UploadSession) {
+		s.Status = status
+		s.ProcessingProgress = progress
+		s.UpdatedAt = time.Now()
+		if errorMsg != "" {
+			s.ErrorMessage = errorMsg
+		}
+	})
+}
+
+func (s *sqliteStore) CompleteSession(ctx context.Context, sessionID primitive.ObjectID, file *models.StoredFile, keyFilePath string, replace bool, completedAt time.Time) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	verb := "INSERT"
+	if replace {
+		verb = "INSERT OR REPLACE"
+	}
+	if err := liteFiles.insert(ctx, tx, verb, file); err != nil {
+		return err
+	}
+	session, err := liteSessions.get(ctx, tx, "id = ?", sessionID.Hex())
+	if err != nil {
+		return err
+	}
+	if session != nil {
+		completeSession(session, file.ID, keyFilePath, completedAt)
+		if err := liteSessions.save(ctx, tx, session); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *sqliteStore) CountActiveUserSessions(ctx context.Context, userID primitive.ObjectID) (int, error) {
+	// A batch counts as a single upload
+	var n int
+	err := s.db.QueryRowContext(ctx, `SELECT COUNT(DISTINCT COALESCE(batch_id, id)) FROM upload_sessions
+		WHERE user_id = ? AND status IN ('uploading', 'processing', 'paused')`, userID.Hex()).Scan(&n)
+	return n, err
+}
+
+func (s *sqliteStore) GetExpiredSessions(ctx context.Context) ([]*models.UploadSession, error) {
+	return liteSessions.find(ctx, s.db, "expires_at < ? AND status IN ('uploading', 'processing')", time.Now().UnixMilli())
+}
+
+func (s *sqliteStore) ListUserSessions(ctx context.Context, userID primitive.ObjectID, status string) ([]*models.UploadSession, error) {
+	return liteSessions.find(ctx, s.db, "user_id = ? AND (? = '' OR status = ?) ORDER BY created_at DESC", userID.Hex(), status, status)
+}
+
+func (s *sqliteStore) ListSessions(ctx context.Context, status string, limit int) ([]*models.UploadSession, error) {
+	return liteSessions.find(ctx, s.db, "(? = '' OR status = ?) ORDER BY created_at DESC LIMIT ?", status, status, limit)
+}
+
+func (s *sqliteStore) DeleteIdleUploadSession(ctx context.Context, sessionID primitive.ObjectID) (bool, error) {
+	n, err := liteSessions.delete(ctx, s.db, "id = ? AND status != 'processing'", sessionID.Hex())
+	return n > 0, err
+}
+
+func (s *sqliteStore) DeleteUploadSession(ctx context.Context, sessionID primitive.ObjectID) error {
+	_, err := liteSessions.delete(ctx, s.db, "id = ?", sessionID.Hex())
+	return err
+}
+
+func (s *sqliteStore) UpdateSessionFileID(ctx context.Context, sessionID, fileID primitive.ObjectID) error {
+	return s.setSession(ctx, sessionID, func(s *models.UploadSession) { s.FileID = fileID })
+}
+
+func (s *sqliteStore) TouchUploadSession(ctx context.Context, sessionID primitive.ObjectID) error {
+	return s.setSession(ctx, sessionID, func(s *models.UploadSession) { s.UpdatedAt = time.Now() })
+}
+
+func (s *sqliteStore) ExtendSessionExpiry(ctx context.Context, sessionID primitive.ObjectID, until time.Time, statuses []string) (*models.UploadSession, error) {
+	now := time.Now()
+	return s.updateSession(ctx, sessionID, func(s *models.UploadSession) bool {
+		if !slices.Contains(statuses, s.Status) || !s.ExpiresAt.After(now) {
+			return false
+		}
+		if until.After(s.ExpiresAt) {
+			s.ExpiresAt = until
+		}
+		return true
+	})
+}
+
+func (s *sqliteStore) ExtendProcessingSessions(ctx context.Context, until time.Time) (int64, error) {
+	return liteSessions.updateAll(ctx, s.db, func(s *models.UploadSession) bool {
+		s.ExpiresAt = until
+		return true
+	}, "status = 'processing' AND expires_at < ?", until.UnixMilli())
+}
+
+func (s *sqliteStore) RequestSessionPause(ctx context.Context, sessionID primitive.ObjectID) (bool, error) {
+	session, err := s.updateSession(ctx, sessionID, func(s *models.UploadSession) bool {
+		if s.Status != "processing" {
+			return false
+		}
+		s.PauseRequested = true
+		return true
+	})
+	return session != nil, err
+}
+
+func (s *sqliteStore) PauseSession(ctx context.Context, sessionID primitive.ObjectID, progress float64, message string) error {
+	return s.setSession(ctx, sessionID, func(s *models.UploadSession) {
+		s.Status = "paused"
+		s.ProcessingProgress = progress
+		s.ErrorMessage = message
+		s.UpdatedAt = time.Now()
+		s.PauseRequested = false
+	})
+}
+
+func (s *sqliteStore) ResumeSession(ctx context.Context, sessionID primitive.ObjectID) (bool, error) {
+	session, err := s.updateSession(ctx, sessionID, func(s *models.UploadSession) bool {
+		if s.Status != "paused" {
+			return false
+		}
+		s.Status = "processing"
+		s.ErrorMessage = "Resuming..."
+		s.UpdatedAt = time.Now()
+		s.PauseRequested = false
+		return true
+	})
+	return session != nil, err
+}
+
+func (s *sqliteStore) MarkSessionIncomplete(ctx context.Context, sessionID primitive.ObjectID, progress float64, message string, expiresAt time.Time) error {
+	return s.setSession(ctx, sessionID, func(s *models.UploadSession) {
+		s.Status = "incomplete"
+		s.ProcessingProgress = progress
+		s.ErrorMessage = message
+		s.UpdatedAt = time.Now()
+		s.ExpiresAt = expiresAt
+		s.PauseRequested = false
+	})
+}
+
+func (s *sqliteStore) RepairSession(ctx context.Context, sessionID primitive.ObjectID) (bool, error) {
+	session, err := s.updateSession(ctx, sessionID, func(s *models.UploadSession) bool {
+		if s.Status != "incomplete" {
+			return false
+		}
+		s.Status = "processing"
+		s.ErrorMessage = "Repairing..."
+		s.UpdatedAt = time.Now()
+		return true
+	})
+	return session != nil, err
+}
+
+func (s *sqliteStore) GetStalledSessions(ctx context.Context, cutoff time.Time) ([]*models.UploadSession, error) {
+	return liteSessions.find(ctx, s.db, "status = 'processing' AND updated_at < ?", cutoff.UnixMilli())
+}
+
+func (s *sqliteStore) CountStalledSessions(ctx context.Context, cutoff time.Time) (int64, error) {
+	return liteSessions.count(ctx, s.db, "status = 'processing' AND updated_at < ?", cutoff.UnixMilli())
+}
+
+func (s *sqliteStore) SetSessionPlanPreview(ctx context.Context, sessionID primitive.ObjectID, preview *models.PlanPreview) error {
+	return s.setSession(ctx, sessionID, func(s *models.UploadSession) { s.PlanPreview = preview })
+}
+
+func (s *sqliteStore) SetSessionCheckpoint(ctx context.Context, sessionID primitive.ObjectID, checkpoint *models.ProcessingCheckpoint) error {
+	return s.setSession(ctx, sessionID, func(s *models.UploadSession) { s.Checkpoint = checkpoint })
+}
+
+func (s *sqliteStore) AddCheckpointChunk(ctx context.Context, sessionID primitive.ObjectID, chunk models.ChunkMetadata) error {
+	_, err := s.updateSession(ctx, sessionID, func(s *models.UploadSession) bool {
+		if s.Checkpoint == nil {
+			return false
+		}
+		s.Checkpoint.Chunks = append(s.Checkpoint.Chunks, chunk)
+		return true
+	})
+	return err
+}
+
+func (s *sqliteStore) ClearSessionCheckpoint(ctx context.Context, sessionID primitive.ObjectID) error {
+	return s.setSession(ctx, sessionID, func(s *models.UploadSession) { s.Checkpoint = nil })
+}
+
+// Stored files
+
+func (s *sqliteStore) CreateStoredFile(ctx context.Context, file *models.StoredFile) error {
+	return liteFiles.insert(ctx, s.db, "INSERT", file)
+}
+
+func (s *sqliteStore) ReplaceStoredFile(ctx context.Context, file *models.StoredFile) error {
+	return liteFiles.insert(ctx, s.db, "INSERT OR REPLACE", file)
+}
+
+func (s *sqliteStore) GetStoredFile(ctx context.Context, fileID primitive.ObjectID) (*models.StoredFile, error) {
+	return liteFiles.get(ctx, s.db, "id = ?", fileID.Hex())
+}
+
+func (s *sqliteStore) ListUserStoredFiles(ctx context.Context, userID primitive.ObjectID, query StoredFileQuery) ([]*models.StoredFile, error) {
+	statuses := query.statuses()
+	args := []interface{}{userID.Hex()}
+	for _, status := range statuses {
+		args = append(args, status)
+	}
+	files, err := liteFiles.find(ctx, s.db, "user_id = ? AND status IN (?"+strings.Repeat(", ?", len(statuses)-1)+") ORDER BY created_at DESC", args...)
+	if err != nil {
+		return nil, err
+	}
+	matched := []*models.StoredFile{}
+	for _, f := range files {
+		if query.matches(f) {
+			matched = append(matched, f)
+		}
+	}
+	return query.page(matched), nil
+}
+
+// updateActiveStoredFile applies fn to an active file owned by userID. Returns false if no such file.
+func (s *sqliteStore) updateActiveStoredFile(ctx context.Context, userID, fileID primitive.ObjectID, fn func(f *models.StoredFile)) (bool, error) {
+	f, err := liteFiles.update(ctx, s.db, func(f *models.StoredFile) bool {
+		fn(f)
+		return true
+	}, "id = ? AND user_id = ? AND status = 'active'", fileID.Hex(), userID.Hex())
+	return f != nil, err
+}
+
+func (s *sqliteStore) SetStoredFileNotes(ctx context.Context, userID, fileID primitive.ObjectID, description *string, metadata map[string]string) (bool, error) {
+	return s.updateActiveStoredFile(ctx, userID, fileID, func(f *models.StoredFile) {
+		if description != nil {
+			f.Description = *description
+		}
+		if metadata != nil {
+			f.Metadata = metadata
+		}
+	})
+}
+
+func (s *sqliteStore) SetStoredFilePinned(ctx context.Context, userID, fileID primitive.ObjectID, pinned bool) (bool, error) {
+	return s.updateActiveStoredFile(ctx, userID, fileID, func(f *models.StoredFile) { f.Pinned = pinned })
+}
+
+func (s *sqliteStore) RenameStoredFile(ctx context.Context, userID, fileID primitive.ObjectID, filename string) (bool, error) {
+	return s.updateActiveStoredFile(ctx, userID, fileID, func(f *models.StoredFile) {
+		f.OriginalFilename = filename
+		f.NameLower = strings.ToLower(filename)
+		f.Path = models.FilePath(f.Folder, filename)
+	})
+}
+
+func (s *sqliteStore) AddStoredFileTags(ctx context.Context, userID, fileID primitive.ObjectID, tags []string) ([]string, bool, error) {
+	var out []string
+	found, err := s.updateActiveStoredFile(ctx, userID, fileID, func(f *models.StoredFile) {
+		f.Tags = addTags(f.Tags, tags)
+		out = f.Tags
+	})
+	return out, found, err
+}
+
+func (s *sqliteStore) RemoveStoredFileTags(ctx context.Context, userID, fileID primitive.ObjectID, tags []string) ([]string, bool, error) {
+	var out []string
+	found, err := s.updateActiveStoredFile(ctx, userID, fileID, func(f *models.StoredFile) {
+		f.Tags = removeTags(f.Tags, tags)
+		out = f.Tags
+	})
+	return out, found, err
+}
+
+func (s *sqliteStore) MoveStoredFile(ctx context.Context, userID, fileID primitive.ObjectID, folder string) (bool, error) {
+	return s.updateActiveStoredFile(ctx, userID, fileID, func(f *models.StoredFile) {
+		f.Folder = folder
+		f.Path = models.FilePath(folder, f.OriginalFilename)
+	})
+}
+
+func (s *sqliteStore) RecordStoredFileDownload(ctx context.Context, fileID primitive.ObjectID, client models.ClientInfo) error {
+	_, err := liteFiles.update(ctx, s.db, func(f *models.StoredFile) bool {
+		now := time.Now().UTC()
+		f.LastDownloadClient = &client
+		f.LastDownloadedAt = &now
+		return true
+	}, "id = ?", fileID.Hex())
+	return err
+}
+
+func (s *sqliteStore) ListFilesToScrub(ctx context.Context, limit int) ([]*models.StoredFile, error) {
+	// NULLs sort first, so files never scrubbed come before the rest
+	return liteFiles.find(ctx, s.db, "status = 'active' ORDER BY last_scrubbed_at LIMIT ?", limit)
+}
+
+func (s *sqliteStore) TrashStoredFile(ctx context.Context, userID, fileID primitive.ObjectID, at time.Time) (bool, error) {
+	f, err := liteFiles.update(ctx, s.db, func(f *models.StoredFile) bool {
+		f.Status = "trashed"
+		f.DeletedAt = &at
+		return true
+	}, "id = ? AND user_id = ? AND status IN ('active', 'incomplete')", fileID.Hex(), userID.Hex())
+	return f != nil, err
+}
+
+func (s *sqliteStore) RestoreStoredFile(ctx context.Context, userID, fileID primitive.ObjectID) (bool, error) {
+	f, err := liteFiles.update(ctx, s.db, func(f *models.StoredFile) bool {
+		f.Status = restoredStatus(f)
+		f.DeletedAt = nil
+		return true
+	}, "id = ? AND user_id = ? AND status = 'trashed'", fileID.Hex(), userID.Hex())
+	return f != nil, err
+}
+
+func (s *sqliteStore) ListPurgeableFiles(ctx context.Context, cutoff time.Time, limit int) ([]*models.StoredFile, error) {
+	deleted, err := liteFiles.find(ctx, s.db, "status IN ('trashed', 'deleted')")
+	if err != nil {
+		return nil, err
+	}
+	files := []*models.StoredFile{}
+	for _, f := range deleted {
+		if f.DeletedAt != nil && f.DeletedAt.Before(cutoff) {
+			files = append(files, f)
+		}
+	}
+	slices.SortFunc(files, func(a, b *models.StoredFile) int { return a.DeletedAt.Compare(*b.DeletedAt) })
+	if len(files) > limit {
+		files = files[:limit]
+	}
+	return files, nil
+}
+
+func (s *sqliteStore) PurgeStoredFile(ctx context.Context, fileID primitive.ObjectID) error {
+	_, err := liteFiles.delete(ctx, s.db, "id = ? AND status IN ('trashed', 'deleted')", fileID.Hex())
+	return err
+}
+
+func (s *sqliteStore) RecordChunkChecks(ctx context.Context, fileID primitive.ObjectID, checks []ChunkCheck, at time.Time) error {
+	_, err := liteFiles.update(ctx, s.db, func(f *models.StoredFile) bool {
+		f.LastScrubbedAt = &at
+		for _, check := range checks {
+			for i := range f.Chunks {
+				c := &f.Chunks[i]
+				if c.ChunkID != check.ChunkID || c.DriveFileID != check.DriveFileID {
+					continue
+				}
+				c.Health = check.Health
+				c.LastCheckedAt = &at
+				if check.Health == models.ChunkOK {
+					c.LastVerifiedAt = &at
+				}
+			}
+		}
+		return true
+	}, "id = ?", fileID.Hex())
+	return err
+}
+
+// Storage usage
+
+func (s *sqliteStore) GetUserStorageUsage(ctx context.Context, userID primitive.ObjectID) (StorageUsage, error) {
+	var usage StorageUsage
+	err := s.db.QueryRowContext(ctx, `SELECT COUNT(*), COALESCE(SUM(original_size), 0) FROM stored_files
+		WHERE user_id = ? AND status IN ('active', 'incomplete')`, userID.Hex()).Scan(&usage.StoredFiles, &usage.StoredBytes)
+	if err != nil {
+		return usage, err
+	}
+	err = s.db.QueryRowContext(ctx, `SELECT COALESCE(SUM(total_size), 0) FROM upload_sessions
+		WHERE user_id = ? AND status IN ('uploading', 'processing', 'paused')`, userID.Hex()).Scan(&usage.PendingBytes)
+	return usage, err
+}
+
+// Drive API usage
+
+func (s *sqliteStore) AddDriveAPIUsage(ctx context.Context, deltas []models.DriveAPIUsage) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, d := range deltas {
+		if _, err := tx.ExecContext(ctx, `INSERT INTO drive_api_usage (day, account_id, operation, count) VALUES (?, ?, ?, ?)
+			ON CONFLICT (day, account_id, operation) DO UPDATE SET count = count + excluded.count`,
+			d.Day, d.AccountID.Hex(), d.Operation, d.Count); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *sqliteStore) GetDriveAPIUsage(ctx context.Context, day string) ([]models.DriveAPIUsage, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT account_id, operation, count FROM drive_api_usage WHERE day = ?`, day)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	usage := []models.DriveAPIUsage{}
+	for rows.Next() {
+		u := models.DriveAPIUsage{Day: day}
+		var accountID string
+		if err := rows.Scan(&accountID, &u.Operation, &u.Count); err != nil {
+			return nil, err
+		}
+		if u.AccountID, err = primitive.ObjectIDFromHex(accountID); err != nil {
+			return nil, err
+		}
+		usage = append(usage, u)
+	}
+	return usage, rows.Err()
+}
+
+// Folders
+
+func (s *sqliteStore) CreateFolder(ctx context.Context, folder *models.Folder) (bool, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+	existing, err := liteFolders.get(ctx, tx, "user_id = ? AND path = ?", sqlID(folder.UserID), folder.Path)
+	if err != nil || existing != nil {
+		return false, err
+	}
+	if err := liteFolders.insert(ctx, tx, "INSERT", folder); err != nil {
+		return false, err
+	}
+	return true, tx.Commit()
+}
+
+func (s *sqliteStore) ListFolders(ctx context.Context, userID primitive.ObjectID) ([]*models.Folder, error) {
+	return liteFolders.find(ctx, s.db, "user_id = ? ORDER BY path", userID.Hex())
+}
+
+func (s *sqliteStore) ListFileFolders(ctx context.Context, userID primitive.ObjectID) ([]string, error) {
+	files, err := liteFiles.find(ctx, s.db, "user_id = ? AND status IN ('active', 'incomplete')", userID.Hex())
+	if err != nil {
+		return nil, err
+	}
+	seen := map[string]bool{}
+	folders := []string{}
+	for _, f := range files {
+		if f.Folder != "" && !seen[f.Folder] {
+			seen[f.Folder] = true
+			folders = append(folders, f.Folder)
+		}
+	}
+	return folders, nil
+}
+
+func (s *sqliteStore) MoveFolder(ctx context.Context, userID primitive.ObjectID, from, to string) (int64, error) {
+	n, err := liteFiles.updateAll(ctx, s.db, func(f *models.StoredFile) bool {
+		if !inFolderPath(f.Folder, from) {
+			return false
+		}
+		f.Folder = to + f.Folder[len(from):]
+		f.Path = models.FilePath(f.Folder, f.OriginalFilename)
+		return true
+	}, "user_id = ?", userID.Hex())
+	if err != nil {
+		return 0, err
+	}
+	_, err = liteFolders.updateAll(ctx, s.db, func(f *models.Folder) bool {
+		if !inFolderPath(f.Path, from) {
+			return false
+		}
+		f.Path = to + f.Path[len(from):]
+		return true
+	}, "user_id = ?", userID.Hex())
+	return n, err
+}
+
+func (s *sqliteStore) DeleteFolder(ctx context.Context, userID primitive.ObjectID, path string) (bool, error) {
+	// Paths below path sort between path+"/" and path+"0", "0" following "/"
+	n, err := liteFolders.delete(ctx, s.db, "user_id = ? AND (path = ? OR path > ? AND path < ?)", userID.Hex(), path, path+"/", path+"0")
+	return n > 0, err
+}
+
+// File shares
+
+func (s *sqliteStore) CreateFileShare(ctx context.Context, share *models.FileShare) (bool, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+	existing, err := liteShares.get(ctx, tx, "file_id = ? AND user_id = ?", sqlID(share.FileID), sqlID(share.UserID))
+	if err != nil || existing != nil {
+		return false, err
+	}
+	if err := liteShares.insert(ctx, tx, "INSERT", share); err != nil {
+		return false, err
+	}
+	return true, tx.Commit()
+}
+
+func (s *sqliteStore) GetFileShare(ctx context.Context, fileID, userID primitive.ObjectID) (*models.FileShare, error) {
+	return liteShares.get(ctx, s.db, "file_id = ? AND user_id = ?", fileID.Hex(), userID.Hex())
+}
+
+func (s *sqliteStore) ListFileShares(ctx context.Context, fileID primitive.ObjectID) ([]*models.FileShare, error) {
+	return liteShares.find(ctx, s.db, "file_id = ? ORDER BY created_at", fileID.Hex())
+}
+
+func (s *sqliteStore) ListUserShares(ctx context.Context, userID primitive.ObjectID) ([]*models.FileShare, error) {
+	return liteShares.find(ctx, s.db, "user_id = ? ORDER BY created_at DESC", userID.Hex())
+}
+
+func (s *sqliteStore) DeleteFileShare(ctx context.Context, ownerID, fileID, userID primitive.ObjectID) (bool, error) {
+	n, err := liteShares.delete(ctx, s.db, "owner_id = ? AND file_id = ? AND user_id = ?", ownerID.Hex(), fileID.Hex(), userID.Hex())
+	return n > 0, err
+}
+
+func (s *sqliteStore) DeleteFileShares(ctx context.Context, fileID primitive.ObjectID) error {
+	_, err := liteShares.delete(ctx, s.db, "file_id = ?", fileID.Hex())
+	return err
+}
+
+// Public links
+
+func (s *sqliteStore) CreatePublicLink(ctx context.Context, link *models.PublicLink) error {
+	return litePublicLinks.insert(ctx, s.db, "INSERT", link)
+}
+
+func (s *sqliteStore) GetPublicLink(ctx context.Context, tokenHash string) (*models.PublicLink, error) {
+	return litePublicLinks.get(ctx, s.db, "token_hash = ?", tokenHash)
+}
+
+func (s *sqliteStore) ListPublicLinks(ctx context.Context, userID, fileID primitive.ObjectID) ([]*models.PublicLink, error) {
+	if fileID.IsZero() {
+		return litePublicLinks.find(ctx, s.db, "user_id = ? ORDER BY created_at DESC, id DESC", userID.Hex())
+	}
+	return litePublicLinks.find(ctx, s.db, "user_id = ? AND file_id = ? ORDER BY created_at DESC, id DESC", userID.Hex(), fileID.Hex())
+}
+
+func (s *sqliteStore) UsePublicLink(ctx context.Context, linkID primitive.ObjectID, now time.Time) (bool, error) {
+	l, err := litePublicLinks.update(ctx, s.db, func(l *models.PublicLink) bool {
+		if !publicLinkUsable(l, now) {
+			return false
+		}
+		l.Downloads++
+		return true
+	}, "id = ?", linkID.Hex())
+	return l != nil, err
+}
+
+func (s *sqliteStore) DeletePublicLink(ctx context.Context, userID, linkID primitive.ObjectID) (bool, error) {
+	n, err := litePublicLinks.delete(ctx, s.db, "id = ? AND user_id = ?", linkID.Hex(), userID.Hex())
+	return n > 0, err
+}
+
+func (s *sqliteStore) DeleteFilePublicLinks(ctx context.Context, fileID primitive.ObjectID) error {
+	_, err := litePublicLinks.delete(ctx, s.db, "file_id = ?", fileID.Hex())
+	return err
+}
+
+// Invites
+
+func (s *sqliteStore) CreateInvite(ctx context.Context, inv *models.Invite) error {
+	return liteInvites.insert(ctx, s.db, "INSERT", inv)
+}
+
+func (s *sqliteStore) ListInvites(ctx context.Context) ([]*models.Invite, error) {
+	return liteInvites.find(ctx, s.db, "1 = 1 ORDER BY created_at DESC")
+}
+
+func (s *sqliteStore) DeleteInvite(ctx context.Context, inviteID primitive.ObjectID) (bool, error) {
+	n, err := liteInvites.delete(ctx, s.db, "id = ?", inviteID.Hex())
+	return n > 0, err
+}
+
+func (s *sqliteStore) RedeemInvite(ctx context.Context, codeHash, email string, now time.Time) (bool, error) {
+	inv, err := liteInvites.update(ctx, s.db, func(inv *models.Invite) bool {
+		if inv.UsedAt != nil || (inv.ExpiresAt != nil && !inv.ExpiresAt.After(now)) {
+			return false
+		}
+		inv.UsedBy = email
+		inv.UsedAt = &now
+		return true
+	}, "code_hash = ?", codeHash)
+	return inv != nil, err
+}
+
+func (s *sqliteStore) ReleaseInvite(ctx context.Context, codeHash string) error {
+	_, err := liteInvites.update(ctx, s.db, func(inv *models.Invite) bool {
+		inv.UsedBy = ""
+		inv.UsedAt = nil
+		return true
+	}, "code_hash = ?", codeHash)
+	return err
+}
+
+// Refresh tokens
+
+func (s *sqliteStore) CreateRefreshToken(ctx context.Context, t *models.RefreshToken) error {
+	return liteTokens.insert(ctx, s.db, "INSERT", t)
+}
+
+func (s *sqliteStore) GetRefreshToken(ctx context.Context, tokenHash string) (*models.RefreshToken, error) {
+	return liteTokens.get(ctx, s.db, "token_hash = ?", tokenHash)
+}
+
+func (s *sqliteStore) UseRefreshToken(ctx context.Context, tokenHash string, now time.Time) (*models.RefreshToken, error) {
+	return liteTokens.update(ctx, s.db, func(t *models.RefreshToken) bool {
+		if t.UsedAt != nil || t.RevokedAt != nil {
+			return false
+		}
+		t.UsedAt = &now
+		return true
+	}, "token_hash = ? AND expires_at > ?", tokenHash, now.UnixMilli())
+}
+
+// revokeRefreshTokens revokes the unrevoked tokens matching where
+func (s *sqliteStore) revokeRefreshTokens(ctx context.Context, now time.Time, where string, args ...interface{}) error {
+	_, err := liteTokens.updateAll(ctx, s.db, func(t *models.RefreshToken) bool {
+		if t.RevokedAt != nil {
+			return false
+		}
+		t.RevokedAt = &now
+		return true
+	}, where, args...)
+	return err
+}
+
+func (s *sqliteStore) RevokeRefreshTokenFamily(ctx context.Context, familyID primitive.ObjectID, now time.Time) error {
+	return s.revokeRefreshTokens(ctx, now, "family_id = ?", familyID.Hex())
+}
+
+func (s *sqliteStore) IsRefreshTokenFamilyRevoked(ctx context.Context, familyID primitive.ObjectID) (bool, error) {
+	tokens, err := liteTokens.find(ctx, s.db, "family_id = ?", familyID.Hex())
+	if err != nil {
+		return false, err
+	}
+	for _, t := range tokens {
+		if t.RevokedAt != nil {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (s *sqliteStore) RevokeUserRefreshTokens(ctx context.Context, userID primitive.ObjectID, now time.Time) error {
+	return s.revokeRefreshTokens(ctx, now, "user_id = ?", userID.Hex())
+}
+
+func (s *sqliteStore) ListActiveRefreshTokens(ctx context.Context, userID primitive.ObjectID, now time.Time) ([]*models.RefreshToken, error) {
+	tokens, err := liteTokens.find(ctx, s.db, "user_id = ? AND expires_at > ? ORDER BY login_at DESC", userID.Hex(), now.UnixMilli())
+	if err != nil {
+		return nil, err
+	}
+	active := []*models.RefreshToken{}
+	for _, t := range tokens {
+		if t.UsedAt == nil && t.RevokedAt == nil {
+			active = append(active, t)
+		}
+	}
+	return active, nil
+}
+
+// Audit log
+
+func (s *sqliteStore) InsertAuditEvent(ctx context.Context, e *models.AuditEvent) error {
+	return liteAudit.insert(ctx, s.db, "INSERT", e)
+}
+
+func (s *sqliteStore) ListAuditEvents(ctx context.Context, query AuditQuery) ([]*models.AuditEvent, error) {
+	where := []string{"1 = 1"}
+	var args []interface{}
+	if !query.UserID.IsZero() {
+		where, args = append(where, "user_id = ?"), append(args, query.UserID.Hex())
+	}
+	if query.Action != "" {
+		where, args = append(where, "action = ?"), append(args, query.Action)
+	}
+	if !query.Before.IsZero() {
+		where, args = append(where, "id < ?"), append(args, query.Before.Hex())
+	}
+	if !query.Since.IsZero() {
+		where, args = append(where, "created_at >= ?"), append(args, query.Since.UnixMilli())
+	}
+	if !query.Until.IsZero() {
+		where, args = append(where, "created_at < ?"), append(args, query.Until.UnixMilli())
+	}
+	return liteAudit.find(ctx, s.db, strings.Join(where, " AND ")+" ORDER BY id DESC LIMIT ?", append(args, query.Limit)...)
+}
+
+// Processing jobs
+
+func (s *sqliteStore) EnqueueJob(ctx context.Context, job *models.ProcessingJob) error {
+	return liteJobs.insert(ctx, s.db, "INSERT", job)
+}
+
+func (s *sqliteStore) ClaimJob(ctx context.Context, owner string, lease time.Duration, fastOnly bool) (*models.ProcessingJob, error) {
+	now := time.Now()
+	where := "(status = ? OR (status = ? AND lease_expires_at < ?))"
+	if fastOnly {
+		where += " AND fast_lane = 1"
+	}
+	return liteJobs.update(ctx, s.db, func(j *models.ProcessingJob) bool {
+		j.Status = models.JobRunning
+		j.LeaseOwner = owner
+		j.LeaseExpiresAt = now.Add(lease)
+		j.UpdatedAt = now
+		j.Attempts++
+		return true
+	}, where+" ORDER BY fast_lane DESC, created_at", models.JobQueued, models.JobRunning, now.UnixMilli())
+}
+
+// updateJob applies fn to a job held by owner. Returns false if the job or lease is gone.
+func (s *sqliteStore) updateJob(ctx context.Context, jobID primitive.ObjectID, owner string, running bool, fn func(j *models.ProcessingJob)) (bool, error) {
+	j, err := liteJobs.update(ctx, s.db, func(j *models.ProcessingJob) bool {
+		if running && j.Status != models.JobRunning {
+			return false
+		}
+		fn(j)
+		return true
+	}, "id = ? AND lease_owner = ?", jobID.Hex(), owner)
+	return j != nil, err
+}
+
+func (s *sqliteStore) RenewJobLease(ctx context.Context, jobID primitive.ObjectID, owner string, lease time.Duration) (bool, error) {
+	return s.updateJob(ctx, jobID, owner, true, renewJob(lease))
+}
+
+func (s *sqliteStore) FinishJob(ctx context.Context, jobID primitive.ObjectID, owner, status, errMsg string) error {
+	_, err := s.updateJob(ctx, jobID, owner, false, finishJob(status, errMsg))
+	return err
+}
+
+func (s *sqliteStore) GetSessionJob(ctx context.Context, sessionID primitive.ObjectID) (*models.ProcessingJob, error) {
+	return liteJobs.get(ctx, s.db, "session_id = ? ORDER BY created_at DESC", sessionID.Hex())
+}
+
+func (s *sqliteStore) CountQueuedJobs(ctx context.Context) (int64, error) {
+	return liteJobs.count(ctx, s.db, "status = ?", models.JobQueued)
+}
+
+// Reports
+
+func (s *sqliteStore) RunReport(ctx context.Context, q ReportQuery) ([]ReportRow, error) {
+	var docs []reportDoc
+	switch q.Source {
+	case ReportStoredFiles:
+		files, err := liteFiles.find(ctx, s.db, "1 = 1")
+		if err != nil {
+			return nil, err
+		}
+		for _, f := range files {
+			docs = append(docs, reportDoc{f.UserID, f.Status, f.CreatedAt, f.OriginalSize, f.Chunks})
+		}
+	case ReportSessions:
+		sessions, err := liteSessions.find(ctx, s.db, "1 = 1")
+		if err != nil {
+			return nil, err
+		}
+		for _, session := range sessions {
+			docs = append(docs, reportDoc{session.UserID, session.Status, session.CreatedAt, session.TotalSize, nil})
+		}
+	default:
+		return nil, fmt.Errorf("%w: unknown source %q", ErrInvalidReport, q.Source)
+	}
+	return buildReport(q, docs)
+}
+
+// Download links
+
+func (s *sqliteStore) UseDownloadLink(ctx context.Context, linkID string, expiresAt time.Time) (bool, error) {
+	res, err := s.db.ExecContext(ctx, `INSERT OR IGNORE INTO used_download_links (id, expires_at) VALUES (?, ?)`, linkID, expiresAt.UnixMilli())
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
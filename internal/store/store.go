@@ -1,10 +1,13 @@
 package store
 
 import (
+	"SE/internal/cache"
 	"SE/internal/models"
 	"context"
-	"errors"
+	"fmt"
+	"log"
 	"os"
+	"strings"
 	"time"
 
 	"go.mongodb.org/mongo-driver/bson"
@@ -18,9 +21,30 @@ var (
 	db          *mongo.Database
 	usersCol    *mongo.Collection
 	stateCol    *mongo.Collection
+
+	// mongoTransactions is set when the server is a replica set member or mongos, which
+	// multi-document transactions need
+	mongoTransactions bool
 )
 
 func InitStore(ctx context.Context) error {
+	switch driver := os.Getenv("STORE_DRIVER"); driver {
+	case "memory":
+		UseMemory()
+		return nil
+	case "sqlite":
+		s, err := openSQLite(ctx, SQLitePath())
+		if err != nil {
+			return err
+		}
+		backend = s
+		return nil
+	case "", "mongo":
+	default:
+		return fmt.Errorf("unknown STORE_DRIVER %q: must be mongo, memory or sqlite", driver)
+	}
+	backend = mongoStore{}
+
 	uri := os.Getenv("MONGO_URI")
 	clientOpts := options.Client().ApplyURI(uri)
 	c, err := mongo.Connect(ctx, clientOpts)
@@ -32,12 +56,50 @@ func InitStore(ctx context.Context) error {
 	}
 	mongoClient = c
 	db = c.Database("drive_backend")
+	var hello bson.M
+	if err := c.Database("admin").RunCommand(ctx, bson.D{{Key: "hello", Value: 1}}).Decode(&hello); err == nil {
+		_, replicaSet := hello["setName"]
+		mongoTransactions = replicaSet || hello["msg"] == "isdbgrid"
+	}
+	if !mongoTransactions {
+		log.Println("MongoDB is standalone: a processed file and its completed upload are written without a transaction")
+	}
 	usersCol = db.Collection("users")
 	stateCol = db.Collection("oauth_states")
 
 	// Initialize sessions collection
 	initSessionsCollection(ctx)
 
+	// Initialize stored files collection
+	initStoredFilesCollection(ctx)
+
+	// Initialize user-created folders
+	initFoldersCollection(ctx)
+
+	// Initialize files shared with other users
+	initSharesCollection(ctx)
+
+	// Initialize public links to stored files
+	initPublicLinksCollection(ctx)
+
+	// Initialize Drive API usage collection
+	initUsageCollection(ctx)
+
+	// Initialize processing job queue
+	initJobsCollection(ctx)
+
+	// Initialize signup invites
+	initInvitesCollection(ctx)
+
+	// Initialize used one-time download links
+	initUsedLinksCollection(ctx)
+
+	// Initialize rotating refresh tokens
+	initRefreshTokensCollection(ctx)
+
+	// Initialize the security audit log
+	initAuditCollection(ctx)
+
 	// Create TTL index for oauth states
 	_, err = stateCol.Indexes().CreateOne(ctx, mongo.IndexModel{
 		Keys:    bson.M{"created_at": 1},
@@ -55,7 +117,60 @@ func InitStore(ctx context.Context) error {
 	return err
 }
 
+// expectedIndexes lists the indexes InitStore creates, by collection
+var expectedIndexes = map[string][]string{
+	"users":           {"email_1"},
+	"oauth_states":    {"created_at_1"},
+	"upload_sessions": {"expires_at_1", "batch_id_1", "user_id_1_created_at_-1"},
+	"stored_files": {"user_id_1_created_at_-1", "status_1_last_scrubbed_at_1", "user_id_1_tags_1", "user_id_1_original_size_1", "user_id_1_name_lower_1",
+		"user_id_1_original_filename_text_description_text_tags_text", "status_1_deleted_at_1"},
+	"drive_api_usage":     {"day_1_account_id_1_operation_1"},
+	"processing_jobs":     {"status_1_lease_expires_at_1_created_at_1", "status_1_fast_lane_-1_created_at_1", "session_id_1"},
+	"invites":             {"code_hash_1"},
+	"used_download_links": {"expires_at_1"},
+	"refresh_tokens":      {"token_hash_1", "family_id_1", "user_id_1", "expires_at_1"},
+	"audit_log":           {"user_id_1__id_-1", "expires_at_1"},
+	"folders":             {"user_id_1_path_1"},
+	"file_shares":         {"file_id_1_user_id_1", "user_id_1_created_at_-1"},
+	"public_links":        {"token_hash_1", "user_id_1_created_at_-1", "file_id_1"},
+}
+
+// CheckStore connects to Mongo without modifying it and reports expected indexes that are missing
+func CheckStore(ctx context.Context) ([]string, error) {
+	c, err := mongo.Connect(ctx, options.Client().ApplyURI(os.Getenv("MONGO_URI")))
+	if err != nil {
+		return nil, err
+	}
+	defer c.Disconnect(ctx)
+
+	if err := c.Ping(ctx, nil); err != nil {
+		return nil, err
+	}
+
+	database := c.Database("drive_backend")
+	var missing []string
+	for col, names := range expectedIndexes {
+		specs, err := database.Collection(col).Indexes().ListSpecifications(ctx)
+		if err != nil {
+			return nil, err
+		}
+		present := make(map[string]bool, len(specs))
+		for _, spec := range specs {
+			present[spec.Name] = true
+		}
+		for _, name := range names {
+			if !present[name] {
+				missing = append(missing, col+"."+name)
+			}
+		}
+	}
+	return missing, nil
+}
+
 func DisconnectStore(ctx context.Context) error {
+	if s, ok := backend.(*sqliteStore); ok {
+		return s.close()
+	}
 	if mongoClient != nil {
 		return mongoClient.Disconnect(ctx)
 	}
@@ -63,75 +178,136 @@ func DisconnectStore(ctx context.Context) error {
 }
 
 func FindUserByEmail(ctx context.Context, email string) (*models.User, error) {
-	var u models.User
-	err := usersCol.FindOne(ctx, bson.M{"email": email}).Decode(&u)
-	if err != nil {
-		if errors.Is(err, mongo.ErrNoDocuments) {
-			return nil, nil
-		}
-		return nil, err
-	}
-	return &u, nil
+	return backend.FindUserByEmail(ctx, email)
+}
+
+func GetUserByID(ctx context.Context, userID primitive.ObjectID) (*models.User, error) {
+	return backend.GetUserByID(ctx, userID)
+}
+
+// ListUsers returns all users, newest first
+func ListUsers(ctx context.Context) ([]*models.User, error) {
+	return backend.ListUsers(ctx)
 }
 
 func CreateUser(ctx context.Context, u *models.User) error {
 	u.CreatedAt = time.Now().UTC()
 	u.ID = primitive.NewObjectID()
-	_, err := usersCol.InsertOne(ctx, u)
-	return err
+	return backend.CreateUser(ctx, u)
 }
 
 func InsertOAuthState(ctx context.Context, state *models.OAuthState) error {
 	state.CreatedAt = time.Now().UTC()
-	_, err := stateCol.InsertOne(ctx, state)
-	return err
+	return backend.InsertOAuthState(ctx, state)
 }
 
 func FindAndDeleteState(ctx context.Context, state string) (*models.OAuthState, error) {
-	var s models.OAuthState
-	err := stateCol.FindOneAndDelete(ctx, bson.M{"state": state}).Decode(&s)
-	if err != nil {
-		if errors.Is(err, mongo.ErrNoDocuments) {
-			return nil, nil
-		}
-		return nil, err
-	}
-	return &s, nil
+	return backend.FindAndDeleteState(ctx, state)
 }
 
 func AddDriveAccountToUser(ctx context.Context, userID primitive.ObjectID, acct models.DriveAccount) error {
 	acct.CreatedAt = time.Now().UTC()
 	acct.ID = primitive.NewObjectID()
-	_, err := usersCol.UpdateOne(ctx, bson.M{"_id": userID}, bson.M{"$push": bson.M{"drive_accounts": acct}})
-	return err
+	return backend.AddDriveAccountToUser(ctx, userID, acct)
 }
 
 func ListUserDriveAccounts(ctx context.Context, userID primitive.ObjectID) ([]models.DriveAccount, error) {
-	var u models.User
-	if err := usersCol.FindOne(ctx, bson.M{"_id": userID}).Decode(&u); err != nil {
-		if errors.Is(err, mongo.ErrNoDocuments) {
-			return []models.DriveAccount{}, nil
-		}
+	u, err := GetUserByID(ctx, userID)
+	if err != nil {
 		return nil, err
 	}
-	if u.DriveAccounts == nil {
+	if u == nil || u.DriveAccounts == nil {
 		return []models.DriveAccount{}, nil
 	}
 	return u.DriveAccounts, nil
 }
 
 func GetDriveAccountByID(ctx context.Context, accountID primitive.ObjectID) (*models.DriveAccount, error) {
-	var u models.User
-	err := usersCol.FindOne(ctx, bson.M{"drive_accounts._id": accountID}).Decode(&u)
+	return backend.GetDriveAccountByID(ctx, accountID)
+}
+
+// UpdateDriveAccountToken stores a refreshed OAuth token of a drive account
+func UpdateDriveAccountToken(ctx context.Context, accountID primitive.ObjectID, encryptedToken []byte, refreshedAt time.Time) error {
+	return backend.UpdateDriveAccountToken(ctx, accountID, encryptedToken, refreshedAt)
+}
+
+// UpdateDriveAccountLabel sets the label and/or color of one of the user's drive accounts.
+// nil arguments leave the field unchanged. Returns false if the account doesn't belong to the user.
+func UpdateDriveAccountLabel(ctx context.Context, userID, accountID primitive.ObjectID, label, color *string) (bool, error) {
+	return backend.UpdateDriveAccountLabel(ctx, userID, accountID, label, color)
+}
+
+// GetUserNotificationChannels returns the user's configured notification channels
+func GetUserNotificationChannels(ctx context.Context, userID primitive.ObjectID) ([]models.NotificationChannel, error) {
+	u, err := GetUserByID(ctx, userID)
 	if err != nil {
 		return nil, err
 	}
-	for _, acc := range u.DriveAccounts {
-		if acc.ID == accountID {
-			return &acc, nil
-		}
+	if u == nil || u.NotificationChannels == nil {
+		return []models.NotificationChannel{}, nil
 	}
-	return nil, errors.New("account not found")
+	return u.NotificationChannels, nil
+}
+
+// SetUserNotificationChannels replaces the user's notification channels
+func SetUserNotificationChannels(ctx context.Context, userID primitive.ObjectID, channels []models.NotificationChannel) error {
+	return backend.SetUserNotificationChannels(ctx, userID, channels)
+}
+
+// GetUserPlacementPolicy returns the user's chunk placement policy, the zero policy if none is set
+func GetUserPlacementPolicy(ctx context.Context, userID primitive.ObjectID) (models.PlacementPolicy, error) {
+	u, err := GetUserByID(ctx, userID)
+	if err != nil {
+		return models.PlacementPolicy{}, err
+	}
+	if u == nil || u.PlacementPolicy == nil {
+		return models.PlacementPolicy{}, nil
+	}
+	return *u.PlacementPolicy, nil
+}
+
+// SetUserPlacementPolicy replaces the user's chunk placement policy
+func SetUserPlacementPolicy(ctx context.Context, userID primitive.ObjectID, policy models.PlacementPolicy) error {
+	return backend.SetUserPlacementPolicy(ctx, userID, policy)
+}
+
+// GetUserPreferences returns the user's preferences, the zero value if none are set
+func GetUserPreferences(ctx context.Context, userID primitive.ObjectID) (models.UserPreferences, error) {
+	u, err := GetUserByID(ctx, userID)
+	if err != nil {
+		return models.UserPreferences{}, err
+	}
+	if u == nil || u.Preferences == nil {
+		return models.UserPreferences{}, nil
+	}
+	return *u.Preferences, nil
+}
+
+// SetUserPreferences replaces the user's preferences
+func SetUserPreferences(ctx context.Context, userID primitive.ObjectID, prefs models.UserPreferences) error {
+	return backend.SetUserPreferences(ctx, userID, prefs)
+}
+
+// SetUserStorageQuota overrides the user's storage quota in bytes; 0 restores the default, -1 is unlimited.
+// Returns false if there is no such user.
+func SetUserStorageQuota(ctx context.Context, userID primitive.ObjectID, quota int64) (bool, error) {
+	return backend.SetUserStorageQuota(ctx, userID, quota)
+}
+
+// SetUserPassword replaces the user's password hash and refuses access tokens issued before
+// tokensValidAfter
+func SetUserPassword(ctx context.Context, userID primitive.ObjectID, passHash []byte, tokensValidAfter time.Time) error {
+	return backend.SetUserPassword(ctx, userID, passHash, tokensValidAfter)
+}
+
+// SetUserRole sets the user's role. Returns false if there is no such user.
+func SetUserRole(ctx context.Context, userID primitive.ObjectID, role string) (bool, error) {
+	return backend.SetUserRole(ctx, userID, role)
+}
+
+// SetUserEmailVerified records that the user's email was verified
+func SetUserEmailVerified(ctx context.Context, userID primitive.ObjectID) error {
+	return backend.SetUserEmailVerified(ctx, userID)
 }
 
 // Upload Session Management
@@ -144,120 +320,208 @@ func initSessionsCollection(ctx context.Context) {
 		Keys:    bson.M{"expires_at": 1},
 		Options: options.Index().SetExpireAfterSeconds(0),
 	})
+	_, _ = sessionsCol.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.M{"batch_id": 1},
+		Options: options.Index().SetSparse(true),
+	})
+	// Listing a user's sessions, newest first
+	_, _ = sessionsCol.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{Key: "user_id", Value: 1}, {Key: "created_at", Value: -1}},
+	})
 }
 
 func CreateUploadSession(ctx context.Context, session *models.UploadSession) error {
-	if sessionsCol == nil {
-		return errors.New("sessions collection not initialized")
-	}
-	_, err := sessionsCol.InsertOne(ctx, session)
-	return err
+	return backend.CreateUploadSessions(ctx, []*models.UploadSession{session})
+}
+
+// CreateUploadSessions inserts the sessions of a batch together
+func CreateUploadSessions(ctx context.Context, sessions []*models.UploadSession) error {
+	return backend.CreateUploadSessions(ctx, sessions)
+}
+
+// GetBatchSessions returns the sessions of a batch in the order they were created
+func GetBatchSessions(ctx context.Context, batchID primitive.ObjectID) ([]*models.UploadSession, error) {
+	return backend.GetBatchSessions(ctx, batchID)
 }
 
 func GetUploadSession(ctx context.Context, sessionID primitive.ObjectID) (*models.UploadSession, error) {
-	if sessionsCol == nil {
-		return nil, errors.New("sessions collection not initialized")
-	}
-	var session models.UploadSession
-	err := sessionsCol.FindOne(ctx, bson.M{"_id": sessionID}).Decode(&session)
-	if err != nil {
-		if errors.Is(err, mongo.ErrNoDocuments) {
-			return nil, nil
-		}
-		return nil, err
-	}
-	return &session, nil
+	return backend.GetUploadSession(ctx, sessionID)
 }
 
-func UpdateSessionUploadProgress(ctx context.Context, sessionID primitive.ObjectID, uploadedSize int64) error {
-	if sessionsCol == nil {
-		return errors.New("sessions collection not initialized")
-	}
-	_, err := sessionsCol.UpdateOne(ctx,
-		bson.M{"_id": sessionID},
-		bson.M{"$set": bson.M{"uploaded_size": uploadedSize}},
-	)
-	return err
+// sessionCacheKey is where an uploading session is cached
+func sessionCacheKey(sessionID primitive.ObjectID) string {
+	return "upload_session:" + sessionID.Hex()
 }
 
-func UpdateSessionStatus(ctx context.Context, sessionID primitive.ObjectID, status string, progress float64, errorMsg string) error {
-	if sessionsCol == nil {
-		return errors.New("sessions collection not initialized")
+// GetCachedUploadSession returns a session from the cache when it's there, else from the store,
+// caching it while it's uploading. The cached copy is dropped when the session's status, expiry
+// or file changes, but not as chunks arrive, so its received ranges and uploaded size may be
+// behind: it suits callers that only check who owns a session and where its bytes go.
+func GetCachedUploadSession(ctx context.Context, sessionID primitive.ObjectID) (*models.UploadSession, error) {
+	key := sessionCacheKey(sessionID)
+	if b, ok := cache.Get(ctx, key); ok {
+		var session models.UploadSession
+		if err := bson.Unmarshal(b, &session); err == nil {
+			return &session, nil
+		}
 	}
-	update := bson.M{
-		"status":              status,
-		"processing_progress": progress,
+	session, err := backend.GetUploadSession(ctx, sessionID)
+	if err != nil || session == nil || session.Status != "uploading" {
+		return session, err
 	}
-	if errorMsg != "" {
-		update["error_message"] = errorMsg
+	if b, err := bson.Marshal(session); err == nil {
+		cache.Set(ctx, key, b, min(cache.SessionTTL(), time.Until(session.ExpiresAt)))
 	}
-	_, err := sessionsCol.UpdateOne(ctx,
-		bson.M{"_id": sessionID},
-		bson.M{"$set": update},
-	)
-	return err
+	return session, nil
+}
+
+// forgetSession drops the cached copy of a session whose status, expiry or file changed
+func forgetSession(ctx context.Context, sessionID primitive.ObjectID) {
+	cache.Delete(ctx, sessionCacheKey(sessionID))
 }
 
-func CompleteSession(ctx context.Context, sessionID primitive.ObjectID, completedAt *time.Time) error {
-	if sessionsCol == nil {
-		return errors.New("sessions collection not initialized")
+// AddSessionReceivedRange appends a received byte range and returns the updated session
+func AddSessionReceivedRange(ctx context.Context, sessionID primitive.ObjectID, r models.ByteRange) (*models.UploadSession, error) {
+	return backend.AddSessionReceivedRange(ctx, sessionID, r)
+}
+
+// CompactSessionRanges replaces the received ranges with their merged form, unless more
+// ranges were pushed since the session was read (seen is the count that was read).
+// Uploaded size only ever grows, so a stale count can't overwrite a newer one.
+func CompactSessionRanges(ctx context.Context, sessionID primitive.ObjectID, seen int, merged []models.ByteRange, uploadedSize int64) error {
+	return backend.CompactSessionRanges(ctx, sessionID, seen, merged, uploadedSize)
+}
+
+func UpdateSessionStatus(ctx context.Context, sessionID primitive.ObjectID, status string, progress float64, errorMsg string) error {
+	defer forgetSession(ctx, sessionID)
+	return backend.UpdateSessionStatus(ctx, sessionID, status, progress, errorMsg)
+}
+
+// CompleteSession records the stored file of a processed session and marks the session complete
+// with its file ID and key file, in one transaction so a crash can't leave one without the other.
+// With replace the file overwrites the incomplete file recorded for the session, else it's created.
+func CompleteSession(ctx context.Context, sessionID primitive.ObjectID, file *models.StoredFile, keyFilePath string, replace bool) error {
+	now := time.Now()
+	if file.CreatedAt.IsZero() || !replace {
+		file.CreatedAt = now.UTC()
 	}
-	_, err := sessionsCol.UpdateOne(ctx,
-		bson.M{"_id": sessionID},
-		bson.M{"$set": bson.M{
-			"status":       "complete",
-			"completed_at": completedAt,
-		}},
-	)
-	return err
+	if file.Status == "" {
+		file.Status = "active"
+	}
+	file.NameLower = strings.ToLower(file.OriginalFilename)
+	defer forgetSession(ctx, sessionID)
+	return backend.CompleteSession(ctx, sessionID, file, keyFilePath, replace, now)
 }
 
 func CountActiveUserSessions(ctx context.Context, userID primitive.ObjectID) (int, error) {
-	if sessionsCol == nil {
-		return 0, errors.New("sessions collection not initialized")
-	}
-	count, err := sessionsCol.CountDocuments(ctx, bson.M{
-		"user_id": userID,
-		"status":  bson.M{"$in": []string{"uploading", "processing"}},
-	})
-	return int(count), err
+	return backend.CountActiveUserSessions(ctx, userID)
 }
 
 func GetExpiredSessions(ctx context.Context) ([]*models.UploadSession, error) {
-	if sessionsCol == nil {
-		return nil, errors.New("sessions collection not initialized")
-	}
-	cursor, err := sessionsCol.Find(ctx, bson.M{
-		"expires_at": bson.M{"$lt": time.Now()},
-		"status":     bson.M{"$in": []string{"uploading", "processing"}},
-	})
-	if err != nil {
-		return nil, err
-	}
-	defer cursor.Close(ctx)
+	return backend.GetExpiredSessions(ctx)
+}
 
-	var sessions []*models.UploadSession
-	if err := cursor.All(ctx, &sessions); err != nil {
-		return nil, err
-	}
-	return sessions, nil
+// ListUserSessions returns the user's upload sessions, newest first, optionally only those with status
+func ListUserSessions(ctx context.Context, userID primitive.ObjectID, status string) ([]*models.UploadSession, error) {
+	return backend.ListUserSessions(ctx, userID, status)
+}
+
+// ListSessions returns up to limit upload sessions of all users, newest first, optionally only
+// those with the given status
+func ListSessions(ctx context.Context, status string, limit int) ([]*models.UploadSession, error) {
+	return backend.ListSessions(ctx, status, limit)
+}
+
+// DeleteIdleUploadSession deletes a session unless it is being processed. Returns false if
+// there is no such session or it is processing.
+func DeleteIdleUploadSession(ctx context.Context, sessionID primitive.ObjectID) (bool, error) {
+	defer forgetSession(ctx, sessionID)
+	return backend.DeleteIdleUploadSession(ctx, sessionID)
 }
 
 func DeleteUploadSession(ctx context.Context, sessionID primitive.ObjectID) error {
-	if sessionsCol == nil {
-		return errors.New("sessions collection not initialized")
-	}
-	_, err := sessionsCol.DeleteOne(ctx, bson.M{"_id": sessionID})
-	return err
+	defer forgetSession(ctx, sessionID)
+	return backend.DeleteUploadSession(ctx, sessionID)
+}
+
+// TouchUploadSession refreshes the processing heartbeat of a session
+func TouchUploadSession(ctx context.Context, sessionID primitive.ObjectID) error {
+	return backend.TouchUploadSession(ctx, sessionID)
+}
+
+// ExtendSessionExpiry moves an unexpired session's expiry out to until, never earlier than it
+// already is. Returns nil if the session doesn't exist, has expired or isn't in one of statuses.
+func ExtendSessionExpiry(ctx context.Context, sessionID primitive.ObjectID, until time.Time, statuses []string) (*models.UploadSession, error) {
+	defer forgetSession(ctx, sessionID)
+	return backend.ExtendSessionExpiry(ctx, sessionID, until, statuses)
+}
+
+// ExtendProcessingSessions moves the expiry of every processing session due before until out
+// to until, so the TTL index can't delete a session while its file is being processed
+func ExtendProcessingSessions(ctx context.Context, until time.Time) (int64, error) {
+	return backend.ExtendProcessingSessions(ctx, until)
+}
+
+// RequestSessionPause flags a processing session to pause. Returns false if it isn't processing.
+func RequestSessionPause(ctx context.Context, sessionID primitive.ObjectID) (bool, error) {
+	defer forgetSession(ctx, sessionID)
+	return backend.RequestSessionPause(ctx, sessionID)
 }
 
-func UpdateSessionKeyFile(ctx context.Context, sessionID primitive.ObjectID, keyFilePath string) error {
-	if sessionsCol == nil {
-		return errors.New("sessions collection not initialized")
+// PauseSession records that processing of a session stopped at a pause request
+func PauseSession(ctx context.Context, sessionID primitive.ObjectID, progress float64, message string) error {
+	defer forgetSession(ctx, sessionID)
+	return backend.PauseSession(ctx, sessionID, progress, message)
+}
+
+// ResumeSession moves a paused session back to processing. Returns false if it isn't paused.
+func ResumeSession(ctx context.Context, sessionID primitive.ObjectID) (bool, error) {
+	defer forgetSession(ctx, sessionID)
+	return backend.ResumeSession(ctx, sessionID)
+}
+
+// MarkSessionIncomplete records that processing stored only some chunks. The session and
+// its checkpoint are kept until expiresAt so the missing chunks can be repaired.
+func MarkSessionIncomplete(ctx context.Context, sessionID primitive.ObjectID, progress float64, message string, expiresAt time.Time) error {
+	defer forgetSession(ctx, sessionID)
+	return backend.MarkSessionIncomplete(ctx, sessionID, progress, message, expiresAt)
+}
+
+// RepairSession moves an incomplete session back to processing. Returns false if it isn't incomplete.
+func RepairSession(ctx context.Context, sessionID primitive.ObjectID) (bool, error) {
+	defer forgetSession(ctx, sessionID)
+	return backend.RepairSession(ctx, sessionID)
+}
+
+// GetStalledSessions returns processing sessions whose heartbeat is older than cutoff
+func GetStalledSessions(ctx context.Context, cutoff time.Time) ([]*models.UploadSession, error) {
+	return backend.GetStalledSessions(ctx, cutoff)
+}
+
+// CountStalledSessions counts processing sessions not updated since cutoff
+func CountStalledSessions(ctx context.Context, cutoff time.Time) (int64, error) {
+	return backend.CountStalledSessions(ctx, cutoff)
+}
+
+// SetSessionPlanPreview replaces the plan previewed for a session
+func SetSessionPlanPreview(ctx context.Context, sessionID primitive.ObjectID, preview *models.PlanPreview) error {
+	return backend.SetSessionPlanPreview(ctx, sessionID, preview)
+}
+
+// SetSessionCheckpoint starts a fresh processing checkpoint for a session
+func SetSessionCheckpoint(ctx context.Context, sessionID primitive.ObjectID, checkpoint *models.ProcessingCheckpoint) error {
+	if checkpoint.Chunks == nil {
+		checkpoint.Chunks = []models.ChunkMetadata{}
 	}
-	_, err := sessionsCol.UpdateOne(ctx,
-		bson.M{"_id": sessionID},
-		bson.M{"$set": bson.M{"key_file_path": keyFilePath}},
-	)
-	return err
+	return backend.SetSessionCheckpoint(ctx, sessionID, checkpoint)
+}
+
+// AddCheckpointChunk records a chunk that finished uploading
+func AddCheckpointChunk(ctx context.Context, sessionID primitive.ObjectID, chunk models.ChunkMetadata) error {
+	return backend.AddCheckpointChunk(ctx, sessionID, chunk)
+}
+
+// ClearSessionCheckpoint drops the processing checkpoint of a session
+func ClearSessionCheckpoint(ctx context.Context, sessionID primitive.ObjectID) error {
+	return backend.ClearSessionCheckpoint(ctx, sessionID)
 }
@@ -0,0 +1,385 @@
+package store
+
+import (
+	"SE/internal/models"
+	"bytes"
+	"cmp"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Stored File Management
+var storedFilesCol *mongo.Collection
+
+func initStoredFilesCollection(ctx context.Context) {
+	storedFilesCol = db.Collection("stored_files")
+	// Listing is always per user, newest first
+	_, _ = storedFilesCol.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{Key: "user_id", Value: 1}, {Key: "created_at", Value: -1}},
+	})
+	// The integrity scrubber picks the files it checked longest ago
+	_, _ = storedFilesCol.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{Key: "status", Value: 1}, {Key: "last_scrubbed_at", Value: 1}},
+	})
+	// Tag filters are per user
+	_, _ = storedFilesCol.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{Key: "user_id", Value: 1}, {Key: "tags", Value: 1}},
+	})
+	// Search by size and by filename prefix
+	_, _ = storedFilesCol.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{Key: "user_id", Value: 1}, {Key: "original_size", Value: 1}},
+	})
+	_, _ = storedFilesCol.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{Key: "user_id", Value: 1}, {Key: "name_lower", Value: 1}},
+	})
+	// Word search in names, descriptions and tags
+	_, _ = storedFilesCol.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{Key: "user_id", Value: 1}, {Key: "original_filename", Value: "text"}, {Key: "description", Value: "text"}, {Key: "tags", Value: "text"}},
+	})
+	// The purge picks the files deleted longest ago
+	_, _ = storedFilesCol.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{Key: "status", Value: 1}, {Key: "deleted_at", Value: 1}},
+	})
+}
+
+func CreateStoredFile(ctx context.Context, file *models.StoredFile) error {
+	if file.ID.IsZero() {
+		file.ID = primitive.NewObjectID()
+	}
+	file.CreatedAt = time.Now().UTC()
+	if file.Status == "" {
+		file.Status = "active"
+	}
+	file.NameLower = strings.ToLower(file.OriginalFilename)
+	return backend.CreateStoredFile(ctx, file)
+}
+
+// ReplaceStoredFile writes file over the stored file with the same ID, creating it if missing.
+// Used when a repair completes a file that was recorded as incomplete.
+func ReplaceStoredFile(ctx context.Context, file *models.StoredFile) error {
+	if file.CreatedAt.IsZero() {
+		file.CreatedAt = time.Now().UTC()
+	}
+	if file.Status == "" {
+		file.Status = "active"
+	}
+	file.NameLower = strings.ToLower(file.OriginalFilename)
+	return backend.ReplaceStoredFile(ctx, file)
+}
+
+func GetStoredFile(ctx context.Context, fileID primitive.ObjectID) (*models.StoredFile, error) {
+	return backend.GetStoredFile(ctx, fileID)
+}
+
+// Orders a file listing can be sorted in
+const (
+	SortByCreated = "created"
+	SortByName    = "name"
+	SortBySize    = "size"
+)
+
+// StoredFileQuery narrows, orders and pages a file listing; zero fields don't filter
+type StoredFileQuery struct {
+	Search     string               // case-insensitive substring of the filename, description or a metadata value
+	Name       string               // case-insensitive substring of the filename
+	NamePrefix string               // case-insensitive start of the filename
+	Text       string               // any of these words in the filename, description or tags
+	MinSize    int64                // at least this many bytes, 0 for no bound
+	MaxSize    int64                // at most this many bytes, 0 for no bound
+	Metadata   map[string]string    // exact metadata key/value matches
+	Tags       []string             // only files with all of these tags
+	Folder     string               // only files in this folder or below it, "" for all
+	Shallow    bool                 // only files directly in Folder, not in its subfolders
+	Status     string               // "active", "incomplete" or "trashed", "" for active and incomplete
+	Drives     []primitive.ObjectID // only files with a chunk on one of these drives, nil for any
+	Since      time.Time            // created at or after
+	Until      time.Time            // created before
+	Sort       string               // SortByCreated (the default), SortByName or SortBySize
+	Asc        bool                 // smallest first; ties are broken by ID in the same direction
+	Limit      int                  // at most this many files, 0 for all
+	After      *FileCursor          // continue after the file a previous page ended with
+}
+
+// FileCursor is where a page of a file listing ended: the sort keys and ID of its last file
+type FileCursor struct {
+	Name      string             `json:"n"`
+	Size      int64              `json:"s"`
+	CreatedAt time.Time          `json:"c"`
+	ID        primitive.ObjectID `json:"i"`
+}
+
+// CursorAfter is the cursor of the page that follows f
+func CursorAfter(f *models.StoredFile) *FileCursor {
+	return &FileCursor{Name: f.OriginalFilename, Size: f.OriginalSize, CreatedAt: f.CreatedAt, ID: f.ID}
+}
+
+// String encodes the cursor for a URL
+func (c *FileCursor) String() string {
+	b, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// ParseFileCursor decodes a cursor made by String
+func ParseFileCursor(s string) (*FileCursor, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, errors.New("invalid cursor")
+	}
+	var c FileCursor
+	if err := json.Unmarshal(b, &c); err != nil || c.ID.IsZero() {
+		return nil, errors.New("invalid cursor")
+	}
+	return &c, nil
+}
+
+// compare orders f against c by the query's sort, largest first unless Asc
+func (q StoredFileQuery) compare(f *models.StoredFile, c *FileCursor) int {
+	var n int
+	switch q.Sort {
+	case SortByName:
+		n = strings.Compare(f.OriginalFilename, c.Name)
+	case SortBySize:
+		n = cmp.Compare(f.OriginalSize, c.Size)
+	default:
+		n = f.CreatedAt.Compare(c.CreatedAt)
+	}
+	if n == 0 {
+		n = bytes.Compare(f.ID[:], c.ID[:])
+	}
+	if !q.Asc {
+		n = -n
+	}
+	return n
+}
+
+// page sorts the files the query matched and cuts out the requested page, for the stores that
+// filter in Go
+func (q StoredFileQuery) page(files []*models.StoredFile) []*models.StoredFile {
+	sort.Slice(files, func(i, j int) bool { return q.compare(files[i], CursorAfter(files[j])) < 0 })
+	if q.After != nil {
+		start := sort.Search(len(files), func(i int) bool { return q.compare(files[i], q.After) > 0 })
+		files = files[start:]
+	}
+	if q.Limit > 0 && len(files) > q.Limit {
+		files = files[:q.Limit]
+	}
+	return files
+}
+
+// statuses are the statuses of the files the query lists
+func (q StoredFileQuery) statuses() []string {
+	if q.Status != "" {
+		return []string{q.Status}
+	}
+	return []string{"active", "incomplete"}
+}
+
+// matches tells whether f is selected by the query, for the stores that filter in Go
+func (q StoredFileQuery) matches(f *models.StoredFile) bool {
+	if !slices.Contains(q.statuses(), f.Status) {
+		return false
+	}
+	if !q.Since.IsZero() && f.CreatedAt.Before(q.Since) || !q.Until.IsZero() && !f.CreatedAt.Before(q.Until) {
+		return false
+	}
+	if q.Drives != nil && !slices.ContainsFunc(f.Chunks, func(c models.StoredChunk) bool { return slices.Contains(q.Drives, c.DriveAccountID) }) {
+		return false
+	}
+	name := strings.ToLower(f.OriginalFilename)
+	if q.Name != "" && !strings.Contains(name, strings.ToLower(q.Name)) || q.NamePrefix != "" && !strings.HasPrefix(name, strings.ToLower(q.NamePrefix)) {
+		return false
+	}
+	if q.MinSize > 0 && f.OriginalSize < q.MinSize || q.MaxSize > 0 && f.OriginalSize > q.MaxSize {
+		return false
+	}
+	if q.Text != "" && !matchesWords(q.Text, f) {
+		return false
+	}
+	for _, tag := range q.Tags {
+		if !slices.Contains(f.Tags, tag) {
+			return false
+		}
+	}
+	for k, v := range q.Metadata {
+		if got, ok := f.Metadata[k]; !ok || got != v {
+			return false
+		}
+	}
+	if q.Shallow && f.Folder != q.Folder || q.Folder != "" && !inFolderPath(f.Folder, q.Folder) {
+		return false
+	}
+	if q.Search == "" {
+		return true
+	}
+	search := strings.ToLower(q.Search)
+	contains := func(s string) bool { return strings.Contains(strings.ToLower(s), search) }
+	if contains(f.OriginalFilename) || contains(f.Description) {
+		return true
+	}
+	for _, v := range f.Metadata {
+		if contains(v) {
+			return true
+		}
+	}
+	return false
+}
+
+// textWords splits s into lowercase words
+func textWords(s string) []string {
+	return strings.FieldsFunc(strings.ToLower(s), func(r rune) bool { return !unicode.IsLetter(r) && !unicode.IsDigit(r) })
+}
+
+// matchesWords tells whether f has any of the words of text in its filename, description or
+// tags, like Mongo's text search without its stemming
+func matchesWords(text string, f *models.StoredFile) bool {
+	words := textWords(f.OriginalFilename + " " + f.Description + " " + strings.Join(f.Tags, " "))
+	for _, w := range textWords(text) {
+		if slices.Contains(words, w) {
+			return true
+		}
+	}
+	return false
+}
+
+// ListUserStoredFiles returns a page of the user's files matching query, active and incomplete
+// ones unless it asks for another status, newest first unless it sorts otherwise
+func ListUserStoredFiles(ctx context.Context, userID primitive.ObjectID, query StoredFileQuery) ([]*models.StoredFile, error) {
+	return backend.ListUserStoredFiles(ctx, userID, query)
+}
+
+// SetStoredFileNotes updates the description and/or replaces the metadata of a file owned by
+// userID; nil leaves a field unchanged. Returns false if no such file.
+func SetStoredFileNotes(ctx context.Context, userID, fileID primitive.ObjectID, description *string, metadata map[string]string) (bool, error) {
+	return backend.SetStoredFileNotes(ctx, userID, fileID, description, metadata)
+}
+
+// SetStoredFilePinned pins or unpins a file owned by userID. Returns false if no such file.
+func SetStoredFilePinned(ctx context.Context, userID, fileID primitive.ObjectID, pinned bool) (bool, error) {
+	return backend.SetStoredFilePinned(ctx, userID, fileID, pinned)
+}
+
+// AddStoredFileTags tags an active file owned by userID and returns its tags. Returns false if
+// no such file.
+func AddStoredFileTags(ctx context.Context, userID, fileID primitive.ObjectID, tags []string) ([]string, bool, error) {
+	return backend.AddStoredFileTags(ctx, userID, fileID, tags)
+}
+
+// RemoveStoredFileTags untags an active file owned by userID and returns the tags it has left.
+// Returns false if no such file.
+func RemoveStoredFileTags(ctx context.Context, userID, fileID primitive.ObjectID, tags []string) ([]string, bool, error) {
+	return backend.RemoveStoredFileTags(ctx, userID, fileID, tags)
+}
+
+// RenameStoredFile renames a file owned by userID, keeping it in its folder. Returns false if
+// no such file.
+func RenameStoredFile(ctx context.Context, userID, fileID primitive.ObjectID, filename string) (bool, error) {
+	return backend.RenameStoredFile(ctx, userID, fileID, filename)
+}
+
+// MoveStoredFile moves an active file owned by userID into folder, "" for the root. Returns
+// false if no such file.
+func MoveStoredFile(ctx context.Context, userID, fileID primitive.ObjectID, folder string) (bool, error) {
+	return backend.MoveStoredFile(ctx, userID, fileID, folder)
+}
+
+// RecordStoredFileDownload notes when and by which client a file was last downloaded
+func RecordStoredFileDownload(ctx context.Context, fileID primitive.ObjectID, client models.ClientInfo) error {
+	return backend.RecordStoredFileDownload(ctx, fileID, client)
+}
+
+// ListFilesToScrub returns up to limit active files, those never scrubbed first and then
+// those scrubbed longest ago
+func ListFilesToScrub(ctx context.Context, limit int) ([]*models.StoredFile, error) {
+	return backend.ListFilesToScrub(ctx, limit)
+}
+
+// TrashStoredFile moves an active or incomplete file owned by userID to the trash. Its chunks
+// stay on the drives, so it can be restored, until PurgeStoredFile removes it. Returns false if
+// no such file.
+func TrashStoredFile(ctx context.Context, userID, fileID primitive.ObjectID) (bool, error) {
+	return backend.TrashStoredFile(ctx, userID, fileID, time.Now().UTC())
+}
+
+// RestoreStoredFile takes a file owned by userID out of the trash. Returns false if no such
+// file is in the trash.
+func RestoreStoredFile(ctx context.Context, userID, fileID primitive.ObjectID) (bool, error) {
+	return backend.RestoreStoredFile(ctx, userID, fileID)
+}
+
+// ListPurgeableFiles returns up to limit files moved to the trash before cutoff, longest
+// trashed first. Files deleted before there was a trash are among them.
+func ListPurgeableFiles(ctx context.Context, cutoff time.Time, limit int) ([]*models.StoredFile, error) {
+	return backend.ListPurgeableFiles(ctx, cutoff, limit)
+}
+
+// PurgeStoredFile removes the record of a trashed or deleted file for good; other files are
+// left alone
+func PurgeStoredFile(ctx context.Context, fileID primitive.ObjectID) error {
+	return backend.PurgeStoredFile(ctx, fileID)
+}
+
+// ChunkCheck is what the integrity scrubber found for one chunk
+type ChunkCheck struct {
+	ChunkID     int
+	DriveFileID string // where the chunk was read from
+	Health      string // models.ChunkOK, ChunkCorrupt or ChunkMissing
+}
+
+// RecordChunkChecks saves the outcome of scrubbing some chunks of a file. A check is dropped
+// if its chunk has moved to another drive file since.
+func RecordChunkChecks(ctx context.Context, fileID primitive.ObjectID, checks []ChunkCheck, at time.Time) error {
+	return backend.RecordChunkChecks(ctx, fileID, checks, at)
+}
+
+// restoredStatus is the status a file gets back when it leaves the trash
+func restoredStatus(f *models.StoredFile) string {
+	if len(f.MissingChunks) > 0 {
+		return "incomplete"
+	}
+	return "active"
+}
+
+// purgeableStatuses are the statuses of files PurgeStoredFile removes
+var purgeableStatuses = []string{"trashed", "deleted"}
+
+// addTags appends the tags not in have, for the stores that update files in Go
+func addTags(have, tags []string) []string {
+	for _, tag := range tags {
+		if !slices.Contains(have, tag) {
+			have = append(have, tag)
+		}
+	}
+	return have
+}
+
+// removeTags drops tags from have, for the stores that update files in Go
+func removeTags(have, tags []string) []string {
+	return slices.DeleteFunc(have, func(tag string) bool { return slices.Contains(tags, tag) })
+}
+
+// completeSession marks s complete with its file, for the stores that update sessions in Go
+func completeSession(s *models.UploadSession, fileID primitive.ObjectID, keyFilePath string, completedAt time.Time) {
+	s.Status = "complete"
+	s.ProcessingProgress = 100
+	s.UpdatedAt = completedAt
+	s.CompletedAt = &completedAt
+	s.FileID = fileID
+	s.KeyFilePath = models.Secret(keyFilePath)
+	s.Checkpoint = nil
+}
+
+func UpdateSessionFileID(ctx context.Context, sessionID, fileID primitive.ObjectID) error {
+	defer forgetSession(ctx, sessionID)
+	return backend.UpdateSessionFileID(ctx, sessionID, fileID)
+}
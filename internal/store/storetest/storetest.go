@@ -0,0 +1,180 @@
+// Package storetest runs unit tests against the in-memory and SQLite stores, with local drives
+// in place of Google Drive, and has fixtures for the users, drives, upload sessions and
+// authenticated requests that handler and pipeline tests need:
+//
+//	func TestMain(m *testing.M) {
+//		os.Exit(storetest.Run(m))
+//	}
+//
+//	func TestSomething(t *testing.T) {
+//		storetest.Setup(t)
+//		fileprocessor.InitFileConfig()
+//		user := storetest.User(t)
+//		storetest.LocalDrives(t, user.ID, 2)
+//		...
+//	}
+package storetest
+
+import (
+	"SE/internal/audit"
+	"SE/internal/drivemanager"
+	"SE/internal/jobs"
+	"SE/internal/models"
+	"SE/internal/notify"
+	"SE/internal/store"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Password is the password of every user User creates
+const Password = "storetest-pass-1"
+
+// userSeq keeps the emails of users created by one test binary apart
+var userSeq atomic.Int64
+
+// Backends are the STORE_DRIVERs Run runs the tests against
+var Backends = []string{"memory", "sqlite"}
+
+// backend is the STORE_DRIVER of the tests running now
+var backend = "memory"
+
+// Run runs the tests of a package once against each of Backends, for its TestMain, and
+// returns the exit code. STORETEST_BACKEND=memory or sqlite runs them against that one only.
+func Run(m *testing.M) int {
+	backends := Backends
+	if only := os.Getenv("STORETEST_BACKEND"); only != "" {
+		backends = []string{only}
+	}
+	for _, b := range backends {
+		backend = b
+		fmt.Printf("storetest: %s store\n", b)
+		if code := m.Run(); code != 0 {
+			return code
+		}
+	}
+	return 0
+}
+
+// Setup gives the test a new, empty store of the backend Run is at, in-memory without Run,
+// and directories of its own for uploads, downloads, the restore cache, exports and local
+// drives. It sets the env those are read from and runs the Init functions of the packages
+// below fileprocessor; a test of fileprocessor or anything above it calls
+// fileprocessor.InitFileConfig after Setup. Tests that use Setup can't run in parallel, since
+// the store and the config are package state. Background processing the test started is
+// stopped and waited for when it ends, before its store is closed and the next test's
+// replaces it.
+func Setup(t testing.TB) {
+	t.Helper()
+	dir := t.TempDir()
+	for k, v := range map[string]string{
+		"STORE_DRIVER":      backend,
+		"SQLITE_PATH":       filepath.Join(dir, "store.db"),
+		"LOCAL_DRIVES":      "true",
+		"LOCAL_DRIVE_DIR":   filepath.Join(dir, "drives"),
+		"UPLOAD_TEMP_DIR":   filepath.Join(dir, "uploads"),
+		"DOWNLOAD_TEMP_DIR": filepath.Join(dir, "downloads"),
+		"RESTORE_CACHE_DIR": filepath.Join(dir, "cache"),
+		"EXPORT_DIR":        filepath.Join(dir, "exports"),
+	} {
+		t.Setenv(k, v)
+	}
+	if err := store.InitStore(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.DisconnectStore(context.Background()) })
+	drivemanager.InitDriveConfig()
+	notify.InitNotifyConfig()
+	audit.InitAuditConfig()
+	jobs.InitJobConfig()
+	t.Cleanup(jobs.Shutdown)
+}
+
+// User creates a user whose password is Password
+func User(t testing.TB) *models.User {
+	t.Helper()
+	hash, err := bcrypt.GenerateFromPassword([]byte(Password), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := userSeq.Add(1)
+	u := &models.User{
+		Email:         fmt.Sprintf("user%d@example.com", n),
+		PasswordsHash: hash,
+	}
+	if err := store.CreateUser(context.Background(), u); err != nil {
+		t.Fatal(err)
+	}
+	return u
+}
+
+// LocalDrives links n local drives to the user and returns all of the user's drives
+func LocalDrives(t testing.TB, userID primitive.ObjectID, n int) []models.DriveAccount {
+	t.Helper()
+	ctx := context.Background()
+	for i := 0; i < n; i++ {
+		acct := models.DriveAccount{
+			Provider:    "local",
+			AccountType: models.DriveAccountTypeLocal,
+			DisplayName: fmt.Sprintf("Local drive %d", i+1),
+		}
+		if err := store.AddDriveAccountToUser(ctx, userID, acct); err != nil {
+			t.Fatal(err)
+		}
+	}
+	accounts, err := store.ListUserDriveAccounts(ctx, userID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return accounts
+}
+
+// Session creates an upload session of the user that has received all of data, ready to
+// finalize or process
+func Session(t testing.TB, userID primitive.ObjectID, filename string, data []byte) *models.UploadSession {
+	t.Helper()
+	now := time.Now()
+	session := &models.UploadSession{
+		ID:               primitive.NewObjectID(),
+		UserID:           userID,
+		OriginalFilename: filename,
+		TotalSize:        int64(len(data)),
+		UploadedSize:     int64(len(data)),
+		Status:           "uploading",
+		CreatedAt:        now,
+		UpdatedAt:        now,
+		ExpiresAt:        now.Add(time.Hour),
+	}
+	if len(data) > 0 {
+		session.ReceivedRanges = []models.ByteRange{{Start: 0, End: int64(len(data))}}
+	}
+	session.TempFilePath = filepath.Join(t.TempDir(), session.ID.Hex()+"_"+filename)
+	if err := os.WriteFile(session.TempFilePath, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.CreateUploadSession(context.Background(), session); err != nil {
+		t.Fatal(err)
+	}
+	return session
+}
+
+// Request builds a request as the user, the way AuthMiddleware passes it on to a handler
+func Request(method, target string, body io.Reader, userID primitive.ObjectID) *http.Request {
+	r := httptest.NewRequest(method, target, body)
+	if body != nil {
+		r.Header.Set("Content-Type", "application/json")
+	}
+	ctx := context.WithValue(r.Context(), "userID", userID)
+	ctx = context.WithValue(ctx, "sessionID", primitive.NewObjectID().Hex())
+	return r.WithContext(ctx)
+}
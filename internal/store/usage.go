@@ -0,0 +1,32 @@
+package store
+
+import (
+	"SE/internal/models"
+	"context"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Drive API Usage
+var usageCol *mongo.Collection
+
+func initUsageCollection(ctx context.Context) {
+	usageCol = db.Collection("drive_api_usage")
+	// One document per day, account and operation
+	_, _ = usageCol.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "day", Value: 1}, {Key: "account_id", Value: 1}, {Key: "operation", Value: 1}},
+		Options: options.Index().SetUnique(true),
+	})
+}
+
+// AddDriveAPIUsage adds the given counts to the stored daily totals
+func AddDriveAPIUsage(ctx context.Context, deltas []models.DriveAPIUsage) error {
+	return backend.AddDriveAPIUsage(ctx, deltas)
+}
+
+// GetDriveAPIUsage returns all usage counters recorded for a day
+func GetDriveAPIUsage(ctx context.Context, day string) ([]models.DriveAPIUsage, error) {
+	return backend.GetDriveAPIUsage(ctx, day)
+}
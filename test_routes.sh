@@ -226,9 +226,9 @@ if [ "$HTTP_CODE" -eq 200 ] && [[ "$BODY" == *"auth_url"* ]]; then
     print_test 0 "Drive link generation successful"
     
     # Extract and display OAuth URL
-    AUTH_URL=$(echo "$BODY" | grep -o '"auth_url":"[^"]*"' | cut -d'"' -f4)
+    AUTH_URL=$(echo "$BODY" | grep -o '"start_url":"[^"]*"' | cut -d'"' -f4)
     echo ""
-    echo -e "${YELLOW}OAuth URL:${NC}"
+    echo -e "${YELLOW}OAuth start URL:${NC}"
     echo "$AUTH_URL"
     echo ""
     echo -e "${YELLOW}Note:${NC} Open this URL in a browser to complete OAuth flow"
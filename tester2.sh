@@ -97,7 +97,8 @@ for ((i=1; i<=NUM_ACCOUNTS; i++)); do
     OAUTH_RESPONSE=$(curl -s -X GET "$BASE_URL/api/drive/link" \
         -H "Authorization: Bearer $TOKEN")
 
-    AUTH_URL=$(echo "$OAUTH_RESPONSE" | grep -o '"auth_url":"[^"]*"' | cut -d'"' -f4)
+    # start_url sets the nonce cookie in the browser that opens it, then goes on to Google
+    AUTH_URL=$(echo "$OAUTH_RESPONSE" | grep -o '"start_url":"[^"]*"' | cut -d'"' -f4)
 
     if [ -z "$AUTH_URL" ]; then
         print_error "Failed to get OAuth URL: $OAUTH_RESPONSE"